@@ -17,6 +17,10 @@ const (
 	ExpiryFactor   = 60 * 60 * 24 * 7
 	metadataLength = 1 + 3 + 2 + 2 + 16
 
+	// Bit of the version field of the metadata attribute marking test credentials. It is not part
+	// of the metadata version, which does not come near using it.
+	metadataTestFlag = 0x80
+
 	// Alphabet for base-62 encoding
 	alph = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 )
@@ -261,7 +265,18 @@ func (attr *MetadataAttribute) PublicKey() (*gabikeys.PublicKey, error) {
 
 // Version returns the metadata version of this instance
 func (attr *MetadataAttribute) Version() byte {
-	return attr.field(versionField)[0]
+	return attr.field(versionField)[0] &^ metadataTestFlag
+}
+
+// IsTestCredential returns whether this instance is marked as belonging to a test credential, i.e.
+// a credential issued by a server not in production mode or of a demo scheme (see
+// CredentialRequest.TestCredential), which production verifiers should not accept.
+func (attr *MetadataAttribute) IsTestCredential() bool {
+	return attr.field(versionField)[0]&metadataTestFlag != 0
+}
+
+func (attr *MetadataAttribute) setTestCredential() {
+	attr.setField(versionField, []byte{attr.field(versionField)[0] | metadataTestFlag})
 }
 
 // SigningDate returns the time at which this instance was signed
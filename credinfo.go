@@ -17,6 +17,7 @@ type CredentialInfo struct {
 	Hash                string                                       // SHA256 hash over the attributes
 	Revoked             bool                                         // If the credential has been revoked
 	RevocationSupported bool                                         // If the credential supports creating nonrevocation proofs
+	TestCredential      bool                                         // If the credential is marked as test credential, see MetadataAttribute.IsTestCredential
 }
 
 // A CredentialInfoList is a list of credentials (implements sort.Interface).
@@ -39,6 +40,7 @@ func (attrs *AttributeList) CredentialInfo() *CredentialInfo {
 		Hash:                attrs.Hash(),
 		Revoked:             attrs.Revoked,
 		RevocationSupported: attrs.RevocationSupported,
+		TestCredential:      attrs.IsTestCredential(),
 	}
 }
 
@@ -27,10 +27,12 @@ type SchemeManager struct {
 	KeyshareServer    string
 	KeyshareWebsite   string
 	KeyshareAttribute string
-	TimestampServer   string
-	Languages         []string `xml:"Languages>Language"`
-	XMLVersion        int      `xml:"version,attr"`
-	XMLName           xml.Name `xml:"SchemeManager"`
+	// Requirements for enrolling at the keyshare server; may be nil
+	KeyshareRegistration *KeyshareRegistrationPolicy `xml:"KeyshareRegistration"`
+	TimestampServer      string
+	Languages            []string `xml:"Languages>Language"`
+	XMLVersion           int      `xml:"version,attr"`
+	XMLName              xml.Name `xml:"SchemeManager"`
 
 	Status    SchemeManagerStatus `xml:"-"`
 	Timestamp Timestamp
@@ -44,6 +46,91 @@ type SchemeAppVersion struct {
 	IOS     int `xml:"iOS"`
 }
 
+// KeyshareRegistrationPolicy describes the requirements that enrollments at the keyshare server
+// of a scheme must satisfy.
+type KeyshareRegistrationPolicy struct {
+	Email            KeyshareEmailPolicy `xml:"Email"`
+	MinimumPinLength int                 `xml:"MinimumPinLength"`
+	TermsURL         string              `xml:"TermsUrl"`
+	TermsVersion     string              `xml:"TermsVersion"`
+}
+
+// KeyshareEmailPolicy specifies whether an email address must be provided during keyshare enrollment.
+type KeyshareEmailPolicy string
+
+const (
+	KeyshareEmailOptional  = KeyshareEmailPolicy("optional") // default
+	KeyshareEmailRequired  = KeyshareEmailPolicy("required")
+	KeyshareEmailForbidden = KeyshareEmailPolicy("forbidden")
+)
+
+// MinimumKeysharePinLength is the minimum PIN length for keyshare enrollment, regardless of the
+// policy of the scheme.
+const MinimumKeysharePinLength = 5
+
+// ValidateEnrollment checks that the email address and accepted terms version of an enrollment
+// satisfy the policy. A nil policy allows everything.
+func (policy *KeyshareRegistrationPolicy) ValidateEnrollment(email *string, acceptedTermsVersion string) error {
+	if policy == nil {
+		return nil
+	}
+	if err := policy.ValidateEmail(email); err != nil {
+		return err
+	}
+	if policy.TermsVersion != "" && acceptedTermsVersion != policy.TermsVersion {
+		return errors.Errorf("terms version %s must be accepted", policy.TermsVersion)
+	}
+	return nil
+}
+
+// ValidateEmail checks that having the specified email address (or none, if nil or empty) satisfies
+// the policy, both when enrolling and when changing or removing the email address afterwards.
+// A nil policy allows everything.
+func (policy *KeyshareRegistrationPolicy) ValidateEmail(email *string) error {
+	if policy == nil {
+		return nil
+	}
+	hasEmail := email != nil && *email != ""
+	switch policy.Email {
+	case KeyshareEmailRequired:
+		if !hasEmail {
+			return errors.New("email address required")
+		}
+	case KeyshareEmailForbidden:
+		if hasEmail {
+			return errors.New("email address not allowed")
+		}
+	}
+	return nil
+}
+
+// ValidatePin checks that the PIN is long enough for the policy.
+func (policy *KeyshareRegistrationPolicy) ValidatePin(pin string) error {
+	min := MinimumKeysharePinLength
+	if policy != nil && policy.MinimumPinLength > min {
+		min = policy.MinimumPinLength
+	}
+	if len(pin) < min {
+		return errors.Errorf("PIN too short, must be at least %d characters", min)
+	}
+	return nil
+}
+
+func (policy *KeyshareRegistrationPolicy) validate() error {
+	switch policy.Email {
+	case "", KeyshareEmailOptional, KeyshareEmailRequired, KeyshareEmailForbidden:
+	default:
+		return errors.Errorf("unknown email policy %s", policy.Email)
+	}
+	if policy.MinimumPinLength < 0 {
+		return errors.New("negative minimum PIN length")
+	}
+	if policy.TermsVersion != "" && policy.TermsURL == "" {
+		return errors.New("terms version specified without terms URL")
+	}
+	return nil
+}
+
 // Issuer describes an issuer.
 type Issuer struct {
 	ID              string           `xml:"ID"`
@@ -801,6 +888,49 @@ func (ct *CredentialType) Logo(conf *Configuration) string {
 	return path
 }
 
+// CredentialTypeMetadata contains what clients need to display credentials of a credential type
+// that is not (yet) present in their schemes, as served by the IRMA server.
+type CredentialTypeMetadata struct {
+	ID          CredentialTypeIdentifier `json:"id"`
+	Name        TranslatedString         `json:"name"`
+	Description TranslatedString         `json:"description"`
+	IssuerName  TranslatedString         `json:"issuerName"`
+	Attributes  []*AttributeTypeMetadata `json:"attributes"`
+	HasLogo     bool                     `json:"hasLogo"`
+}
+
+// AttributeTypeMetadata contains the names of an attribute type, see CredentialTypeMetadata.
+type AttributeTypeMetadata struct {
+	ID          string           `json:"id"`
+	Name        TranslatedString `json:"name"`
+	Description TranslatedString `json:"description"`
+}
+
+// Metadata returns the metadata of the credential type.
+func (ct *CredentialType) Metadata(conf *Configuration) *CredentialTypeMetadata {
+	metadata := &CredentialTypeMetadata{
+		ID:          ct.Identifier(),
+		Name:        ct.Name,
+		Description: ct.Description,
+		Attributes:  make([]*AttributeTypeMetadata, 0, len(ct.AttributeTypes)),
+		HasLogo:     ct.Logo(conf) != "",
+	}
+	if issuer := conf.Issuers[ct.IssuerIdentifier()]; issuer != nil {
+		metadata.IssuerName = issuer.Name
+	}
+	for _, attr := range ct.AttributeTypes {
+		if attr.RevocationAttribute {
+			continue
+		}
+		metadata.Attributes = append(metadata.Attributes, &AttributeTypeMetadata{
+			ID:          attr.ID,
+			Name:        attr.Name,
+			Description: attr.Description,
+		})
+	}
+	return metadata
+}
+
 // Identifier returns the identifier of the specified issuer description.
 func (id *Issuer) Identifier() IssuerIdentifier {
 	return NewIssuerIdentifier(id.SchemeManagerID + "." + id.ID)
@@ -819,3 +949,95 @@ func (ri *RequestorInfo) logoPath(scheme *RequestorScheme) string {
 	}
 	return ""
 }
+
+// RequestDescription describes the attributes that a session request asks for, for showing to
+// users before the session is started.
+type RequestDescription struct {
+	Disjunctions []*DisjunctionDescription `json:"disjunctions"`
+}
+
+// DisjunctionDescription describes one of the disjunctions of a session request, each option of
+// which is a conjunction of attributes with which the disjunction can be satisfied.
+type DisjunctionDescription struct {
+	Label    string                    `json:"label,omitempty"`
+	Optional bool                      `json:"optional,omitempty"`
+	Options  [][]*AttributeDescription `json:"options"`
+}
+
+// AttributeDescription describes a requested attribute, or a requested credential if the type is a
+// credential type identifier, in which case Possession is set: only possession of the credential
+// is requested, without any of its attribute values. If the attribute or credential type is not
+// present in the configuration, only the type, value, Possession and Unknown fields are set.
+type AttributeDescription struct {
+	Type       AttributeTypeIdentifier `json:"type"`
+	Value      *string                 `json:"value,omitempty"`
+	Possession bool                    `json:"possession,omitempty"`
+	Unknown    bool                    `json:"unknown,omitempty"`
+	Name       string                  `json:"name,omitempty"`
+	Credential string                  `json:"credential,omitempty"`
+	Issuer     string                  `json:"issuer,omitempty"`
+	IssueURL   string                  `json:"issueUrl,omitempty"`
+}
+
+// DescribeRequest describes per disjunction the attributes with which the disclosure part of the
+// session request can be satisfied, using the names of the attributes, credential types and
+// issuers in the specified language, and the URLs at which the credentials can be obtained (if
+// specified in the scheme). Names not available in the specified language are given in English.
+// It does not consider which attributes a particular user has.
+func (conf *Configuration) DescribeRequest(request SessionRequest, lang string) *RequestDescription {
+	disclosure := request.Disclosure()
+	description := &RequestDescription{Disjunctions: []*DisjunctionDescription{}}
+	for i, discon := range disclosure.Disclose {
+		disjunction := &DisjunctionDescription{
+			Label:   translate(disclosure.Labels[i], lang),
+			Options: [][]*AttributeDescription{},
+		}
+		for _, con := range discon {
+			if len(con) == 0 {
+				disjunction.Optional = true
+				continue
+			}
+			option := make([]*AttributeDescription, 0, len(con))
+			for _, attr := range con {
+				option = append(option, conf.describeAttribute(attr, lang))
+			}
+			disjunction.Options = append(disjunction.Options, option)
+		}
+		description.Disjunctions = append(description.Disjunctions, disjunction)
+	}
+	return description
+}
+
+func (conf *Configuration) describeAttribute(attr AttributeRequest, lang string) *AttributeDescription {
+	description := &AttributeDescription{Type: attr.Type, Value: attr.Value, Possession: attr.Type.IsCredential()}
+	credtype := conf.CredentialTypes[attr.Type.CredentialTypeIdentifier()]
+	if credtype == nil {
+		description.Unknown = true
+		return description
+	}
+	if !attr.Type.IsCredential() {
+		attrtype := conf.AttributeTypes[attr.Type]
+		if attrtype == nil {
+			description.Unknown = true
+			return description
+		}
+		description.Name = translate(attrtype.Name, lang)
+	}
+
+	description.Credential = translate(credtype.Name, lang)
+	if issuer := conf.Issuers[credtype.IssuerIdentifier()]; issuer != nil {
+		description.Issuer = translate(issuer.Name, lang)
+	}
+	if credtype.IssueURL != nil {
+		description.IssueURL = translate(*credtype.IssueURL, lang)
+	}
+	return description
+}
+
+// translate returns the translation of the string in the specified language, falling back to English.
+func translate(ts TranslatedString, lang string) string {
+	if text, ok := ts[lang]; ok && text != "" {
+		return text
+	}
+	return ts["en"]
+}
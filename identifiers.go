@@ -3,6 +3,7 @@ package irma
 import (
 	"database/sql/driver" // only imported to refer to the driver.Value type
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -147,6 +148,13 @@ func NewIssueWizardIdentifier(id string) IssueWizardIdentifier {
 	return IssueWizardIdentifier{metaObjectIdentifier(id)}
 }
 
+// The New...Identifier() functions below deliberately do not route through the Parse...Identifier()
+// functions, as they cannot return an error and panicking would break existing callers that use
+// them for identifiers which the parsers reject (e.g. empty ones). They are meant for identifiers
+// from trusted sources such as schemes. Identifiers from untrusted input, e.g. session requests,
+// must be parsed using the Parse...Identifier() functions instead, or MustParse...Identifier() for
+// identifiers that are known to be valid.
+
 // NewSchemeManagerIdentifier converts the specified identifier to a SchemeManagerIdentifier.
 func NewSchemeManagerIdentifier(id string) SchemeManagerIdentifier {
 	return SchemeManagerIdentifier{metaObjectIdentifier(id)}
@@ -167,6 +175,99 @@ func NewAttributeTypeIdentifier(id string) AttributeTypeIdentifier {
 	return AttributeTypeIdentifier{metaObjectIdentifier(id)}
 }
 
+// identifierPartRegex matches the parts of scheme, issuer, credential type and attribute type
+// identifiers, which are separated by dots.
+var identifierPartRegex = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+
+// parseIdentifier checks that the specified identifier consists of min up to and including max
+// parts separated by dots, each of which matches identifierPartRegex.
+func parseIdentifier(kind, id string, min, max int) (metaObjectIdentifier, error) {
+	parts := strings.Split(id, ".")
+	if len(parts) < min || len(parts) > max {
+		expected := strconv.Itoa(max)
+		if min != max {
+			expected = fmt.Sprintf("%d or %d", min, max)
+		}
+		return "", errors.Errorf("invalid %s identifier %q: expected %s parts, found %d", kind, id, expected, len(parts))
+	}
+	for i, part := range parts {
+		if !identifierPartRegex.MatchString(part) {
+			return "", errors.Errorf("invalid %s identifier %q: part %d must consist of at least one letter, digit, '_' or '-'", kind, id, i+1)
+		}
+	}
+	return metaObjectIdentifier(id), nil
+}
+
+// ParseSchemeManagerIdentifier parses the specified string to a SchemeManagerIdentifier,
+// returning an error if it does not consist of a single part of letters, digits, '_' and '-'.
+func ParseSchemeManagerIdentifier(id string) (SchemeManagerIdentifier, error) {
+	oi, err := parseIdentifier("scheme", id, 1, 1)
+	return SchemeManagerIdentifier{oi}, err
+}
+
+// ParseIssuerIdentifier parses the specified string to an IssuerIdentifier, returning an error if
+// it does not consist of 2 parts of letters, digits, '_' and '-' separated by dots.
+func ParseIssuerIdentifier(id string) (IssuerIdentifier, error) {
+	oi, err := parseIdentifier("issuer", id, 2, 2)
+	return IssuerIdentifier{oi}, err
+}
+
+// ParseCredentialTypeIdentifier parses the specified string to a CredentialTypeIdentifier,
+// returning an error if it does not consist of 3 parts of letters, digits, '_' and '-' separated
+// by dots.
+func ParseCredentialTypeIdentifier(id string) (CredentialTypeIdentifier, error) {
+	oi, err := parseIdentifier("credential type", id, 3, 3)
+	return CredentialTypeIdentifier{oi}, err
+}
+
+// ParseAttributeTypeIdentifier parses the specified string to an AttributeTypeIdentifier,
+// returning an error if it does not consist of 4 parts of letters, digits, '_' and '-' separated
+// by dots, or of 3 such parts in which case it refers to a credential type (see IsCredential()).
+func ParseAttributeTypeIdentifier(id string) (AttributeTypeIdentifier, error) {
+	oi, err := parseIdentifier("attribute type", id, 3, 4)
+	return AttributeTypeIdentifier{oi}, err
+}
+
+// MustParseSchemeManagerIdentifier is like ParseSchemeManagerIdentifier, but panics if the
+// identifier is invalid. It is meant for identifiers that are known to be valid, e.g. constants.
+func MustParseSchemeManagerIdentifier(id string) SchemeManagerIdentifier {
+	parsed, err := ParseSchemeManagerIdentifier(id)
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+// MustParseIssuerIdentifier is like ParseIssuerIdentifier, but panics if the identifier is
+// invalid. It is meant for identifiers that are known to be valid, e.g. constants.
+func MustParseIssuerIdentifier(id string) IssuerIdentifier {
+	parsed, err := ParseIssuerIdentifier(id)
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+// MustParseCredentialTypeIdentifier is like ParseCredentialTypeIdentifier, but panics if the
+// identifier is invalid. It is meant for identifiers that are known to be valid, e.g. constants.
+func MustParseCredentialTypeIdentifier(id string) CredentialTypeIdentifier {
+	parsed, err := ParseCredentialTypeIdentifier(id)
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+// MustParseAttributeTypeIdentifier is like ParseAttributeTypeIdentifier, but panics if the
+// identifier is invalid. It is meant for identifiers that are known to be valid, e.g. constants.
+func MustParseAttributeTypeIdentifier(id string) AttributeTypeIdentifier {
+	parsed, err := ParseAttributeTypeIdentifier(id)
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
 // RequestorIdentifier returns the requestor identifier of the issue wizard.
 func (id IssueWizardIdentifier) RequestorIdentifier() RequestorIdentifier {
 	return NewRequestorIdentifier(id.Parent())
@@ -94,7 +94,7 @@ func EnsureDirectoryExists(path string) error {
 }
 
 // Save the filecontents at the specified path atomically:
-// - first save the content in a temp file with a random filename in the same dir
+// - first save the content in a temp file with a random filename in the same dir, and flush it to disk
 // - then rename the temp file to the specified filepath, overwriting the old file
 func SaveFile(fpath string, content []byte) (err error) {
 	fpath = filepath.FromSlash(fpath)
@@ -122,10 +122,20 @@ func SaveFile(fpath string, content []byte) (err error) {
 
 	// Create temp file
 	dir := path.Dir(fpath)
-	err = ioutil.WriteFile(filepath.Join(dir, tempfilename), content, 0600)
+	f, err := os.OpenFile(filepath.Join(dir, tempfilename), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
 		return
 	}
+	if _, err = f.Write(content); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(filepath.Join(dir, tempfilename))
+		return
+	}
 
 	// Rename, overwriting old file
 	return os.Rename(filepath.Join(dir, tempfilename), fpath)
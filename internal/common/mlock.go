@@ -0,0 +1,29 @@
+// +build linux darwin freebsd netbsd openbsd
+
+package common
+
+import (
+	"math/big"
+	"syscall"
+	"unsafe"
+)
+
+// LockMemory locks the memory backing the specified integers, preventing it from being swapped
+// to disk. It is meant for secret key material that is kept in memory for the lifetime of the
+// process, and the memory is never unlocked.
+func LockMemory(ints ...*big.Int) error {
+	for _, i := range ints {
+		if i == nil {
+			continue
+		}
+		words := i.Bits()
+		if len(words) == 0 {
+			continue
+		}
+		size := len(words) * int(unsafe.Sizeof(words[0]))
+		if err := syscall.Mlock((*[1 << 30]byte)(unsafe.Pointer(&words[0]))[:size:size]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
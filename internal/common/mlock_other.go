@@ -0,0 +1,14 @@
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package common
+
+import (
+	"math/big"
+
+	"github.com/go-errors/errors"
+)
+
+// LockMemory is not supported on this platform.
+func LockMemory(_ ...*big.Int) error {
+	return errors.New("locking memory is not supported on this platform")
+}
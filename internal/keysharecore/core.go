@@ -3,7 +3,9 @@ package keysharecore
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"io"
 	"sync"
+	"time"
 
 	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/gabi/gabikeys"
@@ -29,15 +31,26 @@ type (
 		jwtPrivateKeyID uint32
 
 		jwtIssuer    string
+		jwtAudience  string
 		jwtPinExpiry int
+		// Whether to accept access tokens lacking the iss or aud claims
+		jwtAcceptMissingClaims bool
+		// Tolerance for the time claims of access tokens
+		clockSkewTolerance time.Duration
 
 		// Commit values generated in first step of keyshare protocol
 		commitmentData  map[uint64]*big.Int
 		commitmentMutex sync.Mutex
+		// IDs of commitments that were used in a response, with the time of use
+		consumedCommitments map[uint64]time.Time
+		lastCommitmentPrune time.Time
 
 		// IRMA issuer keys that are allowed to be used in keyshare
-		//  sessions
-		trustedKeys map[irma.PublicKeyIdentifier]*gabikeys.PublicKey
+		//  sessions, with their precomputed values
+		trustedKeys map[irma.PublicKeyIdentifier]*trustedKey
+
+		// Source of randomness for keyshare secrets, commitments and nonces
+		random io.Reader
 	}
 
 	Configuration struct {
@@ -50,15 +63,37 @@ type (
 		JWTPrivateKeyID uint32
 
 		JWTIssuer    string
-		JWTPinExpiry int // in seconds
+		JWTAudience  string // if empty, no aud claim is set or checked
+		JWTPinExpiry int    // in seconds
+
+		// Accept access tokens without iss or aud claims (logging a warning), to allow tokens
+		// issued before these claims were configured to be used until they expire
+		JWTAcceptMissingClaims bool
+
+		// Tolerated clock difference when checking the time claims of access tokens
+		// (if nil, irma.DefaultClockSkewTolerance)
+		ClockSkewTolerance *time.Duration
 	}
 )
 
 func NewKeyshareCore(conf *Configuration) *Core {
+	return newKeyshareCore(conf, rand.Reader)
+}
+
+// DangerousNewInsecureKeyshareCore is like NewKeyshareCore, but it uses the given reader instead of
+// crypto/rand as its source of randomness. This is meant only for reproducible tests and benchmarks.
+// Using this with a predictable reader WILL compromise keyshare secrets!
+func DangerousNewInsecureKeyshareCore(conf *Configuration, random io.Reader) *Core {
+	return newKeyshareCore(conf, random)
+}
+
+func newKeyshareCore(conf *Configuration, random io.Reader) *Core {
 	c := &Core{
-		decryptionKeys: map[uint32]AESKey{},
-		commitmentData: map[uint64]*big.Int{},
-		trustedKeys:    map[irma.PublicKeyIdentifier]*gabikeys.PublicKey{},
+		decryptionKeys:      map[uint32]AESKey{},
+		commitmentData:      map[uint64]*big.Int{},
+		consumedCommitments: map[uint64]time.Time{},
+		trustedKeys:         map[irma.PublicKeyIdentifier]*trustedKey{},
+		random:              random,
 	}
 
 	c.setDecryptionKey(conf.DecryptionKeyID, conf.DecryptionKey)
@@ -68,10 +103,16 @@ func NewKeyshareCore(conf *Configuration) *Core {
 	if c.jwtIssuer == "" {
 		c.jwtIssuer = JWTIssuerDefault
 	}
+	c.jwtAudience = conf.JWTAudience
+	c.jwtAcceptMissingClaims = conf.JWTAcceptMissingClaims
 	c.jwtPinExpiry = conf.JWTPinExpiry
 	if c.jwtPinExpiry == 0 {
 		c.jwtPinExpiry = JWTPinExpiryDefault
 	}
+	c.clockSkewTolerance = irma.DefaultClockSkewTolerance
+	if conf.ClockSkewTolerance != nil {
+		c.clockSkewTolerance = *conf.ClockSkewTolerance
+	}
 
 	return c
 }
@@ -104,7 +145,9 @@ func (c *Core) setJWTPrivateKey(id uint32, key *rsa.PrivateKey) {
 }
 
 // DangerousAddTrustedPublicKey adds a public key as trusted by keysharecore.
+// The values used to speed up keyshare sessions with the key are precomputed here, replacing
+// those of any key previously added with the same identifier.
 // Calling this on incorrectly generated key material WILL compromise keyshare secrets!
 func (c *Core) DangerousAddTrustedPublicKey(keyID irma.PublicKeyIdentifier, key *gabikeys.PublicKey) {
-	c.trustedKeys[keyID] = key
+	c.trustedKeys[keyID] = newTrustedKey(key)
 }
@@ -0,0 +1,74 @@
+package keysharecore
+
+import (
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/gabi/gabikeys"
+)
+
+// fixedBaseWindow is the amount of bits of the exponent processed per precomputed power in
+// trustedKey.exp. Larger windows need fewer powers but more multiplications per exponentiation;
+// 4 minimizes the time for the exponent lengths used here.
+const fixedBaseWindow = 4
+
+// trustedKey is an issuer public key trusted by the core, along with precomputed powers of its
+// base R[0]. All exponentiations that the keyshare protocol performs have R[0] as their base and
+// N as their modulus, so that they can be sped up using fixed-base exponentiation (Yao's method).
+type trustedKey struct {
+	*gabikeys.PublicKey
+
+	// powers[i] = R[0]^(2^(i*fixedBaseWindow)) mod N, or nil to use plain exponentiation
+	powers []*big.Int
+}
+
+func newTrustedKey(key *gabikeys.PublicKey) *trustedKey {
+	// The longest exponent is the randomizer of the commitments, see newKeyshareCommitments().
+	bits := gabikeys.DefaultSystemParameters[1024].Lm +
+		gabikeys.DefaultSystemParameters[1024].Lh +
+		gabikeys.DefaultSystemParameters[2048].Lstatzk
+	powers := make([]*big.Int, (bits+fixedBaseWindow-1)/fixedBaseWindow)
+	cur := new(big.Int).Mod(key.R[0], key.N)
+	for i := range powers {
+		powers[i] = cur
+		next := new(big.Int).Set(cur)
+		for j := 0; j < fixedBaseWindow; j++ {
+			next.Mul(next, next)
+			next.Mod(next, key.N)
+		}
+		cur = next
+	}
+	return &trustedKey{PublicKey: key, powers: powers}
+}
+
+// exp computes R[0]^e mod N for a nonnegative exponent e, using the precomputed powers of R[0]
+// if e is short enough.
+func (k *trustedKey) exp(e *big.Int) *big.Int {
+	s := getScratch()
+	defer putScratch(s)
+	return k.expScratch(e, s)
+}
+
+// expScratch is like exp, using the specified scratch space for its temporary values.
+func (k *trustedKey) expScratch(e *big.Int, s *scratch) *big.Int {
+	if e.BitLen() > len(k.powers)*fixedBaseWindow {
+		return new(big.Int).Exp(k.R[0], e, k.N)
+	}
+
+	// Split e into digits of fixedBaseWindow bits, so that e = sum_i digits[i] * 2^(i*fixedBaseWindow)
+	// and R[0]^e = prod_d (prod_{i: digits[i] = d} powers[i])^d.
+	digits := s.digitsBuffer(len(k.powers))
+	for i := range digits {
+		for j := 0; j < fixedBaseWindow; j++ {
+			digits[i] |= e.Bit(i*fixedBaseWindow+j) << j
+		}
+	}
+	result, acc := big.NewInt(1), s.acc.SetInt64(1)
+	for d := uint(1<<fixedBaseWindow) - 1; d > 0; d-- {
+		for i, digit := range digits {
+			if digit == d {
+				s.mulMod(acc, acc, k.powers[i], k.N)
+			}
+		}
+		s.mulMod(result, result, acc, k.N)
+	}
+	return result
+}
@@ -1,10 +1,11 @@
 package keysharecore
 
 import (
-	"crypto/rand"
+	"context"
 	"crypto/subtle"
 	"encoding/base64"
 	"encoding/binary"
+	"io"
 	"time"
 
 	"github.com/privacybydesign/gabi"
@@ -23,11 +24,19 @@ var (
 	ErrInvalidJWT       = errors.New("invalid jwt token")
 	ErrKeyNotFound      = errors.New("public key not found")
 	ErrUnknownCommit    = errors.New("unknown commit id")
+	// ErrCommitmentConsumed is returned when a response is requested for a commitment that was
+	// already used in a response, as using it with another challenge would leak the keyshare secret.
+	ErrCommitmentConsumed = errors.New("commitment already used")
 )
 
+// consumedCommitmentRetention is how long the IDs of used commitments are remembered, so that reusing
+// them results in ErrCommitmentConsumed instead of ErrUnknownCommit. Either way a commitment can be
+// used only once, as it is deleted when it is used.
+const consumedCommitmentRetention = 10 * time.Minute
+
 // NewUserSecrets generates a new keyshare secret, secured with the given pin.
 func (c *Core) NewUserSecrets(pinRaw string) (UserSecrets, error) {
-	secret, err := gabi.NewKeyshareSecret()
+	secret, err := c.newKeyshareSecret()
 	if err != nil {
 		return UserSecrets{}, err
 	}
@@ -38,7 +47,7 @@ func (c *Core) NewUserSecrets(pinRaw string) (UserSecrets, error) {
 	}
 
 	var id [32]byte
-	_, err = rand.Read(id[:])
+	_, err = io.ReadFull(c.random, id[:])
 	if err != nil {
 		return UserSecrets{}, err
 	}
@@ -66,12 +75,27 @@ func (c *Core) ValidatePin(secrets UserSecrets, pin string) (string, error) {
 	// Generate jwt token
 	id := s.id()
 	t := time.Now()
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, c.withAudience(jwt.MapClaims{
 		"iss":      c.jwtIssuer,
 		"sub":      "auth_tok",
 		"iat":      t.Unix(),
 		"exp":      t.Add(time.Duration(c.jwtPinExpiry) * time.Second).Unix(),
 		"token_id": base64.StdEncoding.EncodeToString(id[:]),
+	}))
+	token.Header["kid"] = c.jwtPrivateKeyID
+	return token.SignedString(c.jwtPrivateKey)
+}
+
+// SignPinEncryptionKey returns a JWT containing the given X25519 PIN encryption key, signed with the
+// JWT key of the core, so that clients can verify that the key belongs to the keyshare server.
+func (c *Core) SignPinEncryptionKey(key []byte) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, irma.KeysharePinKeyClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:   c.jwtIssuer,
+			Subject:  "pin_key",
+			IssuedAt: time.Now().Unix(),
+		},
+		PinKey: key,
 	})
 	token.Header["kid"] = c.jwtPrivateKeyID
 	return token.SignedString(c.jwtPrivateKey)
@@ -99,7 +123,7 @@ func (c *Core) ChangePin(secrets UserSecrets, oldpinRaw, newpinRaw string) (User
 
 	// change and reencrypt
 	var id [32]byte
-	_, err = rand.Read(id[:])
+	_, err = io.ReadFull(c.random, id[:])
 	if err != nil {
 		return UserSecrets{}, err
 	}
@@ -108,11 +132,54 @@ func (c *Core) ChangePin(secrets UserSecrets, oldpinRaw, newpinRaw string) (User
 	return c.encryptUserSecrets(s)
 }
 
+// NewDeviceSecrets generates keyshare user secrets for an additional device of the user, containing
+// the same keyshare secret as the given encrypted keyshare user secrets, secured with the given pin.
+// Access tokens for the new secrets are not valid for the given secrets, and vice versa.
+func (c *Core) NewDeviceSecrets(secrets UserSecrets, pinRaw string) (UserSecrets, error) {
+	s, err := c.decryptUserSecrets(secrets)
+	if err != nil {
+		return UserSecrets{}, err
+	}
+
+	pin, err := padPin(pinRaw)
+	if err != nil {
+		return UserSecrets{}, err
+	}
+
+	var id [32]byte
+	_, err = io.ReadFull(c.random, id[:])
+	if err != nil {
+		return UserSecrets{}, err
+	}
+	s.setPin(pin)
+	s.setID(id)
+	return c.encryptUserSecrets(s)
+}
+
+// ReencryptUserSecrets re-encrypts the given encrypted keyshare user secrets with the current
+// storage key, if they were encrypted with another key. It returns whether they were re-encrypted.
+// The re-encrypted secrets have the same PIN, and access tokens for them remain valid.
+func (c *Core) ReencryptUserSecrets(secrets UserSecrets) (UserSecrets, bool, error) {
+	if binary.LittleEndian.Uint32(secrets[0:]) == c.decryptionKeyID {
+		return secrets, false, nil
+	}
+	s, err := c.decryptUserSecrets(secrets)
+	if err != nil {
+		return UserSecrets{}, false, err
+	}
+	secrets, err = c.encryptUserSecrets(s)
+	if err != nil {
+		return UserSecrets{}, false, err
+	}
+	return secrets, true, nil
+}
+
 // verifyAccess checks that a given access jwt is valid, and if so, return decrypted keyshare user secrets.
 // Note: Although this is an internal function, it is tested directly
 func (c *Core) verifyAccess(secrets UserSecrets, jwtToken string) (unencryptedUserSecrets, error) {
-	// Verify token validity
-	token, err := jwt.Parse(jwtToken, func(token *jwt.Token) (interface{}, error) {
+	// Verify token validity. We check the time claims ourselves below, to take clock skew into account.
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.Parse(jwtToken, func(token *jwt.Token) (interface{}, error) {
 		if token.Method != jwt.SigningMethodRS256 {
 			return nil, ErrInvalidJWT
 		}
@@ -124,12 +191,21 @@ func (c *Core) verifyAccess(secrets UserSecrets, jwtToken string) (unencryptedUs
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok || claims.Valid() != nil {
+	if !ok {
 		return unencryptedUserSecrets{}, ErrInvalidJWT
 	}
-	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+	now, tolerance := time.Now(), c.clockSkewTolerance
+	if !claims.VerifyExpiresAt(now.Add(-tolerance).Unix(), true) ||
+		!claims.VerifyIssuedAt(now.Add(tolerance).Unix(), false) ||
+		!claims.VerifyNotBefore(now.Add(tolerance).Unix(), false) {
 		return unencryptedUserSecrets{}, ErrInvalidJWT
 	}
+	if err = c.verifyClaim(claims, "iss", c.jwtIssuer); err != nil {
+		return unencryptedUserSecrets{}, err
+	}
+	if err = c.verifyClaim(claims, "aud", c.jwtAudience); err != nil {
+		return unencryptedUserSecrets{}, err
+	}
 	if _, present := claims["token_id"]; !present {
 		return unencryptedUserSecrets{}, ErrInvalidJWT
 	}
@@ -155,10 +231,39 @@ func (c *Core) verifyAccess(secrets UserSecrets, jwtToken string) (unencryptedUs
 	return s, nil
 }
 
+// withAudience adds the configured audience, if any, to the given JWT claims.
+func (c *Core) withAudience(claims jwt.MapClaims) jwt.MapClaims {
+	if c.jwtAudience != "" {
+		claims["aud"] = c.jwtAudience
+	}
+	return claims
+}
+
+// verifyClaim checks that the specified claim equals the expected value, if any. Absent claims
+// are accepted only if the core is configured to accept them, e.g. during migration.
+func (c *Core) verifyClaim(claims jwt.MapClaims, name, expected string) error {
+	if expected == "" {
+		return nil
+	}
+	value, present := claims[name]
+	if !present {
+		if !c.jwtAcceptMissingClaims {
+			return ErrInvalidJWT
+		}
+		irma.Logger.Warnf("Accepting access token without %s claim", name)
+		return nil
+	}
+	if str, ok := value.(string); !ok || str != expected {
+		return ErrInvalidJWT
+	}
+	return nil
+}
+
 // GenerateCommitments generates keyshare commitments using the specified Idemix public key(s).
-func (c *Core) GenerateCommitments(secrets UserSecrets, accessToken string, keyIDs []irma.PublicKeyIdentifier) ([]*gabi.ProofPCommitment, uint64, error) {
+// It aborts with the error of the context when the context is cancelled before it is done.
+func (c *Core) GenerateCommitments(ctx context.Context, secrets UserSecrets, accessToken string, keyIDs []irma.PublicKeyIdentifier) ([]*gabi.ProofPCommitment, uint64, error) {
 	// Validate input request and build key list
-	var keyList []*gabikeys.PublicKey
+	var keyList []*trustedKey
 	for _, keyID := range keyIDs {
 		key, ok := c.trustedKeys[keyID]
 		if !ok {
@@ -174,14 +279,14 @@ func (c *Core) GenerateCommitments(secrets UserSecrets, accessToken string, keyI
 	}
 
 	// Generate commitment
-	commitSecret, commitments, err := gabi.NewKeyshareCommitments(s.keyshareSecret(), keyList)
+	commitSecret, commitments, err := c.newKeyshareCommitments(ctx, s.keyshareSecret(), keyList)
 	if err != nil {
 		return nil, 0, err
 	}
 
 	// Generate commitment id
 	var commitID uint64
-	err = binary.Read(rand.Reader, binary.LittleEndian, &commitID)
+	err = binary.Read(c.random, binary.LittleEndian, &commitID)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -189,13 +294,15 @@ func (c *Core) GenerateCommitments(secrets UserSecrets, accessToken string, keyI
 	// Store commit in backing storage
 	c.commitmentMutex.Lock()
 	c.commitmentData[commitID] = commitSecret
+	delete(c.consumedCommitments, commitID)
 	c.commitmentMutex.Unlock()
 
 	return commitments, commitID, nil
 }
 
 // GenerateResponse generates the response of a zero-knowledge proof of the keyshare secret, for a given previous commit and challenge.
-func (c *Core) GenerateResponse(secrets UserSecrets, accessToken string, commitID uint64, challenge *big.Int, keyID irma.PublicKeyIdentifier) (string, error) {
+// It aborts with the error of the context when the context is cancelled before it is done.
+func (c *Core) GenerateResponse(ctx context.Context, secrets UserSecrets, accessToken string, commitID uint64, challenge *big.Int, keyID irma.PublicKeyIdentifier) (string, error) {
 	// Validate request
 	if uint(challenge.BitLen()) > gabikeys.DefaultSystemParameters[1024].Lh || challenge.Cmp(big.NewInt(0)) < 0 {
 		return "", ErrInvalidChallenge
@@ -210,27 +317,107 @@ func (c *Core) GenerateResponse(secrets UserSecrets, accessToken string, commitI
 	if err != nil {
 		return "", err
 	}
+	if err = ctx.Err(); err != nil {
+		return "", err
+	}
 
-	// Fetch commit
+	// Fetch and consume commit, so that it cannot be used for another response
+	now := time.Now()
 	c.commitmentMutex.Lock()
 	commit, ok := c.commitmentData[commitID]
-	delete(c.commitmentData, commitID)
+	_, consumed := c.consumedCommitments[commitID]
+	if ok {
+		delete(c.commitmentData, commitID)
+		c.consumedCommitments[commitID] = now
+	}
+	c.pruneConsumedCommitments(now)
 	c.commitmentMutex.Unlock()
+	if consumed {
+		return "", ErrCommitmentConsumed
+	}
 	if !ok {
 		return "", ErrUnknownCommit
 	}
 
 	// Generate response
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
-		"ProofP": gabi.KeyshareResponse(s.keyshareSecret(), commit, challenge, key),
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, c.withAudience(jwt.MapClaims{
+		"ProofP": keyshareResponse(s.keyshareSecret(), commit, challenge, key),
 		"iat":    time.Now().Unix(),
 		"sub":    "ProofP",
 		"iss":    c.jwtIssuer,
-	})
+	}))
 	token.Header["kid"] = c.jwtPrivateKeyID
 	return token.SignedString(c.jwtPrivateKey)
 }
 
+// pruneConsumedCommitments forgets the commitments that were used longer than
+// consumedCommitmentRetention ago, at most once per minute. It must be called with
+// the commitment mutex held.
+func (c *Core) pruneConsumedCommitments(now time.Time) {
+	if now.Sub(c.lastCommitmentPrune) < time.Minute {
+		return
+	}
+	c.lastCommitmentPrune = now
+	for id, used := range c.consumedCommitments {
+		if now.Sub(used) > consumedCommitmentRetention {
+			delete(c.consumedCommitments, id)
+		}
+	}
+}
+
+// newKeyshareSecret generates a new keyshare secret like gabi.NewKeyshareSecret(), using the
+// randomness source of the core.
+func (c *Core) newKeyshareSecret() (*big.Int, error) {
+	// This value should be 1 bit less than indicated by Lm, as it is combined with an equal-length value
+	// from the client, resulting in a combined value that should fit in Lm bits.
+	return c.randomBigInt(gabikeys.DefaultSystemParameters[1024].Lm - 1)
+}
+
+// newKeyshareCommitments generates commitments for the given keys like gabi.NewKeyshareCommitments(),
+// using the randomness source of the core and the precomputed values of the keys. Between the
+// exponentiations for each key it checks whether the context has been cancelled.
+func (c *Core) newKeyshareCommitments(ctx context.Context, secret *big.Int, keys []*trustedKey) (*big.Int, []*gabi.ProofPCommitment, error) {
+	// See gabi.NewKeyshareCommitments() for the choice of randomizer length.
+	randLength := gabikeys.DefaultSystemParameters[1024].Lm +
+		gabikeys.DefaultSystemParameters[1024].Lh +
+		gabikeys.DefaultSystemParameters[2048].Lstatzk
+	randomizer, err := c.randomBigInt(randLength)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := getScratch()
+	defer putScratch(s)
+	commitments := make([]*gabi.ProofPCommitment, 0, len(keys))
+	for _, key := range keys {
+		if err = ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		commitments = append(commitments, &gabi.ProofPCommitment{
+			P:       key.expScratch(secret, s),
+			Pcommit: key.expScratch(randomizer, s),
+		})
+	}
+	return randomizer, commitments, nil
+}
+
+// keyshareResponse computes the response to the challenge like gabi.KeyshareResponse(), using the
+// precomputed values of the key.
+func keyshareResponse(secret, commit, challenge *big.Int, key *trustedKey) *gabi.ProofP {
+	s := getScratch()
+	defer putScratch(s)
+	return &gabi.ProofP{
+		P:         key.expScratch(secret, s),
+		C:         new(big.Int).Set(challenge),
+		SResponse: new(big.Int).Add(commit, s.prod.Mul(challenge, secret)),
+	}
+}
+
+// randomBigInt returns a random integer in the range [0, 2^numBits - 1].
+func (c *Core) randomBigInt(numBits uint) (*big.Int, error) {
+	return big.RandInt(c.random, new(big.Int).Lsh(big.NewInt(1), numBits))
+}
+
 // Pad pin string into 64 bytes, extending it with 0s if necessary
 func padPin(pin string) ([64]byte, error) {
 	data := []byte(pin)
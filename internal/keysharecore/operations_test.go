@@ -1,10 +1,14 @@
 package keysharecore
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	mathrand "math/rand"
 	"os"
 	"testing"
 	"time"
@@ -101,6 +105,7 @@ func TestVerifyAccess(t *testing.T) {
 
 	// incorrect exp
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":      JWTIssuerDefault,
 		"iat":      time.Now().Add(-6 * time.Minute).Unix(),
 		"exp":      time.Now().Add(-3 * time.Minute).Unix(),
 		"token_id": tokenID,
@@ -110,8 +115,45 @@ func TestVerifyAccess(t *testing.T) {
 	_, err = c.verifyAccess(secrets1, jwtt)
 	assert.Error(t, err)
 
+	// exp and iat just within clock skew tolerance
+	token = jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":      JWTIssuerDefault,
+		"iat":      time.Now().Add(30 * time.Second).Unix(),
+		"exp":      time.Now().Add(-30 * time.Second).Unix(),
+		"token_id": tokenID,
+	})
+	jwtt, err = token.SignedString(c.jwtPrivateKey)
+	require.NoError(t, err)
+	_, err = c.verifyAccess(secrets1, jwtt)
+	assert.NoError(t, err)
+
+	// exp just outside clock skew tolerance
+	token = jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":      JWTIssuerDefault,
+		"iat":      time.Now().Add(-3 * time.Minute).Unix(),
+		"exp":      time.Now().Add(-90 * time.Second).Unix(),
+		"token_id": tokenID,
+	})
+	jwtt, err = token.SignedString(c.jwtPrivateKey)
+	require.NoError(t, err)
+	_, err = c.verifyAccess(secrets1, jwtt)
+	assert.Error(t, err)
+
+	// iat too far in the future
+	token = jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":      JWTIssuerDefault,
+		"iat":      time.Now().Add(90 * time.Second).Unix(),
+		"exp":      time.Now().Add(3 * time.Minute).Unix(),
+		"token_id": tokenID,
+	})
+	jwtt, err = token.SignedString(c.jwtPrivateKey)
+	require.NoError(t, err)
+	_, err = c.verifyAccess(secrets1, jwtt)
+	assert.Error(t, err)
+
 	// missing exp
 	token = jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":      JWTIssuerDefault,
 		"iat":      time.Now().Unix(),
 		"token_id": tokenID,
 	})
@@ -122,6 +164,7 @@ func TestVerifyAccess(t *testing.T) {
 
 	// Incorrectly typed exp
 	token = jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":      JWTIssuerDefault,
 		"iat":      time.Now().Unix(),
 		"exp":      "test",
 		"token_id": tokenID,
@@ -133,6 +176,7 @@ func TestVerifyAccess(t *testing.T) {
 
 	// missing token_id
 	token = jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss": JWTIssuerDefault,
 		"iat": time.Now().Unix(),
 		"exp": time.Now().Add(3 * time.Minute).Unix(),
 	})
@@ -143,6 +187,7 @@ func TestVerifyAccess(t *testing.T) {
 
 	// mistyped token_id
 	token = jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":      JWTIssuerDefault,
 		"iat":      time.Now().Unix(),
 		"exp":      time.Now().Add(3 * time.Minute).Unix(),
 		"token_id": 7,
@@ -154,6 +199,7 @@ func TestVerifyAccess(t *testing.T) {
 
 	// Incorrect signing method
 	token = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss":      JWTIssuerDefault,
 		"iat":      time.Now().Unix(),
 		"exp":      time.Now().Add(3 * time.Minute).Unix(),
 		"token_id": tokenID,
@@ -164,6 +210,137 @@ func TestVerifyAccess(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestJWTClaims(t *testing.T) {
+	// Setup keys for test, shared by all cores below
+	var key AESKey
+	_, err := rand.Read(key[:])
+	require.NoError(t, err)
+	newCore := func(issuer, audience string, acceptMissing bool) *Core {
+		return NewKeyshareCore(&Configuration{
+			DecryptionKeyID:        1,
+			DecryptionKey:          key,
+			JWTPrivateKeyID:        1,
+			JWTPrivateKey:          jwtTestKey,
+			JWTIssuer:              issuer,
+			JWTAudience:            audience,
+			JWTAcceptMissingClaims: acceptMissing,
+		})
+	}
+	production := newCore("production", "irma", false)
+	staging := newCore("staging", "irma", false)
+	legacy := newCore("production", "", false)
+	migrating := newCore("production", "irma", true)
+
+	secrets, err := production.NewUserSecrets("pin")
+	require.NoError(t, err)
+
+	// Access tokens contain the configured claims and are valid at the issuing core
+	jwtt, err := production.ValidatePin(secrets, "pin")
+	require.NoError(t, err)
+	claims := jwt.MapClaims{}
+	_, _, err = new(jwt.Parser).ParseUnverified(jwtt, claims)
+	require.NoError(t, err)
+	assert.Equal(t, "production", claims["iss"])
+	assert.Equal(t, "irma", claims["aud"])
+	assert.NoError(t, production.ValidateJWT(secrets, jwtt))
+	assert.NoError(t, migrating.ValidateJWT(secrets, jwtt))
+
+	// Tokens of another environment are rejected, even when accepting missing claims
+	jwtt, err = staging.ValidatePin(secrets, "pin")
+	require.NoError(t, err)
+	assert.NoError(t, staging.ValidateJWT(secrets, jwtt))
+	assert.Equal(t, ErrInvalidJWT, production.ValidateJWT(secrets, jwtt))
+	assert.Equal(t, ErrInvalidJWT, migrating.ValidateJWT(secrets, jwtt))
+
+	// Tokens with another audience are rejected
+	jwtt, err = newCore("production", "other", false).ValidatePin(secrets, "pin")
+	require.NoError(t, err)
+	assert.Equal(t, ErrInvalidJWT, production.ValidateJWT(secrets, jwtt))
+	assert.Equal(t, ErrInvalidJWT, migrating.ValidateJWT(secrets, jwtt))
+
+	// Tokens without audience are only accepted when accepting missing claims
+	jwtt, err = legacy.ValidatePin(secrets, "pin")
+	require.NoError(t, err)
+	claims = jwt.MapClaims{}
+	_, _, err = new(jwt.Parser).ParseUnverified(jwtt, claims)
+	require.NoError(t, err)
+	assert.NotContains(t, claims, "aud")
+	assert.Equal(t, ErrInvalidJWT, production.ValidateJWT(secrets, jwtt))
+	assert.NoError(t, migrating.ValidateJWT(secrets, jwtt))
+}
+
+func TestDeviceSecrets(t *testing.T) {
+	// Setup keys for test
+	var key AESKey
+	_, err := rand.Read(key[:])
+	require.NoError(t, err)
+	c := NewKeyshareCore(&Configuration{DecryptionKeyID: 1, DecryptionKey: key, JWTPrivateKeyID: 1, JWTPrivateKey: jwtTestKey})
+
+	// Generate secrets for two devices
+	secrets, err := c.NewUserSecrets("pin")
+	require.NoError(t, err)
+	deviceSecrets, err := c.NewDeviceSecrets(secrets, "devicepin")
+	require.NoError(t, err)
+
+	// Each device has its own pin
+	_, err = c.ValidatePin(deviceSecrets, "pin")
+	assert.Error(t, err)
+	jwtt, err := c.ValidatePin(deviceSecrets, "devicepin")
+	require.NoError(t, err)
+
+	// Access tokens are only valid for the device they were issued to
+	assert.NoError(t, c.ValidateJWT(deviceSecrets, jwtt))
+	assert.Error(t, c.ValidateJWT(secrets, jwtt))
+
+	// Both devices share the keyshare secret
+	s, err := c.decryptUserSecrets(secrets)
+	require.NoError(t, err)
+	ds, err := c.decryptUserSecrets(deviceSecrets)
+	require.NoError(t, err)
+	assert.Equal(t, 0, s.keyshareSecret().Cmp(ds.keyshareSecret()))
+
+	_, err = c.NewDeviceSecrets(secrets, string(make([]byte, 100)))
+	assert.Equal(t, ErrPinTooLong, err)
+}
+
+func TestReencryptUserSecrets(t *testing.T) {
+	// Setup keys for test
+	var oldKey, newKey AESKey
+	_, err := rand.Read(oldKey[:])
+	require.NoError(t, err)
+	_, err = rand.Read(newKey[:])
+	require.NoError(t, err)
+	oldCore := NewKeyshareCore(&Configuration{DecryptionKeyID: 1, DecryptionKey: oldKey, JWTPrivateKeyID: 1, JWTPrivateKey: jwtTestKey})
+	c := NewKeyshareCore(&Configuration{DecryptionKeyID: 2, DecryptionKey: newKey, JWTPrivateKeyID: 1, JWTPrivateKey: jwtTestKey})
+
+	secrets, err := oldCore.NewUserSecrets("pin")
+	require.NoError(t, err)
+	jwtt, err := oldCore.ValidatePin(secrets, "pin")
+	require.NoError(t, err)
+
+	// Without the old key the secrets cannot be re-encrypted
+	_, _, err = c.ReencryptUserSecrets(secrets)
+	assert.Equal(t, ErrNoSuchKey, err)
+
+	c.DangerousAddDecryptionKey(1, oldKey)
+	reencrypted, changed, err := c.ReencryptUserSecrets(secrets)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.NotEqual(t, secrets, reencrypted)
+
+	// The re-encrypted secrets are usable without the old key, with the same PIN and access tokens
+	c = NewKeyshareCore(&Configuration{DecryptionKeyID: 2, DecryptionKey: newKey, JWTPrivateKeyID: 1, JWTPrivateKey: jwtTestKey})
+	assert.NoError(t, c.ValidateJWT(reencrypted, jwtt))
+	_, err = c.ValidatePin(reencrypted, "pin")
+	assert.NoError(t, err)
+
+	// Secrets encrypted with the current key are left alone
+	again, changed, err := c.ReencryptUserSecrets(reencrypted)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, reencrypted, again)
+}
+
 func TestProofFunctionality(t *testing.T) {
 	// Setup keys for test
 	var key AESKey
@@ -187,11 +364,11 @@ func TestProofFunctionality(t *testing.T) {
 	require.NoError(t, err)
 
 	// Get keyshare commitment
-	W, commitID, err := c.GenerateCommitments(secrets, jwtt, []irma.PublicKeyIdentifier{irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}})
+	W, commitID, err := c.GenerateCommitments(context.Background(), secrets, jwtt, []irma.PublicKeyIdentifier{irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}})
 	require.NoError(t, err)
 
 	// Get keyshare response
-	Rjwt, err := c.GenerateResponse(secrets, jwtt, commitID, big.NewInt(12345), irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1})
+	Rjwt, err := c.GenerateResponse(context.Background(), secrets, jwtt, commitID, big.NewInt(12345), irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1})
 	require.NoError(t, err)
 
 	// Decode jwt
@@ -235,7 +412,7 @@ func TestCorruptedUserSecrets(t *testing.T) {
 	jwtt, err := c.ValidatePin(secrets, pin)
 	require.NoError(t, err)
 
-	_, commitID, err := c.GenerateCommitments(secrets, jwtt, []irma.PublicKeyIdentifier{irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}})
+	_, commitID, err := c.GenerateCommitments(context.Background(), secrets, jwtt, []irma.PublicKeyIdentifier{irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}})
 	require.NoError(t, err)
 
 	// Corrupt user secrets
@@ -250,11 +427,11 @@ func TestCorruptedUserSecrets(t *testing.T) {
 	assert.Error(t, err, "ChangePin accepts corrupted keyshare user secrets")
 
 	// GenerateCommitments
-	_, _, err = c.GenerateCommitments(secrets, jwtt, []irma.PublicKeyIdentifier{irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}})
+	_, _, err = c.GenerateCommitments(context.Background(), secrets, jwtt, []irma.PublicKeyIdentifier{irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}})
 	assert.Error(t, err, "GenerateCommitments accepts corrupted keyshare user secrets")
 
 	// GetResponse
-	_, err = c.GenerateResponse(secrets, jwtt, commitID, big.NewInt(12345), irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1})
+	_, err = c.GenerateResponse(context.Background(), secrets, jwtt, commitID, big.NewInt(12345), irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1})
 	assert.Error(t, err, "GenerateResponse accepts corrupted keyshare user secrets")
 }
 
@@ -289,9 +466,9 @@ func TestIncorrectPin(t *testing.T) {
 	assert.Error(t, err, "ChangePin accepts incorrect pin")
 
 	// GetResponse
-	_, commitID, err := c.GenerateCommitments(secrets, jwtt, []irma.PublicKeyIdentifier{irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}})
+	_, commitID, err := c.GenerateCommitments(context.Background(), secrets, jwtt, []irma.PublicKeyIdentifier{irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}})
 	require.NoError(t, err)
-	_, err = c.GenerateResponse(secrets, "pin", commitID, big.NewInt(12345), irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1})
+	_, err = c.GenerateResponse(context.Background(), secrets, "pin", commitID, big.NewInt(12345), irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1})
 	assert.Error(t, err, "GenerateResponse accepts incorrect pin")
 }
 
@@ -318,13 +495,13 @@ func TestMissingKey(t *testing.T) {
 	require.NoError(t, err)
 
 	// GenerateCommitments
-	_, _, err = c.GenerateCommitments(secrets, jwtt, []irma.PublicKeyIdentifier{irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("DNE"), Counter: 1}})
+	_, _, err = c.GenerateCommitments(context.Background(), secrets, jwtt, []irma.PublicKeyIdentifier{irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("DNE"), Counter: 1}})
 	assert.Error(t, err, "Missing key not detected by generateCommitments")
 
 	// GenerateResponse
-	_, commitID, err := c.GenerateCommitments(secrets, jwtt, []irma.PublicKeyIdentifier{irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}})
+	_, commitID, err := c.GenerateCommitments(context.Background(), secrets, jwtt, []irma.PublicKeyIdentifier{irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}})
 	require.NoError(t, err)
-	_, err = c.GenerateResponse(secrets, jwtt, commitID, big.NewInt(12345), irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("DNE"), Counter: 1})
+	_, err = c.GenerateResponse(context.Background(), secrets, jwtt, commitID, big.NewInt(12345), irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("DNE"), Counter: 1})
 	assert.Error(t, err, "Missing key not detected by generateresponse")
 }
 
@@ -351,21 +528,21 @@ func TestInvalidChallenge(t *testing.T) {
 	require.NoError(t, err)
 
 	// Test negative challenge
-	_, commitID, err := c.GenerateCommitments(secrets, jwtt, []irma.PublicKeyIdentifier{irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}})
+	_, commitID, err := c.GenerateCommitments(context.Background(), secrets, jwtt, []irma.PublicKeyIdentifier{irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}})
 	require.NoError(t, err)
-	_, err = c.GenerateResponse(secrets, jwtt, commitID, big.NewInt(-1), irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1})
+	_, err = c.GenerateResponse(context.Background(), secrets, jwtt, commitID, big.NewInt(-1), irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1})
 	assert.Error(t, err, "GenerateResponse incorrectly accepts negative challenge")
 
 	// Test too large challenge
-	_, commitID, err = c.GenerateCommitments(secrets, jwtt, []irma.PublicKeyIdentifier{irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}})
+	_, commitID, err = c.GenerateCommitments(context.Background(), secrets, jwtt, []irma.PublicKeyIdentifier{irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}})
 	require.NoError(t, err)
-	_, err = c.GenerateResponse(secrets, jwtt, commitID, new(big.Int).Lsh(big.NewInt(1), 256), irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1})
+	_, err = c.GenerateResponse(context.Background(), secrets, jwtt, commitID, new(big.Int).Lsh(big.NewInt(1), 256), irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1})
 	assert.Error(t, err, "GenerateResponse accepts challenge that is too small")
 
 	// Test just-right challenge
-	_, commitID, err = c.GenerateCommitments(secrets, jwtt, []irma.PublicKeyIdentifier{irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}})
+	_, commitID, err = c.GenerateCommitments(context.Background(), secrets, jwtt, []irma.PublicKeyIdentifier{irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}})
 	require.NoError(t, err)
-	_, err = c.GenerateResponse(secrets, jwtt, commitID, new(big.Int).Lsh(big.NewInt(1), 255), irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1})
+	_, err = c.GenerateResponse(context.Background(), secrets, jwtt, commitID, new(big.Int).Lsh(big.NewInt(1), 255), irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1})
 	assert.NoError(t, err, "GenerateResponse does not accept challenge of 256 bits")
 }
 
@@ -392,12 +569,48 @@ func TestDoubleCommitUse(t *testing.T) {
 	require.NoError(t, err)
 
 	// Use commit double
-	_, commitID, err := c.GenerateCommitments(secrets, jwtt, []irma.PublicKeyIdentifier{irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}})
+	_, commitID, err := c.GenerateCommitments(context.Background(), secrets, jwtt, []irma.PublicKeyIdentifier{irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}})
 	require.NoError(t, err)
-	_, err = c.GenerateResponse(secrets, jwtt, commitID, big.NewInt(12345), irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1})
+	_, err = c.GenerateResponse(context.Background(), secrets, jwtt, commitID, big.NewInt(12345), irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1})
 	require.NoError(t, err)
-	_, err = c.GenerateResponse(secrets, jwtt, commitID, big.NewInt(12346), irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1})
-	assert.Error(t, err, "GenerateResponse incorrectly allows double use of commit")
+	_, err = c.GenerateResponse(context.Background(), secrets, jwtt, commitID, big.NewInt(12346), irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1})
+	assert.Equal(t, ErrCommitmentConsumed, err, "GenerateResponse incorrectly allows double use of commit")
+}
+
+func TestConcurrentCommitUse(t *testing.T) {
+	// Setup keys for test
+	var key AESKey
+	_, err := rand.Read(key[:])
+	require.NoError(t, err)
+	c := NewKeyshareCore(&Configuration{DecryptionKeyID: 1, DecryptionKey: key, JWTPrivateKeyID: 1, JWTPrivateKey: jwtTestKey})
+	keyID := irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}
+	c.DangerousAddTrustedPublicKey(keyID, testPubK1)
+
+	secrets, err := c.NewUserSecrets("pin")
+	require.NoError(t, err)
+	jwtt, err := c.ValidatePin(secrets, "pin")
+	require.NoError(t, err)
+	_, commitID, err := c.GenerateCommitments(context.Background(), secrets, jwtt, []irma.PublicKeyIdentifier{keyID})
+	require.NoError(t, err)
+
+	// Of parallel responses for the same commit, using different challenges, only one succeeds
+	n := 10
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			_, err := c.GenerateResponse(context.Background(), secrets, jwtt, commitID, big.NewInt(int64(12345+i)), keyID)
+			errs <- err
+		}(i)
+	}
+	succeeded := 0
+	for i := 0; i < n; i++ {
+		if err := <-errs; err == nil {
+			succeeded++
+		} else {
+			assert.Equal(t, ErrCommitmentConsumed, err)
+		}
+	}
+	assert.Equal(t, 1, succeeded)
 }
 
 func TestNonExistingCommit(t *testing.T) {
@@ -423,8 +636,229 @@ func TestNonExistingCommit(t *testing.T) {
 	require.NoError(t, err)
 
 	// test
-	_, err = c.GenerateResponse(secrets, jwtt, 2364, big.NewInt(12345), irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1})
-	assert.Error(t, err, "GenerateResponse failed to detect non-existing commit")
+	_, err = c.GenerateResponse(context.Background(), secrets, jwtt, 2364, big.NewInt(12345), irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1})
+	assert.Equal(t, ErrUnknownCommit, err, "GenerateResponse failed to detect non-existing commit")
+}
+
+func TestCancelledContext(t *testing.T) {
+	// Setup keys for test
+	var key AESKey
+	_, err := rand.Read(key[:])
+	require.NoError(t, err)
+	c := NewKeyshareCore(&Configuration{DecryptionKeyID: 1, DecryptionKey: key, JWTPrivateKeyID: 1, JWTPrivateKey: jwtTestKey})
+	keyID := irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}
+	c.DangerousAddTrustedPublicKey(keyID, testPubK1)
+
+	// Generate user secrets
+	secrets, err := c.NewUserSecrets("12345")
+	require.NoError(t, err)
+	jwtt, err := c.ValidatePin(secrets, "12345")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// test
+	_, _, err = c.GenerateCommitments(ctx, secrets, jwtt, []irma.PublicKeyIdentifier{keyID})
+	assert.Equal(t, context.Canceled, err)
+	_, commitID, err := c.GenerateCommitments(context.Background(), secrets, jwtt, []irma.PublicKeyIdentifier{keyID})
+	require.NoError(t, err)
+	_, err = c.GenerateResponse(ctx, secrets, jwtt, commitID, big.NewInt(12345), keyID)
+	assert.Equal(t, context.Canceled, err)
+
+	// The commit is not consumed by the cancelled call
+	_, err = c.GenerateResponse(context.Background(), secrets, jwtt, commitID, big.NewInt(12345), keyID)
+	require.NoError(t, err)
+}
+
+func TestDeterministicRandomness(t *testing.T) {
+	keyID := irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}
+	c := newDeterministicTestCore(keyID)
+
+	// Generate user secrets
+	secrets, err := c.NewUserSecrets("12345")
+	require.NoError(t, err)
+	digest := sha256.Sum256(secrets[:])
+	assert.Equal(t, "8839b399cbe2919ccf6c22ed95e2bcdb8ded9d4dab6e350a95c11c4cf6cdffc5", hex.EncodeToString(digest[:]))
+
+	jwtt, err := c.ValidatePin(secrets, "12345")
+	require.NoError(t, err)
+
+	// Get keyshare commitment
+	W, commitID, err := c.GenerateCommitments(context.Background(), secrets, jwtt, []irma.PublicKeyIdentifier{keyID})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0x9805f50bd268b68e), commitID)
+	require.Len(t, W, 1)
+	digest = sha256.Sum256(W[0].Pcommit.Bytes())
+	assert.Equal(t, "d528a4614385595b5c754657552c5e279767737b0f9ff16fd48684886c8b6f3b", hex.EncodeToString(digest[:]))
+
+	// Get keyshare response
+	Rjwt, err := c.GenerateResponse(context.Background(), secrets, jwtt, commitID, big.NewInt(12345), keyID)
+	require.NoError(t, err)
+	claims := &struct {
+		jwt.StandardClaims
+		ProofP *gabi.ProofP
+	}{}
+	_, err = jwt.ParseWithClaims(Rjwt, claims, func(tok *jwt.Token) (interface{}, error) {
+		return &c.jwtPrivateKey.PublicKey, nil
+	})
+	require.NoError(t, err)
+	digest = sha256.Sum256(claims.ProofP.SResponse.Bytes())
+	assert.Equal(t, "a988fccb6b4a970cdef4abe49e05e1daff6d48109d5eed8812cd724c88afc7ce", hex.EncodeToString(digest[:]))
+}
+
+func TestPrecomputedKeys(t *testing.T) {
+	keyIDs := []irma.PublicKeyIdentifier{
+		{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1},
+		{Issuer: irma.NewIssuerIdentifier("test"), Counter: 2},
+	}
+
+	// The fixed-base exponentiation agrees with plain exponentiation, also for exponents
+	// exceeding the precomputed powers
+	key := newTrustedKey(testPubK1)
+	for _, e := range []*big.Int{
+		big.NewInt(0),
+		big.NewInt(1),
+		big.NewInt(12345),
+		new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), uint(len(key.powers)*fixedBaseWindow)), big.NewInt(1)),
+		new(big.Int).Lsh(big.NewInt(3), uint(len(key.powers)*fixedBaseWindow)),
+	} {
+		require.Equal(t, new(big.Int).Exp(testPubK1.R[0], e, testPubK1.N), key.exp(e), e.String())
+	}
+
+	// Cores with and without precomputed values produce the same proofs
+	proofs := func(c *Core) ([]*gabi.ProofPCommitment, *gabi.ProofP) {
+		secrets, err := c.NewUserSecrets("12345")
+		require.NoError(t, err)
+		jwtt, err := c.ValidatePin(secrets, "12345")
+		require.NoError(t, err)
+		W, commitID, err := c.GenerateCommitments(context.Background(), secrets, jwtt, keyIDs)
+		require.NoError(t, err)
+		Rjwt, err := c.GenerateResponse(context.Background(), secrets, jwtt, commitID, big.NewInt(12345), keyIDs[1])
+		require.NoError(t, err)
+		claims := &struct {
+			jwt.StandardClaims
+			ProofP *gabi.ProofP
+		}{}
+		_, err = jwt.ParseWithClaims(Rjwt, claims, func(tok *jwt.Token) (interface{}, error) {
+			return &c.jwtPrivateKey.PublicKey, nil
+		})
+		require.NoError(t, err)
+		return W, claims.ProofP
+	}
+	W, P := proofs(newDeterministicTestCore(keyIDs...))
+	expectedW, expectedP := proofs(withoutPrecomputation(newDeterministicTestCore(keyIDs...)))
+	require.Equal(t, expectedW, W)
+	require.Equal(t, expectedP, P)
+	require.Equal(t, W[1].P, P.P)
+
+	// Replacing a key replaces its precomputed values
+	c := newDeterministicTestCore(keyIDs...)
+	otherKey := *testPubK1
+	otherKey.R = append([]*big.Int{big.NewInt(2)}, testPubK1.R[1:]...)
+	c.DangerousAddTrustedPublicKey(keyIDs[0], &otherKey)
+	require.Equal(t, new(big.Int).Exp(big.NewInt(2), big.NewInt(12345), testPubK1.N), c.trustedKeys[keyIDs[0]].exp(big.NewInt(12345)))
+}
+
+func BenchmarkNewUserSecrets(b *testing.B) {
+	c := newDeterministicTestCore()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := c.NewUserSecrets("12345")
+		require.NoError(b, err)
+	}
+}
+
+func BenchmarkValidatePin(b *testing.B) {
+	c := newDeterministicTestCore()
+	secrets, err := c.NewUserSecrets("12345")
+	require.NoError(b, err)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = c.ValidatePin(secrets, "12345")
+		require.NoError(b, err)
+	}
+}
+
+func BenchmarkGenerateCommitments(b *testing.B) {
+	for _, bench := range []struct {
+		n          int
+		precompute bool
+	}{{1, true}, {4, true}, {16, true}, {16, false}} {
+		n, name := bench.n, fmt.Sprintf("%d keys", bench.n)
+		if !bench.precompute {
+			name += " without precomputation"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			keyIDs := make([]irma.PublicKeyIdentifier, n)
+			for i := range keyIDs {
+				keyIDs[i] = irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: uint(i)}
+			}
+			c := newDeterministicTestCore(keyIDs...)
+			if !bench.precompute {
+				withoutPrecomputation(c)
+			}
+			secrets, err := c.NewUserSecrets("12345")
+			require.NoError(b, err)
+			jwtt, err := c.ValidatePin(secrets, "12345")
+			require.NoError(b, err)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, commitID, err := c.GenerateCommitments(context.Background(), secrets, jwtt, keyIDs)
+				require.NoError(b, err)
+
+				// Prevent the stored commitments from piling up
+				b.StopTimer()
+				delete(c.commitmentData, commitID)
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+func BenchmarkGenerateResponse(b *testing.B) {
+	keyID := irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}
+	c := newDeterministicTestCore(keyID)
+	secrets, err := c.NewUserSecrets("12345")
+	require.NoError(b, err)
+	jwtt, err := c.ValidatePin(secrets, "12345")
+	require.NoError(b, err)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		_, commitID, err := c.GenerateCommitments(context.Background(), secrets, jwtt, []irma.PublicKeyIdentifier{keyID})
+		require.NoError(b, err)
+		b.StartTimer()
+
+		_, err = c.GenerateResponse(context.Background(), secrets, jwtt, commitID, big.NewInt(12345), keyID)
+		require.NoError(b, err)
+	}
+}
+
+// newDeterministicTestCore returns a core using a fixed seed as its source of randomness,
+// trusting testPubK1 under each of the specified identifiers.
+func newDeterministicTestCore(keyIDs ...irma.PublicKeyIdentifier) *Core {
+	c := DangerousNewInsecureKeyshareCore(
+		&Configuration{DecryptionKeyID: 1, DecryptionKey: AESKey{1, 2, 3}, JWTPrivateKeyID: 1, JWTPrivateKey: jwtTestKey},
+		mathrand.New(mathrand.NewSource(1)),
+	)
+	for _, keyID := range keyIDs {
+		c.DangerousAddTrustedPublicKey(keyID, testPubK1)
+	}
+	return c
+}
+
+// withoutPrecomputation discards the precomputed values of the trusted keys of the core, so that
+// it uses plain exponentiation.
+func withoutPrecomputation(c *Core) *Core {
+	for _, key := range c.trustedKeys {
+		key.powers = nil
+	}
+	return c
 }
 
 // Test data
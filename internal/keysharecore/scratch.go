@@ -0,0 +1,77 @@
+package keysharecore
+
+import (
+	"math/bits"
+	"sync"
+
+	"github.com/privacybydesign/gabi/big"
+)
+
+// scratchMaxBits bounds the size of the values of pooled scratch spaces: scratch spaces whose
+// values grew larger (e.g. when used with an unusually large modulus) are left to the garbage
+// collector instead of being kept in the pool.
+const scratchMaxBits = 16384
+
+// scratch holds the temporary values of the modular arithmetic of the keyshare protocol. Scratch
+// spaces are reused across computations using scratchPool, so that the hot paths of the core
+// allocate (and the garbage collector reclaims) fewer big integers. A scratch space must not be
+// used concurrently.
+type scratch struct {
+	acc, prod, quo *big.Int
+	digits         []uint
+}
+
+var scratchPool = sync.Pool{New: func() interface{} { return newScratch() }}
+
+func newScratch() *scratch {
+	return &scratch{acc: new(big.Int), prod: new(big.Int), quo: new(big.Int)}
+}
+
+// getScratch returns a scratch space from the pool, which should be returned using putScratch.
+func getScratch() *scratch {
+	return scratchPool.Get().(*scratch)
+}
+
+// putScratch returns the scratch space to the pool, unless its values are too large to be kept.
+// As the values are derived from keyshare secrets, they are wiped first.
+func putScratch(s *scratch) {
+	for i := range s.digits {
+		s.digits[i] = 0
+	}
+	keep := true
+	for _, x := range []*big.Int{s.acc, s.prod, s.quo} {
+		words := x.Bits()
+		words = words[:cap(words)]
+		for i := range words {
+			words[i] = 0
+		}
+		x.SetInt64(0)
+		keep = keep && len(words)*bits.UintSize <= scratchMaxBits
+	}
+	if keep {
+		scratchPool.Put(s)
+	}
+}
+
+// mulMod sets z = x*y mod n for nonnegative x and y, and returns z.
+// z may alias x, y or s.acc, but not s.prod or s.quo.
+func (s *scratch) mulMod(z, x, y, n *big.Int) *big.Int {
+	s.prod.Mul(x, y)
+	// For nonnegative operands the remainder of QuoRem equals x*y mod n, and unlike Mod,
+	// QuoRem stores the quotient in a value that can be reused.
+	s.quo.QuoRem(s.prod, n, z)
+	return z
+}
+
+// digitsBuffer returns a zeroed slice of n digits, reusing the buffer of the scratch space.
+func (s *scratch) digitsBuffer(n int) []uint {
+	if cap(s.digits) < n {
+		s.digits = make([]uint, n)
+		return s.digits
+	}
+	s.digits = s.digits[:n]
+	for i := range s.digits {
+		s.digits[i] = 0
+	}
+	return s.digits
+}
@@ -0,0 +1,132 @@
+package keysharecore
+
+import (
+	mathrand "math/rand"
+	"sync"
+	"testing"
+
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/stretchr/testify/require"
+)
+
+// unpooledExp is trustedKey.exp as it was before scratch spaces were introduced, allocating all of
+// its temporary values, against which the pooled computation is compared.
+func unpooledExp(k *trustedKey, e *big.Int) *big.Int {
+	if e.BitLen() > len(k.powers)*fixedBaseWindow {
+		return new(big.Int).Exp(k.R[0], e, k.N)
+	}
+	digits := make([]uint, len(k.powers))
+	for i := range digits {
+		for j := 0; j < fixedBaseWindow; j++ {
+			digits[i] |= e.Bit(i*fixedBaseWindow+j) << j
+		}
+	}
+	result, acc, tmp := big.NewInt(1), big.NewInt(1), new(big.Int)
+	for d := uint(1<<fixedBaseWindow) - 1; d > 0; d-- {
+		for i, digit := range digits {
+			if digit == d {
+				tmp.Mul(acc, k.powers[i])
+				acc.Mod(tmp, k.N)
+			}
+		}
+		tmp.Mul(result, acc)
+		result.Mod(tmp, k.N)
+	}
+	return result
+}
+
+// randomInt returns a random integer of at most the specified amount of bits.
+func randomInt(rnd *mathrand.Rand, maxBits int) *big.Int {
+	bts := make([]byte, (rnd.Intn(maxBits)+8)/8)
+	rnd.Read(bts)
+	return new(big.Int).SetBytes(bts)
+}
+
+func TestScratchExp(t *testing.T) {
+	key := newTrustedKey(testPubK1)
+	rnd := mathrand.New(mathrand.NewSource(1))
+	maxBits := len(key.powers)*fixedBaseWindow + 64 // also exceeding the precomputed powers
+
+	// The pooled computation agrees with the unpooled one, also when reusing a scratch space
+	reused := newScratch()
+	for i := 0; i < 200; i++ {
+		e := randomInt(rnd, maxBits)
+		expected := unpooledExp(key, e)
+		require.Equal(t, expected, key.exp(e), e.String())
+		require.Equal(t, expected, key.expScratch(e, newScratch()), e.String())
+		require.Equal(t, expected, key.expScratch(e, reused), e.String())
+		if i%20 == 0 {
+			require.Equal(t, new(big.Int).Exp(testPubK1.R[0], e, testPubK1.N), expected, e.String())
+		}
+	}
+
+	// and so does the modular multiplication, also if the destination aliases an operand
+	s := newScratch()
+	for i := 0; i < 200; i++ {
+		x, y := randomInt(rnd, 2048), randomInt(rnd, 2048)
+		expected := new(big.Int).Mod(new(big.Int).Mul(x, y), testPubK1.N)
+		require.Equal(t, expected, s.mulMod(new(big.Int), x, y, testPubK1.N))
+		require.Equal(t, expected, s.mulMod(x, x, y, testPubK1.N))
+	}
+}
+
+func TestScratchConcurrency(t *testing.T) {
+	key := newTrustedKey(testPubK1)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := mathrand.New(mathrand.NewSource(seed))
+			for i := 0; i < 25; i++ {
+				secret, commit, challenge := randomInt(rnd, 256), randomInt(rnd, 640), randomInt(rnd, 256)
+				require.Equal(t, gabi.KeyshareResponse(secret, commit, challenge, testPubK1),
+					keyshareResponse(secret, commit, challenge, key))
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+}
+
+func TestPutScratch(t *testing.T) {
+	key := newTrustedKey(testPubK1)
+
+	// Values are wiped before the scratch space is returned to the pool
+	s := newScratch()
+	key.expScratch(big.NewInt(12345), s)
+	s.prod.Mul(big.NewInt(12345), big.NewInt(67890))
+	words := s.prod.Bits()[:1]
+	putScratch(s)
+	require.Zero(t, s.acc.Sign())
+	require.Zero(t, s.prod.Sign())
+	require.Equal(t, uint(0), uint(words[0]))
+	for _, digit := range s.digits {
+		require.Zero(t, digit)
+	}
+
+	// Scratch spaces with values that grew too large are not kept
+	s = newScratch()
+	s.prod.Lsh(big.NewInt(1), scratchMaxBits+1)
+	putScratch(s)
+	for i := 0; i < 10; i++ {
+		require.NotSame(t, s, getScratch())
+	}
+}
+
+func BenchmarkExp(b *testing.B) {
+	key := newTrustedKey(testPubK1)
+	e := randomInt(mathrand.New(mathrand.NewSource(1)), len(key.powers)*fixedBaseWindow)
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			key.exp(e)
+		}
+	})
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			unpooledExp(key, e)
+		}
+	})
+}
@@ -3,9 +3,9 @@ package keysharecore
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
 	"crypto/subtle"
 	"encoding/binary"
+	"io"
 
 	"github.com/privacybydesign/gabi/big"
 
@@ -81,7 +81,7 @@ func (c *Core) encryptUserSecrets(secrets unencryptedUserSecrets) (UserSecrets,
 	binary.LittleEndian.PutUint32(encSecrets[0:], c.decryptionKeyID)
 
 	// Generate and store nonce
-	_, err := rand.Read(encSecrets[4:16])
+	_, err := io.ReadFull(c.random, encSecrets[4:16])
 	if err != nil {
 		return UserSecrets{}, err
 	}
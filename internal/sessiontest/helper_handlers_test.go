@@ -85,6 +85,7 @@ type TestHandler struct {
 	pairingCodeChan    chan string
 	clientTransport    *irma.HTTPTransport
 	frontendTransport  *irma.HTTPTransport
+	expiresAt          time.Time
 }
 
 func (th TestHandler) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
@@ -99,6 +100,9 @@ func (th TestHandler) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdenti
 func (th TestHandler) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier) {
 	th.Failure(&irma.SessionError{Err: errors.Errorf("Keyshare enrollment deleted for %s", manager.String())})
 }
+func (th TestHandler) KeyshareAccountGone(manager irma.SchemeManagerIdentifier) {
+	th.Failure(&irma.SessionError{Err: errors.Errorf("Keyshare account gone for %s", manager.String())})
+}
 func (th TestHandler) StatusUpdate(action irma.Action, status irma.ClientStatus) {}
 func (th *TestHandler) Success(result string) {
 	th.result = result
@@ -163,6 +167,9 @@ func (th TestHandler) PairingRequired(pairingCode string) {
 	th.Failure(&irma.SessionError{ErrorType: irma.ErrorType("Pairing required")})
 }
 
+func (th *TestHandler) SessionExpiry(expiresAt time.Time) {
+	th.expiresAt = expiresAt
+}
 func (th *TestHandler) SetClientTransport(transport *irma.HTTPTransport) {
 	th.clientTransport = transport
 }
@@ -0,0 +1,205 @@
+package sessiontest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/internal/testkeyshare"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/keyshare/keyshareserver"
+	"github.com/privacybydesign/irmago/server/requestorserver"
+	"github.com/stretchr/testify/require"
+)
+
+// harnessPin is the PIN with which the harness enrolls; TestHandler enters it when asked for the PIN.
+const harnessPin = "12345"
+
+var harnessScheme = irma.NewSchemeManagerIdentifier("test")
+
+// harness is an in-process deployment of the components involved in keyshare sessions, each
+// listening on a random port: a keyshare server with an in-memory database, which issues the
+// keyshare credential using its embedded IRMA server; a requestor server; and an IRMA client
+// using both of them. The keyshare storage key and the JWT key of the requestor server are
+// generated; the issuer keys and keyshare JWT key are those of the test schemes, as the client
+// verifies against them.
+//
+// Scenarios are built from the steps (enroll(), session(), ...), so that tests of new features
+// don't have to set up the components themselves.
+type harness struct {
+	t   *testing.T
+	dir string
+
+	keyshareDB     keyshareserver.DB
+	keyshareServer *keyshareserver.Server
+	keyshareHTTP   *http.Server
+	keyshareURL    string
+
+	requestorServer *requestorserver.Server
+	requestorURL    string
+	jwtPublicKey    *rsa.PublicKey
+
+	client  *irmaclient.Client
+	handler *TestClientHandler
+}
+
+// startHarness starts all components. The client is not yet enrolled at the keyshare server.
+// Use stop() to shut them down.
+func startHarness(t *testing.T) *harness {
+	dir, err := ioutil.TempDir("", "harness")
+	require.NoError(t, err)
+	h := &harness{t: t, dir: dir}
+
+	h.startKeyshareServer()
+	h.startRequestorServer()
+	h.startClient()
+	return h
+}
+
+func (h *harness) stop() {
+	h.requestorServer.Stop()
+	_ = h.keyshareHTTP.Close()
+	h.keyshareServer.Stop()
+	_ = h.client.Close()
+	test.ClearTestStorage(h.t, h.handler.storage)
+	require.NoError(h.t, os.RemoveAll(h.dir))
+}
+
+// listen returns a listener on a random port.
+func (h *harness) listen() (net.Listener, int) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(h.t, err)
+	return l, l.Addr().(*net.TCPAddr).Port
+}
+
+func (h *harness) startKeyshareServer() {
+	l, port := h.listen()
+	h.keyshareURL = fmt.Sprintf("http://localhost:%d", port)
+	h.keyshareDB = keyshareserver.NewMemoryDB()
+
+	// The storage key consists of a 4 byte key ID followed by a 32 byte AES key
+	key := make([]byte, 4+32)
+	_, err := rand.Read(key)
+	require.NoError(h.t, err)
+	keyFile := filepath.Join(h.dir, "storagekey")
+	require.NoError(h.t, ioutil.WriteFile(keyFile, key, 0600))
+
+	conf := testkeyshare.KeyshareServerConfiguration(h.t, logger, h.keyshareURL+"/", h.keyshareDB)
+	conf.StoragePrimaryKeyFile = keyFile
+	h.keyshareServer, err = keyshareserver.New(conf)
+	require.NoError(h.t, err)
+
+	h.keyshareHTTP = &http.Server{Handler: h.keyshareServer.Handler()}
+	go func() {
+		_ = h.keyshareHTTP.Serve(l)
+	}()
+}
+
+func (h *harness) startRequestorServer() {
+	l, port := h.listen()
+	h.requestorURL = fmt.Sprintf("http://localhost:%d", port)
+
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(h.t, err)
+	h.jwtPublicKey = &sk.PublicKey
+	skPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(sk)})
+
+	conf := &requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:                   h.requestorURL + "/irma",
+			Logger:                logger,
+			DisableSchemesUpdate:  true,
+			SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+			IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+			JwtPrivateKey:         string(skPem),
+			EgressAllowedNetworks: []string{"127.0.0.0/8", "::1"},
+		},
+		DisableRequestorAuthentication: true,
+		ListenAddress:                  "localhost",
+		Port:                           port,
+		Permissions: requestorserver.Permissions{
+			Disclosing: []string{"*"},
+			Signing:    []string{"*"},
+			Issuing:    []string{"*"},
+		},
+	}
+	h.requestorServer, err = requestorserver.New(conf)
+	require.NoError(h.t, err)
+	go func() {
+		_ = h.requestorServer.Serve(l, nil)
+	}()
+}
+
+// startClient starts a client without enrollments or credentials, using the harness keyshare server.
+func (h *harness) startClient() {
+	h.client, h.handler = parseStorage(h.t)
+	require.NoError(h.t, h.client.KeyshareRemoveAll())
+	require.NoError(h.t, h.client.RemoveStorage())
+	h.client.SetPreferences(irmaclient.Preferences{DeveloperMode: true})
+	h.client.Configuration.SchemeManagers[harnessScheme].KeyshareServer = h.keyshareURL
+}
+
+// enroll enrolls the client at the keyshare server, which issues the keyshare credential to it.
+func (h *harness) enroll() {
+	h.client.KeyshareEnroll(harnessScheme, nil, harnessPin, "en")
+	require.NoError(h.t, <-h.handler.c)
+	require.Contains(h.t, h.client.EnrolledSchemeManagers(), harnessScheme)
+
+	keyshareAttr := irma.NewAttributeTypeIdentifier(h.client.Configuration.SchemeManagers[harnessScheme].KeyshareAttribute)
+	keyshareCred := keyshareAttr.CredentialTypeIdentifier()
+	require.NotNil(h.t, h.client.Attributes(keyshareCred, 0))
+}
+
+// session performs a session with the client at the requestor server, and returns the session
+// result as reported by the requestor server.
+func (h *harness) session(request irma.SessionRequest) *server.SessionResult {
+	var pkg server.SessionPackage
+	require.NoError(h.t, irma.NewHTTPTransport(h.requestorURL, false).Post("session", &pkg, request))
+
+	c := make(chan *SessionResult, 1)
+	handler := &TestHandler{
+		t:                  h.t,
+		c:                  c,
+		client:             h.client,
+		expectedServerName: expectedRequestorInfo(h.t, h.client.Configuration),
+	}
+	bts, err := json.Marshal(pkg.SessionPtr)
+	require.NoError(h.t, err)
+	h.client.NewSession(string(bts), handler)
+	if result := <-c; result != nil {
+		require.NoError(h.t, result.Err)
+	}
+
+	return h.sessionResult(pkg.Token)
+}
+
+// sessionResult retrieves the session result from the requestor server, verifying the result JWT.
+func (h *harness) sessionResult(token irma.RequestorToken) *server.SessionResult {
+	var j string
+	transport := irma.NewHTTPTransport(h.requestorURL+"/session/"+string(token), false)
+	require.NoError(h.t, transport.Get("result-jwt", &j))
+
+	claims := struct {
+		jwt.RegisteredClaims
+		*server.SessionResult
+	}{}
+	_, err := jwt.ParseWithClaims(j, &claims, func(_ *jwt.Token) (interface{}, error) {
+		return h.jwtPublicKey, nil
+	})
+	require.NoError(h.t, err)
+	require.Equal(h.t, irma.ServerStatusDone, claims.Status)
+	return claims.SessionResult
+}
@@ -227,6 +227,7 @@ func IrmaServerConfiguration() *server.Configuration {
 		DisableSchemesUpdate:  true,
 		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
 		IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+		EgressAllowedNetworks: []string{"127.0.0.0/8", "::1"},
 		RevocationSettings: irma.RevocationSettings{
 			revocationTestCred:  {RevocationServerURL: revocationServerURL, SSE: true},
 			revKeyshareTestCred: {RevocationServerURL: revocationServerURL},
@@ -50,6 +50,60 @@ func TestKeyshareRegister(t *testing.T) {
 	keyshareSessions(t, client, irmaServer)
 }
 
+func TestKeyshareEnrollDevice(t *testing.T) {
+	testkeyshare.StartKeyshareServer(t, logger)
+	defer testkeyshare.StopKeyshareServer(t)
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	scheme := irma.NewSchemeManagerIdentifier("test")
+
+	// Obtain an enrollment code using the existing enrollment
+	success, _, _, err := client.KeyshareVerifyPin("12345", scheme)
+	require.NoError(t, err)
+	require.True(t, success)
+	code, err := client.KeyshareEnrollmentCode(scheme)
+	require.NoError(t, err)
+
+	// Enroll the client again as additional device, with another PIN
+	require.NoError(t, client.KeyshareRemoveAll())
+	require.NoError(t, client.RemoveStorage())
+	client.SetPreferences(irmaclient.Preferences{DeveloperMode: true})
+	client.KeyshareEnrollDevice(scheme, "testusername", code.Code, "54321", "Tablet")
+	require.NoError(t, <-handler.c)
+	require.Len(t, client.CredentialInfoList(), 1)
+
+	success, _, _, err = client.KeyshareVerifyPin("54321", scheme)
+	require.NoError(t, err)
+	require.True(t, success)
+
+	irmaServer := StartIrmaServer(t, nil)
+	defer irmaServer.Stop()
+	doSession(t, getIssuanceRequest(true), client, irmaServer, nil, nil, nil)
+	keyshareSessions(t, client, irmaServer)
+}
+
+func TestKeyshareEmail(t *testing.T) {
+	testkeyshare.StartKeyshareServer(t, logger)
+	defer testkeyshare.StopKeyshareServer(t)
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	scheme := irma.NewSchemeManagerIdentifier("test")
+
+	success, _, _, err := client.KeyshareVerifyPin("12345", scheme)
+	require.NoError(t, err)
+	require.True(t, success)
+	require.NoError(t, client.KeyshareRemoveEmail(scheme))
+
+	// The test keyshare server has no email server, so it cannot send the verification email
+	require.Error(t, client.KeyshareChangeEmail(scheme, "test@example.com", "en"))
+
+	// The registration policy of the scheme is checked before contacting the keyshare server
+	client.Configuration.SchemeManagers[scheme].KeyshareRegistration = &irma.KeyshareRegistrationPolicy{
+		Email: irma.KeyshareEmailRequired,
+	}
+	require.Error(t, client.KeyshareRemoveEmail(scheme))
+}
+
 // Use the existing keyshare enrollment and credentials
 // in a keyshare session of each session type.
 func TestKeyshareSessions(t *testing.T) {
@@ -105,3 +159,25 @@ func TestIssuanceCombinedMultiSchemeSession(t *testing.T) {
 	}, id)
 	doSession(t, request, nil, irmaServer, nil, nil, nil)
 }
+
+// Enroll a new client at an in-process keyshare server, and use the keyshare credential it issues
+// in a disclosure and a signature session at a requestor server.
+func TestKeyshareHarness(t *testing.T) {
+	h := startHarness(t)
+	defer h.stop()
+	h.enroll()
+
+	id := irma.NewAttributeTypeIdentifier("test.test.mijnirma.email")
+	result := h.session(getDisclosureRequest(id))
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Len(t, result.Disclosed, 1)
+	require.Len(t, result.Disclosed[0], 1)
+	require.NotEmpty(t, result.Disclosed[0][0].RawValue)
+
+	result = h.session(irma.NewSignatureRequest("Message signed using the keyshare server", id))
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.NotNil(t, result.Signature)
+	_, status, err := result.Signature.Verify(h.client.Configuration, nil)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+}
@@ -9,6 +9,7 @@ import (
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/privacybydesign/irmago/server"
 	"github.com/stretchr/testify/require"
 )
 
@@ -142,6 +143,53 @@ func TestManualSessionInvalidProof(t *testing.T) {
 	require.Equal(t, irma.ProofStatusInvalid, status)
 }
 
+func TestManualStandaloneSignature(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	attr := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := irma.NewSignatureRequest("I owe you everything", attr)
+	ms := createManualSessionHandler(t, client)
+	go client.SignMessage(request, ms)
+	result := <-ms.c
+	require.NoError(t, result.Err)
+	signature := result.SignatureResult
+	require.Equal(t, irma.SignatureModeStandalone, signature.Mode)
+
+	// The signature is valid on its own and against standalone requests, whose nonce is ignored
+	_, status, err := signature.Verify(client.Configuration, nil)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+	verifyAs := irma.NewSignatureRequest("I owe you everything", attr)
+	verifyAs.Mode = irma.SignatureModeStandalone
+	_, status, err = signature.Verify(client.Configuration, verifyAs)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+
+	// but not against a session request, even with the same nonce
+	verifyAs = irma.NewSignatureRequest("I owe you everything", attr)
+	verifyAs.Nonce = signature.Nonce
+	_, status, err = signature.Verify(client.Configuration, verifyAs)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusUnmatchedRequest, status)
+
+	// nor as a session-bound signature
+	signature.Mode = irma.SignatureModeSession
+	_, status, _ = signature.Verify(client.Configuration, nil)
+	require.Equal(t, irma.ProofStatusInvalid, status)
+}
+
+func TestStandaloneSignatureSession(t *testing.T) {
+	irmaServer := StartIrmaServer(t, nil)
+	defer irmaServer.Stop()
+
+	// Standalone signature requests cannot be used in sessions
+	request := irma.NewSignatureRequest("I owe you everything", irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	request.Mode = irma.SignatureModeStandalone
+	_, _, _, err := irmaServer.irma.StartSession(request, nil)
+	require.Error(t, err)
+}
+
 func TestManualDisclosureSession(t *testing.T) {
 	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
 	ms := createManualSessionHandler(t, nil)
@@ -152,6 +200,38 @@ func TestManualDisclosureSession(t *testing.T) {
 	require.Equal(t, irma.ProofStatusValid, status)
 }
 
+func TestManualDisclosureVerificationResult(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	bts, err := json.Marshal(request)
+	require.NoError(t, err)
+	ms := createManualSessionHandler(t, client)
+	go client.NewSession(string(bts), ms)
+	result := <-ms.c
+	require.NoError(t, result.Err)
+
+	res, err := server.VerifyDisclosure(client.Configuration, request, result.DisclosureResult)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, res.ProofStatus)
+	require.Equal(t, "456", res.Disclosed[0][0].Value["en"])
+	require.Len(t, res.Credentials, 1)
+	require.Equal(t, server.CredentialStatusValid, res.Credentials[0].Status)
+	require.Equal(t, irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"), res.Credentials[0].CredentialType)
+	require.Empty(t, res.Issues)
+
+	// Verifying against another request only affects the overall proof status
+	invalidRequest := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university"))
+	res, err = server.VerifyDisclosure(client.Configuration, invalidRequest, result.DisclosureResult)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusMissingAttributes, res.ProofStatus)
+	require.Equal(t, server.CredentialStatusValid, res.Credentials[0].Status)
+	require.Len(t, res.Issues, 1)
+	require.Equal(t, server.ProofIssueMissingAttributes, res.Issues[0].Code)
+	require.Equal(t, "irma-demo.RU.studentCard.university", res.Issues[0].Identifier)
+}
+
 // Test if proof verification fails with status 'MISSING_ATTRIBUTES' if we provide it with a non-matching disclosure request
 func TestManualDisclosureSessionInvalidRequest(t *testing.T) {
 	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
@@ -286,7 +286,7 @@ func TestRedisSessionFailure(t *testing.T) {
 	mr.Close()
 
 	clientChan := make(chan *SessionResult)
-	h := &TestHandler{t, clientChan, client, nil, 0, "", nil, nil, nil}
+	h := &TestHandler{t, clientChan, client, nil, 0, "", nil, nil, nil, time.Time{}}
 	client.NewSession(string(qrjson), h)
 	clientResult := <-h.c
 
@@ -97,6 +97,14 @@ func TestRevocationAll(t *testing.T) {
 		testRevocation(t, revocationTestAttr, client, handler, revServer.irma)
 	})
 
+	t.Run("RevocationPossessionProof", func(t *testing.T) {
+		revServer := startRevocationServer(t, true)
+		defer revServer.Stop()
+		client, handler := parseStorage(t)
+		defer test.ClearTestStorage(t, handler.storage)
+		testRevocation(t, irma.NewAttributeTypeIdentifier(revocationTestCred.String()), client, handler, revServer.irma)
+	})
+
 	t.Run("RevocationServerSessions", func(t *testing.T) {
 		revServer := startRevocationServer(t, true)
 		defer revServer.Stop()
@@ -775,6 +783,7 @@ func revocationConf(_ *testing.T) *server.Configuration {
 		DisableSchemesUpdate:  true,
 		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
 		IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+		EgressAllowedNetworks: []string{"127.0.0.0/8", "::1"},
 		RevocationSettings: irma.RevocationSettings{
 			revocationTestCred:  {Authority: true},
 			revKeyshareTestCred: {Authority: true},
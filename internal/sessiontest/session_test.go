@@ -7,10 +7,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -21,6 +23,7 @@ import (
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/privacybydesign/irmago/irmaclient"
 	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/requestorserver"
 	sseclient "github.com/sietseringers/go-sse"
 	"github.com/stretchr/testify/require"
 )
@@ -44,6 +47,7 @@ func TestRequestorServer(t *testing.T) {
 	t.Run("NoAttributeDisclosureSession", apply(testNoAttributeDisclosureSession, RequestorServerConfiguration))
 	t.Run("EmptyDisclosure", apply(testEmptyDisclosure, RequestorServerConfiguration))
 	t.Run("SigningSession", apply(testSigningSession, RequestorServerConfiguration))
+	t.Run("HashedSigningSession", apply(testHashedSigningSession, RequestorServerConfiguration))
 	t.Run("IssuanceSession", apply(testIssuanceSession, RequestorServerConfiguration))
 	t.Run("MultipleIssuanceSession", apply(testMultipleIssuanceSession, RequestorServerConfiguration))
 	t.Run("DefaultCredentialValidity", apply(testDefaultCredentialValidity, RequestorServerConfiguration))
@@ -54,13 +58,17 @@ func TestRequestorServer(t *testing.T) {
 	t.Run("IssuancePairing", apply(testIssuancePairing, RequestorServerConfiguration))
 	t.Run("LargeAttribute", apply(testLargeAttribute, RequestorServerConfiguration))
 	t.Run("IssuanceSingletonCredential", apply(testIssuanceSingletonCredential, RequestorServerConfiguration))
+	t.Run("IssuanceDuplicateCredentials", apply(testIssuanceDuplicateCredentials, RequestorServerConfiguration))
 	t.Run("UnsatisfiableDisclosureSession", apply(testUnsatisfiableDisclosureSession, RequestorServerConfiguration))
 	t.Run("AttributeByteEncoding", apply(testAttributeByteEncoding, RequestorServerConfiguration))
 	t.Run("IssuedCredentialIsStored", apply(testIssuedCredentialIsStored, RequestorServerConfiguration))
 	t.Run("BlindIssuanceSession", apply(testBlindIssuanceSession, RequestorServerConfiguration))
 	t.Run("DisablePairing", apply(testDisablePairing, RequestorServerConfiguration))
 	t.Run("DisclosureMultipleAttrs", apply(testDisclosureMultipleAttrs, RequestorServerConfiguration))
+	t.Run("DisclosureAllInstances", apply(testDisclosureAllInstances, RequestorServerConfiguration))
 	t.Run("CombinedSessionMultipleAttributes", apply(testCombinedSessionMultipleAttributes, RequestorServerConfiguration))
+	t.Run("IssuanceDisclosedAttributeValues", apply(testIssuanceDisclosedAttributeValues, RequestorServerConfiguration))
+	t.Run("PartialIssuance", apply(testPartialIssuance, RequestorServerConfiguration))
 	t.Run("ConDisCon", apply(testConDisCon, RequestorServerConfiguration))
 	t.Run("OptionalDisclosure", apply(testOptionalDisclosure, RequestorServerConfiguration))
 }
@@ -90,7 +98,17 @@ func TestIrmaServer(t *testing.T) {
 func testNoAttributeDisclosureSession(t *testing.T, conf interface{}, opts ...option) {
 	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard")
 	request := getDisclosureRequest(id)
-	doSession(t, request, nil, nil, nil, nil, conf, opts...)
+	res := doSession(t, request, nil, nil, nil, nil, conf, opts...)
+	require.Nil(t, res.Err)
+
+	// Only possession of the credential is proven, without any attribute value
+	require.Equal(t, irma.ProofStatusValid, res.ProofStatus)
+	require.Len(t, res.Disclosed, 1)
+	require.Len(t, res.Disclosed[0], 1)
+	require.Equal(t, id, res.Disclosed[0][0].Identifier)
+	require.Equal(t, irma.AttributeProofStatusPresent, res.Disclosed[0][0].Status)
+	require.Nil(t, res.Disclosed[0][0].RawValue)
+	require.Nil(t, res.Disclosed[0][0].Value)
 }
 
 func testEmptyDisclosure(t *testing.T, conf interface{}, opts ...option) {
@@ -254,6 +272,33 @@ func testIssuanceSingletonCredential(t *testing.T, conf interface{}, opts ...opt
 	require.Nil(t, client.Attributes(credid, 1))
 }
 
+func testIssuanceDuplicateCredentials(t *testing.T, conf interface{}, opts ...option) {
+	client, handler := parseStorage(t, opts...)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	// Multiple instances of a credential type that is not a singleton are all stored
+	credid := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	prevLen := len(client.CredentialInfoList())
+	request := getIssuanceRequest(false)
+	second := *request.Credentials[0]
+	second.Attributes = map[string]string{
+		"university":        "Radboud",
+		"studentCardNumber": "27182818",
+		"studentID":         "s7654321",
+		"level":             "43",
+	}
+	request.Credentials = append(request.Credentials, &second)
+
+	doSession(t, request, client, nil, nil, nil, conf, opts...)
+	require.Equal(t, prevLen+2, len(client.CredentialInfoList()))
+	studentIDs := map[string]bool{}
+	for i := 0; client.Attributes(credid, i) != nil; i++ {
+		studentIDs[client.Attributes(credid, i).Attribute(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))["en"]] = true
+	}
+	require.True(t, studentIDs["s1234567"])
+	require.True(t, studentIDs["s7654321"])
+}
+
 func testUnsatisfiableDisclosureSession(t *testing.T, conf interface{}, opts ...option) {
 	client, handler := parseStorage(t, opts...)
 	defer test.ClearTestStorage(t, handler.storage)
@@ -280,6 +325,27 @@ func testUnsatisfiableDisclosureSession(t *testing.T, conf interface{}, opts ...
 
 	missing := [][]irmaclient.DisclosureCandidates{}
 	require.NoError(t, json.Unmarshal([]byte(`[[[{"Type":"irma-demo.MijnOverheid.root.BSN","CredentialHash":"","Expired":false,"Revoked":false,"NotRevokable":false},{"Type":"irma-demo.RU.studentCard.level","CredentialHash":"5ac19c13941eb3b3687511a526adc1fdfa7a8c1bc976634e202671c2ba38c9fa","Expired":false,"Revoked":false,"NotRevokable":false}],[{"Type":"irma-demo.MijnOverheid.root.BSN","CredentialHash":"","Expired":false,"Revoked":false,"NotRevokable":false},{"Type":"irma-demo.RU.studentCard.level","CredentialHash":"","Expired":false,"Revoked":false,"NotRevokable":false}],[{"Type":"test.test.mijnirma.email","CredentialHash":"dc8d5f252ae0e87db6136ba74598682158bfe8d0d2e2fc4ee61dbf24aa2746d4","Expired":false,"Revoked":false,"NotRevokable":false},{"Type":"irma-demo.MijnOverheid.fullName.firstname","CredentialHash":"","Expired":false,"Revoked":false,"NotRevokable":false},{"Type":"irma-demo.MijnOverheid.fullName.familyname","CredentialHash":"","Expired":false,"Revoked":false,"NotRevokable":false}]],[[{"Type":"irma-demo.RU.studentCard.level","CredentialHash":"5ac19c13941eb3b3687511a526adc1fdfa7a8c1bc976634e202671c2ba38c9fa","Expired":false,"Revoked":false,"NotRevokable":false}],[{"Type":"irma-demo.RU.studentCard.level","CredentialHash":"","Expired":false,"Revoked":false,"NotRevokable":false}]]]`), &missing))
+
+	// Present candidates include the credential containing the attribute and the name of its issuer
+	credentials := map[string]*irma.CredentialInfo{}
+	for _, cred := range client.CredentialInfoList() {
+		credentials[cred.Hash] = cred
+	}
+	for _, discon := range missing {
+		for _, con := range discon {
+			for _, candidate := range con {
+				if candidate.CredentialHash == "" {
+					continue
+				}
+				candidate.Credential = credentials[candidate.CredentialHash]
+				require.NotNil(t, candidate.Credential)
+				require.NotEmpty(t, candidate.Credential.Attributes[candidate.Type])
+				candidate.IssuerName = client.Configuration.Issuers[candidate.Type.CredentialTypeIdentifier().IssuerIdentifier()].Name
+				require.NotEmpty(t, candidate.IssuerName)
+			}
+		}
+	}
+
 	require.True(t, reflect.DeepEqual(
 		missing,
 		doSession(t, request, client, nil, nil, nil, nil, append(opts, optionUnsatisfiableRequest)...).Missing),
@@ -403,7 +469,7 @@ func testStaticQRSession(t *testing.T, _ interface{}, opts ...option) {
 	c := make(chan *SessionResult)
 
 	// Perform session
-	client.NewSession(string(bts), &TestHandler{t, c, client, requestor, 0, "", nil, nil, nil})
+	client.NewSession(string(bts), &TestHandler{t, c, client, requestor, 0, "", nil, nil, nil, time.Time{}})
 	if result := <-c; result != nil {
 		require.NoError(t, result.Err)
 	}
@@ -599,6 +665,46 @@ func testSigningSession(t *testing.T, conf interface{}, opts ...option) {
 	require.Equal(t, irma.ProofStatusValid, status)
 }
 
+func testHashedSigningSession(t *testing.T, conf interface{}, opts ...option) {
+	client, handler := parseStorage(t, opts...)
+	defer test.ClearTestStorage(t, handler.storage)
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	message := "I owe you everything"
+	hash, err := irma.NewMessageHash(irma.MessageHashSHA256, []byte(message))
+	require.NoError(t, err)
+	request := irma.NewHashedSignatureRequest(hash, "IOU", id)
+
+	serverResult := doSession(t, request, client, nil, nil, nil, conf, opts...)
+	require.Nil(t, serverResult.Err)
+	require.Equal(t, irma.ProofStatusValid, serverResult.ProofStatus)
+	require.Equal(t, "456", serverResult.Disclosed[0][0].Value["en"])
+
+	sig := serverResult.Signature
+	require.Empty(t, sig.Message)
+	require.Equal(t, hash, sig.MessageHash)
+	require.Equal(t, "IOU", sig.MessageDisplay)
+
+	// The signature can be verified against the full message as well as against the hash
+	_, status, err := sig.Verify(client.Configuration, nil)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+	plain := irma.NewSignatureRequest(message, id)
+	plain.Nonce, plain.Context = sig.Nonce, sig.Context
+	_, status, err = sig.Verify(client.Configuration, plain)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+	plain.Message = "I owe you nothing"
+	_, status, err = sig.Verify(client.Configuration, plain)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusUnmatchedRequest, status)
+
+	// A signature cannot be over both a message and a message hash
+	sig.Message = message
+	_, status, err = sig.Verify(client.Configuration, nil)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusInvalid, status)
+}
+
 func testDisclosureSession(t *testing.T, conf interface{}, opts ...option) {
 	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
 	request := getDisclosureRequest(id)
@@ -625,10 +731,165 @@ func testDisclosureMultipleAttrs(t *testing.T, conf interface{}, opts ...option)
 	require.Len(t, serverResult.Disclosed, 2)
 }
 
+func testDisclosureAllInstances(t *testing.T, conf interface{}, opts ...option) {
+	client, handler := parseStorage(t, opts...)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	// Next to the studentCard with studentID 456 in the test storage, issue two more
+	for _, studentID := range []string{"s1234567", "s7654321"} {
+		ir := getIssuanceRequest(true)
+		ir.Credentials[0].Attributes["studentID"] = studentID
+		doSession(t, ir, client, nil, nil, nil, conf, opts...)
+	}
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := getDisclosureRequest(id)
+	request.AllInstances = []int{0}
+
+	// The client offers all instances as one option
+	candidates, satisfiable, err := client.Candidates(request)
+	require.NoError(t, err)
+	require.True(t, satisfiable)
+	require.Len(t, candidates[0], 1)
+	require.Len(t, candidates[0][0], 3)
+
+	serverResult := doSession(t, request, client, nil, nil, nil, conf, opts...)
+	require.Nil(t, serverResult.Err)
+	require.Equal(t, irma.ProofStatusValid, serverResult.ProofStatus)
+	require.Len(t, serverResult.Disclosed, 1)
+	require.Len(t, serverResult.Disclosed[0], 3)
+	values := map[string]struct{}{}
+	hashes := map[string]struct{}{}
+	for _, attr := range serverResult.Disclosed[0] {
+		require.Equal(t, id, attr.Identifier)
+		values[*attr.RawValue] = struct{}{}
+		hashes[attr.InstanceHash] = struct{}{}
+	}
+	require.Equal(t, map[string]struct{}{"456": {}, "s1234567": {}, "s7654321": {}}, values)
+	require.Len(t, hashes, 3)
+
+	// At most MaxInstances instances are disclosed
+	request.MaxInstances = 2
+	serverResult = doSession(t, request, client, nil, nil, nil, conf, opts...)
+	require.Equal(t, irma.ProofStatusValid, serverResult.ProofStatus)
+	require.Len(t, serverResult.Disclosed[0], 2)
+
+	// Instances disclosing the same values are reported once
+	ir := getIssuanceRequest(true)
+	ir.Credentials[0].Attributes["studentID"] = "s1234567"
+	doSession(t, ir, client, nil, nil, nil, conf, opts...)
+	request.MaxInstances = 0
+	serverResult = doSession(t, request, client, nil, nil, nil, conf, opts...)
+	require.Nil(t, serverResult.Err)
+	require.Equal(t, irma.ProofStatusValid, serverResult.ProofStatus)
+	require.Len(t, serverResult.Disclosed[0], 3)
+}
+
 func testIssuanceSession(t *testing.T, conf interface{}, opts ...option) {
 	doIssuanceSession(t, false, nil, conf, opts...)
 }
 
+func testIssuanceDisclosedAttributeValues(t *testing.T, conf interface{}, opts ...option) {
+	client, handler := parseStorage(t, opts...)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	credid := irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.singleton")
+	attrid := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.singleton.BSN")
+	request := irma.NewIssuanceRequest([]*irma.CredentialRequest{{
+		CredentialTypeID:    credid,
+		Attributes:          map[string]string{},
+		DisclosedAttributes: map[string]irma.AttributeTypeIdentifier{"BSN": irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")},
+	}}, irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+
+	res := doSession(t, request, client, nil, nil, nil, conf, opts...)
+	require.Nil(t, res.Err)
+	require.Len(t, res.Disclosed, 1)
+	require.Len(t, res.Disclosed[0], 1)
+	studentID := res.Disclosed[0][0].RawValue
+	require.NotNil(t, studentID)
+
+	// The client and server computed the same attribute value, otherwise the signature would not verify
+	attrs := client.Attributes(credid, 0)
+	require.NotNil(t, attrs)
+	require.Equal(t, *studentID, *attrs.UntranslatedAttribute(attrid))
+
+	// Referring to an attribute that is requested but not disclosed fails the session
+	request = irma.NewIssuanceRequest([]*irma.CredentialRequest{{
+		CredentialTypeID:    credid,
+		Attributes:          map[string]string{},
+		DisclosedAttributes: map[string]irma.AttributeTypeIdentifier{"BSN": irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")},
+	}}, irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	request.Disclose = append(request.Disclose, irma.AttributeDisCon{
+		irma.AttributeCon{},
+		irma.AttributeCon{irma.NewAttributeRequest("irma-demo.RU.studentCard.level")},
+	})
+	res = doSession(t, request, client, nil, nil, nil, conf, append(opts, optionIgnoreError)...)
+	require.NotNil(t, res.clientResult)
+	require.Error(t, res.clientResult.Err)
+	require.Equal(t, irma.ServerStatusCancelled, res.Status)
+	require.Equal(t, *studentID, *client.Attributes(credid, 0).UntranslatedAttribute(attrid))
+}
+
+func testPartialIssuance(t *testing.T, conf interface{}, opts ...option) {
+	client, handler := parseStorage(t, opts...)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	hasAttribute := func(id irma.AttributeTypeIdentifier, value string) bool {
+		for _, cred := range client.CredentialInfoList() {
+			if attr, ok := cred.Attributes[id]; ok && attr["en"] == value {
+				return true
+			}
+		}
+		return false
+	}
+	cardnumber := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentCardNumber")
+	firstname := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname")
+
+	// The second credential refers to an attribute that is requested in an optional disjunction,
+	// which the client does not disclose, so it cannot be issued
+	request := getMultipleIssuanceRequest()
+	request.Disclose = append(request.Disclose, irma.AttributeDisCon{
+		irma.AttributeCon{},
+		irma.AttributeCon{irma.NewAttributeRequest("irma-demo.RU.studentCard.level")},
+	})
+	request.Credentials[0].Attributes["studentCardNumber"] = "partial"
+	request.Credentials[1].Attributes["firstname"] = "Partial"
+	delete(request.Credentials[1].Attributes, "familyname")
+	request.Credentials[1].DisclosedAttributes = map[string]irma.AttributeTypeIdentifier{
+		"familyname": irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level"),
+	}
+
+	res := doSession(t, request, client, nil, nil, nil, conf, opts...)
+	require.Nil(t, res.Err)
+	require.Equal(t, irma.ServerStatusDone, res.Status)
+	require.True(t, res.PartiallyIssued)
+	require.Len(t, res.Credentials, 2)
+	require.True(t, res.Credentials[0].Issued)
+	require.Nil(t, res.Credentials[0].Err)
+	require.False(t, res.Credentials[1].Issued)
+	require.NotNil(t, res.Credentials[1].Err)
+	require.Equal(t, string(server.ErrorIssuanceFailed.Type), res.Credentials[1].Err.ErrorName)
+
+	// The client stored only the credential that was issued, and logged only that one as issued
+	require.True(t, hasAttribute(cardnumber, "partial"))
+	require.False(t, hasAttribute(firstname, "Partial"))
+	logs, err := client.LoadNewestLogs(1)
+	require.NoError(t, err)
+	issued, err := logs[0].GetIssuedCredentials(client.Configuration)
+	require.NoError(t, err)
+	require.Len(t, issued, 1)
+	require.Equal(t, "studentCard", issued[0].ID)
+
+	// In strict mode, none of the credentials are issued
+	request.Credentials[0].Attributes["studentCardNumber"] = "strict"
+	request.StrictIssuance = true
+	res = doSession(t, request, client, nil, nil, nil, conf, append(opts, optionIgnoreError)...)
+	require.NotNil(t, res.clientResult)
+	require.Error(t, res.clientResult.Err)
+	require.Equal(t, irma.ServerStatusCancelled, res.Status)
+	require.False(t, hasAttribute(cardnumber, "strict"))
+}
+
 func testCombinedSessionMultipleAttributes(t *testing.T, conf interface{}, opts ...option) {
 	var ir irma.IssuanceRequest
 	require.NoError(t, irma.UnmarshalValidate([]byte(`{
@@ -978,6 +1239,251 @@ func TestPOSTSizeLimit(t *testing.T) {
 	require.Equal(t, "http: request body too large", rerr.Message)
 }
 
+func TestSeparateClientServer(t *testing.T) {
+	conf := RequestorServerConfiguration()
+	conf.URL = "http://localhost:port/irma"
+	conf.ClientPort = requestorServerPort + 10
+	rs, err := requestorserver.New(conf)
+	require.NoError(t, err)
+	defer rs.Stop()
+	requestorHandler, clientHandler := rs.RequestorHandler(), rs.ClientHandler()
+
+	do := func(handler http.Handler, method, path string, body interface{}) *httptest.ResponseRecorder {
+		bts, err := json.Marshal(body)
+		require.NoError(t, err)
+		req := httptest.NewRequest(method, path, bytes.NewReader(bts))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	// Sessions can be started only at the requestor handler
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	require.Equal(t, http.StatusNotFound, do(clientHandler, http.MethodPost, "/session", request).Code)
+	res := do(requestorHandler, http.MethodPost, "/session", request)
+	require.Equal(t, http.StatusOK, res.Code)
+	var pkg server.SessionPackage
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &pkg))
+
+	// The session pointer points to the client server
+	clientURL := fmt.Sprintf("http://localhost:%d/irma/session/", conf.ClientPort)
+	require.True(t, strings.HasPrefix(pkg.SessionPtr.URL, clientURL), pkg.SessionPtr.URL)
+	clientPath := "/irma/session/" + strings.TrimPrefix(pkg.SessionPtr.URL, clientURL) + "/status"
+
+	// Both handlers serve their own endpoints for the session (sharing the session store), and only those
+	require.Equal(t, http.StatusOK, do(clientHandler, http.MethodGet, clientPath, nil).Code)
+	require.Equal(t, http.StatusNotFound, do(requestorHandler, http.MethodGet, clientPath, nil).Code)
+	requestorPath := "/session/" + string(pkg.Token) + "/status"
+	require.Equal(t, http.StatusOK, do(requestorHandler, http.MethodGet, requestorPath, nil).Code)
+	require.Equal(t, http.StatusNotFound, do(clientHandler, http.MethodGet, requestorPath, nil).Code)
+
+	// In single-listener mode, Handler() serves both
+	conf = RequestorServerConfiguration()
+	rs2, err := requestorserver.New(conf)
+	require.NoError(t, err)
+	defer rs2.Stop()
+	res = do(rs2.Handler(), http.MethodPost, "/session", request)
+	require.Equal(t, http.StatusOK, res.Code)
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &pkg))
+	require.True(t, strings.HasPrefix(pkg.SessionPtr.URL, requestorServerURL+"/irma/session/"), pkg.SessionPtr.URL)
+	clientPath = "/irma/session/" + strings.TrimPrefix(pkg.SessionPtr.URL, requestorServerURL+"/irma/session/") + "/status"
+	require.Equal(t, http.StatusOK, do(rs2.Handler(), http.MethodGet, clientPath, nil).Code)
+}
+
+func TestRequestTemplates(t *testing.T) {
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	conf := RequestorServerConfiguration()
+	conf.RequestTemplates = map[string]interface{}{"student-id": irma.NewDisclosureRequest(studentID)}
+	conf.AdminToken = "admintoken"
+	rs := StartRequestorServer(t, conf)
+	defer rs.Stop()
+
+	transport := irma.NewHTTPTransport(requestorServerURL, false)
+	admin := irma.NewHTTPTransport(requestorServerURL+"/admin", false)
+	admin.SetHeader("Authorization", "Bearer admintoken")
+
+	// Start a session using the template
+	var sesPkg server.SessionPackage
+	err := transport.Post("session", &sesPkg, map[string]interface{}{
+		"template":  "student-id",
+		"overrides": map[string]interface{}{"labels": map[string]interface{}{"0": map[string]string{"en": "Student number"}}},
+	})
+	require.NoError(t, err)
+
+	// Updating the template does not affect the session that was already started
+	var res string
+	err = admin.Post("templates/student-id", &res, irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university")))
+	require.NoError(t, err)
+	require.Equal(t, "OK", res)
+
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	h := &TestHandler{
+		t:                  t,
+		c:                  make(chan *SessionResult),
+		client:             client,
+		expectedServerName: expectedRequestorInfo(t, client.Configuration),
+	}
+	qrjson, err := json.Marshal(sesPkg.SessionPtr)
+	require.NoError(t, err)
+	client.NewSession(string(qrjson), h)
+	if result := <-h.c; result != nil {
+		require.NoError(t, result.Err)
+	}
+
+	var result server.SessionResult
+	require.NoError(t, transport.Get("session/"+string(sesPkg.Token)+"/result", &result))
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Equal(t, "student-id", result.Template)
+	require.Equal(t, studentID, result.Disclosed[0][0].Identifier)
+
+	// Only the labels and client return URL can be overridden
+	err = transport.Post("session", &sesPkg, map[string]interface{}{
+		"template":  "student-id",
+		"overrides": map[string]interface{}{"callbackUrl": "https://example.com"},
+	})
+	require.Error(t, err)
+	require.Equal(t, "INVALID_REQUEST", err.(*irma.SessionError).RemoteError.ErrorName)
+
+	err = transport.Post("session", &sesPkg, map[string]interface{}{"template": "unknown"})
+	require.Error(t, err)
+	require.Equal(t, "UNKNOWN_TEMPLATE", err.(*irma.SessionError).RemoteError.ErrorName)
+
+	// The administration endpoints require the admin token
+	unauthorized := irma.NewHTTPTransport(requestorServerURL+"/admin", false)
+	unauthorized.SetHeader("Authorization", "Bearer wrongtoken")
+	err = unauthorized.Get("templates", &res)
+	require.Error(t, err)
+	require.Equal(t, http.StatusForbidden, err.(*irma.SessionError).RemoteStatus)
+
+	var templates []struct {
+		Name    string          `json:"name"`
+		Request json.RawMessage `json:"request"`
+	}
+	require.NoError(t, admin.Get("templates", &templates))
+	require.Len(t, templates, 1)
+	require.Equal(t, "student-id", templates[0].Name)
+
+	req, err := http.NewRequest(http.MethodDelete, requestorServerURL+"/admin/templates/student-id", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer admintoken")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	err = transport.Post("session", &sesPkg, map[string]interface{}{"template": "student-id"})
+	require.Error(t, err)
+	require.Equal(t, "UNKNOWN_TEMPLATE", err.(*irma.SessionError).RemoteError.ErrorName)
+}
+
+func TestResultFiltering(t *testing.T) {
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	university := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university")
+	rs := StartRequestorServer(t, RequestorServerConfiguration())
+	defer rs.Stop()
+
+	transport := irma.NewHTTPTransport(requestorServerURL, false)
+	var sesPkg server.SessionPackage
+	require.NoError(t, transport.Post("session", &sesPkg, irma.NewDisclosureRequest(studentID, university)))
+
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	h := &TestHandler{
+		t:                  t,
+		c:                  make(chan *SessionResult),
+		client:             client,
+		expectedServerName: expectedRequestorInfo(t, client.Configuration),
+	}
+	qrjson, err := json.Marshal(sesPkg.SessionPtr)
+	require.NoError(t, err)
+	client.NewSession(string(qrjson), h)
+	if result := <-h.c; result != nil {
+		require.NoError(t, result.Err)
+	}
+	path := "session/" + string(sesPkg.Token) + "/result"
+
+	// The disclosed attributes can be filtered
+	var result server.SessionResult
+	require.NoError(t, transport.Get(path+"?attributes="+university.String(), &result))
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Len(t, result.Disclosed, 2)
+	require.Empty(t, result.Disclosed[0])
+	require.Len(t, result.Disclosed[1], 1)
+	require.Equal(t, university, result.Disclosed[1][0].Identifier)
+
+	// and returned as a map of attribute values
+	var flat map[irma.AttributeTypeIdentifier]string
+	require.NoError(t, transport.Get(path+"?format=flat", &flat))
+	require.Equal(t, map[irma.AttributeTypeIdentifier]string{studentID: "456", university: "Radboud"}, flat)
+	flat = nil
+	require.NoError(t, transport.Get(path+"?format=flat&attributes="+studentID.String(), &flat))
+	require.Equal(t, map[irma.AttributeTypeIdentifier]string{studentID: "456"}, flat)
+
+	// Only requested attributes can be included
+	err = transport.Get(path+"?attributes="+studentID.String()+",irma-demo.RU.studentCard.level", &result)
+	require.Error(t, err)
+	require.Equal(t, string(server.ErrorInvalidRequest.Type), err.(*irma.SessionError).RemoteError.ErrorName)
+	require.Contains(t, err.(*irma.SessionError).RemoteError.Message, "irma-demo.RU.studentCard.level")
+	err = transport.Get(path+"?format=xml", &result)
+	require.Error(t, err)
+	require.Equal(t, string(server.ErrorInvalidRequest.Type), err.(*irma.SessionError).RemoteError.ErrorName)
+}
+
+func TestDisabledSessionTypes(t *testing.T) {
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	requests := map[irma.Action]irma.SessionRequest{
+		irma.ActionDisclosing: getDisclosureRequest(id),
+		irma.ActionSigning:    getSigningRequest(id),
+		irma.ActionIssuing:    getIssuanceRequest(true),
+	}
+
+	for _, disabled := range []irma.Action{"", irma.ActionDisclosing, irma.ActionSigning, irma.ActionIssuing} {
+		conf := RequestorServerAuthConfiguration()
+		conf.StaticSessions = nil
+		conf.Permissions = requestorserver.Permissions{}
+		conf.Requestors = map[string]requestorserver.Requestor{
+			"permitted": {
+				AuthenticationMethod: requestorserver.AuthenticationMethodToken,
+				AuthenticationKey:    "permittedtoken",
+				Permissions: requestorserver.Permissions{
+					Disclosing: []string{"*"},
+					Signing:    []string{"*"},
+					Issuing:    []string{"*"},
+				},
+			},
+			"denied": {
+				AuthenticationMethod: requestorserver.AuthenticationMethodToken,
+				AuthenticationKey:    "deniedtoken",
+			},
+		}
+		conf.DisableDisclosure = disabled == irma.ActionDisclosing
+		conf.DisableSigning = disabled == irma.ActionSigning
+		conf.DisableIssuance = disabled == irma.ActionIssuing
+		rs := StartRequestorServer(t, conf)
+
+		for action, request := range requests {
+			for requestor, expected := range map[string]string{"permitted": "", "denied": "UNAUTHORIZED"} {
+				// The global setting takes precedence over the permissions of the requestor
+				if action == disabled {
+					expected = "SESSION_TYPE_DISABLED"
+				}
+				transport := irma.NewHTTPTransport(requestorServerURL, false)
+				transport.SetHeader("Authorization", requestor+"token")
+				var sesPkg server.SessionPackage
+				err := transport.Post("session", &sesPkg, request)
+				if expected == "" {
+					require.NoError(t, err, "%s session of %s with %s disabled", action, requestor, disabled)
+				} else {
+					require.Error(t, err, "%s session of %s with %s disabled", action, requestor, disabled)
+					require.Equal(t, expected, err.(*irma.SessionError).RemoteError.ErrorName)
+				}
+			}
+		}
+		rs.Stop()
+	}
+}
+
 func TestStatusEventsSSE(t *testing.T) {
 	// Start a server with SSE enabled
 	conf := RequestorServerConfiguration()
@@ -1080,6 +1586,205 @@ func TestInvalidRequest(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestInvalidAllInstancesRequest(t *testing.T) {
+	irmaServer := StartIrmaServer(t, nil)
+	defer irmaServer.Stop()
+
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	request.AllInstances = []int{1}
+	_, _, _, err := irmaServer.irma.StartSession(request, nil)
+	require.Error(t, err)
+
+	request.AllInstances = []int{0}
+	request.MaxInstances = irma.DefaultMaxInstances + 1
+	_, _, _, err = irmaServer.irma.StartSession(request, nil)
+	require.Error(t, err)
+
+	request.Disclose = irma.AttributeConDisCon{{{
+		irma.NewAttributeRequest("irma-demo.RU.studentCard.studentID"),
+		irma.NewAttributeRequest("irma-demo.MijnOverheid.fullName.familyname"),
+	}}}
+	request.MaxInstances = 0
+	_, _, _, err = irmaServer.irma.StartSession(request, nil)
+	require.Error(t, err)
+}
+
+func TestDuplicateSingletonIssuance(t *testing.T) {
+	irmaServer := StartIrmaServer(t, nil)
+	defer irmaServer.Stop()
+
+	singleton := &irma.CredentialRequest{
+		CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.singleton"),
+		Attributes:       map[string]string{"BSN": "299792458"},
+	}
+	other := *singleton
+	other.Attributes = map[string]string{"BSN": "314159265"}
+	_, _, _, err := irmaServer.irma.StartSession(irma.NewIssuanceRequest([]*irma.CredentialRequest{singleton, &other}), nil)
+	require.Error(t, err)
+	require.Equal(t, irma.ErrorDuplicateCredential, err.(*irma.SessionError).ErrorType)
+}
+
+func TestInvalidAttributeValueIssuance(t *testing.T) {
+	irmaServer := StartIrmaServer(t, nil)
+	defer irmaServer.Stop()
+
+	request := getIssuanceRequest(false)
+	request.Credentials[0].Attributes["university"] = "Radboud\x00"
+	_, _, _, err := irmaServer.irma.StartSession(request, nil)
+	require.Error(t, err)
+	require.Equal(t, irma.ErrorInvalidAttributeValue, err.(*irma.SessionError).ErrorType)
+	require.Contains(t, err.Error(), "irma-demo.RU.studentCard.university")
+
+	request.Credentials[0].Attributes["university"] = "Radboud\xff"
+	_, _, _, err = irmaServer.irma.StartSession(request, nil)
+	require.Error(t, err)
+	require.Equal(t, irma.ErrorInvalidAttributeValue, err.(*irma.SessionError).ErrorType)
+
+	// Values longer than the message space of the public key are hashed into it
+	request.Credentials[0].Attributes["university"] = strings.Repeat("Radboud ", 5)
+	_, _, _, err = irmaServer.irma.StartSession(request, nil)
+	require.NoError(t, err)
+}
+
+// Check that the session result mentions the requestor that authenticated the session request
+func TestSessionResultRequestor(t *testing.T) {
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+
+	// Without configuration, doSession signs the request as requestor1
+	result := doSession(t, request, nil, nil, nil, nil, nil)
+	require.Nil(t, result.Err)
+	require.Equal(t, "requestor1", result.Requestor)
+
+	result = doSession(t, request, nil, nil, nil, nil, RequestorServerConfiguration)
+	require.Nil(t, result.Err)
+	require.Empty(t, result.Requestor)
+}
+
+func TestSessionHooks(t *testing.T) {
+	var lock sync.Mutex
+	var created []irma.RequestorToken
+	var statuses []irma.ServerStatus
+	conf := IrmaServerConfiguration()
+	conf.Hooks = &server.Hooks{
+		OnSessionCreated: func(token irma.RequestorToken, action irma.Action) {
+			lock.Lock()
+			defer lock.Unlock()
+			created = append(created, token)
+		},
+		OnSessionStatusChange: func(token irma.RequestorToken, old, new irma.ServerStatus) {
+			lock.Lock()
+			defer lock.Unlock()
+			if len(statuses) == 0 {
+				statuses = append(statuses, old)
+			}
+			statuses = append(statuses, new)
+		},
+	}
+	irmaServer := StartIrmaServer(t, conf)
+	defer irmaServer.Stop()
+
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	doSession(t, request, nil, irmaServer, nil, nil, nil)
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Len(t, created, 1)
+	require.Equal(t, irma.ServerStatusInitialized, statuses[0])
+	require.Equal(t, irma.ServerStatusDone, statuses[len(statuses)-1])
+	require.Contains(t, statuses, irma.ServerStatusConnected)
+}
+
+func TestSessionExpiry(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	irmaServer := StartIrmaServer(t, nil)
+	defer irmaServer.Stop()
+
+	request := &irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{ClientTimeout: 30},
+		Request:              getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+	}
+	sesPkg := startSessionAtServer(t, irmaServer, nil, request)
+	sessionHandler, clientChan := createSessionHandler(t, 0, client, sesPkg, nil, nil)
+	startSessionAtClient(t, sesPkg, client, sessionHandler)
+	require.Nil(t, <-clientChan)
+
+	// The client connected, after which the session expires after the maximum session lifetime
+	// instead of the client timeout of the request
+	lifetime := time.Duration(irmaServer.conf.MaxSessionLifetime) * time.Minute
+	require.WithinDuration(t, time.Now().Add(lifetime), sessionHandler.(*TestHandler).expiresAt, 5*time.Second)
+}
+
+func TestCredentialTypeAssets(t *testing.T) {
+	irmaServer := StartIrmaServer(t, nil)
+	defer irmaServer.Stop()
+	url := fmt.Sprintf("http://localhost:%d/credentialtypes/", irmaServerPort)
+
+	var metadata irma.CredentialTypeMetadata
+	require.NoError(t, irma.NewHTTPTransport(url, false).Get("irma-demo.RU.studentCard", &metadata))
+	require.Equal(t, irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"), metadata.ID)
+	require.Equal(t, "Demo Student Card", metadata.Name["en"])
+	require.Equal(t, "Demo Radboud University Nijmegen", metadata.IssuerName["en"])
+	require.Len(t, metadata.Attributes, 4)
+	require.True(t, metadata.HasLogo)
+
+	res, err := http.Get(url + "irma-demo.RU.studentCard/logo")
+	require.NoError(t, err)
+	logo, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "image/png", res.Header.Get("Content-Type"))
+	expected, err := ioutil.ReadFile(filepath.Join(testdata, "irma_configuration", "irma-demo", "RU", "Issues", "studentCard", "logo.png"))
+	require.NoError(t, err)
+	require.Equal(t, expected, logo)
+
+	// Unmodified logos are not sent again
+	etag := res.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+	req, err := http.NewRequest(http.MethodGet, url+"irma-demo.RU.studentCard/logo", nil)
+	require.NoError(t, err)
+	req.Header.Set("If-None-Match", etag)
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusNotModified, res.StatusCode)
+
+	err = irma.NewHTTPTransport(url, false).Get("irma-demo.RU.nonexisting", &metadata)
+	require.Error(t, err)
+	require.Equal(t, string(server.ErrorUnknownCredentialType.Type), err.(*irma.SessionError).RemoteError.ErrorName)
+}
+
+func TestFetchMissingLogo(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	irmaServer := StartIrmaServer(t, nil)
+	defer irmaServer.Stop()
+
+	// Remove the logo from the scheme of the client, as if the credential type were added to the
+	// scheme of the server after the client last updated it
+	id := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	logo := client.Configuration.CredentialTypes[id].Logo(client.Configuration)
+	require.NotEmpty(t, logo)
+	require.NoError(t, os.Remove(logo))
+	require.Empty(t, client.CredentialTypeLogo(id))
+
+	doSession(t, getIssuanceRequest(true), client, irmaServer, nil, nil, nil)
+
+	// The logo is fetched in the background
+	for i := 0; i < 20 && client.CredentialTypeLogo(id) == ""; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	fetched := client.CredentialTypeLogo(id)
+	require.NotEmpty(t, fetched)
+	require.NotEqual(t, logo, fetched)
+	bts, err := ioutil.ReadFile(fetched)
+	require.NoError(t, err)
+	expected, err := ioutil.ReadFile(filepath.Join(testdata, "irma_configuration", "irma-demo", "RU", "Issues", "studentCard", "logo.png"))
+	require.NoError(t, err)
+	require.Equal(t, expected, bts)
+}
+
 func TestDoubleGET(t *testing.T) {
 	irmaServer := StartIrmaServer(t, nil)
 	defer irmaServer.Stop()
@@ -1097,6 +1802,29 @@ func TestDoubleGET(t *testing.T) {
 	require.NoError(t, transport.Get("", &o))
 }
 
+func TestSessionDescription(t *testing.T) {
+	irmaServer := StartIrmaServer(t, nil)
+	defer irmaServer.Stop()
+	qr, _, frontendRequest, err := irmaServer.irma.StartSession(irma.NewDisclosureRequest(
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+	), nil)
+	require.NoError(t, err)
+
+	// The frontend authorization is required
+	var description irma.RequestDescription
+	transport := irma.NewHTTPTransport(qr.URL, false)
+	err = transport.Get("description?lang=nl", &description)
+	require.Error(t, err)
+	require.Equal(t, server.ErrorIrmaUnauthorized.Status, err.(*irma.SessionError).RemoteStatus)
+
+	transport.SetHeader(irma.AuthorizationHeader, string(frontendRequest.Authorization))
+	require.NoError(t, transport.Get("description?lang=nl", &description))
+	require.Len(t, description.Disjunctions, 1)
+	require.Len(t, description.Disjunctions[0].Options, 1)
+	require.Equal(t, "Studentnummer", description.Disjunctions[0].Options[0][0].Name)
+	require.Equal(t, "Demo Radboud Universiteit Nijmegen", description.Disjunctions[0].Options[0][0].Issuer)
+}
+
 func TestClientDeveloperMode(t *testing.T) {
 	common.ForceHTTPS = true
 	defer func() { common.ForceHTTPS = false }()
@@ -1122,7 +1850,7 @@ func TestClientDeveloperMode(t *testing.T) {
 	c := make(chan *SessionResult, 1)
 	j, err := json.Marshal(qr)
 	require.NoError(t, err)
-	client.NewSession(string(j), &TestHandler{t, c, client, nil, 0, "", nil, nil, nil})
+	client.NewSession(string(j), &TestHandler{t, c, client, nil, 0, "", nil, nil, nil, time.Time{}})
 	result := <-c
 
 	// Check that it failed with an appropriate error message
@@ -1210,3 +1938,106 @@ func TestIssueExpiredKey(t *testing.T) {
 	_, _, _, err := irmaServer.irma.StartSession(getIssuanceRequest(true), nil)
 	require.Error(t, err)
 }
+
+func TestIssueKeyCounter(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	irmaServer := StartIrmaServer(t, nil)
+	defer irmaServer.Stop()
+
+	credid := irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.singleton")
+	attrid := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.singleton.BSN")
+	request := func(counter uint) *irma.IssuanceRequest {
+		return irma.NewIssuanceRequest([]*irma.CredentialRequest{{
+			CredentialTypeID: credid,
+			KeyCounter:       &counter,
+			Attributes:       map[string]string{"BSN": "299792458"},
+		}})
+	}
+
+	// Issue under key 1, while the server also has the private key with counter 2
+	sk, err := irmaServer.conf.IrmaConfiguration.PrivateKeys.Latest(credid.IssuerIdentifier())
+	require.NoError(t, err)
+	require.Equal(t, uint(2), sk.Counter)
+	result := doSession(t, request(1), client, irmaServer, nil, nil, nil)
+	require.Nil(t, result.Err)
+
+	// The metadata attribute refers to the requested key, against which disclosures verify
+	attrs := client.Attributes(credid, 0)
+	require.NotNil(t, attrs)
+	require.Equal(t, uint(1), attrs.MetadataAttribute.KeyCounter())
+	result = doSession(t, getDisclosureRequest(attrid), client, irmaServer, nil, nil, nil)
+	require.Nil(t, result.Err)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Equal(t, "299792458", *result.Disclosed[0][0].RawValue)
+
+	// Sessions requesting expired or missing keys are refused
+	_, _, _, err = irmaServer.irma.StartSession(request(0), nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "expired public key irma-demo.MijnOverheid-0")
+	_, _, _, err = irmaServer.irma.StartSession(request(7), nil)
+	require.Error(t, err)
+}
+
+func TestTestCredentials(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	credid := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	cardnumber := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentCardNumber")
+	issue := func(irmaServer *IrmaServer, number string) *irma.CredentialInfo {
+		request := getIssuanceRequest(true)
+		request.Credentials[0].Attributes["studentCardNumber"] = number
+		doSession(t, request, client, irmaServer, nil, nil, nil)
+		for _, cred := range client.CredentialInfoList() {
+			if cred.Attributes[cardnumber]["en"] == number {
+				return cred
+			}
+		}
+		require.FailNow(t, "issued credential not found")
+		return nil
+	}
+	disclosureRequest := func(number string) *irma.DisclosureRequest {
+		request := irma.NewDisclosureRequest()
+		request.Disclose = irma.AttributeConDisCon{{{{Type: cardnumber, Value: &number}}}}
+		return request
+	}
+
+	// A server not in production mode issues test credentials
+	irmaServer := StartIrmaServer(t, nil)
+	require.True(t, issue(irmaServer, "test").TestCredential)
+	res := doSession(t, disclosureRequest("test"), client, irmaServer, nil, nil, nil)
+	require.Equal(t, irma.ProofStatusValid, res.ProofStatus)
+	require.True(t, res.Disclosed[0][0].TestCredential)
+
+	// unless the client does not support them
+	version := extractClientMaxVersion(client)
+	*version = irma.ProtocolVersion{Major: 2, Minor: 10}
+	require.False(t, issue(irmaServer, "old").TestCredential)
+	*version = irma.ProtocolVersion{Major: 2, Minor: 11}
+	irmaServer.Stop()
+
+	// A production server issues test credentials only of demo schemes
+	conf := IrmaServerConfiguration()
+	conf.Production = true
+	conf.DisableTLS = true
+	irmaServer = StartIrmaServer(t, conf)
+	require.True(t, issue(irmaServer, "demo").TestCredential)
+	conf.IrmaConfiguration.SchemeManagers[credid.SchemeManagerIdentifier()].Demo = false
+	require.False(t, issue(irmaServer, "production").TestCredential)
+	irmaServer.Stop()
+
+	// Servers can be configured to reject test credentials
+	conf = IrmaServerConfiguration()
+	conf.RejectTestCredentials = true
+	irmaServer = StartIrmaServer(t, conf)
+	defer irmaServer.Stop()
+	res = doSession(t, disclosureRequest("production"), client, irmaServer, nil, nil, nil)
+	require.Equal(t, irma.ProofStatusValid, res.ProofStatus)
+	require.False(t, res.Disclosed[0][0].TestCredential)
+	res = doSession(t, disclosureRequest("test"), client, irmaServer, nil, nil, nil, optionIgnoreError)
+	require.Error(t, res.clientResult.Err)
+	require.Equal(t, irma.ProofStatusTestCredential, res.ProofStatus)
+	require.Len(t, res.ProofDetails, 1)
+	require.Equal(t, server.ProofIssueTestCredential, res.ProofDetails[0].Code)
+	require.Equal(t, credid.String(), res.ProofDetails[0].Identifier)
+}
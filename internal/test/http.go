@@ -30,6 +30,14 @@ func HTTPGet(t *testing.T, client *http.Client, url string, headers http.Header,
 	httpDo(t, client, url, "GET", "", headers, expectedStatus, result)
 }
 
+func HTTPPut(t *testing.T, client *http.Client, url, body string, headers http.Header, expectedStatus int, result interface{}) {
+	httpDo(t, client, url, "PUT", body, headers, expectedStatus, result)
+}
+
+func HTTPDelete(t *testing.T, client *http.Client, url string, headers http.Header, expectedStatus int, result interface{}) {
+	httpDo(t, client, url, "DELETE", "", headers, expectedStatus, result)
+}
+
 func httpDo(t *testing.T, client *http.Client, url, method, body string, headers http.Header, expectedStatus int, result interface{}) {
 	var buf io.Reader
 	if body != "" {
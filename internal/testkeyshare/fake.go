@@ -0,0 +1,126 @@
+package testkeyshare
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/keyshare/keyshareserver"
+	"github.com/sirupsen/logrus"
+)
+
+// FakeKeyshareServer is an in-process keyshare server listening on a random port, containing the
+// same users as the server started by StartKeyshareServer(). By default requests are handled by
+// an actual keyshare server, but the responses of individual endpoints can be overridden to
+// simulate wrong PINs, blocked accounts, expired tokens or malformed responses.
+type FakeKeyshareServer struct {
+	*httptest.Server
+
+	keyshareServer *keyshareserver.Server
+	handler        http.Handler
+	mutex          sync.Mutex
+	overrides      map[string]http.HandlerFunc
+}
+
+// StartFakeKeyshareServer starts a new FakeKeyshareServer. Use Stop() to shut it down.
+func StartFakeKeyshareServer(t *testing.T, l *logrus.Logger) *FakeKeyshareServer {
+	s := &FakeKeyshareServer{
+		Server:    httptest.NewUnstartedServer(nil),
+		overrides: map[string]http.HandlerFunc{},
+	}
+	s.keyshareServer = newKeyshareServer(t, l, "http://"+s.Listener.Addr().String()+"/")
+
+	handler := s.keyshareServer.Handler()
+	s.handler = handler
+	s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		override := s.overrides[r.URL.Path]
+		s.mutex.Unlock()
+		if override != nil {
+			override(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+	s.Start()
+	return s
+}
+
+// Stop shuts down the server.
+func (s *FakeKeyshareServer) Stop() {
+	s.Close()
+	s.keyshareServer.Stop()
+}
+
+// Use configures the specified scheme to use this keyshare server.
+func (s *FakeKeyshareServer) Use(conf *irma.Configuration, scheme irma.SchemeManagerIdentifier) {
+	conf.SchemeManagers[scheme].KeyshareServer = s.URL
+}
+
+// Override handles all subsequent requests to the specified path (e.g. "/users/verify/pin")
+// using the specified handler.
+func (s *FakeKeyshareServer) Override(path string, handler http.HandlerFunc) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.overrides[path] = handler
+}
+
+// Respond makes all subsequent requests to the specified path return the specified status code and
+// response. If response is a string it is returned as is, otherwise it is serialized to JSON.
+func (s *FakeKeyshareServer) Respond(path string, status int, response interface{}) {
+	s.Override(path, func(w http.ResponseWriter, r *http.Request) {
+		bts, ok := response.([]byte)
+		if str, isstr := response.(string); isstr {
+			bts, ok = []byte(str), true
+		}
+		if !ok {
+			bts, _ = json.Marshal(response)
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write(bts)
+	})
+}
+
+// RespondError makes all subsequent requests to the specified path return the specified error.
+func (s *FakeKeyshareServer) RespondError(path string, err server.Error, message string) {
+	s.Override(path, func(w http.ResponseWriter, r *http.Request) {
+		server.WriteError(w, err, message)
+	})
+}
+
+// Refuse makes the specified amount of subsequent requests to the specified path fail with
+// 429 Too Many Requests and the specified Retry-After header, after which requests are handled
+// normally again. The returned function returns the amount of requests made to the path since.
+func (s *FakeKeyshareServer) Refuse(path string, times int, retryAfter string) func() int {
+	var mutex sync.Mutex
+	var count int
+	s.Override(path, func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		count++
+		refuse := count <= times
+		mutex.Unlock()
+		if !refuse {
+			s.handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", retryAfter)
+		server.WriteError(w, server.ErrorTooManyRequests, "")
+	})
+	return func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return count
+	}
+}
+
+// Reset removes all overrides.
+func (s *FakeKeyshareServer) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.overrides = map[string]http.HandlerFunc{}
+}
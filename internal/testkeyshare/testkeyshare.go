@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"net/http"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	irma "github.com/privacybydesign/irmago"
@@ -20,8 +21,30 @@ import (
 var keyshareServ *http.Server
 
 func StartKeyshareServer(t *testing.T, l *logrus.Logger) {
+	s := newKeyshareServer(t, l, "http://localhost:8080/")
+
+	keyshareServ = &http.Server{
+		Addr:    "localhost:8080",
+		Handler: s.Handler(),
+	}
+
+	go func() {
+		err := keyshareServ.ListenAndServe()
+		if err == http.ErrServerClosed {
+			err = nil
+		}
+		assert.NoError(t, err)
+	}()
+}
+
+func StopKeyshareServer(t *testing.T) {
+	err := keyshareServ.Shutdown(context.Background())
+	assert.NoError(t, err)
+}
+
+func newKeyshareServer(t *testing.T, l *logrus.Logger, url string) *keyshareserver.Server {
 	db := keyshareserver.NewMemoryDB()
-	err := db.AddUser(&keyshareserver.User{
+	err := db.AddUser(context.Background(), &keyshareserver.User{
 		Username: "",
 		Secrets:  keysharecore.UserSecrets{},
 	})
@@ -30,43 +53,39 @@ func StartKeyshareServer(t *testing.T, l *logrus.Logger) {
 	bts, err := base64.StdEncoding.DecodeString("YWJjZK4w5SC+7D4lDrhiJGvB1iwxSeF90dGGPoGqqG7g3ivbfHibOdkKoOTZPbFlttBzn2EJgaEsL24Re8OWWWw5pd31/GCd14RXcb9Wy2oWhbr0pvJDLpIxXZt/qiQC0nJiIAYWLGZOdj5o0irDfqP1CSfw3IoKkVEl4lHRj0LCeINJIOpEfGlFtl4DHlWu8SMQFV1AIm3Gv64XzGncdkclVd41ti7cicBrcK8N2u9WvY/jCS4/Lxa2syp/O4IY")
 	require.NoError(t, err)
 	copy(secrets[:], bts)
-	err = db.AddUser(&keyshareserver.User{
+	err = db.AddUser(context.Background(), &keyshareserver.User{
 		Username: "testusername",
 		Secrets:  secrets,
 	})
 	require.NoError(t, err)
 
+	s, err := keyshareserver.New(KeyshareServerConfiguration(t, l, url, db))
+	require.NoError(t, err)
+	return s
+}
+
+// KeyshareServerConfiguration returns the configuration of a keyshare server reachable at the
+// specified URL, using the test schemes and keys and storing its users in the specified database.
+// In the schemes of the server, the keyshare server of the test scheme is set to the URL.
+func KeyshareServerConfiguration(t *testing.T, l *logrus.Logger, url string, db keyshareserver.DB) *keyshareserver.Configuration {
 	testdataPath := test.FindTestdataFolder(t)
-	s, err := keyshareserver.New(&keyshareserver.Configuration{
+	irmaconf, err := irma.NewConfiguration(filepath.Join(testdataPath, "irma_configuration"), irma.ConfigurationOptions{})
+	require.NoError(t, err)
+	require.NoError(t, irmaconf.ParseFolder())
+	irmaconf.SchemeManagers[irma.NewSchemeManagerIdentifier("test")].KeyshareServer = strings.TrimSuffix(url, "/")
+
+	return &keyshareserver.Configuration{
 		Configuration: &server.Configuration{
-			SchemesPath:           filepath.Join(testdataPath, "irma_configuration"),
+			IrmaConfiguration:     irmaconf,
 			IssuerPrivateKeysPath: filepath.Join(testdataPath, "privatekeys"),
 			Logger:                l,
-			URL:                   "http://localhost:8080/",
+			URL:                   url,
+			EgressAllowedNetworks: []string{"127.0.0.0/8", "::1"},
 		},
 		DB:                    db,
 		JwtKeyID:              0,
 		JwtPrivateKeyFile:     filepath.Join(testdataPath, "jwtkeys", "kss-sk.pem"),
 		StoragePrimaryKeyFile: filepath.Join(testdataPath, "keyshareStorageTestkey"),
 		KeyshareAttribute:     irma.NewAttributeTypeIdentifier("test.test.mijnirma.email"),
-	})
-	require.NoError(t, err)
-
-	keyshareServ = &http.Server{
-		Addr:    "localhost:8080",
-		Handler: s.Handler(),
 	}
-
-	go func() {
-		err := keyshareServ.ListenAndServe()
-		if err == http.ErrServerClosed {
-			err = nil
-		}
-		assert.NoError(t, err)
-	}()
-}
-
-func StopKeyshareServer(t *testing.T) {
-	err := keyshareServ.Shutdown(context.Background())
-	assert.NoError(t, err)
 }
@@ -42,30 +42,58 @@ func configureEmail() keyshare.EmailConfiguration {
 
 func configureIRMAServer() *server.Configuration {
 	return &server.Configuration{
-		SchemesPath:            viper.GetString("schemes_path"),
-		SchemesAssetsPath:      viper.GetString("schemes_assets_path"),
-		SchemesUpdateInterval:  viper.GetInt("schemes_update"),
-		DisableSchemesUpdate:   viper.GetInt("schemes_update") == 0,
-		IssuerPrivateKeysPath:  viper.GetString("privkeys"),
-		RevocationDBType:       viper.GetString("revocation_db_type"),
-		RevocationDBConnStr:    viper.GetString("revocation_db_str"),
-		RevocationSettings:     irma.RevocationSettings{},
-		URL:                    viper.GetString("url"),
-		DisableTLS:             viper.GetBool("no_tls"),
-		Email:                  viper.GetString("email"),
-		EnableSSE:              viper.GetBool("sse"),
-		StoreType:              viper.GetString("store_type"),
-		Verbose:                viper.GetInt("verbose"),
-		Quiet:                  viper.GetBool("quiet"),
-		LogJSON:                viper.GetBool("log_json"),
-		Logger:                 logger,
-		Production:             viper.GetBool("production"),
-		MaxSessionLifetime:     viper.GetInt("max_session_lifetime"),
-		JwtIssuer:              viper.GetString("jwt_issuer"),
-		JwtPrivateKey:          viper.GetString("jwt_privkey"),
-		JwtPrivateKeyFile:      viper.GetString("jwt_privkey_file"),
-		AllowUnsignedCallbacks: viper.GetBool("allow_unsigned_callbacks"),
-		AugmentClientReturnURL: viper.GetBool("augment_client_return_url"),
+		SchemesPath:                viper.GetString("schemes_path"),
+		SchemesAssetsPath:          viper.GetString("schemes_assets_path"),
+		SchemesUpdateInterval:      viper.GetInt("schemes_update"),
+		DisableSchemesUpdate:       viper.GetInt("schemes_update") == 0,
+		IssuerPrivateKeysPath:      viper.GetString("privkeys"),
+		RevocationDBType:           viper.GetString("revocation_db_type"),
+		RevocationDBConnStr:        viper.GetString("revocation_db_str"),
+		RevocationSettings:         irma.RevocationSettings{},
+		URL:                        viper.GetString("url"),
+		DisableTLS:                 viper.GetBool("no_tls"),
+		Email:                      viper.GetString("email"),
+		EnableSSE:                  viper.GetBool("sse"),
+		StoreType:                  viper.GetString("store_type"),
+		CachePath:                  viper.GetString("cache_path"),
+		Verbose:                    viper.GetInt("verbose"),
+		Quiet:                      viper.GetBool("quiet"),
+		LogJSON:                    viper.GetBool("log_json"),
+		LogAttributeValues:         server.AttributeValueLogging(viper.GetString("log_attribute_values")),
+		Logger:                     logger,
+		Production:                 viper.GetBool("production"),
+		MaxSessionLifetime:         viper.GetInt("max_session_lifetime"),
+		StaticSessionRateLimit:     viper.GetInt("static_session_rate_limit"),
+		ClockSkewTolerance:         viper.GetInt("clock_skew_tolerance"),
+		ReadHeaderTimeout:          viper.GetInt("read_header_timeout"),
+		ReadTimeout:                viper.GetInt("read_timeout"),
+		IdleTimeout:                viper.GetInt("idle_timeout"),
+		StatusTimeout:              viper.GetInt("status_timeout"),
+		ProofTimeout:               viper.GetInt("proof_timeout"),
+		MaxConnections:             viper.GetInt("max_connections"),
+		MaxProofAge:                viper.GetInt("max_proof_age"),
+		DeleteResultOnRead:         viper.GetBool("delete_result_on_read"),
+		ResultRetention:            viper.GetInt("result_retention"),
+		MaxActiveSessions:          viper.GetInt("max_active_sessions"),
+		MaxActiveRequestorSessions: viper.GetInt("max_active_requestor_sessions"),
+		MaxInstances:               viper.GetInt("max_instances"),
+		JwtIssuer:                  viper.GetString("jwt_issuer"),
+		JwtPrivateKey:              viper.GetString("jwt_privkey"),
+		JwtPrivateKeyFile:          viper.GetString("jwt_privkey_file"),
+		KeyshareJwtIssuers:         viper.GetStringMapString("keyshare_jwt_issuers"),
+		KeyshareJwtAudiences:       viper.GetStringMapString("keyshare_jwt_audiences"),
+		AllowUnsignedCallbacks:     viper.GetBool("allow_unsigned_callbacks"),
+		AugmentClientReturnURL:     viper.GetBool("augment_client_return_url"),
+		DisableDisclosure:          viper.GetBool("disable_disclosure"),
+		DisableSigning:             viper.GetBool("disable_signing"),
+		DisableIssuance:            viper.GetBool("disable_issuance"),
+		RejectTestCredentials:      viper.GetBool("reject_test_credentials"),
+		TrustedProxies:             viper.GetStringSlice("trusted_proxies"),
+		EgressAllowedNetworks:      viper.GetStringSlice("egress_allowed_networks"),
+		EgressAllowedHosts:         viper.GetStringSlice("egress_allowed_hosts"),
+		EgressTimeout:              viper.GetInt("egress_timeout"),
+
+		KeyshareJwtAcceptMissingClaims: viper.GetBool("keyshare_jwt_accept_missing_claims"),
 	}
 }
 
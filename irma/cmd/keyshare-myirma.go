@@ -24,7 +24,7 @@ var myirmaServerCmd = &cobra.Command{
 			die("", err)
 		}
 
-		runServer(myirmaServer, conf.Logger)
+		runServer(myirmaServer, conf.Configuration, nil)
 	},
 }
 
@@ -50,6 +50,9 @@ func init() {
 	headers["port"] = "Server address and port to listen on"
 	flags.IntP("port", "p", 8080, "port at which to listen")
 	flags.StringP("listen-addr", "l", "", "address at which to listen (default 0.0.0.0)")
+	flags.StringSlice("trusted-proxies", nil, "IP addresses or CIDR ranges of reverse proxies whose forwarding headers are trusted to determine the client IP address")
+	flags.StringSlice("egress-allowed-networks", nil, "IP addresses or CIDR ranges of private networks to which outbound requests (e.g. callbacks) may be sent")
+	flags.Int("egress-timeout", server.EgressTimeoutDefault, "timeout in seconds of outbound requests")
 	flags.StringSlice("cors-allowed-origins", nil, "CORS allowed origins")
 
 	headers["db-type"] = "Database configuration"
@@ -84,6 +87,12 @@ func init() {
 	flags.String("tls-privkey-file", "", "path to TLS private key")
 	flags.Bool("no-tls", false, "Disable TLS")
 
+	headers["read-header-timeout"] = "Connection limits (protection against slow clients)"
+	flags.Int("read-header-timeout", 5, "maximum time in seconds for reading the headers of a request")
+	flags.Int("read-timeout", 5, "maximum time in seconds for reading an entire request")
+	flags.Int("idle-timeout", 120, "maximum time in seconds that idle connections are kept open")
+	flags.Int("max-connections", 1000, "maximum number of simultaneous connections (-1 means no maximum)")
+
 	headers["verbose"] = "Other options"
 	flags.CountP("verbose", "v", "verbose (repeatable)")
 	flags.BoolP("quiet", "q", false, "quiet")
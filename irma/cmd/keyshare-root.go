@@ -3,13 +3,13 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/privacybydesign/irmago/server"
-	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -28,9 +28,17 @@ type stoppableServer interface {
 	Stop()
 }
 
-func runServer(serv stoppableServer, logger *logrus.Logger) {
+// runServer serves the server until it is interrupted. If reload is not nil, it is called when
+// receiving SIGHUP.
+func runServer(serv stoppableServer, conf *server.Configuration, reload func()) {
+	logger := conf.Logger
+
 	// Determine full listening address.
 	fullAddr := fmt.Sprintf("%s:%d", viper.GetString("listen_addr"), viper.GetInt("port"))
+	l, err := net.Listen("tcp", fullAddr)
+	if err != nil {
+		die("failed to listen", err)
+	}
 
 	// Load TLS configuration
 	TLSConfig := configureTLS()
@@ -40,17 +48,23 @@ func runServer(serv stoppableServer, logger *logrus.Logger) {
 		Handler:   serv.Handler(),
 		TLSConfig: TLSConfig,
 	}
+	conf.ConfigureHTTPServer(httpServer)
+	l = conf.LimitListener(l)
 
 	stopped := make(chan struct{})
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	hangup := make(chan os.Signal, 1)
+	if reload != nil {
+		signal.Notify(hangup, syscall.SIGHUP)
+	}
 
 	go func() {
 		var err error
 		if TLSConfig != nil {
-			err = server.FilterStopError(httpServer.ListenAndServeTLS("", ""))
+			err = server.FilterStopError(httpServer.ServeTLS(l, "", ""))
 		} else {
-			err = server.FilterStopError(httpServer.ListenAndServe())
+			err = server.FilterStopError(httpServer.Serve(l))
 		}
 		if err != nil {
 			_ = server.LogError(err)
@@ -61,6 +75,9 @@ func runServer(serv stoppableServer, logger *logrus.Logger) {
 
 	for {
 		select {
+		case <-hangup:
+			logger.Info("Caught SIGHUP, reloading configuration")
+			reload()
 		case <-interrupt:
 			logger.Debug("Caught interrupt")
 			err := httpServer.Shutdown(context.Background())
@@ -71,6 +88,7 @@ func runServer(serv stoppableServer, logger *logrus.Logger) {
 			logger.Debug("Sent stop signal to server")
 		case <-stopped:
 			logger.Info("Exiting")
+			signal.Stop(hangup)
 			close(stopped)
 			close(interrupt)
 			return
@@ -1,6 +1,9 @@
 package cmd
 
 import (
+	"strconv"
+	"strings"
+
 	"github.com/go-errors/errors"
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/keysharecore"
@@ -10,6 +13,11 @@ import (
 	"github.com/spf13/viper"
 )
 
+// registrationAttestors contains, per attestation platform, a function configuring the attestor of
+// the platform from the configuration, or returning nil if it is not configured. The attestors are
+// added by the files built with their build tags.
+var registrationAttestors = map[string]func() (keyshareserver.RegistrationAttestor, error){}
+
 var keyshareServerCmd = &cobra.Command{
 	Use:   "server",
 	Short: "IRMA keyshare server",
@@ -25,7 +33,7 @@ var keyshareServerCmd = &cobra.Command{
 			die("", err)
 		}
 
-		runServer(keyshareServer, conf.Logger)
+		runServer(keyshareServer, conf.Configuration, func() { reloadKeyshareServer(keyshareServer) })
 	},
 }
 
@@ -44,26 +52,41 @@ func init() {
 	flags.Int("schemes-update", 60, "update IRMA schemes every x minutes (0 to disable)")
 	flags.StringP("privkeys", "k", "", "path to IRMA private keys")
 	flags.StringP("url", "u", "", "external URL to server to which the IRMA client connects, \":port\" being replaced by --port value")
+	flags.String("path-prefix", "", "path under which a reverse proxy forwards requests to the server (e.g. /keyshare), appended to --url")
 
 	headers["port"] = "Server address and port to listen on"
 	flags.IntP("port", "p", 8080, "port at which to listen")
 	flags.StringP("listen-addr", "l", "", "address at which to listen (default 0.0.0.0)")
+	flags.StringSlice("trusted-proxies", nil, "IP addresses or CIDR ranges of reverse proxies whose forwarding headers are trusted to determine the client IP address")
+	flags.StringSlice("egress-allowed-networks", nil, "IP addresses or CIDR ranges of private networks to which outbound requests (e.g. callbacks) may be sent")
+	flags.Int("egress-timeout", server.EgressTimeoutDefault, "timeout in seconds of outbound requests")
 
 	headers["db-type"] = "Database configuration"
 	flags.String("db-type", string(keyshareserver.DBTypePostgres), "Type of database to connect keyshare server to")
 	flags.String("db", "", "Database server connection string")
+	flags.Int("db-failure-threshold", keyshareserver.DBFailureThresholdDefault, "Seconds that the database may fail before /api/ready reports the server as unavailable")
+	flags.Bool("ready-ignores-key-failures", false, "Report the server as ready at /api/ready even when some public keys failed to load")
+	flags.StringToString("log-retention", nil, "Days that log entries of the specified event types are kept (e.g. IRMA_SESSION=30); others are kept indefinitely")
 
 	headers["jwt-privkey"] = "Cryptographic keys"
 	flags.String("jwt-privkey", "", "Private jwt key of keyshare server")
 	flags.String("jwt-privkey-file", "", "Path to file containing private jwt key of keyshare server")
 	flags.Int("jwt-privkey-id", 0, "Key identifier of keyshare server public key matching used private key")
 	flags.String("jwt-issuer", keysharecore.JWTIssuerDefault, "JWT issuer used in \"iss\" field")
+	flags.String("jwt-audience", "", "JWT audience used in \"aud\" field (leave empty to omit)")
+	flags.Bool("jwt-accept-missing-claims", false, "Accept PIN JWTs without \"iss\" or \"aud\" field, for migrating to a new JWT audience")
 	flags.Int("jwt-pin-expiry", keysharecore.JWTPinExpiryDefault, "Expiry of PIN JWT in seconds")
 	flags.String("storage-primary-keyfile", "", "Primary key used for encrypting and decrypting secure containers")
 	flags.StringSlice("storage-fallback-keyfile", nil, "Fallback key(s) used to decrypt older secure containers")
+	flags.String("pin-encryption-key", "", "Base64 encoded X25519 private key to which clients encrypt PINs (leave empty to disable PIN encryption)")
+	flags.String("pin-encryption-key-file", "", "Path to file containing base64 encoded X25519 private key to which clients encrypt PINs")
+	flags.Bool("disable-plaintext-pins", false, "Refuse unencrypted PINs (from clients using keyshare protocol versions older than 5)")
+	flags.StringToString("pinned-scheme-key-files", nil, "Paths to the public keys with which the specified schemes must be signed")
+	flags.StringSlice("trusted-issuers", nil, "Issuers whose public keys are loaded (default: all issuers)")
 
 	headers["keyshare-attribute"] = "Keyshare server attribute issued during registration"
 	flags.String("keyshare-attribute", "", "Attribute identifier that contains username")
+	flags.StringSlice("keyshare-attributes", nil, "Attribute identifiers that contain username, in order of priority: the first is issued during registration, all are accepted (instead of --keyshare-attribute)")
 
 	headers["email-server"] = "Email configuration (leave empty to disable sending emails)"
 	flags.String("email-server", "", "Email server to use for sending email address confirmation emails")
@@ -75,6 +98,40 @@ func init() {
 	flags.StringToString("registration-email-subjects", nil, "Translated subject lines for the registration email")
 	flags.StringToString("registration-email-files", nil, "Translated emails for the registration email")
 	flags.StringToString("verification-url", nil, "Base URL for the email verification link (localized)")
+	flags.Int("email-token-validity", keyshareserver.EmailTokenValidityDefault, "Validity of email verification tokens in hours")
+	flags.Int("recovery-token-validity", keyshareserver.RecoveryTokenValidityDefault, "Validity of recovery tokens with which users re-enroll to their account in days")
+
+	headers["deprecation-date"] = "Protocol retirement announcements"
+	flags.String("deprecation-date", "", "Date (RFC 3339) since which the current keyshare protocol is deprecated")
+	flags.String("sunset-date", "", "Date (RFC 3339) after which the current keyshare protocol will no longer be supported")
+	flags.StringToString("version-message", nil, "Translated message to clients about the protocol retirement")
+
+	headers["maintenance-start"] = "Status announcements"
+	flags.String("maintenance-start", "", "Date (RFC 3339) at which announced maintenance starts")
+	flags.String("maintenance-end", "", "Date (RFC 3339) at which announced maintenance ends")
+	flags.StringToString("maintenance-message", nil, "Translated message to users about the maintenance")
+	flags.String("min-app-version", "", "Minimum supported app version, announced in /api/status")
+	flags.Bool("read-only", false, "Start in read-only maintenance mode, refusing registrations, PIN changes and other changes to accounts")
+
+	headers["oidc-issuer"] = "OpenID Connect registration (leave empty for anonymous registration)"
+	flags.String("oidc-issuer", "", "OpenID Connect provider at which users authenticate when registering and recovering their account")
+	flags.String("oidc-audience", "", "Required audience of ID tokens (client ID at the OpenID Connect provider)")
+	flags.StringToString("oidc-required-claims", nil, "Claims that ID tokens must contain, with their required values")
+	flags.String("oidc-jwks-url", "", "URL of the JSON Web Key Set of the OpenID Connect provider (default: from its discovery document)")
+
+	headers["admin-token"] = "Administration"
+	flags.String("admin-token", "", "Token for accessing the administration endpoints under /admin/ (leave empty to disable them)")
+
+	headers["uniform-pin-responses"] = "Account enumeration protection"
+	flags.Bool("uniform-pin-responses", false, "Respond to PIN verifications and changes for unknown users as if they exist (only for keyshare protocol version 4 and up)")
+	flags.String("uniform-pin-responses-key", "", "Key (at least 32 bytes, base64 encoded) from which the responses for unknown users are derived, shared by all instances (default: random)")
+	flags.String("uniform-pin-responses-key-file", "", "Path to key from which the responses for unknown users are derived")
+
+	headers["error-report-file"] = "Client error reports"
+	flags.String("error-report-file", "", "File to which error reports of clients are appended (leave empty to log them)")
+
+	headers["require-registration-attestation"] = "Registration attestation"
+	flags.Bool("require-registration-attestation", false, "Refuse registrations of new accounts without a valid platform attestation token")
 
 	headers["tls-cert"] = "TLS configuration (leave empty to disable TLS)"
 	flags.String("tls-cert", "", "TLS certificate (chain)")
@@ -83,6 +140,12 @@ func init() {
 	flags.String("tls-privkey-file", "", "path to TLS private key")
 	flags.Bool("no-tls", false, "Disable TLS")
 
+	headers["read-header-timeout"] = "Connection limits (protection against slow clients)"
+	flags.Int("read-header-timeout", 5, "maximum time in seconds for reading the headers of a request")
+	flags.Int("read-timeout", 5, "maximum time in seconds for reading an entire request")
+	flags.Int("idle-timeout", 120, "maximum time in seconds that idle connections are kept open")
+	flags.Int("max-connections", 1000, "maximum number of simultaneous connections (-1 means no maximum)")
+
 	headers["verbose"] = "Other options"
 	flags.CountP("verbose", "v", "verbose (repeatable)")
 	flags.BoolP("quiet", "q", false, "quiet")
@@ -92,28 +155,121 @@ func init() {
 
 func configureKeyshareServer(cmd *cobra.Command) (*keyshareserver.Configuration, error) {
 	readConfig(cmd, "keyshareserver", "keyshareserver", []string{".", "/etc/keyshareserver"}, nil)
+	return keyshareServerConfiguration()
+}
+
+// reloadKeyshareServer rereads the configuration file, and reloads the configuration of the server.
+func reloadKeyshareServer(keyshareServer *keyshareserver.Server) {
+	if err := viper.ReadInConfig(); err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "Failed to reread configuration file", 0))
+		return
+	}
+	conf, err := keyshareServerConfiguration()
+	if err != nil {
+		_ = server.LogError(err)
+		return
+	}
+	_ = keyshareServer.ReloadConfig(conf) // logs errors itself
+}
 
-	// And build the configuration
+func keyshareServerConfiguration() (*keyshareserver.Configuration, error) {
+	// Build the configuration
 	conf := &keyshareserver.Configuration{
 		Configuration:      configureIRMAServer(),
 		EmailConfiguration: configureEmail(),
+		PathPrefix:         viper.GetString("path_prefix"),
 
 		DBType:    keyshareserver.DBType(viper.GetString("db_type")),
 		DBConnStr: viper.GetString("db_str"),
 
+		DBFailureThreshold:      viper.GetInt("db_failure_threshold"),
+		DBTimeout:               viper.GetInt("db_timeout"),
+		DBSlowThreshold:         viper.GetInt("db_slow_threshold"),
+		ReadyIgnoresKeyFailures: viper.GetBool("ready_ignores_key_failures"),
+
 		JwtKeyID:                viper.GetUint32("jwt_privkey_id"),
 		JwtPrivateKey:           viper.GetString("jwt_privkey"),
 		JwtPrivateKeyFile:       viper.GetString("jwt_privkey_file"),
 		JwtIssuer:               viper.GetString("jwt_issuer"),
+		JwtAudience:             viper.GetString("jwt_audience"),
+		JwtAcceptMissingClaims:  viper.GetBool("jwt_accept_missing_claims"),
 		JwtPinExpiry:            viper.GetInt("jwt_pin_expiry"),
 		StoragePrimaryKeyFile:   viper.GetString("storage_primary_key_file"),
 		StorageFallbackKeyFiles: viper.GetStringSlice("storage_fallback_key_file"),
+		PinEncryptionKey:        viper.GetString("pin_encryption_key"),
+		PinEncryptionKeyFile:    viper.GetString("pin_encryption_key_file"),
+		DisablePlaintextPins:    viper.GetBool("disable_plaintext_pins"),
 
 		KeyshareAttribute: irma.NewAttributeTypeIdentifier(viper.GetString("keyshare_attribute")),
 
 		RegistrationEmailSubjects: viper.GetStringMapString("registration_email_subjects"),
 		RegistrationEmailFiles:    viper.GetStringMapString("registration_email_files"),
 		VerificationURL:           viper.GetStringMapString("verification_url"),
+		EmailTokenValidity:        viper.GetInt("email_token_validity"),
+		RecoveryTokenValidity:     viper.GetInt("recovery_token_validity"),
+
+		DeprecationDate: viper.GetString("deprecation_date"),
+		SunsetDate:      viper.GetString("sunset_date"),
+		VersionMessage:  viper.GetStringMapString("version_message"),
+
+		MaintenanceStart:   viper.GetString("maintenance_start"),
+		MaintenanceEnd:     viper.GetString("maintenance_end"),
+		MaintenanceMessage: viper.GetStringMapString("maintenance_message"),
+		MinAppVersion:      viper.GetString("min_app_version"),
+		ReadOnly:           viper.GetBool("read_only"),
+
+		OIDCIssuer:         viper.GetString("oidc_issuer"),
+		OIDCAudience:       viper.GetString("oidc_audience"),
+		OIDCRequiredClaims: viper.GetStringMapString("oidc_required_claims"),
+		OIDCJWKSURL:        viper.GetString("oidc_jwks_url"),
+
+		AdminToken: viper.GetString("admin_token"),
+
+		UniformPinResponses:        viper.GetBool("uniform_pin_responses"),
+		UniformPinResponsesKey:     viper.GetString("uniform_pin_responses_key"),
+		UniformPinResponsesKeyFile: viper.GetString("uniform_pin_responses_key_file"),
+
+		ErrorReportFile: viper.GetString("error_report_file"),
+
+		RequireRegistrationAttestation: viper.GetBool("require_registration_attestation"),
+	}
+
+	attestors := keyshareserver.PlatformAttestors{}
+	for platform, configure := range registrationAttestors {
+		attestor, err := configure()
+		if err != nil {
+			return nil, err
+		}
+		if attestor != nil {
+			attestors[platform] = attestor
+		}
+	}
+	if len(attestors) > 0 {
+		conf.RegistrationAttestor = attestors
+	}
+
+	for scheme, file := range viper.GetStringMapString("pinned_scheme_key_files") {
+		if conf.PinnedSchemeKeyFiles == nil {
+			conf.PinnedSchemeKeyFiles = map[irma.SchemeManagerIdentifier]string{}
+		}
+		conf.PinnedSchemeKeyFiles[irma.NewSchemeManagerIdentifier(scheme)] = file
+	}
+	for _, v := range viper.GetStringSlice("keyshare_attributes") {
+		conf.KeyshareAttributes = append(conf.KeyshareAttributes, irma.NewAttributeTypeIdentifier(v))
+	}
+	for _, v := range viper.GetStringSlice("trusted_issuers") {
+		conf.TrustedIssuers = append(conf.TrustedIssuers, irma.NewIssuerIdentifier(v))
+	}
+	for eventType, days := range viper.GetStringMapString("log_retention") {
+		d, err := strconv.Atoi(days)
+		if err != nil {
+			return nil, errors.Errorf("invalid log retention of %s: %s", eventType, days)
+		}
+		if conf.LogRetention == nil {
+			conf.LogRetention = map[keyshareserver.LogEventType]int{}
+		}
+		// Keys in configuration files are lowercased by viper
+		conf.LogRetention[keyshareserver.LogEventType(strings.ToUpper(eventType))] = d
 	}
 
 	if conf.Production && conf.DBType != keyshareserver.DBTypePostgres {
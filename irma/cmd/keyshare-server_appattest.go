@@ -0,0 +1,32 @@
+// +build appattest
+
+package cmd
+
+import (
+	"io/ioutil"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/server/keyshare/attestation/appattest"
+	"github.com/privacybydesign/irmago/server/keyshare/keyshareserver"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	flags := keyshareServerCmd.Flags()
+	flagHeaders["irma keyshare server"]["app-attest-app-id"] = "App Attest attestation (leave empty to disable)"
+	flags.String("app-attest-app-id", "", "Team identifier and bundle identifier of the iOS app, separated by a dot")
+	flags.String("app-attest-root-ca-file", "", "Path to the PEM encoded Apple App Attestation Root CA certificate")
+	flags.Bool("app-attest-development", false, "Accept attestations from the App Attest development environment")
+
+	registrationAttestors[appattest.Platform] = func() (keyshareserver.RegistrationAttestor, error) {
+		appID := viper.GetString("app_attest_app_id")
+		if appID == "" {
+			return nil, nil
+		}
+		rootCA, err := ioutil.ReadFile(viper.GetString("app_attest_root_ca_file"))
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "failed to read App Attest root certificate", 0)
+		}
+		return appattest.NewVerifier(appID, rootCA, viper.GetBool("app_attest_development"))
+	}
+}
@@ -0,0 +1,28 @@
+// +build playintegrity
+
+package cmd
+
+import (
+	"github.com/privacybydesign/irmago/server/keyshare/attestation/playintegrity"
+	"github.com/privacybydesign/irmago/server/keyshare/keyshareserver"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	flags := keyshareServerCmd.Flags()
+	flagHeaders["irma keyshare server"]["play-integrity-package-name"] = "Play Integrity attestation (leave empty to disable)"
+	flags.String("play-integrity-package-name", "", "Package name of the Android app")
+	flags.String("play-integrity-decryption-key", "", "Base64 encoded key for decrypting integrity tokens, from the Google Play Console")
+	flags.String("play-integrity-verification-key", "", "Base64 encoded key for verifying integrity tokens, from the Google Play Console")
+
+	registrationAttestors[playintegrity.Platform] = func() (keyshareserver.RegistrationAttestor, error) {
+		packageName := viper.GetString("play_integrity_package_name")
+		if packageName == "" {
+			return nil, nil
+		}
+		return playintegrity.NewVerifier(packageName,
+			viper.GetString("play_integrity_decryption_key"),
+			viper.GetString("play_integrity_verification_key"),
+		)
+	}
+}
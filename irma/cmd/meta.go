@@ -75,6 +75,7 @@ func printMetadataAttr(metaint *big.Int, confpath string) error {
 	fmt.Println("Expires         :", meta.Expiry().String())
 	fmt.Println("IsValid         :", meta.IsValid())
 	fmt.Println("Version         :", meta.Version())
+	fmt.Println("TestCredential  :", meta.IsTestCredential())
 	fmt.Println("KeyCounter      :", meta.KeyCounter())
 	if key != nil {
 		fmt.Println("KeyExpires      :", time.Unix(key.ExpiryDate, 0))
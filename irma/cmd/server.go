@@ -72,10 +72,13 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flagHeaders["irma server"] = headers
 
 	var defaulturl string
+	var egressNetworks []string
 	if !production {
 		if localIP != "" {
 			defaulturl = "http://" + localIP + ":port"
 		}
+		// Allow callbacks to requestors in the local network, but not to link-local addresses
+		egressNetworks = []string{"127.0.0.0/8", "::1/128", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
 	}
 
 	schemespath := irma.DefaultSchemesPath()
@@ -88,9 +91,13 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.String("schemes-assets-path", "", "if specified, copy schemes from here into --schemes-path")
 	flags.Int("schemes-update", 60, "update IRMA schemes every x minutes (0 to disable)")
 	flags.StringP("privkeys", "k", "", "path to IRMA private keys")
+	flags.String("privkeys-kms-url", "", "URL of key management service from which to fetch IRMA private keys at startup")
+	flags.String("privkeys-kms-token", "", "bearer token for the key management service")
+	flags.String("privkeys-kms-token-file", "", "path to bearer token for the key management service")
+	flags.StringSlice("privkeys-kms-issuers", nil, "issuers whose private keys to fetch from the key management service")
 	flags.String("static-path", "", "Host files under this path as static files (leave empty to disable)")
 	flags.String("static-prefix", "/", "Host static files under this URL prefix")
-	flags.StringP("url", "u", defaulturl, "external URL to server to which the IRMA client connects, \":port\" being replaced by --port value")
+	flags.StringP("url", "u", defaulturl, "external URL to server to which the IRMA client connects, \":port\" being replaced by --client-port value if specified and by --port value otherwise")
 	flags.String("revocation-db-type", "", "database type for revocation database (supported: mysql, postgres)")
 	flags.String("revocation-db-str", "", "connection string for revocation database")
 	flags.Bool("sse", false, "Enable server sent for status updates (experimental)")
@@ -101,6 +108,10 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.StringP("api-prefix", "a", "/", "prefix API endpoints with this string, e.g. POST /session becomes POST {api-prefix}/session")
 	flags.Int("client-port", 0, "if specified, start a separate server for the IRMA app at this port")
 	flags.String("client-listen-addr", "", "address at which server for IRMA app listens")
+	flags.StringSlice("trusted-proxies", nil, "IP addresses or CIDR ranges of reverse proxies whose forwarding headers are trusted to determine the client IP address")
+	flags.StringSlice("egress-allowed-networks", egressNetworks, "IP addresses or CIDR ranges of private networks to which outbound requests (e.g. callbacks) may be sent")
+	flags.StringSlice("egress-allowed-hosts", nil, "hosts to which requestor-supplied callback and next session URLs may point, e.g. example.com or *.example.com (default: any)")
+	flags.Int("egress-timeout", server.EgressTimeoutDefault, "timeout in seconds of outbound requests")
 
 	headers["no-auth"] = "Requestor authentication and default requestor permissions"
 	flags.Bool("no-auth", !production, "whether or not to authenticate requestors (and reject all authenticated requests)")
@@ -113,14 +124,29 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	}
 	flags.StringSlice("issue-perms", nil, issHelp)
 	flags.StringSlice("revoke-perms", nil, "list of credentials that all requestors may revoke")
+	flags.Bool("disable-disclosure", false, "refuse to start disclosure sessions, whatever the requestor permissions")
+	flags.Bool("disable-signing", false, "refuse to start signature sessions, whatever the requestor permissions")
+	flags.Bool("disable-issuance", false, "refuse to start issuance sessions, whatever the requestor permissions")
+	flags.Bool("reject-test-credentials", false, "reject disclosures and signatures containing test credentials, issued by servers not in production mode or of demo schemes")
 	flags.Bool("skip-private-keys-check", false, "whether or not to skip checking whether the private keys that requestors have permission for using are present in the configuration")
 	flags.String("static-sessions", "", "preconfigured static sessions (in JSON)")
+	flags.Int("static-session-rate-limit", 30, "maximum number of static sessions one IP address may start per minute")
+	flags.String("request-templates", "", "session request templates that requestors can refer to by name (in JSON)")
+	flags.String("admin-token", "", "token enabling the administration endpoints for managing request templates")
 	flags.Int("max-session-lifetime", 5, "maximum duration of a session once a client connects in minutes")
+	flags.Bool("delete-result-on-read", false, "delete the attributes and signature of session results once fetched by the requestor or delivered to the callback URL")
+	flags.Int("result-retention", 0, "time in minutes that finished sessions and their results are kept (0 means max-session-lifetime)")
+	flags.Int("max-proof-age", 0, "maximum time in seconds between the client receiving the session request and sending its proofs (0 means no maximum)")
+	flags.Int("max-active-sessions", 0, "maximum number of sessions that may be active at the same time (0 means no maximum)")
+	flags.Int("max-active-requestor-sessions", 0, "maximum number of sessions that may be active at the same time per requestor (0 means no maximum)")
+	flags.Int("max-instances", irma.DefaultMaxInstances, "maximum number of credential instances that requests may ask to be disclosed per disjunction")
+	flags.Int("clock-skew-tolerance", 60, "tolerated clock difference with other parties in seconds (maximum 300, -1 for no tolerance)")
 
 	flags.String("revocation-settings", "", "revocation settings (in JSON)")
 
 	headers["store-type"] = "Session store configuration"
 	flags.String("store-type", "", "specifies how session state will be saved on the server (default \"memory\")")
+	flags.String("cache-path", "", "directory in which the memory session store saves its sessions, to restore them after a restart")
 	flags.String("redis-addr", "", "Redis address, to be specified as host:port")
 	flags.String("redis-pw", "", "Redis server password")
 	flags.Bool("redis-allow-empty-password", false, "explicitly allow an empty string as Redis password")
@@ -134,6 +160,9 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.String("jwt-privkey", "", "JWT private key")
 	flags.String("jwt-privkey-file", "", "path to JWT private key")
 	flags.Int("max-request-age", 300, "max age in seconds of a session request JWT")
+	flags.StringToString("keyshare-jwt-issuers", nil, "expected \"iss\" field of keyshare proof JWTs of the specified schemes")
+	flags.StringToString("keyshare-jwt-audiences", nil, "expected \"aud\" field of keyshare proof JWTs of the specified schemes")
+	flags.Bool("keyshare-jwt-accept-missing-claims", false, "accept keyshare proof JWTs without the expected \"iss\" or \"aud\" field")
 	flags.Bool("allow-unsigned-callbacks", false, "Allow callbackUrl in session requests when no JWT privatekey is installed (potentially unsafe)")
 	flags.Bool("augment-client-return-url", false, "Augment the client return url with the server session token if present")
 
@@ -152,10 +181,19 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.StringP("email", "e", "", "Email address of server admin, for incidental notifications such as breaking API changes")
 	flags.Bool("no-email", !production, "Opt out of providing an email address with --email")
 
+	headers["read-header-timeout"] = "Connection limits (protection against slow clients)"
+	flags.Int("read-header-timeout", 5, "maximum time in seconds for reading the headers of a request")
+	flags.Int("read-timeout", 5, "maximum time in seconds for reading an entire request")
+	flags.Int("idle-timeout", 120, "maximum time in seconds that idle connections are kept open")
+	flags.Int("status-timeout", 5, "maximum time in seconds for handling requests to session status endpoints")
+	flags.Int("proof-timeout", 30, "maximum time in seconds for handling posted commitments and proofs")
+	flags.Int("max-connections", 1000, "maximum number of simultaneous connections (-1 means no maximum)")
+
 	headers["verbose"] = "Other options"
 	flags.CountP("verbose", "v", "verbose (repeatable)")
 	flags.BoolP("quiet", "q", false, "quiet")
 	flags.Bool("log-json", false, "Log in JSON format")
+	flags.String("log-attribute-values", "full", "whether disclosed attribute values are logged and kept after fetching results: full, hashed or never")
 	flags.Bool("production", false, "Production mode")
 
 	return nil
@@ -194,6 +232,7 @@ func configureServer(cmd *cobra.Command) (*requestorserver.Configuration, error)
 		MaxRequestAge:                  viper.GetInt("max_request_age"),
 		StaticPath:                     viper.GetString("static_path"),
 		StaticPrefix:                   viper.GetString("static_prefix"),
+		AdminToken:                     viper.GetString("admin_token"),
 
 		TlsCertificate:           viper.GetString("tls_cert"),
 		TlsCertificateFile:       viper.GetString("tls_cert_file"),
@@ -222,6 +261,9 @@ func configureServer(cmd *cobra.Command) (*requestorserver.Configuration, error)
 	if err = handleMapOrString("static_sessions", &conf.StaticSessions); err != nil {
 		return nil, err
 	}
+	if err = handleMapOrString("request_templates", &conf.RequestTemplates); err != nil {
+		return nil, err
+	}
 	var m map[string]*irma.RevocationSetting
 	if err = handleMapOrString("revocation_settings", &m); err != nil {
 		return nil, err
@@ -230,6 +272,16 @@ func configureServer(cmd *cobra.Command) (*requestorserver.Configuration, error)
 		conf.RevocationSettings[irma.NewCredentialTypeIdentifier(i)] = s
 	}
 
+	// Parse KMS configuration
+	if url := viper.GetString("privkeys_kms_url"); url != "" {
+		conf.IssuerPrivateKeysKMS = &server.KMSSettings{
+			URL:       url,
+			Token:     viper.GetString("privkeys_kms_token"),
+			TokenFile: viper.GetString("privkeys_kms_token_file"),
+			Issuers:   viper.GetStringSlice("privkeys_kms_issuers"),
+		}
+	}
+
 	// Parse Redis store configuration
 	if conf.StoreType == "redis" {
 		conf.RedisSettings = &server.RedisSettings{}
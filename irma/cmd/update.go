@@ -35,13 +35,14 @@ var updateCmd = &cobra.Command{
 			}
 		}
 
-		if err := updateSchemeManager(paths); err != nil {
+		allowRollback, _ := cmd.Flags().GetBool("allow-rollback")
+		if err := updateSchemeManager(paths, allowRollback); err != nil {
 			die("Updating schemes failed", err)
 		}
 	},
 }
 
-func updateSchemeManager(paths []string) error {
+func updateSchemeManager(paths []string, allowRollback bool) error {
 	// Before doing anything, first check that all paths are scheme managers
 	for _, path := range paths {
 		isscheme, err := common.IsScheme(path, true)
@@ -66,7 +67,12 @@ func updateSchemeManager(paths []string) error {
 		if err != nil {
 			return err
 		}
-		if err = conf.UpdateScheme(scheme, nil); err != nil {
+		if allowRollback {
+			err = conf.DangerousRollbackScheme(scheme)
+		} else {
+			err = conf.UpdateScheme(scheme, nil)
+		}
+		if err != nil {
 			return err
 		}
 	}
@@ -86,4 +92,6 @@ func updateHelp() string {
 
 func init() {
 	schemeCmd.AddCommand(updateCmd)
+
+	updateCmd.Flags().Bool("allow-rollback", false, "also update if the online version is older than the local version or than versions seen before")
 }
@@ -1,28 +1,132 @@
 package irma
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/sha256"
+	_ "crypto/sha512" // registers SHA-384 and SHA-512
 	"encoding/asn1"
 	"log"
 	gobig "math/big"
+	"unicode/utf8"
 
 	"github.com/bwesterb/go-atum"
+	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 )
 
 const LDContextSignedMessage = "https://irma.app/ld/signature/v2"
 
+// Supported algorithms of message hashes.
+const (
+	MessageHashSHA256 = "SHA-256"
+	MessageHashSHA384 = "SHA-384"
+	MessageHashSHA512 = "SHA-512"
+)
+
+var messageHashAlgorithms = map[string]crypto.Hash{
+	MessageHashSHA256: crypto.SHA256,
+	MessageHashSHA384: crypto.SHA384,
+	MessageHashSHA512: crypto.SHA512,
+}
+
+// SignatureMode specifies where the nonce of an attribute-based signature comes from.
+type SignatureMode string
+
+const (
+	// SignatureModeSession is the mode of signatures requested by a verifier (e.g. for contract
+	// signing), whose nonce comes from the session of the verifier. This is the default.
+	SignatureModeSession SignatureMode = "session"
+	// SignatureModeStandalone is the mode of signatures that users create on their own initiative,
+	// without a session, whose nonce is generated by the client (see irmaclient.Client.SignMessage).
+	SignatureModeStandalone SignatureMode = "standalone"
+)
+
+// standaloneSignatureContext is hashed into the nonce of standalone signatures, so that they cannot
+// be used as signatures or disclosures in sessions, nor the other way around.
+const standaloneSignatureContext = "irma-standalone-signature"
+
 // SignedMessage is a message signed with an attribute-based signature
 // The 'realnonce' will be calculated as: SigRequest.GetNonce() = ASN1(nonce, SHA256(message), timestampSignature)
+// For signatures over a message hash, MessageHash and MessageDisplay are set instead of Message;
+// see ASN1ConvertHashedSignatureNonce().
 type SignedMessage struct {
-	LDContext string                    `json:"@context"`
-	Signature gabi.ProofList            `json:"signature"`
-	Indices   DisclosedAttributeIndices `json:"indices"`
-	Nonce     *big.Int                  `json:"nonce"`
-	Context   *big.Int                  `json:"context"`
-	Message   string                    `json:"message"`
-	Timestamp *atum.Timestamp           `json:"timestamp"`
+	LDContext      string                    `json:"@context"`
+	Signature      gabi.ProofList            `json:"signature"`
+	Indices        DisclosedAttributeIndices `json:"indices"`
+	Nonce          *big.Int                  `json:"nonce"`
+	Context        *big.Int                  `json:"context"`
+	Message        string                    `json:"message"`
+	MessageHash    *MessageHash              `json:"messageHash,omitempty"`
+	MessageDisplay string                    `json:"messageDisplay,omitempty"`
+	Timestamp      *atum.Timestamp           `json:"timestamp"`
+	// Mode in which the signature was created; absent in signatures created before modes existed,
+	// which were all session-bound
+	Mode SignatureMode `json:"mode,omitempty"`
+}
+
+// MessageHash is the digest of a message, such as a PDF document, that is signed in an
+// attribute-based signature session without sending the message itself to the client.
+type MessageHash struct {
+	Algorithm string `json:"alg"`
+	Digest    []byte `json:"digest"`
+}
+
+// hashedMessage is hashed into the nonce of signatures over a message hash, along with the
+// message that was shown to the user. It is encoded as an ASN.1 sequence, while plain messages
+// are encoded as an ASN.1 integer, so that signatures over either kind cannot be confused.
+type hashedMessage struct {
+	Algorithm string `asn1:"utf8"`
+	Digest    []byte
+	Display   string `asn1:"utf8"`
+}
+
+// newHashedMessage returns the hashedMessage of the specified message hash and display message.
+// As they are encoded as ASN.1 UTF8Strings, the algorithm and display message must be valid UTF-8
+// (which encoding/asn1 does not check).
+func newHashedMessage(hash *MessageHash, display string) (hashedMessage, error) {
+	if !utf8.ValidString(hash.Algorithm) {
+		return hashedMessage{}, errors.New("message hash algorithm is not valid UTF-8")
+	}
+	if !utf8.ValidString(display) {
+		return hashedMessage{}, errors.New("display message is not valid UTF-8")
+	}
+	return hashedMessage{hash.Algorithm, hash.Digest, display}, nil
+}
+
+// Validate checks that the hash algorithm is supported and that the digest has the right length.
+func (h *MessageHash) Validate() error {
+	alg, ok := messageHashAlgorithms[h.Algorithm]
+	if !ok {
+		return errors.Errorf("unsupported message hash algorithm %s", h.Algorithm)
+	}
+	if len(h.Digest) != alg.Size() {
+		return errors.Errorf("message hash has length %d, expected %d", len(h.Digest), alg.Size())
+	}
+	return nil
+}
+
+// Matches returns whether this is the hash of the specified message.
+func (h *MessageHash) Matches(message []byte) bool {
+	alg, ok := messageHashAlgorithms[h.Algorithm]
+	if !ok {
+		return false
+	}
+	hash := alg.New()
+	hash.Write(message)
+	return bytes.Equal(hash.Sum(nil), h.Digest)
+}
+
+// NewMessageHash computes the MessageHash of the specified message using the specified algorithm.
+func NewMessageHash(algorithm string, message []byte) (*MessageHash, error) {
+	alg, ok := messageHashAlgorithms[algorithm]
+	if !ok {
+		return nil, errors.Errorf("unsupported message hash algorithm %s", algorithm)
+	}
+	hash := alg.New()
+	hash.Write(message)
+	return &MessageHash{Algorithm: algorithm, Digest: hash.Sum(nil)}, nil
 }
 
 func (sm *SignedMessage) Version() int {
@@ -32,13 +136,71 @@ func (sm *SignedMessage) Version() int {
 	return 2
 }
 
+// GetNonce returns the nonce over which the signature was created, or nil if it cannot be computed
+// because the signature is malformed (which Verify reports).
 func (sm *SignedMessage) GetNonce() *big.Int {
-	return ASN1ConvertSignatureNonce(sm.Message, sm.Nonce, sm.Timestamp)
+	nonce, err := sm.nonce()
+	if err != nil {
+		return nil
+	}
+	return nonce
+}
+
+func (sm *SignedMessage) nonce() (*big.Int, error) {
+	nonce, err := signatureNonce(sm.Mode, sm.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	if sm.MessageHash != nil {
+		return ASN1ConvertHashedSignatureNonce(sm.MessageHash, sm.MessageDisplay, nonce, sm.Timestamp)
+	}
+	return ASN1ConvertSignatureNonce(sm.Message, nonce, sm.Timestamp), nil
 }
 
+// MatchesNonceAndContext returns whether the signature was made in response to the specified
+// request. If the signature is over a message hash while the request contains the full message,
+// then the message hash must be the hash of the message of the request. The signature must have
+// been created in the mode of the request; as the nonce of standalone signatures is generated by
+// the client, the nonce of standalone requests is ignored.
 func (sm *SignedMessage) MatchesNonceAndContext(request *SignatureRequest) bool {
-	return sm.Context.Cmp(request.GetContext()) == 0 &&
-		sm.GetNonce().Cmp(request.GetNonce(sm.Timestamp)) == 0
+	if (sm.Mode == SignatureModeStandalone) != (request.Mode == SignatureModeStandalone) {
+		return false
+	}
+	if request.Mode == SignatureModeStandalone {
+		r := *request
+		r.Nonce = sm.Nonce
+		request = &r
+	}
+	if sm.Context.Cmp(request.GetContext()) != 0 {
+		return false
+	}
+	nonce, err := sm.nonce()
+	if err != nil {
+		return false
+	}
+	var expected *big.Int
+	if sm.MessageHash != nil && request.MessageHash == nil {
+		if !sm.MessageHash.Matches([]byte(request.Message)) {
+			return false
+		}
+		requestNonce, err := request.signatureNonce()
+		if err != nil {
+			return false
+		}
+		expected, err = ASN1ConvertHashedSignatureNonce(sm.MessageHash, sm.MessageDisplay, requestNonce, sm.Timestamp)
+		if err != nil {
+			return false
+		}
+	} else if expected, err = request.nonce(sm.Timestamp); err != nil {
+		return false
+	}
+	return nonce.Cmp(expected) == 0
+}
+
+// TimestampMessage returns the message over which the timestamp of the signature is computed:
+// the message itself, or the encoding of the message hash and displayed message.
+func (sm *SignedMessage) TimestampMessage() (string, error) {
+	return timestampMessage(sm.Message, sm.MessageHash, sm.MessageDisplay)
 }
 
 func (sm *SignedMessage) Disclosure() *Disclosure {
@@ -53,18 +215,75 @@ func (sm *SignedMessage) Disclosure() *Disclosure {
 // where serverNonce is the nonce sent by the signature requestor.
 func ASN1ConvertSignatureNonce(message string, nonce *big.Int, timestamp *atum.Timestamp) *big.Int {
 	msgHash := sha256.Sum256([]byte(message))
+	n, err := asn1SignatureNonce(new(gobig.Int).SetBytes(msgHash[:]), nonce, timestamp)
+	if err != nil {
+		log.Print(err) // only fails on invalid types, while the message is hashed into an integer
+	}
+	return n
+}
+
+// ASN1ConvertHashedSignatureNonce computes the nonce that is used in the creation of an
+// attribute-based signature over a message hash:
+//    nonce = SHA256(serverNonce, (algorithm, digest, display), timestampSignature)
+// where display is the message that was shown to the user instead of the hashed message.
+// It fails if the display message is not valid UTF-8.
+func ASN1ConvertHashedSignatureNonce(hash *MessageHash, display string, nonce *big.Int, timestamp *atum.Timestamp) (*big.Int, error) {
+	msg, err := newHashedMessage(hash, display)
+	if err != nil {
+		return nil, err
+	}
+	return asn1SignatureNonce(msg, nonce, timestamp)
+}
+
+// signatureNonce returns the nonce of a signature in the specified mode: for standalone signatures
+//    nonce = SHA256(standaloneSignatureContext, clientNonce)
+// and for session-bound signatures the nonce of the session itself.
+func signatureNonce(mode SignatureMode, nonce *big.Int) (*big.Int, error) {
+	if mode != SignatureModeStandalone {
+		return nonce, nil
+	}
 	n := nonce.Go()
 	if n == nil {
 		n = gobig.NewInt(0)
 	}
-	tohash := []interface{}{n, new(gobig.Int).SetBytes(msgHash[:])}
+	asn1bytes, err := asn1.Marshal([]interface{}{standaloneSignatureContext, n})
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to compute standalone signature nonce", 0)
+	}
+	asn1hash := sha256.Sum256(asn1bytes)
+	return new(big.Int).SetBytes(asn1hash[:]), nil
+}
+
+func asn1SignatureNonce(message interface{}, nonce *big.Int, timestamp *atum.Timestamp) (*big.Int, error) {
+	n := nonce.Go()
+	if n == nil {
+		n = gobig.NewInt(0)
+	}
+	tohash := []interface{}{n, message}
 	if timestamp != nil {
 		tohash = append(tohash, timestamp.Sig.Data)
 	}
 	asn1bytes, err := asn1.Marshal(tohash)
 	if err != nil {
-		log.Print(err) // TODO
+		return nil, errors.WrapPrefix(err, "failed to compute signature nonce", 0)
 	}
 	asn1hash := sha256.Sum256(asn1bytes)
-	return new(big.Int).SetBytes(asn1hash[:])
+	return new(big.Int).SetBytes(asn1hash[:]), nil
+}
+
+// timestampMessage returns the message over which the timestamp of a signature is computed. For
+// signatures over a message hash, it fails if the display message is not valid UTF-8.
+func timestampMessage(message string, hash *MessageHash, display string) (string, error) {
+	if hash == nil {
+		return message, nil
+	}
+	msg, err := newHashedMessage(hash, display)
+	if err != nil {
+		return "", err
+	}
+	bts, err := asn1.Marshal(msg)
+	if err != nil {
+		return "", errors.WrapPrefix(err, "failed to encode message hash", 0)
+	}
+	return string(bts), nil
 }
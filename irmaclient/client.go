@@ -1,8 +1,15 @@
 package irmaclient
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
 	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -67,23 +74,55 @@ type Client struct {
 	handler               ClientHandler
 	sessions              sessions
 
+	// Time budget of the keyshare protocol during sessions, excluding the time the user takes
+	// to enter the PIN (default value 0 means DefaultKeyshareTimeout)
+	KeyshareTimeout time.Duration
+
+	// Longest delay after which the client retries requests that the IRMA server or a keyshare server
+	// refused, asking to be retried after that delay using the Retry-After header, instead of failing
+	// (default value 0 means DefaultMaxRetryAfter, negative values disable retrying). See also
+	// ServerBusyHandler.
+	MaxRetryAfter time.Duration
+
 	jobs       chan func()   // queue of jobs to run
 	jobsPause  chan struct{} // sending pauses background jobs
 	jobsPaused bool
 
 	credMutex sync.Mutex
+
+	// Recently retrieved status of each keyshare server, see KeyshareStatus()
+	keyshareStatuses     map[irma.SchemeManagerIdentifier]*keyshareStatusEntry
+	keyshareStatusesLock sync.Mutex
+
+	// Guards keyshareServers, which keyshare server responses during sessions modify from the session
+	// goroutine (see keyshareSunset()). Code running outside the lock uses copies of the keyshare
+	// servers, see keyshareServer()
+	keyshareServersLock sync.Mutex
 }
 
 // TODO: consider if we should save irmamobile preferences here, because they would automatically
 // be part of any backup and syncing solution we implement at a later time
 type Preferences struct {
 	DeveloperMode bool
+	// Language of the app (e.g. nl or nl-NL), in which keyshare servers are asked to describe PIN statuses
+	Language string `json:",omitempty"`
 }
 
 var defaultPreferences = Preferences{
 	DeveloperMode: false,
 }
 
+// DefaultMaxRetryAfter is the longest delay after which refused requests are retried if
+// Client.MaxRetryAfter is 0.
+const DefaultMaxRetryAfter = 5 * time.Second
+
+func maxRetryAfter(d time.Duration) time.Duration {
+	if d == 0 {
+		return DefaultMaxRetryAfter
+	}
+	return d
+}
+
 // KeyshareHandler is used for asking the user for his email address and PIN,
 // for enrolling at a keyshare server.
 type KeyshareHandler interface {
@@ -91,6 +130,23 @@ type KeyshareHandler interface {
 	EnrollmentSuccess(manager irma.SchemeManagerIdentifier)
 }
 
+// KeyshareSunsetHandler may optionally be implemented by the ClientHandler, to be informed when a
+// keyshare server announces that it deprecates the protocol in use or will stop supporting it,
+// so that the app can prompt the user to update. It is invoked when a keyshare server announces a
+// deprecation or an earlier sunset than before; the latest announcements of each keyshare server
+// are also available through KeyshareSunset().
+type KeyshareSunsetHandler interface {
+	KeyshareSunset(manager irma.SchemeManagerIdentifier, announcement *irma.SunsetAnnouncement)
+}
+
+// KeyshareMaintenanceHandler may optionally be implemented by the ClientHandler, to be informed when
+// a keyshare server could not be reached or responded that it is unavailable, while it announces
+// (in its status, see KeyshareStatus()) that it is under maintenance. This allows the app to show
+// the announced message instead of the error, which is still reported afterwards as usual.
+type KeyshareMaintenanceHandler interface {
+	KeyshareMaintenance(manager irma.SchemeManagerIdentifier, status *irma.KeyshareStatus)
+}
+
 type ChangePinHandler interface {
 	ChangePinFailure(manager irma.SchemeManagerIdentifier, err error)
 	ChangePinSuccess(manager irma.SchemeManagerIdentifier)
@@ -125,6 +181,16 @@ type DisclosureCandidate struct {
 	Expired      bool
 	Revoked      bool
 	NotRevokable bool
+
+	// Only set if the candidate is present: the credential containing the attribute, including
+	// the attribute values that would be disclosed, and the display name of its issuer.
+	Credential *irma.CredentialInfo
+	IssuerName irma.TranslatedString
+
+	// Whether only possession of the credential would be proven, i.e. when the request asks for
+	// the credential type instead of one of its attributes; none of its attribute values are then
+	// disclosed.
+	Possession bool
 }
 
 type DisclosureCandidates []*DisclosureCandidate
@@ -211,6 +277,14 @@ func New(
 		return nil, err
 	}
 
+	// Now that the storage is known to be readable, back it up. If data had to be recovered,
+	// the previous backup is kept.
+	if len(client.storage.Warnings()) == 0 {
+		if err := client.storage.backup(); err != nil {
+			irma.Logger.Warnf("Failed to make database backup: %s", err.Error())
+		}
+	}
+
 	if len(client.UnenrolledSchemeManagers()) > 1 {
 		return nil, errors.New("Too many keyshare servers")
 	}
@@ -235,6 +309,14 @@ func (client *Client) Close() error {
 	return client.storage.Close()
 }
 
+// StorageWarnings returns the data that could not be read from the storage of the client because
+// it was corrupted, e.g. by a crash while writing to it, and that was either restored from a backup
+// or lost. Apps can use this to inform the user, for example that the logs were lost but the
+// credentials are intact.
+func (client *Client) StorageWarnings() []StorageWarning {
+	return client.storage.Warnings()
+}
+
 func (client *Client) nonrevCredPrepareCache(credid irma.CredentialTypeIdentifier, index int) error {
 	irma.Logger.WithFields(logrus.Fields{"credid": credid, "index": index}).Debug("Preparing cache")
 	cred, err := client.credential(credid, index)
@@ -450,7 +532,9 @@ func (client *Client) RemoveStorage() error {
 
 	// Remove data from memory
 	client.attributes = make(map[irma.CredentialTypeIdentifier][]*irma.AttributeList)
+	client.keyshareServersLock.Lock()
 	client.keyshareServers = make(map[irma.SchemeManagerIdentifier]*keyshareServer)
+	client.keyshareServersLock.Unlock()
 	client.credentialsCache = make(map[irma.CredentialTypeIdentifier]map[int]*credential)
 	client.lookup = make(map[string]*credLookup)
 
@@ -507,6 +591,47 @@ func (client *Client) Attributes(id irma.CredentialTypeIdentifier, counter int)
 	return list[counter]
 }
 
+// CredentialTypeLogo returns the path of the logo of the specified credential type: the logo in its
+// scheme if present, otherwise the logo fetched from the IRMA server that issued it, if any.
+func (client *Client) CredentialTypeLogo(id irma.CredentialTypeIdentifier) string {
+	if credtype := client.Configuration.CredentialTypes[id]; credtype != nil {
+		if path := credtype.Logo(client.Configuration); path != "" {
+			return path
+		}
+	}
+	return client.storage.LogoPath(id)
+}
+
+// fetchMissingLogos fetches the logos of the specified credential types that are missing from our
+// schemes from the IRMA server at the specified URL, e.g. because it uses a newer version of the
+// scheme. If any were fetched, the handler is informed so that the credentials are displayed again.
+func (client *Client) fetchMissingLogos(serverURL string, ids []irma.CredentialTypeIdentifier) {
+	transport := irma.NewHTTPTransport(serverURL, !client.Preferences.DeveloperMode)
+	fetched := false
+	for _, id := range ids {
+		if client.CredentialTypeLogo(id) != "" {
+			continue
+		}
+		logo, err := transport.GetBytes("credentialtypes/" + id.String() + "/logo")
+		if err != nil {
+			irma.Logger.Warnf("Failed to fetch logo of %s: %s", id, err.Error())
+			continue
+		}
+		if contentType := http.DetectContentType(logo); contentType != "image/png" {
+			irma.Logger.Warnf("Ignoring logo of %s with unexpected content type %s", id, contentType)
+			continue
+		}
+		if err = client.storage.StoreLogo(id, logo); err != nil {
+			client.reportError(err)
+			continue
+		}
+		fetched = true
+	}
+	if fetched {
+		client.handler.UpdateAttributes()
+	}
+}
+
 func (client *Client) attributesByHash(hash string) (*irma.AttributeList, int) {
 	lookup, present := client.lookup[hash]
 	if !present {
@@ -668,6 +793,9 @@ func (client *Client) satisfiesCon(base *irma.BaseRequest, attrs *irma.Attribute
 			continue
 		}
 		credfound = true
+		if attr.Type.IsCredential() {
+			continue // possession of the credential is requested, which any instance satisfies
+		}
 		if !attr.Satisfy(attr.Type, attrs.UntranslatedAttribute(attr.Type)) {
 			// Using attributes out of more than one instance of a credential type to satisfy
 			// a single con is not allowed, so if any one of the attributes of this instance does
@@ -709,7 +837,8 @@ func (set credCandidateSet) expand(client *Client, base *irma.BaseRequest, con i
 						Type:           attr.Type,
 						CredentialHash: credopt.Hash,
 					},
-					Value: irma.NewTranslatedString(attr.Value),
+					Value:      irma.NewTranslatedString(attr.Value),
+					Possession: attr.Type.IsCredential(),
 				}
 				if credopt.Present() {
 					attrlist, _ := client.attributesByHash(credopt.Hash)
@@ -720,6 +849,10 @@ func (set credCandidateSet) expand(client *Client, base *irma.BaseRequest, con i
 					attropt.Expired = !attrlist.IsValid()
 					attropt.Revoked = attrlist.Revoked
 					attropt.NotRevokable = cred.NonRevocationWitness == nil && base.RequestsRevocation(credopt.Type)
+					attropt.Credential = attrlist.Info()
+					if issuer := client.Configuration.Issuers[credopt.Type.IssuerIdentifier()]; issuer != nil {
+						attropt.IssuerName = issuer.Name
+					}
 				}
 				candidateSet = append(candidateSet, attropt)
 			}
@@ -741,7 +874,9 @@ func cartesianProduct(candidates [][]*credCandidate) credCandidateSet {
 // candidatesDisCon returns attributes present in this client that satisfy the specified attribute
 // disjunction. It returns a list of candidate attribute sets, each of which would satisfy the
 // specified disjunction.
-func (client *Client) candidatesDisCon(request irma.SessionRequest, discon irma.AttributeDisCon) (
+// If instances is more than 1, conjunctions are satisfied by the attributes out of all (but at most
+// instances) credential instances satisfying it, if the client has any.
+func (client *Client) candidatesDisCon(request irma.SessionRequest, discon irma.AttributeDisCon, instances int) (
 	candidates []DisclosureCandidates, satisfiable bool, err error,
 ) {
 	candidates = []DisclosureCandidates{}
@@ -755,6 +890,20 @@ func (client *Client) candidatesDisCon(request irma.SessionRequest, discon irma.
 			continue
 		}
 
+		if instances > 1 {
+			// Offer all instances as a single candidate set, so that the user consents to
+			// disclosing them at once
+			all, err := client.instancesCandidates(request.Base(), con, instances)
+			if err != nil {
+				return nil, false, err
+			}
+			if all != nil {
+				candidates = append(candidates, all)
+				satisfiable = true
+				continue
+			}
+		}
+
 		// Build a list containing, for each attribute in this conjunction, a list of credential
 		// instances containing the attribute. Writing schematically a sample conjunction of three
 		// attribute types as [ a.a.a.a, a.a.a.b, a.a.b.x ], we map this to:
@@ -788,6 +937,57 @@ func (client *Client) candidatesDisCon(request irma.SessionRequest, discon irma.
 	return
 }
 
+// instancesCandidates returns the attributes requested by the conjunction out of each usable
+// credential instance satisfying it, up to the specified maximum number of instances, or nil if
+// the client has no such instances. Instances disclosing the same values as an earlier one are
+// skipped, as the verifier cannot tell them apart.
+func (client *Client) instancesCandidates(base *irma.BaseRequest, con irma.AttributeCon, max int) (DisclosureCandidates, error) {
+	credtypes := con.CredentialTypes()
+	if len(credtypes) != 1 {
+		return nil, nil
+	}
+	credtype := client.Configuration.CredentialTypes[credtypes[0]]
+	if credtype == nil {
+		return nil, nil
+	}
+
+	var creds []*credCandidate
+	disclosed := map[string]struct{}{}
+	for _, attrlist := range client.attributes[credtypes[0]] {
+		if len(creds) == max {
+			break
+		}
+		if satisfies, usable := client.satisfiesCon(base, attrlist, con); !satisfies || !usable {
+			continue
+		}
+		values := attrlist.Ints[0].String() // metadata attribute
+		for _, attr := range con {
+			if attr.Type.IsCredential() {
+				continue
+			}
+			index, err := credtype.IndexOf(attr.Type)
+			if err != nil {
+				return nil, err
+			}
+			values += "," + attrlist.Ints[index+1].String()
+		}
+		if _, ok := disclosed[values]; ok {
+			continue
+		}
+		disclosed[values] = struct{}{}
+		creds = append(creds, &credCandidate{Type: credtypes[0], Hash: attrlist.Hash()})
+	}
+	if len(creds) == 0 {
+		return nil, nil
+	}
+
+	expanded, err := credCandidateSet{creds}.expand(client, base, con)
+	if err != nil {
+		return nil, err
+	}
+	return expanded[0], nil
+}
+
 // Candidates returns a list of options for the user to choose from,
 // given a session request and the credentials currently in storage.
 func (client *Client) Candidates(request irma.SessionRequest) (
@@ -800,7 +1000,7 @@ func (client *Client) Candidates(request irma.SessionRequest) (
 	client.credMutex.Lock()
 	defer client.credMutex.Unlock()
 	for i, discon := range condiscon {
-		cands, disconSatisfiable, err := client.candidatesDisCon(request, discon)
+		cands, disconSatisfiable, err := client.candidatesDisCon(request, discon, request.Disclosure().Instances(i))
 		if err != nil {
 			return nil, false, err
 		}
@@ -903,7 +1103,11 @@ func (client *Client) ProofBuilders(choice *irma.DisclosureChoice, request irma.
 			sigs = append(sigs, s)
 			disclosed = append(disclosed, d)
 		}
-		timestamp, err = irma.GetTimestamp(r.Message, sigs, disclosed, client.Configuration)
+		var message string
+		if message, err = r.TimestampMessage(); err != nil {
+			return nil, nil, nil, err
+		}
+		timestamp, err = irma.GetTimestamp(message, sigs, disclosed, client.Configuration)
 		if err != nil {
 			return nil, nil, nil, err
 		}
@@ -914,13 +1118,18 @@ func (client *Client) ProofBuilders(choice *irma.DisclosureChoice, request irma.
 
 // Proofs computes disclosure proofs containing the attributes specified by choice.
 func (client *Client) Proofs(choice *irma.DisclosureChoice, request irma.SessionRequest) (*irma.Disclosure, *atum.Timestamp, error) {
+	return client.proofs(choice, request, nil)
+}
+
+func (client *Client) proofs(choice *irma.DisclosureChoice, request irma.SessionRequest, progress func(Progress),
+) (*irma.Disclosure, *atum.Timestamp, error) {
 	builders, choices, timestamp, err := client.ProofBuilders(choice, request)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	_, issig := request.(*irma.SignatureRequest)
-	proofs, err := builders.BuildProofList(request.Base().GetContext(), request.GetNonce(timestamp), issig)
+	proofs, err := withProgress(builders, progress).BuildProofList(request.Base().GetContext(), request.GetNonce(timestamp), issig)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -930,6 +1139,37 @@ func (client *Client) Proofs(choice *irma.DisclosureChoice, request irma.Session
 	}, timestamp, nil
 }
 
+// progressBuilder reports the computation of the commitment and response of a proof builder.
+// The underlying builder keeps the state of the proof, so that the builders need only be wrapped
+// while computing the proofs.
+type progressBuilder struct {
+	gabi.ProofBuilder
+	index, total int
+	progress     func(Progress)
+}
+
+func (b progressBuilder) Commit(randomizers map[string]*big.Int) ([]*big.Int, error) {
+	b.progress(Progress{Step: ProgressStepCommitment, Current: b.index + 1, Total: b.total})
+	return b.ProofBuilder.Commit(randomizers)
+}
+
+func (b progressBuilder) CreateProof(challenge *big.Int) gabi.Proof {
+	b.progress(Progress{Step: ProgressStepResponse, Current: b.index + 1, Total: b.total})
+	return b.ProofBuilder.CreateProof(challenge)
+}
+
+// withProgress returns the builders wrapped such that they report their progress, if progress is not nil.
+func withProgress(builders gabi.ProofBuilderList, progress func(Progress)) gabi.ProofBuilderList {
+	if progress == nil {
+		return builders
+	}
+	wrapped := make(gabi.ProofBuilderList, len(builders))
+	for i, builder := range builders {
+		wrapped[i] = progressBuilder{ProofBuilder: builder, index: i, total: len(builders), progress: progress}
+	}
+	return wrapped
+}
+
 // generateIssuerProofNonce generates a nonce which the issuer must use in its gabi.ProofS.
 func generateIssuerProofNonce() (*big.Int, error) {
 	return gabi.GenerateNonce()
@@ -947,10 +1187,17 @@ func (client *Client) IssuanceProofBuilders(request *irma.IssuanceRequest, choic
 	builders := gabi.ProofBuilderList([]gabi.ProofBuilder{})
 	for _, futurecred := range request.Credentials {
 		var pk *gabikeys.PublicKey
-		pk, err = client.Configuration.PublicKey(futurecred.CredentialTypeID.IssuerIdentifier(), futurecred.KeyCounter)
+		pk, err = client.Configuration.PublicKey(futurecred.CredentialTypeID.IssuerIdentifier(), futurecred.PublicKeyCounter())
 		if err != nil {
 			return nil, nil, nil, err
 		}
+		if pk == nil {
+			return nil, nil, nil, errors.Errorf("unknown public key %s-%d", futurecred.CredentialTypeID.IssuerIdentifier(), futurecred.PublicKeyCounter())
+		}
+		// Fail before building commitments for attribute values that cannot be issued
+		if err = futurecred.ValidateAttributeValues(); err != nil {
+			return nil, nil, nil, err
+		}
 		credtype := client.Configuration.CredentialTypes[futurecred.CredentialTypeID]
 		credBuilder, err := gabi.NewCredentialBuilder(pk, request.GetContext(),
 			client.secretkey.Key, issuerProofNonce, credtype.RandomBlindAttributeIndices())
@@ -971,12 +1218,17 @@ func (client *Client) IssuanceProofBuilders(request *irma.IssuanceRequest, choic
 // IssueCommitments computes issuance commitments, along with disclosure proofs specified by choice,
 // and also returns the credential builders which will become the new credentials upon combination with the issuer's signature.
 func (client *Client) IssueCommitments(request *irma.IssuanceRequest, choice *irma.DisclosureChoice,
+) (*irma.IssueCommitmentMessage, gabi.ProofBuilderList, error) {
+	return client.issueCommitments(request, choice, nil)
+}
+
+func (client *Client) issueCommitments(request *irma.IssuanceRequest, choice *irma.DisclosureChoice, progress func(Progress),
 ) (*irma.IssueCommitmentMessage, gabi.ProofBuilderList, error) {
 	builders, choices, issuerProofNonce, err := client.IssuanceProofBuilders(request, choice)
 	if err != nil {
 		return nil, nil, err
 	}
-	proofs, err := builders.BuildProofList(request.GetContext(), request.GetNonce(nil), false)
+	proofs, err := withProgress(builders, progress).BuildProofList(request.GetContext(), request.GetNonce(nil), false)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1007,6 +1259,9 @@ func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, re
 			continue
 		}
 		sig := msg[i-offset]
+		if sig == nil { // The server failed to issue this credential (partial issuance)
+			continue
+		}
 
 		var nonrevAttr *big.Int
 		if sig.NonRevocationWitness != nil {
@@ -1050,9 +1305,43 @@ func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, re
 	return nil
 }
 
+// resolveDisclosedValues fills in the attribute values of the issuance request that refer to
+// attributes disclosed in the same session, using the values that we disclosed, just like the
+// server does after having verified our disclosure. Credentials for which the server sent no
+// signature, because it failed to issue them, are skipped.
+func (client *Client) resolveDisclosedValues(request *irma.IssuanceRequest, choice *irma.DisclosureChoice, sigs []*gabi.IssueSignatureMessage) error {
+	disclosed := map[irma.AttributeTypeIdentifier]string{}
+	if choice != nil {
+		for _, attrlist := range choice.Attributes {
+			for _, attr := range attrlist {
+				attrs, _ := client.attributesByHash(attr.CredentialHash)
+				if attrs == nil {
+					continue
+				}
+				if value := attrs.UntranslatedAttribute(attr.Type); value != nil {
+					disclosed[attr.Type] = *value
+				}
+			}
+		}
+	}
+	for i, cred := range request.Credentials {
+		if i < len(sigs) && sigs[i] == nil {
+			continue
+		}
+		resolved, err := cred.WithDisclosedValues(disclosed)
+		if err != nil {
+			return err
+		}
+		request.Credentials[i] = resolved
+	}
+	return nil
+}
+
 // Keyshare server handling
 
 func (client *Client) genSchemeManagersList(enrolled bool) []irma.SchemeManagerIdentifier {
+	client.keyshareServersLock.Lock()
+	defer client.keyshareServersLock.Unlock()
 	list := []irma.SchemeManagerIdentifier{}
 	for name, manager := range client.Configuration.SchemeManagers {
 		if _, contains := client.keyshareServers[name]; manager.Distributed() && contains == enrolled {
@@ -1071,16 +1360,56 @@ func (client *Client) EnrolledSchemeManagers() []irma.SchemeManagerIdentifier {
 }
 
 // KeyshareEnroll attempts to enroll at the keyshare server of the specified scheme manager.
+// The email address and PIN must satisfy the KeyshareRegistration policy of the scheme manager,
+// if present; if the policy includes terms, use KeyshareEnrollAcceptingTerms instead.
 func (client *Client) KeyshareEnroll(manager irma.SchemeManagerIdentifier, email *string, pin string, lang string) {
+	client.KeyshareEnrollAcceptingTerms(manager, email, pin, lang, "")
+}
+
+// KeyshareEnrollAcceptingTerms is like KeyshareEnroll, additionally indicating that the user
+// accepted the specified version of the terms of the keyshare server.
+func (client *Client) KeyshareEnrollAcceptingTerms(manager irma.SchemeManagerIdentifier, email *string, pin string, lang string, termsVersion string) {
+	client.KeyshareEnrollWithAttestation(manager, email, pin, lang, termsVersion, "", "")
+}
+
+// KeyshareEnrollWithAttestation is like KeyshareEnrollAcceptingTerms, additionally sending a platform
+// attestation token to the keyshare server, for keyshare servers that verify or require these. The
+// token, obtained by the app from the attestation service of its platform, and the platform (e.g.
+// "android" or "ios") are sent as is.
+func (client *Client) KeyshareEnrollWithAttestation(
+	manager irma.SchemeManagerIdentifier, email *string, pin, lang, termsVersion, attestationToken, attestationPlatform string,
+) {
 	go func() {
-		err := client.keyshareEnrollWorker(manager, email, pin, lang)
+		err := client.keyshareEnrollWorker(manager, pin, irma.KeyshareEnrollment{
+			Email:                email,
+			Language:             lang,
+			AcceptedTermsVersion: termsVersion,
+			AttestationToken:     attestationToken,
+			AttestationPlatform:  attestationPlatform,
+		})
 		if err != nil {
 			client.handler.EnrollmentFailure(manager, err)
 		}
 	}()
 }
 
-func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifier, email *string, pin string, lang string) error {
+// KeyshareEnrollWithRecoveryToken re-enrolls this device to the existing account at the keyshare server of the
+// specified scheme manager to which the recovery token belongs (see KeyshareRecoveryToken), keeping
+// its username, after the keyshare state of the device was lost. This invalidates the secrets of all
+// devices previously enrolled to the account. As with KeyshareEnroll, the result is reported to
+// EnrollmentSuccess or EnrollmentFailure of the handler.
+func (client *Client) KeyshareEnrollWithRecoveryToken(manager irma.SchemeManagerIdentifier, recoveryToken, pin, lang string) {
+	go func() {
+		err := client.keyshareEnrollWorker(manager, pin, irma.KeyshareEnrollment{Language: lang, RecoveryToken: recoveryToken})
+		if err != nil {
+			client.handler.EnrollmentFailure(manager, err)
+		}
+	}()
+}
+
+// keyshareEnrollWorker enrolls at the keyshare server using the specified enrollment message, after
+// setting its hashed PIN.
+func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifier, pin string, message irma.KeyshareEnrollment) error {
 	manager, ok := client.Configuration.SchemeManagers[managerID]
 	if !ok {
 		return errors.New("Unknown scheme manager")
@@ -1088,23 +1417,25 @@ func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifie
 	if len(manager.KeyshareServer) == 0 {
 		return errors.New("Scheme manager has no keyshare server")
 	}
-	if len(pin) < 5 {
-		return errors.New("PIN too short, must be at least 5 characters")
+	if err := manager.KeyshareRegistration.ValidatePin(pin); err != nil {
+		return err
+	}
+	// The account to be re-enrolled already satisfied the registration policy when it was registered
+	if message.RecoveryToken == "" {
+		if err := manager.KeyshareRegistration.ValidateEnrollment(message.Email, message.AcceptedTermsVersion); err != nil {
+			return err
+		}
 	}
 
-	transport := irma.NewHTTPTransport(manager.KeyshareServer, !client.Preferences.DeveloperMode)
+	transport := client.newKeyshareTransport(managerID)
 	kss, err := newKeyshareServer(managerID)
 	if err != nil {
 		return err
 	}
-	message := irma.KeyshareEnrollment{
-		Email:    email,
-		Pin:      kss.HashedPin(pin),
-		Language: lang,
-	}
+	message.Pin = kss.HashedPin(pin)
 
 	qr := &irma.Qr{}
-	err = transport.Post("client/register", qr, message)
+	err = kss.postPin(client.Configuration, transport, "client/register", qr, message)
 	if err != nil {
 		return err
 	}
@@ -1114,7 +1445,9 @@ func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifie
 	// keyshare.go needs the relevant keyshare server to be present in the client.
 	// If the session succeeds or fails, the keyshare server is stored to disk or
 	// removed from the client by the keyshareEnrollmentHandler.
+	client.keyshareServersLock.Lock()
 	client.keyshareServers[managerID] = kss
+	client.keyshareServersLock.Unlock()
 	client.newQrSession(qr, &keyshareEnrollmentHandler{
 		client: client,
 		pin:    pin,
@@ -1124,6 +1457,364 @@ func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifie
 	return nil
 }
 
+// KeyshareEnrollDevice attempts to enroll this device as additional device to an existing account at
+// the keyshare server of the specified scheme manager, using an enrollment code obtained by one of the
+// devices already enrolled to the account (see KeyshareEnrollmentCode). This device gets its own PIN.
+// As with KeyshareEnroll, the result is reported to EnrollmentSuccess or EnrollmentFailure of the handler.
+func (client *Client) KeyshareEnrollDevice(manager irma.SchemeManagerIdentifier, username, code, pin, name string) {
+	go func() {
+		err := client.keyshareEnrollDeviceWorker(manager, username, code, pin, name)
+		if err != nil {
+			client.handler.EnrollmentFailure(manager, err)
+		}
+	}()
+}
+
+func (client *Client) keyshareEnrollDeviceWorker(managerID irma.SchemeManagerIdentifier, username, code, pin, name string) error {
+	manager, ok := client.Configuration.SchemeManagers[managerID]
+	if !ok {
+		return errors.New("Unknown scheme manager")
+	}
+	if len(manager.KeyshareServer) == 0 {
+		return errors.New("Scheme manager has no keyshare server")
+	}
+	if err := manager.KeyshareRegistration.ValidatePin(pin); err != nil {
+		return err
+	}
+
+	transport := client.newKeyshareTransport(managerID)
+	kss, err := newKeyshareServer(managerID)
+	if err != nil {
+		return err
+	}
+	message := irma.KeyshareDeviceEnrollment{
+		Username: username,
+		Code:     code,
+		Pin:      kss.HashedPin(pin),
+		Name:     name,
+	}
+
+	registration := &irma.KeyshareDeviceRegistration{}
+	err = kss.postPin(client.Configuration, transport, "client/register/device", registration, message)
+	if err != nil {
+		return err
+	}
+	if registration.SessionPtr == nil {
+		return errors.New("Keyshare server returned no session pointer")
+	}
+
+	// As in keyshareEnrollWorker, the keyshare server is added to the client without saving it
+	// to disk, for the issuance session of the keyshare server login attribute.
+	kss.Username, kss.DeviceID = username, registration.DeviceID
+	client.keyshareServersLock.Lock()
+	client.keyshareServers[managerID] = kss
+	client.keyshareServersLock.Unlock()
+	client.newQrSession(registration.SessionPtr, &keyshareEnrollmentHandler{
+		client: client,
+		pin:    pin,
+		kss:    kss,
+	})
+
+	return nil
+}
+
+// KeyshareEnrollmentCode obtains a short-lived code from the keyshare server of the specified scheme
+// manager, with which another device can be enrolled to the account of this device using
+// KeyshareEnrollDevice. The PIN must have been verified recently using KeyshareVerifyPin.
+func (client *Client) KeyshareEnrollmentCode(manager irma.SchemeManagerIdentifier) (*irma.KeyshareEnrollmentCode, error) {
+	kss, ok := client.keyshareServer(manager)
+	if !ok {
+		return nil, errors.New("Unknown keyshare server")
+	}
+
+	transport := client.newKeyshareTransport(manager)
+	transport.SetHeader(kssUsernameHeader, kss.Username)
+	transport.SetHeader(kssAuthHeader, kss.token)
+	kss.setDeviceHeader(transport)
+	code := &irma.KeyshareEnrollmentCode{}
+	if err := transport.Post("users/devices/code", code, nil); err != nil {
+		return nil, err
+	}
+	return code, nil
+}
+
+// KeyshareRecoveryToken obtains a single-use token from the keyshare server of the specified scheme
+// manager, with which the account of this device can be re-enrolled to a new device using
+// KeyshareEnrollWithRecoveryToken, for example after the app is reinstalled. It should be stored outside of the
+// storage of the client, e.g. in the backup of the platform. Obtaining a new token invalidates the
+// previous one. The PIN must have been verified recently using KeyshareVerifyPin.
+func (client *Client) KeyshareRecoveryToken(manager irma.SchemeManagerIdentifier) (*irma.KeyshareRecoveryToken, error) {
+	kss, ok := client.keyshareServer(manager)
+	if !ok {
+		return nil, errors.New("Unknown keyshare server")
+	}
+
+	transport := client.newKeyshareTransport(manager)
+	transport.SetHeader(kssUsernameHeader, kss.Username)
+	transport.SetHeader(kssAuthHeader, kss.token)
+	kss.setDeviceHeader(transport)
+	token := &irma.KeyshareRecoveryToken{}
+	if err := transport.Post("users/recovery/token", token, nil); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// KeyshareChangeEmail replaces the email addresses registered at the keyshare server of the specified
+// scheme manager by the specified address, to which the keyshare server sends a verification link in
+// the specified language (or the language of the account, if empty). The PIN must have been verified
+// recently using KeyshareVerifyPin.
+func (client *Client) KeyshareChangeEmail(manager irma.SchemeManagerIdentifier, email, lang string) error {
+	transport, err := client.keyshareEmailTransport(manager, &email)
+	if err != nil {
+		return err
+	}
+	return transport.Put("users/email", nil, irma.KeyshareEmail{Email: email, Language: lang})
+}
+
+// KeyshareRemoveEmail removes all email addresses registered at the keyshare server of the specified
+// scheme manager, if its registration policy allows accounts without an email address. The PIN must
+// have been verified recently using KeyshareVerifyPin.
+func (client *Client) KeyshareRemoveEmail(manager irma.SchemeManagerIdentifier) error {
+	transport, err := client.keyshareEmailTransport(manager, nil)
+	if err != nil {
+		return err
+	}
+	return transport.DeleteURL("users/email")
+}
+
+// keyshareEmailTransport checks the new email address (if any) against the registration policy of
+// the scheme manager, and returns an authenticated transport to its keyshare server.
+func (client *Client) keyshareEmailTransport(manager irma.SchemeManagerIdentifier, email *string) (*irma.HTTPTransport, error) {
+	kss, ok := client.keyshareServer(manager)
+	if !ok {
+		return nil, errors.New("Unknown keyshare server")
+	}
+	if scheme, ok := client.Configuration.SchemeManagers[manager]; ok {
+		if err := scheme.KeyshareRegistration.ValidateEmail(email); err != nil {
+			return nil, err
+		}
+	}
+
+	transport := client.newKeyshareTransport(manager)
+	transport.SetHeader(kssUsernameHeader, kss.Username)
+	transport.SetHeader(kssAuthHeader, kss.token)
+	kss.setDeviceHeader(transport)
+	return transport, nil
+}
+
+// KeyshareSunset returns whether the keyshare server of the specified scheme manager has deprecated
+// the protocol in use, and the earliest date it announced to stop supporting it (if any).
+func (client *Client) KeyshareSunset(manager irma.SchemeManagerIdentifier) (bool, *irma.Timestamp) {
+	client.keyshareServersLock.Lock()
+	defer client.keyshareServersLock.Unlock()
+	kss, ok := client.keyshareServers[manager]
+	if !ok {
+		return false, nil
+	}
+	return kss.Deprecated, kss.Sunset
+}
+
+// KeyshareVersionInfo retrieves the supported protocol versions of the keyshare server of the
+// specified scheme manager, along with its announcements about their retirement.
+func (client *Client) KeyshareVersionInfo(manager irma.SchemeManagerIdentifier) (*irma.KeyshareVersionInfo, error) {
+	scheme, ok := client.Configuration.SchemeManagers[manager]
+	if !ok || !scheme.Distributed() {
+		return nil, errors.New("Unknown keyshare server")
+	}
+	info := &irma.KeyshareVersionInfo{}
+	if err := client.newKeyshareTransport(manager).Get("api/version", info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// KeyshareStatus retrieves the status of the keyshare server of the specified scheme manager, which
+// announces its operational state, maintenance window and minimum supported app version. To spare
+// keyshare servers that are struggling, the status (or the failure to retrieve it) is cached for
+// keyshareStatusCacheDuration.
+func (client *Client) KeyshareStatus(manager irma.SchemeManagerIdentifier) (*irma.KeyshareStatus, error) {
+	scheme, ok := client.Configuration.SchemeManagers[manager]
+	if !ok || !scheme.Distributed() {
+		return nil, errors.New("Unknown keyshare server")
+	}
+
+	client.keyshareStatusesLock.Lock()
+	defer client.keyshareStatusesLock.Unlock()
+	if entry, ok := client.keyshareStatuses[manager]; ok && time.Since(entry.retrieved) < keyshareStatusCacheDuration {
+		return entry.status, entry.err
+	}
+
+	// Not using newKeyshareTransport, whose UnavailableHandler would retrieve the status again
+	status := &irma.KeyshareStatus{}
+	err := irma.NewHTTPTransport(scheme.KeyshareServer, !client.Preferences.DeveloperMode).Get("api/status", status)
+	if err != nil {
+		status = nil
+	}
+	if client.keyshareStatuses == nil {
+		client.keyshareStatuses = map[irma.SchemeManagerIdentifier]*keyshareStatusEntry{}
+	}
+	client.keyshareStatuses[manager] = &keyshareStatusEntry{status: status, err: err, retrieved: time.Now()}
+	return status, err
+}
+
+// ReportSessionError reports the session error to the keyshare servers at which the client is
+// enrolled, to help their operators debug, if the user consents to it (otherwise it does nothing).
+// The report contains no attribute values, usernames or other personal data; see
+// irma.ClientErrorReport. The error of the last failed report, if any, is returned.
+func (client *Client) ReportSessionError(err *irma.SessionError, consent bool) error {
+	if !consent || err == nil {
+		return nil
+	}
+	report := newClientErrorReport(err)
+	var reportErr error
+	for manager := range client.keyshareServersCopy() {
+		if e := client.newKeyshareTransport(manager).Post("api/report", nil, report); e != nil {
+			irma.Logger.Warnf("failed to report session error to keyshare server of %s: %s", manager, e.Error())
+			reportErr = e
+		}
+	}
+	return reportErr
+}
+
+// newClientErrorReport returns a report of the session error, leaving out its description and
+// other details that may contain personal data.
+func newClientErrorReport(err *irma.SessionError) *irma.ClientErrorReport {
+	report := &irma.ClientErrorReport{
+		ErrorType:     err.ErrorType,
+		RemoteStatus:  err.RemoteStatus,
+		ClientVersion: irma.Version,
+		Platform:      runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if withStack, ok := err.Err.(*errors.Error); ok {
+		// Only the functions and their positions, as the source lines may contain literals
+		var stack strings.Builder
+		for _, frame := range withStack.StackFrames() {
+			fmt.Fprintf(&stack, "%s.%s\n\t%s:%d\n", frame.Package, frame.Name, frame.File, frame.LineNumber)
+		}
+		report.Stack = stack.String()
+	}
+	if err.RemoteError != nil {
+		report.RemoteError = err.RemoteError.ErrorName
+	}
+	if err.ServerURL != "" {
+		// The client token is the last path element of the session URL
+		hash := sha256.Sum256([]byte(path.Base(err.ServerURL)))
+		report.SessionTokenHash = hex.EncodeToString(hash[:])
+	}
+	if len(report.Stack) > irma.ClientErrorReportMaxStack {
+		report.Stack = report.Stack[:irma.ClientErrorReportMaxStack]
+	}
+	return report
+}
+
+func (client *Client) newKeyshareTransport(manager irma.SchemeManagerIdentifier) *irma.HTTPTransport {
+	transport := irma.NewHTTPTransport(client.Configuration.SchemeManagers[manager].KeyshareServer, !client.Preferences.DeveloperMode)
+	transport.SunsetHandler = func(announcement *irma.SunsetAnnouncement) {
+		client.keyshareSunset(manager, announcement)
+	}
+	transport.UnavailableHandler = func(*irma.SessionError) {
+		client.keyshareUnavailable(manager)
+	}
+	transport.MaxRetryAfter = maxRetryAfter(client.MaxRetryAfter)
+	setLanguageHeader(transport, client.Preferences)
+	return transport
+}
+
+// keyshareUnavailable retrieves the status of the keyshare server of the specified scheme manager
+// after it could not be reached, informing the handler (if it implements KeyshareMaintenanceHandler)
+// if the keyshare server announces that it is under maintenance.
+func (client *Client) keyshareUnavailable(manager irma.SchemeManagerIdentifier) {
+	handler, ok := client.handler.(KeyshareMaintenanceHandler)
+	if !ok {
+		return
+	}
+	status, err := client.KeyshareStatus(manager)
+	if err != nil {
+		irma.Logger.Warnf("failed to retrieve status of keyshare server of %s: %s", manager, err.Error())
+		return
+	}
+	if status.Status == irma.KeyshareStatusMaintenance {
+		handler.KeyshareMaintenance(manager, status)
+	}
+}
+
+// keyshareSunset records the announcement of the keyshare server of the specified scheme manager,
+// informing the handler (if it implements KeyshareSunsetHandler) if the announcement contains news.
+func (client *Client) keyshareSunset(manager irma.SchemeManagerIdentifier, announcement *irma.SunsetAnnouncement) {
+	if !client.recordSunset(manager, announcement) {
+		return
+	}
+	if handler, ok := client.handler.(KeyshareSunsetHandler); ok {
+		handler.KeyshareSunset(manager, announcement)
+	}
+}
+
+// keyshareServer returns a copy of the keyshare server of the specified scheme manager, if we are
+// enrolled there, which can be used without holding keyshareServersLock. State that the copy
+// obtains from the keyshare server is recorded afterwards using keyshareServerUsed.
+func (client *Client) keyshareServer(manager irma.SchemeManagerIdentifier) (*keyshareServer, bool) {
+	client.keyshareServersLock.Lock()
+	defer client.keyshareServersLock.Unlock()
+	kss, ok := client.keyshareServers[manager]
+	if !ok {
+		return nil, false
+	}
+	c := *kss
+	return &c, true
+}
+
+// keyshareServersCopy returns copies of all keyshare servers at which we are enrolled, see keyshareServer.
+func (client *Client) keyshareServersCopy() map[irma.SchemeManagerIdentifier]*keyshareServer {
+	client.keyshareServersLock.Lock()
+	defer client.keyshareServersLock.Unlock()
+	ksses := make(map[irma.SchemeManagerIdentifier]*keyshareServer, len(client.keyshareServers))
+	for manager, kss := range client.keyshareServers {
+		c := *kss
+		ksses[manager] = &c
+	}
+	return ksses
+}
+
+// keyshareServerUsed records the state that the copy of a keyshare server obtained from it: its
+// authorization token, and whether it publishes a PIN encryption key. The latter is stored right
+// away, so that a man in the middle cannot downgrade us to unencrypted PINs after a restart.
+func (client *Client) keyshareServerUsed(used *keyshareServer) {
+	client.keyshareServersLock.Lock()
+	defer client.keyshareServersLock.Unlock()
+	kss, ok := client.keyshareServers[used.SchemeManagerIdentifier]
+	if !ok {
+		return
+	}
+	if used.token != "" {
+		kss.token = used.token
+	}
+	if used.PinEncryption && !kss.PinEncryption {
+		kss.PinEncryption = true
+		if err := client.storage.StoreKeyshareServers(client.keyshareServers); err != nil {
+			client.reportError(err)
+		}
+	}
+}
+
+// recordSunset records the announcement in the keyshare server of the specified scheme manager if we
+// are enrolled there, returning false if we are and the announcement contained no news.
+func (client *Client) recordSunset(manager irma.SchemeManagerIdentifier, announcement *irma.SunsetAnnouncement) bool {
+	client.keyshareServersLock.Lock()
+	defer client.keyshareServersLock.Unlock()
+	kss, ok := client.keyshareServers[manager]
+	if !ok {
+		return true
+	}
+	if !kss.updateSunset(announcement) {
+		return false
+	}
+	if err := client.storage.StoreKeyshareServers(client.keyshareServers); err != nil {
+		client.reportError(err)
+	}
+	return true
+}
+
 // KeyshareVerifyPin verifies the specified PIN at the keyshare server, returning if it succeeded;
 // if not, how many tries are left, or for how long the user is blocked. If an error is returned
 // it is of type *irma.SessionError.
@@ -1136,10 +1827,17 @@ func (client *Client) KeyshareVerifyPin(pin string, schemeid irma.SchemeManagerI
 			Info:      schemeid.String(),
 		}
 	}
-	kss := client.keyshareServers[schemeid]
-	return verifyPinWorker(pin, kss,
-		irma.NewHTTPTransport(scheme.KeyshareServer, !client.Preferences.DeveloperMode),
-	)
+	kss, ok := client.keyshareServer(schemeid)
+	if !ok {
+		return false, 0, 0, &irma.SessionError{
+			Err:       errors.Errorf("Not enrolled to keyshare server of scheme %s", schemeid.String()),
+			ErrorType: irma.ErrorUnknownSchemeManager,
+			Info:      schemeid.String(),
+		}
+	}
+	success, tries, blocked, err := verifyPinWorker(pin, kss, client.Configuration, client.newKeyshareTransport(schemeid))
+	client.keyshareServerUsed(kss)
+	return success, tries, blocked, err
 }
 
 func (client *Client) KeyshareChangePin(manager irma.SchemeManagerIdentifier, oldPin string, newPin string) {
@@ -1152,12 +1850,12 @@ func (client *Client) KeyshareChangePin(manager irma.SchemeManagerIdentifier, ol
 }
 
 func (client *Client) keyshareChangePinWorker(managerID irma.SchemeManagerIdentifier, oldPin string, newPin string) error {
-	kss, ok := client.keyshareServers[managerID]
+	kss, ok := client.keyshareServer(managerID)
 	if !ok {
 		return errors.New("Unknown keyshare server")
 	}
 
-	transport := irma.NewHTTPTransport(client.Configuration.SchemeManagers[managerID].KeyshareServer, !client.Preferences.DeveloperMode)
+	transport := client.newKeyshareTransport(managerID)
 	message := irma.KeyshareChangePin{
 		Username: kss.Username,
 		OldPin:   kss.HashedPin(oldPin),
@@ -1165,7 +1863,9 @@ func (client *Client) keyshareChangePinWorker(managerID irma.SchemeManagerIdenti
 	}
 
 	res := &irma.KeysharePinStatus{}
-	err := transport.Post("users/change/pin", res, message)
+	kss.setDeviceHeader(transport)
+	err := kss.postPin(client.Configuration, transport, "users/change/pin", res, message)
+	client.keyshareServerUsed(kss)
 	if err != nil {
 		return err
 	}
@@ -1194,6 +1894,8 @@ func (client *Client) keyshareChangePinWorker(managerID irma.SchemeManagerIdenti
 
 // KeyshareRemove unenrolls the keyshare server of the specified scheme manager.
 func (client *Client) KeyshareRemove(manager irma.SchemeManagerIdentifier) error {
+	client.keyshareServersLock.Lock()
+	defer client.keyshareServersLock.Unlock()
 	if _, contains := client.keyshareServers[manager]; !contains {
 		return errors.New("Can't uninstall unknown keyshare server")
 	}
@@ -1201,8 +1903,58 @@ func (client *Client) KeyshareRemove(manager irma.SchemeManagerIdentifier) error
 	return client.storage.StoreKeyshareServers(client.keyshareServers)
 }
 
+// KeyshareReenroll enrolls again at the keyshare server of the specified scheme manager, after it
+// no longer knows our account (see KeyshareAccountGoneHandler). It first removes the current
+// enrollment along with all credentials of the scheme manager, which can no longer be used without
+// the keyshare server. As with KeyshareEnrollAcceptingTerms, the result is reported to
+// EnrollmentSuccess or EnrollmentFailure of the handler.
+func (client *Client) KeyshareReenroll(manager irma.SchemeManagerIdentifier, email *string, pin string, lang string, termsVersion string) {
+	go func() {
+		err := client.keyshareReenrollWorker(manager, email, pin, lang, termsVersion)
+		if err != nil {
+			client.handler.EnrollmentFailure(manager, err)
+		}
+	}()
+}
+
+func (client *Client) keyshareReenrollWorker(managerID irma.SchemeManagerIdentifier, email *string, pin string, lang string, termsVersion string) error {
+	manager, ok := client.Configuration.SchemeManagers[managerID]
+	if !ok || !manager.Distributed() {
+		return errors.New("Scheme manager has no keyshare server")
+	}
+
+	client.keyshareServersLock.Lock()
+	if _, enrolled := client.keyshareServers[managerID]; enrolled {
+		delete(client.keyshareServers, managerID)
+		if err := client.storage.StoreKeyshareServers(client.keyshareServers); err != nil {
+			client.keyshareServersLock.Unlock()
+			return err
+		}
+	}
+	client.keyshareServersLock.Unlock()
+	for id, list := range client.attributes {
+		if id.IssuerIdentifier().SchemeManagerIdentifier() != managerID {
+			continue
+		}
+		for i := len(list) - 1; i >= 0; i-- {
+			if err := client.remove(id, i, true); err != nil {
+				return err
+			}
+		}
+	}
+	client.handler.UpdateAttributes()
+
+	return client.keyshareEnrollWorker(managerID, pin, irma.KeyshareEnrollment{
+		Email:                email,
+		Language:             lang,
+		AcceptedTermsVersion: termsVersion,
+	})
+}
+
 // KeyshareRemoveAll removes all keyshare server registrations.
 func (client *Client) KeyshareRemoveAll() error {
+	client.keyshareServersLock.Lock()
+	defer client.keyshareServersLock.Unlock()
 	client.keyshareServers = map[irma.SchemeManagerIdentifier]*keyshareServer{}
 	return client.storage.StoreKeyshareServers(client.keyshareServers)
 }
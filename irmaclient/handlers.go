@@ -8,9 +8,10 @@ import (
 // keyshareEnrollmentHandler handles the keyshare attribute issuance session
 // after registering to a new keyshare server.
 type keyshareEnrollmentHandler struct {
-	pin    string
-	client *Client
-	kss    *keyshareServer
+	pin          string
+	pinRequested bool
+	client       *Client
+	kss          *keyshareServer
 }
 
 // Force keyshareEnrollmentHandler to implement the Handler interface
@@ -20,17 +21,21 @@ var _ Handler = (*keyshareEnrollmentHandler)(nil)
 
 func (h *keyshareEnrollmentHandler) RequestIssuancePermission(request *irma.IssuanceRequest, satisfiable bool, candidates [][]DisclosureCandidates, ServerName *irma.RequestorInfo, callback PermissionHandler) {
 	// Fetch the username from the credential request and save it along with the scheme manager
+	h.client.keyshareServersLock.Lock()
 	for _, attr := range request.Credentials[0].Attributes {
 		h.kss.Username = attr
 		break
 	}
+	h.client.keyshareServersLock.Unlock()
 
 	// Do the issuance
 	callback(true, nil)
 }
 
 func (h *keyshareEnrollmentHandler) RequestPin(remainingAttempts int, callback PinHandler) {
-	if remainingAttempts == -1 { // -1 signifies that this is the first attempt
+	// The PIN was just chosen, so only the first attempt can be right
+	if !h.pinRequested {
+		h.pinRequested = true
 		callback(true, h.pin)
 	} else {
 		h.fail(errors.New("PIN incorrect"))
@@ -38,7 +43,9 @@ func (h *keyshareEnrollmentHandler) RequestPin(remainingAttempts int, callback P
 }
 
 func (h *keyshareEnrollmentHandler) Success(result string) {
+	h.client.keyshareServersLock.Lock()
 	_ = h.client.storage.StoreKeyshareServers(h.client.keyshareServers) // TODO handle err?
+	h.client.keyshareServersLock.Unlock()
 	h.client.handler.EnrollmentSuccess(h.kss.SchemeManagerIdentifier)
 }
 
@@ -48,7 +55,9 @@ func (h *keyshareEnrollmentHandler) Failure(err *irma.SessionError) {
 
 // fail is a helper to ensure the kss is removed from the client in case of any problem
 func (h *keyshareEnrollmentHandler) fail(err error) {
+	h.client.keyshareServersLock.Lock()
 	delete(h.client.keyshareServers, h.kss.SchemeManagerIdentifier)
+	h.client.keyshareServersLock.Unlock()
 	h.client.handler.EnrollmentFailure(h.kss.SchemeManagerIdentifier, err)
 }
 
@@ -77,6 +86,9 @@ func (h *keyshareEnrollmentHandler) KeyshareEnrollmentIncomplete(manager irma.Sc
 func (h *keyshareEnrollmentHandler) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier) {
 	h.fail(errors.New("Keyshare enrollment failed: not enrolled"))
 }
+func (h *keyshareEnrollmentHandler) KeyshareAccountGone(manager irma.SchemeManagerIdentifier) {
+	h.fail(errors.New("Keyshare enrollment failed: account unknown to keyshare server"))
+}
 func (h *keyshareEnrollmentHandler) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier) {
 	h.fail(errors.New("Keyshare enrollment failed: unenrolled"))
 }
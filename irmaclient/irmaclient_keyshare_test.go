@@ -1,12 +1,27 @@
 package irmaclient
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/go-errors/errors"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/privacybydesign/gabi"
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/privacybydesign/irmago/internal/testkeyshare"
+	"github.com/privacybydesign/irmago/server"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/curve25519"
 )
 
 // Test pinchange interaction
@@ -19,3 +34,781 @@ func TestKeyshareChangePin(t *testing.T) {
 	require.NoError(t, client.keyshareChangePinWorker(irma.NewSchemeManagerIdentifier("test"), "12345", "54321"))
 	require.NoError(t, client.keyshareChangePinWorker(irma.NewSchemeManagerIdentifier("test"), "54321", "12345"))
 }
+
+func TestKeyshareVerifyPin(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	kss := testkeyshare.StartFakeKeyshareServer(t, irma.Logger)
+	defer kss.Stop()
+	scheme := irma.NewSchemeManagerIdentifier("test")
+	kss.Use(client.Configuration, scheme)
+
+	tests := []struct {
+		name     string
+		status   int
+		response interface{}
+		success  bool
+		tries    int
+		blocked  int
+		err      bool
+	}{
+		{name: "success"},
+		{name: "wrong pin", status: 200, response: irma.KeysharePinStatus{Status: kssPinFailure, Message: "2"}, tries: 2},
+		{name: "blocked", status: 200, response: irma.KeysharePinStatus{Status: kssPinError, Message: "60"}, blocked: 60},
+		{name: "unknown status", status: 200, response: irma.KeysharePinStatus{Status: "foo"}, err: true},
+		{name: "malformed tries", status: 200, response: irma.KeysharePinStatus{Status: kssPinFailure, Message: "foo"}, err: true},
+		{name: "malformed response", status: 200, response: "{", err: true},
+		{name: "server error", status: 500, response: "", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kss.Reset()
+			if tt.response != nil {
+				kss.Respond("/users/verify/pin", tt.status, tt.response)
+			}
+			success, tries, blocked, err := client.KeyshareVerifyPin("12345", scheme)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.response == nil, success)
+			require.Equal(t, tt.tries, tries)
+			require.Equal(t, tt.blocked, blocked)
+		})
+	}
+}
+
+type sunsetTestHandler struct {
+	*TestClientHandler
+	announcements []*irma.SunsetAnnouncement
+}
+
+func (h *sunsetTestHandler) KeyshareSunset(_ irma.SchemeManagerIdentifier, announcement *irma.SunsetAnnouncement) {
+	h.announcements = append(h.announcements, announcement)
+}
+
+func TestKeyshareSunset(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	sunsetHandler := &sunsetTestHandler{TestClientHandler: handler}
+	client.handler = sunsetHandler
+	kss := testkeyshare.StartFakeKeyshareServer(t, irma.Logger)
+	defer kss.Stop()
+	scheme := irma.NewSchemeManagerIdentifier("test")
+	kss.Use(client.Configuration, scheme)
+
+	announce := func(sunset time.Time) {
+		kss.Override("/users/verify/pin", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+			server.WriteJson(w, irma.KeysharePinStatus{Status: kssPinSuccess, Message: "token"})
+		})
+	}
+	verify := func() {
+		success, _, _, err := client.KeyshareVerifyPin("12345", scheme)
+		require.NoError(t, err)
+		require.True(t, success)
+	}
+
+	deprecated, sunset := client.KeyshareSunset(scheme)
+	require.False(t, deprecated)
+	require.Nil(t, sunset)
+
+	// The server announces it will shut down in a week
+	week := time.Now().Add(7 * 24 * time.Hour).Truncate(time.Second)
+	announce(week)
+	verify()
+	require.Len(t, sunsetHandler.announcements, 1)
+	deprecated, sunset = client.KeyshareSunset(scheme)
+	require.True(t, deprecated)
+	require.NotNil(t, sunset)
+	require.True(t, week.Equal(time.Time(*sunset)))
+
+	// Repeating the same announcement is not news
+	verify()
+	require.Len(t, sunsetHandler.announcements, 1)
+
+	// A later sunset does not replace the earliest known one
+	announce(week.Add(24 * time.Hour))
+	verify()
+	require.Len(t, sunsetHandler.announcements, 1)
+	_, sunset = client.KeyshareSunset(scheme)
+	require.True(t, week.Equal(time.Time(*sunset)))
+
+	// An earlier sunset does
+	tomorrow := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	announce(tomorrow)
+	verify()
+	require.Len(t, sunsetHandler.announcements, 2)
+	_, sunset = client.KeyshareSunset(scheme)
+	require.True(t, tomorrow.Equal(time.Time(*sunset)))
+
+	// Announcements and tokens may be recorded during sessions while the keyshare servers are used
+	// elsewhere
+	errs := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, _, _, err := client.KeyshareVerifyPin("12345", scheme)
+			errs <- err
+		}()
+	}
+	client.KeyshareSunset(scheme)
+	require.Contains(t, client.EnrolledSchemeManagers(), scheme)
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+
+	// The sunset date survives reloading the client from storage
+	require.NoError(t, client.storage.db.Close())
+	client, _ = parseExistingStorage(t, handler.storage)
+	deprecated, sunset = client.KeyshareSunset(scheme)
+	require.True(t, deprecated)
+	require.NotNil(t, sunset)
+	require.True(t, tomorrow.Equal(time.Time(*sunset)))
+}
+
+type maintenanceTestHandler struct {
+	*TestClientHandler
+	statuses []*irma.KeyshareStatus
+}
+
+func (h *maintenanceTestHandler) KeyshareMaintenance(_ irma.SchemeManagerIdentifier, status *irma.KeyshareStatus) {
+	h.statuses = append(h.statuses, status)
+}
+
+func TestKeyshareMaintenance(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	maintenanceHandler := &maintenanceTestHandler{TestClientHandler: handler}
+	client.handler = maintenanceHandler
+	kss := testkeyshare.StartFakeKeyshareServer(t, irma.Logger)
+	defer kss.Stop()
+	scheme := irma.NewSchemeManagerIdentifier("test")
+	kss.Use(client.Configuration, scheme)
+
+	var requests int32
+	statusRequests := func() int { return int(atomic.LoadInt32(&requests)) }
+	announce := func(status irma.KeyshareStatus) {
+		kss.Override("/api/status", func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			server.WriteJson(w, status)
+		})
+	}
+	announce(irma.KeyshareStatus{
+		Status:      irma.KeyshareStatusMaintenance,
+		Maintenance: &irma.KeyshareMaintenanceWindow{Message: irma.TranslatedString{"en": "Scheduled maintenance"}},
+	})
+
+	// Other errors do not involve the status
+	kss.Respond("/users/verify/pin", http.StatusInternalServerError, "")
+	_, _, _, err := client.KeyshareVerifyPin("12345", scheme)
+	require.Error(t, err)
+	require.Zero(t, statusRequests())
+	require.Empty(t, maintenanceHandler.statuses)
+
+	// A keyshare server that is unavailable while announcing maintenance is reported to the handler
+	kss.Respond("/users/verify/pin", http.StatusServiceUnavailable, "")
+	_, _, _, err = client.KeyshareVerifyPin("12345", scheme)
+	require.Error(t, err)
+	require.Equal(t, 1, statusRequests())
+	require.Len(t, maintenanceHandler.statuses, 1)
+	require.Equal(t, "Scheduled maintenance", maintenanceHandler.statuses[0].Maintenance.Message["en"])
+
+	// The status is cached
+	_, _, _, err = client.KeyshareVerifyPin("12345", scheme)
+	require.Error(t, err)
+	require.Equal(t, 1, statusRequests())
+	require.Len(t, maintenanceHandler.statuses, 2)
+
+	// Once the cached status is outdated it is retrieved again; an operational keyshare server is
+	// not reported
+	client.keyshareStatuses[scheme].retrieved = time.Now().Add(-keyshareStatusCacheDuration)
+	announce(irma.KeyshareStatus{Status: irma.KeyshareStatusOperational})
+	_, _, _, err = client.KeyshareVerifyPin("12345", scheme)
+	require.Error(t, err)
+	require.Equal(t, 2, statusRequests())
+	require.Len(t, maintenanceHandler.statuses, 2)
+
+	// Keyshare servers that cannot be reached at all are reported when a status is served for them
+	// (e.g. by a reverse proxy)
+	announce(irma.KeyshareStatus{Status: irma.KeyshareStatusMaintenance})
+	client.keyshareStatuses = nil
+	kss.Override("/users/verify/pin", func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	})
+	_, _, _, err = client.KeyshareVerifyPin("12345", scheme)
+	require.Error(t, err)
+	require.Equal(t, irma.ErrorTransport, err.(*irma.SessionError).ErrorType)
+	require.Len(t, maintenanceHandler.statuses, 3)
+}
+
+func TestKeyshareEnrollRegistrationPolicy(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	kss := testkeyshare.StartFakeKeyshareServer(t, irma.Logger)
+	defer kss.Stop()
+	scheme := irma.NewSchemeManagerIdentifier("test")
+	kss.Use(client.Configuration, scheme)
+	client.Configuration.SchemeManagers[scheme].KeyshareRegistration = &irma.KeyshareRegistrationPolicy{
+		Email:            irma.KeyshareEmailForbidden,
+		MinimumPinLength: 6,
+		TermsURL:         "https://example.com/terms",
+		TermsVersion:     "2",
+	}
+
+	var enrollment *irma.KeyshareEnrollment
+	kss.Override("/client/register", func(w http.ResponseWriter, r *http.Request) {
+		enrollment = &irma.KeyshareEnrollment{}
+		require.NoError(t, server.ParseBody(r, enrollment))
+		server.WriteError(w, server.ErrorInternal, "")
+	})
+
+	// Enrollments not satisfying the policy are not sent to the keyshare server
+	email := "test@example.com"
+	require.Error(t, client.keyshareEnrollWorker(scheme, "12345", irma.KeyshareEnrollment{Language: "en", AcceptedTermsVersion: "2"}))
+	require.Error(t, client.keyshareEnrollWorker(scheme, "123456", irma.KeyshareEnrollment{Email: &email, Language: "en", AcceptedTermsVersion: "2"}))
+	require.Error(t, client.keyshareEnrollWorker(scheme, "123456", irma.KeyshareEnrollment{Language: "en", AcceptedTermsVersion: "1"}))
+	require.Nil(t, enrollment)
+
+	require.Error(t, client.keyshareEnrollWorker(scheme, "123456", irma.KeyshareEnrollment{Language: "en", AcceptedTermsVersion: "2"}))
+	require.NotNil(t, enrollment)
+	require.Equal(t, "2", enrollment.AcceptedTermsVersion)
+	require.Nil(t, enrollment.Email)
+
+	// Attestation tokens are passed on as is
+	require.Error(t, client.keyshareEnrollWorker(scheme, "123456", irma.KeyshareEnrollment{
+		Language: "en", AcceptedTermsVersion: "2", AttestationToken: "token", AttestationPlatform: "android",
+	}))
+	require.Equal(t, "token", enrollment.AttestationToken)
+	require.Equal(t, "android", enrollment.AttestationPlatform)
+}
+
+func TestKeysharePinEncryption(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	kss := testkeyshare.StartFakeKeyshareServer(t, irma.Logger)
+	defer kss.Stop()
+	scheme := irma.NewSchemeManagerIdentifier("test")
+	kss.Use(client.Configuration, scheme)
+
+	privateKey := make([]byte, curve25519.ScalarSize)
+	_, err := rand.Read(privateKey)
+	require.NoError(t, err)
+	pinKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	require.NoError(t, err)
+	jwtKeyBytes, err := ioutil.ReadFile(filepath.Join(test.FindTestdataFolder(t), "jwtkeys", "kss-sk.pem"))
+	require.NoError(t, err)
+	jwtKey, err := jwt.ParseRSAPrivateKeyFromPEM(jwtKeyBytes)
+	require.NoError(t, err)
+	signPinKey := func(key []byte) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, irma.KeysharePinKeyClaims{
+			StandardClaims: jwt.StandardClaims{Subject: "pin_key"},
+			PinKey:         key,
+		}).SignedString(jwtKey)
+		require.NoError(t, err)
+		return token
+	}
+
+	var pinmsg *irma.KeysharePinMessage
+	verifyPin := func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, kssEncryptedPinVersion, r.Header.Get(kssVersionHeader))
+		var msg irma.KeyshareEncryptedMessage
+		require.NoError(t, server.ParseBody(r, &msg))
+		bts, err := msg.Decrypt(privateKey, "users/verify/pin", irma.DefaultClockSkewTolerance)
+		require.NoError(t, err)
+		pinmsg = &irma.KeysharePinMessage{}
+		require.NoError(t, json.Unmarshal(bts, pinmsg))
+		server.WriteJson(w, irma.KeysharePinStatus{Status: kssPinFailure, Message: "2"})
+	}
+
+	// A PIN encryption key not signed by the keyshare server is refused
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodRS256, irma.KeysharePinKeyClaims{
+		StandardClaims: jwt.StandardClaims{Subject: "pin_key"},
+		PinKey:         pinKey,
+	}).SignedString(otherKey)
+	require.NoError(t, err)
+	kss.Override("/api/pinkey", func(w http.ResponseWriter, r *http.Request) { server.WriteString(w, forged) })
+	kss.Override("/users/verify/pin", verifyPin)
+	_, _, _, err = client.KeyshareVerifyPin("12345", scheme)
+	require.Error(t, err)
+	require.Nil(t, pinmsg)
+
+	// The PIN is encrypted to the PIN encryption key of the keyshare server
+	kss.Override("/api/pinkey", func(w http.ResponseWriter, r *http.Request) { server.WriteString(w, signPinKey(pinKey)) })
+	success, tries, _, err := client.KeyshareVerifyPin("12345", scheme)
+	require.NoError(t, err)
+	require.False(t, success)
+	require.Equal(t, 2, tries)
+	require.NotNil(t, pinmsg)
+	require.Equal(t, client.keyshareServers[scheme].HashedPin("12345"), pinmsg.Pin)
+	require.True(t, client.keyshareServers[scheme].PinEncryption)
+
+	// Once the keyshare server published a key, we do not fall back to sending the PIN unencrypted
+	kss.Reset()
+	_, _, _, err = client.KeyshareVerifyPin("12345", scheme)
+	require.Error(t, err)
+
+	// also not after a restart
+	require.NoError(t, client.Close())
+	client, _ = parseExistingStorage(t, handler.storage)
+	kss.Use(client.Configuration, scheme)
+	require.True(t, client.keyshareServers[scheme].PinEncryption)
+	_, _, _, err = client.KeyshareVerifyPin("12345", scheme)
+	require.Error(t, err)
+}
+
+func TestKeyshareSessionErrors(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	kss := testkeyshare.StartFakeKeyshareServer(t, irma.Logger)
+	defer kss.Stop()
+	scheme := irma.NewSchemeManagerIdentifier("test")
+	kss.Use(client.Configuration, scheme)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	wrongKeyProofP, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"ProofP": map[string]string{"P": "Ag==", "c": "Aw==", "s_response": "BQ=="},
+		"iat":    time.Now().Unix(),
+		"sub":    "ProofP",
+	}).SignedString(otherKey)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		setup     func()
+		pins      []string
+		result    string
+		attempts  []int          // remaining attempts passed to RequestPin, if not nil
+		errorType irma.ErrorType // type of the error passed to KeyshareError, if not empty
+	}{
+		{name: "success", pins: []string{"12345"}, result: "done", attempts: []int{3}},
+		{name: "cancelled", pins: []string{}, result: "cancelled"},
+		{
+			name: "wrong pin then cancel",
+			setup: func() {
+				kss.Respond("/users/verify/pin", 200, irma.KeysharePinStatus{Status: kssPinFailure, Message: "2"})
+			},
+			pins:     []string{"54321"},
+			result:   "cancelled",
+			attempts: []int{3, 2},
+		},
+		{
+			name: "blocked before pin",
+			setup: func() {
+				kss.Respond("/users/pinstatus", 200, irma.KeysharePinAttempts{Blocked: 60})
+			},
+			pins:     []string{"12345"},
+			result:   "blocked",
+			attempts: []int{},
+		},
+		{
+			name: "pin status unsupported",
+			setup: func() {
+				kss.Respond("/users/pinstatus", http.StatusNotFound, "")
+			},
+			pins:     []string{"12345"},
+			result:   "done",
+			attempts: []int{-1},
+		},
+		{
+			name: "blocked",
+			setup: func() {
+				kss.Respond("/users/verify/pin", 200, irma.KeysharePinStatus{Status: kssPinError, Message: "60"})
+			},
+			pins:   []string{"54321"},
+			result: "blocked",
+		},
+		{
+			name: "user not registered",
+			setup: func() {
+				kss.RespondError("/users/verify/pin", server.ErrorUserNotRegistered, "")
+			},
+			pins:   []string{"12345"},
+			result: "gone",
+		},
+		{
+			name: "user not registered after PIN",
+			setup: func() {
+				kss.RespondError("/prove/getCommitments", server.ErrorUserNotRegistered, "")
+			},
+			pins:   []string{"12345"},
+			result: "gone",
+		},
+		{
+			name: "expired token",
+			setup: func() {
+				kss.RespondError("/prove/getCommitments", server.ErrorInvalidJWT, "")
+			},
+			pins:   []string{"12345"},
+			result: "error",
+		},
+		{
+			name: "malformed commitments",
+			setup: func() {
+				kss.Respond("/prove/getCommitments", 200, "{")
+			},
+			pins:   []string{"12345"},
+			result: "error",
+		},
+		{
+			name: "malformed response",
+			setup: func() {
+				kss.Respond("/prove/getResponse", 200, "not a jwt")
+			},
+			pins:      []string{"12345"},
+			result:    "error",
+			errorType: irma.ErrorKeyshareProof,
+		},
+		{
+			name: "response signed with wrong key",
+			setup: func() {
+				kss.Respond("/prove/getResponse", 200, wrongKeyProofP)
+			},
+			pins:      []string{"12345"},
+			result:    "error",
+			errorType: irma.ErrorKeyshareProof,
+		},
+		{
+			name: "response server error",
+			setup: func() {
+				kss.Respond("/prove/getResponse", http.StatusInternalServerError, "")
+			},
+			pins:   []string{"12345"},
+			result: "error",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kss.Reset()
+			client.keyshareServers[scheme].token = "" // force PIN entry
+			if tt.setup != nil {
+				tt.setup()
+			}
+			builders, request := keyshareTestBuilders(t, client)
+			h := &testKeyshareHandler{pins: tt.pins, c: make(chan string, 1), attempts: []int{}}
+			go startKeyshareSession(h, h, builders, request, nil, nil,
+				client.Configuration, client.keyshareServers, client.Preferences, 0, 0)
+			require.Equal(t, tt.result, <-h.c)
+			if tt.attempts != nil {
+				require.Equal(t, tt.attempts, h.attempts)
+			}
+			if tt.errorType != "" {
+				serr, ok := h.err.(*irma.SessionError)
+				require.True(t, ok)
+				require.Equal(t, tt.errorType, serr.ErrorType)
+			}
+		})
+	}
+}
+
+func TestKeyshareReenroll(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	kss := testkeyshare.StartFakeKeyshareServer(t, irma.Logger)
+	defer kss.Stop()
+	scheme := irma.NewSchemeManagerIdentifier("test")
+	kss.Use(client.Configuration, scheme)
+
+	var enrollment *irma.KeyshareEnrollment
+	kss.Override("/client/register", func(w http.ResponseWriter, r *http.Request) {
+		enrollment = &irma.KeyshareEnrollment{}
+		require.NoError(t, server.ParseBody(r, enrollment))
+		server.WriteError(w, server.ErrorInternal, "")
+	})
+
+	credcount := func(manager irma.SchemeManagerIdentifier) int {
+		count := 0
+		for id, list := range client.attributes {
+			if id.IssuerIdentifier().SchemeManagerIdentifier() == manager {
+				count += len(list)
+			}
+		}
+		return count
+	}
+	demo := irma.NewSchemeManagerIdentifier("irma-demo")
+	democount := credcount(demo)
+	require.NotZero(t, credcount(scheme))
+	require.NotZero(t, democount)
+
+	// The fake keyshare server refuses the new enrollment, but the local state is wiped regardless
+	require.Error(t, client.keyshareReenrollWorker(scheme, nil, "12345", "en", ""))
+	require.NotNil(t, enrollment)
+	require.NotContains(t, client.keyshareServers, scheme)
+	require.Zero(t, credcount(scheme))
+	require.Equal(t, democount, credcount(demo))
+
+	// Also after reloading from storage
+	require.NoError(t, client.storage.db.Close())
+	client, handler = parseExistingStorage(t, handler.storage)
+	require.NotContains(t, client.keyshareServers, scheme)
+	require.Zero(t, credcount(scheme))
+	require.Equal(t, democount, credcount(demo))
+}
+
+func TestKeyshareSessionProgress(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	kss := testkeyshare.StartFakeKeyshareServer(t, irma.Logger)
+	defer kss.Stop()
+	scheme := irma.NewSchemeManagerIdentifier("test")
+	kss.Use(client.Configuration, scheme)
+
+	// Issuance of two credentials of the keyshare-enabled test scheme
+	request := irma.NewIssuanceRequest([]*irma.CredentialRequest{
+		{
+			CredentialTypeID: irma.NewCredentialTypeIdentifier("test.test.email"),
+			Attributes:       map[string]string{"email": "example@example.com"},
+		},
+		{
+			CredentialTypeID: irma.NewCredentialTypeIdentifier("test.test.mijnirma"),
+			Attributes:       map[string]string{"email": "example@example.com"},
+		},
+	})
+	builders, _, nonce, err := client.IssuanceProofBuilders(request, &irma.DisclosureChoice{})
+	require.NoError(t, err)
+	require.Len(t, builders, 2)
+
+	h := &testKeyshareHandler{pins: []string{"12345"}, c: make(chan string, 1)}
+	go startKeyshareSession(h, h, builders, request, nonce, nil,
+		client.Configuration, client.keyshareServers, client.Preferences, 0, 0)
+	require.Equal(t, "done", <-h.c)
+	require.Equal(t, []Progress{
+		{Step: ProgressStepKeyshare},
+		{Step: ProgressStepCommitment, Current: 1, Total: 2},
+		{Step: ProgressStepCommitment, Current: 2, Total: 2},
+		{Step: ProgressStepKeyshare},
+		{Step: ProgressStepResponse, Current: 1, Total: 2},
+		{Step: ProgressStepResponse, Current: 2, Total: 2},
+	}, h.progress)
+}
+
+func TestKeyshareSessionTimeout(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	kss := testkeyshare.StartFakeKeyshareServer(t, irma.Logger)
+	defer kss.Stop()
+	scheme := irma.NewSchemeManagerIdentifier("test")
+	kss.Use(client.Configuration, scheme)
+	const timeout = 500 * time.Millisecond
+
+	run := func(h *testKeyshareHandler) string {
+		client.keyshareServers[scheme].token = "" // force PIN entry
+		builders, request := keyshareTestBuilders(t, client)
+		h.c = make(chan string, 1)
+		go startKeyshareSession(h, h, builders, request, nil, nil,
+			client.Configuration, client.keyshareServers, client.Preferences, timeout, 0)
+		return <-h.c
+	}
+	delay := func(path string, d time.Duration, response interface{}) {
+		kss.Override(path, func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(d)
+			server.WriteJson(w, response)
+		})
+	}
+
+	// The time the user takes to enter the PIN does not count
+	require.Equal(t, "done", run(&testKeyshareHandler{pins: []string{"12345"}, pinDelay: 2 * timeout}))
+
+	// A keyshare server that hangs in any step makes the keyshare protocol fail
+	for _, step := range []string{"users/pinstatus", "users/verify/pin", "prove/getCommitments", "prove/getResponse"} {
+		kss.Reset()
+		delay("/"+step, 2*timeout, nil)
+		h := &testKeyshareHandler{pins: []string{"12345"}}
+		require.Equal(t, "error", run(h), step)
+		require.IsType(t, &irma.SessionError{}, h.err)
+		require.Equal(t, irma.ErrorKeyshareTimeout, h.err.(*irma.SessionError).ErrorType)
+		require.Equal(t, step, h.err.(*irma.SessionError).Info)
+	}
+
+	// The budget is shared by the steps
+	kss.Reset()
+	delay("/users/pinstatus", 3*timeout/5, irma.KeysharePinAttempts{Remaining: 3})
+	delay("/users/verify/pin", 3*timeout/5, irma.KeysharePinStatus{Status: kssPinFailure, Message: "2"})
+	h := &testKeyshareHandler{pins: []string{"54321"}}
+	require.Equal(t, "error", run(h))
+	require.Equal(t, "users/verify/pin", h.err.(*irma.SessionError).Info)
+}
+
+func TestKeyshareSessionRetryAfter(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	kss := testkeyshare.StartFakeKeyshareServer(t, irma.Logger)
+	defer kss.Stop()
+	scheme := irma.NewSchemeManagerIdentifier("test")
+	kss.Use(client.Configuration, scheme)
+
+	run := func(maxRetryAfter time.Duration) *testKeyshareHandler {
+		client.keyshareServers[scheme].token = "" // force PIN entry
+		builders, request := keyshareTestBuilders(t, client)
+		h := &testKeyshareHandler{pins: []string{"12345"}, c: make(chan string, 1)}
+		go startKeyshareSession(h, h, builders, request, nil, nil,
+			client.Configuration, client.keyshareServers, client.Preferences, 0, maxRetryAfter)
+		h.c <- <-h.c
+		return h
+	}
+
+	// Short delays are waited for, after which the request (including its body) is sent again
+	count := kss.Refuse("/users/verify/pin", 1, "1")
+	h := run(0)
+	require.Equal(t, "done", <-h.c)
+	require.Equal(t, 2, count())
+
+	// but not indefinitely
+	kss.Reset()
+	count = kss.Refuse("/prove/getCommitments", 100, "0")
+	h = run(0)
+	require.Equal(t, "error", <-h.c)
+	require.Equal(t, 1+irma.MaxRetryAfterAttempts, count())
+	require.Equal(t, http.StatusTooManyRequests, h.err.(*irma.SessionError).RemoteStatus)
+
+	// Long delays are not waited for, and reported
+	kss.Reset()
+	count = kss.Refuse("/prove/getCommitments", 1, "60")
+	h = run(0)
+	require.Equal(t, "error", <-h.c)
+	require.Equal(t, 1, count())
+	require.Equal(t, time.Minute, retryAfter(h.err))
+	require.Equal(t, time.Minute, retryAfter(&irma.SessionError{Err: errors.Wrap(h.err, 0)}))
+
+	// Retrying can be disabled
+	kss.Reset()
+	count = kss.Refuse("/prove/getCommitments", 1, "0")
+	h = run(-1)
+	require.Equal(t, "error", <-h.c)
+	require.Equal(t, 1, count())
+}
+
+// keyshareTestBuilders returns proof builders for disclosing the keyshare attribute of the test
+// scheme, for use in a keyshare session.
+func TestKeyshareReportSessionError(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	kss := testkeyshare.StartFakeKeyshareServer(t, irma.Logger)
+	defer kss.Stop()
+	kss.Use(client.Configuration, irma.NewSchemeManagerIdentifier("test"))
+
+	var reports []*irma.ClientErrorReport
+	kss.Override("/api/report", func(w http.ResponseWriter, r *http.Request) {
+		report := &irma.ClientErrorReport{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(report))
+		reports = append(reports, report)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	sessionErr := &irma.SessionError{
+		ErrorType:    irma.ErrorServerResponse,
+		Err:          errors.New("attribute value 12345 of user testusername"),
+		RemoteError:  &irma.RemoteError{ErrorName: "SESSION_UNKNOWN", Description: "Unknown session testusername"},
+		RemoteStatus: 400,
+		ServerURL:    "https://example.com/irma/session/token",
+	}
+
+	// Without consent, nothing is reported
+	require.NoError(t, client.ReportSessionError(sessionErr, false))
+	require.Empty(t, reports)
+
+	require.NoError(t, client.ReportSessionError(sessionErr, true))
+	require.Len(t, reports, 1)
+	report := reports[0]
+	require.Equal(t, irma.ErrorServerResponse, report.ErrorType)
+	require.Equal(t, "SESSION_UNKNOWN", report.RemoteError)
+	require.Equal(t, 400, report.RemoteStatus)
+	require.Equal(t, irma.Version, report.ClientVersion)
+	require.NotEmpty(t, report.Platform)
+	hash := sha256.Sum256([]byte("token"))
+	require.Equal(t, hex.EncodeToString(hash[:]), report.SessionTokenHash)
+	require.Contains(t, report.Stack, "TestKeyshareReportSessionError")
+	require.LessOrEqual(t, len(report.Stack), irma.ClientErrorReportMaxStack)
+
+	// The report contains no error descriptions, which may contain personal data
+	bts, err := json.Marshal(report)
+	require.NoError(t, err)
+	require.NotContains(t, string(bts), "testusername")
+	require.NotContains(t, string(bts), "12345")
+}
+
+func keyshareTestBuilders(t *testing.T, client *Client) (gabi.ProofBuilderList, irma.SessionRequest) {
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("test.test.mijnirma.email"))
+	candidates, satisfiable, err := client.Candidates(request)
+	require.NoError(t, err)
+	require.True(t, satisfiable)
+	ids, err := candidates[0][0].Choose()
+	require.NoError(t, err)
+	builders, _, _, err := client.ProofBuilders(&irma.DisclosureChoice{Attributes: [][]*irma.AttributeIdentifier{ids}}, request)
+	require.NoError(t, err)
+	return builders, request
+}
+
+// testKeyshareHandler enters the specified pins one by one, after which it cancels,
+// and reports the outcome of the keyshare session on its channel.
+type testKeyshareHandler struct {
+	pins     []string
+	pinDelay time.Duration // time the "user" takes to enter each pin
+	c        chan string
+	attempts []int
+	progress []Progress
+	err      error
+}
+
+func (h *testKeyshareHandler) RequestPin(remainingAttempts int, callback PinHandler) {
+	h.attempts = append(h.attempts, remainingAttempts)
+	if len(h.pins) == 0 {
+		callback(false, "")
+		return
+	}
+	pin := h.pins[0]
+	h.pins = h.pins[1:]
+	time.Sleep(h.pinDelay)
+	callback(true, pin)
+}
+
+func (h *testKeyshareHandler) KeyshareDone(message interface{}) { h.c <- "done" }
+func (h *testKeyshareHandler) KeyshareCancelled()               { h.c <- "cancelled" }
+func (h *testKeyshareHandler) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
+	h.c <- "blocked"
+}
+func (h *testKeyshareHandler) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
+	h.c <- "incomplete"
+}
+func (h *testKeyshareHandler) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier) {
+	h.c <- "deleted"
+}
+func (h *testKeyshareHandler) KeyshareAccountGone(manager irma.SchemeManagerIdentifier) {
+	h.c <- "gone"
+}
+func (h *testKeyshareHandler) KeyshareError(manager *irma.SchemeManagerIdentifier, err error) {
+	h.err = err
+	h.c <- "error"
+}
+func (h *testKeyshareHandler) KeysharePin()   {}
+func (h *testKeyshareHandler) KeysharePinOK() {}
+func (h *testKeyshareHandler) KeyshareProgress(progress Progress) {
+	h.progress = append(h.progress, progress)
+}
+func (h *testKeyshareHandler) KeyshareSunset(manager irma.SchemeManagerIdentifier, announcement *irma.SunsetAnnouncement) {
+}
+func (h *testKeyshareHandler) KeyshareServerUsed(kss *keyshareServer)                   {}
+func (h *testKeyshareHandler) KeyshareUnavailable(manager irma.SchemeManagerIdentifier) {}
+
+func TestParseProofResponse(t *testing.T) {
+	jwt := "eyJhbGciOiJSUzI1NiJ9.e30.c2ln"
+
+	// Keyshare protocol version 2
+	j, err := parseProofResponse(jwt)
+	require.NoError(t, err)
+	require.Equal(t, jwt, j)
+
+	// Keyshare protocol version 3
+	j, err = parseProofResponse(`{"jwt":"` + jwt + `","sessionID":"12345"}` + "\n")
+	require.NoError(t, err)
+	require.Equal(t, jwt, j)
+
+	_, err = parseProofResponse(`{"jwt":`)
+	require.Error(t, err)
+	_, err = parseProofResponse(`{"sessionID":"12345"}`)
+	require.Error(t, err)
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/privacybydesign/gabi/gabikeys"
 	irma "github.com/privacybydesign/irmago"
@@ -125,7 +126,7 @@ func TestCandidates(t *testing.T) {
 	request := irma.NewDisclosureRequest(attrtype)
 	disjunction := request.Disclose[0]
 	request.ProtocolVersion = &irma.ProtocolVersion{Major: 2, Minor: 8}
-	attrs, satisfiable, err := client.candidatesDisCon(request, disjunction)
+	attrs, satisfiable, err := client.candidatesDisCon(request, disjunction, 1)
 	require.NoError(t, err)
 	require.True(t, satisfiable)
 	require.NotNil(t, attrs)
@@ -142,7 +143,7 @@ func TestCandidates(t *testing.T) {
 	// then our attribute is a candidate
 	reqval := "456"
 	disjunction[0][0].Value = &reqval
-	attrs, satisfiable, err = client.candidatesDisCon(request, disjunction)
+	attrs, satisfiable, err = client.candidatesDisCon(request, disjunction, 1)
 	require.NoError(t, err)
 	require.True(t, satisfiable)
 	require.NotNil(t, attrs)
@@ -152,12 +153,16 @@ func TestCandidates(t *testing.T) {
 	require.True(t, attrs[0][0].Present())
 	require.NotNil(t, attrs[0][0].Value)
 	require.Equal(t, reqval, attrs[0][0].Value[""])
+	require.NotNil(t, attrs[0][0].Credential)
+	require.Equal(t, attrs[0][0].CredentialHash, attrs[0][0].Credential.Hash)
+	require.Equal(t, reqval, attrs[0][0].Credential.Attributes[attrtype][""])
+	require.NotEmpty(t, attrs[0][0].IssuerName)
 
 	// If the disjunction requires our attribute to have a different value than it does,
 	// then it is NOT a match.
 	reqval = "foobarbaz"
 	disjunction[0][0].Value = &reqval
-	attrs, satisfiable, err = client.candidatesDisCon(request, disjunction)
+	attrs, satisfiable, err = client.candidatesDisCon(request, disjunction, 1)
 	require.NoError(t, err)
 	require.False(t, satisfiable)
 	require.NotNil(t, attrs)
@@ -166,11 +171,12 @@ func TestCandidates(t *testing.T) {
 	require.False(t, attrs[0][0].Present())
 	require.NotNil(t, attrs[0][0].Value)
 	require.Equal(t, reqval, attrs[0][0].Value[""])
+	require.Nil(t, attrs[0][0].Credential)
 
 	// A required value of nil counts as no requirement on the value, so our attribute is a candidate
 	// and we should also get the option to get another value
 	disjunction[0][0].Value = nil
-	attrs, satisfiable, err = client.candidatesDisCon(request, disjunction)
+	attrs, satisfiable, err = client.candidatesDisCon(request, disjunction, 1)
 	require.NoError(t, err)
 	require.True(t, satisfiable)
 	require.NotNil(t, attrs)
@@ -183,10 +189,23 @@ func TestCandidates(t *testing.T) {
 	require.False(t, attrs[1][0].Present())
 	require.Empty(t, attrs[1][0].Value)
 
+	// Possession of the credential is satisfied by our instance, disclosing none of its attributes
+	credtype := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard")
+	disjunction[0][0] = irma.AttributeRequest{Type: credtype}
+	attrs, satisfiable, err = client.candidatesDisCon(request, disjunction, 1)
+	require.NoError(t, err)
+	require.True(t, satisfiable)
+	require.Len(t, attrs, 2)
+	require.Equal(t, credtype, attrs[0][0].Type)
+	require.True(t, attrs[0][0].Present())
+	require.True(t, attrs[0][0].Possession)
+	require.Empty(t, attrs[0][0].Value)
+	require.NotNil(t, attrs[0][0].Credential)
+
 	// Require an attribute we do not have: a "non-present" credential (i.e. without hash)
 	// is included with the candidates as suggestion to the user
 	disjunction[0][0] = irma.NewAttributeRequest("irma-demo.MijnOverheid.fullName.familyname")
-	attrs, satisfiable, err = client.candidatesDisCon(request, disjunction)
+	attrs, satisfiable, err = client.candidatesDisCon(request, disjunction, 1)
 	require.NoError(t, err)
 	require.False(t, satisfiable)
 	require.Len(t, attrs, 1)
@@ -204,13 +223,30 @@ func TestCandidates(t *testing.T) {
 		{},
 		{irma.NewAttributeRequest("irma-demo.MijnOverheid.root.BSN")},
 	}}
-	attrs, satisfiable, err = client.candidatesDisCon(isreq, isreq.Disclose[0])
+	attrs, satisfiable, err = client.candidatesDisCon(isreq, isreq.Disclose[0], 1)
 	require.NoError(t, err)
 	require.True(t, satisfiable)
 	// we don't have irma-demo.MijnOverheid.root, the empty conjunction gives the only candidate
 	require.Len(t, attrs, 1)
 }
 
+func TestIssuanceInvalidAttributeValue(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	request := irma.NewIssuanceRequest([]*irma.CredentialRequest{{
+		CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"),
+		Attributes:       map[string]string{"BSN": "1234\x00"},
+	}})
+	_, _, _, err := client.IssuanceProofBuilders(request, &irma.DisclosureChoice{})
+	require.Error(t, err)
+	require.Equal(t, irma.ErrorInvalidAttributeValue, err.(*irma.SessionError).ErrorType)
+
+	request.Credentials[0].Attributes["BSN"] = "12345"
+	_, _, _, err = client.IssuanceProofBuilders(request, &irma.DisclosureChoice{})
+	require.NoError(t, err)
+}
+
 func TestCandidateConjunctionOrder(t *testing.T) {
 	client, handler := parseStorage(t)
 	defer test.ClearTestStorage(t, handler.storage)
@@ -344,6 +380,147 @@ func TestKeyshareEnrollmentRemoval(t *testing.T) {
 	require.NotContains(t, client.keyshareServers, "test")
 }
 
+// truncateStorageValue simulates a write to the specified value that was interrupted halfway.
+func truncateStorageValue(t *testing.T, client *Client, bucket string, key []byte) {
+	require.NoError(t, client.storage.Transaction(func(tx *transaction) error {
+		b := tx.Bucket([]byte(bucket))
+		require.NotNil(t, b)
+		value := b.Get(key)
+		require.NotEmpty(t, value)
+		return b.Put(key, append([]byte{}, value[:len(value)/2]...))
+	}))
+}
+
+func TestStorageCorruption(t *testing.T) {
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	reopen := func(t *testing.T, client *Client, handler *TestClientHandler) *Client {
+		require.NoError(t, client.Close())
+		client, _ = parseExistingStorage(t, handler.storage)
+		return client
+	}
+
+	t.Run("database", func(t *testing.T) {
+		client, handler := parseStorage(t)
+		defer test.ClearTestStorage(t, handler.storage)
+		require.NoError(t, client.Close())
+
+		// Truncate the database file
+		path := filepath.Join(handler.storage, "client", databaseFile)
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.NoError(t, os.Truncate(path, info.Size()/2))
+
+		client, _ = parseExistingStorage(t, handler.storage)
+		require.Len(t, client.StorageWarnings(), 1)
+		require.Equal(t, StorageDatabase, client.StorageWarnings()[0].Class)
+		require.True(t, client.StorageWarnings()[0].Restored)
+		verifyClientIsUnmarshaled(t, client)
+		verifyKeyshareIsUnmarshaled(t, client)
+
+		// Without backup, the database cannot be recovered
+		require.NoError(t, client.Close())
+		require.NoError(t, ioutil.WriteFile(path, make([]byte, 8192), 0600))
+		require.NoError(t, os.Remove(filepath.Join(handler.storage, "client", databaseBackupFile)))
+		_, err = New(filepath.Join(handler.storage, "client"), filepath.Join(test.FindTestdataFolder(t), "irma_configuration"), handler)
+		require.Error(t, err)
+	})
+
+	t.Run("preferences", func(t *testing.T) {
+		client, handler := parseStorage(t)
+		defer test.ClearTestStorage(t, handler.storage)
+		truncateStorageValue(t, client, userdataBucket, []byte(preferencesKey))
+
+		client = reopen(t, client, handler)
+		require.Len(t, client.StorageWarnings(), 1)
+		require.Equal(t, StoragePreferences, client.StorageWarnings()[0].Class)
+		require.False(t, client.StorageWarnings()[0].Restored)
+		verifyClientIsUnmarshaled(t, client)
+	})
+
+	t.Run("attributes", func(t *testing.T) {
+		client, handler := parseStorage(t)
+		defer test.ClearTestStorage(t, handler.storage)
+		truncateStorageValue(t, client, attributesBucket, []byte(studentCard.String()))
+
+		// Corrupt attributes are restored from the backup
+		client = reopen(t, client, handler)
+		require.Len(t, client.StorageWarnings(), 1)
+		require.Equal(t, StorageAttributes, client.StorageWarnings()[0].Class)
+		require.True(t, client.StorageWarnings()[0].Restored)
+		require.Contains(t, client.attributes, studentCard)
+		require.Contains(t, client.attributes, irma.NewCredentialTypeIdentifier("test.test.mijnirma"))
+		verifyCredentials(t, client)
+		verifyKeyshareIsUnmarshaled(t, client)
+
+		// and stored again
+		client = reopen(t, client, handler)
+		require.Empty(t, client.StorageWarnings())
+		require.Contains(t, client.attributes, studentCard)
+
+		// Without backup, the corrupt attributes are removed
+		truncateStorageValue(t, client, attributesBucket, []byte(studentCard.String()))
+		require.NoError(t, client.Close())
+		require.NoError(t, os.Remove(filepath.Join(handler.storage, "client", databaseBackupFile)))
+		client, _ = parseExistingStorage(t, handler.storage)
+		require.Len(t, client.StorageWarnings(), 1)
+		require.Equal(t, StorageAttributes, client.StorageWarnings()[0].Class)
+		require.False(t, client.StorageWarnings()[0].Restored)
+		require.NotContains(t, client.attributes, studentCard)
+		require.Contains(t, client.attributes, irma.NewCredentialTypeIdentifier("test.test.mijnirma"))
+
+		client = reopen(t, client, handler)
+		require.Empty(t, client.StorageWarnings())
+		require.NotContains(t, client.attributes, studentCard)
+	})
+
+	t.Run("keyshare servers", func(t *testing.T) {
+		client, handler := parseStorage(t)
+		defer test.ClearTestStorage(t, handler.storage)
+		truncateStorageValue(t, client, userdataBucket, []byte(kssKey))
+
+		// Corrupt keyshare servers are restored from the backup
+		client = reopen(t, client, handler)
+		require.Len(t, client.StorageWarnings(), 1)
+		require.Equal(t, StorageKeyshareServers, client.StorageWarnings()[0].Class)
+		require.True(t, client.StorageWarnings()[0].Restored)
+		verifyClientIsUnmarshaled(t, client)
+		verifyKeyshareIsUnmarshaled(t, client)
+
+		// Without backup, the enrollments are lost
+		truncateStorageValue(t, client, userdataBucket, []byte(kssKey))
+		require.NoError(t, client.Close())
+		require.NoError(t, os.Remove(filepath.Join(handler.storage, "client", databaseBackupFile)))
+		client, _ = parseExistingStorage(t, handler.storage)
+		require.Len(t, client.StorageWarnings(), 1)
+		require.Equal(t, StorageKeyshareServers, client.StorageWarnings()[0].Class)
+		require.False(t, client.StorageWarnings()[0].Restored)
+		require.Empty(t, client.keyshareServers)
+		verifyClientIsUnmarshaled(t, client)
+	})
+
+	t.Run("logs", func(t *testing.T) {
+		client, handler := parseStorage(t)
+		defer test.ClearTestStorage(t, handler.storage)
+		before, err := client.LoadNewestLogs(100)
+		require.NoError(t, err)
+		for i := 0; i < 2; i++ {
+			require.NoError(t, client.storage.AddLogEntry(&LogEntry{Type: irma.ActionDisclosing, Time: irma.Timestamp(time.Now())}))
+		}
+		newest, err := client.LoadNewestLogs(1)
+		require.NoError(t, err)
+		truncateStorageValue(t, client, logsBucket, client.storage.logEntryKeyToBytes(newest[0].ID))
+
+		client = reopen(t, client, handler)
+		require.Empty(t, client.StorageWarnings())
+		logs, err := client.LoadNewestLogs(100)
+		require.NoError(t, err)
+		require.Len(t, logs, len(before)+1)
+		require.Len(t, client.StorageWarnings(), 1)
+		require.Equal(t, StorageLogs, client.StorageWarnings()[0].Class)
+		verifyClientIsUnmarshaled(t, client)
+	})
+}
+
 func TestUpdatingStorage(t *testing.T) {
 	client, handler := parseStorage(t)
 	defer test.ClearTestStorage(t, handler.storage)
@@ -1,11 +1,14 @@
 package irmaclient
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bwesterb/go-atum"
@@ -31,10 +34,21 @@ type keyshareSessionHandler interface {
 	KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int)
 	KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier)
 	KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier)
+	// The keyshare server does not know our account (anymore), e.g. after it was deleted or lost
+	KeyshareAccountGone(manager irma.SchemeManagerIdentifier)
 	// In errors the manager may be nil, as not all keyshare errors have a clearly associated scheme manager
 	KeyshareError(manager *irma.SchemeManagerIdentifier, err error)
 	KeysharePin()
 	KeysharePinOK()
+	// KeyshareProgress is called when a step of the keyshare protocol starts (see SessionProgressHandler)
+	KeyshareProgress(progress Progress)
+	KeyshareSunset(manager irma.SchemeManagerIdentifier, announcement *irma.SunsetAnnouncement)
+	// KeyshareServerUsed is called after the PIN was sent to the keyshare server, with the session's
+	// copy of it, so that the state it obtained (e.g. its token) can be recorded
+	KeyshareServerUsed(kss *keyshareServer)
+	// KeyshareUnavailable is called when the keyshare server could not be reached or responded
+	// that it is unavailable, before the error is reported
+	KeyshareUnavailable(manager irma.SchemeManagerIdentifier)
 }
 
 type keyshareSession struct {
@@ -50,17 +64,37 @@ type keyshareSession struct {
 	timestamp        *atum.Timestamp
 	pinCheck         bool
 	preferences      Preferences
+
+	// Time budget of the keyshare protocol, and what remains of it: as the budget does not run
+	// down while the user enters the PIN, either deadline is set while it runs, or remaining
+	// while it is paused
+	timeout   time.Duration
+	deadline  time.Time
+	remaining time.Duration
+}
+
+// keyshareStatusEntry is a status of a keyshare server, or the error with which retrieving it
+// failed, cached by Client.KeyshareStatus().
+type keyshareStatusEntry struct {
+	status    *irma.KeyshareStatus
+	err       error
+	retrieved time.Time
 }
 
 type keyshareServer struct {
 	Username                string `json:"username"`
 	Nonce                   []byte `json:"nonce"`
 	SchemeManagerIdentifier irma.SchemeManagerIdentifier
+	DeviceID                string          `json:"deviceId,omitempty"`      // Set if enrolled as additional device of the account
+	Deprecated              bool            `json:"deprecated,omitempty"`    // Protocol in use is deprecated by the keyshare server
+	Sunset                  *irma.Timestamp `json:"sunset,omitempty"`        // Earliest announced end of support of the protocol in use
+	PinEncryption           bool            `json:"pinEncryption,omitempty"` // Keyshare server published a PIN encryption key
 	token                   string
 }
 
 const (
 	kssUsernameHeader = "X-IRMA-Keyshare-Username"
+	kssDeviceHeader   = "X-IRMA-Keyshare-Device"
 	kssVersionHeader  = "X-IRMA-Keyshare-ProtocolVersion"
 	kssAuthHeader     = "Authorization"
 	kssAuthorized     = "authorized"
@@ -68,6 +102,21 @@ const (
 	kssPinSuccess     = "success"
 	kssPinFailure     = "failure"
 	kssPinError       = "error"
+
+	// Keyshare protocol version sent to keyshare servers. Since version 3, keyshare servers return
+	// an irma.KeyshareProofResponse from /prove/getResponse, older ones return the bare ProofP JWT.
+	kssProtocolVersion = "3"
+	// Keyshare protocol version sent when requesting commitments. Since version 7, keyshare servers
+	// return them as an irma.OrderedProofPCommitmentMap, which irma.ProofPCommitmentMap also parses.
+	kssCommitmentsVersion = "7"
+	// Keyshare protocol version sent along with encrypted PINs, see keyshareServer.postPin().
+	kssEncryptedPinVersion = "5"
+
+	// DefaultKeyshareTimeout is the time budget of the keyshare protocol if Client.KeyshareTimeout is 0.
+	DefaultKeyshareTimeout = 30 * time.Second
+
+	// Duration for which Client.KeyshareStatus() caches the status of keyshare servers.
+	keyshareStatusCacheDuration = 30 * time.Second
 )
 
 func newKeyshareServer(schemeManagerIdentifier irma.SchemeManagerIdentifier) (ks *keyshareServer, err error) {
@@ -87,6 +136,85 @@ func (ks *keyshareServer) HashedPin(pin string) string {
 	return base64.StdEncoding.EncodeToString(hash[:]) + "\n"
 }
 
+// updateSunset records the announcement of the keyshare server, returning whether it contained
+// news: a deprecation that was not yet known, or an earlier sunset date than known before.
+func (ks *keyshareServer) updateSunset(announcement *irma.SunsetAnnouncement) bool {
+	updated := false
+	if announcement.Deprecated && !ks.Deprecated {
+		ks.Deprecated = true
+		updated = true
+	}
+	if announcement.Sunset != nil && (ks.Sunset == nil || announcement.Sunset.Before(time.Time(*ks.Sunset))) {
+		ks.Sunset = (*irma.Timestamp)(announcement.Sunset)
+		updated = true
+	}
+	return updated
+}
+
+// postPin posts the message containing a PIN to the specified endpoint of the keyshare server.
+// If the keyshare server publishes a PIN encryption key, the message is encrypted to it and keyshare
+// protocol version 5 is used on the transport. Once a keyshare server published a key, we no longer
+// send it unencrypted PINs, so that a man in the middle cannot downgrade us by hiding the key.
+func (kss *keyshareServer) postPin(conf *irma.Configuration, transport *irma.HTTPTransport, endpoint string, result, message interface{}) error {
+	pinKey, err := kss.pinKey(conf, transport)
+	if err != nil {
+		return err
+	}
+	if pinKey == nil {
+		return transport.Post(endpoint, result, message)
+	}
+
+	bts, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	encrypted, err := irma.EncryptKeyshareMessage(pinKey, endpoint, bts)
+	if err != nil {
+		return err
+	}
+	transport.SetHeader(kssVersionHeader, kssEncryptedPinVersion)
+	return transport.Post(endpoint, result, encrypted)
+}
+
+// pinKey fetches the PIN encryption key of the keyshare server, verifying that it is signed by the
+// keyshare server. It returns nil if the keyshare server does not publish one.
+func (kss *keyshareServer) pinKey(conf *irma.Configuration, transport *irma.HTTPTransport) ([]byte, error) {
+	var token string
+	err := transport.Get("api/pinkey", &token)
+	if serr, ok := err.(*irma.SessionError); ok && serr.RemoteStatus == http.StatusNotFound && !kss.PinEncryption {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &irma.KeysharePinKeyClaims{}
+	parser := &jwt.Parser{SkipClaimsValidation: true} // The key does not expire
+	if _, err = parser.ParseWithClaims(token, claims, conf.KeyshareServerKeyFunc(kss.SchemeManagerIdentifier)); err != nil {
+		return nil, errors.WrapPrefix(err, "invalid PIN encryption key", 0)
+	}
+	if claims.Subject != "pin_key" || len(claims.PinKey) != 32 {
+		return nil, errors.New("invalid PIN encryption key")
+	}
+	kss.PinEncryption = true
+	return claims.PinKey, nil
+}
+
+// setDeviceHeader identifies the device to the keyshare server, if enrolled as additional device.
+// setLanguageHeader sets the Accept-Language header to the language of the app, if configured, in
+// which the keyshare server then describes PIN statuses (see irma.KeysharePinStatus).
+func setLanguageHeader(transport *irma.HTTPTransport, preferences Preferences) {
+	if preferences.Language != "" {
+		transport.SetHeader("Accept-Language", preferences.Language)
+	}
+}
+
+func (ks *keyshareServer) setDeviceHeader(transport *irma.HTTPTransport) {
+	if ks.DeviceID != "" {
+		transport.SetHeader(kssDeviceHeader, ks.DeviceID)
+	}
+}
+
 // startKeyshareSession starts and completes the entire keyshare protocol with all involved keyshare servers
 // for the specified session, merging the keyshare proofs into the specified ProofBuilder's.
 // The user's pin is retrieved using the KeysharePinRequestor, repeatedly, until either it is correct; or the
@@ -102,6 +230,8 @@ func startKeyshareSession(
 	conf *irma.Configuration,
 	keyshareServers map[irma.SchemeManagerIdentifier]*keyshareServer,
 	preferences Preferences,
+	timeout time.Duration,
+	maxDelay time.Duration,
 ) {
 	ksscount := 0
 	for managerID := range session.Identifiers().SchemeManagers {
@@ -132,7 +262,12 @@ func startKeyshareSession(
 		timestamp:        timestamp,
 		pinCheck:         false,
 		preferences:      preferences,
+		timeout:          timeout,
 	}
+	if ks.timeout == 0 {
+		ks.timeout = DefaultKeyshareTimeout
+	}
+	ks.deadline = time.Now().Add(ks.timeout)
 
 	for managerID := range session.Identifiers().SchemeManagers {
 		scheme := ks.conf.SchemeManagers[managerID]
@@ -142,9 +277,19 @@ func startKeyshareSession(
 
 		ks.keyshareServer = ks.keyshareServers[managerID]
 		transport := irma.NewHTTPTransport(scheme.KeyshareServer, !ks.preferences.DeveloperMode)
+		managerID := managerID
+		transport.SunsetHandler = func(announcement *irma.SunsetAnnouncement) {
+			ks.sessionHandler.KeyshareSunset(managerID, announcement)
+		}
+		transport.UnavailableHandler = func(*irma.SessionError) {
+			ks.sessionHandler.KeyshareUnavailable(managerID)
+		}
+		transport.MaxRetryAfter = maxRetryAfter(maxDelay)
 		transport.SetHeader(kssUsernameHeader, ks.keyshareServer.Username)
+		ks.keyshareServer.setDeviceHeader(transport)
 		transport.SetHeader(kssAuthHeader, ks.keyshareServer.token)
-		transport.SetHeader(kssVersionHeader, "2")
+		transport.SetHeader(kssVersionHeader, kssProtocolVersion)
+		setLanguageHeader(transport, ks.preferences)
 		ks.transports[managerID] = transport
 
 		// Try to parse token as a jwt to see if it is still valid; if so we don't need to ask for the PIN
@@ -169,7 +314,7 @@ func startKeyshareSession(
 
 	if ks.pinCheck {
 		ks.sessionHandler.KeysharePin()
-		ks.VerifyPin(-1)
+		ks.askPin()
 	} else {
 		ks.GetCommitments()
 	}
@@ -177,39 +322,116 @@ func startKeyshareSession(
 
 func (ks *keyshareSession) fail(manager irma.SchemeManagerIdentifier, err error) {
 	serr, ok := err.(*irma.SessionError)
-	if ok {
-		if serr.RemoteError != nil && len(serr.RemoteError.ErrorName) > 0 {
-			switch serr.RemoteError.ErrorName {
-			case "USER_NOT_FOUND":
-				ks.sessionHandler.KeyshareEnrollmentDeleted(manager)
-			case "USER_NOT_REGISTERED":
-				ks.sessionHandler.KeyshareEnrollmentIncomplete(manager)
-			case "USER_BLOCKED":
-				duration, err := strconv.Atoi(serr.RemoteError.Message)
-				if err != nil { // Not really clear what to do with duration, but should never happen anyway
-					duration = -1
-				}
-				ks.sessionHandler.KeyshareBlocked(manager, duration)
-			default:
-				ks.sessionHandler.KeyshareError(&manager, err)
-			}
+	if !ok || serr.RemoteError == nil || len(serr.RemoteError.ErrorName) == 0 {
+		ks.sessionHandler.KeyshareError(&manager, err)
+		return
+	}
+	switch serr.RemoteError.ErrorName {
+	case "USER_NOT_FOUND", "DEVICE_NOT_REGISTERED":
+		ks.sessionHandler.KeyshareEnrollmentDeleted(manager)
+	case "USER_NOT_REGISTERED":
+		// The keyshare server returns this for accounts it does not know, so our account is gone
+		ks.sessionHandler.KeyshareAccountGone(manager)
+	case "USER_BLOCKED":
+		duration, err := strconv.Atoi(serr.RemoteError.Message)
+		if err != nil { // Not really clear what to do with duration, but should never happen anyway
+			duration = -1
 		}
-	} else {
+		ks.sessionHandler.KeyshareBlocked(manager, duration)
+	default:
 		ks.sessionHandler.KeyshareError(&manager, err)
 	}
 }
 
+// request performs a request to a keyshare server using the transport passed to do, which aborts
+// the request when the time budget of the keyshare protocol runs out. In that case an error of type
+// irma.ErrorKeyshareTimeout naming the step is returned.
+func (ks *keyshareSession) request(transport *irma.HTTPTransport, step string, do func(*irma.HTTPTransport) error) error {
+	ctx, cancel := context.WithDeadline(context.Background(), ks.deadline)
+	defer cancel()
+	err := do(transport.WithContext(ctx))
+	if err != nil && ctx.Err() != nil {
+		return &irma.SessionError{
+			ErrorType: irma.ErrorKeyshareTimeout,
+			Info:      step,
+			Err:       errors.Errorf("keyshare protocol exceeded its time budget of %s during %s", ks.timeout, step),
+		}
+	}
+	return err
+}
+
+// pauseBudget stops the time budget of the keyshare protocol from running down, until resumeBudget
+// is called. This is used while waiting for the user.
+func (ks *keyshareSession) pauseBudget() {
+	ks.remaining = time.Until(ks.deadline)
+}
+
+func (ks *keyshareSession) resumeBudget() {
+	ks.deadline = time.Now().Add(ks.remaining)
+}
+
+// askPin asks for the pin for the first time, passing the remaining pin attempts if the keyshare
+// servers report them; or informs of the block if we are blocked at one of the keyshare servers.
+func (ks *keyshareSession) askPin() {
+	attempts, blocked, manager, err := ks.pinAttempts()
+	if err != nil {
+		ks.fail(manager, err)
+		return
+	}
+	if blocked != 0 {
+		ks.sessionHandler.KeyshareBlocked(manager, blocked)
+		return
+	}
+	ks.VerifyPin(attempts)
+}
+
+// pinAttempts fetches the remaining pin attempts at each of the keyshare servers involved in the
+// session, returning the lowest one, or -1 if a keyshare server does not report them (e.g. because
+// it does not support this). If we are blocked at one of the keyshare servers, the amount of time
+// for which we are blocked is returned as the second return value. An error is only returned if
+// the time budget of the keyshare protocol ran out.
+func (ks *keyshareSession) pinAttempts() (attempts int, blocked int, manager irma.SchemeManagerIdentifier, err error) {
+	attempts = -1
+	for manager = range ks.session.Identifiers().SchemeManagers {
+		if !ks.conf.SchemeManagers[manager].Distributed() {
+			continue
+		}
+
+		res := &irma.KeysharePinAttempts{}
+		err = ks.request(ks.transports[manager], "users/pinstatus", func(transport *irma.HTTPTransport) error {
+			return transport.Get("users/pinstatus", res)
+		})
+		if serr, ok := err.(*irma.SessionError); ok && serr.ErrorType == irma.ErrorKeyshareTimeout {
+			return -1, 0, manager, err
+		}
+		if err != nil {
+			// Not essential, so we just ask for the pin without mentioning the remaining attempts
+			irma.Logger.Info("Could not fetch remaining PIN attempts: ", err)
+			return -1, 0, manager, nil
+		}
+		if res.Blocked > 0 {
+			return 0, int(res.Blocked), manager, nil
+		}
+		if attempts == -1 || res.Remaining < attempts {
+			attempts = res.Remaining
+		}
+	}
+	return
+}
+
 // Ask for a pin, repeatedly if necessary, and either continue the keyshare protocol
 // with authorization, or stop the keyshare protocol and inform of failure.
 func (ks *keyshareSession) VerifyPin(attempts int) {
+	ks.pauseBudget()
 	ks.pinRequestor.RequestPin(attempts, PinHandler(func(proceed bool, pin string) {
+		ks.resumeBudget()
 		if !proceed {
 			ks.sessionHandler.KeyshareCancelled()
 			return
 		}
 		success, attemptsRemaining, blocked, manager, err := ks.verifyPinAttempt(pin)
 		if err != nil {
-			ks.sessionHandler.KeyshareError(&manager, err)
+			ks.fail(manager, err)
 			return
 		}
 		if blocked != 0 {
@@ -226,11 +448,12 @@ func (ks *keyshareSession) VerifyPin(attempts int) {
 	}))
 }
 
-func verifyPinWorker(pin string, kss *keyshareServer, transport *irma.HTTPTransport) (
+func verifyPinWorker(pin string, kss *keyshareServer, conf *irma.Configuration, transport *irma.HTTPTransport) (
 	success bool, tries int, blocked int, err error) {
 	pinmsg := irma.KeysharePinMessage{Username: kss.Username, Pin: kss.HashedPin(pin)}
 	pinresult := &irma.KeysharePinStatus{}
-	err = transport.Post("users/verify/pin", pinresult, pinmsg)
+	kss.setDeviceHeader(transport)
+	err = kss.postPin(conf, transport, "users/verify/pin", pinresult, pinmsg)
 	if err != nil {
 		return
 	}
@@ -273,8 +496,11 @@ func (ks *keyshareSession) verifyPinAttempt(pin string) (
 		}
 
 		kss := ks.keyshareServers[manager]
-		transport := ks.transports[manager]
-		success, tries, blocked, err = verifyPinWorker(pin, kss, transport)
+		err = ks.request(ks.transports[manager], "users/verify/pin", func(transport *irma.HTTPTransport) (err error) {
+			success, tries, blocked, err = verifyPinWorker(pin, kss, ks.conf, transport)
+			return
+		})
+		ks.sessionHandler.KeyshareServerUsed(kss)
 		if !success {
 			return
 		}
@@ -312,7 +538,11 @@ func (ks *keyshareSession) GetCommitments() {
 
 		transport := ks.transports[managerID]
 		comms := &irma.ProofPCommitmentMap{}
-		err := transport.Post("prove/getCommitments", comms, pkids[managerID])
+		ks.sessionHandler.KeyshareProgress(Progress{Step: ProgressStepKeyshare})
+		transport.SetHeader(kssVersionHeader, kssCommitmentsVersion)
+		err := ks.request(transport, "prove/getCommitments", func(transport *irma.HTTPTransport) error {
+			return transport.Post("prove/getCommitments", comms, pkids[managerID])
+		})
 		if err != nil {
 			if err.(*irma.SessionError).RemoteError != nil &&
 				err.(*irma.SessionError).RemoteError.Status == http.StatusForbidden && !ks.pinCheck {
@@ -320,10 +550,10 @@ func (ks *keyshareSession) GetCommitments() {
 				// (but only if we did not ask for a PIN earlier)
 				ks.pinCheck = false
 				ks.sessionHandler.KeysharePin()
-				ks.VerifyPin(-1)
+				ks.askPin()
 				return
 			}
-			ks.sessionHandler.KeyshareError(&managerID, err)
+			ks.fail(managerID, err)
 			return
 		}
 		for pki, c := range comms.Commitments {
@@ -350,7 +580,7 @@ func (ks *keyshareSession) GetCommitments() {
 // receive their responses (2nd and 3rd message in Schnorr zero-knowledge protocol).
 func (ks *keyshareSession) GetProofPs() {
 	_, issig := ks.session.(*irma.SignatureRequest)
-	challenge, err := ks.builders.Challenge(ks.session.Base().GetContext(), ks.session.GetNonce(ks.timestamp), issig)
+	challenge, err := withProgress(ks.builders, ks.sessionHandler.KeyshareProgress).Challenge(ks.session.Base().GetContext(), ks.session.GetNonce(ks.timestamp), issig)
 	if err != nil {
 		ks.sessionHandler.KeyshareError(&ks.keyshareServer.SchemeManagerIdentifier, err)
 		return
@@ -363,8 +593,16 @@ func (ks *keyshareSession) GetProofPs() {
 		if !distributed {
 			continue
 		}
-		var j string
-		err = transport.Post("prove/getResponse", &j, challenge)
+		var res string
+		ks.sessionHandler.KeyshareProgress(Progress{Step: ProgressStepKeyshare})
+		err = ks.request(transport, "prove/getResponse", func(transport *irma.HTTPTransport) error {
+			return transport.Post("prove/getResponse", &res, irma.NewBigInt(challenge))
+		})
+		if err != nil {
+			ks.fail(managerID, err)
+			return
+		}
+		j, err := parseProofResponse(res)
 		if err != nil {
 			ks.sessionHandler.KeyshareError(&managerID, err)
 			return
@@ -375,6 +613,24 @@ func (ks *keyshareSession) GetProofPs() {
 	ks.Finish(challenge, responses)
 }
 
+// parseProofResponse returns the ProofP JWT from the response of /prove/getResponse, which is either
+// an irma.KeyshareProofResponse or (in keyshare protocol version 2) the JWT itself. As a JWT cannot
+// start with a curly bracket, these can be distinguished by looking at the first character.
+func parseProofResponse(response string) (string, error) {
+	response = strings.TrimSpace(response)
+	if !strings.HasPrefix(response, "{") {
+		return response, nil
+	}
+	var res irma.KeyshareProofResponse
+	if err := json.Unmarshal([]byte(response), &res); err != nil {
+		return "", &irma.SessionError{ErrorType: irma.ErrorServerResponse, Err: err}
+	}
+	if res.JWT == "" {
+		return "", &irma.SessionError{ErrorType: irma.ErrorServerResponse, Info: "Keyshare server returned no ProofP"}
+	}
+	return res.JWT, nil
+}
+
 // Finish the keyshare protocol: in case of issuance, put the keyshare jwt in the
 // IssueCommitmentMessage; in case of disclosure and signing, parse each keyshare jwt,
 // merge in the received ProofP's, and finish.
@@ -387,8 +643,15 @@ func (ks *keyshareSession) Finish(challenge *big.Int, responses map[irma.SchemeM
 	case *irma.IssuanceRequest:
 		// Calculate IssueCommitmentMessage, without merging in any of the received ProofP's:
 		// instead, include the keyshare server's JWT in the IssueCommitmentMessage for the
-		// issuance server to verify
-		list, err := ks.builders.BuildDistributedProofList(challenge, nil)
+		// issuance server to verify. We do verify them ourselves first, so that an invalid JWT
+		// is reported as such instead of as a rejection by the issuance server.
+		for manager, response := range responses {
+			if _, _, err := ks.conf.ParseKeyshareProofP(manager, response); err != nil {
+				ks.sessionHandler.KeyshareError(&manager, err)
+				return
+			}
+		}
+		list, err := withProgress(ks.builders, ks.sessionHandler.KeyshareProgress).BuildDistributedProofList(challenge, nil)
 		if err != nil {
 			ks.sessionHandler.KeyshareError(&ks.keyshareServer.SchemeManagerIdentifier, err)
 			return
@@ -410,21 +673,16 @@ func (ks *keyshareSession) finishDisclosureOrSigning(challenge *big.Int, respons
 		if !ks.conf.SchemeManagers[managerID].Distributed() {
 			continue
 		}
-		claims := struct {
-			jwt.StandardClaims
-			ProofP *gabi.ProofP
-		}{}
-		parser := new(jwt.Parser)
-		parser.SkipClaimsValidation = true // no need to abort due to clock drift issues
-		if _, err := parser.ParseWithClaims(responses[managerID], &claims, ks.conf.KeyshareServerKeyFunc(managerID)); err != nil {
+		proofP, _, err := ks.conf.ParseKeyshareProofP(managerID, responses[managerID])
+		if err != nil {
 			ks.sessionHandler.KeyshareError(&managerID, err)
 			return
 		}
-		proofPs[i] = claims.ProofP
+		proofPs[i] = proofP
 	}
 
 	// Create merged proofs and finish protocol
-	list, err := ks.builders.BuildDistributedProofList(challenge, proofPs)
+	list, err := withProgress(ks.builders, ks.sessionHandler.KeyshareProgress).BuildDistributedProofList(challenge, proofPs)
 	if err != nil {
 		ks.sessionHandler.KeyshareError(nil, err)
 		return
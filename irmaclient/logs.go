@@ -26,6 +26,7 @@ type LogEntry struct {
 
 	// Issuance sessions
 	IssueCommitment *irma.IssueCommitmentMessage `json:",omitempty"`
+	IssueErrors     []*irma.RemoteError          `json:",omitempty"` // per credential, in case of partial issuance
 
 	// All session types
 	ServerName *irma.RequestorInfo   `json:",omitempty"`
@@ -124,7 +125,7 @@ func (entry *LogEntry) GetDisclosedCredentials(conf *irma.Configuration) ([][]*i
 	} else {
 		disclosure = entry.Disclosure
 	}
-	_, attrs, err := disclosure.DisclosedAttributes(conf, disjunctions.Disclose, nil)
+	_, attrs, err := disclosure.RequestedAttributes(conf, disjunctions, nil)
 	return attrs, err
 }
 
@@ -137,7 +138,18 @@ func (entry *LogEntry) GetIssuedCredentials(conf *irma.Configuration) (list irma
 	if err != nil {
 		return nil, err
 	}
-	return request.(*irma.IssuanceRequest).GetCredentialInfoList(conf, entry.Version, time.Time(entry.Time))
+	list, err = request.(*irma.IssuanceRequest).GetCredentialInfoList(conf, entry.Version, time.Time(entry.Time))
+	if err != nil || len(entry.IssueErrors) == 0 {
+		return list, err
+	}
+	// Leave out the credentials that were not issued
+	issued := irma.CredentialInfoList{}
+	for i, info := range list {
+		if i >= len(entry.IssueErrors) || entry.IssueErrors[i] == nil {
+			issued = append(issued, info)
+		}
+	}
+	return issued, nil
 }
 
 // GetSignedMessage gets the signed for a log entry
@@ -151,12 +163,14 @@ func (entry *LogEntry) GetSignedMessage() (abs *irma.SignedMessage, err error) {
 	}
 	sigrequest := request.(*irma.SignatureRequest)
 	return &irma.SignedMessage{
-		LDContext: entry.SignedMessageLDContext,
-		Signature: entry.Disclosure.Proofs,
-		Nonce:     sigrequest.Nonce,
-		Context:   sigrequest.GetContext(),
-		Message:   string(entry.SignedMessage),
-		Timestamp: entry.Timestamp,
+		LDContext:      entry.SignedMessageLDContext,
+		Signature:      entry.Disclosure.Proofs,
+		Nonce:          sigrequest.Nonce,
+		Context:        sigrequest.GetContext(),
+		Message:        string(entry.SignedMessage),
+		MessageHash:    sigrequest.MessageHash,
+		MessageDisplay: sigrequest.MessageDisplay,
+		Timestamp:      entry.Timestamp,
 	}, nil
 }
 
@@ -187,6 +201,7 @@ func (session *session) createLogEntry(response interface{}) (*LogEntry, error)
 		entry.Disclosure = response.(*irma.Disclosure)
 	case irma.ActionIssuing:
 		entry.IssueCommitment = response.(*irma.IssueCommitmentMessage)
+		entry.IssueErrors = session.issueErrors
 	default:
 		return nil, errors.New("Invalid log type")
 	}
@@ -59,9 +59,66 @@ type Handler interface {
 	RequestSchemeManagerPermission(manager *irma.SchemeManager,
 		callback func(proceed bool))
 
+	// RequestPin asks the user for the PIN. remainingAttempts is the amount of PIN attempts left before
+	// the user is blocked, or -1 if unknown (e.g. because the keyshare server does not report it).
 	RequestPin(remainingAttempts int, callback PinHandler)
 }
 
+// KeyshareAccountGoneHandler may optionally be implemented by a Handler, to be informed when the
+// keyshare server no longer knows our account, e.g. because it was deleted, so that the user can
+// enroll again using Client.KeyshareReenroll. Handlers not implementing it are informed using
+// KeyshareEnrollmentDeleted instead.
+type KeyshareAccountGoneHandler interface {
+	KeyshareAccountGone(manager irma.SchemeManagerIdentifier)
+}
+
+// PartialIssuanceHandler may optionally be implemented by a Handler, to be informed when some but
+// not all of the credentials of an issuance session could be issued. The errors correspond to the
+// credentials of the request; they are nil for the credentials that were issued.
+type PartialIssuanceHandler interface {
+	PartialIssuance(request *irma.IssuanceRequest, errs []*irma.RemoteError)
+}
+
+// SessionExpiryHandler may optionally be implemented by a Handler, to be informed of the time at
+// which the session times out at the IRMA server if the user does not act before, e.g. to show a
+// countdown. It is invoked before the user is asked for permission, if the server reports it.
+type SessionExpiryHandler interface {
+	SessionExpiry(expiresAt time.Time)
+}
+
+// ServerBusyHandler may optionally be implemented by a Handler, to be informed when the session
+// fails because the IRMA server or a keyshare server refused a request, asking it to be retried after
+// a delay longer than Client.MaxRetryAfter (or after which retrying did not succeed either). It is
+// invoked before Failure, e.g. to ask the user to try again after retryAfter.
+type ServerBusyHandler interface {
+	ServerBusy(retryAfter time.Duration)
+}
+
+// SessionProgressHandler may optionally be implemented by a Handler, to be informed of the progress
+// of the computations and keyshare server requests performed after the user gave permission, which
+// may take several seconds on slow devices.
+type SessionProgressHandler interface {
+	SessionProgress(action irma.Action, progress Progress)
+}
+
+// ProgressStep is a step of a session reported to SessionProgressHandler.
+type ProgressStep string
+
+const (
+	ProgressStepCommitment ProgressStep = "commitment" // computing the commitment of a proof
+	ProgressStepKeyshare   ProgressStep = "keyshare"   // waiting for a keyshare server
+	ProgressStepResponse   ProgressStep = "response"   // computing the response of a proof
+)
+
+// Progress is reported to SessionProgressHandler when a step of a session starts. For the
+// commitment and response steps, Current is the (1-based) index of the proof that is being
+// computed, out of Total proofs (one per credential involved in the session).
+type Progress struct {
+	Step    ProgressStep
+	Current int
+	Total   int
+}
+
 // SessionDismisser can dismiss the current IRMA session.
 type SessionDismisser interface {
 	Dismiss()
@@ -87,6 +144,10 @@ type session struct {
 	// State for issuance sessions
 	issuerProofNonce *big.Int
 	builders         gabi.ProofBuilderList
+	issueErrors      []*irma.RemoteError // credentials that the server failed to issue, if any
+
+	// Time at which the session times out at the server, if reported by the server
+	expiresAt *irma.Timestamp
 
 	// State for signature sessions
 	timestamp *atum.Timestamp
@@ -108,11 +169,16 @@ var _ keyshareSessionHandler = (*session)(nil)
 // Supported protocol versions. Minor version numbers should be sorted.
 var supportedVersions = map[int][]int{
 	2: {
-		4, // old protocol with legacy session requests
-		5, // introduces condiscon feature
-		6, // introduces nonrevocation proofs
-		7, // introduces chained sessions
-		8, // introduces session binding
+		4,  // old protocol with legacy session requests
+		5,  // introduces condiscon feature
+		6,  // introduces nonrevocation proofs
+		7,  // introduces chained sessions
+		8,  // introduces session binding
+		9,  // introduces hashed signature messages
+		10, // introduces partial issuance
+		11, // introduces test credentials
+		12, // introduces disclosure of all instances
+		13, // introduces issued attributes copying disclosed attributes
 	},
 }
 
@@ -134,6 +200,9 @@ func (client *Client) NewSession(sessionrequest string, handler Handler) Session
 
 	sigRequest := &irma.SignatureRequest{}
 	if err := json.Unmarshal(bts, sigRequest); err == nil && sigRequest.IsSignatureRequest() {
+		if sigRequest.Mode == irma.SignatureModeStandalone {
+			return client.SignMessage(sigRequest, handler)
+		}
 		if err = sigRequest.Validate(); err != nil {
 			handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
 			return nil
@@ -177,12 +246,33 @@ func (client *Client) newManualSession(request irma.SessionRequest, handler Hand
 	return session
 }
 
+// SignMessage creates an attribute-based signature over the message of the request on the initiative
+// of the user, without a requestor or IRMA server: the request is put in standalone mode, with a nonce
+// generated by the client (see irma.SignatureModeStandalone). As in other sessions, the handler is
+// asked for permission, and the signed message is passed as JSON to its Success method.
+func (client *Client) SignMessage(request *irma.SignatureRequest, handler Handler) SessionDismisser {
+	nonce, err := gabi.GenerateNonce()
+	if err != nil {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
+		return nil
+	}
+	request.Mode = irma.SignatureModeStandalone
+	request.Nonce = nonce
+	if err = request.Validate(); err != nil {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
+		return nil
+	}
+	return client.newManualSession(request, handler, irma.ActionSigning)
+}
+
 // newQrSession creates and starts a new interactive IRMA session
 func (client *Client) newQrSession(qr *irma.Qr, handler Handler) *session {
 	if qr.Type == irma.ActionRedirect {
 		newqr := &irma.Qr{}
 		transport := irma.NewHTTPTransport("", !client.Preferences.DeveloperMode)
+		transport.MaxRetryAfter = maxRetryAfter(client.MaxRetryAfter)
 		if err := transport.Post(qr.URL, newqr, struct{}{}); err != nil {
+			serverBusy(handler, err)
 			handler.Failure(&irma.SessionError{ErrorType: irma.ErrorTransport, Err: errors.Wrap(err, 0)})
 			return nil
 		}
@@ -210,6 +300,7 @@ func (client *Client) newQrSession(qr *irma.Qr, handler Handler) *session {
 		done:           doneChannel,
 		prepRevocation: make(chan error),
 	}
+	session.transport.MaxRetryAfter = maxRetryAfter(client.MaxRetryAfter)
 	client.sessions.add(session)
 
 	session.Handler.StatusUpdate(session.Action, irma.ClientStatusCommunicating)
@@ -267,6 +358,7 @@ func (session *session) getSessionInfo() {
 		session.fail(err.(*irma.SessionError))
 		return
 	}
+	session.expiresAt = cr.ExpiresAt
 
 	// Check whether pairing is needed, and if so, wait for it to be completed.
 	if cr.Options.PairingMethod != irma.PairingMethodNone {
@@ -374,11 +466,15 @@ func (session *session) processSessionInfo() {
 			}
 			return
 		}
+		if err = ir.CheckDuplicates(session.client.Configuration); err != nil {
+			session.fail(err.(*irma.SessionError))
+			return
+		}
 
 		// Calculate singleton credentials to be removed
 		ir.RemovalCredentialInfoList = irma.CredentialInfoList{}
 		for _, credreq := range ir.Credentials {
-			err := checkKey(session.client.Configuration, credreq.CredentialTypeID.IssuerIdentifier(), credreq.KeyCounter)
+			err := checkKey(session.client.Configuration, credreq.CredentialTypeID.IssuerIdentifier(), credreq.PublicKeyCounter())
 			if err != nil {
 				session.fail(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
 				return
@@ -431,6 +527,9 @@ func (session *session) requestPermission() {
 	}
 
 	session.Handler.StatusUpdate(session.Action, irma.ClientStatusConnected)
+	if handler, ok := session.Handler.(SessionExpiryHandler); ok && session.expiresAt != nil {
+		handler.SessionExpiry(time.Time(*session.expiresAt))
+	}
 
 	// Ask for permission to execute the session
 	switch session.Action {
@@ -500,8 +599,10 @@ func (session *session) doSession(proceed bool, choice *irma.DisclosureChoice) {
 			session.issuerProofNonce,
 			session.timestamp,
 			session.client.Configuration,
-			session.client.keyshareServers,
+			session.client.keyshareServersCopy(),
 			session.client.Preferences,
+			session.client.KeyshareTimeout,
+			session.client.MaxRetryAfter,
 		)
 	}
 }
@@ -553,10 +654,16 @@ func (session *session) sendResponse(message interface{}) {
 			return
 		}
 		if session.Action == irma.ActionIssuing {
-			if err = session.client.ConstructCredentials(serverResponse.IssueSignatures, session.request.(*irma.IssuanceRequest), session.builders); err != nil {
+			request := session.request.(*irma.IssuanceRequest)
+			if err = session.client.resolveDisclosedValues(request, session.choice, serverResponse.IssueSignatures); err != nil {
+				session.fail(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
+				return
+			}
+			if err = session.client.ConstructCredentials(serverResponse.IssueSignatures, request, session.builders); err != nil {
 				session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
 				return
 			}
+			session.issueErrors = serverResponse.IssueErrors
 		}
 	}
 
@@ -570,6 +677,12 @@ func (session *session) sendResponse(message interface{}) {
 	}
 	if session.Action == irma.ActionIssuing {
 		session.client.handler.UpdateAttributes()
+		if session.IsInteractive() {
+			go session.client.fetchMissingLogos(session.serverRoot(), session.issuedCredentialTypes())
+		}
+		if handler, ok := session.Handler.(PartialIssuanceHandler); ok && len(session.issueErrors) > 0 {
+			handler.PartialIssuance(session.request.(*irma.IssuanceRequest), session.issueErrors)
+		}
 	}
 	session.finish(false)
 
@@ -609,14 +722,21 @@ func (session *session) getProof() (interface{}, error) {
 
 	switch session.Action {
 	case irma.ActionSigning, irma.ActionDisclosing:
-		message, session.timestamp, err = session.client.Proofs(session.choice, session.request)
+		message, session.timestamp, err = session.client.proofs(session.choice, session.request, session.progress)
 	case irma.ActionIssuing:
-		message, session.builders, err = session.client.IssueCommitments(session.request.(*irma.IssuanceRequest), session.choice)
+		message, session.builders, err = session.client.issueCommitments(session.request.(*irma.IssuanceRequest), session.choice, session.progress)
 	}
 
 	return message, err
 }
 
+// progress informs the handler of the progress of the session, if it implements SessionProgressHandler.
+func (session *session) progress(progress Progress) {
+	if handler, ok := session.Handler.(SessionProgressHandler); ok {
+		handler.SessionProgress(session.Action, progress)
+	}
+}
+
 // Helper functions
 
 // checkKeyshareEnrollment checks if we are enrolled into all involved keyshare servers,
@@ -624,7 +744,7 @@ func (session *session) getProof() (interface{}, error) {
 func (session *session) checkKeyshareEnrollment() bool {
 	for id := range session.request.Identifiers().SchemeManagers {
 		distributed := session.client.Configuration.SchemeManagers[id].Distributed()
-		_, enrolled := session.client.keyshareServers[id]
+		_, enrolled := session.client.keyshareServer(id)
 		if distributed && !enrolled {
 			session.finish(false)
 			session.Handler.KeyshareEnrollmentMissing(id)
@@ -666,6 +786,24 @@ func (session *session) IsInteractive() bool {
 	return session.ServerURL != ""
 }
 
+// serverRoot returns the URL of the IRMA server of this session, i.e. the session URL without the
+// session/{token}/ suffix.
+func (session *session) serverRoot() string {
+	if i := strings.LastIndex(session.ServerURL, "session/"); i >= 0 {
+		return session.ServerURL[:i]
+	}
+	return session.ServerURL
+}
+
+// issuedCredentialTypes returns the types of the credentials issued in this issuance session.
+func (session *session) issuedCredentialTypes() []irma.CredentialTypeIdentifier {
+	var ids []irma.CredentialTypeIdentifier
+	for _, cred := range session.request.(*irma.IssuanceRequest).Credentials {
+		ids = append(ids, cred.CredentialTypeID)
+	}
+	return ids
+}
+
 // Distributed returns whether or not this session involves a keyshare server.
 func (session *session) Distributed() bool {
 	var smi irma.SchemeManagerIdentifier
@@ -748,10 +886,45 @@ func (session *session) fail(err *irma.SessionError) {
 	if session.finish(true) && err.ErrorType != irma.ErrorKeyshareUnenrolled {
 		irma.Logger.Warn("client session error: ", err.Error())
 		err.Err = errors.Wrap(err.Err, 0)
+		if err.ServerURL == "" {
+			err.ServerURL = session.ServerURL
+		}
+		serverBusy(session.Handler, err)
 		session.Handler.Failure(err)
 	}
 }
 
+// serverBusy informs the handler, if it implements ServerBusyHandler, if err was caused by a server
+// asking its request to be retried after some delay.
+func serverBusy(handler Handler, err error) {
+	h, ok := handler.(ServerBusyHandler)
+	if !ok {
+		return
+	}
+	if retryAfter := retryAfter(err); retryAfter > 0 {
+		h.ServerBusy(retryAfter)
+	}
+}
+
+// retryAfter returns the delay after which the server that caused err asked its request to be
+// retried, or 0 if err was not caused by such a server.
+func retryAfter(err error) time.Duration {
+	for err != nil {
+		switch e := err.(type) {
+		case *irma.SessionError:
+			if e.RetryAfter > 0 {
+				return e.RetryAfter
+			}
+			err = e.Err
+		case *errors.Error:
+			err = e.Err
+		default:
+			return 0
+		}
+	}
+	return 0
+}
+
 func (session *session) cancel() {
 	if session.finish(true) {
 		session.Handler.Cancelled()
@@ -799,6 +972,15 @@ func (session *session) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIden
 	session.Handler.KeyshareEnrollmentDeleted(manager)
 }
 
+func (session *session) KeyshareAccountGone(manager irma.SchemeManagerIdentifier) {
+	session.finish(false)
+	if handler, ok := session.Handler.(KeyshareAccountGoneHandler); ok {
+		handler.KeyshareAccountGone(manager)
+	} else {
+		session.Handler.KeyshareEnrollmentDeleted(manager)
+	}
+}
+
 func (session *session) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
 	session.finish(false)
 	session.Handler.KeyshareBlocked(manager, duration)
@@ -821,6 +1003,22 @@ func (session *session) KeysharePinOK() {
 	session.Handler.StatusUpdate(session.Action, irma.ClientStatusCommunicating)
 }
 
+func (session *session) KeyshareProgress(progress Progress) {
+	session.progress(progress)
+}
+
+func (session *session) KeyshareSunset(manager irma.SchemeManagerIdentifier, announcement *irma.SunsetAnnouncement) {
+	session.client.keyshareSunset(manager, announcement)
+}
+
+func (session *session) KeyshareServerUsed(kss *keyshareServer) {
+	session.client.keyshareServerUsed(kss)
+}
+
+func (session *session) KeyshareUnavailable(manager irma.SchemeManagerIdentifier) {
+	session.client.keyshareUnavailable(manager)
+}
+
 func (s sessions) remove(token string) {
 	last := s.sessions[token]
 	delete(s.sessions, token)
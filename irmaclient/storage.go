@@ -1,9 +1,15 @@
 package irmaclient
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/privacybydesign/gabi"
@@ -23,6 +29,22 @@ type storage struct {
 	storagePath   string
 	db            *bbolt.DB
 	Configuration *irma.Configuration
+
+	warnings     []StorageWarning
+	warningsLock sync.Mutex
+}
+
+// StorageClass identifies a kind of data in the storage of the client.
+type StorageClass string
+
+// StorageWarning reports data that could not be read from the storage of the client,
+// because the storage was corrupted.
+type StorageWarning struct {
+	Class StorageClass
+	// Whether the data was restored from the backup of the storage that is made each time the client
+	// starts, in which case only the changes made since then are lost. Otherwise, the data is lost.
+	Restored bool
+	Err      error
 }
 
 type transaction struct {
@@ -30,7 +52,18 @@ type transaction struct {
 }
 
 // Filenames
-const databaseFile = "db"
+const (
+	databaseFile       = "db"
+	databaseBackupFile = "db.bak"
+)
+
+const (
+	StorageDatabase        StorageClass = "database"
+	StoragePreferences     StorageClass = "preferences"
+	StorageAttributes      StorageClass = "attributes"
+	StorageKeyshareServers StorageClass = "keyshareServers"
+	StorageLogs            StorageClass = "logs"
+)
 
 // Bucketnames bbolt
 const (
@@ -45,23 +78,211 @@ const (
 	signaturesBucket = "sigs"  // Key: credential.attrs.Hash, value: *gabi.CLSignature
 )
 
+// Directory containing logos of credential types that are missing from the schemes,
+// fetched from the IRMA server that issued them
+const logosDir = "logos"
+
 func (s *storage) path(p string) string {
 	return filepath.Join(s.storagePath, p)
 }
 
+// LogoPath returns the path of the fetched logo of the credential type, or "" if it was not fetched.
+func (s *storage) LogoPath(id irma.CredentialTypeIdentifier) string {
+	path := s.path(filepath.Join(logosDir, id.String()+".png"))
+	if exists, _ := common.PathExists(path); !exists {
+		return ""
+	}
+	return path
+}
+
+func (s *storage) StoreLogo(id irma.CredentialTypeIdentifier, logo []byte) error {
+	if err := common.EnsureDirectoryExists(s.path(logosDir)); err != nil {
+		return err
+	}
+	return common.SaveFile(s.path(filepath.Join(logosDir, id.String()+".png")), logo)
+}
+
 // Open initializes the credential storage,
 // ensuring that it is in a usable state.
 // Setting it up in a properly protected location (e.g., with automatic
 // backups to iCloud/Google disabled) is the responsibility of the user.
+// If the database is corrupted, it is restored from its backup (see backup).
 func (s *storage) Open() error {
 	var err error
 	if err = common.AssertPathExists(s.storagePath); err != nil {
 		return err
 	}
-	s.db, err = bbolt.Open(s.path(databaseFile), 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	s.db, err = openDatabase(s.path(databaseFile), false)
+	if err != nil && err != bbolt.ErrTimeout {
+		if restoreErr := s.restoreBackup(); restoreErr != nil {
+			irma.Logger.Warnf("Failed to restore database backup: %s", restoreErr.Error())
+			return err
+		}
+		s.warn(StorageDatabase, true, err)
+		s.db, err = openDatabase(s.path(databaseFile), false)
+	}
 	return err
 }
 
+// openDatabase opens the bbolt database and checks its consistency.
+func openDatabase(path string, readOnly bool) (db *bbolt.DB, err error) {
+	// bbolt panics on some kinds of corruption
+	defer func() {
+		if e := recover(); e != nil {
+			if db != nil {
+				_ = db.Close()
+			}
+			db, err = nil, errors.Errorf("corrupt database: %v", e)
+		}
+	}()
+
+	if err = checkDatabaseSize(path); err != nil {
+		return nil, err
+	}
+	db, err = bbolt.Open(path, 0600, &bbolt.Options{Timeout: 1 * time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, err
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		var checkErr error
+		for err := range tx.Check() {
+			if checkErr == nil {
+				checkErr = err
+			}
+		}
+		return checkErr
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// checkDatabaseSize returns an error if the bbolt database file at path is shorter than the
+// amount of pages in use according to its meta pages, which bbolt itself does not detect.
+// The database starts with two meta pages, each consisting of a 16 byte page header followed by
+// magic, version, page size, flags (uint32 each), root bucket (16 bytes), freelist, pgid, txid
+// and checksum (uint64 each); the valid one with the highest txid is the current one.
+func checkDatabaseSize(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer common.Close(f)
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	const metaSize = 64
+	readMeta := func(offset int64) (pageSize, pgid, txid uint64, ok bool) {
+		buf := make([]byte, 16+metaSize)
+		if _, err := f.ReadAt(buf, offset); err != nil {
+			return
+		}
+		m := buf[16:]
+		if binary.LittleEndian.Uint32(m[0:]) != 0xED0CDAED {
+			return
+		}
+		h := fnv.New64a()
+		_, _ = h.Write(m[:56])
+		if sum := binary.LittleEndian.Uint64(m[56:]); sum != 0 && sum != h.Sum64() {
+			return
+		}
+		return uint64(binary.LittleEndian.Uint32(m[8:])), binary.LittleEndian.Uint64(m[40:]),
+			binary.LittleEndian.Uint64(m[48:]), true
+	}
+
+	pageSize, pgid, txid, ok := readMeta(0)
+	if !ok {
+		// The first meta page is damaged; use the page size of this platform to find the second one
+		pageSize = uint64(os.Getpagesize())
+	}
+	if pageSize2, pgid2, txid2, ok2 := readMeta(int64(pageSize)); ok2 && (!ok || txid2 > txid) {
+		pageSize, pgid, ok = pageSize2, pgid2, true
+	}
+	if !ok {
+		// Leave it to bbolt to report the invalid database
+		return nil
+	}
+	if uint64(info.Size()) < pgid*pageSize {
+		return errors.Errorf("corrupt database: file is %d bytes, expected at least %d", info.Size(), pgid*pageSize)
+	}
+	return nil
+}
+
+// backup saves a copy of the database in databaseBackupFile. The client does so each time it
+// starts, once it has read its data from the database without finding corruption.
+func (s *storage) backup() error {
+	var buf bytes.Buffer
+	if err := s.db.View(func(tx *bbolt.Tx) error {
+		_, err := tx.WriteTo(&buf)
+		return err
+	}); err != nil {
+		return err
+	}
+	return common.SaveFile(s.path(databaseBackupFile), buf.Bytes())
+}
+
+// restoreBackup replaces the database by its backup, if present.
+func (s *storage) restoreBackup() error {
+	bts, err := ioutil.ReadFile(s.path(databaseBackupFile))
+	if err != nil {
+		return err
+	}
+	return common.SaveFile(s.path(databaseFile), bts)
+}
+
+// restore reads the value at the key from the backup of the database using parse, for when the
+// value in the database could not be parsed due to err. It reports whether that succeeded; if not,
+// the value is lost and should be dropped by the caller.
+func (s *storage) restore(class StorageClass, bucketName, key string, err error, parse func([]byte) error) bool {
+	backupErr := func() error {
+		db, err := openDatabase(s.path(databaseBackupFile), true)
+		if err != nil {
+			return err
+		}
+		defer common.Close(db)
+		return db.View(func(tx *bbolt.Tx) error {
+			b := tx.Bucket([]byte(bucketName))
+			if b == nil || b.Get([]byte(key)) == nil {
+				return errors.Errorf("%s not found in backup", key)
+			}
+			return parse(b.Get([]byte(key)))
+		})
+	}()
+	if backupErr != nil {
+		s.warn(class, false, errors.Errorf("%v (backup: %v)", err, backupErr))
+		return false
+	}
+	s.warn(class, true, err)
+	return true
+}
+
+// warn records that data of the specified class could not be read from storage. Only the first
+// warning of each class is recorded.
+func (s *storage) warn(class StorageClass, restored bool, err error) {
+	irma.Logger.WithField("restored", restored).Warnf("Failed to read %s from storage: %s", class, err.Error())
+	s.warningsLock.Lock()
+	defer s.warningsLock.Unlock()
+	for _, w := range s.warnings {
+		if w.Class == class {
+			return
+		}
+	}
+	s.warnings = append(s.warnings, StorageWarning{Class: class, Restored: restored, Err: err})
+}
+
+func (s *storage) Warnings() []StorageWarning {
+	s.warningsLock.Lock()
+	defer s.warningsLock.Unlock()
+	return append([]StorageWarning{}, s.warnings...)
+}
+
 func (s *storage) Close() error {
 	return s.db.Close()
 }
@@ -294,9 +515,12 @@ func (s *storage) LoadSecretKey() (*secretKey, error) {
 	return sk, nil
 }
 
+// LoadAttributes loads the attributes of all credentials. Corrupt attributes of a credential type
+// are restored from the backup of the database and stored again, or removed if that fails.
 func (s *storage) LoadAttributes() (list map[irma.CredentialTypeIdentifier][]*irma.AttributeList, err error) {
 	list = make(map[irma.CredentialTypeIdentifier][]*irma.AttributeList)
-	return list, s.db.View(func(tx *bbolt.Tx) error {
+	restored := map[irma.CredentialTypeIdentifier][]*irma.AttributeList{}
+	err = s.db.View(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte(attributesBucket))
 		if b == nil {
 			return nil
@@ -304,10 +528,20 @@ func (s *storage) LoadAttributes() (list map[irma.CredentialTypeIdentifier][]*ir
 		return b.ForEach(func(key, value []byte) error {
 			credTypeID := irma.NewCredentialTypeIdentifier(string(key))
 
-			var attrlistlist []*irma.AttributeList
-			err = json.Unmarshal(value, &attrlistlist)
+			attrlistlist, err := parseAttributeLists(value)
 			if err != nil {
-				return err
+				ok := s.restore(StorageAttributes, attributesBucket, string(key), errors.WrapPrefix(err, credTypeID.String(), 0),
+					func(value []byte) (err error) {
+						attrlistlist, err = parseAttributeLists(value)
+						return
+					},
+				)
+				if !ok {
+					// Storing no attributes removes the credential type from the database
+					restored[credTypeID] = nil
+					return nil
+				}
+				restored[credTypeID] = attrlistlist
 			}
 
 			// Initialize metadata attributes
@@ -319,12 +553,47 @@ func (s *storage) LoadAttributes() (list map[irma.CredentialTypeIdentifier][]*ir
 			return nil
 		})
 	})
+	if err != nil {
+		return nil, err
+	}
+	for credTypeID, attrlistlist := range restored {
+		if err = s.StoreAttributes(credTypeID, attrlistlist); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// parseAttributeLists parses the stored attributes of the credentials of a credential type.
+func parseAttributeLists(value []byte) ([]*irma.AttributeList, error) {
+	var attrlistlist []*irma.AttributeList
+	if err := json.Unmarshal(value, &attrlistlist); err != nil {
+		return nil, err
+	}
+	for _, attrlist := range attrlistlist {
+		if attrlist == nil || len(attrlist.Ints) == 0 {
+			return nil, errors.New("missing metadata attribute")
+		}
+	}
+	return attrlistlist, nil
 }
 
+// LoadKeyshareServers loads the keyshare servers with which the client is enrolled. If they are
+// corrupt, they are restored from the backup of the database and stored again; if that fails, the
+// enrollments are lost.
 func (s *storage) LoadKeyshareServers() (ksses map[irma.SchemeManagerIdentifier]*keyshareServer, err error) {
 	ksses = make(map[irma.SchemeManagerIdentifier]*keyshareServer)
-	_, err = s.load(userdataBucket, kssKey, &ksses)
-	return
+	if _, err = s.load(userdataBucket, kssKey, &ksses); !isCorrupt(err) {
+		return
+	}
+	ok := s.restore(StorageKeyshareServers, userdataBucket, kssKey, err, func(value []byte) error {
+		ksses = make(map[irma.SchemeManagerIdentifier]*keyshareServer)
+		return json.Unmarshal(value, &ksses)
+	})
+	if !ok {
+		ksses = make(map[irma.SchemeManagerIdentifier]*keyshareServer)
+	}
+	return ksses, s.StoreKeyshareServers(ksses)
 }
 
 // Returns all logs stored before log with ID 'index' sorted from new to old with
@@ -358,7 +627,8 @@ func (s *storage) loadLogs(max int, startAt func(*bbolt.Cursor) (key, value []by
 		for k, v := startAt(c); k != nil && len(logs) < max; k, v = c.Prev() {
 			var log LogEntry
 			if err := json.Unmarshal(v, &log); err != nil {
-				return err
+				s.warn(StorageLogs, false, err)
+				continue
 			}
 
 			logs = append(logs, &log)
@@ -375,8 +645,22 @@ func (s *storage) LoadUpdates() (updates []update, err error) {
 
 func (s *storage) LoadPreferences() (Preferences, error) {
 	config := defaultPreferences
-	_, err := s.load(userdataBucket, preferencesKey, &config)
-	return config, err
+	if _, err := s.load(userdataBucket, preferencesKey, &config); isCorrupt(err) {
+		s.warn(StoragePreferences, false, err)
+		return defaultPreferences, nil
+	} else if err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// isCorrupt returns whether the error was caused by stored data that could not be parsed.
+func isCorrupt(err error) bool {
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return true
+	}
+	return err == io.ErrUnexpectedEOF
 }
 
 func (s *storage) TxDeleteUserdata(tx *transaction) error {
@@ -1,10 +1,13 @@
 package irma
 
 import (
+	"bytes"
+	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
@@ -12,11 +15,14 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"runtime/debug"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/gabikeys"
 	"github.com/privacybydesign/irmago/internal/common"
 
@@ -50,7 +56,8 @@ type Configuration struct {
 	// (i.e., invalid signature, parsing error), and the problem that occurred when parsing them
 	DisabledSchemeManagers map[SchemeManagerIdentifier]*SchemeManagerError
 
-	// Listeners for configuration changes from initialization and updating of the schemes
+	// Listeners for configuration changes from initialization and updating of the schemes,
+	// which are run synchronously in the updater. See also AddUpdateListener().
 	UpdateListeners []ConfigurationListener
 
 	// Path to the irma_configuration folder that this instance represents
@@ -60,6 +67,17 @@ type Configuration struct {
 	Scheduler   *gocron.Scheduler
 	Warnings    []string `json:"-"`
 
+	listenersMutex sync.Mutex
+	listeners      []*updateListener
+
+	timestampsMutex sync.Mutex
+
+	// Stops the Scheduler; used when the revocation storage is closed
+	stopScheduler chan bool
+
+	// Set using SetClockSkewTolerance(); if nil, DefaultClockSkewTolerance applies
+	clockSkewTolerance *time.Duration
+
 	options     ConfigurationOptions
 	initialized bool
 	assets      string
@@ -86,6 +104,21 @@ type ConfigurationOptions struct {
 	RevocationDBConnStr string
 	RevocationDBType    string
 	RevocationSettings  RevocationSettings
+	// Public keys with which the specified issuer schemes must be signed. Schemes signed with another
+	// key fail to parse, and updates to them are rejected.
+	PinnedSchemeKeys map[SchemeManagerIdentifier]*ecdsa.PublicKey
+	// If set, invoked on the HTTP transports with which schemes, keys and revocation updates are
+	// downloaded, e.g. to restrict their destinations using HTTPTransport.SetDialer.
+	ConfigureTransport func(transport *HTTPTransport)
+}
+
+// newHTTPTransport returns a new HTTPTransport, configured using ConfigurationOptions.ConfigureTransport.
+func (conf *Configuration) newHTTPTransport(serverURL string, forceHTTPS bool) *HTTPTransport {
+	transport := NewHTTPTransport(serverURL, forceHTTPS)
+	if conf.options.ConfigureTransport != nil {
+		conf.options.ConfigureTransport(transport)
+	}
+	return transport
 }
 
 // NewConfiguration returns a new configuration. After this
@@ -196,7 +229,7 @@ func (conf *Configuration) ParseFolder() (err error) {
 
 	if conf.Revocation == nil {
 		conf.Scheduler = gocron.NewScheduler()
-		conf.Scheduler.Start()
+		conf.stopScheduler = conf.Scheduler.Start()
 		conf.Revocation = &RevocationStorage{conf: conf}
 		if err = conf.Revocation.Load(
 			Logger.IsLevelEnabled(logrus.DebugLevel),
@@ -400,9 +433,13 @@ func (conf *Configuration) ValidateKeys() error {
 }
 
 // KeyshareServerKeyFunc returns a function that returns the public key with which to verify a keyshare server JWT,
-// suitable for passing to jwt.Parse() and jwt.ParseWithClaims().
+// suitable for passing to jwt.Parse() and jwt.ParseWithClaims(). As keyshare servers sign their JWTs
+// using RS256, JWTs using any other algorithm are rejected.
 func (conf *Configuration) KeyshareServerKeyFunc(scheme SchemeManagerIdentifier) func(t *jwt.Token) (interface{}, error) {
 	return func(t *jwt.Token) (i interface{}, e error) {
+		if t.Method != jwt.SigningMethodRS256 {
+			return nil, errors.Errorf("keyshare server JWT has unexpected algorithm %v", t.Header["alg"])
+		}
 		var kid int
 		if kidstr, ok := t.Header["kid"].(string); ok {
 			var err error
@@ -426,6 +463,9 @@ func (conf *Configuration) KeyshareServerPublicKey(schemeid SchemeManagerIdentif
 			return nil, err
 		}
 		pkblk, _ := pem.Decode(pkbts)
+		if pkblk == nil {
+			return nil, errors.New("Invalid keyshare server public key")
+		}
 		genericPk, err := x509.ParsePKIXPublicKey(pkblk.Bytes)
 		if err != nil {
 			return nil, err
@@ -439,6 +479,45 @@ func (conf *Configuration) KeyshareServerPublicKey(schemeid SchemeManagerIdentif
 	return conf.kssPublicKeys[schemeid][i], nil
 }
 
+// ParseKeyshareProofP parses the JWT in which the keyshare server of the specified scheme sends its
+// ProofP, returning the ProofP and the standard claims of the JWT. The JWT must be signed by one of
+// the keyshare server keys of the scheme, have been issued (and not be expired) taking
+// ClockSkewTolerance() into account, and contain exactly the fields of a ProofP. Failures are
+// returned as a *SessionError of type ErrorKeyshareProof.
+func (conf *Configuration) ParseKeyshareProofP(scheme SchemeManagerIdentifier, token string) (*gabi.ProofP, *jwt.StandardClaims, error) {
+	claims := &struct {
+		jwt.StandardClaims
+		ProofP json.RawMessage
+	}{}
+	// We check the time claims ourselves below, to take clock skew into account
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	if _, err := parser.ParseWithClaims(token, claims, conf.KeyshareServerKeyFunc(scheme)); err != nil {
+		return nil, nil, &SessionError{ErrorType: ErrorKeyshareProof, Info: "could not verify ProofP JWT", Err: err}
+	}
+
+	now, tolerance := time.Now(), conf.ClockSkewTolerance()
+	switch {
+	case claims.Subject != "" && claims.Subject != "ProofP":
+		return nil, nil, &SessionError{ErrorType: ErrorKeyshareProof, Info: "ProofP JWT has invalid subject"}
+	case !claims.VerifyIssuedAt(now.Add(tolerance).Unix(), true),
+		!claims.VerifyNotBefore(now.Add(tolerance).Unix(), false):
+		return nil, nil, &SessionError{ErrorType: ErrorKeyshareProof, Info: "ProofP JWT not yet valid"}
+	case !claims.VerifyExpiresAt(now.Add(-tolerance).Unix(), false):
+		return nil, nil, &SessionError{ErrorType: ErrorKeyshareProof, Info: "ProofP JWT expired"}
+	}
+
+	proofP := &gabi.ProofP{}
+	decoder := json.NewDecoder(bytes.NewReader(claims.ProofP))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(proofP); err != nil {
+		return nil, nil, &SessionError{ErrorType: ErrorKeyshareProof, Info: "ProofP JWT contains invalid ProofP", Err: err}
+	}
+	if proofP.P == nil || proofP.C == nil || proofP.SResponse == nil {
+		return nil, nil, &SessionError{ErrorType: ErrorKeyshareProof, Info: "ProofP JWT contains incomplete ProofP"}
+	}
+	return proofP, &claims.StandardClaims, nil
+}
+
 // IsInitialized indicates whether this instance has successfully been initialized.
 func (conf *Configuration) IsInitialized() bool {
 	return conf.initialized
@@ -572,7 +651,8 @@ func (conf *Configuration) checkCredentialTypes(session SessionRequest, missing
 			}
 
 			// Check for attributes in the request that are not in the credential configuration
-			for reqAttr := range credreq.Attributes {
+			names := credreq.attributeNames()
+			for reqAttr := range names {
 				attrID := NewAttributeTypeIdentifier(credreq.CredentialTypeID.String() + "." + reqAttr)
 				if !typ.ContainsAttribute(attrID) {
 					missing.AttributeTypes[attrID] = struct{}{}
@@ -581,7 +661,7 @@ func (conf *Configuration) checkCredentialTypes(session SessionRequest, missing
 
 			// Check if all attributes from the configuration are present, unless they are marked as optional
 			for _, attrtype := range typ.AttributeTypes {
-				_, present := credreq.Attributes[attrtype.ID]
+				_, present := names[attrtype.ID]
 				if !present && !attrtype.RevocationAttribute && !attrtype.RandomBlind && !attrtype.IsOptional() {
 					requiredMissing.AttributeTypes[attrtype.GetAttributeTypeIdentifier()] = struct{}{}
 				}
@@ -900,8 +980,101 @@ func firstExistingPath(paths []string) string {
 	return ""
 }
 
+// AddUpdateListener registers a listener for configuration changes from initialization and updating
+// of the schemes, returning a function that removes it again. Unless synchronous is set, the listener
+// runs in its own goroutine, so that it does not block the updater; if the configuration changes
+// again while it runs, it is run once more afterwards, so that it sees the latest configuration
+// without being run for each intermediate change. Synchronous listeners run in the updater, in the
+// order in which they were added.
+func (conf *Configuration) AddUpdateListener(listener ConfigurationListener, synchronous bool) (remove func()) {
+	l := &updateListener{listener: listener, synchronous: synchronous}
+	conf.listenersMutex.Lock()
+	conf.listeners = append(conf.listeners, l)
+	conf.listenersMutex.Unlock()
+
+	return func() {
+		conf.listenersMutex.Lock()
+		defer conf.listenersMutex.Unlock()
+		for i, other := range conf.listeners {
+			if other == l {
+				conf.listeners = append(conf.listeners[:i:i], conf.listeners[i+1:]...)
+				break
+			}
+		}
+		l.mutex.Lock()
+		l.removed = true
+		l.mutex.Unlock()
+	}
+}
+
 func (conf *Configuration) CallListeners() {
 	for _, listener := range conf.UpdateListeners {
-		listener(conf)
+		callListener(listener, conf)
 	}
+
+	conf.listenersMutex.Lock()
+	listeners := make([]*updateListener, len(conf.listeners))
+	copy(listeners, conf.listeners)
+	conf.listenersMutex.Unlock()
+	for _, l := range listeners {
+		l.notify(conf)
+	}
+}
+
+// updateListener is a listener registered with AddUpdateListener.
+type updateListener struct {
+	listener    ConfigurationListener
+	synchronous bool
+
+	mutex   sync.Mutex
+	running bool // an asynchronous run is ongoing
+	pending bool // the configuration changed during the ongoing run
+	removed bool
+}
+
+func (l *updateListener) notify(conf *Configuration) {
+	l.mutex.Lock()
+	if l.removed {
+		l.mutex.Unlock()
+		return
+	}
+	if l.synchronous {
+		l.mutex.Unlock()
+		callListener(l.listener, conf)
+		return
+	}
+	defer l.mutex.Unlock()
+	if l.running {
+		l.pending = true
+		return
+	}
+	l.running = true
+	go l.run(conf)
+}
+
+func (l *updateListener) run(conf *Configuration) {
+	for {
+		callListener(l.listener, conf)
+
+		l.mutex.Lock()
+		if !l.pending || l.removed {
+			l.running = false
+			l.mutex.Unlock()
+			return
+		}
+		l.pending = false
+		l.mutex.Unlock()
+	}
+}
+
+// callListener runs the listener, logging instead of propagating any panic,
+// so that a failing listener does not affect the updater or the other listeners.
+func callListener(listener ConfigurationListener, conf *Configuration) {
+	defer func() {
+		if e := recover(); e != nil {
+			Logger.WithField("panic", e).Error("Configuration update listener panicked")
+			Logger.Debug(string(debug.Stack()))
+		}
+	}()
+	listener(conf)
 }
@@ -1,24 +1,37 @@
 package irma
 
 import (
+	"context"
+	"crypto/ecdsa"
 	"crypto/rand"
+	"crypto/rsa"
 	"encoding/json"
 	"encoding/xml"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/go-errors/errors"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/gabi/gabikeys"
 	"github.com/privacybydesign/gabi/revocation"
+	"github.com/privacybydesign/gabi/signed"
 	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/curve25519"
 )
 
 func init() {
@@ -96,6 +109,55 @@ func TestUpdateConfiguration(t *testing.T) {
 	require.Contains(t, updated.RequestorSchemes, requestorschemeid)
 }
 
+func TestSchemeRollback(t *testing.T) {
+	storage := test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t, storage)
+	test.StartSchemeManagerHttpServer()
+	defer test.StopSchemeManagerHttpServer()
+
+	path := filepath.Join(storage, "client")
+	conf, err := NewConfiguration(path, ConfigurationOptions{Assets: filepath.Join("testdata", "irma_configuration")})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	schemeid := NewSchemeManagerIdentifier("irma-demo")
+	oldURL := conf.SchemeManagers[schemeid].URL
+	newURL := "http://localhost:48681/irma_configuration_updated/irma-demo"
+	conf.SchemeManagers[schemeid].URL = newURL
+	require.NoError(t, conf.UpdateScheme(conf.SchemeManagers[schemeid], nil))
+	newTimestamp := conf.SchemeManagers[schemeid].Timestamp
+
+	// The older copy of the scheme is validly signed, but rejected once a newer version was seen,
+	// also when the local scheme is older, as if it were reinstalled
+	scheme := conf.SchemeManagers[schemeid]
+	scheme.URL = oldURL
+	scheme.Timestamp = Timestamp(time.Time(scheme.Timestamp).Add(-1000 * time.Hour))
+	err = conf.UpdateScheme(scheme, nil)
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrSchemeRollback))
+
+	// The seen timestamps are persisted in the irma_configuration folder
+	conf, err = NewConfiguration(path, ConfigurationOptions{})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	scheme = conf.SchemeManagers[schemeid]
+	require.Equal(t, newTimestamp, scheme.Timestamp)
+	scheme.URL = oldURL
+	scheme.Timestamp = Timestamp(time.Time(scheme.Timestamp).Add(-1000 * time.Hour))
+	err = conf.UpdateScheme(scheme, nil)
+	require.True(t, errors.Is(err, ErrSchemeRollback))
+
+	// Genuine rollbacks can be done explicitly, after which the older version is accepted
+	scheme.Timestamp = newTimestamp
+	require.NoError(t, conf.DangerousRollbackScheme(scheme))
+	scheme = conf.SchemeManagers[schemeid]
+	require.True(t, time.Time(scheme.Timestamp).Before(time.Time(newTimestamp)))
+	require.NoError(t, conf.UpdateScheme(scheme, nil))
+	scheme.URL = newURL
+	require.NoError(t, conf.UpdateScheme(scheme, nil))
+	require.Equal(t, newTimestamp, conf.SchemeManagers[schemeid].Timestamp)
+}
+
 func TestParseInvalidIrmaConfiguration(t *testing.T) {
 	// The description.xml of the scheme manager under this folder has been edited
 	// to invalidate the scheme manager signature
@@ -116,6 +178,35 @@ func TestParseInvalidIrmaConfiguration(t *testing.T) {
 	require.Equal(t, SchemeManagerStatusInvalidSignature, conf.SchemeManagers[id].Status)
 }
 
+func TestParsePinnedSchemeKeys(t *testing.T) {
+	readKey := func(scheme string) *ecdsa.PublicKey {
+		bts, err := ioutil.ReadFile(filepath.Join("testdata", "irma_configuration", scheme, "pk.pem"))
+		require.NoError(t, err)
+		pk, err := signed.UnmarshalPemPublicKey(bts)
+		require.NoError(t, err)
+		return pk
+	}
+	id := NewSchemeManagerIdentifier("irma-demo")
+
+	// Pinning the key with which the scheme is signed succeeds
+	conf, err := NewConfiguration(filepath.Join("testdata", "irma_configuration"), ConfigurationOptions{
+		ReadOnly:         true,
+		PinnedSchemeKeys: map[SchemeManagerIdentifier]*ecdsa.PublicKey{id: readKey("irma-demo")},
+	})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	// Pinning another key disables the scheme
+	conf, err = NewConfiguration(filepath.Join("testdata", "irma_configuration"), ConfigurationOptions{
+		ReadOnly:         true,
+		PinnedSchemeKeys: map[SchemeManagerIdentifier]*ecdsa.PublicKey{id: readKey("test")},
+	})
+	require.NoError(t, err)
+	require.Error(t, conf.ParseFolder())
+	require.Contains(t, conf.DisabledSchemeManagers, id)
+	require.Equal(t, SchemeManagerStatusInvalidSignature, conf.SchemeManagers[id].Status)
+}
+
 func TestRetryHTTPRequest(t *testing.T) {
 	test.StartBadHttpServer(2, 1*time.Second, "42")
 	defer test.StopBadHttpServer()
@@ -296,6 +387,36 @@ func TestMetadataCompatibility(t *testing.T) {
 	require.Equal(t, time.Unix(1499904000, 0), attr.SigningDate(), "Unexpected signing date")
 	require.Equal(t, time.Unix(1516233600, 0), attr.Expiry(), "Unexpected expiry date")
 	require.Equal(t, uint(2), attr.KeyCounter(), "Unexpected key counter")
+	require.False(t, attr.IsTestCredential())
+}
+
+func TestMetadataTestCredential(t *testing.T) {
+	conf := parseConfiguration(t)
+	request := &CredentialRequest{
+		CredentialTypeID: NewCredentialTypeIdentifier("irma-demo.RU.studentCard"),
+		Attributes: map[string]string{
+			"university":        "Radboud",
+			"studentCardNumber": "31415927",
+			"studentID":         "s1234567",
+			"level":             "42",
+		},
+	}
+	list, err := request.AttributeList(conf, 0x03, nil, time.Now())
+	require.NoError(t, err)
+	require.False(t, list.IsTestCredential())
+	require.False(t, list.Info().TestCredential)
+
+	// The flag does not change the metadata version, nor the other fields or the attribute values
+	request.TestCredential = true
+	testList, err := request.AttributeList(conf, 0x03, nil, time.Now())
+	require.NoError(t, err)
+	require.True(t, testList.IsTestCredential())
+	require.True(t, testList.Info().TestCredential)
+	require.Equal(t, byte(0x03), testList.Version())
+	require.NotEqual(t, list.Ints[0], testList.Ints[0])
+	require.Equal(t, list.Bytes()[1:], testList.Bytes()[1:])
+	require.Equal(t, list.CredentialType(), testList.CredentialType())
+	require.Equal(t, list.Map(), testList.Map())
 }
 
 func TestTimestamp(t *testing.T) {
@@ -357,6 +478,384 @@ func TestEmptySignature(t *testing.T) {
 	require.NotEqual(t, ProofStatusValid, status)
 }
 
+func TestHashedSignatureRequest(t *testing.T) {
+	message := "I owe you everything"
+	hash, err := NewMessageHash(MessageHashSHA256, []byte(message))
+	require.NoError(t, err)
+	require.NoError(t, hash.Validate())
+	require.True(t, hash.Matches([]byte(message)))
+	require.False(t, hash.Matches([]byte("I owe you nothing")))
+
+	_, err = NewMessageHash("MD5", []byte(message))
+	require.Error(t, err)
+	require.Error(t, (&MessageHash{Algorithm: MessageHashSHA512, Digest: hash.Digest}).Validate())
+
+	attr := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	plain := NewSignatureRequest(message, attr)
+	plain.Nonce = big.NewInt(42)
+	hashed := NewHashedSignatureRequest(hash, "IOU", attr)
+	hashed.Nonce = big.NewInt(42)
+	require.NoError(t, plain.Validate())
+	require.NoError(t, hashed.Validate())
+	require.NotEqual(t, plain.GetNonce(nil), hashed.GetNonce(nil))
+	plainMessage, err := plain.TimestampMessage()
+	require.NoError(t, err)
+	hashedMessage, err := hashed.TimestampMessage()
+	require.NoError(t, err)
+	require.NotEqual(t, plainMessage, hashedMessage)
+
+	// The displayed message is bound to the nonce as well
+	other := NewHashedSignatureRequest(hash, "Receipt", attr)
+	other.Nonce = big.NewInt(42)
+	require.NotEqual(t, hashed.GetNonce(nil), other.GetNonce(nil))
+
+	// The hash and display message survive (un)marshaling
+	bts, err := json.Marshal(hashed)
+	require.NoError(t, err)
+	parsed := &SignatureRequest{}
+	require.NoError(t, json.Unmarshal(bts, parsed))
+	require.Equal(t, hashed.GetNonce(nil), parsed.GetNonce(nil))
+
+	// A signature over the hash matches both the hashed request and the request containing the full message
+	sm, err := hashed.SignatureFromMessage(&Disclosure{}, nil)
+	require.NoError(t, err)
+	require.Equal(t, hashed.GetNonce(nil), sm.GetNonce())
+	require.True(t, sm.MatchesNonceAndContext(hashed))
+	require.True(t, sm.MatchesNonceAndContext(plain))
+	require.False(t, sm.MatchesNonceAndContext(other))
+	require.False(t, sm.MatchesNonceAndContext(NewSignatureRequest("I owe you nothing", attr)))
+
+	// A signature over the full message does not match the hashed request
+	sm, err = plain.SignatureFromMessage(&Disclosure{}, nil)
+	require.NoError(t, err)
+	require.True(t, sm.MatchesNonceAndContext(plain))
+	require.False(t, sm.MatchesNonceAndContext(hashed))
+
+	invalid := NewHashedSignatureRequest(hash, "", attr)
+	require.Error(t, invalid.Validate())
+	invalid = NewHashedSignatureRequest(hash, "IOU", attr)
+	invalid.Message = message
+	require.Error(t, invalid.Validate())
+	invalid = NewHashedSignatureRequest(&MessageHash{Algorithm: MessageHashSHA256}, "IOU", attr)
+	require.Error(t, invalid.Validate())
+	invalid = NewSignatureRequest(message, attr)
+	invalid.MessageDisplay = "IOU"
+	require.Error(t, invalid.Validate())
+
+	// The display message must be valid UTF-8, as it is encoded as an ASN.1 UTF8String
+	invalid = NewHashedSignatureRequest(hash, "IOU\xff", attr)
+	require.Error(t, invalid.Validate())
+	require.Nil(t, invalid.GetNonce(nil))
+	_, err = invalid.TimestampMessage()
+	require.Error(t, err)
+	sm, err = hashed.SignatureFromMessage(&Disclosure{}, nil)
+	require.NoError(t, err)
+	sm.MessageDisplay = "IOU\xff"
+	require.Nil(t, sm.GetNonce())
+	require.False(t, sm.MatchesNonceAndContext(hashed))
+}
+
+func TestStandaloneSignatureRequest(t *testing.T) {
+	attr := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	session := NewSignatureRequest("I owe you everything", attr)
+	session.Nonce = big.NewInt(42)
+	standalone := NewSignatureRequest("I owe you everything", attr)
+	standalone.Nonce = big.NewInt(42)
+	standalone.Mode = SignatureModeStandalone
+	require.NoError(t, standalone.Validate())
+
+	// The nonce of standalone requests is bound to the standalone context
+	require.NotEqual(t, session.GetNonce(nil), standalone.GetNonce(nil))
+
+	// The mode survives (un)marshaling and is recorded in the signature
+	bts, err := json.Marshal(standalone)
+	require.NoError(t, err)
+	parsed := &SignatureRequest{}
+	require.NoError(t, json.Unmarshal(bts, parsed))
+	require.Equal(t, SignatureModeStandalone, parsed.Mode)
+	require.Equal(t, standalone.GetNonce(nil), parsed.GetNonce(nil))
+	_, err = standalone.Legacy()
+	require.Error(t, err)
+
+	sm, err := standalone.SignatureFromMessage(&Disclosure{}, nil)
+	require.NoError(t, err)
+	require.Equal(t, SignatureModeStandalone, sm.Mode)
+	require.Equal(t, standalone.GetNonce(nil), sm.GetNonce())
+
+	// A standalone signature matches standalone requests regardless of their nonce, but not session requests
+	verifier := NewSignatureRequest("I owe you everything", attr)
+	verifier.Mode = SignatureModeStandalone
+	require.True(t, sm.MatchesNonceAndContext(standalone))
+	require.True(t, sm.MatchesNonceAndContext(verifier))
+	require.False(t, sm.MatchesNonceAndContext(session))
+	require.False(t, sm.MatchesNonceAndContext(NewSignatureRequest("I owe you nothing", attr)))
+
+	// and the other way around
+	sm, err = session.SignatureFromMessage(&Disclosure{}, nil)
+	require.NoError(t, err)
+	require.Equal(t, SignatureModeSession, sm.Mode)
+	require.True(t, sm.MatchesNonceAndContext(session))
+	require.False(t, sm.MatchesNonceAndContext(standalone))
+
+	invalid := NewSignatureRequest("I owe you everything", attr)
+	invalid.Mode = "offline"
+	require.Error(t, invalid.Validate())
+}
+
+func TestClockSkewTolerance(t *testing.T) {
+	conf, other := &Configuration{}, &Configuration{}
+	require.Equal(t, DefaultClockSkewTolerance, conf.ClockSkewTolerance())
+	require.Error(t, conf.SetClockSkewTolerance(MaxClockSkewTolerance+time.Second))
+	require.Error(t, conf.SetClockSkewTolerance(-time.Second))
+	require.Equal(t, DefaultClockSkewTolerance, conf.ClockSkewTolerance())
+
+	// The tolerance can be set to 0, without affecting other configurations
+	require.NoError(t, conf.SetClockSkewTolerance(0))
+	require.Equal(t, time.Duration(0), conf.ClockSkewTolerance())
+	require.Equal(t, DefaultClockSkewTolerance, other.ClockSkewTolerance())
+
+	jwt := &ServiceProviderJwt{ServerJwt: ServerJwt{Type: "verification_request"}}
+	jwt.IssuedAt = Timestamp(time.Now().Add(30 * time.Second))
+	require.NoError(t, jwt.Valid())
+	jwt.IssuedAt = Timestamp(time.Now().Add(90 * time.Second))
+	require.Error(t, jwt.Valid())
+	require.NoError(t, jwt.ValidWithTolerance(2*time.Minute))
+	require.Error(t, (&RevocationJwt{ServerJwt: jwt.ServerJwt}).ValidWithTolerance(0))
+}
+
+func TestParseKeyshareProofP(t *testing.T) {
+	conf := parseConfiguration(t)
+	scheme := NewSchemeManagerIdentifier("test")
+	bts, err := ioutil.ReadFile(filepath.Join("testdata", "jwtkeys", "kss-sk.pem"))
+	require.NoError(t, err)
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(bts)
+	require.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pubBts, err := ioutil.ReadFile(filepath.Join("testdata", "irma_configuration", "test", "kss-0.pem"))
+	require.NoError(t, err)
+
+	proofP := map[string]interface{}{"P": "Ag==", "c": "Aw==", "s_response": "BQ=="}
+	claims := func(modify func(jwt.MapClaims)) jwt.MapClaims {
+		c := jwt.MapClaims{"ProofP": proofP, "iat": time.Now().Unix(), "sub": "ProofP", "iss": "keyshare_server"}
+		if modify != nil {
+			modify(c)
+		}
+		return c
+	}
+	sign := func(method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = "0"
+		str, err := token.SignedString(key)
+		require.NoError(t, err)
+		return str
+	}
+
+	p, c, err := conf.ParseKeyshareProofP(scheme, sign(jwt.SigningMethodRS256, key, claims(nil)))
+	require.NoError(t, err)
+	require.Equal(t, &gabi.ProofP{P: big.NewInt(2), C: big.NewInt(3), SResponse: big.NewInt(5)}, p)
+	require.Equal(t, "keyshare_server", c.Issuer)
+
+	// Within the clock skew tolerance, JWTs from the future or from the past are accepted
+	_, _, err = conf.ParseKeyshareProofP(scheme, sign(jwt.SigningMethodRS256, key, claims(func(c jwt.MapClaims) {
+		c["iat"] = time.Now().Add(30 * time.Second).Unix()
+		c["exp"] = time.Now().Add(-30 * time.Second).Unix()
+	})))
+	require.NoError(t, err)
+
+	for name, token := range map[string]string{
+		"none":       sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, claims(nil)),
+		"hmac":       sign(jwt.SigningMethodHS256, pubBts, claims(nil)),
+		"rs512":      sign(jwt.SigningMethodRS512, key, claims(nil)),
+		"wrong key":  sign(jwt.SigningMethodRS256, otherKey, claims(nil)),
+		"malformed":  "not a jwt",
+		"subject":    sign(jwt.SigningMethodRS256, key, claims(func(c jwt.MapClaims) { c["sub"] = "auth_tok" })),
+		"no iat":     sign(jwt.SigningMethodRS256, key, claims(func(c jwt.MapClaims) { delete(c, "iat") })),
+		"future iat": sign(jwt.SigningMethodRS256, key, claims(func(c jwt.MapClaims) { c["iat"] = time.Now().Add(time.Hour).Unix() })),
+		"future nbf": sign(jwt.SigningMethodRS256, key, claims(func(c jwt.MapClaims) { c["nbf"] = time.Now().Add(time.Hour).Unix() })),
+		"expired":    sign(jwt.SigningMethodRS256, key, claims(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() })),
+		"no proofp":  sign(jwt.SigningMethodRS256, key, claims(func(c jwt.MapClaims) { delete(c, "ProofP") })),
+		"extra field": sign(jwt.SigningMethodRS256, key, claims(func(c jwt.MapClaims) {
+			c["ProofP"] = map[string]interface{}{"P": "Ag==", "c": "Aw==", "s_response": "BQ==", "extra": "Bw=="}
+		})),
+		"missing field": sign(jwt.SigningMethodRS256, key, claims(func(c jwt.MapClaims) {
+			c["ProofP"] = map[string]interface{}{"P": "Ag==", "c": "Aw=="}
+		})),
+	} {
+		_, _, err := conf.ParseKeyshareProofP(scheme, token)
+		require.Error(t, err, name)
+		serr, ok := err.(*SessionError)
+		require.True(t, ok, name)
+		require.Equal(t, ErrorKeyshareProof, serr.ErrorType, name)
+	}
+}
+
+func TestKeyshareRegistrationPolicy(t *testing.T) {
+	var scheme SchemeManager
+	require.NoError(t, xml.Unmarshal([]byte(`<SchemeManager version="7">
+		<KeyshareRegistration>
+			<Email>required</Email>
+			<MinimumPinLength>6</MinimumPinLength>
+			<TermsUrl>https://example.com/terms</TermsUrl>
+			<TermsVersion>2</TermsVersion>
+		</KeyshareRegistration>
+	</SchemeManager>`), &scheme))
+	policy := scheme.KeyshareRegistration
+	require.Equal(t, &KeyshareRegistrationPolicy{
+		Email:            KeyshareEmailRequired,
+		MinimumPinLength: 6,
+		TermsURL:         "https://example.com/terms",
+		TermsVersion:     "2",
+	}, policy)
+	require.NoError(t, policy.validate())
+
+	email, empty := "test@example.com", ""
+	require.NoError(t, policy.ValidateEnrollment(&email, "2"))
+	require.Error(t, policy.ValidateEnrollment(&email, "1"))
+	require.Error(t, policy.ValidateEnrollment(&empty, "2"))
+	require.Error(t, policy.ValidateEnrollment(nil, "2"))
+	require.NoError(t, policy.ValidatePin("123456"))
+	require.Error(t, policy.ValidatePin("12345"))
+
+	policy = &KeyshareRegistrationPolicy{Email: KeyshareEmailForbidden}
+	require.NoError(t, policy.ValidateEnrollment(nil, ""))
+	require.NoError(t, policy.ValidateEnrollment(&empty, ""))
+	require.Error(t, policy.ValidateEnrollment(&email, ""))
+
+	// Without policy, everything is allowed except for too short PINs
+	policy = nil
+	require.NoError(t, policy.ValidateEnrollment(&email, ""))
+	require.NoError(t, policy.ValidateEnrollment(nil, ""))
+	require.NoError(t, policy.ValidatePin("12345"))
+	require.Error(t, policy.ValidatePin("1234"))
+
+	require.Error(t, (&KeyshareRegistrationPolicy{Email: "sometimes"}).validate())
+	require.Error(t, (&KeyshareRegistrationPolicy{TermsVersion: "1"}).validate())
+	require.Error(t, (&KeyshareRegistrationPolicy{MinimumPinLength: -1}).validate())
+}
+
+func TestParseSunsetHeaders(t *testing.T) {
+	require.Nil(t, ParseSunsetHeaders(http.Header{}))
+
+	sunset := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	deprecation := time.Date(2029, 1, 1, 0, 0, 0, 0, time.UTC)
+	announcement := ParseSunsetHeaders(http.Header{
+		"Deprecation": []string{deprecation.Format(http.TimeFormat)},
+		"Sunset":      []string{sunset.Format(http.TimeFormat)},
+	})
+	require.True(t, announcement.Deprecated)
+	require.True(t, deprecation.Equal(*announcement.Deprecation))
+	require.True(t, sunset.Equal(*announcement.Sunset))
+
+	announcement = ParseSunsetHeaders(http.Header{"Deprecation": []string{"@1861920000"}})
+	require.True(t, announcement.Deprecated)
+	require.True(t, deprecation.Equal(*announcement.Deprecation))
+	require.Nil(t, announcement.Sunset)
+
+	announcement = ParseSunsetHeaders(http.Header{"Deprecation": []string{"true"}})
+	require.True(t, announcement.Deprecated)
+	require.Nil(t, announcement.Deprecation)
+
+	announcement = ParseSunsetHeaders(http.Header{"Sunset": []string{"not a date"}})
+	require.False(t, announcement.Deprecated)
+	require.Nil(t, announcement.Sunset)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	_, ok := ParseRetryAfter(http.Header{})
+	require.False(t, ok)
+	_, ok = ParseRetryAfter(http.Header{"Retry-After": []string{"soon"}})
+	require.False(t, ok)
+
+	delay, ok := ParseRetryAfter(http.Header{"Retry-After": []string{"120"}})
+	require.True(t, ok)
+	require.Equal(t, 2*time.Minute, delay)
+
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	delay, ok = ParseRetryAfter(http.Header{"Retry-After": []string{date}})
+	require.True(t, ok)
+	require.InDelta(t, time.Hour, delay, float64(2*time.Second))
+
+	date = time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	delay, ok = ParseRetryAfter(http.Header{"Retry-After": []string{date}})
+	require.True(t, ok)
+	require.Zero(t, delay)
+}
+
+func TestRetryAfter(t *testing.T) {
+	var mutex sync.Mutex
+	var requests, refusals, status int
+	var retryAfter string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != "42" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		requests++
+		if requests <= refusals {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(status)
+			return
+		}
+		_, _ = w.Write(body)
+	}))
+	defer s.Close()
+
+	reset := func(refuse int, refusal int, delay string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests, refusals, status, retryAfter = 0, refuse, refusal, delay
+	}
+	run := func(maxRetryAfter time.Duration, refuse int, refusal int, delay string) error {
+		reset(refuse, refusal, delay)
+		transport := NewHTTPTransport(s.URL, false)
+		transport.MaxRetryAfter = maxRetryAfter
+		var result string
+		return transport.Post("", &result, "42")
+	}
+
+	// Short delays are waited for before retrying
+	start := time.Now()
+	require.NoError(t, run(2*time.Second, 1, http.StatusTooManyRequests, "1"))
+	require.Equal(t, 2, requests)
+	require.True(t, time.Since(start) >= time.Second)
+	require.NoError(t, run(time.Second, 2, http.StatusServiceUnavailable, "0"))
+	require.Equal(t, 3, requests)
+
+	// A bounded amount of times
+	err := run(time.Second, 100, http.StatusTooManyRequests, "0")
+	require.Error(t, err)
+	require.Equal(t, 1+MaxRetryAfterAttempts, requests)
+	require.Equal(t, http.StatusTooManyRequests, err.(*SessionError).RemoteStatus)
+
+	// Long delays are not waited for, and exposed in the error
+	err = run(time.Second, 1, http.StatusTooManyRequests, "60")
+	require.Error(t, err)
+	require.Equal(t, 1, requests)
+	require.Equal(t, time.Minute, err.(*SessionError).RetryAfter)
+
+	// Neither are delays exceeding the deadline of the context of the transport
+	reset(1, http.StatusTooManyRequests, "1")
+	transport := NewHTTPTransport(s.URL, false)
+	transport.MaxRetryAfter = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	var result string
+	err = transport.WithContext(ctx).Post("", &result, "42")
+	require.Error(t, err)
+	require.Equal(t, 1, requests)
+	require.Equal(t, time.Second, err.(*SessionError).RetryAfter)
+
+	// Other statuses, and transports without MaxRetryAfter, are not retried
+	require.Error(t, run(time.Second, 1, http.StatusInternalServerError, "0"))
+	require.Equal(t, 1, requests)
+	require.Error(t, run(0, 1, http.StatusTooManyRequests, "1"))
+	require.Equal(t, 1, requests)
+}
+
 // Test attribute decoding with both old and new metadata versions
 func TestAttributeDecoding(t *testing.T) {
 	expected := "male"
@@ -444,8 +943,8 @@ func TestSessionRequests(t *testing.T) {
 
 		{
 			expected: &SignatureRequest{
-				DisclosureRequest{BaseRequest{LDContext: LDContextSignatureRequest}, base.Disclose, base.Labels},
-				sigMessage,
+				DisclosureRequest: DisclosureRequest{BaseRequest: BaseRequest{LDContext: LDContextSignatureRequest}, Disclose: base.Disclose, Labels: base.Labels},
+				Message:           sigMessage,
 			},
 			old: &SignatureRequest{},
 			oldJson: `{
@@ -499,7 +998,7 @@ func TestSessionRequests(t *testing.T) {
 
 		{
 			expected: &IssuanceRequest{
-				DisclosureRequest: DisclosureRequest{BaseRequest{LDContext: LDContextIssuanceRequest}, base.Disclose, base.Labels},
+				DisclosureRequest: DisclosureRequest{BaseRequest: BaseRequest{LDContext: LDContextIssuanceRequest}, Disclose: base.Disclose, Labels: base.Labels},
 				Credentials: []*CredentialRequest{
 					{
 						CredentialTypeID: NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"),
@@ -578,7 +1077,121 @@ func TestSessionRequests(t *testing.T) {
 
 		_, err := tst.expected.Legacy()
 		require.NoError(t, err)
+
+		bts, err := json.Marshal(tst.expected)
+		require.NoError(t, err)
+		roundtrip := reflect.New(reflect.TypeOf(tst.expected).Elem()).Interface().(SessionRequest)
+		require.NoError(t, json.Unmarshal(bts, roundtrip))
+		require.True(t, reflect.DeepEqual(roundtrip, tst.expected), "%s did not survive marshaling", reflect.TypeOf(tst.old).String())
+	}
+
+	// Requests without @context are marshaled including it, so that they don't unmarshal as legacy requests
+	sigreq := &SignatureRequest{DisclosureRequest: DisclosureRequest{Disclose: base.Disclose}, Message: sigMessage}
+	bts, err := json.Marshal(sigreq)
+	require.NoError(t, err)
+	parsed := &SignatureRequest{}
+	require.NoError(t, json.Unmarshal(bts, parsed))
+	require.Equal(t, LDContextSignatureRequest, parsed.LDContext)
+	require.False(t, parsed.legacy)
+	require.Equal(t, sigMessage, parsed.Message)
+	require.Empty(t, sigreq.LDContext)
+}
+
+func TestIssuanceRequestCheckDuplicates(t *testing.T) {
+	conf := parseConfiguration(t)
+	singleton := NewCredentialTypeIdentifier("irma-demo.MijnOverheid.singleton")
+	studentCard := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+
+	request := NewIssuanceRequest([]*CredentialRequest{
+		{CredentialTypeID: singleton},
+		{CredentialTypeID: studentCard},
+		{CredentialTypeID: studentCard},
+	})
+	require.NoError(t, request.CheckDuplicates(conf))
+
+	request.Credentials = append(request.Credentials, &CredentialRequest{CredentialTypeID: singleton})
+	err := request.CheckDuplicates(conf)
+	require.Error(t, err)
+	require.Equal(t, ErrorDuplicateCredential, err.(*SessionError).ErrorType)
+}
+
+func TestCredentialRequestDisclosedValues(t *testing.T) {
+	bsn := NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")
+	cr := &CredentialRequest{
+		CredentialTypeID:    NewCredentialTypeIdentifier("irma-demo.MijnOverheid.singleton"),
+		Attributes:          map[string]string{},
+		DisclosedAttributes: map[string]AttributeTypeIdentifier{"BSN": bsn},
+	}
+
+	resolved, err := cr.WithDisclosedValues(map[AttributeTypeIdentifier]string{bsn: "12345"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"BSN": "12345"}, resolved.Attributes)
+	require.Nil(t, resolved.DisclosedAttributes)
+	require.Empty(t, cr.Attributes)
+
+	_, err = cr.WithDisclosedValues(map[AttributeTypeIdentifier]string{})
+	require.Error(t, err)
+
+	// Values are taken literally, also if they look like placeholders
+	literal := &CredentialRequest{
+		CredentialTypeID: cr.CredentialTypeID,
+		Attributes:       map[string]string{"BSN": `{{ disclosed "irma-demo.MijnOverheid.root.BSN" }}`},
+	}
+	resolved, err = literal.WithDisclosedValues(map[AttributeTypeIdentifier]string{bsn: "12345"})
+	require.NoError(t, err)
+	require.Equal(t, literal.Attributes, resolved.Attributes)
+
+	// Copied attributes must be requested to be disclosed exactly once
+	require.NoError(t, NewIssuanceRequest([]*CredentialRequest{cr}, bsn).Validate())
+	require.Error(t, NewIssuanceRequest([]*CredentialRequest{cr}).Validate())
+	request := NewIssuanceRequest([]*CredentialRequest{cr}, bsn, bsn)
+	require.Error(t, request.Validate())
+	request = NewIssuanceRequest([]*CredentialRequest{cr}, bsn)
+	request.AllInstances = []int{0}
+	require.Error(t, request.Validate())
+
+	// Copied attributes must exist, and must not also have a value
+	conf := parseConfiguration(t)
+	require.NoError(t, cr.Validate(conf))
+	cr.Attributes["BSN"] = "12345"
+	require.Error(t, cr.Validate(conf))
+	cr.DisclosedAttributes = map[string]AttributeTypeIdentifier{"nonexistent": bsn}
+	require.Error(t, cr.Validate(conf))
+}
+
+func TestCredentialRequestValidateAttributeValues(t *testing.T) {
+	validate := func(value string) error {
+		cr := &CredentialRequest{
+			CredentialTypeID: NewCredentialTypeIdentifier("irma-demo.RU.studentCard"),
+			Attributes:       map[string]string{"university": "Radboud", "studentID": value},
+		}
+		return cr.ValidateAttributeValues()
+	}
+	requireInvalid := func(value, message string) {
+		err := validate(value)
+		require.Error(t, err)
+		require.Equal(t, ErrorInvalidAttributeValue, err.(*SessionError).ErrorType)
+		require.Contains(t, err.Error(), "irma-demo.RU.studentCard.studentID")
+		require.Contains(t, err.Error(), message)
 	}
+
+	require.NoError(t, validate(""))
+	require.NoError(t, validate(strings.Repeat("é", 300))) // hashed into the message space
+	requireInvalid("Straatweg 1\nNijmegen", "control character U+000A")
+	requireInvalid("\xff", "not valid UTF-8")
+
+	// Attributes copying a disclosed attribute are validated once filled in
+	cr := &CredentialRequest{
+		CredentialTypeID:    NewCredentialTypeIdentifier("irma-demo.RU.studentCard"),
+		Attributes:          map[string]string{"university": "Radboud"},
+		DisclosedAttributes: map[string]AttributeTypeIdentifier{"studentID": NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")},
+	}
+	require.NoError(t, cr.ValidateAttributeValues())
+	resolved, err := cr.WithDisclosedValues(map[AttributeTypeIdentifier]string{
+		NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN"): "12345\n",
+	})
+	require.NoError(t, err)
+	require.Error(t, resolved.ValidateAttributeValues())
 }
 
 func trivialTranslation(str string) TranslatedString {
@@ -635,6 +1248,113 @@ func TestConDisconSingletons(t *testing.T) {
 	}
 }
 
+func TestPossessionRequestValidation(t *testing.T) {
+	value := "456"
+	require.NoError(t, AttributeCon{NewAttributeRequest("irma-demo.RU.studentCard")}.Validate())
+	require.NoError(t, AttributeCon{
+		NewAttributeRequest("irma-demo.RU.studentCard"),
+		{Type: NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"), Value: &value},
+	}.Validate())
+
+	// Possession proofs disclose no attribute value, so they cannot require one
+	require.Error(t, AttributeCon{{Type: NewAttributeTypeIdentifier("irma-demo.RU.studentCard"), Value: &value}}.Validate())
+	require.Error(t, AttributeCon{{Type: NewAttributeTypeIdentifier("irma-demo.RU.studentCard"), NotNull: true}}.Validate())
+}
+
+func TestParseIdentifiers(t *testing.T) {
+	valid := []string{"irma-demo", "irma-demo.RU", "irma-demo.RU.studentCard", "irma-demo.RU.studentCard.student_ID"}
+	parsers := []func(string) (fmt.Stringer, error){
+		func(s string) (fmt.Stringer, error) { return ParseSchemeManagerIdentifier(s) },
+		func(s string) (fmt.Stringer, error) { return ParseIssuerIdentifier(s) },
+		func(s string) (fmt.Stringer, error) { return ParseCredentialTypeIdentifier(s) },
+		func(s string) (fmt.Stringer, error) { return ParseAttributeTypeIdentifier(s) },
+	}
+	for i, parse := range parsers {
+		for j, id := range valid {
+			parsed, err := parse(id)
+			// Attribute type identifiers may also refer to a credential type
+			if i == j || (i == 3 && j == 2) {
+				require.NoError(t, err, id)
+				require.Equal(t, id, parsed.String())
+			} else {
+				require.Error(t, err, id)
+			}
+		}
+	}
+
+	for _, id := range []string{"", ".", "irma-demo..studentCard.studentID", "irma-demo.RU.studentCard.", "irma-demo.RU.student Card.studentID", "irma-demo.RU.studentCärd.studentID"} {
+		_, err := ParseAttributeTypeIdentifier(id)
+		require.Error(t, err, id)
+	}
+
+	require.Equal(t, NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"), MustParseAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	require.Panics(t, func() { MustParseCredentialTypeIdentifier("irma-demo.RU") })
+
+	// Requests containing invalid identifiers are rejected with an error
+	require.Error(t, AttributeCon{NewAttributeRequest("irma-demo.RU")}.Validate())
+	request := NewIssuanceRequest([]*CredentialRequest{{
+		CredentialTypeID: NewCredentialTypeIdentifier("irma-demo.RU.studentCard"),
+		Attributes:       map[string]string{"student.ID": "456"},
+	}})
+	require.Error(t, request.Validate())
+	require.Error(t, AttributeConDisCon{{{NewAttributeRequest("irma-demo.RU.unknown.studentID")}}}.Validate(parseConfiguration(t)))
+	require.Error(t, (&RevocationRequest{LDContext: LDContextRevocationRequest, CredentialType: NewCredentialTypeIdentifier("irma-demo.RU")}).Validate())
+	require.NoError(t, (&RevocationRequest{LDContext: LDContextRevocationRequest, CredentialType: NewCredentialTypeIdentifier("irma-demo.RU.studentCard")}).Validate())
+}
+
+// Check that parsing and validating arbitrary identifiers returns errors instead of panicking.
+func TestParseIdentifiersArbitraryInput(t *testing.T) {
+	conf := parseConfiguration(t)
+	alphabet := []byte("irmaRU09_-...... /\x00\xff")
+	bts := make([]byte, 32)
+	for i := 0; i < 5000; i++ {
+		_, err := rand.Read(bts)
+		require.NoError(t, err)
+		id := make([]byte, int(bts[0])%len(bts))
+		for j := range id {
+			id[j] = alphabet[int(bts[j])%len(alphabet)]
+		}
+		if i%10 == 0 { // also try raw bytes, including invalid UTF-8
+			id = bts[:int(bts[0])%len(bts)]
+		}
+		s := string(id)
+
+		require.NotPanics(t, func() {
+			_, _ = ParseSchemeManagerIdentifier(s)
+			_, _ = ParseIssuerIdentifier(s)
+			_, _ = ParseCredentialTypeIdentifier(s)
+			if attr, err := ParseAttributeTypeIdentifier(s); err == nil {
+				require.Equal(t, s, attr.String())
+				require.Contains(t, []int{2, 3}, attr.PartsCount())
+			}
+
+			disjunction := AttributeConDisCon{{{NewAttributeRequest(s)}}}
+			if NewDisclosureRequest(NewAttributeTypeIdentifier(s)).Validate() == nil {
+				_ = disjunction.Validate(conf)
+			}
+			_ = NewIssuanceRequest([]*CredentialRequest{{
+				CredentialTypeID: NewCredentialTypeIdentifier(s),
+				Attributes:       map[string]string{s: s},
+			}}).Validate()
+			_ = (&DisclosureChoice{Attributes: [][]*AttributeIdentifier{{{Type: NewAttributeTypeIdentifier(s), CredentialHash: s}}}}).Validate()
+
+			// Requests containing the identifier are unmarshaled and validated
+			js, err := json.Marshal(s)
+			require.NoError(t, err)
+			dr := &DisclosureRequest{}
+			err = json.Unmarshal([]byte(fmt.Sprintf(`{"@context":%q,"disclose":[[[%s]]],"labels":{"0":{"en":%s}}}`, LDContextDisclosureRequest, js, js)), dr)
+			if err == nil {
+				_ = dr.Validate()
+			}
+			ir := &IssuanceRequest{}
+			err = json.Unmarshal([]byte(fmt.Sprintf(`{"@context":%q,"credentials":[{"credential":%s,"attributes":{%s:%s}}],"disclose":[[[{"type":%s,"value":%s}]]]}`, LDContextIssuanceRequest, js, js, js, js, js)), ir)
+			if err == nil {
+				_ = ir.Validate()
+			}
+		}, "%q", s)
+	}
+}
+
 func parseDisclosure(t *testing.T) (*Configuration, *DisclosureRequest, *Disclosure) {
 	conf := parseConfiguration(t)
 
@@ -816,6 +1536,55 @@ func TestPrivateKeyRings(t *testing.T) {
 	require.NoError(t, err)
 }
 
+type testPrivateKeyStore map[string][]byte
+
+func (s testPrivateKeyStore) PrivateKey(id IssuerIdentifier, counter uint) ([]byte, error) {
+	bts, ok := s[fmt.Sprintf("%s.%d", id.String(), counter)]
+	if !ok {
+		return nil, ErrMissingPrivateKey
+	}
+	// Return a copy, as the ring zeroes the bytes after parsing
+	return append([]byte{}, bts...), nil
+}
+
+func TestPrivateKeyRingStore(t *testing.T) {
+	conf := parseConfiguration(t)
+	ru := NewIssuerIdentifier("irma-demo.RU")
+	tst := NewIssuerIdentifier("test.test")
+	mo := NewIssuerIdentifier("irma-demo.MijnOverheid")
+
+	path := filepath.Join(test.FindTestdataFolder(t), "privatekeys")
+	rukey, err := ioutil.ReadFile(filepath.Join(path, "irma-demo.RU.2.xml"))
+	require.NoError(t, err)
+	tstkey, err := ioutil.ReadFile(filepath.Join(path, "test.test.xml"))
+	require.NoError(t, err)
+	store := testPrivateKeyStore{"irma-demo.RU.2": rukey, "test.test.3": tstkey}
+
+	ring, err := NewPrivateKeyRingStore(store, []IssuerIdentifier{ru, tst}, conf)
+	require.NoError(t, err)
+	sk, err := ring.Get(ru, 2)
+	require.NoError(t, err)
+	require.Equal(t, uint(2), sk.Counter)
+	sk, err = ring.Latest(tst)
+	require.NoError(t, err)
+	require.Equal(t, uint(3), sk.Counter)
+	_, err = ring.Get(ru, 1)
+	require.Equal(t, ErrMissingPrivateKey, err)
+	_, err = ring.Latest(mo)
+	require.Equal(t, ErrMissingPrivateKey, err)
+	require.NoError(t, validatePrivateKeyRing(ring, conf))
+
+	// Each issuer must have a key in the store
+	_, err = NewPrivateKeyRingStore(store, []IssuerIdentifier{ru, mo}, conf)
+	require.Error(t, err)
+	_, err = NewPrivateKeyRingStore(store, []IssuerIdentifier{NewIssuerIdentifier("irma-demo.nonexisting")}, conf)
+	require.Error(t, err)
+
+	// A key with the wrong counter or not belonging to the public key is rejected
+	_, err = NewPrivateKeyRingStore(testPrivateKeyStore{"irma-demo.RU.2": tstkey}, []IssuerIdentifier{ru}, conf)
+	require.Error(t, err)
+}
+
 // Helper functions for wizard tests below
 func credid(s string) CredentialTypeIdentifier {
 	return NewCredentialTypeIdentifier(s)
@@ -1450,3 +2219,242 @@ func TestSchemeLanguageValidation(t *testing.T) {
 	require.Empty(t, testScheme.Description.validate(langs))
 	require.Equal(t, langs, conf.CredentialTypes[NewCredentialTypeIdentifier("test.test.email")].IssueURL.validate(langs))
 }
+
+func TestKeyshareMessageEncryption(t *testing.T) {
+	privateKey := make([]byte, curve25519.ScalarSize)
+	_, err := rand.Read(privateKey)
+	require.NoError(t, err)
+	pinKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	require.NoError(t, err)
+
+	body := []byte(`{"id":"username","pin":"pin"}`)
+	msg, err := EncryptKeyshareMessage(pinKey, "users/verify/pin", body)
+	require.NoError(t, err)
+	decrypted, err := msg.Decrypt(privateKey, "users/verify/pin", 0)
+	require.NoError(t, err)
+	require.Equal(t, body, decrypted)
+
+	// The message is bound to the endpoint and to the private key
+	_, err = msg.Decrypt(privateKey, "users/change/pin", 0)
+	require.Error(t, err)
+	otherKey := make([]byte, curve25519.ScalarSize)
+	_, err = rand.Read(otherKey)
+	require.NoError(t, err)
+	_, err = msg.Decrypt(otherKey, "users/verify/pin", 0)
+	require.Error(t, err)
+
+	msg.Ciphertext[0] ^= 1
+	_, err = msg.Decrypt(privateKey, "users/verify/pin", 0)
+	require.Error(t, err)
+	msg.Ciphertext[0] ^= 1
+
+	// The timestamp is authenticated
+	msg.Timestamp++
+	_, err = msg.Decrypt(privateKey, "users/verify/pin", time.Minute)
+	require.Error(t, err)
+
+	// Expired messages and messages from the future are refused, allowing for clock skew
+	msg, err = encryptKeyshareMessage(pinKey, "users/verify/pin", body, time.Now().Add(-KeyshareMessageLifetime-time.Minute))
+	require.NoError(t, err)
+	_, err = msg.Decrypt(privateKey, "users/verify/pin", 0)
+	require.Error(t, err)
+	_, err = msg.Decrypt(privateKey, "users/verify/pin", 2*time.Minute)
+	require.NoError(t, err)
+	msg, err = encryptKeyshareMessage(pinKey, "users/verify/pin", body, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	_, err = msg.Decrypt(privateKey, "users/verify/pin", 0)
+	require.Error(t, err)
+	_, err = msg.Decrypt(privateKey, "users/verify/pin", 2*time.Minute)
+	require.NoError(t, err)
+}
+
+func TestBigIntJSON(t *testing.T) {
+	i := s2big("123456789012345678901234567890")
+
+	// The canonical encoding is that of gabi
+	old, err := json.Marshal(i)
+	require.NoError(t, err)
+	bts, err := json.Marshal(NewBigInt(i))
+	require.NoError(t, err)
+	require.Equal(t, string(old), string(bts))
+
+	var parsed BigInt
+	require.NoError(t, json.Unmarshal(old, &parsed))
+	require.Zero(t, i.Cmp(parsed.Int()))
+
+	// Legacy encoding as a base 10 JSON number, e.g. by math/big
+	old, err = json.Marshal(i.Go())
+	require.NoError(t, err)
+	require.Equal(t, "123456789012345678901234567890", string(old))
+	parsed = BigInt{}
+	require.NoError(t, json.Unmarshal(old, &parsed))
+	require.Zero(t, i.Cmp(parsed.Int()))
+
+	for _, invalid := range []string{`-12`, `1.5`, `"not base64"`, `true`} {
+		require.Error(t, json.Unmarshal([]byte(invalid), &parsed), invalid)
+	}
+	_, err = json.Marshal(NewBigInt(big.NewInt(-1)))
+	require.Error(t, err)
+}
+
+func TestProofPCommitmentMapJSON(t *testing.T) {
+	pki := PublicKeyIdentifier{Issuer: NewIssuerIdentifier("irma-demo.RU"), Counter: 2}
+	commitments := &ProofPCommitmentMap{Commitments: map[PublicKeyIdentifier]*gabi.ProofPCommitment{
+		pki: {P: big.NewInt(12345), Pcommit: big.NewInt(67890)},
+	}}
+
+	// Encoding of previous versions, directly marshaling the gabi.ProofPCommitment
+	old, err := json.Marshal(struct {
+		Commitments map[string]*gabi.ProofPCommitment `json:"c"`
+	}{map[string]*gabi.ProofPCommitment{"irma-demo.RU-2": commitments.Commitments[pki]}})
+	require.NoError(t, err)
+	bts, err := json.Marshal(commitments)
+	require.NoError(t, err)
+	require.JSONEq(t, string(old), string(bts))
+
+	var parsed ProofPCommitmentMap
+	require.NoError(t, json.Unmarshal(old, &parsed))
+	require.Equal(t, commitments, &parsed)
+
+	// With integers encoded in base 10
+	parsed = ProofPCommitmentMap{}
+	require.NoError(t, json.Unmarshal([]byte(`{"c":{"irma-demo.RU-2":{"P":12345,"Pcommit":67890}}}`), &parsed))
+	require.Equal(t, commitments, &parsed)
+
+	require.Error(t, json.Unmarshal([]byte(`{"c":{"irma-demo.RU-2":{"P":12345}}}`), &parsed))
+}
+
+func TestOrderedProofPCommitmentMapJSON(t *testing.T) {
+	commitments := &ProofPCommitmentMap{Commitments: map[PublicKeyIdentifier]*gabi.ProofPCommitment{}}
+	for i, key := range []string{"test.test-3", "irma-demo.RU-10", "irma-demo.RU-2", "irma-demo.MijnOverheid-2"} {
+		var pki PublicKeyIdentifier
+		require.NoError(t, pki.UnmarshalText([]byte(key)))
+		commitments.Commitments[pki] = &gabi.ProofPCommitment{P: big.NewInt(int64(1000 + i)), Pcommit: big.NewInt(int64(2000 + i))}
+	}
+
+	// The encoding is byte-stable, and sorted by issuer and (numerically) by counter
+	golden, err := ioutil.ReadFile(filepath.Join("testdata", "proofpcommitmentmap_ordered.json"))
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		bts, err := json.Marshal((*OrderedProofPCommitmentMap)(commitments))
+		require.NoError(t, err)
+		require.Equal(t, strings.TrimSpace(string(golden)), string(bts))
+	}
+
+	// Both encodings are parsed
+	var parsed ProofPCommitmentMap
+	require.NoError(t, json.Unmarshal(golden, &parsed))
+	require.Equal(t, commitments, &parsed)
+	bts, err := json.Marshal(commitments)
+	require.NoError(t, err)
+	parsed = ProofPCommitmentMap{}
+	require.NoError(t, json.Unmarshal(bts, &parsed))
+	require.Equal(t, commitments, &parsed)
+
+	require.Error(t, json.Unmarshal([]byte(`{"c":[{"key":"irma-demo.RU-2","commitment":{"P":"MDk="}}]}`), &parsed))
+	require.Error(t, json.Unmarshal([]byte(`{"c":[{"key":"irma-demo.RU","commitment":{"P":"MDk=","Pcommit":"MDk="}}]}`), &parsed))
+}
+
+func TestUpdateListeners(t *testing.T) {
+	conf := parseConfiguration(t)
+
+	// Synchronous listeners run in order, even if one of them panics
+	var order []int
+	removeFirst := conf.AddUpdateListener(func(*Configuration) { order = append(order, 1) }, true)
+	conf.AddUpdateListener(func(*Configuration) { panic("listener failed") }, true)
+	conf.AddUpdateListener(func(*Configuration) { order = append(order, 2) }, true)
+	conf.CallListeners()
+	require.Equal(t, []int{1, 2}, order)
+
+	removeFirst()
+	conf.CallListeners()
+	require.Equal(t, []int{1, 2, 2}, order)
+
+	// Asynchronous listeners don't block the updater, and run once more for all updates
+	// that happen while they run
+	var calls int32
+	started, unblock, done := make(chan struct{}), make(chan struct{}), make(chan struct{}, 10)
+	removeAsync := conf.AddUpdateListener(func(*Configuration) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+			<-unblock
+		}
+		done <- struct{}{}
+	}, false)
+	conf.CallListeners()
+	<-started
+	conf.CallListeners()
+	conf.CallListeners()
+	close(unblock)
+	<-done
+	<-done
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// Removed listeners are no longer run
+	removeAsync()
+	conf.CallListeners()
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestDescribeRequest(t *testing.T) {
+	conf := parseConfiguration(t)
+
+	value := "s1234567"
+	request := NewDisclosureRequest()
+	request.Disclose = AttributeConDisCon{
+		AttributeDisCon{
+			AttributeCon{{Type: NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"), Value: &value}},
+			AttributeCon{
+				NewAttributeRequest("irma-demo.MijnOverheid.fullName.familyname"),
+				NewAttributeRequest("irma-demo.RU.nonexisting.attribute"),
+			},
+		},
+		AttributeDisCon{
+			AttributeCon{NewAttributeRequest("irma-demo.MijnOverheid.fullName")},
+			AttributeCon{},
+		},
+	}
+	request.Labels = map[int]TranslatedString{1: {"en": "Your name", "nl": "Uw naam"}}
+
+	description := conf.DescribeRequest(request, "nl")
+	require.Len(t, description.Disjunctions, 2)
+
+	first := description.Disjunctions[0]
+	require.False(t, first.Optional)
+	require.Empty(t, first.Label)
+	require.Len(t, first.Options, 2)
+	require.Equal(t, &AttributeDescription{
+		Type:       NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+		Value:      &value,
+		Name:       "Studentnummer",
+		Credential: "Demo Studentenkaart",
+		Issuer:     "Demo Radboud Universiteit Nijmegen",
+		IssueURL:   "https://example.com",
+	}, first.Options[0][0])
+	require.Len(t, first.Options[1], 2)
+	require.Equal(t, "Achternaam", first.Options[1][0].Name)
+	require.Empty(t, first.Options[1][0].IssueURL)
+
+	// Unknown attributes are reported
+	require.Equal(t, &AttributeDescription{
+		Type:    NewAttributeTypeIdentifier("irma-demo.RU.nonexisting.attribute"),
+		Unknown: true,
+	}, first.Options[1][1])
+
+	// Requested credentials are possession proofs, having no attribute name
+	second := description.Disjunctions[1]
+	require.True(t, second.Optional)
+	require.Equal(t, "Uw naam", second.Label)
+	require.Len(t, second.Options, 1)
+	require.True(t, second.Options[0][0].Possession)
+	require.False(t, first.Options[0][0].Possession)
+	require.Empty(t, second.Options[0][0].Name)
+	require.Equal(t, "Demo Naam", second.Options[0][0].Credential)
+
+	// Unavailable languages fall back to English
+	description = conf.DescribeRequest(request, "fr")
+	require.Equal(t, "Student number", description.Disjunctions[0].Options[0][0].Name)
+	require.Equal(t, "Your name", description.Disjunctions[1].Label)
+}
@@ -4,6 +4,7 @@ import (
 	goerrors "errors"
 	"fmt"
 	"io/ioutil"
+	gobig "math/big"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -44,6 +45,20 @@ type (
 		conf *Configuration
 	}
 
+	// PrivateKeyStore provides access to private keys kept in an external key store, such as a KMS.
+	PrivateKeyStore interface {
+		// PrivateKey returns the XML-encoded private key with the specified counter of the specified
+		// issuer, or an error wrapping os.ErrNotExist if the store does not contain it.
+		PrivateKey(id IssuerIdentifier, counter uint) ([]byte, error)
+	}
+
+	// PrivateKeyRingStore contains the private keys of a set of issuers, fetched from a
+	// PrivateKeyStore when the ring is created. Where the OS supports it, the keys are kept in
+	// locked memory so that they are never swapped to disk.
+	PrivateKeyRingStore struct {
+		keys map[IssuerIdentifier]map[uint]*gabikeys.PrivateKey
+	}
+
 	// privateKeyRingMerge is a merge of multiple key rings into one, provides access to the
 	// private keys of all of them.
 	privateKeyRingMerge struct {
@@ -178,6 +193,100 @@ func (p *PrivateKeyRingFolder) Iterate(id IssuerIdentifier, f func(sk *gabikeys.
 	return nil
 }
 
+// NewPrivateKeyRingStore fetches all private keys of the specified issuers from the store, for
+// each public key of the issuer in the configuration. It returns an error if for any of the
+// issuers no private key could be fetched.
+func NewPrivateKeyRingStore(store PrivateKeyStore, issuers []IssuerIdentifier, conf *Configuration) (*PrivateKeyRingStore, error) {
+	ring := &PrivateKeyRingStore{keys: map[IssuerIdentifier]map[uint]*gabikeys.PrivateKey{}}
+	for _, id := range issuers {
+		if _, ok := conf.Issuers[id]; !ok {
+			return nil, errors.Errorf("cannot fetch private keys of unknown issuer %s", id.String())
+		}
+		counters, err := conf.PublicKeyIndices(id)
+		if err != nil {
+			return nil, err
+		}
+		ring.keys[id] = map[uint]*gabikeys.PrivateKey{}
+		for _, counter := range counters {
+			sk, err := ring.fetch(store, id, counter, conf)
+			if goerrors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, errors.WrapPrefix(err, fmt.Sprintf("failed to fetch private key %d of issuer %s", counter, id.String()), 0)
+			}
+			ring.keys[id][counter] = sk
+		}
+		if len(ring.keys[id]) == 0 {
+			return nil, errors.Errorf("no private key of issuer %s found in key store", id.String())
+		}
+	}
+	return ring, nil
+}
+
+func (p *PrivateKeyRingStore) fetch(store PrivateKeyStore, id IssuerIdentifier, counter uint, conf *Configuration) (*gabikeys.PrivateKey, error) {
+	bts, err := store.PrivateKey(id, counter)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for i := range bts {
+			bts[i] = 0
+		}
+	}()
+	sk, err := gabikeys.NewPrivateKeyFromXML(string(bts), conf.SchemeManagers[id.SchemeManagerIdentifier()].Demo)
+	if err != nil {
+		return nil, err
+	}
+	if sk.Counter != counter {
+		return nil, errors.Errorf("private key has wrong counter %d", sk.Counter)
+	}
+	if err = validatePrivateKey(id, sk, conf); err != nil {
+		return nil, err
+	}
+	if err = common.LockMemory(privateKeyInts(sk)...); err != nil {
+		Logger.WithField("error", err).Warnf("Failed to lock private key %d of issuer %s in memory", counter, id.String())
+	}
+	return sk, nil
+}
+
+func privateKeyInts(sk *gabikeys.PrivateKey) []*gobig.Int {
+	ints := []*gobig.Int{sk.P.Go(), sk.Q.Go(), sk.PPrime.Go(), sk.QPrime.Go(), sk.Order.Go()}
+	if sk.ECDSA != nil {
+		ints = append(ints, sk.ECDSA.D)
+	}
+	return ints
+}
+
+func (p *PrivateKeyRingStore) Get(id IssuerIdentifier, counter uint) (*gabikeys.PrivateKey, error) {
+	if sk := p.keys[id][counter]; sk != nil {
+		return sk, nil
+	}
+	return nil, ErrMissingPrivateKey
+}
+
+func (p *PrivateKeyRingStore) Latest(id IssuerIdentifier) (*gabikeys.PrivateKey, error) {
+	var sk *gabikeys.PrivateKey
+	for _, s := range p.keys[id] {
+		if sk == nil || s.Counter > sk.Counter {
+			sk = s
+		}
+	}
+	if sk == nil {
+		return nil, ErrMissingPrivateKey
+	}
+	return sk, nil
+}
+
+func (p *PrivateKeyRingStore) Iterate(id IssuerIdentifier, f func(sk *gabikeys.PrivateKey) error) error {
+	for _, sk := range p.keys[id] {
+		if err := f(sk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func newPrivateKeyRingScheme(conf *Configuration) (*privateKeyRingScheme, error) {
 	ring := &privateKeyRingScheme{conf}
 	if err := validatePrivateKeyRing(ring, conf); err != nil {
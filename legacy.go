@@ -199,6 +199,12 @@ func (dr *DisclosureRequest) UnmarshalJSON(bts []byte) (err error) {
 }
 
 func (sr *SignatureRequest) Legacy() (SessionRequest, error) {
+	if sr.MessageHash != nil {
+		return nil, errors.New("signature requests over a message hash cannot be converted to legacy format")
+	}
+	if sr.Mode == SignatureModeStandalone {
+		return nil, errors.New("standalone signature requests cannot be converted to legacy format")
+	}
 	disjunctions, err := convertConDisCon(sr.Disclose, sr.Labels)
 	if err != nil {
 		return nil, err
@@ -226,9 +232,14 @@ func (sr *SignatureRequest) UnmarshalJSON(bts []byte) (err error) {
 	if ldContext != "" {
 		var req struct { // Identical type with default JSON unmarshaler
 			BaseRequest
-			Disclose AttributeConDisCon       `json:"disclose"`
-			Labels   map[int]TranslatedString `json:"labels"`
-			Message  string                   `json:"message"`
+			Disclose       AttributeConDisCon       `json:"disclose"`
+			Labels         map[int]TranslatedString `json:"labels"`
+			AllInstances   []int                    `json:"allInstances"`
+			MaxInstances   int                      `json:"maxInstances"`
+			Message        string                   `json:"message"`
+			MessageHash    *MessageHash             `json:"messageHash"`
+			MessageDisplay string                   `json:"messageDisplay"`
+			Mode           SignatureMode            `json:"mode"`
 		}
 		if err = json.Unmarshal(bts, &req); err != nil {
 			return err
@@ -238,8 +249,13 @@ func (sr *SignatureRequest) UnmarshalJSON(bts []byte) (err error) {
 				req.BaseRequest,
 				req.Disclose,
 				req.Labels,
+				req.AllInstances,
+				req.MaxInstances,
 			},
 			req.Message,
+			req.MessageHash,
+			req.MessageDisplay,
+			req.Mode,
 		}
 		return nil
 	}
@@ -283,16 +299,20 @@ func (ir *IssuanceRequest) UnmarshalJSON(bts []byte) (err error) {
 	if ldContext != "" {
 		var req struct { // Identical type with default JSON unmarshaler
 			BaseRequest
-			Disclose    AttributeConDisCon       `json:"disclose"`
-			Labels      map[int]TranslatedString `json:"labels"`
-			Credentials []*CredentialRequest     `json:"credentials"`
+			Disclose       AttributeConDisCon       `json:"disclose"`
+			Labels         map[int]TranslatedString `json:"labels"`
+			AllInstances   []int                    `json:"allInstances"`
+			MaxInstances   int                      `json:"maxInstances"`
+			Credentials    []*CredentialRequest     `json:"credentials"`
+			StrictIssuance bool                     `json:"strictIssuance"`
 		}
 		if err = json.Unmarshal(bts, &req); err != nil {
 			return err
 		}
 		*ir = IssuanceRequest{
-			DisclosureRequest: DisclosureRequest{req.BaseRequest, req.Disclose, req.Labels},
+			DisclosureRequest: DisclosureRequest{req.BaseRequest, req.Disclose, req.Labels, req.AllInstances, req.MaxInstances},
 			Credentials:       req.Credentials,
+			StrictIssuance:    req.StrictIssuance,
 		}
 		return nil
 	}
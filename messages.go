@@ -2,12 +2,15 @@ package irma
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"github.com/privacybydesign/irmago/internal/common"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"fmt"
 
@@ -15,6 +18,7 @@ import (
 	"github.com/go-errors/errors"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
 )
 
 // ClientStatus encodes the client status of an IRMA session (e.g., connected).
@@ -108,6 +112,11 @@ type SessionError struct {
 	Info         string
 	RemoteError  *RemoteError
 	RemoteStatus int
+	// Delay after which the server asked the request to be retried, if it refused the request with
+	// 429 Too Many Requests or 503 Service Unavailable and a Retry-After header
+	RetryAfter time.Duration
+	// URL of the session at the IRMA server, if the error occurred in a session with a server
+	ServerURL string
 }
 
 // RemoteError is an error message returned by the API server on errors.
@@ -249,6 +258,10 @@ const (
 	ErrorKeyshare = ErrorType("keyshare")
 	// The user is not enrolled at one of the keyshare servers needed for the request
 	ErrorKeyshareUnenrolled = ErrorType("keyshareUnenrolled")
+	// The keyshare protocol did not complete within its time budget; Info contains the step that timed out
+	ErrorKeyshareTimeout = ErrorType("keyshareTimeout")
+	// The keyshare server sent a ProofP JWT that could not be verified or is malformed
+	ErrorKeyshareProof = ErrorType("keyshareProof")
 	// API server error
 	ErrorApi = ErrorType("api")
 	// Server returned unexpected or malformed response
@@ -269,6 +282,10 @@ const (
 	ErrorPanic = ErrorType("panic")
 	// Error involving random blind attributes
 	ErrorRandomBlind = ErrorType("randomblind")
+	// Issuance request contains multiple instances of a singleton credential type
+	ErrorDuplicateCredential = ErrorType("duplicateCredential")
+	// Attribute value in issuance request is not valid UTF-8 or contains control characters
+	ErrorInvalidAttributeValue = ErrorType("invalidAttributeValue")
 )
 
 type Disclosure struct {
@@ -298,15 +315,87 @@ type IssueCommitmentMessage struct {
 //
 
 type KeyshareEnrollment struct {
-	Pin      string  `json:"pin"`
-	Email    *string `json:"email"`
-	Language string  `json:"language"`
+	Pin                  string  `json:"pin"`
+	Email                *string `json:"email"`
+	Language             string  `json:"language"`
+	AcceptedTermsVersion string  `json:"acceptedTermsVersion,omitempty"`
+	IDToken              string  `json:"idToken,omitempty"`
+	// If set, the existing account to which the recovery token belongs is re-enrolled to this device
+	// instead of creating a new account (see KeyshareRecoveryToken)
+	RecoveryToken string `json:"recoveryToken,omitempty"`
+	// Platform attestation token obtained by the app, and the platform whose attestation service
+	// issued it (e.g. "android" or "ios"). Both are opaque to irmaclient.
+	AttestationToken    string `json:"attestationToken,omitempty"`
+	AttestationPlatform string `json:"attestationPlatform,omitempty"`
+}
+
+// KeyshareRecovery binds a keyshare account to a new device, after the user has authenticated
+// at the OpenID Connect provider to which the account is bound.
+type KeyshareRecovery struct {
+	IDToken  string `json:"idToken"`
+	Pin      string `json:"pin"`
+	Language string `json:"language"`
+}
+
+// KeyshareDeviceEnrollment enrolls an additional device to an existing keyshare account, using an
+// enrollment code obtained by one of the devices already enrolled to the account.
+type KeyshareDeviceEnrollment struct {
+	Username string `json:"id"`
+	Code     string `json:"code"`
+	Pin      string `json:"pin"`
+	Name     string `json:"name,omitempty"`
+}
+
+// KeyshareDeviceRegistration is returned by the keyshare server when enrolling an additional device,
+// containing the ID of the device and the session pointer of the keyshare attribute issuance session.
+// KeyshareRegistrationSession is returned on registration (since keyshare protocol version 6):
+// the session pointer of the issuance session of the keyshare credential, and a token with which
+// (web) frontends can follow that session at /client/register/{token}/status.
+type KeyshareRegistrationSession struct {
+	SessionPtr *Qr    `json:"sessionPtr"`
+	Token      string `json:"token"`
+}
+
+type KeyshareDeviceRegistration struct {
+	DeviceID   string `json:"deviceId"`
+	SessionPtr *Qr    `json:"sessionPtr"`
+}
+
+// KeyshareEnrollmentCode authorizes the enrollment of an additional device to a keyshare account.
+type KeyshareEnrollmentCode struct {
+	Code   string     `json:"code"`
+	Expiry *Timestamp `json:"expiry"`
+}
+
+// KeyshareRecoveryToken is a single-use token, obtained while authenticated, with which the account
+// can be re-enrolled to a new device after the keyshare state of the old one is lost, keeping its
+// username. Re-enrolling invalidates the secrets of all devices enrolled to the account.
+type KeyshareRecoveryToken struct {
+	Token  string     `json:"token"`
+	Expiry *Timestamp `json:"expiry"`
+}
+
+// KeyshareEmail is the message with which the email address of a keyshare account is changed.
+// The keyshare server sends a verification email to the new address, in the specified language
+// (or the language of the account, if not specified).
+type KeyshareEmail struct {
+	Email    string `json:"email"`
+	Language string `json:"language,omitempty"`
+}
+
+// KeyshareDevice is an additional device enrolled to a keyshare account.
+type KeyshareDevice struct {
+	ID      string     `json:"id"`
+	Name    string     `json:"name,omitempty"`
+	Created *Timestamp `json:"created"`
 }
 
 type KeyshareChangePin struct {
 	Username string `json:"id"`
 	OldPin   string `json:"oldpin"`
 	NewPin   string `json:"newpin"`
+	// Language in which the description of the resulting KeysharePinStatus is requested
+	Language string `json:"language,omitempty"`
 }
 
 type KeyshareAuthorization struct {
@@ -317,34 +406,279 @@ type KeyshareAuthorization struct {
 type KeysharePinMessage struct {
 	Username string `json:"id"`
 	Pin      string `json:"pin"`
+	// Language in which the description of the resulting KeysharePinStatus is requested
+	Language string `json:"language,omitempty"`
+}
+
+// KeyshareEncryptedMessage replaces the body of requests containing a PIN in keyshare protocol
+// version 5, if the keyshare server publishes a PIN encryption key (see KeysharePinKeyClaims).
+// See EncryptKeyshareMessage.
+type KeyshareEncryptedMessage struct {
+	EphemeralKey []byte `json:"ephemeralKey"`
+	Nonce        []byte `json:"nonce"`
+	Timestamp    int64  `json:"timestamp"`
+	Ciphertext   []byte `json:"ciphertext"`
+}
+
+// KeysharePinKeyClaims are the claims of the JWT returned by the /api/pinkey endpoint of the
+// keyshare server, which is signed with its JWT key and contains its X25519 PIN encryption key.
+type KeysharePinKeyClaims struct {
+	jwt.StandardClaims
+	PinKey []byte `json:"pin_key"`
 }
 
+// KeysharePinStatus is returned by the PIN endpoints of the keyshare server. Message contains the
+// PIN access token if Status is "success", the amount of remaining PIN attempts if it is "failure",
+// and the amount of seconds that the user is blocked if it is "error". In the latter two cases, these
+// are also present as numbers in Remaining and Blocked, along with a human-readable Description in
+// Language: the requested language, the language of the user, or the default language of the server.
 type KeysharePinStatus struct {
-	Status  string `json:"status"`
-	Message string `json:"message"`
+	Status      string `json:"status"`
+	Message     string `json:"message"`
+	Remaining   int    `json:"remaining,omitempty"`
+	Blocked     int64  `json:"blocked,omitempty"`
+	Description string `json:"description,omitempty"`
+	Language    string `json:"language,omitempty"`
+}
+
+// KeysharePinAttempts is returned by the /users/pinstatus endpoint of the keyshare server, so that
+// clients can show the amount of remaining PIN attempts before the user enters the PIN.
+type KeysharePinAttempts struct {
+	// Amount of PIN attempts remaining before the user is blocked (again)
+	Remaining int `json:"remaining"`
+	// Amount of seconds that the user is still blocked, if blocked
+	Blocked int64 `json:"blocked,omitempty"`
+}
+
+// ClientErrorReportMaxStack is the maximum size in bytes of the stack trace in a ClientErrorReport.
+const ClientErrorReportMaxStack = 4096
+
+// ClientErrorReport is sent by clients to the /api/report endpoint of the keyshare server of their
+// scheme when a session fails and the user consents to reporting it, to help the scheme operator
+// debug. To protect the privacy of the user it contains no attribute values, usernames or error
+// descriptions, and the session is identified only by the hash of its token.
+type ClientErrorReport struct {
+	// Hex encoded SHA-256 hash of the client token of the session, if any
+	SessionTokenHash string    `json:"sessionTokenHash,omitempty"`
+	ErrorType        ErrorType `json:"errorType"`
+	// Error type and HTTP status with which the IRMA server or keyshare server responded, if any
+	RemoteError   string `json:"remoteError,omitempty"`
+	RemoteStatus  int    `json:"remoteStatus,omitempty"`
+	ClientVersion string `json:"clientVersion"`
+	// Operating system and architecture of the client (e.g. android/arm64)
+	Platform string `json:"platform"`
+	// Stack trace of the error, truncated to ClientErrorReportMaxStack bytes
+	Stack string `json:"stack,omitempty"`
+}
+
+// KeyshareProofResponse is returned by the /prove/getResponse endpoint of the keyshare server
+// from keyshare protocol version 3, containing the JWT containing the ProofP of the keyshare server
+// and the ID of the commitment session in which it was computed.
+type KeyshareProofResponse struct {
+	JWT       string `json:"jwt"`
+	SessionID string `json:"sessionID"`
+}
+
+// KeyshareVersionInfo is returned by the /api/version endpoint of the keyshare server,
+// announcing the supported keyshare protocol versions and their retirement.
+type KeyshareVersionInfo struct {
+	MinProtocolVersion int              `json:"minProtocolVersion"`
+	MaxProtocolVersion int              `json:"maxProtocolVersion"`
+	Deprecation        *Timestamp       `json:"deprecation,omitempty"`
+	Sunset             *Timestamp       `json:"sunset,omitempty"`
+	Message            TranslatedString `json:"message,omitempty"`
+}
+
+// KeyshareServerStatus is the operational state of a keyshare server, see KeyshareStatus.
+type KeyshareServerStatus string
+
+const (
+	KeyshareStatusOperational KeyshareServerStatus = "operational"
+	KeyshareStatusMaintenance KeyshareServerStatus = "maintenance"
+	// The keyshare server works, except for operations that change state, such as registrations and
+	// PIN changes, which fail with a READ_ONLY error
+	KeyshareStatusReadOnly KeyshareServerStatus = "readOnly"
+)
+
+// KeyshareStatus is returned by the /api/status endpoint of the keyshare server, announcing its
+// operational state, its upcoming or ongoing maintenance window (if any), and the minimum version
+// of the apps it supports. While the keyshare server is down, a reverse proxy may serve it instead.
+type KeyshareStatus struct {
+	Status        KeyshareServerStatus       `json:"status"`
+	Maintenance   *KeyshareMaintenanceWindow `json:"maintenance,omitempty"`
+	MinAppVersion string                     `json:"minAppVersion,omitempty"`
 }
 
+// KeyshareMaintenanceWindow is a period in which the keyshare server is under maintenance, with a
+// message to show to users. If Start or End is not specified, the period starts or ends whenever
+// the operator announces so.
+type KeyshareMaintenanceWindow struct {
+	Start   *Timestamp       `json:"start,omitempty"`
+	End     *Timestamp       `json:"end,omitempty"`
+	Message TranslatedString `json:"message,omitempty"`
+}
+
+// ProofPCommitmentMap contains the commitments of the keyshare server for each public key in a session.
+// Keyshare servers send them encoded as a map or, since keyshare protocol version 7, as an
+// OrderedProofPCommitmentMap; both are accepted when unmarshaling.
 type ProofPCommitmentMap struct {
 	Commitments map[PublicKeyIdentifier]*gabi.ProofPCommitment `json:"c"`
 }
 
+// OrderedProofPCommitmentMap is a ProofPCommitmentMap that is encoded as a list of public key
+// identifiers and commitments, sorted by issuer identifier and counter, so that its encoding does
+// not depend on the order of the map.
+type OrderedProofPCommitmentMap ProofPCommitmentMap
+
+// orderedProofPCommitmentJSON is an element of the JSON encoding of an OrderedProofPCommitmentMap.
+type orderedProofPCommitmentJSON struct {
+	Key        string               `json:"key"`
+	Commitment proofPCommitmentJSON `json:"commitment"`
+}
+
+// proofPCommitmentJSON is the JSON encoding of gabi.ProofPCommitment in a ProofPCommitmentMap.
+type proofPCommitmentJSON struct {
+	P       *BigInt `json:"P"`
+	Pcommit *BigInt `json:"Pcommit"`
+}
+
 func (ppcm *ProofPCommitmentMap) MarshalJSON() ([]byte, error) {
 	var encPPCM struct {
-		Commitments map[string]*gabi.ProofPCommitment `json:"c"`
+		Commitments map[string]proofPCommitmentJSON `json:"c"`
 	}
-	encPPCM.Commitments = make(map[string]*gabi.ProofPCommitment)
+	encPPCM.Commitments = make(map[string]proofPCommitmentJSON)
 
 	for pki, v := range ppcm.Commitments {
 		pkiBytes, err := pki.MarshalText()
 		if err != nil {
 			return nil, err
 		}
-		encPPCM.Commitments[string(pkiBytes)] = v
+		encPPCM.Commitments[string(pkiBytes)] = proofPCommitmentJSON{
+			P:       (*BigInt)(v.P),
+			Pcommit: (*BigInt)(v.Pcommit),
+		}
 	}
 
 	return json.Marshal(encPPCM)
 }
 
+func (ppcm *ProofPCommitmentMap) UnmarshalJSON(bts []byte) error {
+	var raw struct {
+		Commitments json.RawMessage `json:"c"`
+	}
+	if err := json.Unmarshal(bts, &raw); err != nil {
+		return err
+	}
+
+	commitments := map[PublicKeyIdentifier]proofPCommitmentJSON{}
+	if trimmed := bytes.TrimSpace(raw.Commitments); len(trimmed) > 0 && trimmed[0] == '[' {
+		var list []orderedProofPCommitmentJSON
+		if err := json.Unmarshal(trimmed, &list); err != nil {
+			return err
+		}
+		for _, c := range list {
+			var pki PublicKeyIdentifier
+			if err := pki.UnmarshalText([]byte(c.Key)); err != nil {
+				return err
+			}
+			commitments[pki] = c.Commitment
+		}
+	} else if err := json.Unmarshal(raw.Commitments, &commitments); err != nil {
+		return err
+	}
+
+	ppcm.Commitments = make(map[PublicKeyIdentifier]*gabi.ProofPCommitment, len(commitments))
+	for pki, v := range commitments {
+		if v.P == nil || v.Pcommit == nil {
+			return errors.Errorf("incomplete ProofP commitment for %s-%d", pki.Issuer, pki.Counter)
+		}
+		ppcm.Commitments[pki] = &gabi.ProofPCommitment{P: v.P.Int(), Pcommit: v.Pcommit.Int()}
+	}
+	return nil
+}
+
+func (oppcm *OrderedProofPCommitmentMap) MarshalJSON() ([]byte, error) {
+	keys := make([]PublicKeyIdentifier, 0, len(oppcm.Commitments))
+	for pki := range oppcm.Commitments {
+		keys = append(keys, pki)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Issuer != keys[j].Issuer {
+			return keys[i].Issuer.String() < keys[j].Issuer.String()
+		}
+		return keys[i].Counter < keys[j].Counter
+	})
+
+	var encOPPCM struct {
+		Commitments []orderedProofPCommitmentJSON `json:"c"`
+	}
+	encOPPCM.Commitments = make([]orderedProofPCommitmentJSON, 0, len(keys))
+	for _, pki := range keys {
+		pkiBytes, err := pki.MarshalText()
+		if err != nil {
+			return nil, err
+		}
+		v := oppcm.Commitments[pki]
+		encOPPCM.Commitments = append(encOPPCM.Commitments, orderedProofPCommitmentJSON{
+			Key:        string(pkiBytes),
+			Commitment: proofPCommitmentJSON{P: (*BigInt)(v.P), Pcommit: (*BigInt)(v.Pcommit)},
+		})
+	}
+	return json.Marshal(encOPPCM)
+}
+
+// BigInt is a non-negative big integer with the JSON encoding that clients and servers use for
+// big integers in protocol messages (such as the challenge posted to the keyshare server):
+// a base64 encoded string of its big-endian bytes, as used by gabi. Older implementations sent
+// some big integers as a JSON number in base 10, which is also accepted when unmarshaling.
+type BigInt big.Int
+
+// NewBigInt returns the specified integer as a BigInt.
+func NewBigInt(i *big.Int) *BigInt {
+	return (*BigInt)(i)
+}
+
+// Int returns i as a *big.Int.
+func (i *BigInt) Int() *big.Int {
+	return (*big.Int)(i)
+}
+
+func (i *BigInt) MarshalJSON() ([]byte, error) {
+	if i.Int().Sign() < 0 {
+		return nil, errors.New("cannot marshal negative integer")
+	}
+	return json.Marshal(base64.StdEncoding.EncodeToString(i.Int().Bytes()))
+}
+
+func (i *BigInt) UnmarshalJSON(bts []byte) error {
+	bts = bytes.TrimSpace(bts)
+	if len(bts) == 0 || string(bts) == "null" {
+		return nil
+	}
+
+	if bts[0] != '"' {
+		// Legacy encoding: a JSON number in base 10
+		if _, ok := i.Int().SetString(string(bts), 10); !ok {
+			return errors.Errorf("invalid big integer: %s", string(bts))
+		}
+		if i.Int().Sign() < 0 {
+			return errors.New("unexpected negative integer")
+		}
+		return nil
+	}
+
+	var str string
+	if err := json.Unmarshal(bts, &str); err != nil {
+		return err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return errors.Errorf("invalid base64 encoded big integer: %v", err)
+	}
+	i.Int().SetBytes(decoded)
+	return nil
+}
+
 //
 // Errors
 //
@@ -374,6 +708,10 @@ func (e *SessionError) Error() string {
 		buffer.WriteString("\nIRMA server error: ")
 		buffer.WriteString(e.RemoteError.Error())
 	}
+	if e.RetryAfter > 0 {
+		buffer.WriteString("\nRetry after: ")
+		buffer.WriteString(e.RetryAfter.String())
+	}
 
 	return buffer.String()
 }
@@ -456,6 +794,7 @@ func (status ServerStatus) Finished() bool {
 type ServerSessionResponse struct {
 	ProofStatus     ProofStatus                   `json:"proofStatus"`
 	IssueSignatures []*gabi.IssueSignatureMessage `json:"sigs,omitempty"`
+	IssueErrors     []*RemoteError                `json:"sigErrors,omitempty"` // in case of partial issuance, per credential whether it failed
 	NextSession     *Qr                           `json:"nextSession,omitempty"`
 
 	// needed for legacy (un)marshaling
@@ -466,4 +805,6 @@ type ServerSessionResponse struct {
 type FrontendSessionStatus struct {
 	Status      ServerStatus `json:"status"`
 	NextSession *Qr          `json:"nextSession,omitempty"`
+	// Time at which the session times out if the client does not act before, if not finished
+	ExpiresAt *Timestamp `json:"expiresAt,omitempty"`
 }
@@ -0,0 +1,114 @@
+package irma
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/go-errors/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const keysharePinEncryptionInfo = "IRMA keyshare PIN encryption"
+
+// KeyshareMessageLifetime is the period after its encryption during which a message encrypted
+// using EncryptKeyshareMessage is accepted, in addition to the clock skew tolerance.
+const KeyshareMessageLifetime = 5 * time.Minute
+
+// EncryptKeyshareMessage encrypts the specified request body for the specified endpoint
+// (e.g. "users/verify/pin") of the keyshare server having the specified X25519 PIN encryption key.
+// The body is encrypted using XChaCha20-Poly1305, with a key derived using HKDF-SHA256 from an
+// X25519 key exchange between a fresh ephemeral key and the PIN encryption key. The endpoint and
+// the current time are authenticated as additional data, so that the message cannot be used at
+// other endpoints nor after KeyshareMessageLifetime.
+func EncryptKeyshareMessage(pinKey []byte, endpoint string, body []byte) (*KeyshareEncryptedMessage, error) {
+	return encryptKeyshareMessage(pinKey, endpoint, body, time.Now())
+}
+
+func encryptKeyshareMessage(pinKey []byte, endpoint string, body []byte, now time.Time) (*KeyshareEncryptedMessage, error) {
+	ephemeralPrivateKey := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeralPrivateKey); err != nil {
+		return nil, err
+	}
+	ephemeralKey, err := curve25519.X25519(ephemeralPrivateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(ephemeralPrivateKey, pinKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := keyshareMessageAEAD(shared, ephemeralKey, pinKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	timestamp := now.Unix()
+	return &KeyshareEncryptedMessage{
+		EphemeralKey: ephemeralKey,
+		Nonce:        nonce,
+		Timestamp:    timestamp,
+		Ciphertext:   aead.Seal(nil, nonce, body, keyshareMessageAdditionalData(endpoint, timestamp)),
+	}, nil
+}
+
+// Decrypt decrypts the request body for the specified endpoint, using the X25519 private key
+// of which the public key was used in EncryptKeyshareMessage. Messages encrypted more than
+// KeyshareMessageLifetime ago, or in the future, are refused, allowing for the specified clock skew.
+// As the message itself may still be replayed within its lifetime, the caller must refuse messages
+// of which the ephemeral key was seen before.
+func (m *KeyshareEncryptedMessage) Decrypt(privateKey []byte, endpoint string, clockSkewTolerance time.Duration) ([]byte, error) {
+	now, timestamp := time.Now(), time.Unix(m.Timestamp, 0)
+	if timestamp.After(now.Add(clockSkewTolerance)) {
+		return nil, errors.New("message timestamp lies in the future")
+	}
+	if now.After(timestamp.Add(KeyshareMessageLifetime + clockSkewTolerance)) {
+		return nil, errors.New("message expired")
+	}
+
+	pinKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(privateKey, m.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := keyshareMessageAEAD(shared, m.EphemeralKey, pinKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce length")
+	}
+	return aead.Open(nil, m.Nonce, m.Ciphertext, keyshareMessageAdditionalData(endpoint, m.Timestamp))
+}
+
+// keyshareMessageAdditionalData returns the additional data authenticated by the AEAD: the endpoint
+// followed by the big-endian timestamp.
+func keyshareMessageAdditionalData(endpoint string, timestamp int64) []byte {
+	ad := make([]byte, len(endpoint)+8)
+	copy(ad, endpoint)
+	binary.BigEndian.PutUint64(ad[len(endpoint):], uint64(timestamp))
+	return ad
+}
+
+// keyshareMessageAEAD derives the AEAD from the shared secret of the X25519 key exchange between
+// the ephemeral key and the PIN encryption key, binding it to both keys.
+func keyshareMessageAEAD(shared, ephemeralKey, pinKey []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ephemeralKey...), pinKey...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(keysharePinEncryptionInfo)), key); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(key)
+}
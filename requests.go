@@ -6,8 +6,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/bwesterb/go-atum"
 	"github.com/go-errors/errors"
@@ -69,13 +73,30 @@ type DisclosureRequest struct {
 
 	Disclose AttributeConDisCon       `json:"disclose,omitempty"`
 	Labels   map[int]TranslatedString `json:"labels,omitempty"`
+
+	// Indices of the disjunctions that are to be satisfied by all credential instances of the user
+	// satisfying it, instead of by one, up to MaxInstances instances per disjunction (default value
+	// 0 means DefaultMaxInstances)
+	AllInstances []int `json:"allInstances,omitempty"`
+	MaxInstances int   `json:"maxInstances,omitempty"`
 }
 
+// DefaultMaxInstances is the default maximum number of credential instances disclosed for
+// disjunctions of which all instances are requested.
+const DefaultMaxInstances = 10
+
 // A SignatureRequest is a a request to sign a message with certain attributes. Construct new
-// instances using NewSignatureRequest().
+// instances using NewSignatureRequest() or NewHashedSignatureRequest().
+// Instead of a Message, a request may contain the MessageHash of a message that is not sent to
+// the client (e.g. a large document), along with a MessageDisplay that is shown to the user.
 type SignatureRequest struct {
 	DisclosureRequest
-	Message string `json:"message"`
+	Message        string       `json:"message"`
+	MessageHash    *MessageHash `json:"messageHash,omitempty"`
+	MessageDisplay string       `json:"messageDisplay,omitempty"`
+	// Mode of the signature: session-bound (the default), or standalone, in which case the nonce
+	// is generated by the client and the request cannot be used in a session
+	Mode SignatureMode `json:"mode,omitempty"`
 }
 
 // An IssuanceRequest is a request to issue certain credentials,
@@ -84,6 +105,10 @@ type SignatureRequest struct {
 type IssuanceRequest struct {
 	DisclosureRequest
 	Credentials []*CredentialRequest `json:"credentials"`
+	// If set, the session fails when any of the credentials cannot be issued. Otherwise, if the
+	// client supports it, the credentials that could be issued are issued and the others are
+	// reported as failed in the session result.
+	StrictIssuance bool `json:"strictIssuance,omitempty"`
 
 	// Derived data
 	CredentialInfoList        CredentialInfoList `json:",omitempty"`
@@ -93,13 +118,25 @@ type IssuanceRequest struct {
 // A CredentialRequest contains the attributes and metadata of a credential
 // that will be issued in an IssuanceRequest.
 type CredentialRequest struct {
-	Validity                    *Timestamp               `json:"validity,omitempty"`
-	KeyCounter                  uint                     `json:"keyCounter,omitempty"`
+	Validity *Timestamp `json:"validity,omitempty"`
+	// Counter of the issuer public key under which the credential is issued. Requestors may set it
+	// to issue under a specific key (e.g. an older one during key rollover); if absent, the server
+	// issues under its most recent private key and sets it accordingly before sending the request
+	// to the client.
+	KeyCounter                  *uint                    `json:"keyCounter,omitempty"`
 	CredentialTypeID            CredentialTypeIdentifier `json:"credential"`
 	Attributes                  map[string]string        `json:"attributes"`
 	RevocationKey               string                   `json:"revocationKey,omitempty"`
 	RevocationSupported         bool                     `json:"revocationSupported,omitempty"`
 	RandomBlindAttributeTypeIDs []string                 `json:"randomblindIDs,omitempty"`
+	// Whether to mark the credential as test credential in its metadata attribute. Requestors may
+	// set it; otherwise the server sets it before sending the request to the client if it is not in
+	// production mode or the credential type belongs to a demo scheme (and the client supports it).
+	TestCredential bool `json:"testCredential,omitempty"`
+	// Attributes whose value is copied from an attribute disclosed in the same session, mapping the
+	// name of the attribute to the disclosed attribute. The server fills these in after verifying the
+	// disclosure, see WithDisclosedValues.
+	DisclosedAttributes map[string]AttributeTypeIdentifier `json:"disclosedAttributes,omitempty"`
 }
 
 // SessionRequest instances contain all information the irmaclient needs to perform an IRMA session.
@@ -130,6 +167,11 @@ type RequestorBaseRequest struct {
 	ClientTimeout     int              `json:"timeout,omitempty"`     // Wait this many seconds for the IRMA app to connect before the session times out
 	CallbackURL       string           `json:"callbackUrl,omitempty"` // URL to post session result to
 	NextSession       *NextSessionData `json:"nextSession,omitempty"` // Data about session to start after this one (if any)
+	// Include the proof details of the session result in result JWTs (omitted by default because of their size)
+	ResultJwtProofDetails bool `json:"resultJwtProofDetails,omitempty"`
+	// Name of the server-side request template from which the request was expanded, if any.
+	// Set by the server; it cannot be specified by requestors.
+	Template string `json:"-"`
 }
 
 type NextSessionData struct {
@@ -198,6 +240,7 @@ type RequestorJwt interface {
 	SessionRequest() SessionRequest
 	Requestor() string
 	Valid() error
+	ValidWithTolerance(tolerance time.Duration) error
 	Sign(jwt.SigningMethod, interface{}) (string, error)
 }
 
@@ -265,6 +308,8 @@ type ClientSessionRequest struct {
 	ProtocolVersion *ProtocolVersion `json:"protocolVersion,omitempty"`
 	Options         *SessionOptions  `json:"options,omitempty"`
 	Request         SessionRequest   `json:"request,omitempty"`
+	// Time at which the session times out if the client does not act before
+	ExpiresAt *Timestamp `json:"expiresAt,omitempty"`
 }
 
 func (choice *DisclosureChoice) Validate() error {
@@ -273,6 +318,9 @@ func (choice *DisclosureChoice) Validate() error {
 	}
 	for _, attrlist := range choice.Attributes {
 		for _, attr := range attrlist {
+			if _, err := ParseAttributeTypeIdentifier(attr.Type.String()); err != nil {
+				return err
+			}
 			if attr.CredentialHash == "" {
 				return errors.Errorf("no credential hash specified for %s", attr.Type)
 			}
@@ -303,7 +351,8 @@ func (r *RevocationRequest) Validate() error {
 	if r.LDContext != LDContextRevocationRequest {
 		return errors.New("not a revocation request")
 	}
-	return nil
+	_, err := ParseCredentialTypeIdentifier(r.CredentialType.String())
+	return err
 }
 
 var (
@@ -374,9 +423,11 @@ func (c AttributeCon) Validate() error {
 	credtypes := map[CredentialTypeIdentifier]struct{}{}
 	var last CredentialTypeIdentifier
 	for _, attr := range c {
-		count := attr.Type.PartsCount()
-		if count != 3 && count != 2 {
-			return errors.Errorf("Expected attribute request to consist of 4 or 3 parts, %d found", count+1)
+		if _, err := ParseAttributeTypeIdentifier(attr.Type.String()); err != nil {
+			return err
+		}
+		if attr.Type.IsCredential() && (attr.Value != nil || attr.NotNull) {
+			return errors.Errorf("Attribute request %s for possession of a credential cannot require an attribute value", attr.Type)
 		}
 		typ := attr.Type.CredentialTypeIdentifier()
 		if _, contains := credtypes[typ]; contains && last != typ {
@@ -442,6 +493,45 @@ func (c AttributeCon) Satisfy(proofs gabi.ProofList, indices []*DisclosedAttribu
 	return true, attrs, nil
 }
 
+// satisfyInstances returns if the attributes specified by proofs and indices consist of one or
+// more, but at most max, consecutive groups of attributes, each of which satisfies the conjunction
+// and is disclosed out of a credential instance. If so it also returns the disclosed attribute
+// values, whose InstanceHash identifies the instance out of which they were disclosed. Instances
+// disclosing the same values cannot be told apart, so their attributes are returned only once.
+func (c AttributeCon) satisfyInstances(proofs gabi.ProofList, indices []*DisclosedAttributeIndex, revocation map[int]*time.Time, conf *Configuration, max int) (bool, []*DisclosedAttribute, error) {
+	if len(c) == 0 {
+		return c.Satisfy(proofs, indices, revocation, conf)
+	}
+	if len(indices) == 0 || len(indices)%len(c) != 0 || len(indices)/len(c) > max {
+		return false, nil, nil
+	}
+
+	attrs := make([]*DisclosedAttribute, 0, len(indices))
+	hashes := map[string]struct{}{}
+	for start := 0; start < len(indices); start += len(c) {
+		group := indices[start : start+len(c)]
+		for _, index := range group {
+			if index.CredentialIndex != group[0].CredentialIndex {
+				return false, nil, nil
+			}
+		}
+		satisfied, groupAttrs, err := c.Satisfy(proofs, group, revocation, conf)
+		if err != nil || !satisfied {
+			return false, nil, err
+		}
+		hash := instanceHash(proofs[group[0].CredentialIndex].(*gabi.ProofD), group)
+		if _, seen := hashes[hash]; seen {
+			continue
+		}
+		hashes[hash] = struct{}{}
+		for _, attr := range groupAttrs {
+			attr.InstanceHash = hash
+		}
+		attrs = append(attrs, groupAttrs...)
+	}
+	return true, attrs, nil
+}
+
 func (dc AttributeDisCon) Validate() error {
 	if len(dc) == 0 {
 		return errors.New("Empty disjunction")
@@ -458,8 +548,21 @@ func (dc AttributeDisCon) Validate() error {
 // Satisfy returns true if the attributes specified by proofs and indices satisfies any one of the
 // contained AttributeCon's. If so it also returns a list of the disclosed attribute values.
 func (dc AttributeDisCon) Satisfy(proofs gabi.ProofList, indices []*DisclosedAttributeIndex, revocation map[int]*time.Time, conf *Configuration) (bool, []*DisclosedAttribute, error) {
+	return dc.satisfy(proofs, indices, revocation, conf, 1)
+}
+
+// satisfy is Satisfy, accepting up to the specified number of credential instances satisfying
+// one of the contained AttributeCon's if it is more than 1.
+func (dc AttributeDisCon) satisfy(proofs gabi.ProofList, indices []*DisclosedAttributeIndex, revocation map[int]*time.Time, conf *Configuration, instances int) (bool, []*DisclosedAttribute, error) {
 	for _, con := range dc {
-		satisfied, attrs, err := con.Satisfy(proofs, indices, revocation, conf)
+		var satisfied bool
+		var attrs []*DisclosedAttribute
+		var err error
+		if instances > 1 {
+			satisfied, attrs, err = con.satisfyInstances(proofs, indices, revocation, conf, instances)
+		} else {
+			satisfied, attrs, err = con.Satisfy(proofs, indices, revocation, conf)
+		}
 		if err != nil {
 			return false, nil, err
 		}
@@ -476,7 +579,11 @@ func (cdc AttributeConDisCon) Validate(conf *Configuration) error {
 			var nonsingleton *CredentialTypeIdentifier
 			for _, attr := range con {
 				typ := attr.Type.CredentialTypeIdentifier()
-				if !conf.CredentialTypes[typ].IsSingleton {
+				credtype, ok := conf.CredentialTypes[typ]
+				if !ok {
+					return errors.Errorf("Unknown credential type %s", typ)
+				}
+				if !credtype.IsSingleton {
 					if nonsingleton != nil && *nonsingleton != typ {
 						return errors.New("Multiple non-singletons within one inner conjunction are not allowed")
 					} else {
@@ -492,6 +599,12 @@ func (cdc AttributeConDisCon) Validate(conf *Configuration) error {
 // Satisfy returns true if each of the contained AttributeDisCon is satisfied by the specified disclosure.
 // If so it also returns the disclosed attributes.
 func (cdc AttributeConDisCon) Satisfy(disclosure *Disclosure, revocation map[int]*time.Time, conf *Configuration) (bool, [][]*DisclosedAttribute, error) {
+	return cdc.satisfy(disclosure, revocation, conf, nil)
+}
+
+// satisfy is Satisfy, accepting multiple credential instances for the disjunctions of which the
+// request (if not nil) asks all instances.
+func (cdc AttributeConDisCon) satisfy(disclosure *Disclosure, revocation map[int]*time.Time, conf *Configuration, request *DisclosureRequest) (bool, [][]*DisclosedAttribute, error) {
 	if len(disclosure.Indices) < len(cdc) {
 		return false, nil, nil
 	}
@@ -499,7 +612,11 @@ func (cdc AttributeConDisCon) Satisfy(disclosure *Disclosure, revocation map[int
 	complete := true
 
 	for i, discon := range cdc {
-		satisfied, attrs, err := discon.Satisfy(disclosure.Proofs, disclosure.Indices[i], revocation, conf)
+		instances := 1
+		if request != nil {
+			instances = request.Instances(i)
+		}
+		satisfied, attrs, err := discon.satisfy(disclosure.Proofs, disclosure.Indices[i], revocation, conf, instances)
 		if err != nil {
 			return false, nil, err
 		}
@@ -555,6 +672,15 @@ func NewSignatureRequest(message string, attrs ...AttributeTypeIdentifier) *Sign
 	}
 }
 
+// NewHashedSignatureRequest returns a request to sign the message having the specified hash,
+// during which the display message is shown to the user.
+func NewHashedSignatureRequest(hash *MessageHash, display string, attrs ...AttributeTypeIdentifier) *SignatureRequest {
+	sr := NewSignatureRequest("", attrs...)
+	sr.MessageHash = hash
+	sr.MessageDisplay = display
+	return sr
+}
+
 func NewIssuanceRequest(creds []*CredentialRequest, attrs ...AttributeTypeIdentifier) *IssuanceRequest {
 	dr := NewDisclosureRequest(attrs...)
 	dr.LDContext = LDContextIssuanceRequest
@@ -595,6 +721,17 @@ func (dr *DisclosureRequest) Base() *BaseRequest {
 
 func (dr *DisclosureRequest) Action() Action { return ActionDisclosing }
 
+// MarshalJSON marshals the request, including its @context also if it was not set, so that
+// the request unmarshals to the same type.
+func (dr *DisclosureRequest) MarshalJSON() ([]byte, error) {
+	type newDisclosureRequest DisclosureRequest // Same type with default JSON marshaler
+	req := newDisclosureRequest(*dr)
+	if req.LDContext == "" {
+		req.LDContext = LDContextDisclosureRequest
+	}
+	return json.Marshal(&req)
+}
+
 func (dr *DisclosureRequest) IsDisclosureRequest() bool {
 	return dr.LDContext == LDContextDisclosureRequest
 }
@@ -606,15 +743,60 @@ func (dr *DisclosureRequest) Validate() error {
 	if len(dr.Identifiers().AttributeTypes) == 0 {
 		return errors.New("Disclosure request had no attributes")
 	}
-	var err error
+	if err := dr.validateDisclose(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (dr *DisclosureRequest) validateDisclose() error {
 	for _, discon := range dr.Disclose {
-		if err = discon.Validate(); err != nil {
+		if err := discon.Validate(); err != nil {
+			return err
+		}
+	}
+	for id := range dr.Revocation {
+		if _, err := ParseCredentialTypeIdentifier(id.String()); err != nil {
 			return err
 		}
 	}
+	return dr.ValidateInstances()
+}
+
+// ValidateInstances checks that the disjunctions of which all instances are requested exist and
+// request attributes of one credential type per inner conjunction.
+func (dr *DisclosureRequest) ValidateInstances() error {
+	if dr.MaxInstances < 0 {
+		return errors.New("Maximum number of instances cannot be negative")
+	}
+	for _, i := range dr.AllInstances {
+		if i < 0 || i >= len(dr.Disclose) {
+			return errors.Errorf("All instances requested of nonexisting disjunction %d", i)
+		}
+		for _, con := range dr.Disclose[i] {
+			if len(con.CredentialTypes()) > 1 {
+				return errors.New("Disjunctions of which all instances are requested may contain attributes of one credential type per inner conjunction")
+			}
+		}
+	}
 	return nil
 }
 
+// Instances returns the maximum number of credential instances with which the specified
+// disjunction is to be satisfied: 1, unless all instances are requested for it.
+func (dr *DisclosureRequest) Instances(disjunction int) int {
+	for _, i := range dr.AllInstances {
+		if i != disjunction {
+			continue
+		}
+		if dr.MaxInstances == 0 {
+			return DefaultMaxInstances
+		}
+		return dr.MaxInstances
+	}
+	return 1
+}
+
 func (cr *CredentialRequest) Info(conf *Configuration, metadataVersion byte, issuedAt time.Time) (*CredentialInfo, error) {
 	list, err := cr.AttributeList(conf, metadataVersion, nil, issuedAt)
 	if err != nil {
@@ -623,6 +805,15 @@ func (cr *CredentialRequest) Info(conf *Configuration, metadataVersion byte, iss
 	return list.CredentialInfo(), nil
 }
 
+// PublicKeyCounter returns the counter of the public key under which the credential is issued,
+// i.e. KeyCounter, or 0 if it is absent (which older servers did for counter 0).
+func (cr *CredentialRequest) PublicKeyCounter() uint {
+	if cr.KeyCounter == nil {
+		return 0
+	}
+	return *cr.KeyCounter
+}
+
 // Validate checks that this credential request is consistent with the specified Configuration:
 // the credential type is known, all required attributes are present and no unknown attributes
 // are given.
@@ -635,6 +826,12 @@ func (cr *CredentialRequest) Validate(conf *Configuration) error {
 	// Check that there are no attributes in the credential request that aren't
 	// in the credential descriptor.
 	for crName := range cr.Attributes {
+		if _, copied := cr.DisclosedAttributes[crName]; copied {
+			return &SessionError{ErrorType: ErrorInvalidRequest, Err: errors.Errorf("attribute %s both has a value and copies a disclosed attribute", crName)}
+		}
+	}
+	names := cr.attributeNames()
+	for crName := range names {
 		found := false
 		for _, ad := range credtype.AttributeTypes {
 			if ad.ID == crName {
@@ -648,7 +845,7 @@ func (cr *CredentialRequest) Validate(conf *Configuration) error {
 	}
 
 	for _, attrtype := range credtype.AttributeTypes {
-		_, present := cr.Attributes[attrtype.ID]
+		_, present := names[attrtype.ID]
 		if !present && !attrtype.RevocationAttribute && !attrtype.RandomBlind && attrtype.Optional != "true" {
 			return &SessionError{ErrorType: ErrorRequiredAttributeMissing, Err: errors.New("Required attribute not present in credential request")}
 		}
@@ -669,6 +866,64 @@ func (cr *CredentialRequest) Validate(conf *Configuration) error {
 	return nil
 }
 
+// attributeNames returns the names of the attributes of this credential request, including those
+// copying a disclosed attribute.
+func (cr *CredentialRequest) attributeNames() map[string]struct{} {
+	names := make(map[string]struct{}, len(cr.Attributes)+len(cr.DisclosedAttributes))
+	for name := range cr.Attributes {
+		names[name] = struct{}{}
+	}
+	for name := range cr.DisclosedAttributes {
+		names[name] = struct{}{}
+	}
+	return names
+}
+
+// ValidateAttributeValues checks that the attribute values of this credential request are valid
+// UTF-8 without control characters. Their length is not limited: values that do not fit in the
+// message space of the issuer's public key are hashed into it by gabi. The values of attributes
+// copying a disclosed attribute (see WithDisclosedValues) are only checked once filled in.
+func (cr *CredentialRequest) ValidateAttributeValues() error {
+	names := make([]string, 0, len(cr.Attributes))
+	for name := range cr.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := cr.Attributes[name]
+		id := NewAttributeTypeIdentifier(cr.CredentialTypeID.String() + "." + name)
+		if !utf8.ValidString(value) {
+			return &SessionError{ErrorType: ErrorInvalidAttributeValue, Err: errors.Errorf("value of attribute %s is not valid UTF-8", id)}
+		}
+		if i := strings.IndexFunc(value, unicode.IsControl); i >= 0 {
+			return &SessionError{ErrorType: ErrorInvalidAttributeValue,
+				Err: errors.Errorf("value of attribute %s contains control character %U", id, []rune(value[i:])[0])}
+		}
+	}
+	return nil
+}
+
+// WithDisclosedValues returns a copy of this credential request in which the values of the attributes
+// in DisclosedAttributes are filled in using the specified values of the attributes disclosed in the
+// same session. An error is returned if one of them refers to an attribute that was not disclosed.
+func (cr *CredentialRequest) WithDisclosedValues(disclosed map[AttributeTypeIdentifier]string) (*CredentialRequest, error) {
+	resolved := *cr
+	resolved.DisclosedAttributes = nil
+	resolved.Attributes = make(map[string]string, len(cr.Attributes)+len(cr.DisclosedAttributes))
+	for name, value := range cr.Attributes {
+		resolved.Attributes[name] = value
+	}
+	for name, id := range cr.DisclosedAttributes {
+		value, ok := disclosed[id]
+		if !ok {
+			return nil, errors.Errorf("attribute %s copies attribute %s, which was not disclosed", name, id)
+		}
+		resolved.Attributes[name] = value
+	}
+	return &resolved, nil
+}
+
 // Checks for equality between two slices of strings
 func stringSliceEqual(a, b []string) bool {
 	if len(a) != len(b) {
@@ -700,9 +955,12 @@ func (cr *CredentialRequest) AttributeList(
 
 	// Compute metadata attribute
 	meta := NewMetadataAttribute(metadataVersion)
-	meta.setKeyCounter(cr.KeyCounter)
+	meta.setKeyCounter(cr.PublicKeyCounter())
 	meta.setCredentialTypeIdentifier(cr.CredentialTypeID.String())
 	meta.setSigningDate(issuedAt)
+	if cr.TestCredential {
+		meta.setTestCredential()
+	}
 	if err := meta.setExpiryDate(cr.Validity); err != nil {
 		return nil, err
 	}
@@ -747,13 +1005,13 @@ func (ir *IssuanceRequest) Identifiers() *IrmaIdentifierSet {
 			ir.ids.Issuers[issuer] = struct{}{}
 			credID := credreq.CredentialTypeID
 			ir.ids.CredentialTypes[credID] = struct{}{}
-			for attr, _ := range credreq.Attributes { // this is kind of ugly
+			for attr := range credreq.attributeNames() { // this is kind of ugly
 				ir.ids.AttributeTypes[NewAttributeTypeIdentifier(credID.String()+"."+attr)] = struct{}{}
 			}
 			if ir.ids.PublicKeys[issuer] == nil {
 				ir.ids.PublicKeys[issuer] = []uint{}
 			}
-			ir.ids.PublicKeys[issuer] = append(ir.ids.PublicKeys[issuer], credreq.KeyCounter)
+			ir.ids.PublicKeys[issuer] = append(ir.ids.PublicKeys[issuer], credreq.PublicKeyCounter())
 		}
 
 		ir.ids.join(ir.DisclosureRequest.identifiers())
@@ -761,6 +1019,27 @@ func (ir *IssuanceRequest) Identifiers() *IrmaIdentifierSet {
 	return ir.ids
 }
 
+// CheckDuplicates returns an error if the request contains multiple credentials of a singleton
+// credential type, of which the client can store only one. Credential types that are not singletons
+// may occur multiple times, in which case the client stores all instances.
+func (ir *IssuanceRequest) CheckDuplicates(conf *Configuration) error {
+	seen := map[CredentialTypeIdentifier]struct{}{}
+	for _, credreq := range ir.Credentials {
+		id := credreq.CredentialTypeID
+		if credtype := conf.CredentialTypes[id]; credtype == nil || !credtype.IsSingleton {
+			continue
+		}
+		if _, ok := seen[id]; ok {
+			return &SessionError{
+				ErrorType: ErrorDuplicateCredential,
+				Err:       errors.Errorf("singleton credential type %s is issued more than once", id),
+			}
+		}
+		seen[id] = struct{}{}
+	}
+	return nil
+}
+
 func (ir *IssuanceRequest) GetCredentialInfoList(
 	conf *Configuration,
 	version *ProtocolVersion,
@@ -780,6 +1059,29 @@ func (ir *IssuanceRequest) GetCredentialInfoList(
 
 func (ir *IssuanceRequest) Action() Action { return ActionIssuing }
 
+// MarshalJSON marshals the request, including its @context also if it was not set, so that
+// the request unmarshals to the same type.
+func (ir *IssuanceRequest) MarshalJSON() ([]byte, error) {
+	type newDisclosureRequest DisclosureRequest
+	req := struct { // Identical type with default JSON marshaler
+		newDisclosureRequest
+		Credentials               []*CredentialRequest `json:"credentials"`
+		StrictIssuance            bool                 `json:"strictIssuance,omitempty"`
+		CredentialInfoList        CredentialInfoList   `json:",omitempty"`
+		RemovalCredentialInfoList CredentialInfoList   `json:",omitempty"`
+	}{
+		newDisclosureRequest(ir.DisclosureRequest),
+		ir.Credentials,
+		ir.StrictIssuance,
+		ir.CredentialInfoList,
+		ir.RemovalCredentialInfoList,
+	}
+	if req.LDContext == "" {
+		req.LDContext = LDContextIssuanceRequest
+	}
+	return json.Marshal(&req)
+}
+
 func (ir *IssuanceRequest) Validate() error {
 	if ir.LDContext != LDContextIssuanceRequest {
 		return errors.New("Not an issuance request")
@@ -788,27 +1090,85 @@ func (ir *IssuanceRequest) Validate() error {
 		return errors.New("Empty issuance request")
 	}
 	for _, cred := range ir.Credentials {
-		count := cred.CredentialTypeID.PartsCount()
-		if count != 2 {
-			return errors.Errorf("Expected credential ID to consist of 3 parts, %d found", count+1)
+		if _, err := ParseCredentialTypeIdentifier(cred.CredentialTypeID.String()); err != nil {
+			return err
 		}
 		if cred.Validity != nil && cred.Validity.Floor().Before(Timestamp(time.Now())) {
 			return errors.New("Expired credential request")
 		}
+		for id := range cred.attributeNames() {
+			if _, err := ParseAttributeTypeIdentifier(cred.CredentialTypeID.String() + "." + id); err != nil {
+				return err
+			}
+		}
+		for _, disclosed := range cred.DisclosedAttributes {
+			if _, err := ParseAttributeTypeIdentifier(disclosed.String()); err != nil {
+				return err
+			}
+		}
 	}
-	var err error
-	for _, discon := range ir.Disclose {
-		if err = discon.Validate(); err != nil {
-			return err
+	if err := ir.DisclosureRequest.validateDisclose(); err != nil {
+		return err
+	}
+	return ir.validateDisclosedAttributes()
+}
+
+// validateDisclosedAttributes checks that each attribute whose value is copied into an issued
+// attribute is requested exactly once in the disclosure part of this request, so that the value
+// to be copied is unambiguous. Requesting all instances of the containing disjunction counts as
+// requesting it more than once.
+func (ir *IssuanceRequest) validateDisclosedAttributes() error {
+	requested := map[AttributeTypeIdentifier]int{}
+	for i, discon := range ir.Disclose {
+		for _, con := range discon {
+			for _, attr := range con {
+				requested[attr.Type] += ir.Instances(i)
+			}
+		}
+	}
+	for _, cred := range ir.Credentials {
+		for name, id := range cred.DisclosedAttributes {
+			if n := requested[id]; n == 0 {
+				return errors.Errorf("attribute %s copies attribute %s, which is not requested to be disclosed", name, id)
+			} else if n > 1 {
+				return errors.Errorf("attribute %s copies attribute %s, which is requested to be disclosed more than once", name, id)
+			}
 		}
 	}
 	return nil
 }
 
 // GetNonce returns the nonce of this signature session
-// (with the message already hashed into it).
+// (with the message already hashed into it), or nil if it cannot be computed, which Validate rules out.
 func (sr *SignatureRequest) GetNonce(timestamp *atum.Timestamp) *big.Int {
-	return ASN1ConvertSignatureNonce(sr.Message, sr.BaseRequest.GetNonce(nil), timestamp)
+	nonce, err := sr.nonce(timestamp)
+	if err != nil {
+		return nil
+	}
+	return nonce
+}
+
+func (sr *SignatureRequest) nonce(timestamp *atum.Timestamp) (*big.Int, error) {
+	nonce, err := sr.signatureNonce()
+	if err != nil {
+		return nil, err
+	}
+	if sr.MessageHash != nil {
+		return ASN1ConvertHashedSignatureNonce(sr.MessageHash, sr.MessageDisplay, nonce, timestamp)
+	}
+	return ASN1ConvertSignatureNonce(sr.Message, nonce, timestamp), nil
+}
+
+// signatureNonce returns the nonce of the request, bound to the standalone signature context if
+// the request is in standalone mode, before the message is hashed into it.
+func (sr *SignatureRequest) signatureNonce() (*big.Int, error) {
+	return signatureNonce(sr.Mode, sr.BaseRequest.GetNonce(nil))
+}
+
+// TimestampMessage returns the message over which the timestamp of the signature is computed:
+// the message itself, or the encoding of the message hash and displayed message.
+func (sr *SignatureRequest) TimestampMessage() (string, error) {
+	return timestampMessage(sr.Message, sr.MessageHash, sr.MessageDisplay)
 }
 
 func (sr *SignatureRequest) SignatureFromMessage(message interface{}, timestamp *atum.Timestamp) (*SignedMessage, error) {
@@ -822,19 +1182,49 @@ func (sr *SignatureRequest) SignatureFromMessage(message interface{}, timestamp
 	if nonce == nil {
 		nonce = bigZero
 	}
+	mode := sr.Mode
+	if mode == "" {
+		mode = SignatureModeSession
+	}
 	return &SignedMessage{
-		LDContext: LDContextSignedMessage,
-		Signature: signature.Proofs,
-		Indices:   signature.Indices,
-		Nonce:     nonce,
-		Context:   sr.GetContext(),
-		Message:   sr.Message,
-		Timestamp: timestamp,
+		LDContext:      LDContextSignedMessage,
+		Signature:      signature.Proofs,
+		Indices:        signature.Indices,
+		Nonce:          nonce,
+		Context:        sr.GetContext(),
+		Message:        sr.Message,
+		MessageHash:    sr.MessageHash,
+		MessageDisplay: sr.MessageDisplay,
+		Timestamp:      timestamp,
+		Mode:           mode,
 	}, nil
 }
 
 func (sr *SignatureRequest) Action() Action { return ActionSigning }
 
+// MarshalJSON marshals the request, including its @context also if it was not set, so that
+// the request unmarshals to the same type.
+func (sr *SignatureRequest) MarshalJSON() ([]byte, error) {
+	type newDisclosureRequest DisclosureRequest
+	req := struct { // Identical type with default JSON marshaler
+		newDisclosureRequest
+		Message        string        `json:"message"`
+		MessageHash    *MessageHash  `json:"messageHash,omitempty"`
+		MessageDisplay string        `json:"messageDisplay,omitempty"`
+		Mode           SignatureMode `json:"mode,omitempty"`
+	}{
+		newDisclosureRequest(sr.DisclosureRequest),
+		sr.Message,
+		sr.MessageHash,
+		sr.MessageDisplay,
+		sr.Mode,
+	}
+	if req.LDContext == "" {
+		req.LDContext = LDContextSignatureRequest
+	}
+	return json.Marshal(&req)
+}
+
 func (sr *SignatureRequest) IsSignatureRequest() bool {
 	return sr.LDContext == LDContextSignatureRequest
 }
@@ -843,17 +1233,38 @@ func (sr *SignatureRequest) Validate() error {
 	if !sr.IsSignatureRequest() {
 		return errors.New("Not a signature request")
 	}
-	if sr.Message == "" {
-		return errors.New("Signature request had empty message")
+	if sr.MessageHash != nil {
+		if sr.Message != "" {
+			return errors.New("Signature request cannot have both a message and a message hash")
+		}
+		if err := sr.MessageHash.Validate(); err != nil {
+			return errors.WrapPrefix(err, "Signature request had invalid message hash", 0)
+		}
+		if sr.MessageDisplay == "" {
+			return errors.New("Signature request had message hash but empty display message")
+		}
+		if !utf8.ValidString(sr.MessageDisplay) {
+			return errors.New("Signature request had display message that is not valid UTF-8")
+		}
+	} else {
+		if sr.MessageDisplay != "" {
+			return errors.New("Signature request had display message but no message hash")
+		}
+		if sr.Message == "" {
+			return errors.New("Signature request had empty message")
+		}
+	}
+	if sr.Mode != "" && sr.Mode != SignatureModeSession && sr.Mode != SignatureModeStandalone {
+		return errors.Errorf("Signature request had unknown mode %s", sr.Mode)
 	}
 	if len(sr.Disclose) == 0 {
 		return errors.New("Signature request had no attributes")
 	}
-	var err error
-	for _, discon := range sr.Disclose {
-		if err = discon.Validate(); err != nil {
-			return err
-		}
+	if _, err := sr.nonce(nil); err != nil {
+		return err
+	}
+	if err := sr.DisclosureRequest.validateDisclose(); err != nil {
+		return err
 	}
 	return nil
 }
@@ -1062,40 +1473,67 @@ func (claims *SignatureRequestorJwt) RequestorRequest() RequestorRequest { retur
 
 func (claims *IdentityProviderJwt) RequestorRequest() RequestorRequest { return claims.Request }
 
+// The Valid() methods below implement jwt.Claims. Having no access to a Configuration, they tolerate
+// the DefaultClockSkewTolerance; parse the JWTs with jwt.Parser.SkipClaimsValidation and use
+// ValidWithTolerance() to apply the ClockSkewTolerance() of a Configuration instead.
+
 func (claims *ServiceProviderJwt) Valid() error {
-	if claims.Type != "verification_request" {
+	return claims.ValidWithTolerance(DefaultClockSkewTolerance)
+}
 
+func (claims *SignatureRequestorJwt) Valid() error {
+	return claims.ValidWithTolerance(DefaultClockSkewTolerance)
+}
+
+func (claims *IdentityProviderJwt) Valid() error {
+	return claims.ValidWithTolerance(DefaultClockSkewTolerance)
+}
+
+func (claims *RevocationJwt) Valid() error {
+	return claims.ValidWithTolerance(DefaultClockSkewTolerance)
+}
+
+// ValidWithTolerance checks the subject of the JWT and that it was not issued in the future,
+// tolerating the specified clock skew.
+func (claims *ServiceProviderJwt) ValidWithTolerance(tolerance time.Duration) error {
+	if claims.Type != "verification_request" {
 		return errors.New("Verification jwt has invalid subject")
 	}
-	if time.Time(claims.IssuedAt).After(time.Now()) {
+	if time.Time(claims.IssuedAt).After(time.Now().Add(tolerance)) {
 		return errors.New("Verification jwt not yet valid")
 	}
 	return nil
 }
 
-func (claims *SignatureRequestorJwt) Valid() error {
+// ValidWithTolerance checks the subject of the JWT and that it was not issued in the future,
+// tolerating the specified clock skew.
+func (claims *SignatureRequestorJwt) ValidWithTolerance(tolerance time.Duration) error {
 	if claims.Type != "signature_request" {
 		return errors.New("Signature jwt has invalid subject")
 	}
-	if time.Time(claims.IssuedAt).After(time.Now()) {
+	if time.Time(claims.IssuedAt).After(time.Now().Add(tolerance)) {
 		return errors.New("Signature jwt not yet valid")
 	}
 	return nil
 }
 
-func (claims *IdentityProviderJwt) Valid() error {
+// ValidWithTolerance checks the subject of the JWT and that it was not issued in the future,
+// tolerating the specified clock skew.
+func (claims *IdentityProviderJwt) ValidWithTolerance(tolerance time.Duration) error {
 	if claims.Type != "issue_request" {
 		return errors.New("Issuance jwt has invalid subject")
 	}
-	if time.Time(claims.IssuedAt).After(time.Now()) {
+	if time.Time(claims.IssuedAt).After(time.Now().Add(tolerance)) {
 		return errors.New("Issuance jwt not yet valid")
 	}
 	return nil
 }
 
-func (claims *RevocationJwt) Valid() error {
-	if time.Time(claims.IssuedAt).After(time.Now()) {
-		return errors.New("Signature jwt not yet valid")
+// ValidWithTolerance checks that the JWT was not issued in the future, tolerating the specified
+// clock skew.
+func (claims *RevocationJwt) ValidWithTolerance(tolerance time.Duration) error {
+	if time.Time(claims.IssuedAt).After(time.Now().Add(tolerance)) {
+		return errors.New("Revocation jwt not yet valid")
 	}
 	return nil
 }
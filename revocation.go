@@ -801,6 +801,10 @@ func (rs *RevocationStorage) Close() error {
 	if rs.close != nil {
 		close(rs.close)
 	}
+	if rs.conf.stopScheduler != nil {
+		rs.conf.stopScheduler <- true
+		rs.conf.stopScheduler = nil
+	}
 	return rs.sqldb.Close()
 }
 
@@ -979,7 +983,7 @@ func (client RevocationClient) getMultiple(urls []string, path string, dest inte
 
 func (client RevocationClient) transport(forceHTTPS bool) *HTTPTransport {
 	if client.http == nil {
-		client.http = NewHTTPTransport("", forceHTTPS)
+		client.http = client.Conf.newHTTPTransport("", forceHTTPS)
 		client.http.Binary = true
 	}
 	return client.http
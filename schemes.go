@@ -62,7 +62,7 @@ type (
 		setPath(path string)
 		parseContents(conf *Configuration) error
 		validate(conf *Configuration) (error, SchemeManagerStatus)
-		update() error
+		update(conf *Configuration) error
 		handleUpdateFile(conf *Configuration, path, filename string, bts []byte, transport *HTTPTransport, _ *IrmaIdentifierSet) error
 		delete(conf *Configuration) error
 		add(conf *Configuration)
@@ -106,8 +106,16 @@ const (
 	SchemeTypeRequestor = SchemeType("requestor")
 
 	maxDepComplexity = 25
+
+	// File in the irma_configuration folder containing the newest seen timestamp of each scheme
+	schemeTimestampsFile = ".schemetimestamps.json"
 )
 
+// ErrSchemeRollback is returned when the signed timestamp of a remote scheme is older than the
+// timestamp of the scheme seen before, as an attacker serving an old copy of a scheme could roll
+// back clients and servers to e.g. retired issuer public keys. See DangerousRollbackScheme().
+var ErrSchemeRollback = errors.New("remote scheme is older than previously seen version")
+
 func (conf *Configuration) DownloadDefaultSchemes() error {
 	Logger.Info("downloading default schemes (may take a while)")
 	for _, s := range DefaultSchemes {
@@ -173,7 +181,21 @@ func (conf *Configuration) UpdateSchemes() error {
 // with the remote version at the scheme's URL, downloading and storing
 // new and modified files, according to the index files of both versions.
 // It stores the identifiers of new or updated entities in the second parameter.
+// Updates whose signed timestamp is older than the newest timestamp of the scheme seen before
+// are rejected with ErrSchemeRollback.
 func (conf *Configuration) UpdateScheme(scheme Scheme, downloaded *IrmaIdentifierSet) error {
+	return conf.updateScheme(scheme, downloaded, false)
+}
+
+// DangerousRollbackScheme updates the scheme to the remote version like UpdateScheme, but also if
+// the remote version is older than the stored version or than versions seen before. This should
+// only be used for genuine rollbacks of a scheme by its maintainer, as serving an old copy of the
+// scheme can be used to reintroduce e.g. retired issuer public keys.
+func (conf *Configuration) DangerousRollbackScheme(scheme Scheme) error {
+	return conf.updateScheme(scheme, nil, true)
+}
+
+func (conf *Configuration) updateScheme(scheme Scheme, downloaded *IrmaIdentifierSet, allowRollback bool) error {
 	if conf.readOnly {
 		return errors.New("cannot update a read-only configuration")
 	}
@@ -187,7 +209,7 @@ func (conf *Configuration) UpdateScheme(scheme Scheme, downloaded *IrmaIdentifie
 		schemepath = scheme.path()
 	)
 	Logger.WithFields(logrus.Fields{"scheme": id, "type": typ}).Info("checking for updates")
-	shouldUpdate, _, index, err := conf.checkRemoteScheme(scheme)
+	shouldUpdate, _, index, err := conf.checkRemoteScheme(scheme, allowRollback)
 	if err != nil {
 		return err
 	}
@@ -220,13 +242,16 @@ func (conf *Configuration) UpdateScheme(scheme Scheme, downloaded *IrmaIdentifie
 
 	// verify the updated scheme in the temp dir
 	var newconf *Configuration
-	if newconf, err = NewConfiguration(dir, ConfigurationOptions{}); err != nil {
+	if newconf, err = NewConfiguration(dir, ConfigurationOptions{
+		PinnedSchemeKeys:   conf.options.PinnedSchemeKeys,
+		ConfigureTransport: conf.options.ConfigureTransport,
+	}); err != nil {
 		return err
 	}
 	if scheme, err = newconf.ParseSchemeFolder(newschemepath); err != nil {
 		return err
 	}
-	if err = scheme.update(); err != nil {
+	if err = scheme.update(newconf); err != nil {
 		return err
 	}
 
@@ -237,7 +262,7 @@ func (conf *Configuration) UpdateScheme(scheme Scheme, downloaded *IrmaIdentifie
 
 	scheme.purge(conf)
 	conf.join(newconf)
-	return nil
+	return conf.recordSchemeTimestamp(scheme, allowRollback)
 }
 
 func (conf *Configuration) ParseSchemeFolder(dir string) (scheme Scheme, serr error) {
@@ -271,6 +296,10 @@ func (conf *Configuration) ParseSchemeFolder(dir string) (scheme Scheme, serr er
 		serr = &SchemeManagerError{Scheme: id, Status: status, Err: err}
 		return
 	}
+	if err = conf.verifyPinnedKey(scheme); err != nil {
+		serr = &SchemeManagerError{Scheme: id, Status: SchemeManagerStatusInvalidSignature, Err: err}
+		return
+	}
 	err = scheme.parseContents(conf)
 	if err != nil {
 		serr = &SchemeManagerError{Scheme: id, Err: err, Status: SchemeManagerStatusContentParsingError}
@@ -292,7 +321,7 @@ func (conf *Configuration) updateSchemeFiles(
 	scheme Scheme, index SchemeManagerIndex, newschemepath string, downloaded *IrmaIdentifierSet,
 ) error {
 	var (
-		transport = NewHTTPTransport(scheme.url(), true)
+		transport = conf.newHTTPTransport(scheme.url(), true)
 		oldIndex  = scheme.idx()
 		id        = scheme.id()
 	)
@@ -470,7 +499,7 @@ func (conf *Configuration) installScheme(url string, publickey []byte, dir strin
 		return errors.New("cannot install scheme into a read-only configuration")
 	}
 
-	scheme, err := downloadScheme(url)
+	scheme, err := conf.downloadScheme(url)
 	if err != nil {
 		return err
 	}
@@ -490,7 +519,7 @@ func (conf *Configuration) installScheme(url string, publickey []byte, dir strin
 			return err
 		}
 	} else {
-		if _, err := downloadFile(NewHTTPTransport(url, true), path, "pk.pem"); err != nil {
+		if _, err := downloadFile(conf.newHTTPTransport(url, true), path, "pk.pem"); err != nil {
 			return err
 		}
 	}
@@ -502,18 +531,26 @@ func (conf *Configuration) installScheme(url string, publickey []byte, dir strin
 	return conf.UpdateScheme(scheme, nil)
 }
 
-func (conf *Configuration) checkRemoteScheme(scheme Scheme) (bool, *Timestamp, SchemeManagerIndex, error) {
+func (conf *Configuration) checkRemoteScheme(scheme Scheme, allowRollback bool) (bool, *Timestamp, SchemeManagerIndex, error) {
 	timestamp, indexbts, sigbts, index, err := conf.checkRemoteTimestamp(scheme)
 	if err != nil {
 		return false, nil, nil, err
 	}
 	id := scheme.id()
 	typ := string(scheme.typ())
+	seen, err := conf.seenSchemeTimestamp(scheme)
+	if err != nil {
+		return false, nil, nil, err
+	}
+	if !allowRollback && seen != nil && timestamp.Before(*seen) {
+		return false, nil, nil, errors.WrapPrefix(ErrSchemeRollback,
+			fmt.Sprintf("remote %s scheme %s has timestamp %s, but %s was seen before", typ, id, timestamp, seen), 0)
+	}
 	timestampdiff := int64(timestamp.Sub(scheme.timestamp()))
 	if timestampdiff == 0 {
 		Logger.WithFields(logrus.Fields{"scheme": id, "type": typ}).Info("scheme is up-to-date, not updating")
 		return false, nil, index, nil
-	} else if timestampdiff < 0 {
+	} else if timestampdiff < 0 && !allowRollback {
 		Logger.WithFields(logrus.Fields{"scheme": id, "type": typ}).Info("local scheme is newer than remote, not updating")
 		return false, nil, index, nil
 	}
@@ -532,7 +569,7 @@ func (conf *Configuration) checkRemoteScheme(scheme Scheme) (bool, *Timestamp, S
 func (conf *Configuration) checkRemoteTimestamp(scheme Scheme) (
 	*Timestamp, []byte, []byte, SchemeManagerIndex, error,
 ) {
-	t := NewHTTPTransport(scheme.url(), true)
+	t := conf.newHTTPTransport(scheme.url(), true)
 	indexbts, err := t.GetBytes("index")
 	if err != nil {
 		return nil, nil, nil, nil, err
@@ -571,6 +608,66 @@ func (conf *Configuration) checkRemoteTimestamp(scheme Scheme) (
 	return timestamp, indexbts, sig, index, nil
 }
 
+// seenSchemeTimestamp returns the newest timestamp of the scheme that was installed or updated
+// before, if any. These are kept in a file in the irma_configuration folder, so that they outlive
+// the scheme folders which may be deleted, e.g. to reinstall a scheme.
+func (conf *Configuration) seenSchemeTimestamp(scheme Scheme) (*Timestamp, error) {
+	conf.timestampsMutex.Lock()
+	defer conf.timestampsMutex.Unlock()
+
+	timestamps, err := conf.readSchemeTimestamps()
+	if err != nil {
+		return nil, err
+	}
+	unix, ok := timestamps[scheme.typ()][scheme.id()]
+	if !ok {
+		return nil, nil
+	}
+	ts := Timestamp(time.Unix(unix, 0))
+	return &ts, nil
+}
+
+// recordSchemeTimestamp records the timestamp of the scheme if it is newer than the timestamps
+// of the scheme seen before, or always if overwrite is set.
+func (conf *Configuration) recordSchemeTimestamp(scheme Scheme, overwrite bool) error {
+	conf.timestampsMutex.Lock()
+	defer conf.timestampsMutex.Unlock()
+
+	timestamps, err := conf.readSchemeTimestamps()
+	if err != nil {
+		return err
+	}
+	ts := scheme.timestamp()
+	unix := time.Time(ts).Unix()
+	if seen, ok := timestamps[scheme.typ()][scheme.id()]; ok && seen >= unix && !overwrite {
+		return nil
+	}
+	if timestamps[scheme.typ()] == nil {
+		timestamps[scheme.typ()] = map[string]int64{}
+	}
+	timestamps[scheme.typ()][scheme.id()] = unix
+	bts, err := json.Marshal(timestamps)
+	if err != nil {
+		return err
+	}
+	return common.SaveFile(filepath.Join(conf.Path, schemeTimestampsFile), bts)
+}
+
+func (conf *Configuration) readSchemeTimestamps() (map[SchemeType]map[string]int64, error) {
+	timestamps := map[SchemeType]map[string]int64{}
+	bts, err := ioutil.ReadFile(filepath.Join(conf.Path, schemeTimestampsFile))
+	if os.IsNotExist(err) {
+		return timestamps, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(bts, &timestamps); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to parse seen scheme timestamps", 0)
+	}
+	return timestamps, nil
+}
+
 func (conf *Configuration) writeIndex(dest string, indexbts, sigbts []byte) error {
 	if err := common.EnsureDirectoryExists(dest); err != nil {
 		return err
@@ -651,6 +748,27 @@ func (conf *Configuration) verifySignature(dir string) (err error) {
 	return signed.Verify(pk, indexbts, sig)
 }
 
+// verifyPinnedKey checks that the scheme is signed with its key in ConfigurationOptions.PinnedSchemeKeys,
+// if any. As verifySignature checks the signature against the pk.pem of the scheme, it suffices to
+// compare that key.
+func (conf *Configuration) verifyPinnedKey(scheme Scheme) error {
+	if scheme.typ() != SchemeTypeIssuer {
+		return nil
+	}
+	pinned := conf.options.PinnedSchemeKeys[NewSchemeManagerIdentifier(scheme.id())]
+	if pinned == nil {
+		return nil
+	}
+	pk, err := conf.schemePublicKey(scheme.path())
+	if err != nil {
+		return err
+	}
+	if !pk.Equal(pinned) {
+		return errors.Errorf("scheme %s is not signed with its pinned public key", scheme.id())
+	}
+	return nil
+}
+
 func (conf *Configuration) schemePublicKey(dir string) (*ecdsa.PublicKey, error) {
 	pkbts, err := ioutil.ReadFile(filepath.Join(dir, "pk.pem"))
 	if err != nil {
@@ -766,7 +884,7 @@ func dirInScheme(index SchemeManagerIndex, dir string) bool {
 	return false
 }
 
-func downloadScheme(url string) (Scheme, error) {
+func (conf *Configuration) downloadScheme(url string) (Scheme, error) {
 	if url[len(url)-1] == '/' {
 		url = url[:len(url)-1]
 	}
@@ -784,7 +902,7 @@ func downloadScheme(url string) (Scheme, error) {
 		if strings.HasSuffix(url, "/"+filename) {
 			u = url[:len(url)-1-len(filename)]
 		}
-		b, err := NewHTTPTransport(u, true).GetBytes(filename)
+		b, err := conf.newHTTPTransport(u, true).GetBytes(filename)
 		if err != nil {
 			if err.(*SessionError).RemoteStatus == 404 {
 				continue
@@ -1020,6 +1138,11 @@ func (scheme *SchemeManager) validate(conf *Configuration) (error, SchemeManager
 			return errors.Errorf("Scheme %s has keyshare URL but no keyshare public key kss-0.pem", scheme.ID), SchemeManagerStatusParsingError
 		}
 	}
+	if scheme.KeyshareRegistration != nil {
+		if err := scheme.KeyshareRegistration.validate(); err != nil {
+			return errors.Errorf("Scheme %s has invalid keyshare registration policy: %v", scheme.ID, err), SchemeManagerStatusParsingError
+		}
+	}
 	conf.validateTranslations(fmt.Sprintf("Scheme %s", scheme.ID), scheme, scheme.Languages)
 
 	// Verify that all other files are validly signed
@@ -1030,8 +1153,8 @@ func (scheme *SchemeManager) validate(conf *Configuration) (error, SchemeManager
 	return nil, SchemeManagerStatusValid
 }
 
-func (scheme *SchemeManager) update() error {
-	return scheme.downloadDemoPrivateKeys()
+func (scheme *SchemeManager) update(conf *Configuration) error {
+	return scheme.downloadDemoPrivateKeys(conf)
 }
 
 func (scheme *SchemeManager) handleUpdateFile(conf *Configuration, _, filename string, _ []byte, _ *HTTPTransport, downloaded *IrmaIdentifierSet) error {
@@ -1226,13 +1349,13 @@ func (scheme *SchemeManager) parseCredentialsFolder(conf *Configuration, issuer
 // downloadDemoPrivateKeys attempts to download the scheme and issuer private keys, if the scheme is
 // a demo scheme and if they are not already present in the scheme, without failing if any of them
 // is not available.
-func (scheme *SchemeManager) downloadDemoPrivateKeys() error {
+func (scheme *SchemeManager) downloadDemoPrivateKeys(conf *Configuration) error {
 	if !scheme.Demo {
 		return nil
 	}
 
 	Logger.WithField("scheme", scheme.ID).Debugf("Attempting downloading of private keys")
-	transport := NewHTTPTransport(scheme.URL, true)
+	transport := conf.newHTTPTransport(scheme.URL, true)
 
 	_, err := downloadFile(transport, scheme.path(), "sk.pem")
 	if err != nil { // If downloading of any of the private key fails just log it, and then continue
@@ -1384,7 +1507,7 @@ func (scheme *RequestorScheme) checkLogo(conf *Configuration, logo string) (erro
 	return nil, ""
 }
 
-func (scheme *RequestorScheme) update() error {
+func (scheme *RequestorScheme) update(*Configuration) error {
 	return nil
 }
 
@@ -2,11 +2,15 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"net"
 	"net/http"
 	"reflect"
@@ -14,12 +18,12 @@ import (
 	"runtime/debug"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-errors/errors"
 	"github.com/golang-jwt/jwt/v4"
 	irma "github.com/privacybydesign/irmago"
-	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/sirupsen/logrus"
 	prefixed "github.com/x-cray/logrus-prefixed-formatter"
 )
@@ -43,18 +47,46 @@ type SessionResult struct {
 	Signature   *irma.SignedMessage          `json:"signature,omitempty"`
 	Err         *irma.RemoteError            `json:"error,omitempty"`
 	NextSession irma.RequestorToken          `json:"nextSession,omitempty"`
+	ProofAge    int64                        `json:"proofAge,omitempty"`  // milliseconds between sending the request to the client and receiving its proofs
+	Requestor   string                       `json:"requestor,omitempty"` // name of the authenticated requestor that started the session, if any
+	Template    string                       `json:"template,omitempty"`  // name of the request template from which the session was started, if any
+	Redacted    bool                         `json:"redacted,omitempty"`  // whether the attribute values were hashed or removed, see LoggedResult
+	Deleted     bool                         `json:"deleted,omitempty"`   // whether the attributes and signature were deleted after being read, see DeletedResult
+
+	// Reasons why the proofs are not valid, if so, per credential where applicable.
+	// Omitted from result JWTs unless RequestorBaseRequest.ResultJwtProofDetails is set.
+	ProofDetails []ProofIssue `json:"proofDetails,omitempty"`
+
+	// Issuance sessions: the outcome per requested credential, and whether some but not all
+	// of the credentials could be issued (which is only possible if IssuanceRequest.StrictIssuance is false)
+	Credentials     []*CredentialIssuanceResult `json:"credentials,omitempty"`
+	PartiallyIssued bool                        `json:"partiallyIssued,omitempty"`
 
 	LegacySession bool `json:"-"` // true if request was started with legacy (i.e. pre-condiscon) session request
 }
 
+// CredentialIssuanceResult is the outcome of issuing one of the credentials of an issuance session.
+type CredentialIssuanceResult struct {
+	CredentialTypeID irma.CredentialTypeIdentifier `json:"credential"`
+	Issued           bool                          `json:"issued"`
+	Err              *irma.RemoteError             `json:"error,omitempty"`
+}
+
 // SessionHandler is a function that can handle a session result
 // once an IRMA session has completed.
 type SessionHandler func(*SessionResult)
 
 type LogOptions struct {
 	Response, Headers, From, EncodeBinary bool
+	// Proxies whose forwarding headers are trusted to determine the client address logged if From is set
+	TrustedProxies TrustedProxies
+	// Maximum amount of bytes of request and response bodies that is logged
+	// (default value 0 means DefaultLogMaxBodySize, negative means no limit)
+	MaxBodySize int
 }
 
+const DefaultLogMaxBodySize = 16 * 1024
+
 // Remove this when dropping support for legacy pre-condiscon session requests
 type LegacySessionResult struct {
 	Token       irma.RequestorToken        `json:"token"`
@@ -80,15 +112,61 @@ const (
 
 var PostSizeLimit int64 = 10 << 20 // 10 MB
 
+// GzipThreshold is the response size in bytes above which WriteJson and WriteString gzip
+// compress the response, if the request is passed to them and the client accepts that.
+var GzipThreshold = 1 << 10 // 1 KB
+
 // Remove this when dropping support for legacy pre-condiscon session requests
 func (r *SessionResult) Legacy() *LegacySessionResult {
 	var disclosed []*irma.DisclosedAttribute
 	for _, l := range r.Disclosed {
-		disclosed = append(disclosed, l[0])
+		if len(l) > 0 {
+			disclosed = append(disclosed, l[0])
+		}
 	}
 	return &LegacySessionResult{r.Token, r.Status, r.Type, r.ProofStatus, disclosed, r.Signature, r.Err}
 }
 
+// FilteredResult returns a copy of the session result containing only the disclosed attributes of
+// the specified types. The structure of Disclosed is kept: it contains a list of attributes for each
+// disjunction of the request, which is empty if none of its attributes are included.
+func FilteredResult(result *SessionResult, attrs []irma.AttributeTypeIdentifier) *SessionResult {
+	if result == nil || result.Disclosed == nil {
+		return result
+	}
+	include := make(map[irma.AttributeTypeIdentifier]struct{}, len(attrs))
+	for _, attr := range attrs {
+		include[attr] = struct{}{}
+	}
+
+	filtered := *result
+	filtered.Disclosed = make([][]*irma.DisclosedAttribute, len(result.Disclosed))
+	for i, l := range result.Disclosed {
+		filtered.Disclosed[i] = []*irma.DisclosedAttribute{}
+		for _, attr := range l {
+			if _, ok := include[attr.Identifier]; ok {
+				filtered.Disclosed[i] = append(filtered.Disclosed[i], attr)
+			}
+		}
+	}
+	return &filtered
+}
+
+// FlatResult returns the values of the disclosed attributes of the session result by their type,
+// which are nil for optional attributes without a value.
+func FlatResult(result *SessionResult) map[irma.AttributeTypeIdentifier]*string {
+	values := map[irma.AttributeTypeIdentifier]*string{}
+	if result == nil {
+		return values
+	}
+	for _, l := range result.Disclosed {
+		for _, attr := range l {
+			values[attr.Identifier] = attr.RawValue
+		}
+	}
+	return values
+}
+
 // RemoteError converts an error and an explaining message to an *irma.RemoteError.
 func RemoteError(err Error, message string) *irma.RemoteError {
 	var stack string
@@ -141,9 +219,20 @@ func WriteError(w http.ResponseWriter, err Error, msg string) {
 	WriteResponse(w, nil, RemoteError(err, msg))
 }
 
-// WriteJson writes the specified object as JSON to the http.ResponseWriter.
-func WriteJson(w http.ResponseWriter, object interface{}) {
-	WriteResponse(w, object, nil)
+// WriteJson writes the specified object as JSON to the http.ResponseWriter. If the request is
+// specified, the response is gzip compressed if it exceeds GzipThreshold and the request accepts
+// gzip encoding. Meant for responses that may become large, such as session results.
+func WriteJson(w http.ResponseWriter, object interface{}, r ...*http.Request) {
+	if len(r) == 0 {
+		WriteResponse(w, object, nil)
+		return
+	}
+	status, bts := JsonResponse(object, nil)
+	if status != http.StatusOK {
+		WriteError(w, ErrorInternal, "")
+		return
+	}
+	writeCompressed(w, r[0], "application/json", bts)
 }
 
 func WriteBinaryResponse(w http.ResponseWriter, object interface{}, rerr *irma.RemoteError) {
@@ -164,9 +253,14 @@ func WriteResponse(w http.ResponseWriter, object interface{}, rerr *irma.RemoteE
 	}
 }
 
-// WriteString writes the specified string to the http.ResponseWriter.
-func WriteString(w http.ResponseWriter, str string) {
-	w.Header().Set("Content-Type", "text/plain")
+// WriteString writes the specified string to the http.ResponseWriter. If the request is specified,
+// the response is gzip compressed as in WriteJson.
+func WriteString(w http.ResponseWriter, str string, r ...*http.Request) {
+	if len(r) > 0 {
+		writeCompressed(w, r[0], "text/plain; charset=utf-8", []byte(str))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	_, err := w.Write([]byte(str))
 	if err != nil {
@@ -174,6 +268,75 @@ func WriteString(w http.ResponseWriter, str string) {
 	}
 }
 
+// WriteCacheable writes the specified content with the specified content type and ETag to the
+// http.ResponseWriter, or responds with 304 Not Modified if the request has a matching If-None-Match header.
+func WriteCacheable(w http.ResponseWriter, r *http.Request, contentType string, etag string, content []byte) {
+	w.Header().Set("ETag", etag)
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if match = strings.TrimSpace(match); match == etag || match == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(content); err != nil {
+		_ = LogWarning(errors.WrapPrefix(err, "failed to write response", 0))
+	}
+}
+
+// writeCompressed writes the specified content to the http.ResponseWriter, gzip compressing it
+// if it exceeds GzipThreshold and the request accepts gzip encoding.
+func writeCompressed(w http.ResponseWriter, r *http.Request, contentType string, content []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept-Encoding")
+	if len(content) <= GzipThreshold || !acceptsGzip(r) {
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(content); err != nil {
+			_ = LogWarning(errors.WrapPrefix(err, "failed to write response", 0))
+		}
+		return
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.WriteHeader(http.StatusOK)
+	gz := gzip.NewWriter(w)
+	_, err := gz.Write(content)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		_ = LogWarning(errors.WrapPrefix(err, "failed to write response", 0))
+	}
+}
+
+// RemoteIP returns the IP address of the client that sent the request (or of the reverse proxy in front of us).
+// Use TrustedProxies.ClientIP to obtain the address of the client behind trusted reverse proxies.
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// acceptsGzip returns whether the Accept-Encoding header of the request includes gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, encoding := range strings.Split(header, ",") {
+			parts := strings.Split(encoding, ";")
+			if strings.TrimSpace(parts[0]) != "gzip" {
+				continue
+			}
+			if len(parts) > 1 && strings.ReplaceAll(parts[1], " ", "") == "q=0" {
+				return false
+			}
+			return true
+		}
+	}
+	return false
+}
+
 // ParseSessionRequest attempts to parse the input as an irma.RequestorRequest instance, accepting (skipping "irma.")
 //  - RequestorRequest instances directly (ServiceProviderRequest, SignatureRequestorRequest, IdentityProviderRequest)
 //  - SessionRequest instances (DisclosureRequest, SignatureRequest, IssuanceRequest)
@@ -197,61 +360,126 @@ func parseInput(request interface{}) (irma.RequestorRequest, error) {
 	case string:
 		return parseInput([]byte(r))
 	case []byte:
-		var isRequestorRequest bool
-		context, err := common.ParseLDContext(r)
-		if err != nil {
-			return nil, err
-		}
-		if context == "" {
-			context, err = common.ParseNestedLDContext(r)
-			if err != nil {
-				return nil, err
-			}
-			if context != "" {
-				isRequestorRequest = true
-			}
+		return parseRequestJSON(r)
+	default:
+		return nil, errors.New("Invalid request type")
+	}
+}
+
+// Kinds of SessionRequestError
+var (
+	ErrRequestInvalidJSON = errors.New("request is not valid JSON")
+	ErrRequestUnknownType = errors.New("unknown request type")
+	ErrRequestInvalid     = errors.New("invalid request")
+)
+
+// SessionRequestError is returned by ParseSessionRequest when a JSON request cannot be parsed.
+// Kind is ErrRequestInvalidJSON, ErrRequestUnknownType or ErrRequestInvalid, which can be checked
+// using errors.Is of the standard library. Err is the underlying error, e.g. the JSON syntax error
+// or the validation error of the request, and Attempted contains the types as which parsing the
+// request was attempted (e.g. irma.DisclosureRequest), if any.
+type SessionRequestError struct {
+	Kind      error
+	Attempted []string
+	Err       error
+}
+
+func (e *SessionRequestError) Error() string {
+	msg := e.Kind.Error()
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	if len(e.Attempted) > 0 {
+		msg += " (attempted " + strings.Join(e.Attempted, ", ") + ")"
+	}
+	return msg
+}
+
+func (e *SessionRequestError) Unwrap() error {
+	return e.Err
+}
+
+func (e *SessionRequestError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// requestEnvelope contains the fields of a JSON session request or requestor request that determine
+// its type: the @context of the (nested) session request, or for legacy requests, their type.
+type requestEnvelope struct {
+	LDContext string      `json:"@context"`
+	Type      irma.Action `json:"type"`
+	Request   *struct {
+		LDContext string      `json:"@context"`
+		Type      irma.Action `json:"type"`
+	} `json:"request"`
+}
+
+// parseRequestJSON parses a session request or requestor request, of the type indicated by its
+// @context, or if absent, as a legacy request.
+func parseRequestJSON(bts []byte) (irma.RequestorRequest, error) {
+	var envelope requestEnvelope
+	if err := json.Unmarshal(bts, &envelope); err != nil {
+		if _, ok := err.(*json.UnmarshalTypeError); ok {
+			// Valid JSON, but not an object or having fields of the wrong type
+			return nil, &SessionRequestError{Kind: ErrRequestInvalid, Err: err}
 		}
+		return nil, &SessionRequestError{Kind: ErrRequestInvalidJSON, Err: err}
+	}
 
-		if context == "" {
-			return parseLegacySessionRequest(r)
+	var attempt irma.Validator
+	switch {
+	case envelope.LDContext != "":
+		switch envelope.LDContext {
+		case irma.LDContextDisclosureRequest:
+			attempt = &irma.DisclosureRequest{}
+		case irma.LDContextSignatureRequest:
+			attempt = &irma.SignatureRequest{}
+		case irma.LDContextIssuanceRequest:
+			attempt = &irma.IssuanceRequest{}
+		default:
+			return nil, &SessionRequestError{Kind: ErrRequestUnknownType, Err: errors.Errorf("unknown @context %s", envelope.LDContext)}
+		}
+	case envelope.Request != nil && envelope.Request.LDContext != "":
+		switch envelope.Request.LDContext {
+		case irma.LDContextDisclosureRequest:
+			attempt = &irma.ServiceProviderRequest{}
+		case irma.LDContextSignatureRequest:
+			attempt = &irma.SignatureRequestorRequest{}
+		case irma.LDContextIssuanceRequest:
+			attempt = &irma.IdentityProviderRequest{}
+		default:
+			return nil, &SessionRequestError{Kind: ErrRequestUnknownType, Err: errors.Errorf("unknown @context %s", envelope.Request.LDContext)}
 		}
+	default:
+		attempts, err := legacyRequestAttempts(envelope)
+		if err != nil {
+			return nil, err
+		}
+		return parseRequestAttempts(bts, attempts)
+	}
+	return parseRequestAttempts(bts, []irma.Validator{attempt})
+}
 
-		if isRequestorRequest {
-			var msg irma.RequestorRequest
-			switch context {
-			case irma.LDContextDisclosureRequest:
-				msg = &irma.ServiceProviderRequest{}
-			case irma.LDContextSignatureRequest:
-				msg = &irma.SignatureRequestorRequest{}
-			case irma.LDContextIssuanceRequest:
-				msg = &irma.IdentityProviderRequest{}
-			default:
-				return nil, errors.New("Invalid requestor request type")
-			}
-			if err := irma.UnmarshalValidate(r, msg); err != nil {
-				return nil, err
-			}
-			return msg, nil
-		} else {
-			var msg irma.SessionRequest
-			switch context {
-			case irma.LDContextDisclosureRequest:
-				msg = &irma.DisclosureRequest{}
-			case irma.LDContextSignatureRequest:
-				msg = &irma.SignatureRequest{}
-			case irma.LDContextIssuanceRequest:
-				msg = &irma.IssuanceRequest{}
-			default:
-				return nil, errors.New("Invalid session request type")
+// parseRequestAttempts returns the first of the attempted request types as which the request
+// can be parsed and validated.
+func parseRequestAttempts(bts []byte, attempts []irma.Validator) (irma.RequestorRequest, error) {
+	var names, errs []string
+	var err error
+	for _, attempt := range attempts {
+		if err = irma.UnmarshalValidate(bts, attempt); err == nil {
+			if rr, ok := attempt.(irma.RequestorRequest); ok {
+				return rr, nil
 			}
-			if err := irma.UnmarshalValidate(r, msg); err != nil {
-				return nil, err
-			}
-			return wrapSessionRequest(msg)
+			return wrapSessionRequest(attempt.(irma.SessionRequest))
 		}
-	default:
-		return nil, errors.New("Invalid request type")
+		name := reflect.TypeOf(attempt).Elem().String()
+		names = append(names, name)
+		errs = append(errs, name+": "+err.Error())
+	}
+	if len(attempts) > 1 {
+		err = errors.New(strings.Join(errs, "; "))
 	}
+	return nil, &SessionRequestError{Kind: ErrRequestInvalid, Attempted: names, Err: err}
 }
 
 func wrapSessionRequest(request irma.SessionRequest) (irma.RequestorRequest, error) {
@@ -321,7 +549,15 @@ func TypeString(x interface{}) string {
 	return reflect.TypeOf(x).String()
 }
 
-func ResultJwt(sessionresult *SessionResult, issuer string, validity int, privatekey *rsa.PrivateKey) (string, error) {
+// ResultJwt returns the session result as a JWT signed with the private key. Proof details are
+// omitted (because of their size) unless proofDetails is true.
+func ResultJwt(sessionresult *SessionResult, issuer string, validity int, privatekey *rsa.PrivateKey, proofDetails bool) (string, error) {
+	if !proofDetails && sessionresult.ProofDetails != nil {
+		withoutDetails := *sessionresult
+		withoutDetails.ProofDetails = nil
+		sessionresult = &withoutDetails
+	}
+
 	standardclaims := jwt.StandardClaims{
 		Issuer:   issuer,
 		IssuedAt: time.Now().Unix(),
@@ -347,7 +583,10 @@ func ResultJwt(sessionresult *SessionResult, issuer string, validity int, privat
 	return token.SignedString(privatekey)
 }
 
-func DoResultCallback(callbackUrl string, result *SessionResult, issuer string, validity int, privatekey *rsa.PrivateKey) {
+// DoResultCallback POSTs the session result, or a JWT containing it if privatekey is set, to the
+// requestor-supplied callback URL, through the specified Egress. Failures are logged, and returned
+// so that the caller knows whether the result was delivered.
+func DoResultCallback(egress *Egress, callbackUrl string, result *SessionResult, issuer string, validity int, privatekey *rsa.PrivateKey, proofDetails bool) error {
 	logger := Logger.WithFields(logrus.Fields{"session": result.Token, "callbackUrl": callbackUrl})
 	if !strings.HasPrefix(callbackUrl, "https") {
 		logger.Warn("POSTing session result to callback URL without TLS: attributes are unencrypted in traffic")
@@ -358,23 +597,28 @@ func DoResultCallback(callbackUrl string, result *SessionResult, issuer string,
 	var res interface{}
 	if privatekey != nil {
 		var err error
-		res, err = ResultJwt(result, issuer, validity, privatekey)
+		res, err = ResultJwt(result, issuer, validity, privatekey, proofDetails)
 		if err != nil {
-			_ = LogError(errors.WrapPrefix(err, "Failed to create JWT for result callback", 0))
-			return
+			return LogError(errors.WrapPrefix(err, "Failed to create JWT for result callback", 0))
 		}
 	} else {
 		res = result
 	}
 
-	if err := irma.NewHTTPTransport(callbackUrl, false).Post("", nil, res); err != nil {
+	transport := egress.Transport(callbackUrl, false, true)
+	transport.LoggedBody = LoggedResult(result)
+	if err := transport.Post("", nil, res); err != nil {
 		// not our problem, log it and go on
-		logger.Warn(errors.WrapPrefix(err, "Failed to POST session result to callback URL", 0))
+		err = errors.WrapPrefix(err, "Failed to POST session result to callback URL", 0)
+		logger.Warn(err)
+		return err
 	}
+	return nil
 }
 
 func log(level logrus.Level, err error) error {
 	writer := Logger.WithFields(logrus.Fields{"err": TypeString(err)}).WriterLevel(level)
+	defer writer.Close()
 	if e, ok := err.(*errors.Error); ok && Logger.IsLevelEnabled(logrus.DebugLevel) {
 		_, _ = writer.Write([]byte(e.ErrorStack()))
 	} else {
@@ -402,7 +646,9 @@ func LogWarning(err error) error {
 	return log(logrus.WarnLevel, err)
 }
 
-func LogRequest(typ, proto, method, url, from string, headers http.Header, message []byte) {
+// LogRequest logs the request at trace level. If binary is true the message is hex encoded,
+// and messages larger than maxBodySize bytes are truncated (see LogOptions.MaxBodySize).
+func LogRequest(typ, proto, method, url, from string, headers http.Header, binary bool, message []byte, maxBodySize int) {
 	fields := logrus.Fields{
 		"type":   typ,
 		"proto":  proto,
@@ -413,11 +659,7 @@ func LogRequest(typ, proto, method, url, from string, headers http.Header, messa
 		fields["headers"] = headers
 	}
 	if len(message) > 0 {
-		if headers.Get("Content-Type") == "application/octet-stream" {
-			fields["message"] = hex.EncodeToString(message)
-		} else {
-			fields["message"] = string(message)
-		}
+		addBodyFields(fields, "message", message, binary, maxBodySize)
 	}
 	if from != "" {
 		fields["from"] = from
@@ -425,17 +667,16 @@ func LogRequest(typ, proto, method, url, from string, headers http.Header, messa
 	Logger.WithFields(fields).Tracef("=> request")
 }
 
-func LogResponse(url string, status int, duration time.Duration, binary bool, response []byte) {
+// LogResponse logs the response, at trace level if the status indicates success and as warning
+// otherwise. If binary is true the response is hex encoded, and responses larger than maxBodySize
+// bytes are truncated (see LogOptions.MaxBodySize).
+func LogResponse(url string, status int, duration time.Duration, binary bool, response []byte, maxBodySize int) {
 	fields := logrus.Fields{
 		"status":   status,
 		"duration": duration.String(),
 	}
 	if len(response) > 0 {
-		if binary {
-			fields["response"] = hex.EncodeToString(response)
-		} else {
-			fields["response"] = string(response)
-		}
+		addBodyFields(fields, "response", response, binary, maxBodySize)
 	}
 	l := Logger.WithFields(fields)
 	if status < 400 {
@@ -445,6 +686,65 @@ func LogResponse(url string, status int, duration time.Duration, binary bool, re
 	}
 }
 
+// IsBinaryBody returns whether the body should be considered binary when logging it:
+// either it is not valid UTF-8, or its content type is not a textual one.
+func IsBinaryBody(body []byte, contentType string) bool {
+	if !utf8.Valid(body) {
+		return true
+	}
+	if contentType == "" {
+		return false
+	}
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediatype, "text/"),
+		strings.HasSuffix(mediatype, "+json"),
+		strings.HasSuffix(mediatype, "+xml"):
+		return false
+	}
+	switch mediatype {
+	case "application/json", "application/xml", "application/javascript",
+		"application/x-www-form-urlencoded", "application/jwt":
+		return false
+	}
+	return true
+}
+
+// addBodyFields adds the (possibly truncated and hex encoded) body to the log fields under the
+// specified name, along with the SHA-256 hash of the full body.
+func addBodyFields(fields logrus.Fields, name string, body []byte, binary bool, maxBodySize int) {
+	if maxBodySize == 0 {
+		maxBodySize = DefaultLogMaxBodySize
+	}
+	hash := sha256.Sum256(body)
+	fields[name+"_sha256"] = hex.EncodeToString(hash[:])
+
+	logged, truncated := body, false
+	if maxBodySize > 0 && len(body) > maxBodySize {
+		logged, truncated = body[:maxBodySize], true
+		if !binary {
+			// Avoid cutting a multibyte UTF-8 character in half
+			for len(logged) > 0 && !utf8.Valid(logged) {
+				logged = logged[:len(logged)-1]
+			}
+		}
+	}
+
+	var str string
+	if binary {
+		str = hex.EncodeToString(logged)
+	} else {
+		str = string(logged)
+	}
+	if truncated {
+		str += fmt.Sprintf("...<truncated, %d bytes total>", len(body))
+	}
+	fields[name] = str
+}
+
 func ToJson(o interface{}) string {
 	bts, _ := json.Marshal(o)
 	return string(bts)
@@ -478,21 +778,69 @@ func SizeLimitMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func TimeoutMiddleware(except []string, timeout time.Duration) func(http.Handler) http.Handler {
+// TimeoutMiddleware aborts the handling of requests that take longer than the specified timeout,
+// responding with ErrorTimeout. Requests whose path ends with one of the keys of the timeouts map
+// get the corresponding timeout instead, so that route groups can have their own timeouts; a
+// timeout of 0 disables the timeout, e.g. for server-sent event streams. The keys must not be
+// suffixes of each other.
+func TimeoutMiddleware(timeouts map[string]time.Duration, timeout time.Duration) func(http.Handler) http.Handler {
+	body, _ := json.Marshal(&irma.RemoteError{
+		Status:      ErrorTimeout.Status,
+		ErrorName:   string(ErrorTimeout.Type),
+		Description: ErrorTimeout.Description,
+	})
 	return func(next http.Handler) http.Handler {
-		timeoutNext := http.TimeoutHandler(next, timeout, "")
+		withTimeout := func(timeout time.Duration) http.Handler {
+			if timeout == 0 {
+				return next
+			}
+			timeoutNext := http.TimeoutHandler(next, timeout, string(body))
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				timeoutNext.ServeHTTP(&timeoutResponseWriter{ResponseWriter: w, r: r}, r)
+			})
+		}
+		handlers := make(map[string]http.Handler, len(timeouts))
+		for suffix, t := range timeouts {
+			handlers[suffix] = withTimeout(t)
+		}
+		defaultHandler := withTimeout(timeout)
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			for _, e := range except {
-				if strings.HasSuffix(r.URL.Path, e) {
-					next.ServeHTTP(w, r)
+			for suffix, handler := range handlers {
+				if strings.HasSuffix(r.URL.Path, suffix) {
+					handler.ServeHTTP(w, r)
 					return
 				}
 			}
-			timeoutNext.ServeHTTP(w, r)
+			defaultHandler.ServeHTTP(w, r)
 		})
 	}
 }
 
+// timeoutResponseWriter sets the content type of the ErrorTimeout response that
+// http.TimeoutHandler writes when a request times out, which it writes without content type.
+type timeoutResponseWriter struct {
+	http.ResponseWriter
+	r *http.Request
+}
+
+func (w *timeoutResponseWriter) WriteHeader(status int) {
+	if status == ErrorTimeout.Status && w.Header().Get("Content-Type") == "" {
+		Logger.WithField("path", w.r.URL.Path).Warn("Request timed out")
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+type loggedResponseKey struct{}
+
+// SetLoggedResponse makes LogMiddleware log the specified response, marshaled to JSON, instead of
+// the response actually written, for responses containing data that should not be logged as is.
+func SetLoggedResponse(r *http.Request, response interface{}) {
+	if logged, ok := r.Context().Value(loggedResponseKey{}).(*interface{}); ok {
+		*logged = response
+	}
+}
+
 // LogMiddleware is middleware for logging HTTP requests and responses.
 func LogMiddleware(typ string, opts LogOptions) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -515,16 +863,22 @@ func LogMiddleware(typ string, opts LogOptions) func(next http.Handler) http.Han
 				}
 				if opts.From {
 					from = r.RemoteAddr
+					if client := opts.TrustedProxies.ClientIP(r); client != RemoteIP(r) {
+						from = client + " via " + r.RemoteAddr
+					}
 				}
-				LogRequest(typ, r.Proto, r.Method, r.URL.String(), from, headers, message)
+				binary := IsBinaryBody(message, r.Header.Get("Content-Type"))
+				LogRequest(typ, r.Proto, r.Method, r.URL.String(), from, headers, binary, message, opts.MaxBodySize)
 			}
 
 			// copy output of HTTP handler to our buffer for later logging
 			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
 			var buf *bytes.Buffer
+			var logged interface{}
 			if opts.Response {
 				buf = new(bytes.Buffer)
 				ww.Tee(buf)
+				r = r.WithContext(context.WithValue(r.Context(), loggedResponseKey{}, &logged))
 			}
 
 			// print response afterwards
@@ -536,15 +890,17 @@ func LogMiddleware(typ string, opts LogOptions) func(next http.Handler) http.Han
 				}
 				if opts.Response && ww.BytesWritten() > 0 {
 					resp = buf.Bytes()
+					if logged != nil {
+						resp, _ = json.Marshal(logged)
+					}
 				}
 				if ww.Status() >= 400 {
 					resp = nil // avoid printing stacktraces and SSE in response
 				}
-				var hexencode bool
-				if opts.EncodeBinary && ww.Header().Get("Content-Type") != "application/json" {
-					hexencode = true
-				}
-				LogResponse(r.URL.String(), ww.Status(), time.Since(start), hexencode, resp)
+				// Compressed responses are not readable, so log them hex encoded
+				compressed := ww.Header().Get("Content-Encoding") != ""
+				hexencode := (opts.EncodeBinary || compressed) && IsBinaryBody(resp, ww.Header().Get("Content-Type"))
+				LogResponse(r.URL.String(), ww.Status(), time.Since(start), hexencode, resp, opts.MaxBodySize)
 			}()
 
 			// start timer and preform request
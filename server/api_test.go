@@ -1,16 +1,24 @@
 package server
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/privacybydesign/irmago"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/require"
 )
 
@@ -81,7 +89,62 @@ func TestParseSessionRequest(t *testing.T) {
 
 	t.Run("invalid string", func(t *testing.T) {
 		_, err := ParseSessionRequest(`{"foo": "bar"}`)
-		require.Error(t, err)
+		require.ErrorIs(t, err, ErrRequestInvalid)
+		require.Len(t, err.(*SessionRequestError).Attempted, 6)
+	})
+
+	t.Run("invalid json", func(t *testing.T) {
+		_, err := ParseSessionRequest(`{"@context": `)
+		require.ErrorIs(t, err, ErrRequestInvalidJSON)
+		var syntaxErr *json.SyntaxError
+		require.ErrorAs(t, err, &syntaxErr)
+	})
+
+	t.Run("unknown context", func(t *testing.T) {
+		_, err := ParseSessionRequest(`{"@context": "https://irma.app/ld/request/foo/v1"}`)
+		require.ErrorIs(t, err, ErrRequestUnknownType)
+
+		_, err = ParseSessionRequest(`{"request": {"@context": "https://irma.app/ld/request/foo/v1"}}`)
+		require.ErrorIs(t, err, ErrRequestUnknownType)
+
+		_, err = ParseSessionRequest(`{"type": "foo"}`)
+		require.ErrorIs(t, err, ErrRequestUnknownType)
+	})
+
+	t.Run("invalid request", func(t *testing.T) {
+		_, err := ParseSessionRequest(`{"@context": "https://irma.app/ld/request/signature/v2", "disclose": []}`)
+		require.ErrorIs(t, err, ErrRequestInvalid)
+		require.Equal(t, []string{"irma.SignatureRequest"}, err.(*SessionRequestError).Attempted)
+
+		_, err = ParseSessionRequest(`[]`)
+		require.ErrorIs(t, err, ErrRequestInvalid)
+	})
+
+	t.Run("struct without context", func(t *testing.T) {
+		request := &irma.SignatureRequest{
+			DisclosureRequest: irma.DisclosureRequest{
+				Disclose: irma.AttributeConDisCon{{{irma.NewAttributeRequest("irma-demo.RU.studentCard.studentID")}}},
+			},
+			Message: "message",
+		}
+		bts, err := json.Marshal(request)
+		require.NoError(t, err)
+		res, err := ParseSessionRequest(bts)
+		require.NoError(t, err)
+		require.IsType(t, &irma.SignatureRequestorRequest{}, res)
+		require.Equal(t, "message", res.SessionRequest().(*irma.SignatureRequest).Message)
+	})
+
+	t.Run("legacy request", func(t *testing.T) {
+		res, err := ParseSessionRequest(`{"type":"disclosing","content":[{"label":"Student number","attributes":["irma-demo.RU.studentCard.studentID"]}]}`)
+		require.NoError(t, err)
+		require.Equal(t,
+			"irma-demo.RU.studentCard.studentID",
+			res.SessionRequest().Disclosure().Disclose[0][0][0].Type.String())
+
+		res, err = ParseSessionRequest(`{"request":{"type":"signing","message":"message","content":[{"label":"Student number","attributes":["irma-demo.RU.studentCard.studentID"]}]}}`)
+		require.NoError(t, err)
+		require.IsType(t, &irma.SignatureRequestorRequest{}, res)
 	})
 }
 
@@ -89,6 +152,32 @@ type readerFunc func(p []byte) (int, error)
 
 func (r readerFunc) Read(p []byte) (int, error) { return r(p) }
 
+func TestFilteredResult(t *testing.T) {
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	university := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university")
+	level := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")
+	id, uni := "s1234567", "Radboud"
+	result := &SessionResult{
+		Type: irma.ActionDisclosing,
+		Disclosed: [][]*irma.DisclosedAttribute{
+			{{Identifier: studentID, RawValue: &id}, {Identifier: university, RawValue: &uni}},
+			{{Identifier: level}},
+		},
+	}
+
+	// The structure of the disclosed attributes is kept
+	filtered := FilteredResult(result, []irma.AttributeTypeIdentifier{university})
+	require.Equal(t, [][]*irma.DisclosedAttribute{{result.Disclosed[0][1]}, {}}, filtered.Disclosed)
+	require.Len(t, result.Disclosed[0], 2)
+	require.Len(t, filtered.Legacy().Disclosed, 1)
+
+	require.Equal(t, map[irma.AttributeTypeIdentifier]*string{studentID: &id, university: &uni, level: nil}, FlatResult(result))
+	require.Equal(t, map[irma.AttributeTypeIdentifier]*string{university: &uni}, FlatResult(filtered))
+	bts, err := json.Marshal(FlatResult(result))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"irma-demo.RU.studentCard.studentID":"s1234567","irma-demo.RU.studentCard.university":"Radboud","irma-demo.RU.studentCard.level":null}`, string(bts))
+}
+
 func TestServerTimeouts(t *testing.T) {
 	timeout := 250 * time.Millisecond
 	var called bool
@@ -149,6 +238,91 @@ func TestServerTimeouts(t *testing.T) {
 	}
 }
 
+func TestTimeoutMiddleware(t *testing.T) {
+	handler := TimeoutMiddleware(map[string]time.Duration{
+		"/events": 0,
+		"/proofs": time.Second,
+	}, 100*time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		WriteJson(w, "done")
+	}))
+
+	// Requests taking longer than the timeout of their path are aborted with a RemoteError
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/status", nil))
+	require.Equal(t, ErrorTimeout.Status, res.Code)
+	require.Equal(t, "application/json", res.Header().Get("Content-Type"))
+	var rerr irma.RemoteError
+	require.NoError(t, json.Unmarshal(res.Body.Bytes(), &rerr))
+	require.Equal(t, string(ErrorTimeout.Type), rerr.ErrorName)
+	require.Equal(t, ErrorTimeout.Status, rerr.Status)
+
+	for _, path := range []string{"/session/proofs", "/events"} {
+		res = httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest(http.MethodPost, path, nil))
+		require.Equal(t, http.StatusOK, res.Code, path)
+		require.Equal(t, `"done"`, res.Body.String(), path)
+	}
+}
+
+func TestLogMiddleware(t *testing.T) {
+	logger, hook := logrustest.NewNullLogger()
+	logger.SetLevel(logrus.TraceLevel)
+	defer func(l *logrus.Logger) { Logger = l }(Logger)
+	Logger = logger
+
+	jsonBody := []byte(`{"n":"` + strings.Repeat("AQIDBAUGBwgJ", 10) + `"}`)
+	binaryBody := []byte{0x0a, 0x05, 0xff, 0xfe, 0x00, 0x01, 0x12, 0x03, 0x80, 0x81, 0x82}
+	largeBody := []byte(strings.Repeat("a", 2*DefaultLogMaxBodySize))
+
+	tests := []struct {
+		name, contentType string
+		body              []byte
+		opts              LogOptions
+		logged            string
+	}{
+		{"json", "application/json", jsonBody, LogOptions{}, string(jsonBody)},
+		{"json without content type", "", jsonBody, LogOptions{}, string(jsonBody)},
+		{"binary", "application/x-protobuf", binaryBody, LogOptions{}, hex.EncodeToString(binaryBody)},
+		{"invalid utf-8", "text/plain", binaryBody, LogOptions{}, hex.EncodeToString(binaryBody)},
+		{"octet stream", "application/octet-stream", []byte("abc"), LogOptions{}, "616263"},
+		{"oversized", "text/plain", largeBody, LogOptions{},
+			string(largeBody[:DefaultLogMaxBodySize]) + fmt.Sprintf("...<truncated, %d bytes total>", len(largeBody))},
+		{"custom limit", "application/x-protobuf", binaryBody, LogOptions{MaxBodySize: 4},
+			hex.EncodeToString(binaryBody[:4]) + fmt.Sprintf("...<truncated, %d bytes total>", len(binaryBody))},
+		{"no limit", "text/plain", largeBody, LogOptions{MaxBodySize: -1}, string(largeBody)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook.Reset()
+			opts := tt.opts
+			opts.Response, opts.EncodeBinary = true, true
+			handler := LogMiddleware("test", opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, err := ioutil.ReadAll(r.Body)
+				require.NoError(t, err)
+				w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+				_, err = w.Write(body)
+				require.NoError(t, err)
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			hash := sha256.Sum256(tt.body)
+			entries := hook.AllEntries()
+			require.Len(t, entries, 2)
+			require.Equal(t, tt.logged, entries[0].Data["message"])
+			require.Equal(t, hex.EncodeToString(hash[:]), entries[0].Data["message_sha256"])
+			require.Equal(t, tt.logged, entries[1].Data["response"])
+			require.Equal(t, hex.EncodeToString(hash[:]), entries[1].Data["response_sha256"])
+		})
+	}
+}
+
 func startServer(t *testing.T, handler http.Handler, timeout time.Duration) *http.Server {
 	s := &http.Server{
 		Addr:        "localhost:34534",
@@ -168,3 +342,84 @@ func stopServer(t *testing.T, server *http.Server) {
 	require.NoError(t, server.Shutdown(ctx))
 	cancel()
 }
+
+func TestWriteString(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteString(w, "eyJhbGciOiJSUzI1NiJ9.e30.c2ln")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	require.Equal(t, []byte("eyJhbGciOiJSUzI1NiJ9.e30.c2ln"), w.Body.Bytes())
+}
+
+func TestWriteJsonCompression(t *testing.T) {
+	small := map[string]string{"status": "DONE"}
+	large := make([]string, 1000)
+	for i := range large {
+		large[i] = fmt.Sprintf("irma-demo.RU.studentCard.studentID %d", i)
+	}
+	largeJson, err := json.Marshal(large)
+	require.NoError(t, err)
+
+	write := func(object interface{}, acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		WriteJson(w, object, r)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		return w
+	}
+
+	t.Run("small response is not compressed", func(t *testing.T) {
+		w := write(small, "gzip")
+		require.Empty(t, w.Header().Get("Content-Encoding"))
+		require.JSONEq(t, `{"status":"DONE"}`, w.Body.String())
+	})
+
+	t.Run("large response without gzip support", func(t *testing.T) {
+		for _, acceptEncoding := range []string{"", "deflate", "gzip;q=0"} {
+			w := write(large, acceptEncoding)
+			require.Empty(t, w.Header().Get("Content-Encoding"))
+			require.JSONEq(t, string(largeJson), w.Body.String())
+		}
+	})
+
+	t.Run("large response with gzip support", func(t *testing.T) {
+		w := write(large, "deflate, gzip;q=1.0")
+		require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+		require.Less(t, w.Body.Len(), len(largeJson)/2)
+
+		gz, err := gzip.NewReader(w.Body)
+		require.NoError(t, err)
+		bts, err := ioutil.ReadAll(gz)
+		require.NoError(t, err)
+		require.JSONEq(t, string(largeJson), string(bts))
+	})
+
+	t.Run("unencodable object", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		w := httptest.NewRecorder()
+		WriteJson(w, make(chan int), r)
+		require.Equal(t, http.StatusInternalServerError, w.Code)
+	})
+}
+
+func TestWriteStringCompression(t *testing.T) {
+	str := strings.Repeat("eyJhbGciOiJSUzI1NiJ9.", 100)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	WriteString(w, str, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	require.Less(t, w.Body.Len(), len(str))
+
+	gz, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	bts, err := ioutil.ReadAll(gz)
+	require.NoError(t, err)
+	require.Equal(t, str, string(bts))
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/tls"
 	"encoding/json"
@@ -14,6 +15,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Configuration contains configuration for the irmaserver library and irmad.
@@ -30,8 +32,13 @@ type Configuration struct {
 	DisableSchemesUpdate bool `json:"disable_schemes_update" mapstructure:"disable_schemes_update"`
 	// Update all schemes every x minutes (default value 0 means 60) (use DisableSchemesUpdate to disable)
 	SchemesUpdateInterval int `json:"schemes_update" mapstructure:"schemes_update"`
+	// Public keys with which the specified schemes must be signed (only used if IrmaConfiguration == nil).
+	// Schemes signed with another key are disabled, and updates to them are rejected.
+	PinnedSchemeKeys map[irma.SchemeManagerIdentifier]*ecdsa.PublicKey `json:"-"`
 	// Path to issuer private keys to parse
 	IssuerPrivateKeysPath string `json:"privkeys" mapstructure:"privkeys"`
+	// Issuer private keys to fetch at startup from an external key management service (optional)
+	IssuerPrivateKeysKMS *KMSSettings `json:"privkeys_kms,omitempty" mapstructure:"privkeys_kms"`
 	// URL at which the IRMA app can reach this server during sessions
 	URL string `json:"url" mapstructure:"url"`
 	// Required to be set to true if URL does not begin with https:// in production mode.
@@ -49,17 +56,68 @@ type Configuration struct {
 	StoreType string `json:"store_type" mapstructure:"store_type"`
 	// RedisSettings that need to be specified when Redis is used as session data store.
 	RedisSettings *RedisSettings `json:"redis_settings" mapstructure:"redis_settings"`
+	// Directory in which the memory session store periodically and on shutdown saves the sessions
+	// that are not yet finished, to restore them when the server restarts (optional)
+	CachePath string `json:"cache_path" mapstructure:"cache_path"`
 
-	// Static session requests that can be created by POST /session/{name}
+	// Static session requests that can be created by POST /session/{name} or GET /session/static/{name}
 	StaticSessions map[string]interface{} `json:"static_sessions"`
 	// Static session requests after parsing
 	StaticSessionRequests map[string]irma.RequestorRequest `json:"-"`
+	// Maximum number of static sessions that one IP address may start per minute (default value 0 means 30)
+	StaticSessionRateLimit int `json:"static_session_rate_limit" mapstructure:"static_session_rate_limit"`
 
 	// Session Timeout in minutes (default value 0 means 5)
 	MaxSessionLifetime int `json:"max_session_lifetime" mapstructure:"max_session_lifetime"`
+	// Maximum time in seconds between sending the session request to the client and receiving its
+	// proofs (default value 0 means no maximum)
+	MaxProofAge int `json:"max_proof_age" mapstructure:"max_proof_age"`
+	// Delete the disclosed attributes and signature of a session result once the requestor fetched
+	// it or it was delivered to the callback URL, after which fetching it fails with RESULT_CONSUMED,
+	// while its status and proof status remain available
+	DeleteResultOnRead bool `json:"delete_result_on_read" mapstructure:"delete_result_on_read"`
+	// Time in minutes that finished sessions, including their results, are kept (default value 0
+	// means MaxSessionLifetime)
+	ResultRetention int `json:"result_retention" mapstructure:"result_retention"`
+	// Maximum number of sessions that may be active (i.e. not yet finished) at the same time
+	// (default value 0 means no maximum)
+	MaxActiveSessions int `json:"max_active_sessions" mapstructure:"max_active_sessions"`
+	// Maximum number of sessions that may be active at the same time per requestor
+	// (default value 0 means no maximum)
+	MaxActiveRequestorSessions int `json:"max_active_requestor_sessions" mapstructure:"max_active_requestor_sessions"`
+	// Maximum number of credential instances that session requests may ask to be disclosed for
+	// disjunctions of which they request all instances (default value 0 means irma.DefaultMaxInstances)
+	MaxInstances int `json:"max_instances" mapstructure:"max_instances"`
+	// Tolerated difference in seconds between the clocks of this server and of other parties when
+	// checking validity periods (default value 0 means 60, -1 means no tolerance, maximum 300).
+	// Applied to the IrmaConfiguration, so servers sharing it should use the same tolerance.
+	ClockSkewTolerance int `json:"clock_skew_tolerance" mapstructure:"clock_skew_tolerance"`
+
+	// Protection of the HTTP servers against clients that send their requests slowly (see also
+	// ConfigureHTTPServer and LimitListener): maximum time in seconds for reading the headers of a
+	// request (default value 0 means 5), for reading the entire request (default value 0 means 5),
+	// and for keeping idle connections open (default value 0 means 120)
+	ReadHeaderTimeout int `json:"read_header_timeout" mapstructure:"read_header_timeout"`
+	ReadTimeout       int `json:"read_timeout" mapstructure:"read_timeout"`
+	IdleTimeout       int `json:"idle_timeout" mapstructure:"idle_timeout"`
+	// Maximum time in seconds for handling requests of IRMA apps and frontends to the status
+	// endpoints of sessions (default value 0 means 5), and to the endpoints to which IRMA apps post
+	// their commitments and proofs (default value 0 means 30). Other requests may take 10 seconds.
+	StatusTimeout int `json:"status_timeout" mapstructure:"status_timeout"`
+	ProofTimeout  int `json:"proof_timeout" mapstructure:"proof_timeout"`
+	// Maximum number of simultaneous connections per listening address
+	// (default value 0 means 1000, -1 means no maximum)
+	MaxConnections int `json:"max_connections" mapstructure:"max_connections"`
 
 	// Used in the "iss" field of result JWTs from /result-jwt and /getproof
 	JwtIssuer string `json:"jwt_issuer" mapstructure:"jwt_issuer"`
+	// Expected "iss" and "aud" fields of the keyshare proof JWTs of the specified schemes, by scheme
+	// identifier. For schemes not listed here, these fields are not checked.
+	KeyshareJwtIssuers   map[string]string `json:"keyshare_jwt_issuers" mapstructure:"keyshare_jwt_issuers"`
+	KeyshareJwtAudiences map[string]string `json:"keyshare_jwt_audiences" mapstructure:"keyshare_jwt_audiences"`
+	// Accept keyshare proof JWTs lacking the expected "iss" or "aud" fields (logging a warning),
+	// e.g. while the keyshare server is migrating to a new JWT audience
+	KeyshareJwtAcceptMissingClaims bool `json:"keyshare_jwt_accept_missing_claims" mapstructure:"keyshare_jwt_accept_missing_claims"`
 	// Private key to sign result JWTs with. If absent, /result-jwt and /getproof are disabled.
 	JwtPrivateKey     string `json:"jwt_privkey" mapstructure:"jwt_privkey"`
 	JwtPrivateKeyFile string `json:"jwt_privkey_file" mapstructure:"jwt_privkey_file"`
@@ -71,6 +129,14 @@ type Configuration struct {
 	// Whether to augment the clientreturnurl with the server token of the request (this allows for stateless
 	// requestor servers more easily)
 	AugmentClientReturnURL bool `json:"augment_client_return_url" mapstructure:"augment_client_return_url"`
+	// Refuse to start sessions of the specified types, regardless of requestor permissions
+	// (the disclosures of issuance sessions are not affected by DisableDisclosure)
+	DisableDisclosure bool `json:"disable_disclosure" mapstructure:"disable_disclosure"`
+	DisableSigning    bool `json:"disable_signing" mapstructure:"disable_signing"`
+	DisableIssuance   bool `json:"disable_issuance" mapstructure:"disable_issuance"`
+	// Reject disclosures (also in issuance sessions) and attribute-based signatures containing test
+	// credentials, i.e. credentials issued by servers not in production mode or of demo schemes
+	RejectTestCredentials bool `json:"reject_test_credentials" mapstructure:"reject_test_credentials"`
 
 	// Logging verbosity level: 0 is normal, 1 includes DEBUG level, 2 includes TRACE level
 	Verbose int `json:"verbose" mapstructure:"verbose"`
@@ -78,8 +144,14 @@ type Configuration struct {
 	Quiet bool `json:"quiet" mapstructure:"quiet"`
 	// Output structured log in JSON format
 	LogJSON bool `json:"log_json" mapstructure:"log_json"`
+	// Whether disclosed attribute values may appear in logs and in session results that are kept
+	// after the requestor fetched them: "full", "hashed" (replaced by salted hashes) or "never"
+	// (default value "" means "full")
+	LogAttributeValues AttributeValueLogging `json:"log_attribute_values" mapstructure:"log_attribute_values"`
 	// Custom logger instance. If specified, Verbose, Quiet and LogJSON are ignored.
 	Logger *logrus.Logger `json:"-"`
+	// Callbacks with which applications embedding the server observe it, e.g. for tracing (optional)
+	Hooks *Hooks `json:"-"`
 
 	// Connection string for revocation database
 	RevocationDBConnStr string `json:"revocation_db_str" mapstructure:"revocation_db_str"`
@@ -88,6 +160,28 @@ type Configuration struct {
 	// Credentials types for which revocation database should be hosted
 	RevocationSettings irma.RevocationSettings `json:"revocation_settings" mapstructure:"revocation_settings"`
 
+	// IP addresses or CIDR ranges of the reverse proxies in front of this server, whose Forwarded,
+	// X-Forwarded-For and X-Real-IP headers are trusted to determine the IP address of clients
+	// in logs and when rate limiting (see TrustedProxies.ClientIP). If empty, these headers are ignored.
+	TrustedProxies []string `json:"trusted_proxies" mapstructure:"trusted_proxies"`
+	// Parsed trusted proxies
+	TrustedProxyNetworks TrustedProxies `json:"-"`
+
+	// IP addresses or CIDR ranges of private networks to which the server may send outbound requests
+	// (e.g. 10.0.0.0/8 for a key management service or requestor in the local network). Requests to
+	// private, loopback and link-local addresses are refused otherwise.
+	EgressAllowedNetworks []string `json:"egress_allowed_networks" mapstructure:"egress_allowed_networks"`
+	// Hostnames to which the URLs that requestors supply in session requests (callbackUrl and
+	// nextSession) may point, e.g. example.com, or *.example.com for its subdomains. If empty, URLs
+	// may point to any host.
+	EgressAllowedHosts []string `json:"egress_allowed_hosts" mapstructure:"egress_allowed_hosts"`
+	// Timeout in seconds of outbound requests (default value 0 means 10)
+	EgressTimeout int `json:"egress_timeout" mapstructure:"egress_timeout"`
+	// Through which all outbound requests are sent, parsed from the settings above. The downloads of a
+	// provided IrmaConfiguration are only restricted if it was created with Egress.ConfigureTransport
+	// as irma.ConfigurationOptions.ConfigureTransport.
+	Egress *Egress `json:"-"`
+
 	// Production mode: enables safer and stricter defaults and config checking
 	Production bool `json:"production" mapstructure:"production"`
 }
@@ -114,16 +208,29 @@ func (conf *Configuration) Check() error {
 	if conf.MaxSessionLifetime == 0 {
 		conf.MaxSessionLifetime = 5
 	}
+	if conf.StaticSessionRateLimit == 0 {
+		conf.StaticSessionRateLimit = 30
+	}
+	if conf.MaxInstances == 0 {
+		conf.MaxInstances = irma.DefaultMaxInstances
+	}
 
 	// loop to avoid repetetive err != nil line triplets
 	for _, f := range []func() error{
+		conf.verifyEgress,
 		conf.verifyIrmaConf,
+		conf.verifyClockSkewTolerance,
 		conf.verifyPrivateKeys,
 		conf.verifyURL,
 		conf.verifyEmail,
 		conf.verifyRevocation,
 		conf.verifyJwtPrivateKey,
 		conf.verifyStaticSessions,
+		conf.verifyTrustedProxies,
+		conf.verifyKeyshareJwtClaims,
+		conf.verifyLogAttributeValues,
+		conf.verifyHTTPLimits,
+		conf.verifyCachePath,
 	} {
 		if err := f(); err != nil {
 			_ = LogError(err)
@@ -143,6 +250,20 @@ func (conf *Configuration) Check() error {
 	return nil
 }
 
+// SessionTypeEnabled returns whether sessions of the specified type may be started.
+func (conf *Configuration) SessionTypeEnabled(action irma.Action) bool {
+	switch action {
+	case irma.ActionDisclosing:
+		return !conf.DisableDisclosure
+	case irma.ActionSigning:
+		return !conf.DisableSigning
+	case irma.ActionIssuing:
+		return !conf.DisableIssuance
+	default:
+		return false
+	}
+}
+
 func (conf *Configuration) HavePrivateKeys() bool {
 	var err error
 	for id := range conf.IrmaConfiguration.Issuers {
@@ -179,6 +300,9 @@ func (conf *Configuration) verifyStaticSessions() error {
 		if action != irma.ActionDisclosing && action != irma.ActionSigning {
 			return errors.Errorf("static session %s must be either a disclosing or signing session", name)
 		}
+		if !conf.SessionTypeEnabled(action) {
+			return errors.Errorf("static session %s is a %s session, which is disabled", name, action)
+		}
 		base := rrequest.Base()
 		if base.CallbackURL == "" && (base.NextSession == nil || base.NextSession.URL == "") {
 			return errors.Errorf("static session %s has no callback URL or next session URL", name)
@@ -188,6 +312,39 @@ func (conf *Configuration) verifyStaticSessions() error {
 	return nil
 }
 
+func (conf *Configuration) verifyEgress() error {
+	var err error
+	conf.Egress, err = NewEgress(conf.EgressAllowedNetworks, conf.EgressAllowedHosts, time.Duration(conf.EgressTimeout)*time.Second)
+	return err
+}
+
+func (conf *Configuration) verifyTrustedProxies() error {
+	var err error
+	conf.TrustedProxyNetworks, err = ParseTrustedProxies(conf.TrustedProxies)
+	return err
+}
+
+func (conf *Configuration) verifyKeyshareJwtClaims() error {
+	for _, m := range []map[string]string{conf.KeyshareJwtIssuers, conf.KeyshareJwtAudiences} {
+		for scheme := range m {
+			if _, ok := conf.IrmaConfiguration.SchemeManagers[irma.NewSchemeManagerIdentifier(scheme)]; !ok {
+				return errors.Errorf("keyshare JWT claims specified for unknown scheme %s", scheme)
+			}
+		}
+	}
+	return nil
+}
+
+func (conf *Configuration) verifyCachePath() error {
+	if conf.CachePath == "" {
+		return nil
+	}
+	if conf.StoreType != "" && conf.StoreType != "memory" {
+		return errors.New("cache_path can only be used with the memory session store")
+	}
+	return common.EnsureDirectoryExists(conf.CachePath)
+}
+
 func (conf *Configuration) verifyIrmaConf() error {
 	if conf.IrmaConfiguration == nil {
 		var (
@@ -209,6 +366,8 @@ func (conf *Configuration) verifyIrmaConf() error {
 			RevocationDBType:    conf.RevocationDBType,
 			RevocationDBConnStr: conf.RevocationDBConnStr,
 			RevocationSettings:  conf.RevocationSettings,
+			PinnedSchemeKeys:    conf.PinnedSchemeKeys,
+			ConfigureTransport:  conf.Egress.ConfigureTransport,
 		})
 		if err != nil {
 			return err
@@ -234,15 +393,35 @@ func (conf *Configuration) verifyIrmaConf() error {
 	return nil
 }
 
+func (conf *Configuration) verifyClockSkewTolerance() error {
+	tolerance := time.Duration(conf.ClockSkewTolerance) * time.Second
+	switch {
+	case conf.ClockSkewTolerance == 0:
+		conf.ClockSkewTolerance = int(irma.DefaultClockSkewTolerance / time.Second)
+		tolerance = irma.DefaultClockSkewTolerance
+	case conf.ClockSkewTolerance == -1:
+		tolerance = 0
+	}
+	if err := conf.IrmaConfiguration.SetClockSkewTolerance(tolerance); err != nil {
+		return errors.WrapPrefix(err, "invalid clock_skew_tolerance", 0)
+	}
+	return nil
+}
+
 func (conf *Configuration) verifyPrivateKeys() error {
-	if conf.IssuerPrivateKeysPath == "" {
-		return nil
+	if conf.IssuerPrivateKeysPath != "" {
+		ring, err := irma.NewPrivateKeyRingFolder(conf.IssuerPrivateKeysPath, conf.IrmaConfiguration)
+		if err != nil {
+			return err
+		}
+		if err = conf.IrmaConfiguration.AddPrivateKeyRing(ring); err != nil {
+			return err
+		}
 	}
-	ring, err := irma.NewPrivateKeyRingFolder(conf.IssuerPrivateKeysPath, conf.IrmaConfiguration)
-	if err != nil {
-		return err
+	if conf.IssuerPrivateKeysKMS != nil {
+		return conf.verifyKMS()
 	}
-	return conf.IrmaConfiguration.AddPrivateKeyRing(ring)
+	return nil
 }
 
 func (conf *Configuration) prepareRevocation(credid irma.CredentialTypeIdentifier) error {
@@ -364,7 +543,7 @@ func (conf *Configuration) verifyEmail() error {
 	if !strings.Contains(conf.Email, "@") || strings.Contains(conf.Email, "\n") {
 		return errors.New("Invalid email address specified")
 	}
-	t := irma.NewHTTPTransport("https://privacybydesign.foundation/", true)
+	t := conf.Egress.Transport("https://privacybydesign.foundation/", true, false)
 	t.SetHeader("User-Agent", "irmaserver")
 	data := &serverInfo{Email: conf.Email, Version: irma.Version}
 
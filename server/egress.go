@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// EgressTimeoutDefault is the default timeout in seconds of outbound requests (see Egress).
+const EgressTimeoutDefault = 10
+
+// deniedNetworks are the private, loopback, link-local and otherwise non-public networks to which
+// outbound requests are refused, unless they are explicitly allowed.
+var deniedNetworks = mustParseNetworks(
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, including cloud metadata services
+	"172.16.0.0/12",  // private
+	"192.168.0.0/16", // private
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved, including broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+)
+
+// Egress sends the outbound HTTP requests of the server, such as result callbacks, next session
+// requests, scheme downloads and JWKS fetches, restricting their destinations: connections to
+// private, loopback and link-local addresses are refused, unless they are in one of the allowed
+// networks, and URLs supplied by requestors (callbackUrl and nextSession) must point to one of the
+// allowed hosts, if any. Hostnames are resolved once per connection and the resolved address is
+// dialed, so that a hostname cannot be made to resolve to a denied address after being checked.
+// The zero value refuses all private addresses and allows all hosts.
+type Egress struct {
+	allowedNetworks TrustedProxies
+	allowedHosts    []string
+	timeout         time.Duration
+}
+
+// NewEgress returns an Egress allowing connections to the specified IP addresses or CIDR ranges
+// (e.g. 10.0.0.0/8) of private networks, and requestor-supplied URLs pointing to the specified
+// hostnames (e.g. example.com, or *.example.com for its subdomains), or to any host if empty.
+// If timeout is 0, EgressTimeoutDefault is used.
+func NewEgress(allowedNetworks, allowedHosts []string, timeout time.Duration) (*Egress, error) {
+	networks, err := ParseTrustedProxies(allowedNetworks)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "invalid allowed egress network", 0)
+	}
+	hosts := make([]string, 0, len(allowedHosts))
+	for _, host := range allowedHosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" || host == "*." || strings.ContainsAny(host, "/:") {
+			return nil, errors.Errorf("invalid allowed egress host %s", host)
+		}
+		hosts = append(hosts, host)
+	}
+	return &Egress{allowedNetworks: networks, allowedHosts: hosts, timeout: timeout}, nil
+}
+
+// Client returns an HTTP client whose requests are subject to the restrictions of the Egress.
+// If requestorSupplied is set, the requests must point to one of the allowed hosts.
+func (e *Egress) Client(requestorSupplied bool) *http.Client {
+	return &http.Client{
+		Timeout: e.requestTimeout(),
+		Transport: &http.Transport{
+			DialContext:         e.dialer(requestorSupplied),
+			TLSHandshakeTimeout: e.requestTimeout(),
+		},
+	}
+}
+
+// Transport returns an irma.HTTPTransport whose requests are subject to the restrictions of the
+// Egress. If requestorSupplied is set, the requests must point to one of the allowed hosts.
+func (e *Egress) Transport(serverURL string, forceHTTPS, requestorSupplied bool) *irma.HTTPTransport {
+	transport := irma.NewHTTPTransport(serverURL, forceHTTPS)
+	transport.SetDialer(e.dialer(requestorSupplied), e.requestTimeout())
+	return transport
+}
+
+// ConfigureTransport subjects the requests of the specified transport to the restrictions of the
+// Egress, for irma.ConfigurationOptions.ConfigureTransport.
+func (e *Egress) ConfigureTransport(transport *irma.HTTPTransport) {
+	transport.SetDialer(e.dialer(false), e.requestTimeout())
+}
+
+func (e *Egress) requestTimeout() time.Duration {
+	if e == nil || e.timeout == 0 {
+		return EgressTimeoutDefault * time.Second
+	}
+	return e.timeout
+}
+
+func (e *Egress) dialer(requestorSupplied bool) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if requestorSupplied && !e.hostAllowed(host) {
+			return nil, fmt.Errorf("%w: host %s is not allowed", irma.ErrRequestRefused, host)
+		}
+
+		var ips []net.IP
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else {
+			addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			for _, a := range addrs {
+				ips = append(ips, a.IP)
+			}
+		}
+
+		dialer := &net.Dialer{Timeout: e.requestTimeout()}
+		err = fmt.Errorf("%w: no addresses found for %s", irma.ErrRequestRefused, host)
+		for _, ip := range ips {
+			if !e.ipAllowed(ip) {
+				err = fmt.Errorf("%w: %s is not a public address", irma.ErrRequestRefused, ip)
+				continue
+			}
+			var conn net.Conn
+			if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+func (e *Egress) hostAllowed(host string) bool {
+	if e == nil || len(e.allowedHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range e.allowedHosts {
+		if host == allowed || strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *Egress) ipAllowed(ip net.IP) bool {
+	if e != nil && e.allowedNetworks.trusted(ip) {
+		return true
+	}
+	return !deniedNetworks.trusted(ip)
+}
+
+func mustParseNetworks(cidrs ...string) TrustedProxies {
+	networks := make(TrustedProxies, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
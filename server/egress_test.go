@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEgressMetadataCallback(t *testing.T) {
+	logger, hook := logrustest.NewNullLogger()
+	defer func(l *logrus.Logger) { Logger = l }(Logger)
+	Logger = logger
+
+	// A callback (webhook) to the cloud metadata service is refused before connecting
+	DoResultCallback(&Egress{}, "http://169.254.169.254/latest/meta-data/", disclosureResult(), "", 0, nil, false)
+	entry := hook.LastEntry()
+	require.NotNil(t, entry)
+	require.Equal(t, logrus.WarnLevel, entry.Level)
+	require.Contains(t, entry.Message, "169.254.169.254 is not a public address")
+
+	// also when allowing all hosts and the private networks of the development defaults
+	egress, err := NewEgress([]string{"10.0.0.0/8", "127.0.0.0/8"}, nil, 0)
+	require.NoError(t, err)
+	err = egress.Transport("http://169.254.169.254/latest/meta-data/", false, true).Post("", nil, struct{}{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "refused")
+}
+
+func TestEgress(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(u.Host)
+	require.NoError(t, err)
+
+	post := func(egress *Egress, u string, requestorSupplied bool) error {
+		err := egress.Transport(u, false, requestorSupplied).Post("", nil, struct{}{})
+		if serr, ok := err.(*irma.SessionError); ok && serr.RemoteStatus == http.StatusNoContent {
+			return nil
+		}
+		return err
+	}
+
+	// Loopback addresses are refused, also when referred to by hostname
+	var denying *Egress
+	require.Error(t, post(denying, ts.URL, false))
+	require.Error(t, post(denying, "http://localhost:"+port, false))
+	res, err := denying.Client(false).Get(ts.URL)
+	if err == nil {
+		_ = res.Body.Close()
+	}
+	require.Error(t, err)
+
+	// unless allowed
+	egress, err := NewEgress([]string{"127.0.0.0/8", "::1"}, nil, 0)
+	require.NoError(t, err)
+	require.NoError(t, post(egress, ts.URL, true))
+	require.NoError(t, post(egress, "http://localhost:"+port, true))
+	res, err = egress.Client(false).Get(ts.URL)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+
+	// Requestor-supplied URLs must point to one of the allowed hosts
+	egress, err = NewEgress([]string{"127.0.0.0/8", "::1"}, []string{"*.example.com", "LOCALHOST"}, 0)
+	require.NoError(t, err)
+	require.NoError(t, post(egress, "http://localhost:"+port, true))
+	require.Error(t, post(egress, ts.URL, true))
+	require.NoError(t, post(egress, ts.URL, false))
+	require.True(t, egress.hostAllowed("sub.example.com"))
+	require.False(t, egress.hostAllowed("example.com"))
+	require.False(t, egress.hostAllowed("evilexample.com"))
+
+	_, err = NewEgress([]string{"10.0.0.0/33"}, nil, 0)
+	require.Error(t, err)
+	_, err = NewEgress(nil, []string{"https://example.com"}, 0)
+	require.Error(t, err)
+}
+
+func TestEgressAllowedIPs(t *testing.T) {
+	var egress *Egress
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "100.64.0.1", "0.0.0.0", "::1", "fe80::1", "fd00::1", "::ffff:127.0.0.1", "::ffff:169.254.169.254"} {
+		require.False(t, egress.ipAllowed(net.ParseIP(ip)), ip)
+	}
+	for _, ip := range []string{"1.1.1.1", "8.8.8.8", "2606:4700:4700::1111", "::ffff:1.1.1.1"} {
+		require.True(t, egress.ipAllowed(net.ParseIP(ip)), ip)
+	}
+}
@@ -26,6 +26,7 @@ var (
 	ErrorInvalidProofs        Error = Error{Type: "INVALID_PROOFS", Status: 400, Description: "Invalid secret key commitments and/or disclosure proofs"}
 	ErrorAttributesMissing    Error = Error{Type: "ATTRIBUTES_MISSING", Status: 400, Description: "Not all requested-for attributes were present"}
 	ErrorAttributesExpired    Error = Error{Type: "ATTRIBUTES_EXPIRED", Status: 400, Description: "Disclosed attributes were expired"}
+	ErrorTestCredential       Error = Error{Type: "TEST_CREDENTIAL", Status: 400, Description: "Disclosed attributes were disclosed out of test credentials"}
 	ErrorUnexpectedRequest    Error = Error{Type: "UNEXPECTED_REQUEST", Status: 403, Description: "Unexpected request in this state"}
 	ErrorUnknownPublicKey     Error = Error{Type: "UNKNOWN_PUBLIC_KEY", Status: 403, Description: "Attributes were not valid against a known public key"}
 	ErrorKeyshareProofMissing Error = Error{Type: "KEYSHARE_PROOF_MISSING", Status: 403, Description: "ProofP object from a keyshare server missing"}
@@ -35,15 +36,113 @@ var (
 	ErrorNextSession          Error = Error{Type: "NEXT_SESSION", Status: 500, Description: "Error starting next session"}
 	ErrorRevocation           Error = Error{Type: "REVOCATION", Status: 500, Description: "Revocation error"}
 	ErrorUnknownRevocationKey Error = Error{Type: "UNKNOWN_REVOCATION_KEY", Status: 404, Description: "No issuance records correspond to the given revocationKey"}
+	ErrorProofTooOld          Error = Error{Type: "PROOF_TOO_OLD", Status: 400, Description: "Session took too long, please retry"}
+	ErrorResultConsumed       Error = Error{Type: "RESULT_CONSUMED", Status: 410, Description: "Session result was already read and has been deleted"}
 
-	ErrorUnsupported     Error = Error{Type: "UNSUPPORTED", Status: 501, Description: "Unsupported by this server"}
-	ErrorInvalidRequest  Error = Error{Type: "INVALID_REQUEST", Status: 400, Description: "Invalid HTTP request"}
-	ErrorProtocolVersion Error = Error{Type: "PROTOCOL_VERSION", Status: 400, Description: "Protocol version negotiation failed"}
-	ErrorInternal        Error = Error{Type: "INTERNAL_ERROR", Status: 500, Description: "Internal server error"}
+	ErrorUnknownCredentialType Error = Error{Type: "UNKNOWN_CREDENTIAL_TYPE", Status: 404, Description: "Unknown credential type"}
+	ErrorNoLogo                Error = Error{Type: "NO_LOGO", Status: 404, Description: "No logo available for this credential type"}
+	ErrorUnknownTemplate       Error = Error{Type: "UNKNOWN_TEMPLATE", Status: 404, Description: "Unknown session request template"}
+
+	ErrorUnsupported         Error = Error{Type: "UNSUPPORTED", Status: 501, Description: "Unsupported by this server"}
+	ErrorInvalidRequest      Error = Error{Type: "INVALID_REQUEST", Status: 400, Description: "Invalid HTTP request"}
+	ErrorProtocolVersion     Error = Error{Type: "PROTOCOL_VERSION", Status: 400, Description: "Protocol version negotiation failed"}
+	ErrorInternal            Error = Error{Type: "INTERNAL_ERROR", Status: 500, Description: "Internal server error"}
+	ErrorTooManyRequests     Error = Error{Type: "TOO_MANY_REQUESTS", Status: 429, Description: "Too many requests, try again later"}
+	ErrorTooManySessions     Error = Error{Type: "TOO_MANY_SESSIONS", Status: 429, Description: "Too many active sessions, try again later"}
+	ErrorSessionTypeDisabled Error = Error{Type: "SESSION_TYPE_DISABLED", Status: 403, Description: "Session type disabled on this server"}
+	ErrorSSEDisabled         Error = Error{Type: "SSE_DISABLED", Status: 500, Description: "Server sent events disabled"}
+	ErrorUnavailable         Error = Error{Type: "UNAVAILABLE", Status: 503, Description: "Service temporarily unavailable, try again later"}
+	ErrorTimeout             Error = Error{Type: "TIMEOUT", Status: 503, Description: "Handling the request took too long, try again later"}
+
+	ErrorUnknownEndpoint  Error = Error{Type: "INVALID_REQUEST", Status: 404, Description: "Unknown endpoint"}
+	ErrorMethodNotAllowed Error = Error{Type: "INVALID_REQUEST", Status: 405, Description: "Method not allowed at this endpoint"}
 )
 
 // Keyshare errors
 var (
-	ErrorUserNotRegistered = Error{Type: "USER_NOT_REGISTERED", Status: 403, Description: "User is not yet fully registered"}
-	ErrorInvalidJWT        = Error{Type: "UNAUTHORIZED", Status: 403, Description: "Invalid or expired jwt provided"}
+	// Clients treat this as their account having been deleted. Keyshare servers configured with
+	// uniform_pin_responses do not send it to clients using keyshare protocol version 4 or higher when
+	// verifying or changing the PIN of an unknown user, so that this does not reveal which usernames
+	// exist; such clients can then no longer distinguish a deleted account from a wrong PIN. Clients
+	// using older versions still receive it, so usernames can be enumerated using those versions
+	// until support for them is dropped.
+	ErrorUserNotRegistered     = Error{Type: "USER_NOT_REGISTERED", Status: 403, Description: "User is not yet fully registered"}
+	ErrorInvalidJWT            = Error{Type: "UNAUTHORIZED", Status: 403, Description: "Invalid or expired jwt provided"}
+	ErrorInvalidEmailToken     = Error{Type: "INVALID_EMAIL_TOKEN", Status: 403, Description: "Unknown, expired or already used email verification token"}
+	ErrorRegistrationPolicy    = Error{Type: "REGISTRATION_POLICY_VIOLATION", Status: 400, Description: "Enrollment does not satisfy the registration policy of the scheme"}
+	ErrorInvalidIDToken        = Error{Type: "INVALID_ID_TOKEN", Status: 403, Description: "Missing or invalid OpenID Connect ID token"}
+	ErrorAccountExists         = Error{Type: "ACCOUNT_EXISTS", Status: 409, Description: "An account is already bound to this identity"}
+	ErrorDeviceNotRegistered   = Error{Type: "DEVICE_NOT_REGISTERED", Status: 403, Description: "Device not registered"}
+	ErrorInvalidEnrollmentCode = Error{Type: "INVALID_ENROLLMENT_CODE", Status: 403, Description: "Unknown, expired or already used device enrollment code"}
+	ErrorPinEncryption         = Error{Type: "PIN_ENCRYPTION", Status: 400, Description: "PIN must be encrypted to the PIN encryption key of the keyshare server"}
+	ErrorInvalidRecoveryToken  = Error{Type: "INVALID_RECOVERY_TOKEN", Status: 403, Description: "Unknown, expired or already used recovery token"}
+	ErrorAttestationFailed     = Error{Type: "ATTESTATION_FAILED", Status: 403, Description: "Missing or invalid platform attestation token"}
+	ErrorReadOnly              = Error{Type: "READ_ONLY", Status: 503, Description: "Operation unavailable during read-only maintenance, try again later"}
 )
+
+// Errors returns all errors that the IRMA server, the keyshare server and the MyIRMA server
+// may respond with, allowing clients to map them without having to enumerate them themselves.
+// Note that the type of an error is not unique: UNAUTHORIZED and INVALID_REQUEST occur with
+// different statuses or descriptions.
+func Errors() []Error {
+	return []Error{
+		ErrorInvalidTimestamp,
+		ErrorIssuingDisabled,
+		ErrorMalformedVerifierRequest,
+		ErrorMalformedSignatureRequest,
+		ErrorMalformedIssuerRequest,
+		ErrorUnauthorized,
+		ErrorAttributesWrong,
+		ErrorCannotIssue,
+
+		ErrorIrmaUnauthorized,
+		ErrorPairingRequired,
+		ErrorIssuanceFailed,
+		ErrorInvalidProofs,
+		ErrorAttributesMissing,
+		ErrorAttributesExpired,
+		ErrorTestCredential,
+		ErrorUnexpectedRequest,
+		ErrorUnknownPublicKey,
+		ErrorKeyshareProofMissing,
+		ErrorSessionUnknown,
+		ErrorMalformedInput,
+		ErrorUnknown,
+		ErrorNextSession,
+		ErrorRevocation,
+		ErrorUnknownRevocationKey,
+		ErrorProofTooOld,
+		ErrorResultConsumed,
+
+		ErrorUnknownCredentialType,
+		ErrorNoLogo,
+		ErrorUnknownTemplate,
+
+		ErrorUnsupported,
+		ErrorInvalidRequest,
+		ErrorProtocolVersion,
+		ErrorInternal,
+		ErrorTooManyRequests,
+		ErrorTooManySessions,
+		ErrorSessionTypeDisabled,
+		ErrorSSEDisabled,
+		ErrorUnavailable,
+		ErrorTimeout,
+
+		ErrorUnknownEndpoint,
+		ErrorMethodNotAllowed,
+
+		ErrorUserNotRegistered,
+		ErrorInvalidJWT,
+		ErrorInvalidEmailToken,
+		ErrorRegistrationPolicy,
+		ErrorInvalidIDToken,
+		ErrorAccountExists,
+		ErrorDeviceNotRegistered,
+		ErrorInvalidEnrollmentCode,
+		ErrorPinEncryption,
+		ErrorInvalidRecoveryToken,
+		ErrorAttestationFailed,
+		ErrorReadOnly,
+	}
+}
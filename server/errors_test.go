@@ -0,0 +1,115 @@
+package server
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorCatalog(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "errors.go", nil, 0)
+	require.NoError(t, err)
+
+	// Collect the declared errors and the errors returned by Errors()
+	var declared, cataloged []string
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.GenDecl:
+			if d.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range d.Specs {
+				for _, name := range spec.(*ast.ValueSpec).Names {
+					declared = append(declared, name.Name)
+				}
+			}
+		case *ast.FuncDecl:
+			if d.Name.Name != "Errors" {
+				continue
+			}
+			for _, elt := range d.Body.List[0].(*ast.ReturnStmt).Results[0].(*ast.CompositeLit).Elts {
+				cataloged = append(cataloged, elt.(*ast.Ident).Name)
+			}
+		}
+	}
+	require.ElementsMatch(t, declared, cataloged)
+
+	errs := Errors()
+	require.Len(t, errs, len(declared))
+	seen := map[Error]bool{}
+	for _, e := range errs {
+		require.NotEmpty(t, e.Type)
+		require.NotEmpty(t, e.Description)
+		require.True(t, e.Status >= 400 && e.Status < 600, "%s has non-error status %d", e.Type, e.Status)
+		require.False(t, seen[e], "%s occurs twice", e.Type)
+		seen[e] = true
+	}
+}
+
+// Check that the servers only respond with errors from the catalog, by checking that no errors
+// are defined outside errors.go and that all RemoteErrors are derived from a catalog entry.
+func TestNoAdHocErrors(t *testing.T) {
+	fset := token.NewFileSet()
+	err := filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return err
+		}
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return err
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			lit, ok := n.(*ast.CompositeLit)
+			if !ok {
+				return true
+			}
+			switch typeName(lit.Type) {
+			case "Error", "server.Error":
+				if path != "errors.go" {
+					require.Empty(t, lit.Elts, "error defined outside errors.go at %s", fset.Position(lit.Pos()))
+				}
+			case "irma.RemoteError":
+				require.True(t, derivedFromCatalog(lit), "RemoteError not derived from catalog at %s", fset.Position(lit.Pos()))
+			}
+			return true
+		})
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func typeName(expr ast.Expr) string {
+	switch e := expr.(type) {
+	case *ast.Ident:
+		return e.Name
+	case *ast.SelectorExpr:
+		if x, ok := e.X.(*ast.Ident); ok {
+			return x.Name + "." + e.Sel.Name
+		}
+	}
+	return ""
+}
+
+// derivedFromCatalog checks that the ErrorName of the RemoteError literal is of the form string(err.Type).
+func derivedFromCatalog(lit *ast.CompositeLit) bool {
+	for _, elt := range lit.Elts {
+		kv, ok := elt.(*ast.KeyValueExpr)
+		if !ok || typeName(kv.Key) != "ErrorName" {
+			continue
+		}
+		call, ok := kv.Value.(*ast.CallExpr)
+		if !ok || typeName(call.Fun) != "string" || len(call.Args) != 1 {
+			return false
+		}
+		sel, ok := call.Args[0].(*ast.SelectorExpr)
+		return ok && sel.Sel.Name == "Type"
+	}
+	return false
+}
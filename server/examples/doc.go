@@ -0,0 +1,4 @@
+// Package examples contains examples of integrating the IRMA server and keyshare server libraries
+// in applications. The examples are contained in tests of a separate module, so that their
+// dependencies are not required by the module of the libraries themselves.
+package examples
@@ -0,0 +1,13 @@
+module github.com/privacybydesign/irmago/server/examples
+
+go 1.15
+
+require (
+	github.com/go-errors/errors v1.0.1
+	github.com/privacybydesign/irmago v0.0.0
+	github.com/stretchr/testify v1.7.0
+	go.opentelemetry.io/otel v0.19.0
+	go.opentelemetry.io/otel/trace v0.19.0
+)
+
+replace github.com/privacybydesign/irmago => ../../
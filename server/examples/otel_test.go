@@ -0,0 +1,193 @@
+package examples
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/privacybydesign/irmago/server/keyshare/keyshareserver"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// openTelemetryHooks returns hooks that record sessions, keyshare operations and HTTP requests as
+// OpenTelemetry spans. The span of a session starts when the session is created and ends when it
+// finishes, with an event for each status change.
+func openTelemetryHooks(tracer trace.Tracer) *server.Hooks {
+	var lock sync.Mutex
+	sessions := map[irma.RequestorToken]trace.Span{}
+
+	// Spans of completed operations are started and ended retroactively
+	record := func(name string, duration time.Duration, err error, attrs ...attribute.KeyValue) {
+		end := time.Now()
+		_, span := tracer.Start(context.Background(), name,
+			trace.WithTimestamp(end.Add(-duration)),
+			trace.WithAttributes(attrs...),
+		)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End(trace.WithTimestamp(end))
+	}
+
+	return &server.Hooks{
+		OnSessionCreated: func(token irma.RequestorToken, action irma.Action) {
+			_, span := tracer.Start(context.Background(), "irma.session",
+				trace.WithAttributes(attribute.String("irma.session.type", string(action))),
+			)
+			lock.Lock()
+			defer lock.Unlock()
+			sessions[token] = span
+		},
+		OnSessionStatusChange: func(token irma.RequestorToken, old, new irma.ServerStatus) {
+			lock.Lock()
+			defer lock.Unlock()
+			span := sessions[token]
+			if span == nil {
+				// Created by another server sharing the Redis session store
+				return
+			}
+			span.AddEvent("irma.session.status", trace.WithAttributes(
+				attribute.String("irma.session.status.old", string(old)),
+				attribute.String("irma.session.status.new", string(new)),
+			))
+			if new.Finished() {
+				span.SetAttributes(attribute.String("irma.session.status", string(new)))
+				span.End()
+				delete(sessions, token)
+			}
+		},
+		OnKeyshareOperation: func(username string, op server.KeyshareOperation, duration time.Duration, err error) {
+			record("keyshare."+string(op), duration, err, attribute.String("keyshare.username", username))
+		},
+		OnHTTPRequest: func(route string, status int, duration time.Duration) {
+			var err error
+			if status >= 500 {
+				err = errors.New(http.StatusText(status))
+			}
+			record("HTTP "+route, duration, err,
+				attribute.String("http.route", route),
+				attribute.Int("http.status_code", status),
+			)
+		},
+	}
+}
+
+func Example_openTelemetry() {
+	// Use the tracer provider configured by the application, e.g. exporting to an OTLP collector
+	hooks := openTelemetryHooks(otel.Tracer("github.com/privacybydesign/irmago/server"))
+
+	irmaServer, err := irmaserver.New(&server.Configuration{
+		URL:   "https://example.com/irma",
+		Hooks: hooks,
+	})
+	if err != nil {
+		panic(err)
+	}
+	http.Handle("/irma/", irmaServer.HandlerFunc())
+
+	// The keyshare server uses the hooks of its embedded server configuration
+	keyshareServer, err := keyshareserver.New(&keyshareserver.Configuration{
+		Configuration: &server.Configuration{
+			URL:   "https://example.com/keyshare/irma",
+			Hooks: hooks,
+		},
+		DBType:    keyshareserver.DBTypePostgres,
+		DBConnStr: "postgresql://localhost:5432/keyshare",
+	})
+	if err != nil {
+		panic(err)
+	}
+	http.Handle("/keyshare/", http.StripPrefix("/keyshare", keyshareServer.Handler()))
+}
+
+// recordingTracer records the spans it starts, which are no-op spans apart from recording their
+// name, attributes, events, error and whether they ended.
+type recordingTracer struct {
+	sync.Mutex
+	spans []*recordingSpan
+}
+
+type recordingSpan struct {
+	trace.Span
+	name   string
+	attrs  map[attribute.Key]attribute.Value
+	events []string
+	err    error
+	ended  bool
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, opts ...trace.SpanOption) (context.Context, trace.Span) {
+	t.Lock()
+	defer t.Unlock()
+	span := &recordingSpan{
+		Span:  trace.SpanFromContext(context.Background()),
+		name:  name,
+		attrs: map[attribute.Key]attribute.Value{},
+	}
+	span.SetAttributes(trace.NewSpanConfig(opts...).Attributes...)
+	t.spans = append(t.spans, span)
+	return ctx, span
+}
+
+func (s *recordingSpan) SetAttributes(kv ...attribute.KeyValue) {
+	for _, attr := range kv {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *recordingSpan) AddEvent(name string, _ ...trace.EventOption) {
+	s.events = append(s.events, name)
+}
+
+func (s *recordingSpan) RecordError(err error, _ ...trace.EventOption) {
+	s.err = err
+}
+
+func (s *recordingSpan) End(...trace.SpanOption) {
+	s.ended = true
+}
+
+func TestOpenTelemetryHooks(t *testing.T) {
+	tracer := &recordingTracer{}
+	hooks := openTelemetryHooks(tracer)
+
+	hooks.SessionCreated("token", irma.ActionIssuing)
+	hooks.SessionStatusChange("token", irma.ServerStatusInitialized, irma.ServerStatusConnected)
+	require.Len(t, tracer.spans, 1)
+	session := tracer.spans[0]
+	require.Equal(t, "irma.session", session.name)
+	require.Equal(t, "issuing", session.attrs["irma.session.type"].AsString())
+	require.False(t, session.ended)
+
+	hooks.SessionStatusChange("token", irma.ServerStatusConnected, irma.ServerStatusDone)
+	require.True(t, session.ended)
+	require.Len(t, session.events, 2)
+	require.Equal(t, "DONE", session.attrs["irma.session.status"].AsString())
+
+	// Status changes of sessions created elsewhere are ignored
+	hooks.SessionStatusChange("other", irma.ServerStatusConnected, irma.ServerStatusDone)
+	require.Len(t, tracer.spans, 1)
+
+	hooks.KeyshareOperation("user", server.KeyshareOperationVerifyPin, time.Millisecond, errors.New("database unavailable"))
+	require.Len(t, tracer.spans, 2)
+	require.Equal(t, "keyshare.verifyPin", tracer.spans[1].name)
+	require.Error(t, tracer.spans[1].err)
+	require.True(t, tracer.spans[1].ended)
+
+	hooks.HTTPRequest("/session/{clientToken}/status", http.StatusOK, time.Millisecond)
+	require.Len(t, tracer.spans, 3)
+	require.Equal(t, "HTTP /session/{clientToken}/status", tracer.spans[2].name)
+	require.Equal(t, int64(http.StatusOK), tracer.spans[2].attrs["http.status_code"].AsInt64())
+	require.NoError(t, tracer.spans[2].err)
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/sirupsen/logrus"
+)
+
+// KeyshareOperation is an operation of the keyshare server reported to Hooks.OnKeyshareOperation.
+type KeyshareOperation string
+
+const (
+	KeyshareOperationRegister    KeyshareOperation = "register"
+	KeyshareOperationVerifyPin   KeyshareOperation = "verifyPin"
+	KeyshareOperationChangePin   KeyshareOperation = "changePin"
+	KeyshareOperationCommitments KeyshareOperation = "commitments"
+	KeyshareOperationResponse    KeyshareOperation = "response"
+)
+
+// Hooks contains callbacks with which applications embedding the IRMA server or keyshare server
+// as a library can observe them, e.g. to record traces or metrics. All callbacks are optional, and
+// a nil *Hooks calls none of them.
+//
+// The callbacks are called synchronously, in the goroutine handling the event, so they must return
+// quickly; in particular OnSessionCreated and OnSessionStatusChange are called while the session is
+// locked. Panics in callbacks are recovered and logged. For each session, OnSessionCreated is called
+// before OnSessionStatusChange, and the status changes are reported in the order in which they occur.
+// When sessions are stored in Redis, each server reports the status changes that it makes, so that
+// callbacks of different servers may be called for the same session.
+type Hooks struct {
+	// OnSessionCreated is called when a session is started.
+	OnSessionCreated func(token irma.RequestorToken, action irma.Action)
+	// OnSessionStatusChange is called when the status of a session changes.
+	OnSessionStatusChange func(token irma.RequestorToken, old, new irma.ServerStatus)
+	// OnKeyshareOperation is called by the keyshare server when it completed an operation for a
+	// user, with the error with which it failed if any. Failed PIN verifications are not errors.
+	// For registrations, the username is empty if registering failed before it was generated.
+	OnKeyshareOperation func(username string, op KeyshareOperation, duration time.Duration, err error)
+	// OnHTTPRequest is called when an HTTP request was handled, with its route pattern
+	// (e.g. /session/{clientToken}/status), which is empty if no route matched.
+	OnHTTPRequest func(route string, status int, duration time.Duration)
+	// OnConfigReload is called by the keyshare server when its configuration was reloaded, with the
+	// names of the settings that changed, or with the error with which the reload was rejected.
+	OnConfigReload func(changed []string, err error)
+	// OnKeyshareReadOnly is called by the keyshare server when it starts and whenever its read-only
+	// maintenance mode is switched on or off, with whether it is now in read-only mode.
+	OnKeyshareReadOnly func(readOnly bool)
+	// OnKeyshareDBOperation is called by the keyshare server after each operation on its database
+	// (e.g. "addLog"), with the error with which its queries failed if any (so not when e.g. a
+	// user was not found). It is not called when the keyshare server uses an in-memory database.
+	OnKeyshareDBOperation func(op string, duration time.Duration, err error)
+	// OnKeyshareKeysLoaded is called by the keyshare server whenever it loaded the Idemix public keys
+	// of the issuers into its core, with the amount of keys that were loaded and that failed to load.
+	OnKeyshareKeysLoaded func(loaded, failed int)
+}
+
+// SessionCreated calls OnSessionCreated, if set.
+func (h *Hooks) SessionCreated(token irma.RequestorToken, action irma.Action) {
+	if h == nil || h.OnSessionCreated == nil {
+		return
+	}
+	defer recoverHook("OnSessionCreated")
+	h.OnSessionCreated(token, action)
+}
+
+// SessionStatusChange calls OnSessionStatusChange, if set.
+func (h *Hooks) SessionStatusChange(token irma.RequestorToken, old, new irma.ServerStatus) {
+	if h == nil || h.OnSessionStatusChange == nil {
+		return
+	}
+	defer recoverHook("OnSessionStatusChange")
+	h.OnSessionStatusChange(token, old, new)
+}
+
+// KeyshareOperation calls OnKeyshareOperation, if set.
+func (h *Hooks) KeyshareOperation(username string, op KeyshareOperation, duration time.Duration, err error) {
+	if h == nil || h.OnKeyshareOperation == nil {
+		return
+	}
+	defer recoverHook("OnKeyshareOperation")
+	h.OnKeyshareOperation(username, op, duration, err)
+}
+
+// HTTPRequest calls OnHTTPRequest, if set.
+func (h *Hooks) HTTPRequest(route string, status int, duration time.Duration) {
+	if h == nil || h.OnHTTPRequest == nil {
+		return
+	}
+	defer recoverHook("OnHTTPRequest")
+	h.OnHTTPRequest(route, status, duration)
+}
+
+// ConfigReload calls OnConfigReload, if set.
+func (h *Hooks) ConfigReload(changed []string, err error) {
+	if h == nil || h.OnConfigReload == nil {
+		return
+	}
+	defer recoverHook("OnConfigReload")
+	h.OnConfigReload(changed, err)
+}
+
+// KeyshareReadOnly calls OnKeyshareReadOnly, if set.
+func (h *Hooks) KeyshareReadOnly(readOnly bool) {
+	if h == nil || h.OnKeyshareReadOnly == nil {
+		return
+	}
+	defer recoverHook("OnKeyshareReadOnly")
+	h.OnKeyshareReadOnly(readOnly)
+}
+
+// KeyshareDBOperation calls OnKeyshareDBOperation, if set.
+func (h *Hooks) KeyshareDBOperation(op string, duration time.Duration, err error) {
+	if h == nil || h.OnKeyshareDBOperation == nil {
+		return
+	}
+	defer recoverHook("OnKeyshareDBOperation")
+	h.OnKeyshareDBOperation(op, duration, err)
+}
+
+// KeyshareKeysLoaded calls OnKeyshareKeysLoaded, if set.
+func (h *Hooks) KeyshareKeysLoaded(loaded, failed int) {
+	if h == nil || h.OnKeyshareKeysLoaded == nil {
+		return
+	}
+	defer recoverHook("OnKeyshareKeysLoaded")
+	h.OnKeyshareKeysLoaded(loaded, failed)
+}
+
+func recoverHook(name string) {
+	if e := recover(); e != nil {
+		Logger.WithFields(logrus.Fields{"hook": name, "panic": e}).Error("Recovered from panic in hook")
+	}
+}
+
+type hooksContextKey struct{}
+
+// HooksMiddleware reports the requests that it handles to Hooks.OnHTTPRequest. Requests are
+// reported once, by the outermost HooksMiddleware, so that requests to a router mounted in
+// another router using this middleware are not reported twice.
+func HooksMiddleware(hooks *Hooks) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if hooks == nil || hooks.OnHTTPRequest == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Context().Value(hooksContextKey{}) != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), hooksContextKey{}, true))
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			start := time.Now()
+			defer func() {
+				var route string
+				if rctx := chi.RouteContext(r.Context()); rctx != nil {
+					route = rctx.RoutePattern()
+				}
+				status := ww.Status()
+				if status == 0 {
+					status = http.StatusOK
+				}
+				hooks.HTTPRequest(route, status, time.Since(start))
+			}()
+			next.ServeHTTP(ww, r)
+		})
+	}
+}
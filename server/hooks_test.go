@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHooks(t *testing.T) {
+	// Without hooks, or with unset callbacks, nothing happens
+	var hooks *Hooks
+	hooks.SessionCreated("token", irma.ActionDisclosing)
+	hooks.KeyshareOperation("user", KeyshareOperationVerifyPin, time.Second, nil)
+	hooks.ConfigReload([]string{"sunset_date"}, nil)
+	(&Hooks{}).SessionStatusChange("token", irma.ServerStatusInitialized, irma.ServerStatusDone)
+
+	// Panics are recovered
+	called := false
+	hooks = &Hooks{OnSessionCreated: func(irma.RequestorToken, irma.Action) {
+		called = true
+		panic("hook failed")
+	}}
+	require.NotPanics(t, func() { hooks.SessionCreated("token", irma.ActionDisclosing) })
+	require.True(t, called)
+}
+
+func TestHooksMiddleware(t *testing.T) {
+	type request struct {
+		route  string
+		status int
+	}
+	var requests []request
+	hooks := &Hooks{OnHTTPRequest: func(route string, status int, _ time.Duration) {
+		requests = append(requests, request{route, status})
+	}}
+
+	inner := chi.NewRouter()
+	inner.Use(HooksMiddleware(hooks))
+	inner.Get("/session/{token}/status", func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, ErrorSessionUnknown, "")
+	})
+	outer := chi.NewRouter()
+	outer.Use(HooksMiddleware(hooks))
+	outer.Get("/version", func(w http.ResponseWriter, r *http.Request) {
+		WriteString(w, "1")
+	})
+	outer.Mount("/irma", inner)
+
+	for _, path := range []string{"/version", "/irma/session/foo/status", "/unknown"} {
+		outer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	require.Equal(t, []request{
+		{"/version", http.StatusOK},
+		{"/irma/session/{token}/status", ErrorSessionUnknown.Status},
+		{"", http.StatusNotFound},
+	}, requests)
+
+	// Without callback, the handler is left alone
+	handler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	require.NotNil(t, HooksMiddleware(nil)(handler))
+}
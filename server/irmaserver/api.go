@@ -9,6 +9,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/bsm/redislock"
@@ -31,6 +32,11 @@ type Server struct {
 	scheduler        *gocron.Scheduler
 	stopScheduler    chan bool
 	serverSentEvents *sse.Server
+	staticLimiter    *staticSessionLimiter
+	staticErrors     *staticSessionErrors
+	credentialTypes  *credentialTypeAssets
+
+	removeUpdateListener func()
 }
 
 // Default server instance
@@ -56,20 +62,29 @@ func New(conf *server.Configuration) (*Server, error) {
 		conf:             conf,
 		scheduler:        gocron.NewScheduler(),
 		serverSentEvents: e,
+		staticLimiter:    &staticSessionLimiter{counts: map[string]int{}},
+		staticErrors:     &staticSessionErrors{errs: map[string]error{}},
+		credentialTypes:  newCredentialTypeAssets(conf.IrmaConfiguration),
 	}
 
 	switch conf.StoreType {
 	case "":
 		fallthrough // no specification defaults to the memory session store
 	case "memory":
-		s.sessions = &memorySessionStore{
-			requestor: make(map[irma.RequestorToken]*session),
-			client:    make(map[irma.ClientToken]*session),
-			conf:      conf,
+		store := newMemorySessionStore(conf)
+		s.sessions = store
+		if conf.CachePath != "" {
+			store.loadSnapshot(e)
 		}
 
 		s.scheduler.Every(10).Seconds().Do(func() {
-			s.sessions.(*memorySessionStore).deleteExpired()
+			store.deleteExpired()
+			if conf.CachePath == "" {
+				return
+			}
+			if err := store.saveSnapshot(); err != nil {
+				_ = server.LogError(errors.WrapPrefix(err, "failed to save session snapshot", 0))
+			}
 		})
 	case "redis":
 		// Configure Redis TLS. If Redis TLS is disabled, tlsConfig becomes nil and the redis client will not use TLS.
@@ -110,6 +125,24 @@ func New(conf *server.Configuration) (*Server, error) {
 		}
 	})
 
+	s.scheduler.Every(1).Minute().Do(s.staticLimiter.reset)
+
+	// Static sessions whose request is invalid for the current schemes are disabled. In production
+	// we refuse to start instead, as it is most likely a configuration mistake.
+	for name, err := range s.validateStaticSessions() {
+		if conf.Production {
+			return nil, errors.WrapPrefix(err, "invalid static session request "+name, 0)
+		}
+	}
+
+	// Check the static session requests again whenever the schemes change, so that we notice when
+	// they refer to something that no longer exists, or when disabled ones have become valid again.
+	// Also forget the credential type metadata and logos served to clients, which may have changed.
+	s.removeUpdateListener = conf.IrmaConfiguration.AddUpdateListener(func(*irma.Configuration) {
+		s.credentialTypes.clear()
+		s.validateStaticSessions()
+	}, false)
+
 	s.stopScheduler = s.scheduler.Start()
 
 	return s, nil
@@ -154,6 +187,8 @@ func redisTLSConfig(conf *server.Configuration) (*tls.Config, error) {
 //   http.HandleFunc("/irma/", irmaserver.HandlerFunc())
 //
 // The IRMA app can then perform IRMA sessions at https://example.com/irma.
+// To protect the http.Server serving it against slow clients, use the ConfigureHTTPServer() and
+// LimitListener() methods of the server.Configuration.
 func HandlerFunc() http.HandlerFunc {
 	return s.HandlerFunc()
 }
@@ -165,14 +200,31 @@ func (s *Server) HandlerFunc() http.HandlerFunc {
 	r := chi.NewRouter()
 	s.router = r
 
+	r.Use(server.HooksMiddleware(s.conf.Hooks))
 	opts := server.LogOptions{Response: true, Headers: true, From: false, EncodeBinary: true}
 	r.Use(server.LogMiddleware("client", opts))
 
 	r.Use(server.SizeLimitMiddleware)
-	r.Use(server.TimeoutMiddleware([]string{"/statusevents", "/updateevents"}, server.WriteTimeout))
-
-	notfound := &irma.RemoteError{Status: 404, ErrorName: string(server.ErrorInvalidRequest.Type)}
-	notallowed := &irma.RemoteError{Status: 405, ErrorName: string(server.ErrorInvalidRequest.Type)}
+	statusTimeout := time.Duration(s.conf.StatusTimeout) * time.Second
+	proofTimeout := time.Duration(s.conf.ProofTimeout) * time.Second
+	r.Use(server.TimeoutMiddleware(map[string]time.Duration{
+		"/statusevents": 0,
+		"/updateevents": 0,
+		"/status":       statusTimeout,
+		"/commitments":  proofTimeout,
+		"/proofs":       proofTimeout,
+	}, server.WriteTimeout))
+
+	notfound := &irma.RemoteError{
+		Status:      server.ErrorUnknownEndpoint.Status,
+		ErrorName:   string(server.ErrorUnknownEndpoint.Type),
+		Description: server.ErrorUnknownEndpoint.Description,
+	}
+	notallowed := &irma.RemoteError{
+		Status:      server.ErrorMethodNotAllowed.Status,
+		ErrorName:   string(server.ErrorMethodNotAllowed.Type),
+		Description: server.ErrorMethodNotAllowed.Description,
+	}
 	r.NotFound(errorWriter(notfound, server.WriteResponse))
 	r.MethodNotAllowed(errorWriter(notallowed, server.WriteResponse))
 
@@ -181,10 +233,12 @@ func (s *Server) HandlerFunc() http.HandlerFunc {
 		r.Delete("/", s.handleSessionDelete)
 		r.Get("/status", s.handleSessionStatus)
 		r.Get("/statusevents", s.handleSessionStatusEvents)
+		r.With(s.frontendMiddleware).Get("/description", s.handleSessionDescription)
 		r.Route("/frontend", func(r chi.Router) {
 			r.Use(s.frontendMiddleware)
 			r.Get("/status", s.handleFrontendStatus)
 			r.Get("/statusevents", s.handleFrontendStatusEvents)
+			r.Get("/request", s.handleFrontendRequest)
 			r.Post("/options", s.handleFrontendOptionsPost)
 			r.Post("/pairingcompleted", s.handleFrontendPairingCompleted)
 		})
@@ -200,6 +254,12 @@ func (s *Server) HandlerFunc() http.HandlerFunc {
 		})
 	})
 	r.Post("/session/{name}", s.handleStaticMessage)
+	r.Get("/session/static/{name}", s.handleStaticMessage)
+
+	r.Route("/credentialtypes/{id}", func(r chi.Router) {
+		r.Get("/", s.handleCredentialTypeMetadata)
+		r.Get("/logo", s.handleCredentialTypeLogo)
+	})
 
 	r.Route("/revocation/{id}", func(r chi.Router) {
 		r.NotFound(errorWriter(notfound, server.WriteBinaryResponse))
@@ -219,6 +279,7 @@ func Stop() {
 	s.Stop()
 }
 func (s *Server) Stop() {
+	s.removeUpdateListener()
 	if err := s.conf.IrmaConfiguration.Revocation.Close(); err != nil {
 		_ = server.LogWarning(err)
 	}
@@ -238,10 +299,23 @@ func StartSession(request interface{}, handler server.SessionHandler,
 }
 func (s *Server) StartSession(req interface{}, handler server.SessionHandler,
 ) (*irma.Qr, irma.RequestorToken, *irma.FrontendSessionRequest, error) {
-	return s.startNextSession(req, handler, nil, "")
+	return s.startNextSession(req, handler, nil, "", "")
+}
+
+// StartRequestorSession is like StartSession, but additionally associates the session, as well as
+// any chained sessions following it, with the specified requestor. The amount of active sessions
+// of each requestor is limited by the MaxActiveRequestorSessions configuration option.
+func StartRequestorSession(request interface{}, handler server.SessionHandler, requestor string,
+) (*irma.Qr, irma.RequestorToken, *irma.FrontendSessionRequest, error) {
+	return s.StartRequestorSession(request, handler, requestor)
 }
+func (s *Server) StartRequestorSession(req interface{}, handler server.SessionHandler, requestor string,
+) (*irma.Qr, irma.RequestorToken, *irma.FrontendSessionRequest, error) {
+	return s.startNextSession(req, handler, nil, "", requestor)
+}
+
 func (s *Server) startNextSession(
-	req interface{}, handler server.SessionHandler, disclosed irma.AttributeConDisCon, FrontendAuth irma.FrontendAuthorization,
+	req interface{}, handler server.SessionHandler, disclosed irma.AttributeConDisCon, FrontendAuth irma.FrontendAuthorization, requestor string,
 ) (*irma.Qr, irma.RequestorToken, *irma.FrontendSessionRequest, error) {
 	if s.conf.StoreType == "redis" && handler != nil {
 		return nil, "", nil, errors.New("Handlers cannot be used in combination with Redis.")
@@ -254,6 +328,10 @@ func (s *Server) startNextSession(
 	request := rrequest.SessionRequest()
 	action := request.Action()
 
+	// Check this first, so that we don't complain about e.g. missing private keys instead
+	if !s.conf.SessionTypeEnabled(action) {
+		return nil, "", nil, &SessionTypeDisabledError{Action: action}
+	}
 	if err := s.validateRequest(request); err != nil {
 		return nil, "", nil, err
 	}
@@ -289,11 +367,15 @@ func (s *Server) startNextSession(
 	}
 
 	request.Base().DevelopmentMode = !s.conf.Production
-	session, err := s.newSession(action, rrequest, disclosed, FrontendAuth)
+	session, err := s.newSession(action, rrequest, disclosed, FrontendAuth, requestor)
 	if err != nil {
 		return nil, "", nil, err
 	}
-	s.conf.Logger.WithFields(logrus.Fields{"action": action, "session": session.RequestorToken}).Infof("Session started")
+	fields := logrus.Fields{"action": action, "session": session.RequestorToken}
+	if requestor != "" {
+		fields["requestor"] = requestor
+	}
+	s.conf.Logger.WithFields(fields).Infof("Session started")
 	if s.conf.Logger.IsLevelEnabled(logrus.DebugLevel) {
 		s.conf.Logger.
 			WithFields(logrus.Fields{"session": session.RequestorToken, "clienttoken": session.ClientToken}).
@@ -318,6 +400,15 @@ func (s *Server) startNextSession(
 		nil
 }
 
+// ActiveSessions returns the amount of sessions that are not yet finished, of the specified
+// requestor, or of all requestors if requestor is empty.
+func ActiveSessions(requestor string) (int, error) {
+	return s.ActiveSessions(requestor)
+}
+func (s *Server) ActiveSessions(requestor string) (int, error) {
+	return s.sessions.activeSessions(requestor)
+}
+
 // GetSessionResult retrieves the result of the specified IRMA session.
 func GetSessionResult(requestorToken irma.RequestorToken) (*server.SessionResult, error) {
 	return s.GetSessionResult(requestorToken)
@@ -333,6 +424,32 @@ func (s *Server) GetSessionResult(requestorToken irma.RequestorToken) (res *serv
 	return
 }
 
+// FetchSessionResult retrieves the result of the specified IRMA session like GetSessionResult, on
+// behalf of the requestor. Once the session is finished, the result is from then on only kept as
+// returned by server.LoggedResult, i.e. with the attribute values hashed or removed if so configured,
+// or if DeleteResultOnRead is configured, as returned by server.DeletedResult, in which case
+// fetching it again returns a *ResultConsumedError.
+func FetchSessionResult(requestorToken irma.RequestorToken) (*server.SessionResult, error) {
+	return s.FetchSessionResult(requestorToken)
+}
+func (s *Server) FetchSessionResult(requestorToken irma.RequestorToken) (res *server.SessionResult, err error) {
+	session, err := s.sessions.get(requestorToken)
+	defer func() { err = updateAndUnlock(session, err) }()
+	if err != nil {
+		return
+	}
+	if session.ResultDeleted {
+		err = &ResultConsumedError{requestorToken: requestorToken}
+		return
+	}
+
+	res = session.Result
+	if res != nil && res.Status.Finished() {
+		session.resultRead()
+	}
+	return
+}
+
 // GetRequest retrieves the request submitted by the requestor that started the specified IRMA session.
 func GetRequest(requestorToken irma.RequestorToken) (irma.RequestorRequest, error) {
 	return s.GetRequest(requestorToken)
@@ -407,14 +524,33 @@ func (s *Server) Revoke(credid irma.CredentialTypeIdentifier, key string, issued
 	return s.conf.IrmaConfiguration.Revocation.Revoke(credid, key, issued)
 }
 
+// StaticSessions returns the configured static sessions sorted by name. Static sessions whose
+// request is not valid for the current schemes are disabled, along with the reason why.
+func StaticSessions() []StaticSession {
+	return s.StaticSessions()
+}
+func (s *Server) StaticSessions() []StaticSession {
+	sessions := make([]StaticSession, 0, len(s.conf.StaticSessionRequests))
+	for name, rrequest := range s.conf.StaticSessionRequests {
+		static := StaticSession{Name: name, Request: rrequest, Enabled: true}
+		if err := s.staticErrors.get(name); err != nil {
+			static.Enabled = false
+			static.Error = err.Error()
+		}
+		sessions = append(sessions, static)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Name < sessions[j].Name })
+	return sessions
+}
+
 // SubscribeServerSentEvents subscribes the HTTP client to server sent events on status updates
 // of the specified IRMA session.
 func (s *Server) SubscribeServerSentEvents(w http.ResponseWriter, r *http.Request, token irma.RequestorToken) (err error) {
 	if !s.conf.EnableSSE {
 		server.WriteResponse(w, nil, &irma.RemoteError{
-			Status:      500,
-			Description: "Server sent events disabled",
-			ErrorName:   "SSE_DISABLED",
+			Status:      server.ErrorSSEDisabled.Status,
+			ErrorName:   string(server.ErrorSSEDisabled.Type),
+			Description: server.ErrorSSEDisabled.Description,
 		})
 		s.conf.Logger.Info("GET /statusevents: endpoint disabled (see --sse in irma server -h)")
 		return nil
@@ -442,9 +578,9 @@ func (s *Server) SubscribeServerSentEvents(w http.ResponseWriter, r *http.Reques
 func (s *Server) subscribeServerSentEvents(w http.ResponseWriter, r *http.Request, session *session, requestor bool) error {
 	if !s.conf.EnableSSE {
 		server.WriteResponse(w, nil, &irma.RemoteError{
-			Status:      500,
-			Description: "Server sent events disabled",
-			ErrorName:   "SSE_DISABLED",
+			Status:      server.ErrorSSEDisabled.Status,
+			ErrorName:   string(server.ErrorSSEDisabled.Type),
+			Description: server.ErrorSSEDisabled.Description,
 		})
 		s.conf.Logger.Info("GET /statusevents: endpoint disabled (see --sse in irma server -h)")
 		return nil
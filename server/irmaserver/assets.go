@@ -0,0 +1,114 @@
+package irmaserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/go-chi/chi"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// credentialTypeAssets caches the metadata and logos of credential types served to clients.
+// It is cleared when the schemes are updated.
+type credentialTypeAssets struct {
+	sync.Mutex
+	conf    *irma.Configuration
+	entries map[irma.CredentialTypeIdentifier]*credentialTypeAsset
+}
+
+type credentialTypeAsset struct {
+	metadata     []byte
+	metadataETag string
+	logo         []byte
+	logoType     string
+	logoETag     string
+}
+
+func newCredentialTypeAssets(conf *irma.Configuration) *credentialTypeAssets {
+	return &credentialTypeAssets{
+		conf:    conf,
+		entries: map[irma.CredentialTypeIdentifier]*credentialTypeAsset{},
+	}
+}
+
+// get returns the assets of the specified credential type, or nil if it does not exist.
+func (a *credentialTypeAssets) get(id irma.CredentialTypeIdentifier) (*credentialTypeAsset, error) {
+	a.Lock()
+	defer a.Unlock()
+	if asset, ok := a.entries[id]; ok {
+		return asset, nil
+	}
+
+	credtype := a.conf.CredentialTypes[id]
+	if credtype == nil {
+		return nil, nil
+	}
+	metadata, err := json.Marshal(credtype.Metadata(a.conf))
+	if err != nil {
+		return nil, err
+	}
+	asset := &credentialTypeAsset{metadata: metadata, metadataETag: etag(metadata)}
+	if path := credtype.Logo(a.conf); path != "" {
+		if asset.logo, err = ioutil.ReadFile(path); err != nil {
+			return nil, err
+		}
+		asset.logoType = http.DetectContentType(asset.logo)
+		asset.logoETag = etag(asset.logo)
+	}
+
+	a.entries[id] = asset
+	return asset, nil
+}
+
+func (a *credentialTypeAssets) clear() {
+	a.Lock()
+	defer a.Unlock()
+	a.entries = map[irma.CredentialTypeIdentifier]*credentialTypeAsset{}
+}
+
+func etag(content []byte) string {
+	hash := sha256.Sum256(content)
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+func (s *Server) credentialTypeAsset(w http.ResponseWriter, r *http.Request) *credentialTypeAsset {
+	id, err := irma.ParseCredentialTypeIdentifier(chi.URLParam(r, "id"))
+	if err != nil {
+		server.WriteError(w, server.ErrorUnknownCredentialType, err.Error())
+		return nil
+	}
+	asset, err := s.credentialTypes.get(id)
+	if err != nil {
+		_ = server.LogError(err)
+		server.WriteError(w, server.ErrorInternal, "")
+		return nil
+	}
+	if asset == nil {
+		server.WriteError(w, server.ErrorUnknownCredentialType, "")
+		return nil
+	}
+	return asset
+}
+
+func (s *Server) handleCredentialTypeMetadata(w http.ResponseWriter, r *http.Request) {
+	if asset := s.credentialTypeAsset(w, r); asset != nil {
+		server.WriteCacheable(w, r, "application/json", asset.metadataETag, asset.metadata)
+	}
+}
+
+func (s *Server) handleCredentialTypeLogo(w http.ResponseWriter, r *http.Request) {
+	asset := s.credentialTypeAsset(w, r)
+	if asset == nil {
+		return
+	}
+	if asset.logo == nil {
+		server.WriteError(w, server.ErrorNoLogo, "")
+		return
+	}
+	server.WriteCacheable(w, r, asset.logoType, asset.logoETag, asset.logo)
+}
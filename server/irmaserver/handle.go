@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/gabi/signed"
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/common"
@@ -30,18 +31,25 @@ func (session *session) handleDelete() {
 	}
 	session.markAlive()
 
-	session.Result = &server.SessionResult{Token: session.RequestorToken, Status: irma.ServerStatusCancelled, Type: session.Action}
+	session.Result = &server.SessionResult{Token: session.RequestorToken, Status: irma.ServerStatusCancelled, Type: session.Action, Requestor: session.Requestor}
 	session.setStatus(irma.ServerStatusCancelled)
 }
 
 func (session *session) handleGetClientRequest(min, max *irma.ProtocolVersion, clientAuth irma.ClientAuthorization) (
 	interface{}, *irma.RemoteError) {
 
+	if session.Status == irma.ServerStatusTimeout {
+		return nil, server.RemoteError(server.ErrorSessionUnknown, "Session expired")
+	}
 	if session.Status != irma.ServerStatusInitialized {
 		return nil, server.RemoteError(server.ErrorUnexpectedRequest, "Session already started")
 	}
 
 	session.markAlive()
+	// The proof age counts from the first time the nonce was handed to the client
+	if session.RequestSent.IsZero() {
+		session.RequestSent = timeNow()
+	}
 	logger := session.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken})
 
 	var err error
@@ -72,6 +80,7 @@ func (session *session) handleGetClientRequest(min, max *irma.ProtocolVersion, c
 
 	logger.WithFields(logrus.Fields{"version": session.Version.String()}).Debugf("Protocol version negotiated")
 	session.request.Base().ProtocolVersion = session.Version
+	session.markTestCredentials()
 
 	if session.Options.PairingMethod != irma.PairingMethodNone && session.Version.Above(2, 7) {
 		session.setStatus(irma.ServerStatusPairing)
@@ -106,6 +115,9 @@ func (session *session) handleGetStatus() (irma.ServerStatus, *irma.RemoteError)
 
 func (session *session) handlePostSignature(signature *irma.SignedMessage) (*irma.ServerSessionResponse, *irma.RemoteError) {
 	session.markAlive()
+	if rerr := session.checkProofAge(); rerr != nil {
+		return nil, rerr
+	}
 
 	var err error
 	var rerr *irma.RemoteError
@@ -115,7 +127,13 @@ func (session *session) handlePostSignature(signature *irma.SignedMessage) (*irm
 	request := session.request.(*irma.SignatureRequest)
 	request.Disclose = append(request.Disclose, session.ImplicitDisclosure...)
 
-	session.Result.Disclosed, session.Result.ProofStatus, err = signature.Verify(session.conf.IrmaConfiguration, request)
+	var result *server.VerificationResult
+	result, err = server.VerifySignature(session.conf.IrmaConfiguration, request, signature)
+	if session.conf.RejectTestCredentials {
+		result.RejectTestCredentials()
+	}
+	session.Result.Disclosed, session.Result.ProofStatus = result.Disclosed, result.ProofStatus
+	session.Result.ProofDetails = result.Issues
 	if err != nil && err == irma.ErrMissingPublicKey {
 		rerr = session.fail(server.ErrorUnknownPublicKey, err.Error())
 	} else if err != nil {
@@ -131,6 +149,9 @@ func (session *session) handlePostSignature(signature *irma.SignedMessage) (*irm
 
 func (session *session) handlePostDisclosure(disclosure *irma.Disclosure) (*irma.ServerSessionResponse, *irma.RemoteError) {
 	session.markAlive()
+	if rerr := session.checkProofAge(); rerr != nil {
+		return nil, rerr
+	}
 
 	var err error
 	var rerr *irma.RemoteError
@@ -139,7 +160,13 @@ func (session *session) handlePostDisclosure(disclosure *irma.Disclosure) (*irma
 	request := session.request.(*irma.DisclosureRequest)
 	request.Disclose = append(request.Disclose, session.ImplicitDisclosure...)
 
-	session.Result.Disclosed, session.Result.ProofStatus, err = disclosure.Verify(session.conf.IrmaConfiguration, request)
+	var result *server.VerificationResult
+	result, err = server.VerifyDisclosure(session.conf.IrmaConfiguration, request, disclosure)
+	if session.conf.RejectTestCredentials {
+		result.RejectTestCredentials()
+	}
+	session.Result.Disclosed, session.Result.ProofStatus = result.Disclosed, result.ProofStatus
+	session.Result.ProofDetails = result.Issues
 	if err != nil && err == irma.ErrMissingPublicKey {
 		rerr = session.fail(server.ErrorUnknownPublicKey, err.Error())
 	} else if err != nil {
@@ -155,6 +182,9 @@ func (session *session) handlePostDisclosure(disclosure *irma.Disclosure) (*irma
 
 func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentMessage) (*irma.ServerSessionResponse, *irma.RemoteError) {
 	session.markAlive()
+	if rerr := session.checkProofAge(); rerr != nil {
+		return nil, rerr
+	}
 	request := session.request.(*irma.IssuanceRequest)
 
 	discloseCount := len(commitments.Proofs) - len(request.Credentials)
@@ -170,7 +200,7 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 	}
 	for _, cred := range request.Credentials {
 		iss := cred.CredentialTypeID.IssuerIdentifier()
-		pubkey, _ := session.conf.IrmaConfiguration.PublicKey(iss, cred.KeyCounter) // No error, already checked earlier
+		pubkey, _ := session.conf.IrmaConfiguration.PublicKey(iss, cred.PublicKeyCounter()) // No error, already checked earlier
 		pubkeys = append(pubkeys, pubkey)
 	}
 
@@ -200,34 +230,68 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 			return nil, session.fail(server.ErrorUnknown, "")
 		}
 	}
+	if session.conf.RejectTestCredentials && session.Result.ProofStatus == irma.ProofStatusValid &&
+		server.TestCredentialDisclosed(session.Result.Disclosed) {
+		session.Result.ProofStatus = irma.ProofStatusTestCredential
+	}
+	session.Result.ProofDetails = server.ProofIssues(session.conf.IrmaConfiguration, commitments.Proofs[:discloseCount],
+		request.Disclose, session.Result.ProofStatus, session.Result.Disclosed, now)
 	if session.Result.ProofStatus == irma.ProofStatusExpired {
 		return nil, session.fail(server.ErrorAttributesExpired, "")
 	}
+	if session.Result.ProofStatus == irma.ProofStatusTestCredential {
+		return nil, session.fail(server.ErrorTestCredential, "")
+	}
 	if session.Result.ProofStatus != irma.ProofStatusValid {
 		return nil, session.fail(server.ErrorInvalidProofs, "")
 	}
 
-	// Compute CL signatures
-	var sigs []*gabi.IssueSignatureMessage
+	// Now that the disclosure is verified, fill in attribute values referring to disclosed attributes
+	disclosed := map[irma.AttributeTypeIdentifier]string{}
+	for _, attrlist := range session.Result.Disclosed {
+		for _, attr := range attrlist {
+			if attr.RawValue != nil {
+				disclosed[attr.Identifier] = *attr.RawValue
+			}
+		}
+	}
+
+	// Compute CL signatures. Unless all-or-nothing issuance is required, a credential that cannot
+	// be issued does not fail the session, as long as at least one other credential can be issued.
+	partial := !request.StrictIssuance && !session.Version.Below(2, 10)
+	var (
+		sigs    []*gabi.IssueSignatureMessage
+		errs    []*irma.RemoteError
+		results []*server.CredentialIssuanceResult
+		failed  int
+	)
 	for i, cred := range request.Credentials {
-		id := cred.CredentialTypeID.IssuerIdentifier()
-		pk, _ := session.conf.IrmaConfiguration.PublicKey(id, cred.KeyCounter)
-		sk, _ := session.conf.IrmaConfiguration.PrivateKeys.Latest(id)
-		issuer := gabi.NewIssuer(sk, pk, one)
 		proof, ok := commitments.Proofs[i+discloseCount].(*gabi.ProofU)
 		if !ok {
 			return nil, session.fail(server.ErrorMalformedInput, "Received invalid issuance commitment")
 		}
-		attrs, witness, err := session.computeAttributes(sk, cred)
+		result := &server.CredentialIssuanceResult{CredentialTypeID: cred.CredentialTypeID}
+		results = append(results, result)
+		sig, err := session.issueSignature(cred, disclosed, proof, commitments.Nonce2)
 		if err != nil {
-			return nil, session.fail(server.ErrorIssuanceFailed, err.Error())
-		}
-		rb := session.conf.IrmaConfiguration.CredentialTypes[cred.CredentialTypeID].RandomBlindAttributeIndices()
-		sig, err := issuer.IssueSignature(proof.U, attrs, witness, commitments.Nonce2, rb)
-		if err != nil {
-			return nil, session.fail(server.ErrorIssuanceFailed, err.Error())
+			if !partial {
+				return nil, session.fail(server.ErrorIssuanceFailed, err.Error())
+			}
+			result.Err = server.RemoteError(server.ErrorIssuanceFailed, err.Error())
+			failed++
+		} else {
+			result.Issued = true
 		}
 		sigs = append(sigs, sig)
+		errs = append(errs, result.Err)
+	}
+	if failed == len(request.Credentials) {
+		return nil, session.fail(server.ErrorIssuanceFailed, "none of the credentials could be issued")
+	}
+	session.Result.Credentials = results
+	session.Result.PartiallyIssued = failed > 0
+	if failed == 0 {
+		errs = nil
 	}
 
 	return &irma.ServerSessionResponse{
@@ -235,9 +299,42 @@ func (session *session) handlePostCommitments(commitments *irma.IssueCommitmentM
 		ProtocolVersion: session.Version,
 		ProofStatus:     session.Result.ProofStatus,
 		IssueSignatures: sigs,
+		IssueErrors:     errs,
 	}, nil
 }
 
+// issueSignature computes the CL signature over the specified credential,
+// after filling in its attribute values that refer to disclosed attributes.
+func (session *session) issueSignature(
+	cred *irma.CredentialRequest,
+	disclosed map[irma.AttributeTypeIdentifier]string,
+	proof *gabi.ProofU,
+	nonce2 *big.Int,
+) (*gabi.IssueSignatureMessage, error) {
+	cred, err := cred.WithDisclosedValues(disclosed)
+	if err != nil {
+		return nil, err
+	}
+	id := cred.CredentialTypeID.IssuerIdentifier()
+	pk, _ := session.conf.IrmaConfiguration.PublicKey(id, cred.PublicKeyCounter()) // No error, already checked earlier
+	// The values of attributes referring to disclosed attributes are only known now
+	if err = cred.ValidateAttributeValues(); err != nil {
+		return nil, err
+	}
+	// Sign using the key selected when the session was started, even if a newer key was added since
+	sk, err := session.conf.IrmaConfiguration.PrivateKeys.Get(id, cred.PublicKeyCounter())
+	if err != nil {
+		return nil, err
+	}
+	issuer := gabi.NewIssuer(sk, pk, one)
+	attrs, witness, err := session.computeAttributes(sk, cred)
+	if err != nil {
+		return nil, err
+	}
+	rb := session.conf.IrmaConfiguration.CredentialTypes[cred.CredentialTypeID].RandomBlindAttributeIndices()
+	return issuer.IssueSignature(proof.U, attrs, witness, nonce2, rb)
+}
+
 func (session *session) nextSession() (irma.RequestorRequest, irma.AttributeConDisCon, error) {
 	base := session.Rrequest.Base()
 	if base.NextSession == nil {
@@ -261,6 +358,7 @@ func (session *session) nextSession() (irma.RequestorRequest, irma.AttributeConD
 			session.conf.JwtIssuer,
 			base.ResultJwtValidity,
 			session.conf.JwtRSAPrivateKey,
+			base.ResultJwtProofDetails,
 		)
 		if err != nil {
 			return nil, nil, err
@@ -270,7 +368,9 @@ func (session *session) nextSession() (irma.RequestorRequest, irma.AttributeConD
 	}
 
 	var reqbts json.RawMessage
-	err = irma.NewHTTPTransport("", false).Post(url, &reqbts, res)
+	transport := session.conf.Egress.Transport("", false, true)
+	transport.LoggedBody = server.LoggedResult(session.Result)
+	err = transport.Post(url, &reqbts, res)
 	if err != nil {
 		if sessErr, ok := err.(*irma.SessionError); ok && sessErr.RemoteStatus == http.StatusNoContent {
 			// 204 instead of a new sessionRequest means no next session is coming
@@ -311,7 +411,7 @@ func (s *Server) startNext(session *session, res *irma.ServerSessionResponse) er
 	// All attributes that were disclosed in the previous session, as well as any attributes
 	// from sessions before that, need to be disclosed in the new session as well.
 	// Therefore pass them as parameters to startNextSession
-	qr, token, _, err := s.startNextSession(next, nil, disclosed, session.FrontendAuth)
+	qr, token, _, err := s.startNextSession(next, nil, disclosed, session.FrontendAuth, session.Requestor)
 	if err != nil {
 		return err
 	}
@@ -445,10 +545,37 @@ func (s *Server) handleSessionGetRequest(w http.ResponseWriter, r *http.Request)
 
 func (s *Server) handleFrontendStatus(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value("session").(*session)
-	status := irma.FrontendSessionStatus{Status: session.Status, NextSession: session.Next}
+	status := session.frontendStatus()
 	server.WriteResponse(w, status, nil)
 }
 
+// handleFrontendRequest returns the session request without requestor-internal fields.
+func (s *Server) handleFrontendRequest(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value("session").(*session)
+	if session.Status == irma.ServerStatusTimeout {
+		server.WriteError(w, server.ErrorSessionUnknown, "Session expired")
+		return
+	}
+	request, err := session.getFrontendRequest()
+	if err != nil {
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+	server.WriteResponse(w, request, nil)
+}
+
+// handleSessionDescription describes the attributes that the session request asks for, in the
+// language specified by the lang query parameter (default English).
+func (s *Server) handleSessionDescription(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value("session").(*session)
+	lang := r.URL.Query().Get("lang")
+	if lang == "" {
+		lang = "en"
+	}
+	description := s.conf.IrmaConfiguration.DescribeRequest(session.Rrequest.SessionRequest(), lang)
+	server.WriteResponse(w, description, nil)
+}
+
 func (s *Server) handleFrontendStatusEvents(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value("session").(*session)
 	// Unlock session, so frontend status events will not block the session.
@@ -496,13 +623,26 @@ func (s *Server) handleFrontendPairingCompleted(w http.ResponseWriter, r *http.R
 }
 
 func (s *Server) handleStaticMessage(w http.ResponseWriter, r *http.Request) {
-	rrequest := s.conf.StaticSessionRequests[chi.URLParam(r, "name")]
+	name := chi.URLParam(r, "name")
+	rrequest := s.conf.StaticSessionRequests[name]
 	if rrequest == nil {
 		server.WriteResponse(w, nil, server.RemoteError(server.ErrorInvalidRequest, "unknown static session"))
 		return
 	}
+	if err := s.staticErrors.get(name); err != nil {
+		server.WriteResponse(w, nil, server.RemoteError(server.ErrorInvalidRequest, "static session disabled: "+err.Error()))
+		return
+	}
+	if !s.staticLimiter.allow(s.conf.TrustedProxyNetworks.ClientIP(r), s.conf.StaticSessionRateLimit) {
+		w.Header().Set("Retry-After", "60")
+		server.WriteResponse(w, nil, server.RemoteError(server.ErrorTooManyRequests, "too many static sessions started"))
+		return
+	}
 	qr, _, _, err := s.StartSession(rrequest, nil)
-	if err != nil {
+	if _, ok := err.(*TooManySessionsError); ok {
+		server.WriteResponse(w, nil, server.RemoteError(server.ErrorTooManySessions, err.Error()))
+		return
+	} else if err != nil {
 		server.WriteResponse(w, nil, server.RemoteError(server.ErrorMalformedInput, err.Error()))
 		return
 	}
@@ -511,7 +651,11 @@ func (s *Server) handleStaticMessage(w http.ResponseWriter, r *http.Request) {
 
 // GET revocation/events/{credtype}/{pkcounter}/{min}/{max}
 func (s *Server) handleRevocationGetEvents(w http.ResponseWriter, r *http.Request) {
-	cred := irma.NewCredentialTypeIdentifier(chi.URLParam(r, "id"))
+	cred, err := irma.ParseCredentialTypeIdentifier(chi.URLParam(r, "id"))
+	if err != nil {
+		server.WriteBinaryResponse(w, nil, server.RemoteError(server.ErrorInvalidRequest, err.Error()))
+		return
+	}
 	pkcounter, _ := strconv.ParseUint(chi.URLParam(r, "counter"), 10, 32)
 	min, _ := strconv.ParseUint(chi.URLParam(r, "min"), 10, 64)
 	max, _ := strconv.ParseUint(chi.URLParam(r, "max"), 10, 64)
@@ -546,7 +690,11 @@ func (s *Server) handleRevocationUpdateEvents(w http.ResponseWriter, r *http.Req
 
 // GET revocation/update/{credtype}/{count}[/{pkcounter}]
 func (s *Server) handleRevocationGetUpdateLatest(w http.ResponseWriter, r *http.Request) {
-	cred := irma.NewCredentialTypeIdentifier(chi.URLParam(r, "id")) // id
+	cred, err := irma.ParseCredentialTypeIdentifier(chi.URLParam(r, "id"))
+	if err != nil {
+		server.WriteBinaryResponse(w, nil, server.RemoteError(server.ErrorInvalidRequest, err.Error()))
+		return
+	}
 	count, _ := strconv.ParseUint(chi.URLParam(r, "count"), 10, 64) // count
 	c := chi.URLParam(r, "counter")
 	var counter *uint
@@ -582,7 +730,11 @@ func (s *Server) handleRevocationGetUpdateLatest(w http.ResponseWriter, r *http.
 
 // POST revocation/issuancerecord/{credtype}/{counter}
 func (s *Server) handleRevocationPostIssuanceRecord(w http.ResponseWriter, r *http.Request) {
-	cred := irma.NewCredentialTypeIdentifier(chi.URLParam(r, "id"))
+	cred, err := irma.ParseCredentialTypeIdentifier(chi.URLParam(r, "id"))
+	if err != nil {
+		server.WriteBinaryResponse(w, nil, server.RemoteError(server.ErrorInvalidRequest, err.Error()))
+		return
+	}
 	counter, _ := strconv.ParseUint(chi.URLParam(r, "counter"), 10, 32)
 
 	if settings := s.conf.RevocationSettings[cred]; settings == nil || !settings.Authority {
@@ -10,6 +10,7 @@ import (
 	"log"
 	"net/http"
 	"reflect"
+	"sync"
 	"time"
 
 	"github.com/alexandrevicenzi/go-sse"
@@ -36,12 +37,52 @@ func (session *session) markAlive() {
 		Debug("Session marked active, deletion delayed")
 }
 
+// expiry returns the time at which the session times out if it is not active before: after the
+// client timeout of the request (if specified) while the client has not yet connected, and after
+// the maximum session lifetime otherwise.
+func (session *session) expiry() time.Time {
+	lifetime := time.Duration(session.conf.MaxSessionLifetime) * time.Minute
+	if session.Status == irma.ServerStatusInitialized && session.Rrequest.Base().ClientTimeout != 0 {
+		lifetime = time.Duration(session.Rrequest.Base().ClientTimeout) * time.Second
+	}
+	if session.Status.Finished() && session.conf.ResultRetention != 0 {
+		lifetime = time.Duration(session.conf.ResultRetention) * time.Minute
+	}
+	return session.LastActive.Add(lifetime)
+}
+
+// expiresAt returns the expiry of the session as reported to the client and frontend, or nil if
+// the session is finished.
+func (session *session) expiresAt() *irma.Timestamp {
+	if session.Status.Finished() {
+		return nil
+	}
+	ts := irma.Timestamp(session.expiry())
+	return &ts
+}
+
+// checkExpiry times out the session if it expired, so that it cannot be continued in the period
+// before expired sessions are cleaned up.
+func (session *session) checkExpiry() {
+	if session.Status.Finished() || !session.expiry().Before(time.Now()) {
+		return
+	}
+	session.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken}).Info("Session expired")
+	session.markAlive()
+	session.setStatus(irma.ServerStatusTimeout)
+}
+
 func (session *session) setStatus(status irma.ServerStatus) {
 	session.conf.Logger.
 		WithFields(logrus.Fields{"session": session.RequestorToken, "status": status}).
 		Info("Session status updated")
+	old := session.Status
 	session.Status = status
 	session.Result.Status = status
+	if status.Finished() {
+		session.sessions.deactivate(session)
+	}
+	session.conf.Hooks.SessionStatusChange(session.RequestorToken, old, status)
 	session.onStatusChange()
 }
 
@@ -56,12 +97,16 @@ func (session *session) onStatusChange() {
 
 	// Execute callback and handler if status is Finished
 	if session.Status.Finished() {
-		session.doResultCallback()
+		result := session.Result
+		delivered := session.doResultCallback()
 
 		if session.handler != nil {
 			handler := session.handler
 			session.handler = nil
-			go handler(session.Result)
+			go handler(result)
+		}
+		if delivered && session.conf.DeleteResultOnRead {
+			session.resultRead()
 		}
 	}
 
@@ -75,23 +120,42 @@ func (session *session) onStatusChange() {
 	session.sse.SendMessage("session/"+string(session.RequestorToken),
 		sse.SimpleMessage(fmt.Sprintf(`"%s"`, session.Status)),
 	)
-	frontendstatus, _ := json.Marshal(irma.FrontendSessionStatus{Status: session.Status, NextSession: session.Next})
+	frontendstatus, _ := json.Marshal(session.frontendStatus())
 	session.sse.SendMessage("frontendsession/"+string(session.ClientToken),
 		sse.SimpleMessage(string(frontendstatus)),
 	)
 }
 
-func (session *session) doResultCallback() {
+// doResultCallback POSTs the session result to the callback URL of the session, if any, and
+// returns whether it was delivered.
+func (session *session) doResultCallback() bool {
 	url := session.Rrequest.Base().CallbackURL
 	if url == "" {
-		return
+		return false
 	}
-	server.DoResultCallback(url,
+	return server.DoResultCallback(session.conf.Egress, url,
 		session.Result,
 		session.conf.JwtIssuer,
 		session.Rrequest.Base().ResultJwtValidity,
 		session.conf.JwtRSAPrivateKey,
-	)
+		session.Rrequest.Base().ResultJwtProofDetails,
+	) == nil
+}
+
+// resultRead records that the requestor read the result of the finished session: from then on
+// the result is only kept as returned by server.LoggedResult, or server.DeletedResult if
+// DeleteResultOnRead is configured.
+func (session *session) resultRead() {
+	if session.ResultFetched {
+		return
+	}
+	session.ResultFetched = true
+	if session.conf.DeleteResultOnRead {
+		session.Result = server.DeletedResult(session.Result)
+		session.ResultDeleted = true
+	} else {
+		session.Result = server.LoggedResult(session.Result)
+	}
 }
 
 // Checks whether requested options are valid in the current session context.
@@ -123,7 +187,7 @@ func (session *session) pairingCompleted() error {
 
 func (session *session) fail(err server.Error, message string) *irma.RemoteError {
 	rerr := server.RemoteError(err, message)
-	session.Result = &server.SessionResult{Err: rerr, Token: session.RequestorToken, Status: irma.ServerStatusCancelled, Type: session.Action}
+	session.Result = &server.SessionResult{Err: rerr, Token: session.RequestorToken, Status: irma.ServerStatusCancelled, Type: session.Action, Requestor: session.Requestor}
 	session.setStatus(irma.ServerStatusCancelled)
 	return rerr
 }
@@ -142,6 +206,31 @@ func (session *session) chooseProtocolVersion(minClient, maxClient *irma.Protoco
 	if session.Rrequest.Base().NextSession != nil {
 		minServer = &irma.ProtocolVersion{Major: 2, Minor: 7}
 	}
+	// Set minimum to 2.9 if the message to be signed is hashed
+	if sigrequest, ok := session.request.(*irma.SignatureRequest); ok && sigrequest.MessageHash != nil {
+		minServer = &irma.ProtocolVersion{Major: 2, Minor: 9}
+	}
+	// Set minimum to 2.11 if the requestor asks for test credentials to be issued
+	if isrequest, ok := session.request.(*irma.IssuanceRequest); ok {
+		for _, cred := range isrequest.Credentials {
+			if cred.TestCredential {
+				minServer = &irma.ProtocolVersion{Major: 2, Minor: 11}
+			}
+		}
+	}
+
+	// Set minimum to 2.12 if the requestor asks for all instances of attributes
+	if len(session.request.Disclosure().AllInstances) > 0 {
+		minServer = &irma.ProtocolVersion{Major: 2, Minor: 12}
+	}
+	// Set minimum to 2.13 if issued attributes copy the value of a disclosed attribute
+	if isrequest, ok := session.request.(*irma.IssuanceRequest); ok {
+		for _, cred := range isrequest.Credentials {
+			if len(cred.DisclosedAttributes) > 0 {
+				minServer = &irma.ProtocolVersion{Major: 2, Minor: 13}
+			}
+		}
+	}
 
 	if minClient.AboveVersion(maxProtocolVersion) || maxClient.BelowVersion(minServer) || maxClient.BelowVersion(minClient) {
 		err := errors.Errorf("Protocol version negotiation failed, min=%s max=%s minServer=%s maxServer=%s", minClient.String(), maxClient.String(), minServer.String(), maxProtocolVersion.String())
@@ -155,6 +244,25 @@ func (session *session) chooseProtocolVersion(minClient, maxClient *irma.Protoco
 	}
 }
 
+// timeNow returns the current time; it can be replaced in tests.
+var timeNow = time.Now
+
+// checkProofAge records in the session result how long it took the client to send its proofs after
+// receiving the session request, failing the session if this exceeds the configured maximum.
+func (session *session) checkProofAge() *irma.RemoteError {
+	if session.RequestSent.IsZero() {
+		return nil
+	}
+	age := timeNow().Sub(session.RequestSent)
+	if max := session.conf.MaxProofAge; max != 0 && age > time.Duration(max)*time.Second {
+		rerr := session.fail(server.ErrorProofTooOld, fmt.Sprintf("proofs received after %s", age))
+		session.Result.ProofAge = age.Milliseconds()
+		return rerr
+	}
+	session.Result.ProofAge = age.Milliseconds()
+	return nil
+}
+
 const retryTimeLimit = 10 * time.Second
 
 // checkCache returns a previously cached response, for replaying against multiple requests from
@@ -192,13 +300,14 @@ func (session *session) computeWitness(sk *gabikeys.PrivateKey, cred *irma.Crede
 
 	// Fetch latest revocation record, and then extract the current value of the accumulator
 	// from it to generate the witness from
-	updates, err := rs.UpdateLatest(id, 0, &cred.KeyCounter)
+	counter := cred.PublicKeyCounter()
+	updates, err := rs.UpdateLatest(id, 0, &counter)
 	if err != nil {
 		return nil, err
 	}
-	u := updates[cred.KeyCounter]
+	u := updates[counter]
 	if u == nil {
-		return nil, errors.Errorf("no revocation updates found for key %d", cred.KeyCounter)
+		return nil, errors.Errorf("no revocation updates found for key %d", counter)
 	}
 	sig := u.SignedAccumulator
 	pk, err := rs.Keys.PublicKey(id.IssuerIdentifier(), sig.PKCounter)
@@ -257,10 +366,22 @@ func (session *session) computeAttributes(
 }
 
 func (s *Server) validateIssuanceRequest(request *irma.IssuanceRequest) error {
+	if err := request.CheckDuplicates(s.conf.IrmaConfiguration); err != nil {
+		return err
+	}
 	for _, cred := range request.Credentials {
-		// Check that we have the appropriate private key
+		// Check that we have the appropriate private key: the requested one, or else the latest one
 		iss := cred.CredentialTypeID.IssuerIdentifier()
-		privatekey, err := s.conf.IrmaConfiguration.PrivateKeys.Latest(iss)
+		var privatekey *gabikeys.PrivateKey
+		var err error
+		if cred.KeyCounter != nil {
+			privatekey, err = s.conf.IrmaConfiguration.PrivateKeys.Get(iss, *cred.KeyCounter)
+			if err == irma.ErrMissingPrivateKey {
+				return errors.Errorf("missing private key %s-%d", iss.String(), *cred.KeyCounter)
+			}
+		} else {
+			privatekey, err = s.conf.IrmaConfiguration.PrivateKeys.Latest(iss)
+		}
 		if err != nil {
 			return err
 		}
@@ -278,7 +399,8 @@ func (s *Server) validateIssuanceRequest(request *irma.IssuanceRequest) error {
 		if now.Unix() > pubkey.ExpiryDate {
 			return errors.Errorf("cannot issue using expired public key %s-%d", iss.String(), privatekey.Counter)
 		}
-		cred.KeyCounter = privatekey.Counter
+		counter := privatekey.Counter
+		cred.KeyCounter = &counter
 
 		if s.conf.IrmaConfiguration.CredentialTypes[cred.CredentialTypeID].RevocationSupported() {
 			settings := s.conf.RevocationSettings[cred.CredentialTypeID]
@@ -294,6 +416,9 @@ func (s *Server) validateIssuanceRequest(request *irma.IssuanceRequest) error {
 		if err := cred.Validate(s.conf.IrmaConfiguration); err != nil {
 			return err
 		}
+		if err := cred.ValidateAttributeValues(); err != nil {
+			return err
+		}
 
 		// Ensure the credential has an expiry date
 		defaultValidity := irma.Timestamp(time.Now().AddDate(0, 6, 0))
@@ -319,28 +444,67 @@ func (session *session) getProofP(commitments *irma.IssueCommitmentMessage, sche
 			return nil, errors.Errorf("no keyshare proof included for scheme %s", scheme.Name())
 		}
 		session.conf.Logger.Debug("Parsing keyshare ProofP JWT: ", str)
-		claims := &struct {
-			jwt.StandardClaims
-			ProofP *gabi.ProofP
-		}{}
-		token, err := jwt.ParseWithClaims(str, claims, session.conf.IrmaConfiguration.KeyshareServerKeyFunc(scheme))
+		proofP, claims, err := session.conf.IrmaConfiguration.ParseKeyshareProofP(scheme, str)
 		if err != nil {
 			return nil, err
 		}
-		if !token.Valid {
-			return nil, errors.Errorf("invalid keyshare proof included for scheme %s", scheme.Name())
+		if err = session.verifyKeyshareClaims(*claims, scheme); err != nil {
+			return nil, err
 		}
-		session.KssProofs[scheme] = claims.ProofP
+		session.KssProofs[scheme] = proofP
 	}
 
 	return session.KssProofs[scheme], nil
 }
 
+// verifyKeyshareClaims checks that the "iss" and "aud" fields of a keyshare proof JWT have the
+// values configured for the scheme, if any.
+func (session *session) verifyKeyshareClaims(claims jwt.StandardClaims, scheme irma.SchemeManagerIdentifier) error {
+	for _, field := range []struct {
+		name, value string
+		expected    map[string]string
+	}{
+		{"iss", claims.Issuer, session.conf.KeyshareJwtIssuers},
+		{"aud", claims.Audience, session.conf.KeyshareJwtAudiences},
+	} {
+		expected, ok := field.expected[scheme.Name()]
+		if !ok {
+			continue
+		}
+		if field.value == "" && session.conf.KeyshareJwtAcceptMissingClaims {
+			session.conf.Logger.Warnf("Accepting keyshare proof of scheme %s without %s field", scheme, field.name)
+			continue
+		}
+		if field.value != expected {
+			return errors.Errorf("keyshare proof included for scheme %s has invalid %s field", scheme.Name(), field.name)
+		}
+	}
+	return nil
+}
+
+// markTestCredentials marks the credentials to be issued as test credentials if this server is not
+// in production mode, or if they belong to a demo scheme. Clients that do not support test
+// credentials would compute a different metadata attribute than we do, so for them the credentials
+// are left unmarked.
+func (session *session) markTestCredentials() {
+	isrequest, ok := session.request.(*irma.IssuanceRequest)
+	if !ok || session.Version.Below(2, 11) {
+		return
+	}
+	for _, cred := range isrequest.Credentials {
+		scheme := session.conf.IrmaConfiguration.SchemeManagers[cred.CredentialTypeID.SchemeManagerIdentifier()]
+		if !session.conf.Production || (scheme != nil && scheme.Demo) {
+			cred.TestCredential = true
+		}
+	}
+}
+
 func (session *session) getClientRequest() (*irma.ClientSessionRequest, error) {
 	info := irma.ClientSessionRequest{
 		LDContext:       irma.LDContextClientSessionRequest,
 		ProtocolVersion: session.Version,
 		Options:         &session.Options,
+		ExpiresAt:       session.expiresAt(),
 	}
 
 	if session.Options.PairingMethod == irma.PairingMethodNone {
@@ -353,6 +517,10 @@ func (session *session) getClientRequest() (*irma.ClientSessionRequest, error) {
 	return &info, nil
 }
 
+func (session *session) frontendStatus() irma.FrontendSessionStatus {
+	return irma.FrontendSessionStatus{Status: session.Status, NextSession: session.Next, ExpiresAt: session.expiresAt()}
+}
+
 func (session *session) getRequest() (irma.SessionRequest, error) {
 	// In case of issuance requests, strip revocation keys from []CredentialRequest
 	isreq, issuing := session.request.(*irma.IssuanceRequest)
@@ -370,6 +538,36 @@ func (session *session) getRequest() (irma.SessionRequest, error) {
 	return cpy.(*irma.IssuanceRequest), nil
 }
 
+// getFrontendRequest returns a copy of the session request for the frontend, which it may use to
+// show the user what the session will ask for. Requestor-internal fields, and fields that the server
+// sets or changes during the session, are removed, so that it does not change during the session.
+func (session *session) getFrontendRequest() (irma.SessionRequest, error) {
+	cpy, err := copyObject(session.request)
+	if err != nil {
+		return nil, err
+	}
+	request := cpy.(irma.SessionRequest)
+
+	base := request.Base()
+	base.Context, base.Nonce, base.ProtocolVersion = nil, nil, nil
+	base.ClientReturnURL, base.AugmentReturnURL = "", false
+	for _, nonrev := range base.Revocation {
+		if nonrev != nil {
+			nonrev.Updates = nil
+		}
+	}
+
+	if isreq, ok := request.(*irma.IssuanceRequest); ok {
+		isreq.CredentialInfoList, isreq.RemovalCredentialInfoList = nil, nil
+		for _, cred := range isreq.Credentials {
+			cred.KeyCounter = nil
+			cred.RevocationKey, cred.RevocationSupported = "", false
+			cred.TestCredential = false // set by the server when the client connects
+		}
+	}
+	return request, nil
+}
+
 func (session *session) updateAndUnlock() error {
 	err := session.sessions.update(session)
 	if err != nil {
@@ -432,6 +630,9 @@ func (s *Server) validateRequest(request irma.SessionRequest) error {
 	if err := base.Validate(s.conf.IrmaConfiguration); err != nil {
 		return err
 	}
+	if sr, ok := request.(*irma.SignatureRequest); ok && sr.Mode == irma.SignatureModeStandalone {
+		return errors.New("standalone signature requests cannot be used in sessions")
+	}
 	if base.AugmentReturnURL {
 		if !s.conf.AugmentClientReturnURL {
 			return errors.New("augmenting client return url not enabled in server configuration")
@@ -440,7 +641,84 @@ func (s *Server) validateRequest(request irma.SessionRequest) error {
 			return errors.New("cannot augment empty client return url")
 		}
 	}
-	return request.Disclosure().Disclose.Validate(s.conf.IrmaConfiguration)
+	disclosure := request.Disclosure()
+	if err := disclosure.ValidateInstances(); err != nil {
+		return err
+	}
+	if len(disclosure.AllInstances) > 0 && disclosure.Instances(disclosure.AllInstances[0]) > s.conf.MaxInstances {
+		return errors.Errorf("requests may ask for at most %d credential instances", s.conf.MaxInstances)
+	}
+	return disclosure.Disclose.Validate(s.conf.IrmaConfiguration)
+}
+
+// validateStaticSessions checks the static session requests against the current schemes, disabling
+// the invalid ones and enabling the others. It returns the reasons of the invalid ones.
+func (s *Server) validateStaticSessions() map[string]error {
+	invalid := map[string]error{}
+	for name, rrequest := range s.conf.StaticSessionRequests {
+		// Don't use validateRequest() here as we are called from within scheme parsing, which Download() may trigger
+		request := rrequest.SessionRequest()
+		err := request.Base().Validate(s.conf.IrmaConfiguration)
+		if err == nil {
+			err = request.Disclosure().Disclose.Validate(s.conf.IrmaConfiguration)
+		}
+		if err != nil {
+			s.conf.Logger.WithField("name", name).Warn("Static session request invalid, disabling it: ", err.Error())
+			invalid[name] = err
+		} else if s.staticErrors.get(name) != nil {
+			s.conf.Logger.WithField("name", name).Info("Static session request valid again, enabling it")
+		}
+	}
+	s.staticErrors.set(invalid)
+	return invalid
+}
+
+// StaticSession describes a static session from the server configuration, as returned by StaticSessions().
+type StaticSession struct {
+	Name    string                `json:"name"`
+	Request irma.RequestorRequest `json:"request"`
+	Enabled bool                  `json:"enabled"`
+	Error   string                `json:"error,omitempty"`
+}
+
+// staticSessionErrors keeps track of the static sessions that are disabled because their request is invalid.
+type staticSessionErrors struct {
+	sync.RWMutex
+	errs map[string]error
+}
+
+func (e *staticSessionErrors) get(name string) error {
+	e.RLock()
+	defer e.RUnlock()
+	return e.errs[name]
+}
+
+func (e *staticSessionErrors) set(errs map[string]error) {
+	e.Lock()
+	defer e.Unlock()
+	e.errs = errs
+}
+
+// staticSessionLimiter counts the static sessions started per IP address in the current minute.
+type staticSessionLimiter struct {
+	sync.Mutex
+	counts map[string]int
+}
+
+func (l *staticSessionLimiter) allow(ip string, max int) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.counts[ip] >= max {
+		return false
+	}
+	l.counts[ip]++
+	return true
+}
+
+func (l *staticSessionLimiter) reset() {
+	l.Lock()
+	defer l.Unlock()
+	l.counts = map[string]int{}
 }
 
 func copyObject(i interface{}) (interface{}, error) {
@@ -617,6 +895,10 @@ func (s *Server) pairingMiddleware(next http.Handler) http.Handler {
 
 		// Endpoints behind the pairingMiddleware can only be accessed when the client is already connected
 		// and the request includes the right authorization header to prove we still talk to the same client as before.
+		if session.Status == irma.ServerStatusTimeout {
+			server.WriteError(w, server.ErrorSessionUnknown, "Session expired")
+			return
+		}
 		if session.Status != irma.ServerStatusConnected {
 			server.WriteError(w, server.ErrorUnexpectedRequest, "Session not yet started or already finished")
 			return
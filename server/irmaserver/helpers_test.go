@@ -3,8 +3,12 @@ package irmaserver
 import (
 	"encoding/json"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v4"
+	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 )
 
@@ -21,3 +25,114 @@ func TestAnonimizeRequest(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, `{"validity":120,"request":{"@context":"https://irma.app/ld/request/issuance/v2","context":"AQ==","nonce":"wrmq+QY8r86nbGTI+mMAzg==","devMode":true,"disclose":[[["test.test.email.email"]]],"credentials":[{"validity":2000000000,"keyCounter":2,"credential":"irma-demo.RU.studentCard","attributes":null}]}}`, string(out))
 }
+
+func TestStaticSessionLimiter(t *testing.T) {
+	l := &staticSessionLimiter{counts: map[string]int{}}
+	require.True(t, l.allow("127.0.0.1", 2))
+	require.True(t, l.allow("127.0.0.1", 2))
+	require.False(t, l.allow("127.0.0.1", 2))
+	require.True(t, l.allow("::1", 2))
+
+	l.reset()
+	require.True(t, l.allow("127.0.0.1", 2))
+}
+
+func TestCheckProofAge(t *testing.T) {
+	start := time.Now()
+	defer func() { timeNow = time.Now }()
+
+	newSession := func() *session {
+		conf := &server.Configuration{MaxProofAge: 60, Logger: logrus.New()}
+		return &session{
+			conf:     conf,
+			sessions: newMemorySessionStore(conf),
+			sessionData: sessionData{
+				Rrequest:    &irma.ServiceProviderRequest{Request: irma.NewDisclosureRequest()},
+				Result:      &server.SessionResult{},
+				Status:      irma.ServerStatusConnected,
+				RequestSent: start,
+			},
+		}
+	}
+
+	s := newSession()
+	timeNow = func() time.Time { return start.Add(59 * time.Second) }
+	require.Nil(t, s.checkProofAge())
+	require.Equal(t, int64(59000), s.Result.ProofAge)
+	require.Equal(t, irma.ServerStatusConnected, s.Status)
+
+	s = newSession()
+	timeNow = func() time.Time { return start.Add(61 * time.Second) }
+	rerr := s.checkProofAge()
+	require.NotNil(t, rerr)
+	require.Equal(t, string(server.ErrorProofTooOld.Type), rerr.ErrorName)
+	require.Equal(t, int64(61000), s.Result.ProofAge)
+	require.Equal(t, irma.ServerStatusCancelled, s.Status)
+
+	// No maximum configured
+	s = newSession()
+	s.conf.MaxProofAge = 0
+	require.Nil(t, s.checkProofAge())
+}
+
+func TestChooseProtocolVersion(t *testing.T) {
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	s := &session{
+		request: request,
+		sessionData: sessionData{
+			Rrequest:         &irma.ServiceProviderRequest{Request: request},
+			LegacyCompatible: true,
+		},
+	}
+	min, max := irma.NewVersion(2, 4), irma.NewVersion(2, 11)
+	version, err := s.chooseProtocolVersion(min, max)
+	require.NoError(t, err)
+	require.Equal(t, max, version)
+
+	// Requests for all instances require protocol version 2.12
+	request.AllInstances = []int{0}
+	_, err = s.chooseProtocolVersion(min, max)
+	require.Error(t, err)
+	version, err = s.chooseProtocolVersion(min, irma.NewVersion(2, 12))
+	require.NoError(t, err)
+	require.Equal(t, irma.NewVersion(2, 12), version)
+
+	// Issuance requests copying disclosed attributes require protocol version 2.13
+	bsn := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")
+	isrequest := irma.NewIssuanceRequest([]*irma.CredentialRequest{{
+		CredentialTypeID:    irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.singleton"),
+		DisclosedAttributes: map[string]irma.AttributeTypeIdentifier{"BSN": bsn},
+	}}, bsn)
+	s.request = isrequest
+	s.Rrequest = &irma.IdentityProviderRequest{Request: isrequest}
+	_, err = s.chooseProtocolVersion(min, irma.NewVersion(2, 12))
+	require.Error(t, err)
+	version, err = s.chooseProtocolVersion(min, irma.NewVersion(2, 13))
+	require.NoError(t, err)
+	require.Equal(t, irma.NewVersion(2, 13), version)
+}
+
+func TestVerifyKeyshareClaims(t *testing.T) {
+	scheme := irma.NewSchemeManagerIdentifier("test")
+	s := &session{conf: &server.Configuration{
+		Logger:               logrus.New(),
+		KeyshareJwtIssuers:   map[string]string{"test": "production"},
+		KeyshareJwtAudiences: map[string]string{"test": "irma"},
+	}}
+
+	require.NoError(t, s.verifyKeyshareClaims(jwt.StandardClaims{Issuer: "production", Audience: "irma"}, scheme))
+
+	// Proofs of a keyshare server of another environment are rejected
+	require.Error(t, s.verifyKeyshareClaims(jwt.StandardClaims{Issuer: "staging", Audience: "irma"}, scheme))
+	require.Error(t, s.verifyKeyshareClaims(jwt.StandardClaims{Issuer: "production", Audience: "other"}, scheme))
+
+	// Missing claims are only accepted when configured
+	require.Error(t, s.verifyKeyshareClaims(jwt.StandardClaims{Issuer: "production"}, scheme))
+	s.conf.KeyshareJwtAcceptMissingClaims = true
+	require.NoError(t, s.verifyKeyshareClaims(jwt.StandardClaims{Issuer: "production"}, scheme))
+	require.NoError(t, s.verifyKeyshareClaims(jwt.StandardClaims{}, scheme))
+	require.Error(t, s.verifyKeyshareClaims(jwt.StandardClaims{Issuer: "staging"}, scheme))
+
+	// Claims of schemes without configured values are not checked
+	require.NoError(t, s.verifyKeyshareClaims(jwt.StandardClaims{Issuer: "staging"}, irma.NewSchemeManagerIdentifier("other")))
+}
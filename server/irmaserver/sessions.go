@@ -4,6 +4,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -48,6 +52,7 @@ type sessionData struct {
 	Status             irma.ServerStatus
 	ResponseCache      responseCache
 	LastActive         time.Time
+	RequestSent        time.Time
 	Result             *server.SessionResult
 	KssProofs          map[irma.SchemeManagerIdentifier]*gabi.ProofP
 	Next               *irma.Qr
@@ -55,6 +60,9 @@ type sessionData struct {
 	ImplicitDisclosure irma.AttributeConDisCon
 	Options            irma.SessionOptions
 	ClientAuth         irma.ClientAuthorization
+	Requestor          string `json:",omitempty"`
+	ResultFetched      bool   `json:",omitempty"` // whether the requestor fetched the result of the finished session
+	ResultDeleted      bool   `json:",omitempty"` // whether the result was deleted after being read, see server.Configuration.DeleteResultOnRead
 }
 
 type responseCache struct {
@@ -71,6 +79,8 @@ type sessionStore interface {
 	add(session *session) error
 	update(session *session) error
 	unlock(session *session)
+	deactivate(session *session)
+	activeSessions(requestor string) (int, error)
 	stop()
 }
 
@@ -80,6 +90,17 @@ type memorySessionStore struct {
 
 	requestor map[irma.RequestorToken]*session
 	client    map[irma.ClientToken]*session
+
+	// Requestors of the sessions that are not yet finished, and the amount of such sessions per requestor
+	active           map[irma.RequestorToken]string
+	activeRequestors map[string]int
+}
+
+// sessionSnapshot is the content of the snapshot file in which the memory session store saves its
+// sessions. Version must be incremented on incompatible changes to sessionData.
+type sessionSnapshot struct {
+	Version  int
+	Sessions []json.RawMessage
 }
 
 type redisSessionStore struct {
@@ -96,6 +117,41 @@ func (err *RedisError) Error() string {
 	return fmt.Sprintf("redis error: %s", err.err)
 }
 
+// TooManySessionsError is returned when starting a session while the maximum amount of active
+// sessions, either in total or of the requestor, has been reached.
+type TooManySessionsError struct {
+	Requestor string
+	Count     int
+	Max       int
+}
+
+func (err *TooManySessionsError) Error() string {
+	if err.Requestor != "" {
+		return fmt.Sprintf("requestor %s has too many active sessions (%d, maximum %d)", err.Requestor, err.Count, err.Max)
+	}
+	return fmt.Sprintf("too many active sessions (%d, maximum %d)", err.Count, err.Max)
+}
+
+// SessionTypeDisabledError is returned when starting a session of a type that is disabled in the
+// configuration.
+type SessionTypeDisabledError struct {
+	Action irma.Action
+}
+
+func (err *SessionTypeDisabledError) Error() string {
+	return fmt.Sprintf("session type %s disabled on this server", err.Action)
+}
+
+// ResultConsumedError is returned when fetching a session result that was deleted after it was
+// read before (see server.Configuration.DeleteResultOnRead).
+type ResultConsumedError struct {
+	requestorToken irma.RequestorToken
+}
+
+func (err *ResultConsumedError) Error() string {
+	return fmt.Sprintf("result of session %s was already read and has been deleted", err.requestorToken)
+}
+
 type UnknownSessionError struct {
 	requestorToken irma.RequestorToken
 	clientToken    irma.ClientToken
@@ -116,18 +172,69 @@ const (
 	requestorTokenLookupPrefix = "token:"
 	clientTokenLookupPrefix    = "session:"
 	lockPrefix                 = "lock:"
+	activeSessionsKey          = "active-sessions"
+	activeSessionsPrefix       = "active-sessions:"
+	sessionSnapshotFile        = "sessions.json"
+	sessionSnapshotVersion     = 1
 )
 
 var (
 	minProtocolVersion = irma.NewVersion(2, 4)
-	maxProtocolVersion = irma.NewVersion(2, 8)
+	maxProtocolVersion = irma.NewVersion(2, 13)
 
 	minFrontendProtocolVersion = irma.NewVersion(1, 0)
 	maxFrontendProtocolVersion = irma.NewVersion(1, 1)
 
 	lockingRetryOptions = &redislock.Options{RetryStrategy: redislock.ExponentialBackoff(minLockRetryTime, maxLockRetryTime)}
+
+	// activateSessionScript registers a new session as active in the sorted sets of active sessions,
+	// in which each session is scored by its expiry time, if the maximum amounts of active sessions
+	// have not been reached. Expired sessions are removed first. Returns 0 and the new total count
+	// if the session was registered, or 1 or 2 and the global or requestor count, respectively,
+	// if a maximum was reached.
+	// KEYS: global set, requestor set (optional)
+	// ARGV: current time, session token, session expiry time, global maximum, requestor maximum
+	activateSessionScript = redis.NewScript(`
+		redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+		local count = redis.call('ZCARD', KEYS[1])
+		if tonumber(ARGV[4]) > 0 and count >= tonumber(ARGV[4]) then
+			return {1, count}
+		end
+		if #KEYS > 1 then
+			redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])
+			local requestorCount = redis.call('ZCARD', KEYS[2])
+			if tonumber(ARGV[5]) > 0 and requestorCount >= tonumber(ARGV[5]) then
+				return {2, requestorCount}
+			end
+			redis.call('ZADD', KEYS[2], ARGV[3], ARGV[2])
+		end
+		redis.call('ZADD', KEYS[1], ARGV[3], ARGV[2])
+		return {0, count + 1}
+	`)
 )
 
+// checkSessionLimits returns an error if the specified amounts of active sessions, in total and
+// of the specified requestor, have reached their maximum.
+func checkSessionLimits(conf *server.Configuration, requestor string, count, requestorCount int) error {
+	if conf.MaxActiveSessions > 0 && count >= conf.MaxActiveSessions {
+		return &TooManySessionsError{Count: count, Max: conf.MaxActiveSessions}
+	}
+	if requestor != "" && conf.MaxActiveRequestorSessions > 0 && requestorCount >= conf.MaxActiveRequestorSessions {
+		return &TooManySessionsError{Requestor: requestor, Count: requestorCount, Max: conf.MaxActiveRequestorSessions}
+	}
+	return nil
+}
+
+func newMemorySessionStore(conf *server.Configuration) *memorySessionStore {
+	return &memorySessionStore{
+		requestor:        make(map[irma.RequestorToken]*session),
+		client:           make(map[irma.ClientToken]*session),
+		active:           make(map[irma.RequestorToken]string),
+		activeRequestors: make(map[string]int),
+		conf:             conf,
+	}
+}
+
 func (s *memorySessionStore) get(t irma.RequestorToken) (*session, error) {
 	s.RLock()
 	ses := s.requestor[t]
@@ -136,6 +243,7 @@ func (s *memorySessionStore) get(t irma.RequestorToken) (*session, error) {
 	if ses != nil {
 		ses.Lock()
 		ses.locked = true
+		ses.checkExpiry()
 
 		return ses, nil
 	} else {
@@ -151,6 +259,7 @@ func (s *memorySessionStore) clientGet(t irma.ClientToken) (*session, error) {
 	if ses != nil {
 		ses.Lock()
 		ses.locked = true
+		ses.checkExpiry()
 
 		return ses, nil
 	} else {
@@ -161,11 +270,45 @@ func (s *memorySessionStore) clientGet(t irma.ClientToken) (*session, error) {
 func (s *memorySessionStore) add(session *session) error {
 	s.Lock()
 	defer s.Unlock()
+	if err := checkSessionLimits(s.conf, session.Requestor, len(s.active), s.activeRequestors[session.Requestor]); err != nil {
+		return err
+	}
 	s.requestor[session.RequestorToken] = session
 	s.client[session.ClientToken] = session
+	s.active[session.RequestorToken] = session.Requestor
+	if session.Requestor != "" {
+		s.activeRequestors[session.Requestor]++
+	}
 	return nil
 }
 
+func (s *memorySessionStore) deactivate(session *session) {
+	s.Lock()
+	defer s.Unlock()
+	requestor, active := s.active[session.RequestorToken]
+	if !active {
+		return
+	}
+	delete(s.active, session.RequestorToken)
+	if requestor == "" {
+		return
+	}
+	if s.activeRequestors[requestor] <= 1 {
+		delete(s.activeRequestors, requestor)
+	} else {
+		s.activeRequestors[requestor]--
+	}
+}
+
+func (s *memorySessionStore) activeSessions(requestor string) (int, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if requestor == "" {
+		return len(s.active), nil
+	}
+	return s.activeRequestors[requestor], nil
+}
+
 func (s *memorySessionStore) update(_ *session) error {
 	return nil
 }
@@ -178,6 +321,12 @@ func (s *memorySessionStore) unlock(session *session) {
 }
 
 func (s *memorySessionStore) stop() {
+	if s.conf.CachePath != "" {
+		if err := s.saveSnapshot(); err != nil {
+			_ = server.LogError(errors.WrapPrefix(err, "failed to save session snapshot", 0))
+		}
+	}
+
 	s.Lock()
 	defer s.Unlock()
 	for _, session := range s.requestor {
@@ -203,12 +352,7 @@ func (s *memorySessionStore) deleteExpired() {
 	for token, session := range toCheck {
 		session.Lock()
 
-		timeout := time.Duration(s.conf.MaxSessionLifetime) * time.Minute
-		if session.Status == irma.ServerStatusInitialized && session.Rrequest.Base().ClientTimeout != 0 {
-			timeout = time.Duration(session.Rrequest.Base().ClientTimeout) * time.Second
-		}
-
-		if session.LastActive.Add(timeout).Before(time.Now()) {
+		if session.expiry().Before(time.Now()) {
 			if !session.Status.Finished() {
 				s.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken}).Info("Session expired")
 				session.markAlive()
@@ -236,6 +380,101 @@ func (s *memorySessionStore) deleteExpired() {
 	s.Unlock()
 }
 
+// saveSnapshot saves the sessions that are not yet finished to the snapshot file in the cache
+// path, from which loadSnapshot restores them when the server restarts.
+func (s *memorySessionStore) saveSnapshot() error {
+	s.RLock()
+	sessions := make([]*session, 0, len(s.active))
+	for token := range s.active {
+		sessions = append(sessions, s.requestor[token])
+	}
+	s.RUnlock()
+
+	snapshot := sessionSnapshot{Version: sessionSnapshotVersion, Sessions: make([]json.RawMessage, 0, len(sessions))}
+	for _, session := range sessions {
+		session.Lock()
+		if session.Status.Finished() {
+			session.Unlock()
+			continue
+		}
+		bts, err := json.Marshal(session.sessionData)
+		session.Unlock()
+		if err != nil {
+			return err
+		}
+		snapshot.Sessions = append(snapshot.Sessions, bts)
+	}
+
+	bts, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return common.SaveFile(filepath.Join(s.conf.CachePath, sessionSnapshotFile), bts)
+}
+
+// loadSnapshot restores the sessions from the snapshot file in the cache path, if present.
+// Sessions that have expired in the meantime, or whose request refers to credential types that no
+// longer exist, are discarded. Restored sessions have no session handler. As losing the sessions is
+// preferable to not starting, a snapshot that cannot be read is ignored.
+func (s *memorySessionStore) loadSnapshot(e *sse.Server) {
+	path := filepath.Join(s.conf.CachePath, sessionSnapshotFile)
+	bts, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	var snapshot sessionSnapshot
+	if err == nil {
+		err = json.Unmarshal(bts, &snapshot)
+	}
+	if err == nil && snapshot.Version != sessionSnapshotVersion {
+		err = errors.Errorf("unsupported version %d", snapshot.Version)
+	}
+	if err != nil {
+		_ = server.LogWarning(errors.WrapPrefix(err, "ignoring session snapshot "+path, 0))
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	for _, bts := range snapshot.Sessions {
+		ses := &session{sessions: s, sse: e, conf: s.conf}
+		if err = json.Unmarshal(bts, &ses.sessionData); err != nil {
+			_ = server.LogWarning(errors.WrapPrefix(err, "ignoring session in snapshot", 0))
+			continue
+		}
+		ses.request = ses.Rrequest.SessionRequest()
+		if ses.Status.Finished() || ses.expiry().Before(now) {
+			s.conf.Logger.WithFields(logrus.Fields{"session": ses.RequestorToken}).Debug("Not restoring expired session")
+			continue
+		}
+		if id, missing := s.missingCredentialType(ses.request); missing {
+			s.conf.Logger.WithFields(logrus.Fields{"session": ses.RequestorToken, "credential": id}).
+				Info("Not restoring session referring to unknown credential type")
+			continue
+		}
+
+		s.requestor[ses.RequestorToken] = ses
+		s.client[ses.ClientToken] = ses
+		s.active[ses.RequestorToken] = ses.Requestor
+		if ses.Requestor != "" {
+			s.activeRequestors[ses.Requestor]++
+		}
+	}
+	s.conf.Logger.Infof("Restored %d sessions from snapshot", len(s.requestor))
+}
+
+// missingCredentialType returns a credential type to which the request refers that does not exist
+// in the configuration, if any.
+func (s *memorySessionStore) missingCredentialType(request irma.SessionRequest) (irma.CredentialTypeIdentifier, bool) {
+	for id := range request.Identifiers().CredentialTypes {
+		if _, ok := s.conf.IrmaConfiguration.CredentialTypes[id]; !ok {
+			return id, true
+		}
+	}
+	return irma.CredentialTypeIdentifier{}, false
+}
+
 func (s *redisSessionStore) get(t irma.RequestorToken) (*session, error) {
 	val, err := s.client.Get(context.Background(), requestorTokenLookupPrefix+string(t)).Result()
 	if err == redis.Nil {
@@ -290,18 +529,39 @@ func (s *redisSessionStore) clientGet(t irma.ClientToken) (*session, error) {
 	hash := session.sessionData.hash()
 	session.hashBefore = &hash
 
-	// timeout check
-	lifetime := time.Duration(s.conf.MaxSessionLifetime) * time.Minute
-	if session.LastActive.Add(lifetime).Before(time.Now()) && !session.Status.Finished() {
-		s.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken}).Info("Session expired")
-		session.markAlive()
-		session.setStatus(irma.ServerStatusTimeout)
-	}
-
+	session.checkExpiry()
 	return session, nil
 }
 
 func (s *redisSessionStore) add(session *session) error {
+	now := time.Now()
+	res, err := activateSessionScript.Run(context.Background(), s.client, s.activeSessionsKeys(session),
+		now.UnixNano(),
+		string(session.RequestorToken),
+		now.Add(s.timeout(session)).UnixNano(),
+		s.conf.MaxActiveSessions,
+		s.conf.MaxActiveRequestorSessions,
+	).Result()
+	if err != nil {
+		return logAsRedisError(err)
+	}
+	counts, ok := res.([]interface{})
+	if !ok || len(counts) != 2 {
+		return logAsRedisError(errors.Errorf("unexpected result from session activation script: %v", res))
+	}
+	count, _ := counts[1].(int64)
+	switch counts[0] {
+	case int64(1):
+		return &TooManySessionsError{Count: int(count), Max: s.conf.MaxActiveSessions}
+	case int64(2):
+		return &TooManySessionsError{Requestor: session.Requestor, Count: int(count), Max: s.conf.MaxActiveRequestorSessions}
+	}
+
+	return s.store(session)
+}
+
+// timeout returns after how long the session will be removed from the Redis datastore.
+func (s *redisSessionStore) timeout(session *session) time.Duration {
 	lifetime := time.Duration(s.conf.MaxSessionLifetime) * time.Minute
 	// After the timeout, the session will automatically be removed. Therefore the timeout needs to
 	// be significantly longer than the session lifetime. Factor 2 was chosen since it matches the logic
@@ -312,8 +572,15 @@ func (s *redisSessionStore) add(session *session) error {
 		timeout = time.Duration(session.Rrequest.Base().ClientTimeout) * time.Second
 	} else if session.Status.Finished() {
 		timeout = lifetime
+		if s.conf.ResultRetention != 0 {
+			timeout = time.Duration(s.conf.ResultRetention) * time.Minute
+		}
 	}
+	return timeout
+}
 
+func (s *redisSessionStore) store(session *session) error {
+	timeout := s.timeout(session)
 	sessionJSON, err := json.Marshal(session.sessionData)
 	if err != nil {
 		return server.LogError(err)
@@ -347,7 +614,47 @@ func (s *redisSessionStore) update(session *session) error {
 	} else if ttl == 0 {
 		return logAsRedisError(errors.Errorf("no session lock available for session with requestorToken %s", session.RequestorToken))
 	}
-	return s.add(session)
+
+	// Keep the expiry time of the session in the sets of active sessions in sync with its timeout.
+	// XX ensures that sessions that were deactivated in the meantime are not added again.
+	if !session.Status.Finished() {
+		expiry := float64(time.Now().Add(s.timeout(session)).UnixNano())
+		for _, key := range s.activeSessionsKeys(session) {
+			err := s.client.ZAddXX(context.Background(), key, &redis.Z{Score: expiry, Member: string(session.RequestorToken)}).Err()
+			if err != nil {
+				return logAsRedisError(err)
+			}
+		}
+	}
+	return s.store(session)
+}
+
+func (s *redisSessionStore) deactivate(session *session) {
+	for _, key := range s.activeSessionsKeys(session) {
+		if err := s.client.ZRem(context.Background(), key, string(session.RequestorToken)).Err(); err != nil {
+			_ = logAsRedisError(err)
+		}
+	}
+}
+
+func (s *redisSessionStore) activeSessions(requestor string) (int, error) {
+	key := activeSessionsKey
+	if requestor != "" {
+		key = activeSessionsPrefix + requestor
+	}
+	count, err := s.client.ZCount(context.Background(), key, strconv.FormatInt(time.Now().UnixNano(), 10), "+inf").Result()
+	if err != nil {
+		return 0, logAsRedisError(err)
+	}
+	return int(count), nil
+}
+
+func (s *redisSessionStore) activeSessionsKeys(session *session) []string {
+	keys := []string{activeSessionsKey}
+	if session.Requestor != "" {
+		keys = append(keys, activeSessionsPrefix+session.Requestor)
+	}
+	return keys
 }
 
 func (s *redisSessionStore) unlock(session *session) {
@@ -377,7 +684,9 @@ func (s *redisSessionStore) stop() {
 
 var one *big.Int = big.NewInt(1)
 
-func (s *Server) newSession(action irma.Action, request irma.RequestorRequest, disclosed irma.AttributeConDisCon, FrontendAuth irma.FrontendAuthorization) (*session, error) {
+func (s *Server) newSession(
+	action irma.Action, request irma.RequestorRequest, disclosed irma.AttributeConDisCon, FrontendAuth irma.FrontendAuthorization, requestor string,
+) (*session, error) {
 	clientToken := irma.ClientToken(common.NewSessionToken())
 	requestorToken := irma.RequestorToken(common.NewSessionToken())
 	if len(FrontendAuth) == 0 {
@@ -405,6 +714,8 @@ func (s *Server) newSession(action irma.Action, request irma.RequestorRequest, d
 			Token:         requestorToken,
 			Type:          action,
 			Status:        irma.ServerStatusInitialized,
+			Requestor:     requestor,
+			Template:      request.Base().Template,
 		},
 		Options: irma.SessionOptions{
 			LDContext:     irma.LDContextSessionOptions,
@@ -412,6 +723,7 @@ func (s *Server) newSession(action irma.Action, request irma.RequestorRequest, d
 		},
 		FrontendAuth:       FrontendAuth,
 		ImplicitDisclosure: disclosed,
+		Requestor:          requestor,
 	}
 	ses := &session{
 		sessionData: sd,
@@ -430,6 +742,7 @@ func (s *Server) newSession(action irma.Action, request irma.RequestorRequest, d
 	if err != nil {
 		return nil, err
 	}
+	s.conf.Hooks.SessionCreated(requestorToken, action)
 
 	return ses, nil
 }
@@ -1,11 +1,20 @@
 package irmaserver
 
 import (
+	"encoding/json"
 	"github.com/privacybydesign/irmago/internal/test"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/sirupsen/logrus"
@@ -76,7 +85,7 @@ func TestMemoryStoreNoDeadlock(t *testing.T) {
 
 	req, err := server.ParseSessionRequest(`{"request":{"@context":"https://irma.app/ld/request/disclosure/v2","context":"AQ==","nonce":"MtILupG0g0J23GNR1YtupQ==","devMode":true,"disclose":[[[{"type":"test.test.email.email","value":"example@example.com"}]]]}}`)
 	require.NoError(t, err)
-	session, err := s.newSession(irma.ActionDisclosing, req, nil, "")
+	session, err := s.newSession(irma.ActionDisclosing, req, nil, "", "")
 	require.NoError(t, err)
 
 	session.Lock()
@@ -99,7 +108,7 @@ func TestMemoryStoreNoDeadlock(t *testing.T) {
 
 	// Make a new session; this involves adding it to the memory session store.
 	go func() {
-		_, _ = s.newSession(irma.ActionDisclosing, req, nil, "")
+		_, _ = s.newSession(irma.ActionDisclosing, req, nil, "", "")
 		addingCompleted = true
 	}()
 
@@ -108,3 +117,641 @@ func TestMemoryStoreNoDeadlock(t *testing.T) {
 	require.True(t, addingCompleted)
 	require.False(t, deletingCompleted)
 }
+
+func redisSessionsConf(t *testing.T) *server.Configuration {
+	mr := miniredis.NewMiniRedis()
+	require.NoError(t, mr.Start())
+	t.Cleanup(mr.Close)
+
+	conf := sessionsConf(t)
+	conf.StoreType = "redis"
+	conf.RedisSettings = &server.RedisSettings{Addr: mr.Addr(), DisableTLS: true}
+	return conf
+}
+
+func limitedSessionRequest(clientTimeout int) *irma.ServiceProviderRequest {
+	return &irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{ClientTimeout: clientTimeout},
+		Request:              irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+	}
+}
+
+func TestSessionLimits(t *testing.T) {
+	t.Run("Memory", func(t *testing.T) { testSessionLimits(t, sessionsConf(t)) })
+	t.Run("Redis", func(t *testing.T) { testSessionLimits(t, redisSessionsConf(t)) })
+}
+
+func testSessionLimits(t *testing.T, conf *server.Configuration) {
+	conf.MaxActiveSessions = 3
+	conf.MaxActiveRequestorSessions = 2
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	_, token, _, err := s.StartRequestorSession(limitedSessionRequest(0), nil, "alice")
+	require.NoError(t, err)
+	_, _, _, err = s.StartRequestorSession(limitedSessionRequest(0), nil, "alice")
+	require.NoError(t, err)
+
+	// Alice reached her maximum, but others can still start sessions
+	_, _, _, err = s.StartRequestorSession(limitedSessionRequest(0), nil, "alice")
+	require.Equal(t, &TooManySessionsError{Requestor: "alice", Count: 2, Max: 2}, err)
+	_, _, _, err = s.StartRequestorSession(limitedSessionRequest(0), nil, "bob")
+	require.NoError(t, err)
+
+	// Now the global maximum is reached
+	_, _, _, err = s.StartSession(limitedSessionRequest(0), nil)
+	require.Equal(t, &TooManySessionsError{Count: 3, Max: 3}, err)
+	_, _, _, err = s.StartRequestorSession(limitedSessionRequest(0), nil, "bob")
+	require.Equal(t, &TooManySessionsError{Count: 3, Max: 3}, err)
+
+	count, err := s.ActiveSessions("")
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+	count, err = s.ActiveSessions("alice")
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	// Finished sessions no longer count
+	require.NoError(t, s.CancelSession(token))
+	count, err = s.ActiveSessions("alice")
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+	_, _, _, err = s.StartRequestorSession(limitedSessionRequest(0), nil, "alice")
+	require.NoError(t, err)
+}
+
+func TestSessionLimitExpiryRace(t *testing.T) {
+	t.Run("Memory", func(t *testing.T) {
+		testSessionLimitExpiryRace(t, sessionsConf(t), func(s *Server) {
+			s.sessions.(*memorySessionStore).deleteExpired()
+		})
+	})
+	t.Run("Redis", func(t *testing.T) {
+		// Redis forgets expired sessions by itself
+		testSessionLimitExpiryRace(t, redisSessionsConf(t), func(*Server) {})
+	})
+}
+
+func testSessionLimitExpiryRace(t *testing.T, conf *server.Configuration, expire func(*Server)) {
+	const max = 5
+	conf.MaxActiveSessions = max
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	for i := 0; i < max; i++ {
+		_, _, _, err = s.StartSession(limitedSessionRequest(1), nil)
+		require.NoError(t, err)
+	}
+	_, _, _, err = s.StartSession(limitedSessionRequest(1), nil)
+	require.IsType(t, &TooManySessionsError{}, err)
+	time.Sleep(1100 * time.Millisecond)
+
+	// Start more sessions than fit concurrently with the sessions expiring
+	var started, exceeded int32
+	var expired int32
+	var wg sync.WaitGroup
+	for i := 0; i < 2*max; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				last := atomic.LoadInt32(&expired) == 1
+				_, _, _, err := s.StartSession(limitedSessionRequest(0), nil)
+				if err == nil {
+					atomic.AddInt32(&started, 1)
+					if count, _ := s.ActiveSessions(""); count > max {
+						atomic.AddInt32(&exceeded, 1)
+					}
+					return
+				}
+				if _, ok := err.(*TooManySessionsError); !ok || last {
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	expire(s)
+	atomic.StoreInt32(&expired, 1)
+	wg.Wait()
+
+	require.Zero(t, exceeded)
+	require.Equal(t, int32(max), started)
+	count, err := s.ActiveSessions("")
+	require.NoError(t, err)
+	require.Equal(t, max, count)
+}
+
+func TestSessionExpiresAt(t *testing.T) {
+	t.Run("Memory", func(t *testing.T) { testSessionExpiresAt(t, sessionsConf(t)) })
+	t.Run("Redis", func(t *testing.T) { testSessionExpiresAt(t, redisSessionsConf(t)) })
+}
+
+func testSessionExpiresAt(t *testing.T, conf *server.Configuration) {
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+	handler := s.HandlerFunc()
+
+	qr, _, frontendRequest, err := s.StartSession(limitedSessionRequest(60), nil)
+	require.NoError(t, err)
+	clientToken := irma.ClientToken(path.Base(qr.URL))
+	do := func(method, endpoint string, headers http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/session/"+string(clientToken)+endpoint, strings.NewReader("invalid"))
+		for key, values := range headers {
+			r.Header.Set(key, values[0])
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+	// setLastActive moves the last activity of the session, with which its expiry moves along
+	setLastActive := func(lastActive time.Time) {
+		session, err := s.sessions.clientGet(clientToken)
+		require.NoError(t, err)
+		session.LastActive = lastActive
+		require.NoError(t, session.updateAndUnlock())
+	}
+
+	// Before the client connects, the session expires after the client timeout of the request
+	var status irma.FrontendSessionStatus
+	w := do(http.MethodGet, "/frontend/status", http.Header{irma.AuthorizationHeader: {string(frontendRequest.Authorization)}})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	require.NotNil(t, status.ExpiresAt)
+	require.WithinDuration(t, time.Now().Add(60*time.Second), time.Time(*status.ExpiresAt), 2*time.Second)
+
+	// After connecting, it expires after the maximum session lifetime
+	clientHeaders := http.Header{
+		irma.MinVersionHeader:    {`"2.8"`},
+		irma.MaxVersionHeader:    {`"2.8"`},
+		irma.AuthorizationHeader: {"testauthorization"},
+	}
+	w = do(http.MethodGet, "/", clientHeaders)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	request := irma.ClientSessionRequest{Request: &irma.DisclosureRequest{}}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &request))
+	require.NotNil(t, request.ExpiresAt)
+	lifetime := time.Duration(conf.MaxSessionLifetime) * time.Minute
+	require.WithinDuration(t, time.Now().Add(lifetime), time.Time(*request.ExpiresAt), 2*time.Second)
+
+	// Just before expiry, proofs are still processed (and rejected, as they are malformed)
+	var rerr irma.RemoteError
+	setLastActive(time.Now().Add(-lifetime + 2*time.Second))
+	w = do(http.MethodPost, "/proofs", clientHeaders)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rerr))
+	require.Equal(t, string(server.ErrorMalformedInput.Type), rerr.ErrorName)
+
+	// After expiry, proofs are refused because the session timed out
+	setLastActive(time.Now().Add(-lifetime - time.Second))
+	w = do(http.MethodPost, "/proofs", clientHeaders)
+	require.Equal(t, server.ErrorSessionUnknown.Status, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rerr))
+	require.Equal(t, string(server.ErrorSessionUnknown.Type), rerr.ErrorName)
+
+	w = do(http.MethodGet, "/frontend/status", http.Header{irma.AuthorizationHeader: {string(frontendRequest.Authorization)}})
+	status = irma.FrontendSessionStatus{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	require.Equal(t, irma.ServerStatusTimeout, status.Status)
+	require.Nil(t, status.ExpiresAt)
+}
+
+func TestFetchSessionResult(t *testing.T) {
+	t.Run("Memory", func(t *testing.T) { testFetchSessionResult(t, sessionsConf(t)) })
+	t.Run("Redis", func(t *testing.T) { testFetchSessionResult(t, redisSessionsConf(t)) })
+}
+
+func testFetchSessionResult(t *testing.T, conf *server.Configuration) {
+	conf.LogAttributeValues = server.AttributeValueLoggingNever
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	_, token, _, err := s.StartSession(limitedSessionRequest(60), nil)
+	require.NoError(t, err)
+	value := "s1234567"
+	session, err := s.sessions.get(token)
+	require.NoError(t, err)
+	session.Result.Disclosed = [][]*irma.DisclosedAttribute{{{
+		Identifier: irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+		RawValue:   &value,
+	}}}
+	require.NoError(t, session.updateAndUnlock())
+
+	// Unfinished sessions are not affected
+	res, err := s.FetchSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, &value, res.Disclosed[0][0].RawValue)
+
+	session, err = s.sessions.get(token)
+	require.NoError(t, err)
+	session.Result.Status = irma.ServerStatusDone
+	require.NoError(t, session.updateAndUnlock())
+
+	// GetSessionResult does not count as fetching the result
+	res, err = s.GetSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, &value, res.Disclosed[0][0].RawValue)
+
+	// Only the first fetch of the finished session returns the attribute values
+	res, err = s.FetchSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, &value, res.Disclosed[0][0].RawValue)
+	require.False(t, res.Redacted)
+
+	res, err = s.FetchSessionResult(token)
+	require.NoError(t, err)
+	require.Nil(t, res.Disclosed[0][0].RawValue)
+	require.True(t, res.Redacted)
+}
+
+func TestDeleteResultOnRead(t *testing.T) {
+	t.Run("Memory", func(t *testing.T) { testDeleteResultOnRead(t, sessionsConf(t)) })
+	t.Run("Redis", func(t *testing.T) { testDeleteResultOnRead(t, redisSessionsConf(t)) })
+}
+
+func testDeleteResultOnRead(t *testing.T, conf *server.Configuration) {
+	callbacks := make(chan *server.SessionResult, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var result server.SessionResult
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&result))
+		callbacks <- &result
+	}))
+	defer ts.Close()
+
+	conf.DeleteResultOnRead = true
+	conf.EgressAllowedNetworks = []string{"127.0.0.0/8", "::1"}
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	// finish starts a session and finishes it with a disclosed attribute
+	value := "s1234567"
+	finish := func(callbackURL string) irma.RequestorToken {
+		request := limitedSessionRequest(60)
+		request.CallbackURL = callbackURL
+		_, token, _, err := s.StartSession(request, nil)
+		require.NoError(t, err)
+		session, err := s.sessions.get(token)
+		require.NoError(t, err)
+		session.Result.Disclosed = [][]*irma.DisclosedAttribute{{{
+			Identifier: irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+			RawValue:   &value,
+		}}}
+		session.Result.ProofStatus = irma.ProofStatusValid
+		session.setStatus(irma.ServerStatusDone)
+		require.NoError(t, session.updateAndUnlock())
+		return token
+	}
+
+	// The result can be fetched once
+	token := finish("")
+	res, err := s.FetchSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, &value, res.Disclosed[0][0].RawValue)
+
+	_, err = s.FetchSessionResult(token)
+	require.IsType(t, &ResultConsumedError{}, err)
+
+	// after which only its status remains
+	res, err = s.GetSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, irma.ServerStatusDone, res.Status)
+	require.Equal(t, irma.ProofStatusValid, res.ProofStatus)
+	require.Nil(t, res.Disclosed)
+	require.True(t, res.Deleted)
+
+	// Delivering the result to the callback URL counts as reading it
+	token = finish(ts.URL)
+	res = <-callbacks
+	require.Equal(t, &value, res.Disclosed[0][0].RawValue)
+	require.False(t, res.Deleted)
+
+	_, err = s.FetchSessionResult(token)
+	require.IsType(t, &ResultConsumedError{}, err)
+}
+
+func TestResultRetention(t *testing.T) {
+	conf := sessionsConf(t)
+	conf.MaxSessionLifetime = 5
+	conf.ResultRetention = 60
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	_, token, _, err := s.StartSession(limitedSessionRequest(0), nil)
+	require.NoError(t, err)
+	session, err := s.sessions.get(token)
+	require.NoError(t, err)
+	now := time.Now()
+	session.LastActive = now
+	require.Equal(t, now.Add(5*time.Minute), session.expiry())
+
+	// Finished sessions are kept for the result retention instead of the session lifetime
+	session.setStatus(irma.ServerStatusDone)
+	session.LastActive = now.Add(-30 * time.Minute)
+	require.Equal(t, now.Add(30*time.Minute), session.expiry())
+	require.NoError(t, session.updateAndUnlock())
+
+	s.sessions.(*memorySessionStore).deleteExpired()
+	_, err = s.GetSessionResult(token)
+	require.NoError(t, err)
+}
+
+func TestSessionSnapshot(t *testing.T) {
+	cachePath := t.TempDir()
+	conf := sessionsConf(t)
+	conf.CachePath = cachePath
+	s, err := New(conf)
+	require.NoError(t, err)
+
+	// setStatus starts a session with the specified status, returning its data
+	setStatus := func(request interface{}, requestor string, status irma.ServerStatus, lastActive time.Time) sessionData {
+		_, token, _, err := s.StartRequestorSession(request, nil, requestor)
+		require.NoError(t, err)
+		session, err := s.sessions.get(token)
+		require.NoError(t, err)
+		defer s.sessions.unlock(session)
+		if status != irma.ServerStatusInitialized {
+			session.setStatus(status)
+		}
+		session.LastActive = lastActive
+		return session.sessionData
+	}
+
+	restored := map[irma.RequestorToken]sessionData{}
+	for _, status := range []irma.ServerStatus{irma.ServerStatusInitialized, irma.ServerStatusPairing, irma.ServerStatusConnected} {
+		sd := setStatus(limitedSessionRequest(60), "alice", status, time.Now())
+		restored[sd.RequestorToken] = sd
+	}
+	var discarded []irma.RequestorToken
+	for _, status := range []irma.ServerStatus{irma.ServerStatusDone, irma.ServerStatusCancelled, irma.ServerStatusTimeout} {
+		discarded = append(discarded, setStatus(limitedSessionRequest(60), "", status, time.Now()).RequestorToken)
+	}
+	expired := setStatus(limitedSessionRequest(60), "", irma.ServerStatusConnected, time.Now().Add(-time.Hour))
+	bsn := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN"))
+	unknown := setStatus(bsn, "", irma.ServerStatusConnected, time.Now())
+	discarded = append(discarded, expired.RequestorToken, unknown.RequestorToken)
+
+	// The snapshot is saved on shutdown
+	s.Stop()
+
+	// Restart with a configuration that no longer contains the credential type of one session
+	conf = sessionsConf(t)
+	conf.CachePath = cachePath
+	conf.IrmaConfiguration, err = irma.NewConfiguration(conf.SchemesPath, irma.ConfigurationOptions{})
+	require.NoError(t, err)
+	require.NoError(t, conf.IrmaConfiguration.ParseFolder())
+	delete(conf.IrmaConfiguration.CredentialTypes, irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"))
+	s, err = New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	for token, sd := range restored {
+		session, err := s.sessions.get(token)
+		require.NoError(t, err)
+		require.Equal(t, sd.hash(), session.sessionData.hash())
+		require.Equal(t, sd.Rrequest.SessionRequest(), session.request)
+		s.sessions.unlock(session)
+
+		session, err = s.sessions.clientGet(sd.ClientToken)
+		require.NoError(t, err)
+		require.Equal(t, token, session.RequestorToken)
+		s.sessions.unlock(session)
+	}
+	for _, token := range discarded {
+		_, err = s.sessions.get(token)
+		require.IsType(t, &UnknownSessionError{}, err)
+	}
+	count, err := s.ActiveSessions("alice")
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+
+	// Restored sessions can be continued
+	for token := range restored {
+		require.NoError(t, s.CancelSession(token))
+	}
+	count, err = s.ActiveSessions("")
+	require.NoError(t, err)
+	require.Zero(t, count)
+}
+
+func TestSessionSnapshotInvalid(t *testing.T) {
+	for name, snapshot := range map[string]string{
+		"Corrupt":            `{"Version":1,"Sessions":[{"Act`,
+		"UnsupportedVersion": `{"Version":2,"Sessions":[]}`,
+		"InvalidSession":     `{"Version":1,"Sessions":[{"Action":"disclosing"}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			conf := sessionsConf(t)
+			conf.CachePath = t.TempDir()
+			require.NoError(t, ioutil.WriteFile(filepath.Join(conf.CachePath, sessionSnapshotFile), []byte(snapshot), 0600))
+
+			// The snapshot is ignored, and replaced by a valid one on shutdown
+			s, err := New(conf)
+			require.NoError(t, err)
+			count, err := s.ActiveSessions("")
+			require.NoError(t, err)
+			require.Zero(t, count)
+			_, _, _, err = s.StartSession(limitedSessionRequest(60), nil)
+			require.NoError(t, err)
+			s.Stop()
+
+			s, err = New(conf)
+			require.NoError(t, err)
+			defer s.Stop()
+			count, err = s.ActiveSessions("")
+			require.NoError(t, err)
+			require.Equal(t, 1, count)
+		})
+	}
+}
+
+func TestSessionTypeDisabled(t *testing.T) {
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	requests := map[irma.Action]irma.SessionRequest{
+		irma.ActionDisclosing: irma.NewDisclosureRequest(id),
+		irma.ActionSigning:    irma.NewSignatureRequest("message", id),
+		// No private keys are installed, so this fails if issuance is enabled
+		irma.ActionIssuing: irma.NewIssuanceRequest([]*irma.CredentialRequest{{
+			CredentialTypeID: id.CredentialTypeIdentifier(),
+			Attributes:       map[string]string{"university": "Radboud", "studentCardNumber": "1", "studentID": "s1", "level": "42"},
+		}}),
+	}
+
+	for _, disabled := range []irma.Action{irma.ActionDisclosing, irma.ActionSigning, irma.ActionIssuing} {
+		conf := sessionsConf(t)
+		conf.DisableDisclosure = disabled == irma.ActionDisclosing
+		conf.DisableSigning = disabled == irma.ActionSigning
+		conf.DisableIssuance = disabled == irma.ActionIssuing
+		s, err := New(conf)
+		require.NoError(t, err)
+
+		for action, request := range requests {
+			_, _, _, err = s.StartSession(request, nil)
+			switch {
+			case action == disabled:
+				require.Equal(t, &SessionTypeDisabledError{Action: action}, err)
+			case action == irma.ActionIssuing:
+				require.Error(t, err)
+				require.NotEqual(t, &SessionTypeDisabledError{Action: action}, err)
+			default:
+				require.NoError(t, err)
+			}
+		}
+		s.Stop()
+	}
+}
+
+func TestFrontendRequest(t *testing.T) {
+	conf := sessionsConf(t)
+	conf.IssuerPrivateKeysPath = filepath.Join(test.FindTestdataFolder(t), "privatekeys")
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+	handler := s.HandlerFunc()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	base := irma.RequestorBaseRequest{CallbackURL: "https://example.com/callback"}
+	disclosure := irma.NewDisclosureRequest(id)
+	disclosure.Labels = map[int]irma.TranslatedString{0: {"en": "Student number"}}
+	requests := map[irma.Action]irma.RequestorRequest{
+		irma.ActionDisclosing: &irma.ServiceProviderRequest{RequestorBaseRequest: base, Request: disclosure},
+		irma.ActionSigning: &irma.SignatureRequestorRequest{
+			RequestorBaseRequest: base,
+			Request:              irma.NewSignatureRequest("message to be signed", id),
+		},
+		irma.ActionIssuing: &irma.IdentityProviderRequest{
+			RequestorBaseRequest: base,
+			Request: irma.NewIssuanceRequest([]*irma.CredentialRequest{{
+				CredentialTypeID: id.CredentialTypeIdentifier(),
+				Attributes:       map[string]string{"university": "Radboud", "studentCardNumber": "1", "studentID": "s1", "level": "42"},
+			}}),
+		},
+	}
+
+	for action, rrequest := range requests {
+		t.Run(string(action), func(t *testing.T) {
+			qr, _, frontendRequest, err := s.StartSession(rrequest, nil)
+			require.NoError(t, err)
+			clientToken := irma.ClientToken(path.Base(qr.URL))
+			do := func(method, endpoint string, auth string) *httptest.ResponseRecorder {
+				r := httptest.NewRequest(method, "/session/"+string(clientToken)+endpoint, nil)
+				r.Header.Set(irma.AuthorizationHeader, auth)
+				if endpoint == "/" {
+					r.Header.Set(irma.MinVersionHeader, `"2.8"`)
+					r.Header.Set(irma.MaxVersionHeader, `"2.8"`)
+				}
+				w := httptest.NewRecorder()
+				handler(w, r)
+				return w
+			}
+			frontendAuth := string(frontendRequest.Authorization)
+
+			// The frontend authorization is required
+			w := do(http.MethodGet, "/frontend/request", "wrongauthorization")
+			require.Equal(t, server.ErrorIrmaUnauthorized.Status, w.Code)
+
+			w = do(http.MethodGet, "/frontend/request", frontendAuth)
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			body := w.Body.String()
+			require.NotContains(t, body, "callbackUrl")
+			require.NotContains(t, body, "nonce")
+			require.NotContains(t, body, "revocationKey")
+			require.Contains(t, body, id.CredentialTypeIdentifier().String())
+
+			request := map[irma.Action]irma.SessionRequest{
+				irma.ActionDisclosing: &irma.DisclosureRequest{},
+				irma.ActionSigning:    &irma.SignatureRequest{},
+				irma.ActionIssuing:    &irma.IssuanceRequest{},
+			}[action]
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), request))
+			require.Equal(t, action, request.Action())
+			switch r := request.(type) {
+			case *irma.SignatureRequest:
+				require.Equal(t, "message to be signed", r.Message)
+			case *irma.IssuanceRequest:
+				require.Len(t, r.Credentials, 1)
+				require.Equal(t, "s1", r.Credentials[0].Attributes["studentID"])
+			case *irma.DisclosureRequest:
+				require.Equal(t, "Student number", r.Labels[0]["en"])
+			}
+
+			// The response does not change when the client connects
+			w = do(http.MethodGet, "/", "testauthorization")
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			w = do(http.MethodGet, "/frontend/request", frontendAuth)
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, body, w.Body.String())
+
+			// After expiry, the request is no longer returned
+			session, err := s.sessions.clientGet(clientToken)
+			require.NoError(t, err)
+			session.LastActive = time.Now().Add(-time.Duration(conf.MaxSessionLifetime)*time.Minute - time.Second)
+			require.NoError(t, session.updateAndUnlock())
+			w = do(http.MethodGet, "/frontend/request", frontendAuth)
+			require.Equal(t, server.ErrorSessionUnknown.Status, w.Code)
+			var rerr irma.RemoteError
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rerr))
+			require.Equal(t, string(server.ErrorSessionUnknown.Type), rerr.ErrorName)
+		})
+	}
+}
+
+func TestStaticSessionsDisabled(t *testing.T) {
+	credid := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	staticConf := func(production bool) *server.Configuration {
+		conf := sessionsConf(t)
+		conf.Production = production
+		conf.AllowUnsignedCallbacks = true
+		conf.StaticSessions = map[string]interface{}{
+			"student": irma.ServiceProviderRequest{
+				RequestorBaseRequest: irma.RequestorBaseRequest{CallbackURL: "https://example.com/callback"},
+				Request:              irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+			},
+		}
+		var err error
+		conf.IrmaConfiguration, err = irma.NewConfiguration(conf.SchemesPath, irma.ConfigurationOptions{})
+		require.NoError(t, err)
+		require.NoError(t, conf.IrmaConfiguration.ParseFolder())
+		return conf
+	}
+
+	// In production, the server refuses to start with an invalid static session
+	conf := staticConf(true)
+	delete(conf.IrmaConfiguration.CredentialTypes, credid)
+	_, err := New(conf)
+	require.Error(t, err)
+
+	// Otherwise, the static session is disabled
+	conf = staticConf(false)
+	credtype := conf.IrmaConfiguration.CredentialTypes[credid]
+	delete(conf.IrmaConfiguration.CredentialTypes, credid)
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+	handler := s.HandlerFunc()
+	start := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/session/static/student", nil))
+		return w
+	}
+
+	sessions := s.StaticSessions()
+	require.Len(t, sessions, 1)
+	require.Equal(t, "student", sessions[0].Name)
+	require.False(t, sessions[0].Enabled)
+	require.NotEmpty(t, sessions[0].Error)
+	require.Equal(t, server.ErrorInvalidRequest.Status, start().Code)
+
+	// It is enabled again when a scheme update makes it valid again
+	conf.IrmaConfiguration.CredentialTypes[credid] = credtype
+	s.validateStaticSessions()
+	sessions = s.StaticSessions()
+	require.True(t, sessions[0].Enabled)
+	require.Empty(t, sessions[0].Error)
+	w := start()
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
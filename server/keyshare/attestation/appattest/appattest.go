@@ -0,0 +1,195 @@
+// +build appattest
+
+// Package appattest verifies the key attestations of Apple's App Attest service, with which iOS
+// apps prove that they run unmodified on a genuine Apple device. The Verifier can be used as
+// keyshareserver.RegistrationAttestor.
+//
+// Tokens are the base64 encoded attestation objects returned by attestKey of DCAppAttestService.
+// As the keyshare server issues no challenge for registrations, the app must attest its key using
+// as client data hash the SHA-256 hash of the key identifier (i.e. of the decoded keyId); each key
+// can be used for only one registration while the verifier runs.
+//
+// This package is only built with the build tag appattest.
+package appattest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor"
+	"github.com/go-errors/errors"
+)
+
+// Platform is the attestation platform of App Attest attestations.
+const Platform = "ios"
+
+var (
+	nonceExtension = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 8, 2}
+
+	aaguidProduction  = []byte("appattest\x00\x00\x00\x00\x00\x00\x00")
+	aaguidDevelopment = []byte("appattestdevelop")
+)
+
+// Verifier verifies attestations of keys of the specified app.
+type Verifier struct {
+	appID            string
+	roots            *x509.CertPool
+	allowDevelopment bool
+
+	mutex sync.Mutex
+	used  map[string]time.Time // identifiers of attested keys, until their certificates expire
+}
+
+type attestation struct {
+	Fmt     string `cbor:"fmt"`
+	AttStmt struct {
+		X5C     [][]byte `cbor:"x5c"`
+		Receipt []byte   `cbor:"receipt"`
+	} `cbor:"attStmt"`
+	AuthData []byte `cbor:"authData"`
+}
+
+// NewVerifier returns a verifier for attestations of the app with the specified identifier (its
+// team identifier and bundle identifier, separated by a dot), whose certificates must chain to the
+// PEM encoded Apple App Attestation Root CA. Attestations from the development environment are
+// only accepted if allowDevelopment is set.
+func NewVerifier(appID string, rootCA []byte, allowDevelopment bool) (*Verifier, error) {
+	if appID == "" {
+		return nil, errors.New("App Attest app identifier required")
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(rootCA) {
+		return nil, errors.New("failed to parse App Attest root certificate")
+	}
+	return &Verifier{
+		appID:            appID,
+		roots:            roots,
+		allowDevelopment: allowDevelopment,
+		used:             map[string]time.Time{},
+	}, nil
+}
+
+// Verify checks that the token is an attestation of a new key of the app, following the steps
+// documented by Apple for validating attestations.
+func (v *Verifier) Verify(token string, platform string) error {
+	if platform != Platform {
+		return errors.Errorf("App Attest attestations cannot attest platform %q", platform)
+	}
+	bts, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return errors.WrapPrefix(err, "failed to decode attestation", 0)
+	}
+	var att attestation
+	if err = cbor.Unmarshal(bts, &att); err != nil {
+		return errors.WrapPrefix(err, "failed to parse attestation", 0)
+	}
+	if att.Fmt != "apple-appattest" || len(att.AttStmt.X5C) < 2 {
+		return errors.New("Not an App Attest attestation")
+	}
+
+	// The credential certificate must chain to the App Attestation root
+	certs := make([]*x509.Certificate, len(att.AttStmt.X5C))
+	for i, der := range att.AttStmt.X5C {
+		if certs[i], err = x509.ParseCertificate(der); err != nil {
+			return errors.WrapPrefix(err, "failed to parse attestation certificate", 0)
+		}
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = certs[0].Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return errors.WrapPrefix(err, "failed to verify attestation certificate", 0)
+	}
+
+	// The certificate contains the nonce binding the authenticator data and the client data
+	pk, ok := certs[0].PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return errors.New("Attested key is not an EC key")
+	}
+	keyID := sha256.Sum256(elliptic.Marshal(pk.Curve, pk.X, pk.Y))
+	clientDataHash := sha256.Sum256(keyID[:])
+	nonce := sha256.Sum256(append(append([]byte{}, att.AuthData...), clientDataHash[:]...))
+	if !bytes.Equal(certificateNonce(certs[0]), nonce[:]) {
+		return errors.New("Attestation nonce mismatch")
+	}
+
+	if err = v.verifyAuthData(att.AuthData, keyID[:]); err != nil {
+		return err
+	}
+	return v.use(hex.EncodeToString(keyID[:]), certs[0].NotAfter)
+}
+
+// certificateNonce returns the nonce in the App Attest extension of the certificate, if any.
+func certificateNonce(cert *x509.Certificate) []byte {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(nonceExtension) {
+			continue
+		}
+		var value struct {
+			Nonce []byte `asn1:"tag:1,explicit"`
+		}
+		if _, err := asn1.Unmarshal(ext.Value, &value); err != nil {
+			return nil
+		}
+		return value.Nonce
+	}
+	return nil
+}
+
+// verifyAuthData checks that the authenticator data concerns a new key, with the specified
+// identifier, of our app.
+func (v *Verifier) verifyAuthData(authData, keyID []byte) error {
+	// RP ID hash (32), flags (1), counter (4), AAGUID (16), credential ID length (2), credential ID
+	if len(authData) < 55 {
+		return errors.New("Authenticator data too short")
+	}
+	appIDHash := sha256.Sum256([]byte(v.appID))
+	if !bytes.Equal(authData[:32], appIDHash[:]) {
+		return errors.New("Attestation of another app")
+	}
+	if binary.BigEndian.Uint32(authData[33:37]) != 0 {
+		return errors.New("Attestation of a key that has already been used")
+	}
+	aaguid := authData[37:53]
+	if !bytes.Equal(aaguid, aaguidProduction) && !(v.allowDevelopment && bytes.Equal(aaguid, aaguidDevelopment)) {
+		return errors.New("Attestation from unaccepted App Attest environment")
+	}
+	credentialIDLength := int(binary.BigEndian.Uint16(authData[53:55]))
+	if len(authData) < 55+credentialIDLength || !bytes.Equal(authData[55:55+credentialIDLength], keyID) {
+		return errors.New("Attestation of another key")
+	}
+	return nil
+}
+
+// use records that the key has been attested, returning an error if it already was.
+func (v *Verifier) use(keyID string, expiry time.Time) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	now := time.Now()
+	for id, e := range v.used {
+		if e.Before(now) {
+			delete(v.used, id)
+		}
+	}
+	if _, ok := v.used[keyID]; ok {
+		return errors.New("Attestation has already been used")
+	}
+	v.used[keyID] = expiry
+	return nil
+}
@@ -0,0 +1,136 @@
+// +build appattest
+
+package appattest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor"
+	"github.com/stretchr/testify/require"
+)
+
+const testAppID = "TEAMID1234.org.example.app"
+
+type testCA struct {
+	root, intermediate       *x509.Certificate
+	rootKey, intermediateKey *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{}
+	ca.root, ca.rootKey = newCertificate(t, "Test App Attestation Root CA", nil, nil, true, nil)
+	ca.intermediate, ca.intermediateKey = newCertificate(t, "Test App Attestation CA", ca.root, ca.rootKey, true, nil)
+	return ca
+}
+
+func newCertificate(
+	t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, isCA bool, exts []pkix.Extension,
+) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtraExtensions:       exts,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+// attest returns an attestation of a new key of the app, as returned by App Attest.
+func (ca *testCA) attest(t *testing.T, appID string, counter uint32, aaguid []byte, clientData func(keyID []byte) []byte) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	keyID := sha256.Sum256(elliptic.Marshal(key.Curve, key.X, key.Y))
+
+	appIDHash := sha256.Sum256([]byte(appID))
+	authData := append([]byte{}, appIDHash[:]...)
+	authData = append(authData, 0x40)
+	authData = append(authData, make([]byte, 4)...)
+	binary.BigEndian.PutUint32(authData[33:], counter)
+	authData = append(authData, aaguid...)
+	authData = append(authData, 0, byte(len(keyID)))
+	authData = append(authData, keyID[:]...)
+
+	clientDataHash := sha256.Sum256(clientData(keyID[:]))
+	nonce := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	ext, err := asn1.Marshal(struct {
+		Nonce []byte `asn1:"tag:1,explicit"`
+	}{nonce[:]})
+	require.NoError(t, err)
+
+	// The credential certificate certifies the attested key
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(time.Now().UnixNano()),
+		Subject:         pkix.Name{CommonName: "credential"},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: nonceExtension, Value: ext}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.intermediate, &key.PublicKey, ca.intermediateKey)
+	require.NoError(t, err)
+
+	var att attestation
+	att.Fmt = "apple-appattest"
+	att.AttStmt.X5C = [][]byte{der, ca.intermediate.Raw}
+	att.AuthData = authData
+	bts, err := cbor.Marshal(att, cbor.EncOptions{})
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(bts)
+}
+
+// keyIDClientData returns the client data that apps attest: the key identifier itself.
+func keyIDClientData(keyID []byte) []byte {
+	return keyID
+}
+
+func TestVerify(t *testing.T) {
+	ca := newTestCA(t)
+	v, err := NewVerifier(testAppID, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.root.Raw}), false)
+	require.NoError(t, err)
+
+	token := ca.attest(t, testAppID, 0, aaguidProduction, keyIDClientData)
+	require.NoError(t, v.Verify(token, "ios"))
+
+	// Each key can be attested only once
+	require.Error(t, v.Verify(token, "ios"))
+
+	require.Error(t, v.Verify(ca.attest(t, testAppID, 0, aaguidProduction, keyIDClientData), "android"))
+	require.Error(t, v.Verify(ca.attest(t, "TEAMID1234.org.example.other", 0, aaguidProduction, keyIDClientData), "ios"))
+	require.Error(t, v.Verify(ca.attest(t, testAppID, 1, aaguidProduction, keyIDClientData), "ios"))
+	require.Error(t, v.Verify(ca.attest(t, testAppID, 0, aaguidDevelopment, keyIDClientData), "ios"))
+	require.Error(t, v.Verify(ca.attest(t, testAppID, 0, aaguidProduction, func([]byte) []byte { return []byte("other") }), "ios"))
+	require.Error(t, v.Verify("bm90IGFuIGF0dGVzdGF0aW9u", "ios"))
+
+	// Attestations must chain to the configured root
+	other := newTestCA(t)
+	require.Error(t, v.Verify(other.attest(t, testAppID, 0, aaguidProduction, keyIDClientData), "ios"))
+
+	// Development attestations are accepted if allowed
+	v, err = NewVerifier(testAppID, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.root.Raw}), true)
+	require.NoError(t, err)
+	require.NoError(t, v.Verify(ca.attest(t, testAppID, 0, aaguidDevelopment, keyIDClientData), "ios"))
+}
@@ -0,0 +1,201 @@
+// +build playintegrity
+
+// Package playintegrity verifies the integrity tokens of the Play Integrity API, with which Android
+// apps prove that they are recognized by Google Play and run on a genuine device. Tokens are
+// decrypted and verified locally, using the keys of the app from the Google Play Console, so that
+// no requests to Google are made. The Verifier can be used as keyshareserver.RegistrationAttestor.
+//
+// This package is only built with the build tag playintegrity.
+package playintegrity
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Platform is the attestation platform of Play Integrity tokens.
+const Platform = "android"
+
+// MaxAgeDefault is the default maximum age of integrity tokens.
+const MaxAgeDefault = 10 * time.Minute
+
+// Verifier verifies integrity tokens of the specified app.
+type Verifier struct {
+	PackageName string
+	// Maximum time between the app requesting the token and the token being verified
+	MaxAge time.Duration
+
+	decryptionKey   []byte
+	verificationKey *ecdsa.PublicKey
+}
+
+type verdict struct {
+	RequestDetails struct {
+		RequestPackageName string `json:"requestPackageName"`
+		TimestampMillis    int64  `json:"timestampMillis,string"`
+	} `json:"requestDetails"`
+	AppIntegrity struct {
+		AppRecognitionVerdict string `json:"appRecognitionVerdict"`
+		PackageName           string `json:"packageName"`
+	} `json:"appIntegrity"`
+	DeviceIntegrity struct {
+		DeviceRecognitionVerdict []string `json:"deviceRecognitionVerdict"`
+	} `json:"deviceIntegrity"`
+}
+
+// Valid implements jwt.Claims; the verdict is checked by Verify.
+func (verdict) Valid() error {
+	return nil
+}
+
+// NewVerifier returns a verifier for the integrity tokens of the app with the specified package
+// name, using its decryption and verification keys, base64 encoded as in the Google Play Console.
+func NewVerifier(packageName, decryptionKey, verificationKey string) (*Verifier, error) {
+	if packageName == "" {
+		return nil, errors.New("Play Integrity package name required")
+	}
+	key, err := base64.StdEncoding.DecodeString(decryptionKey)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("Play Integrity decryption key must consist of 32 base64 encoded bytes")
+	}
+	der, err := base64.StdEncoding.DecodeString(verificationKey)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to decode Play Integrity verification key", 0)
+	}
+	pk, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to parse Play Integrity verification key", 0)
+	}
+	ecpk, ok := pk.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Play Integrity verification key must be an EC public key")
+	}
+	return &Verifier{
+		PackageName:     packageName,
+		MaxAge:          MaxAgeDefault,
+		decryptionKey:   key,
+		verificationKey: ecpk,
+	}, nil
+}
+
+// Verify checks that the token is a fresh integrity token of the app, which Google Play recognizes,
+// running on a device that meets the device integrity requirements.
+func (v *Verifier) Verify(token string, platform string) error {
+	if platform != Platform {
+		return errors.Errorf("Play Integrity tokens cannot attest platform %q", platform)
+	}
+	jws, err := v.decrypt(token)
+	if err != nil {
+		return errors.WrapPrefix(err, "failed to decrypt integrity token", 0)
+	}
+	var verdict verdict
+	parser := &jwt.Parser{ValidMethods: []string{"ES256"}}
+	_, err = parser.ParseWithClaims(string(jws), &verdict, func(*jwt.Token) (interface{}, error) {
+		return v.verificationKey, nil
+	})
+	if err != nil {
+		return errors.WrapPrefix(err, "failed to verify integrity token", 0)
+	}
+
+	if verdict.RequestDetails.RequestPackageName != v.PackageName || verdict.AppIntegrity.PackageName != v.PackageName {
+		return errors.New("Integrity token of another app")
+	}
+	age := time.Since(time.Unix(0, verdict.RequestDetails.TimestampMillis*int64(time.Millisecond)))
+	if age > v.MaxAge || age < -v.MaxAge {
+		return errors.New("Integrity token expired")
+	}
+	if verdict.AppIntegrity.AppRecognitionVerdict != "PLAY_RECOGNIZED" {
+		return errors.Errorf("App not recognized by Google Play: %s", verdict.AppIntegrity.AppRecognitionVerdict)
+	}
+	for _, label := range verdict.DeviceIntegrity.DeviceRecognitionVerdict {
+		if label == "MEETS_DEVICE_INTEGRITY" {
+			return nil
+		}
+	}
+	return errors.New("Device does not meet device integrity")
+}
+
+// decrypt decrypts the token, a JWE using A256KW key wrapping and A256GCM content encryption,
+// returning its content.
+func (v *Verifier) decrypt(token string) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		return nil, errors.New("not a JWE in compact serialization")
+	}
+	var decoded [5][]byte
+	for i, part := range parts {
+		var err error
+		if decoded[i], err = base64.RawURLEncoding.DecodeString(part); err != nil {
+			return nil, err
+		}
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Enc string `json:"enc"`
+	}
+	if err := json.Unmarshal(decoded[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "A256KW" || header.Enc != "A256GCM" {
+		return nil, errors.Errorf("unsupported algorithms %s and %s", header.Alg, header.Enc)
+	}
+
+	cek, err := unwrapKey(v.decryptionKey, decoded[1])
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(decoded[2]))
+	if err != nil {
+		return nil, err
+	}
+	// The authentication tag follows the ciphertext; the additional data is the encoded header
+	return gcm.Open(nil, decoded[2], append(decoded[3], decoded[4]...), []byte(parts[0]))
+}
+
+var keyWrapIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+// unwrapKey unwraps the key using the AES key wrap algorithm of RFC 3394.
+func unwrapKey(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped)%8 != 0 || len(wrapped) < 24 {
+		return nil, errors.New("invalid wrapped key length")
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(wrapped)/8 - 1
+	a := make([]byte, 8)
+	copy(a, wrapped[:8])
+	r := make([]byte, n*8)
+	copy(r, wrapped[8:])
+	buf := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			binary.BigEndian.PutUint64(buf[:8], binary.BigEndian.Uint64(a)^uint64(n*j+i))
+			copy(buf[8:], r[(i-1)*8:i*8])
+			block.Decrypt(buf, buf)
+			copy(a, buf[:8])
+			copy(r[(i-1)*8:i*8], buf[8:])
+		}
+	}
+	if subtle.ConstantTimeCompare(a, keyWrapIV) != 1 {
+		return nil, errors.New("failed to unwrap key")
+	}
+	return r, nil
+}
@@ -0,0 +1,127 @@
+// +build playintegrity
+
+package playintegrity
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnwrapKey(t *testing.T) {
+	// Test vector 4.6 of RFC 3394
+	kek, _ := hex.DecodeString("000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F")
+	key, _ := hex.DecodeString("00112233445566778899AABBCCDDEEFF000102030405060708090A0B0C0D0E0F")
+	wrapped, _ := hex.DecodeString("28C9F404C4B810F4CBCCB35CFB87F8263F5786E2D80ED326CBC7F0E71A99F43BFB988B9B7A02DD21")
+	require.Equal(t, wrapped, wrapKey(t, kek, key))
+
+	unwrapped, err := unwrapKey(kek, wrapped)
+	require.NoError(t, err)
+	require.Equal(t, key, unwrapped)
+
+	wrapped[0] ^= 1
+	_, err = unwrapKey(kek, wrapped)
+	require.Error(t, err)
+}
+
+func TestVerify(t *testing.T) {
+	decryptionKey := make([]byte, 32)
+	_, err := rand.Read(decryptionKey)
+	require.NoError(t, err)
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&signingKey.PublicKey)
+	require.NoError(t, err)
+
+	v, err := NewVerifier("org.example.app",
+		base64.StdEncoding.EncodeToString(decryptionKey), base64.StdEncoding.EncodeToString(der))
+	require.NoError(t, err)
+
+	token := func(packageName string, timestamp time.Time, appVerdict string, deviceVerdict ...string) string {
+		jws, err := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+			"requestDetails": map[string]string{
+				"requestPackageName": packageName,
+				"timestampMillis":    strconv.FormatInt(timestamp.UnixNano()/int64(time.Millisecond), 10),
+			},
+			"appIntegrity": map[string]string{
+				"appRecognitionVerdict": appVerdict,
+				"packageName":           packageName,
+			},
+			"deviceIntegrity": map[string][]string{
+				"deviceRecognitionVerdict": deviceVerdict,
+			},
+		}).SignedString(signingKey)
+		require.NoError(t, err)
+		return encrypt(t, decryptionKey, []byte(jws))
+	}
+
+	now := time.Now()
+	require.NoError(t, v.Verify(token("org.example.app", now, "PLAY_RECOGNIZED", "MEETS_DEVICE_INTEGRITY"), "android"))
+	require.NoError(t, v.Verify(token("org.example.app", now, "PLAY_RECOGNIZED", "MEETS_BASIC_INTEGRITY", "MEETS_DEVICE_INTEGRITY"), "android"))
+
+	require.Error(t, v.Verify(token("org.example.app", now, "PLAY_RECOGNIZED", "MEETS_DEVICE_INTEGRITY"), "ios"))
+	require.Error(t, v.Verify(token("org.example.other", now, "PLAY_RECOGNIZED", "MEETS_DEVICE_INTEGRITY"), "android"))
+	require.Error(t, v.Verify(token("org.example.app", now.Add(-time.Hour), "PLAY_RECOGNIZED", "MEETS_DEVICE_INTEGRITY"), "android"))
+	require.Error(t, v.Verify(token("org.example.app", now, "UNRECOGNIZED_VERSION", "MEETS_DEVICE_INTEGRITY"), "android"))
+	require.Error(t, v.Verify(token("org.example.app", now, "PLAY_RECOGNIZED", "MEETS_BASIC_INTEGRITY"), "android"))
+	require.Error(t, v.Verify(token("org.example.app", now, "PLAY_RECOGNIZED"), "android"))
+	require.Error(t, v.Verify("not.a.valid.integrity.token", "android"))
+
+	// Tokens signed with another key are refused
+	signingKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	require.Error(t, v.Verify(token("org.example.app", now, "PLAY_RECOGNIZED", "MEETS_DEVICE_INTEGRITY"), "android"))
+}
+
+// encrypt returns a JWE containing the payload, as issued by the Play Integrity API.
+func encrypt(t *testing.T, kek, payload []byte) string {
+	cek := make([]byte, 32)
+	iv := make([]byte, 12)
+	_, err := rand.Read(cek)
+	require.NoError(t, err)
+	_, err = rand.Read(iv)
+	require.NoError(t, err)
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"A256KW","enc":"A256GCM"}`))
+	block, err := aes.NewCipher(cek)
+	require.NoError(t, err)
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	sealed := gcm.Seal(nil, iv, payload, []byte(header))
+	ciphertext, tag := sealed[:len(payload)], sealed[len(payload):]
+
+	enc := base64.RawURLEncoding.EncodeToString
+	return header + "." + enc(wrapKey(t, kek, cek)) + "." + enc(iv) + "." + enc(ciphertext) + "." + enc(tag)
+}
+
+func wrapKey(t *testing.T, kek, key []byte) []byte {
+	block, err := aes.NewCipher(kek)
+	require.NoError(t, err)
+
+	n := len(key) / 8
+	a := append([]byte{}, keyWrapIV...)
+	r := append([]byte{}, key...)
+	buf := make([]byte, 16)
+	for j := 0; j <= 5; j++ {
+		for i := 1; i <= n; i++ {
+			copy(buf[:8], a)
+			copy(buf[8:], r[(i-1)*8:i*8])
+			block.Encrypt(buf, buf)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(buf[:8])^uint64(n*j+i))
+			copy(r[(i-1)*8:i*8], buf[8:])
+		}
+	}
+	return append(a, r...)
+}
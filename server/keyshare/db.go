@@ -1,20 +1,249 @@
 package keyshare
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/go-errors/errors"
+	"github.com/jackc/pgx"
 	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
 )
 
 var ErrUserNotFound = errors.New("Could not find specified user")
 
+// Queries failing with a transient error (see IsTransientError), e.g. during a database failover,
+// are retried this many times, after a randomized delay that doubles with each attempt, if
+// retrying them is safe (see DB). Vars so that tests may change them.
+var (
+	RetryAttempts  = 3
+	RetryBaseDelay = 100 * time.Millisecond
+)
+
+// DB wraps a database connection, providing convenience methods for common queries.
+// The methods ending in Context abort the query when the context is cancelled.
+// SELECT queries are retried when they fail with a transient error. Other statements may have been
+// executed by the database before the connection broke, so they are retried only when the error
+// guarantees that they had no effect, e.g. when no connection could be established.
 type DB struct {
+	// Start (in Unix nanoseconds) of the ongoing series of transient failures, or 0 if the last
+	// query succeeded. Kept first for the alignment required by sync/atomic.
+	failingSince int64
+
 	*sql.DB
+
+	// Instrumentation of the operations started using Operation.
+	Instrumentation DBInstrumentation
+}
+
+// DBInstrumentation limits the duration of database operations and reports them. An operation
+// is a unit of work of the application, e.g. a method of its database interface, usually
+// consisting of a single query.
+type DBInstrumentation struct {
+	// Operations are cancelled when they take longer than this, if it is not 0.
+	Timeout time.Duration
+	// Operations taking longer than this are logged with their name and duration (but not the
+	// values used in their queries), if it is not 0.
+	SlowThreshold time.Duration
+	// OnOperation, if set, is called after each operation with its name, its duration, and the
+	// last error returned by its queries, if any.
+	OnOperation func(op string, duration time.Duration, err error)
+}
+
+type operationContextKey struct{}
+
+// operation records the last error of the queries of an operation.
+type operation struct {
+	err error
+}
+
+// Operation starts the database operation op, consisting of the queries done using the returned
+// context, which is cancelled when the operation takes longer than Instrumentation.Timeout.
+// The returned function must be called when the operation is done, e.g. using defer; it logs
+// the operation if it was slow and reports it to Instrumentation.OnOperation.
+func (db *DB) Operation(ctx context.Context, op string) (context.Context, func()) {
+	instr := db.Instrumentation
+	start := time.Now()
+	o := &operation{}
+	ctx = context.WithValue(ctx, operationContextKey{}, o)
+	cancel := func() {}
+	if instr.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, instr.Timeout)
+	}
+
+	return ctx, func() {
+		cancel()
+		duration := time.Since(start)
+		if instr.SlowThreshold > 0 && duration > instr.SlowThreshold {
+			server.Logger.WithFields(logrus.Fields{"operation": op, "duration": duration.String()}).
+				Warn("Slow database operation")
+		}
+		if instr.OnOperation != nil {
+			instr.OnOperation(op, duration, o.err)
+		}
+	}
+}
+
+// FailingFor returns how long queries have been failing with transient errors, or 0 if the
+// last query succeeded.
+func (db *DB) FailingFor() time.Duration {
+	since := atomic.LoadInt64(&db.failingSince)
+	if since == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, since))
+}
+
+func (db *DB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	var rows *sql.Rows
+	err := db.retry(ctx, isSelect(query), func() (err error) {
+		rows, err = db.DB.QueryContext(ctx, query, args...)
+		return
+	})
+	return rows, err
+}
+
+func (db *DB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	var res sql.Result
+	err := db.retry(ctx, isSelect(query), func() (err error) {
+		res, err = db.DB.ExecContext(ctx, query, args...)
+		return
+	})
+	return res, err
+}
+
+// retry runs f until it succeeds, fails with a non-transient error, or RetryAttempts retries
+// have been done. Unless f is idempotent, only errors after which f certainly had no effect are
+// retried (see notExecuted). Once the database has been failing for longer than the delays of all
+// retries together, each query is tried only once, so that requests fail fast until it recovers.
+func (db *DB) retry(ctx context.Context, idempotent bool, f func() error) error {
+	attempts := RetryAttempts
+	if db.FailingFor() > RetryBaseDelay<<uint(RetryAttempts) {
+		attempts = 0
+	}
+
+	var err error
+	defer func() {
+		if o, ok := ctx.Value(operationContextKey{}).(*operation); ok && err != nil {
+			o.err = err
+		}
+	}()
+
+	for i := 0; ; i++ {
+		err = f()
+		if err != nil && ctx.Err() != nil {
+			return err // cancelled by the caller, which says nothing about the database
+		}
+		if err == nil || !IsTransientError(err) {
+			atomic.StoreInt64(&db.failingSince, 0)
+			return err
+		}
+		atomic.CompareAndSwapInt64(&db.failingSince, 0, time.Now().UnixNano())
+		if i == attempts || !(idempotent || notExecuted(err)) {
+			return err
+		}
+
+		// Wait between half and the full delay of this attempt
+		delay := RetryBaseDelay << uint(i)
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// IsTransientError returns whether the error indicates that the database is temporarily
+// unreachable or unable to process the query, such that retrying it may succeed.
+func IsTransientError(err error) bool {
+	for ; err != nil; err = unwrap(err) {
+		if err == driver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF ||
+			err == syscall.ECONNRESET || err == syscall.ECONNREFUSED || err == syscall.EPIPE {
+			return true
+		}
+		switch e := err.(type) {
+		case pgx.PgError:
+			// Class 08: connection exception; 57P01-57P03: server shutting down or starting up;
+			// 40001 and 40P01: serialization failure and deadlock, resolved by trying again
+			return strings.HasPrefix(e.Code, "08") ||
+				e.Code == "57P01" || e.Code == "57P02" || e.Code == "57P03" ||
+				e.Code == "40001" || e.Code == "40P01"
+		case net.Error:
+			if e.Timeout() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsUniqueViolation returns whether the error indicates that the query was rejected because it
+// would violate the unique index or constraint with the specified name.
+func IsUniqueViolation(err error, constraint string) bool {
+	for ; err != nil; err = unwrap(err) {
+		if e, ok := err.(pgx.PgError); ok {
+			return e.Code == "23505" && e.ConstraintName == constraint
+		}
+	}
+	return false
+}
+
+// notExecuted returns whether the transient error guarantees that the statement had no effect:
+// it failed before the statement was sent, or the database rolled it back.
+func notExecuted(err error) bool {
+	for ; err != nil; err = unwrap(err) {
+		if err == driver.ErrBadConn || err == syscall.ECONNREFUSED {
+			return true
+		}
+		switch e := err.(type) {
+		case pgx.PgError:
+			// 57P03: server starting up; 40001 and 40P01: serialization failure and deadlock
+			return e.Code == "57P03" || e.Code == "40001" || e.Code == "40P01"
+		case *net.OpError:
+			if e.Op == "dial" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isSelect returns whether the query is a SELECT query, which is safe to execute twice.
+func isSelect(query string) bool {
+	query = strings.TrimSpace(query)
+	return len(query) >= 6 && strings.EqualFold(query[:6], "SELECT")
+}
+
+func unwrap(err error) error {
+	switch e := err.(type) {
+	case *errors.Error:
+		return e.Err
+	case interface{ Unwrap() error }:
+		return e.Unwrap()
+	case interface{ Cause() error }: // github.com/pkg/errors, used by pgx
+		if cause := e.Cause(); cause != err {
+			return cause
+		}
+	}
+	return nil
 }
 
 func (db *DB) ExecCount(query string, args ...interface{}) (int64, error) {
-	res, err := db.Exec(query, args...)
+	return db.ExecCountContext(context.Background(), query, args...)
+}
+
+func (db *DB) ExecCountContext(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	res, err := db.ExecContext(ctx, query, args...)
 	if err != nil {
 		return 0, err
 	}
@@ -22,7 +251,11 @@ func (db *DB) ExecCount(query string, args ...interface{}) (int64, error) {
 }
 
 func (db *DB) ExecUser(query string, args ...interface{}) error {
-	c, err := db.ExecCount(query, args...)
+	return db.ExecUserContext(context.Background(), query, args...)
+}
+
+func (db *DB) ExecUserContext(ctx context.Context, query string, args ...interface{}) error {
+	c, err := db.ExecCountContext(ctx, query, args...)
 	if err != nil {
 		return err
 	}
@@ -33,7 +266,11 @@ func (db *DB) ExecUser(query string, args ...interface{}) error {
 }
 
 func (db *DB) QueryScan(query string, results []interface{}, args ...interface{}) error {
-	res, err := db.Query(query, args...)
+	return db.QueryScanContext(context.Background(), query, results, args...)
+}
+
+func (db *DB) QueryScanContext(ctx context.Context, query string, results []interface{}, args ...interface{}) error {
+	res, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return err
 	}
@@ -55,7 +292,11 @@ func (db *DB) QueryScan(query string, results []interface{}, args ...interface{}
 }
 
 func (db *DB) QueryUser(query string, results []interface{}, args ...interface{}) error {
-	err := db.QueryScan(query, results, args...)
+	return db.QueryUserContext(context.Background(), query, results, args...)
+}
+
+func (db *DB) QueryUserContext(ctx context.Context, query string, results []interface{}, args ...interface{}) error {
+	err := db.QueryScanContext(ctx, query, results, args...)
 	if err == sql.ErrNoRows {
 		return ErrUserNotFound
 	}
@@ -63,7 +304,11 @@ func (db *DB) QueryUser(query string, results []interface{}, args ...interface{}
 }
 
 func (db *DB) QueryIterate(query string, f func(rows *sql.Rows) error, args ...interface{}) error {
-	res, err := db.Query(query, args...)
+	return db.QueryIterateContext(context.Background(), query, f, args...)
+}
+
+func (db *DB) QueryIterateContext(ctx context.Context, query string, f func(rows *sql.Rows) error, args ...interface{}) error {
+	res, err := db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return err
 	}
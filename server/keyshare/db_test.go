@@ -0,0 +1,185 @@
+package keyshare
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/jackc/pgx"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsTransientError(t *testing.T) {
+	require.True(t, IsTransientError(&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}))
+	require.True(t, IsTransientError(errors.WrapPrefix(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, "connecting", 0)))
+	require.True(t, IsTransientError(driver.ErrBadConn))
+	require.True(t, IsTransientError(pgx.PgError{Code: "08006"}))
+	require.True(t, IsTransientError(pgx.PgError{Code: "57P01"}))
+
+	require.False(t, IsTransientError(pgx.PgError{Code: "23505"})) // unique violation
+	require.False(t, IsTransientError(sql.ErrNoRows))
+	require.False(t, IsTransientError(context.Canceled))
+}
+
+func TestIsUniqueViolation(t *testing.T) {
+	violation := pgx.PgError{Code: "23505", ConstraintName: "oidc_subject_index"}
+	require.True(t, IsUniqueViolation(violation, "oidc_subject_index"))
+	require.True(t, IsUniqueViolation(errors.WrapPrefix(violation, "AddUser", 0), "oidc_subject_index"))
+
+	require.False(t, IsUniqueViolation(violation, "username_index"))
+	require.False(t, IsUniqueViolation(pgx.PgError{Code: "08006"}, "oidc_subject_index"))
+	require.False(t, IsUniqueViolation(sql.ErrNoRows, "oidc_subject_index"))
+}
+
+func TestNotExecuted(t *testing.T) {
+	require.True(t, notExecuted(errors.WrapPrefix(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNRESET}, "connecting", 0)))
+	require.True(t, notExecuted(&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNREFUSED}))
+	require.True(t, notExecuted(driver.ErrBadConn))
+	require.True(t, notExecuted(pgx.PgError{Code: "57P03"}))
+	require.True(t, notExecuted(pgx.PgError{Code: "40001"}))
+
+	require.False(t, notExecuted(&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}))
+	require.False(t, notExecuted(&net.OpError{Op: "write", Net: "tcp", Err: syscall.EPIPE}))
+	require.False(t, notExecuted(pgx.PgError{Code: "08006"}))
+	require.False(t, notExecuted(pgx.PgError{Code: "57P01"}))
+
+	require.True(t, isSelect("\n\t\tselect 1"))
+	require.False(t, isSelect("DELETE FROM irma.email_verification_tokens RETURNING email"))
+	require.False(t, isSelect("WITH x AS (DELETE FROM y RETURNING z) SELECT z FROM x"))
+}
+
+func TestRetry(t *testing.T) {
+	defer func(delay time.Duration) { RetryBaseDelay = delay }(RetryBaseDelay)
+	RetryBaseDelay = time.Millisecond
+
+	connector := &flakyConnector{}
+	db := &DB{DB: sql.OpenDB(connector)}
+	defer func() { require.NoError(t, db.Close()) }()
+	db.SetMaxIdleConns(0) // connect for each query
+
+	// Connection failures are retried
+	connector.failures = int32(RetryAttempts)
+	require.NoError(t, db.ExecUser("UPDATE"))
+	require.Zero(t, db.FailingFor())
+
+	// Until the retries are exhausted
+	connector.failures = 100
+	require.Error(t, db.ExecUser("UPDATE"))
+	require.Equal(t, int32(100-RetryAttempts-1), connector.failures)
+	require.NotZero(t, db.FailingFor())
+
+	// When the database keeps failing, queries are no longer retried
+	time.Sleep(RetryBaseDelay<<uint(RetryAttempts) + 10*time.Millisecond)
+	connector.failures = 100
+	require.Error(t, db.ExecUser("UPDATE"))
+	require.Equal(t, int32(99), connector.failures)
+
+	// Until it recovers
+	connector.failures = 0
+	require.NoError(t, db.ExecUser("UPDATE"))
+	require.Zero(t, db.FailingFor())
+
+	// Statements that may have been executed before the connection broke are not retried,
+	// SELECT queries are
+	connector.execFailures = 1
+	require.Error(t, db.ExecUser("UPDATE"))
+	require.Zero(t, connector.execFailures)
+	connector.execFailures = 1
+	require.NoError(t, db.ExecUser("SELECT"))
+	require.Zero(t, connector.execFailures)
+}
+
+func TestOperation(t *testing.T) {
+	connector := &flakyConnector{}
+	db := &DB{DB: sql.OpenDB(connector)}
+	defer func() { require.NoError(t, db.Close()) }()
+	db.SetMaxIdleConns(0) // connect for each query, so that changes to connector.delay take effect
+
+	type report struct {
+		op  string
+		err error
+	}
+	var reports []report
+	db.Instrumentation = DBInstrumentation{
+		Timeout:       50 * time.Millisecond,
+		SlowThreshold: 10 * time.Millisecond,
+		OnOperation: func(op string, duration time.Duration, err error) {
+			reports = append(reports, report{op, err})
+		},
+	}
+	exec := func(op string) error {
+		ctx, done := db.Operation(context.Background(), op)
+		defer done()
+		return db.ExecUserContext(ctx, "UPDATE")
+	}
+
+	require.NoError(t, exec("fast"))
+
+	// Operations taking longer than the timeout are cancelled
+	connector.delay = time.Second
+	start := time.Now()
+	require.Error(t, exec("slow"))
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	require.Len(t, reports, 2)
+	require.Equal(t, report{"fast", nil}, reports[0])
+	require.Equal(t, "slow", reports[1].op)
+	require.Error(t, reports[1].err)
+}
+
+// flakyConnector fails to connect as many times as specified by failures, and then fails to
+// complete as many statements as specified by execFailures.
+type flakyConnector struct {
+	failures     int32
+	execFailures int32
+	// If set, statements take this long, unless their context is cancelled earlier
+	delay time.Duration
+}
+
+type flakyConn struct {
+	delay     time.Duration
+	connector *flakyConnector
+}
+
+func (c *flakyConnector) Connect(context.Context) (driver.Conn, error) {
+	if atomic.AddInt32(&c.failures, -1) >= 0 {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNRESET}
+	}
+	atomic.StoreInt32(&c.failures, 0)
+	return flakyConn{delay: c.delay, connector: c}, nil
+}
+
+func (c *flakyConnector) Driver() driver.Driver {
+	return nil
+}
+
+func (c flakyConn) ExecContext(ctx context.Context, _ string, _ []driver.NamedValue) (driver.Result, error) {
+	if atomic.AddInt32(&c.connector.execFailures, -1) >= 0 {
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	}
+	atomic.StoreInt32(&c.connector.execFailures, 0)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(c.delay):
+		return driver.RowsAffected(1), nil
+	}
+}
+
+func (flakyConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (flakyConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+func (flakyConn) Close() error {
+	return nil
+}
@@ -2,13 +2,22 @@ package keyshare
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"html/template"
+	"net/mail"
 	"net/smtp"
+	"sort"
+	"strings"
 
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago/server"
+	"golang.org/x/text/language"
 )
 
+// MaxLanguageLength is the maximum length of the language tags that are accepted from users.
+const MaxLanguageLength = 35
+
 type EmailConfiguration struct {
 	EmailServer     string `json:"email_server" mapstructure:"email_server"`
 	EmailFrom       string `json:"email_from" mapstructure:"email_from"`
@@ -16,6 +25,15 @@ type EmailConfiguration struct {
 	EmailAuth       smtp.Auth
 }
 
+// HashEmailToken returns the hash of an email verification token, under which it is stored in the
+// database. The token itself is not stored, so that the tokens of unverified email addresses do
+// not leak along with the database; since tokens are looked up by their hash, the timing of the
+// lookup reveals nothing about the tokens either.
+func HashEmailToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
 func ParseEmailTemplates(files, subjects map[string]string, defaultLanguage string) (map[string]*template.Template, error) {
 	if _, ok := files[defaultLanguage]; !ok {
 		return nil, errors.New("missing email file for default language")
@@ -36,6 +54,37 @@ func ParseEmailTemplates(files, subjects map[string]string, defaultLanguage stri
 	return templates, nil
 }
 
+// parseLanguage parses lang as a BCP 47 language tag, also accepting POSIX locales such as
+// en_US.UTF-8, and returns it in lowercase. It returns the empty string if lang is empty, malformed,
+// undetermined, or longer than MaxLanguageLength after normalization.
+func parseLanguage(lang string) string {
+	if len(lang) > 4*MaxLanguageLength {
+		return ""
+	}
+	if i := strings.IndexAny(lang, ".@"); i >= 0 {
+		lang = lang[:i] // strip POSIX encoding and modifier
+	}
+	tag, err := language.Parse(strings.ReplaceAll(lang, "_", "-"))
+	if err != nil || tag == language.Und {
+		return ""
+	}
+	normalized := strings.ToLower(tag.String())
+	if len(normalized) > MaxLanguageLength {
+		return ""
+	}
+	return normalized
+}
+
+// NormalizeLanguage returns lang as a lowercase BCP 47 language tag, or the default language if lang
+// is not a valid language tag. Languages received from users should be normalized before they are
+// stored or used.
+func (conf EmailConfiguration) NormalizeLanguage(lang string) string {
+	if normalized := parseLanguage(lang); normalized != "" {
+		return normalized
+	}
+	return conf.DefaultLanguage
+}
+
 func (conf EmailConfiguration) TranslateString(strings map[string]string, lang string) string {
 	s, ok := strings[lang]
 	if ok {
@@ -43,7 +92,36 @@ func (conf EmailConfiguration) TranslateString(strings map[string]string, lang s
 	}
 	server.Logger.WithField("lang", lang).
 		Warn("email string translation requested for unknown language, falling back to default")
-	return strings[conf.DefaultLanguage]
+	return strings[conf.Language(strings, lang)]
+}
+
+// Language negotiates the language of a translation: it returns the first of the given languages
+// that translations contains, trying each language also without its region (e.g. nl for nl-NL), or
+// else the default language, or else English. The given languages are normalized first.
+func (conf EmailConfiguration) Language(translations map[string]string, langs ...string) string {
+	return conf.negotiateLanguage(func(lang string) bool {
+		_, ok := translations[lang]
+		return ok
+	}, langs)
+}
+
+func (conf EmailConfiguration) negotiateLanguage(available func(string) bool, langs []string) string {
+	for _, lang := range langs {
+		lang = parseLanguage(lang)
+		if lang == "" {
+			continue
+		}
+		if available(lang) {
+			return lang
+		}
+		if i := strings.IndexByte(lang, '-'); i > 0 && available(lang[:i]) {
+			return lang[:i]
+		}
+	}
+	if available(conf.DefaultLanguage) {
+		return conf.DefaultLanguage
+	}
+	return "en"
 }
 
 func (conf EmailConfiguration) translateTemplate(templates map[string]*template.Template, lang string) *template.Template {
@@ -53,7 +131,10 @@ func (conf EmailConfiguration) translateTemplate(templates map[string]*template.
 	}
 	server.Logger.WithField("lang", lang).
 		Warn("email template translation requested for unknown language, falling back to default")
-	return templates[conf.DefaultLanguage]
+	return templates[conf.negotiateLanguage(func(lang string) bool {
+		_, ok := templates[lang]
+		return ok
+	}, []string{lang})]
 }
 
 func (conf EmailConfiguration) SendEmail(
@@ -62,6 +143,19 @@ func (conf EmailConfiguration) SendEmail(
 	templateData map[string]string,
 	email string,
 	lang string,
+) error {
+	return conf.SendEmailWithHeaders(templates, subjects, templateData, email, lang, nil)
+}
+
+// SendEmailWithHeaders sends an email like SendEmail, including the specified additional headers
+// (e.g. List-Unsubscribe).
+func (conf EmailConfiguration) SendEmailWithHeaders(
+	templates map[string]*template.Template,
+	subjects map[string]string,
+	templateData map[string]string,
+	email string,
+	lang string,
+	headers map[string]string,
 ) error {
 	var msg bytes.Buffer
 	err := conf.translateTemplate(templates, lang).Execute(&msg, templateData)
@@ -76,6 +170,7 @@ func (conf EmailConfiguration) SendEmail(
 		conf.EmailFrom,
 		email,
 		conf.TranslateString(subjects, lang),
+		headers,
 		msg.Bytes(),
 	)
 	if err != nil {
@@ -106,12 +201,42 @@ func (conf EmailConfiguration) VerifyEmailServer() error {
 	return nil
 }
 
-func sendHTMLEmail(addr string, a smtp.Auth, from, to, subject string, msg []byte) error {
-	headers := []byte("To: " + to + "\r\n" +
+// ValidEmailAddress returns whether email is a bare email address (e.g. without display name).
+func ValidEmailAddress(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+func sendHTMLEmail(addr string, a smtp.Auth, from, to, subject string, headers map[string]string, msg []byte) error {
+	email, err := htmlEmail(from, to, subject, headers, msg)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(addr, a, from, []string{to}, email)
+}
+
+// htmlEmail returns the email containing the HTML message, with the specified additional headers
+// in alphabetical order.
+func htmlEmail(from, to, subject string, headers map[string]string, msg []byte) ([]byte, error) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var email bytes.Buffer
+	email.WriteString("To: " + to + "\r\n" +
 		"From: " + from + "\r\n" +
-		"Subject: " + subject + "\r\n" +
-		"Content-Type: text/html; charset=UTF-8\r\n" +
+		"Subject: " + subject + "\r\n")
+	for _, name := range names {
+		if strings.ContainsAny(name+headers[name], "\r\n") {
+			return nil, errors.Errorf("invalid email header %s", name)
+		}
+		email.WriteString(name + ": " + headers[name] + "\r\n")
+	}
+	email.WriteString("Content-Type: text/html; charset=UTF-8\r\n" +
 		"Content-Transfer-Encoding: binary\r\n" +
 		"\r\n")
-	return smtp.SendMail(addr, a, from, []string{to}, append(headers, msg...))
+	email.Write(msg)
+	return email.Bytes(), nil
 }
@@ -3,6 +3,7 @@ package keyshare
 import (
 	"bytes"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/privacybydesign/irmago/internal/test"
@@ -46,3 +47,56 @@ func TestParseEmailTemplates(t *testing.T) {
 	require.NoError(t, templ[lang].Execute(&msg, map[string]string{"VerificationURL": "123"}))
 	require.Equal(t, "This is a test template 123", msg.String())
 }
+
+func TestHTMLEmail(t *testing.T) {
+	email, err := htmlEmail("from@example.com", "to@example.com", "subject", map[string]string{
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		"List-Unsubscribe":      "<https://example.com/unsubscribe>",
+	}, []byte("<p>message</p>"))
+	require.NoError(t, err)
+	require.Equal(t, "To: to@example.com\r\n"+
+		"From: from@example.com\r\n"+
+		"Subject: subject\r\n"+
+		"List-Unsubscribe: <https://example.com/unsubscribe>\r\n"+
+		"List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n"+
+		"Content-Type: text/html; charset=UTF-8\r\n"+
+		"Content-Transfer-Encoding: binary\r\n"+
+		"\r\n"+
+		"<p>message</p>", string(email))
+
+	_, err = htmlEmail("from@example.com", "to@example.com", "subject",
+		map[string]string{"List-Unsubscribe": "<https://example.com>\r\nBcc: other@example.com"}, nil)
+	require.Error(t, err)
+}
+
+func TestValidEmailAddress(t *testing.T) {
+	require.True(t, ValidEmailAddress("test@example.com"))
+	require.False(t, ValidEmailAddress(""))
+	require.False(t, ValidEmailAddress("test"))
+	require.False(t, ValidEmailAddress("Test <test@example.com>"))
+	require.False(t, ValidEmailAddress("test@example.com\r\nBcc: other@example.com"))
+}
+
+func TestNormalizeLanguage(t *testing.T) {
+	conf := EmailConfiguration{DefaultLanguage: "en"}
+	require.Equal(t, "nl", conf.NormalizeLanguage("nl"))
+	require.Equal(t, "en-us", conf.NormalizeLanguage("EN-us"))
+	require.Equal(t, "en-us", conf.NormalizeLanguage("en_US.UTF-8"))
+	require.Equal(t, "de-de", conf.NormalizeLanguage("de_DE@euro"))
+	require.Equal(t, "en", conf.NormalizeLanguage(""))
+	require.Equal(t, "en", conf.NormalizeLanguage("😀"))
+	require.Equal(t, "en", conf.NormalizeLanguage("und"))
+	require.Equal(t, "en", conf.NormalizeLanguage("nonexistinglanguage"))
+	require.Equal(t, "en", conf.NormalizeLanguage(strings.Repeat("a-", 100)+"a"))
+	require.Equal(t, "en", conf.NormalizeLanguage("en-"+strings.Repeat("x-abcdefgh-", 3)))
+}
+
+func TestLanguage(t *testing.T) {
+	conf := EmailConfiguration{DefaultLanguage: "nl"}
+	translations := map[string]string{"en": "Hello", "nl": "Hallo"}
+	require.Equal(t, "en", conf.Language(translations, "fr", "en-GB"))
+	require.Equal(t, "en", conf.Language(translations, "EN_us.UTF-8"))
+	require.Equal(t, "nl", conf.Language(translations, "😀", ""))
+	require.Equal(t, "Hello", conf.TranslateString(translations, "en_GB.UTF-8"))
+	require.Equal(t, "Hallo", conf.TranslateString(translations, strings.Repeat("en", 100)))
+}
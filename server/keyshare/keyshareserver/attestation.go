@@ -0,0 +1,56 @@
+package keyshareserver
+
+import (
+	"net/http"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// RegistrationAttestor verifies platform attestation tokens, which apps obtain from the attestation
+// service of their platform (e.g. Play Integrity on Android, App Attest on iOS) and include in their
+// registration at the keyshare server, to prove that they run unmodified on a genuine device.
+// Implementations for these services are available in the subpackages of server/keyshare/attestation,
+// which are only built with the build tag of the service, to avoid their dependencies by default.
+type RegistrationAttestor interface {
+	// Verify returns an error if the token is not a valid attestation for the specified platform,
+	// both as supplied by the app (see irma.KeyshareEnrollment).
+	Verify(token string, platform string) error
+}
+
+// PlatformAttestors is a RegistrationAttestor that verifies tokens using the attestor of their
+// platform, refusing tokens of other platforms.
+type PlatformAttestors map[string]RegistrationAttestor
+
+func (a PlatformAttestors) Verify(token string, platform string) error {
+	attestor, ok := a[platform]
+	if !ok {
+		return errors.Errorf("Unsupported attestation platform %q", platform)
+	}
+	return attestor.Verify(token, platform)
+}
+
+// verifyAttestation verifies the attestation token of the enrollment, if present or required,
+// writing an error and returning false if it is missing or invalid.
+func (s *Server) verifyAttestation(w http.ResponseWriter, msg irma.KeyshareEnrollment) bool {
+	if s.conf.RegistrationAttestor == nil {
+		return true
+	}
+	if msg.AttestationToken == "" {
+		if s.conf.RequireRegistrationAttestation && msg.RecoveryToken == "" {
+			s.conf.Logger.Info("Enrollment without attestation token")
+			server.WriteError(w, server.ErrorAttestationFailed, "attestation token required")
+			return false
+		}
+		return true
+	}
+	if err := s.conf.RegistrationAttestor.Verify(msg.AttestationToken, msg.AttestationPlatform); err != nil {
+		s.conf.Logger.WithFields(logrus.Fields{"platform": msg.AttestationPlatform, "error": err}).
+			Info("Enrollment with invalid attestation token")
+		server.WriteError(w, server.ErrorAttestationFailed, err.Error())
+		return false
+	}
+	return true
+}
@@ -1,10 +1,16 @@
 package keyshareserver
 
 import (
+	"crypto/ecdsa"
+	"encoding/base64"
 	"encoding/binary"
+	"fmt"
 	"html/template"
 	"io/ioutil"
+	"net/url"
+	"path"
 	"strings"
+	"time"
 
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/common"
@@ -13,7 +19,9 @@ import (
 
 	"github.com/go-errors/errors"
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/privacybydesign/gabi/signed"
 	"github.com/privacybydesign/irmago/server"
+	"golang.org/x/crypto/curve25519"
 )
 
 type DBType string
@@ -25,30 +33,66 @@ const (
 	DBTypePostgres DBType = "postgres"
 )
 
+const (
+	EmailTokenValidityDefault    = 24    // hours
+	RecoveryTokenValidityDefault = 90    // days
+	DBFailureThresholdDefault    = 10    // seconds
+	DBTimeoutDefault             = 10000 // milliseconds
+	DBSlowThresholdDefault       = 1000  // milliseconds
+
+	minSessionLogRetention = 2 // days
+)
+
 // Configuration contains configuration for the irmaserver library and irmad.
 type Configuration struct {
 	// IRMA server configuration
 	*server.Configuration `mapstructure:",squash"`
 
+	// Path under which the keyshare server is reachable, e.g. /keyshare if a reverse proxy forwards
+	// https://example.com/keyshare/ to it (in which case URL is https://example.com). The prefix is
+	// appended to URL and to verification URLs that are paths, and Handler() serves its endpoints
+	// both with and without the prefix, so that it does not matter whether the proxy strips it.
+	PathPrefix string `json:"path_prefix" mapstructure:"path_prefix"`
+	// URL including PathPrefix, against which verification URLs that are paths are resolved
+	baseURL string
+
 	// Database configuration (ignored when database is provided)
 	DBType    DBType `json:"db_type" mapstructure:"db_type"`
 	DBConnStr string `json:"db_str" mapstructure:"db_str"`
 	// Provide a prepared database (useful for testing)
 	DB DB `json:"-"`
+	// Amount of seconds that database queries may fail with transient errors (after retrying them)
+	// before /api/ready reports the server as unavailable (default value 0 means 10)
+	DBFailureThreshold int `json:"db_failure_threshold" mapstructure:"db_failure_threshold"`
+	// Report the server as ready at /api/ready even when some Idemix public keys failed to load (see
+	// /admin/keys). By default it is reported unavailable until the keys are fixed and reloaded.
+	ReadyIgnoresKeyFailures bool `json:"ready_ignores_key_failures" mapstructure:"ready_ignores_key_failures"`
+	// Amount of milliseconds after which database operations are cancelled (default value 0 means 10000)
+	DBTimeout int `json:"db_timeout" mapstructure:"db_timeout"`
+	// Database operations taking longer than this amount of milliseconds are logged as slow, with their
+	// name and duration (default value 0 means 1000)
+	DBSlowThreshold int `json:"db_slow_threshold" mapstructure:"db_slow_threshold"`
 
 	// Configuration of secure Core
 	// Private key used to sign JWTs with
 	JwtKeyID          uint32 `json:"jwt_key_id" mapstructure:"jwt_key_id"`
 	JwtIssuer         string `json:"jwt_issuer" mapstructure:"jwt_issuer"`
+	JwtAudience       string `json:"jwt_audience" mapstructure:"jwt_audience"`
 	JwtPinExpiry      int    `json:"jwt_pin_expiry" mapstructure:"jwt_pin_expiry"`
 	JwtPrivateKey     string `json:"jwt_privkey" mapstructure:"jwt_privkey"`
 	JwtPrivateKeyFile string `json:"jwt_privkey_file" mapstructure:"jwt_privkey_file"`
+	// Accept PIN access tokens lacking the iss or aud claims, e.g. while migrating to a new jwt_audience
+	JwtAcceptMissingClaims bool `json:"jwt_accept_missing_claims" mapstructure:"jwt_accept_missing_claims"`
 	// Decryption keys used for user secrets
 	StorageFallbackKeyFiles []string `json:"storage_fallback_key_files" mapstructure:"storage_fallback_key_files"`
 	StoragePrimaryKeyFile   string   `json:"storage_primary_key_file" mapstructure:"storage_primary_key_file"`
 
 	// Keyshare attribute to issue during registration
 	KeyshareAttribute irma.AttributeTypeIdentifier `json:"keyshare_attribute" mapstructure:"keyshare_attribute"`
+	// Keyshare attributes in order of priority, instead of KeyshareAttribute: the first one is issued
+	// during registration, while all of them are accepted as keyshare credential (e.g. during a scheme
+	// migration). If KeyshareAttribute is also specified, it must be the first one.
+	KeyshareAttributes []irma.AttributeTypeIdentifier `json:"keyshare_attributes" mapstructure:"keyshare_attributes"`
 
 	// Configuration for email sending during registration (email address use will be disabled if not present)
 	keyshare.EmailConfiguration `mapstructure:",squash"`
@@ -58,6 +102,106 @@ type Configuration struct {
 	registrationEmailTemplates map[string]*template.Template
 
 	VerificationURL map[string]string `json:"verification_url" mapstructure:"verification_url"`
+	// Amount of hours that email verification tokens are valid (default value 0 means 24)
+	EmailTokenValidity int `json:"email_token_validity" mapstructure:"email_token_validity"`
+
+	// Amount of days that recovery tokens, with which users re-enroll to their existing account after
+	// losing their device, are valid (default value 0 means 90)
+	RecoveryTokenValidity int `json:"recovery_token_validity" mapstructure:"recovery_token_validity"`
+
+	// Amount of days that log entries of the specified event types are kept, after which they are
+	// deleted (e.g. IRMA_SESSION: 30, PIN_CHECK_BLOCKED: 365). Entries of event types that are not
+	// listed are kept indefinitely, unless another type is listed, in which case entries of event
+	// types unknown to this version are deleted along with those of the shortest period. Keyshare
+	// sessions (IRMA_SESSION) must be kept at least 2 days, so that they are included in the usage
+	// statistics; rebuilding the usage statistics only works for days whose sessions are still kept.
+	LogRetention map[LogEventType]int `json:"log_retention" mapstructure:"log_retention"`
+
+	// Announcement to clients that the current keyshare protocol will no longer be supported, sent in
+	// the Deprecation and Sunset response headers and in /api/version. Dates are in RFC 3339 format.
+	DeprecationDate string            `json:"deprecation_date" mapstructure:"deprecation_date"`
+	SunsetDate      string            `json:"sunset_date" mapstructure:"sunset_date"`
+	VersionMessage  map[string]string `json:"version_message" mapstructure:"version_message"`
+	deprecation     *time.Time
+	sunset          *time.Time
+
+	// Maintenance window announced in /api/status (see irma.KeyshareStatus), during which the status
+	// is "maintenance", so that apps can show the translated message instead of errors when the server
+	// cannot be reached. Either date may be omitted (e.g. only the start, until the announcement is
+	// removed). Dates are in RFC 3339 format. Also announced is the minimum supported app version.
+	MaintenanceStart   string            `json:"maintenance_start" mapstructure:"maintenance_start"`
+	MaintenanceEnd     string            `json:"maintenance_end" mapstructure:"maintenance_end"`
+	MaintenanceMessage map[string]string `json:"maintenance_message" mapstructure:"maintenance_message"`
+	MinAppVersion      string            `json:"min_app_version" mapstructure:"min_app_version"`
+	maintenanceStart   *time.Time
+	maintenanceEnd     *time.Time
+
+	// OpenID Connect provider at which users must authenticate when registering, binding their account
+	// to their identity at the provider so that it can be recovered on a new device using /client/recover.
+	// If no issuer is configured, registration is anonymous.
+	OIDCIssuer string `json:"oidc_issuer" mapstructure:"oidc_issuer"`
+	// Required audience of ID tokens, i.e. the client ID of the app at the provider
+	OIDCAudience string `json:"oidc_audience" mapstructure:"oidc_audience"`
+	// Claims that ID tokens must contain, with their required values (e.g. email_verified: true)
+	OIDCRequiredClaims map[string]string `json:"oidc_required_claims" mapstructure:"oidc_required_claims"`
+	// URL of the JSON Web Key Set of the provider (default: the jwks_uri from its discovery document)
+	OIDCJWKSURL string `json:"oidc_jwks_url" mapstructure:"oidc_jwks_url"`
+	oidc        *oidcVerifier
+
+	// Verifies the platform attestation tokens (e.g. from Play Integrity or App Attest) that apps may
+	// include in registrations, with which they prove to run unmodified on a genuine device. Tokens
+	// are verified whenever present. If RequireRegistrationAttestation is set, registrations of new
+	// accounts without a token are refused; re-enrollments using a recovery token are not affected.
+	RegistrationAttestor           RegistrationAttestor `json:"-"`
+	RequireRegistrationAttestation bool                 `json:"require_registration_attestation" mapstructure:"require_registration_attestation"`
+
+	// Token with which operators can access the administration endpoints (/admin/...), to be sent
+	// in the Authorization header. If empty, the administration endpoints are disabled.
+	AdminToken string `json:"admin_token" mapstructure:"admin_token"`
+
+	// If set, PIN verifications and changes for unknown users result in a synthetic PIN failure status
+	// instead of server.ErrorUserNotRegistered, so that they do not reveal which usernames exist. This
+	// only applies to clients using keyshare protocol version 4 or higher; see server.ErrorUserNotRegistered.
+	// The descriptions of synthetic PIN statuses are in the requested or else the default language, as
+	// unknown users have no language, so clients should request a language to be indistinguishable.
+	UniformPinResponses bool `json:"uniform_pin_responses" mapstructure:"uniform_pin_responses"`
+	// Key (at least 32 bytes, base64 encoded) from which the synthetic PIN attempts of unknown users are
+	// derived. All instances of the keyshare server should use the same key, so that their responses
+	// for a username do not differ. If not set, each instance uses a random key, which changes on restart.
+	UniformPinResponsesKey     string `json:"uniform_pin_responses_key" mapstructure:"uniform_pin_responses_key"`
+	UniformPinResponsesKeyFile string `json:"uniform_pin_responses_key_file" mapstructure:"uniform_pin_responses_key_file"`
+	uniformPinResponsesKey     []byte
+
+	// X25519 private key (32 bytes, base64 encoded) to which clients using keyshare protocol version 5
+	// or higher encrypt the bodies of requests containing a PIN. Its public key is published, signed
+	// with the JWT key, at /api/pinkey. If not set, PINs are sent unencrypted (but over TLS).
+	PinEncryptionKey     string `json:"pin_encryption_key" mapstructure:"pin_encryption_key"`
+	PinEncryptionKeyFile string `json:"pin_encryption_key_file" mapstructure:"pin_encryption_key_file"`
+	pinEncryptionKey     []byte
+	// If set, unencrypted PINs are refused, so that clients using keyshare protocol versions older
+	// than 5 can no longer be used. Requires a PIN encryption key.
+	DisablePlaintextPins bool `json:"disable_plaintext_pins" mapstructure:"disable_plaintext_pins"`
+
+	// Files containing the PEM encoded public keys with which the specified schemes must be signed,
+	// so that a compromised scheme distribution point cannot push other issuer public keys. Schemes
+	// signed with another key fail to load, and updates to them are rejected.
+	PinnedSchemeKeyFiles map[irma.SchemeManagerIdentifier]string `json:"pinned_scheme_key_files" mapstructure:"pinned_scheme_key_files"`
+	// Issuers whose public keys are loaded into the keyshare core. If empty, the keys of all issuers
+	// in the IRMA configuration are loaded.
+	TrustedIssuers []irma.IssuerIdentifier `json:"trusted_issuers" mapstructure:"trusted_issuers"`
+	trustedIssuers map[irma.IssuerIdentifier]struct{}
+
+	// File to which the error reports that clients send to /api/report are appended as JSON lines.
+	// If not set, the reports are logged. Alternatively, ErrorReportSink stores them elsewhere.
+	ErrorReportFile string          `json:"error_report_file" mapstructure:"error_report_file"`
+	ErrorReportSink ErrorReportSink `json:"-"`
+
+	// If set, the server starts in read-only maintenance mode, e.g. during database migrations, in
+	// which registrations, recoveries, PIN changes, email verifications and changes to devices are
+	// refused with server.ErrorReadOnly, while PIN verifications and keyshare sessions keep working.
+	// Failures to record their activity are then logged as warnings. The mode can be switched at
+	// runtime at /admin/read-only, and is announced in /api/status.
+	ReadOnly bool `json:"read_only" mapstructure:"read_only"`
 }
 
 func readAESKey(filename string) (uint32, keysharecore.AESKey, error) {
@@ -76,6 +220,155 @@ func readAESKey(filename string) (uint32, keysharecore.AESKey, error) {
 // Process a passed configuration to ensure all field values are valid and initialized
 // as required by the rest of this keyshare server component.
 func validateConf(conf *Configuration) error {
+	// Setup IRMA session server url for in QR code
+	var err error
+	if conf.PathPrefix, err = parsePathPrefix(conf.PathPrefix); err != nil {
+		return server.LogError(err)
+	}
+	conf.baseURL = strings.TrimSuffix(conf.URL, "/") + conf.PathPrefix
+	conf.URL = conf.baseURL + "/irma/"
+
+	if conf.PinEncryptionKey != "" || conf.PinEncryptionKeyFile != "" {
+		keybytes, err := common.ReadKey(conf.PinEncryptionKey, conf.PinEncryptionKeyFile)
+		if err != nil {
+			return server.LogError(errors.WrapPrefix(err, "failed to read PIN encryption key", 0))
+		}
+		conf.pinEncryptionKey, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(keybytes)))
+		if err != nil || len(conf.pinEncryptionKey) != curve25519.ScalarSize {
+			return server.LogError(errors.Errorf("PIN encryption key must consist of %d base64 encoded bytes", curve25519.ScalarSize))
+		}
+	}
+
+	if conf.UniformPinResponsesKey != "" || conf.UniformPinResponsesKeyFile != "" {
+		keybytes, err := common.ReadKey(conf.UniformPinResponsesKey, conf.UniformPinResponsesKeyFile)
+		if err != nil {
+			return server.LogError(errors.WrapPrefix(err, "failed to read uniform PIN responses key", 0))
+		}
+		conf.uniformPinResponsesKey, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(keybytes)))
+		if err != nil || len(conf.uniformPinResponsesKey) < 32 {
+			return server.LogError(errors.New("uniform PIN responses key must consist of at least 32 base64 encoded bytes"))
+		}
+	} else if conf.UniformPinResponses {
+		conf.Logger.Warn("No uniform PIN responses key configured, using a random key: the synthetic PIN attempts of unknown users differ between instances and restarts")
+	}
+
+	if err = validateReloadableConf(conf); err != nil {
+		return err
+	}
+
+	if conf.OIDCIssuer != "" {
+		if conf.OIDCAudience == "" {
+			return server.LogError(errors.Errorf("OpenID Connect audience required when an issuer is configured"))
+		}
+		conf.oidc = newOIDCVerifier(conf)
+	}
+	if conf.RequireRegistrationAttestation && conf.RegistrationAttestor == nil {
+		return server.LogError(errors.Errorf("Requiring registration attestation requires a registration attestor"))
+	}
+
+	if err = conf.processKeyshareAttributes(); err != nil {
+		return server.LogError(err)
+	}
+	if err = conf.validateKeyshareScheme(); err != nil {
+		return server.LogError(err)
+	}
+	_, err = conf.IrmaConfiguration.PrivateKeys.Latest(conf.KeyshareAttribute.CredentialTypeIdentifier().IssuerIdentifier())
+	if err != nil {
+		return server.LogError(errors.Errorf("Failed to load private key of keyshare attribute: %v", err))
+	}
+
+	for scheme := range conf.PinnedSchemeKeyFiles {
+		if conf.IrmaConfiguration.SchemeManagers[scheme] == nil {
+			return server.LogError(errors.Errorf("Unknown scheme with pinned key: %s", scheme))
+		}
+	}
+	if conf.ErrorReportSink == nil {
+		if conf.ErrorReportFile != "" {
+			conf.ErrorReportSink = &FileErrorReportSink{Path: conf.ErrorReportFile}
+		} else {
+			conf.ErrorReportSink = logErrorReportSink{logger: conf.Logger}
+		}
+	}
+	if len(conf.TrustedIssuers) > 0 {
+		conf.trustedIssuers = map[irma.IssuerIdentifier]struct{}{}
+		for _, issuer := range conf.TrustedIssuers {
+			if conf.IrmaConfiguration.Issuers[issuer] == nil {
+				return server.LogError(errors.Errorf("Unknown trusted issuer: %s", issuer))
+			}
+			conf.trustedIssuers[issuer] = struct{}{}
+		}
+	}
+
+	return nil
+}
+
+// keyshareAttributes returns the keyshare attributes, taking into account both KeyshareAttribute
+// and KeyshareAttributes.
+func (conf *Configuration) keyshareAttributes() []irma.AttributeTypeIdentifier {
+	if len(conf.KeyshareAttributes) == 0 && !conf.KeyshareAttribute.Empty() {
+		return []irma.AttributeTypeIdentifier{conf.KeyshareAttribute}
+	}
+	return conf.KeyshareAttributes
+}
+
+// processKeyshareAttributes validates the keyshare attributes, and sets KeyshareAttribute to the
+// primary one and KeyshareAttributes to all of them.
+func (conf *Configuration) processKeyshareAttributes() error {
+	if len(conf.KeyshareAttributes) > 0 && !conf.KeyshareAttribute.Empty() && conf.KeyshareAttribute != conf.KeyshareAttributes[0] {
+		return errors.Errorf("Keyshare attribute %s must be the first of the keyshare attributes", conf.KeyshareAttribute)
+	}
+	conf.KeyshareAttributes = conf.keyshareAttributes()
+	if len(conf.KeyshareAttributes) == 0 {
+		return errors.New("Missing keyshare attribute")
+	}
+	conf.KeyshareAttribute = conf.KeyshareAttributes[0]
+
+	scheme := conf.KeyshareAttribute.CredentialTypeIdentifier().IssuerIdentifier().SchemeManagerIdentifier()
+	for _, attr := range conf.KeyshareAttributes {
+		if conf.IrmaConfiguration.AttributeTypes[attr] == nil {
+			return errors.Errorf("Unknown keyshare attribute: %s", attr)
+		}
+		if s := attr.CredentialTypeIdentifier().IssuerIdentifier().SchemeManagerIdentifier(); s != scheme {
+			return errors.Errorf("Keyshare attribute %s does not belong to scheme %s", attr, scheme)
+		}
+	}
+	return nil
+}
+
+// validateKeyshareScheme checks that the scheme of the keyshare attributes is distributed and uses
+// this keyshare server (if its URL is configured), and that the credential type of the (primary)
+// keyshare attribute contains no other attributes, so that the server can issue it.
+func (conf *Configuration) validateKeyshareScheme() error {
+	schemeID := conf.KeyshareAttribute.CredentialTypeIdentifier().IssuerIdentifier().SchemeManagerIdentifier()
+	scheme := conf.IrmaConfiguration.SchemeManagers[schemeID]
+	if !scheme.Distributed() {
+		return errors.Errorf("Scheme %s of keyshare attribute %s is not distributed: "+
+			"its description.xml must specify the URL of this keyshare server in <KeyshareServer>", schemeID, conf.KeyshareAttribute)
+	}
+
+	// The keyshare server URL of the scheme must be (a prefix of) the URL of this server
+	schemeURL := strings.TrimSuffix(scheme.KeyshareServer, "/")
+	if u, err := url.Parse(conf.baseURL); err == nil && u.IsAbs() && !strings.HasPrefix(conf.baseURL+"/", schemeURL+"/") {
+		return errors.Errorf("Keyshare server URL %s of scheme %s does not match the URL of this keyshare server %s: "+
+			"configure url (and path_prefix) such that clients of the scheme reach this server", schemeURL, schemeID, conf.baseURL)
+	}
+
+	credTypeID := conf.KeyshareAttribute.CredentialTypeIdentifier()
+	var others []string
+	for _, attr := range conf.IrmaConfiguration.CredentialTypes[credTypeID].AttributeTypes {
+		if attr.ID != conf.KeyshareAttribute.Name() && !attr.RevocationAttribute {
+			others = append(others, attr.ID)
+		}
+	}
+	if len(others) > 0 {
+		return errors.Errorf("Credential type %s of keyshare attribute %s contains other attributes (%s) which the keyshare server cannot issue: "+
+			"configure an attribute of a credential type containing only that attribute", credTypeID, conf.KeyshareAttribute, strings.Join(others, ", "))
+	}
+	return nil
+}
+
+// validateReloadableConf processes the settings that can be changed by Server.ReloadConfig.
+func validateReloadableConf(conf *Configuration) error {
 	// Setup email templates
 	var err error
 	if conf.EmailServer != "" {
@@ -95,24 +388,121 @@ func validateConf(conf *Configuration) error {
 	if err = conf.VerifyEmailServer(); err != nil {
 		return server.LogError(err)
 	}
+	if conf.EmailTokenValidity == 0 {
+		conf.EmailTokenValidity = EmailTokenValidityDefault
+	}
+	if conf.RecoveryTokenValidity == 0 {
+		conf.RecoveryTokenValidity = RecoveryTokenValidityDefault
+	}
+	if conf.DBFailureThreshold == 0 {
+		conf.DBFailureThreshold = DBFailureThresholdDefault
+	}
+	if conf.DBTimeout == 0 {
+		conf.DBTimeout = DBTimeoutDefault
+	}
+	if conf.DBSlowThreshold == 0 {
+		conf.DBSlowThreshold = DBSlowThresholdDefault
+	}
 
-	if conf.IrmaConfiguration.AttributeTypes[conf.KeyshareAttribute] == nil {
-		return server.LogError(errors.Errorf("Unknown keyshare attribute: %s", conf.KeyshareAttribute))
+	for eventType, days := range conf.LogRetention {
+		if !validLogEventType(eventType) {
+			return server.LogError(errors.Errorf("Unknown log event type %s in log retention", eventType))
+		}
+		if days < 1 {
+			return server.LogError(errors.Errorf("Log retention of %s must be at least 1 day", eventType))
+		}
+		if eventType == LogEventIRMASession && days < minSessionLogRetention {
+			return server.LogError(errors.Errorf("Log retention of %s must be at least %d days, for the usage statistics", eventType, minSessionLogRetention))
+		}
 	}
-	_, err = conf.IrmaConfiguration.PrivateKeys.Latest(conf.KeyshareAttribute.CredentialTypeIdentifier().IssuerIdentifier())
-	if err != nil {
-		return server.LogError(errors.Errorf("Failed to load private key of keyshare attribute: %v", err))
+
+	// Resolve verification URLs that are paths
+	for lang, u := range conf.VerificationURL {
+		if strings.HasPrefix(u, "/") {
+			conf.VerificationURL[lang] = conf.baseURL + u
+		}
 	}
 
-	// Setup IRMA session server url for in QR code
-	if !strings.HasSuffix(conf.URL, "/") {
-		conf.URL += "/"
+	if conf.deprecation, err = parseDate(conf.DeprecationDate); err != nil {
+		return server.LogError(errors.Errorf("Failed to parse deprecation date: %v", err))
+	}
+	if conf.sunset, err = parseDate(conf.SunsetDate); err != nil {
+		return server.LogError(errors.Errorf("Failed to parse sunset date: %v", err))
+	}
+	if conf.maintenanceStart, err = parseDate(conf.MaintenanceStart); err != nil {
+		return server.LogError(errors.Errorf("Failed to parse maintenance start: %v", err))
+	}
+	if conf.maintenanceEnd, err = parseDate(conf.MaintenanceEnd); err != nil {
+		return server.LogError(errors.Errorf("Failed to parse maintenance end: %v", err))
+	}
+	if conf.maintenanceStart != nil && conf.maintenanceEnd != nil && !conf.maintenanceEnd.After(*conf.maintenanceStart) {
+		return server.LogError(errors.Errorf("Maintenance end must be after maintenance start"))
+	}
+	if len(conf.MaintenanceMessage) > 0 && conf.maintenanceStart == nil && conf.maintenanceEnd == nil {
+		return server.LogError(errors.Errorf("Maintenance message requires a maintenance start or end"))
+	}
+
+	if conf.DisablePlaintextPins && conf.pinEncryptionKey == nil {
+		return server.LogError(errors.Errorf("Disabling plaintext PINs requires a PIN encryption key"))
 	}
-	conf.URL += "irma/"
 
 	return nil
 }
 
+// parsePathPrefix checks that the prefix is an absolute, clean path, and returns it without
+// trailing slash (so that the root path results in the empty prefix).
+func parsePathPrefix(prefix string) (string, error) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(prefix, "/") || path.Clean(prefix) != prefix || strings.ContainsAny(prefix, "?#%") {
+		return "", errors.Errorf("Invalid path prefix %q: must be an absolute path without query or fragment", prefix)
+	}
+	return prefix, nil
+}
+
+// readPinnedSchemeKeys reads the public keys in PinnedSchemeKeyFiles into the IRMA server configuration,
+// so that they are enforced when the schemes are parsed and updated.
+func readPinnedSchemeKeys(conf *Configuration) error {
+	if len(conf.PinnedSchemeKeyFiles) == 0 {
+		return nil
+	}
+	if conf.IrmaConfiguration != nil {
+		return server.LogError(errors.Errorf("Pinned scheme keys cannot be used with an already parsed IRMA configuration"))
+	}
+	conf.PinnedSchemeKeys = map[irma.SchemeManagerIdentifier]*ecdsa.PublicKey{}
+	for scheme, file := range conf.PinnedSchemeKeyFiles {
+		bts, err := ioutil.ReadFile(file)
+		if err != nil {
+			return server.LogError(errors.WrapPrefix(err, fmt.Sprintf("failed to read pinned key of scheme %s", scheme), 0))
+		}
+		if conf.PinnedSchemeKeys[scheme], err = signed.UnmarshalPemPublicKey(bts); err != nil {
+			return server.LogError(errors.WrapPrefix(err, fmt.Sprintf("failed to parse pinned key of scheme %s", scheme), 0))
+		}
+	}
+	return nil
+}
+
+func (conf *Configuration) trustsIssuer(issuer irma.IssuerIdentifier) bool {
+	if conf.trustedIssuers == nil {
+		return true
+	}
+	_, ok := conf.trustedIssuers[issuer]
+	return ok
+}
+
+func parseDate(date string) (*time.Time, error) {
+	if date == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
 func setupDatabase(conf *Configuration) (DB, error) {
 	var db DB
 	switch conf.DBType {
@@ -148,13 +538,18 @@ func setupCore(conf *Configuration) (*keysharecore.Core, error) {
 		return nil, server.LogError(errors.WrapPrefix(err, "failed to load primary storage key", 0))
 	}
 
+	tolerance := conf.IrmaConfiguration.ClockSkewTolerance()
 	core := keysharecore.NewKeyshareCore(&keysharecore.Configuration{
 		DecryptionKeyID: decKeyID,
 		DecryptionKey:   decKey,
 		JWTPrivateKeyID: conf.JwtKeyID,
 		JWTPrivateKey:   jwtPrivateKey,
 		JWTIssuer:       conf.JwtIssuer,
+		JWTAudience:     conf.JwtAudience,
 		JWTPinExpiry:    conf.JwtPinExpiry,
+
+		JWTAcceptMissingClaims: conf.JwtAcceptMissingClaims,
+		ClockSkewTolerance:     &tolerance,
 	})
 	for _, keyFile := range conf.StorageFallbackKeyFiles {
 		id, key, err := readAESKey(keyFile)
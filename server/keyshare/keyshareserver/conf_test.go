@@ -8,6 +8,7 @@ import (
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func validConf(t *testing.T) *Configuration {
@@ -26,6 +27,17 @@ func validConf(t *testing.T) *Configuration {
 	}
 }
 
+// doctoredConf returns a valid configuration, whose parsed test schemes are modified by doctor.
+func doctoredConf(t *testing.T, doctor func(irmaconf *irma.Configuration)) *Configuration {
+	conf := validConf(t)
+	irmaconf, err := irma.NewConfiguration(conf.SchemesPath, irma.ConfigurationOptions{})
+	require.NoError(t, err)
+	require.NoError(t, irmaconf.ParseFolder())
+	doctor(irmaconf)
+	conf.IrmaConfiguration = irmaconf
+	return conf
+}
+
 func TestConf(t *testing.T) {
 	testdataPath := test.FindTestdataFolder(t)
 
@@ -71,4 +83,165 @@ func TestConf(t *testing.T) {
 	conf.IssuerPrivateKeysPath = testdataPath // no private keys here
 	_, err = New(conf)
 	assert.Error(t, err)
+
+	conf = validConf(t)
+	conf.PinEncryptionKey = "AAAA" // too short
+	_, err = New(conf)
+	assert.Error(t, err)
+
+	conf = validConf(t)
+	conf.UniformPinResponsesKey = "AAAA" // too short
+	_, err = New(conf)
+	assert.Error(t, err)
+
+	conf = validConf(t)
+	conf.DisablePlaintextPins = true // requires a PIN encryption key
+	_, err = New(conf)
+	assert.Error(t, err)
+
+	conf = validConf(t)
+	conf.RequireRegistrationAttestation = true // requires an attestor
+	_, err = New(conf)
+	assert.Error(t, err)
+
+	conf = validConf(t)
+	conf.LogRetention = map[LogEventType]int{"UNKNOWN_EVENT": 30}
+	_, err = New(conf)
+	assert.Error(t, err)
+
+	conf = validConf(t)
+	conf.LogRetention = map[LogEventType]int{LogEventPinCheckFailed: 0}
+	_, err = New(conf)
+	assert.Error(t, err)
+
+	conf = validConf(t)
+	conf.LogRetention = map[LogEventType]int{LogEventIRMASession: 1} // too short for usage statistics
+	_, err = New(conf)
+	assert.Error(t, err)
+}
+
+func TestConfKeyshareAttributes(t *testing.T) {
+	primary := irma.NewAttributeTypeIdentifier("test.test.email.email")
+	secondary := irma.NewAttributeTypeIdentifier("test.test.mijnirma.email")
+
+	conf := validConf(t)
+	conf.KeyshareAttribute = irma.AttributeTypeIdentifier{}
+	conf.KeyshareAttributes = []irma.AttributeTypeIdentifier{primary, secondary}
+	_, err := New(conf)
+	assert.NoError(t, err)
+	assert.Equal(t, primary, conf.KeyshareAttribute)
+
+	// A single keyshare attribute is the only one
+	conf = validConf(t)
+	_, err = New(conf)
+	assert.NoError(t, err)
+	assert.Equal(t, []irma.AttributeTypeIdentifier{secondary}, conf.KeyshareAttributes)
+
+	// If both are specified, the keyshare attribute must be the primary one
+	conf = validConf(t)
+	conf.KeyshareAttributes = []irma.AttributeTypeIdentifier{secondary, primary}
+	_, err = New(conf)
+	assert.NoError(t, err)
+	conf = validConf(t)
+	conf.KeyshareAttributes = []irma.AttributeTypeIdentifier{primary, secondary}
+	_, err = New(conf)
+	assert.Error(t, err)
+
+	conf = validConf(t)
+	conf.KeyshareAttribute = irma.AttributeTypeIdentifier{}
+	_, err = New(conf)
+	assert.Error(t, err)
+
+	conf = validConf(t)
+	conf.KeyshareAttributes = []irma.AttributeTypeIdentifier{secondary, irma.NewAttributeTypeIdentifier("test.test.foo.bar")}
+	_, err = New(conf)
+	assert.Error(t, err)
+
+	// All keyshare attributes must belong to the same scheme
+	conf = validConf(t)
+	conf.KeyshareAttributes = []irma.AttributeTypeIdentifier{secondary, irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname")}
+	_, err = New(conf)
+	assert.Error(t, err)
+}
+
+func TestConfKeyshareScheme(t *testing.T) {
+	scheme := irma.NewSchemeManagerIdentifier("test")
+	credType := irma.NewCredentialTypeIdentifier("test.test.mijnirma")
+	withKeyshareServer := func(url string) func(*irma.Configuration) {
+		return func(irmaconf *irma.Configuration) {
+			irmaconf.SchemeManagers[scheme].KeyshareServer = url
+		}
+	}
+
+	// The scheme of the keyshare attribute must be distributed
+	_, err := New(doctoredConf(t, withKeyshareServer("")))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is not distributed")
+
+	// and its keyshare server URL must be (a prefix of) the URL of the server, if configured
+	conf := validConf(t)
+	conf.URL = "https://example.com/"
+	_, err = New(conf)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "does not match the URL of this keyshare server")
+
+	for url, valid := range map[string]bool{
+		"https://example.com":            true,
+		"https://example.com/keyshare/":  true,
+		"https://example.com/keyshare/a": false,
+		"https://example.com/key":        false,
+		"https://other.example.com":      false,
+	} {
+		conf = doctoredConf(t, withKeyshareServer(url))
+		conf.URL = "https://example.com/"
+		conf.PathPrefix = "/keyshare"
+		_, err = New(conf)
+		if valid {
+			assert.NoError(t, err, url)
+		} else {
+			assert.Error(t, err, url)
+		}
+	}
+
+	// The credential type of the keyshare attribute must contain only that attribute
+	conf = doctoredConf(t, func(irmaconf *irma.Configuration) {
+		ct := irmaconf.CredentialTypes[credType]
+		ct.AttributeTypes = append(ct.AttributeTypes, &irma.AttributeType{ID: "level"})
+	})
+	_, err = New(conf)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "contains other attributes (level)")
+
+	// apart from the revocation attribute
+	conf = doctoredConf(t, func(irmaconf *irma.Configuration) {
+		ct := irmaconf.CredentialTypes[credType]
+		ct.AttributeTypes = append(ct.AttributeTypes, &irma.AttributeType{ID: "revocation", RevocationAttribute: true})
+	})
+	_, err = New(conf)
+	assert.NoError(t, err)
+}
+
+func TestConfPathPrefix(t *testing.T) {
+	conf := doctoredConf(t, func(irmaconf *irma.Configuration) {
+		irmaconf.SchemeManagers[irma.NewSchemeManagerIdentifier("test")].KeyshareServer = "https://example.com/keyshare"
+	})
+	conf.URL = "https://example.com/"
+	conf.PathPrefix = "/keyshare/"
+	conf.VerificationURL = map[string]string{
+		"en": "/users/email/verify/",
+		"nl": "https://myirma.example.com/verify/",
+	}
+	_, err := New(conf)
+	assert.NoError(t, err)
+	assert.Equal(t, "/keyshare", conf.PathPrefix)
+	assert.Equal(t, "https://example.com/keyshare/irma/", conf.URL)
+	assert.Equal(t, "https://example.com/keyshare/users/email/verify/", conf.VerificationURL["en"])
+	assert.Equal(t, "https://myirma.example.com/verify/", conf.VerificationURL["nl"])
+
+	for _, prefix := range []string{"keyshare", "/keyshare/../admin", "//keyshare", "/key share?", "/keyshare#x", "/key%2Fshare"} {
+		conf = validConf(t)
+		conf.PathPrefix = prefix
+		_, err = New(conf)
+		assert.Error(t, err, prefix)
+	}
 }
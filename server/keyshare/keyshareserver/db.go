@@ -1,34 +1,87 @@
 package keyshareserver
 
 import (
+	"context"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/keysharecore"
+	"github.com/privacybydesign/irmago/server/keyshare"
 
 	"github.com/go-errors/errors"
 )
 
 var (
 	errUserAlreadyExists = errors.New("Cannot create user, username already taken")
+	errAccountExists     = errors.New("Cannot create user, identity already bound to another user")
 	errInvalidRecord     = errors.New("Invalid record in database")
+	errUpdateConflict    = errors.New("Cannot update user, it was changed in the meantime")
+
+	errDeviceNotFound          = errors.New("Could not find specified device")
+	errEnrollmentCodeInvalid   = errors.New("Device enrollment code unknown, expired or already used")
+	errRecoveryTokenInvalid    = errors.New("Recovery token unknown, expired or already used")
+	errEmailTokenInvalid       = errors.New("Email verification token unknown, expired or already used")
+	errUnsubscribeTokenInvalid = errors.New("Unsubscribe token unknown or already used")
 )
 
-type eventType string
+// LogEventType is the type of an event in the log of a user, as stored in the event column of the
+// irma.log_entry_records table. Its values are stable, so that they can be used by external tools.
+type LogEventType string
 
 const (
-	eventTypePinCheckRefused eventType = "PIN_CHECK_REFUSED"
-	eventTypePinCheckSuccess eventType = "PIN_CHECK_SUCCESS"
-	eventTypePinCheckFailed  eventType = "PIN_CHECK_FAILED"
-	eventTypePinCheckBlocked eventType = "PIN_CHECK_BLOCKED"
-	eventTypeIRMASession     eventType = "IRMA_SESSION"
+	LogEventPinCheckRefused  LogEventType = "PIN_CHECK_REFUSED"
+	LogEventPinCheckSuccess  LogEventType = "PIN_CHECK_SUCCESS"
+	LogEventPinCheckFailed   LogEventType = "PIN_CHECK_FAILED"
+	LogEventPinCheckBlocked  LogEventType = "PIN_CHECK_BLOCKED"
+	LogEventIRMASession      LogEventType = "IRMA_SESSION"
+	LogEventAccountRecovered LogEventType = "ACCOUNT_RECOVERED"
+	LogEventDeviceAdded      LogEventType = "DEVICE_ADDED"
+	LogEventDeviceRevoked    LogEventType = "DEVICE_REVOKED"
+	LogEventReenrolled       LogEventType = "REENROLLED"
+	LogEventEmailChanged     LogEventType = "EMAIL_CHANGED"
+	LogEventEmailRemoved     LogEventType = "EMAIL_REMOVED"
 )
 
+// LogEventTypes contains all log event types.
+var LogEventTypes = []LogEventType{
+	LogEventPinCheckRefused,
+	LogEventPinCheckSuccess,
+	LogEventPinCheckFailed,
+	LogEventPinCheckBlocked,
+	LogEventIRMASession,
+	LogEventAccountRecovered,
+	LogEventDeviceAdded,
+	LogEventDeviceRevoked,
+	LogEventReenrolled,
+	LogEventEmailChanged,
+	LogEventEmailRemoved,
+}
+
+func validLogEventType(eventType LogEventType) bool {
+	for _, t := range LogEventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
 // DB is an interface used by server to manage data storage.
 // There are multiple implementations of this, currently:
 //  - memorydb (memorydb.go) storing all data in memory (forgets everything after reboot)
 //  - postgresdb (postgresdb.go) storing all data in a postgres database
 type DB interface {
-	AddUser(user *User) error
-	user(username string) (*User, error)
-	updateUser(user *User) error
+	AddUser(ctx context.Context, user *User) error
+	user(ctx context.Context, username string) (*User, error)
+
+	// updateUser writes the user, provided that it was not changed since it was read (including by
+	// replaceSecrets); otherwise it returns errUpdateConflict, after which the user should be read
+	// again before retrying.
+	updateUser(ctx context.Context, user *User) error
+
+	// userByOIDCSubject returns the user whose account is bound to the specified OpenID Connect
+	// subject, or keyshare.ErrUserNotFound if there is none.
+	userByOIDCSubject(ctx context.Context, subject string) (*User, error)
 
 	// reservePinTry reserves a pin check attempt, and additionally it returns:
 	//  - allowed is whether the user is allowed to do the pin check (false if user is blocked)
@@ -37,19 +90,118 @@ type DB interface {
 	// resetPinTries increases the user's try count and (if applicable) the date when the user
 	// is unblocked again in the database, regardless of if the pin check succeeds after this
 	// invocation.
-	reservePinTry(user *User) (allowed bool, tries int, wait int64, err error)
+	reservePinTry(ctx context.Context, user *User) (allowed bool, tries int, wait int64, err error)
+
+	// pinTries returns how many pin checks the user may do before being blocked (again), and how long
+	// the user is still blocked, like reservePinTry but without reserving a pin check attempt.
+	pinTries(ctx context.Context, user *User) (tries int, wait int64, err error)
 
 	// resetPinTries resets the user's pin count and unblock date fields in the database to their
 	// default values (0 past attempts, no unblock date).
-	resetPinTries(user *User) error
+	resetPinTries(ctx context.Context, user *User) error
 
 	// User activity registration.
 	// setSeen calls are used to track when a users account was last active, for deleting old accounts.
-	setSeen(user *User) error
-	addLog(user *User, eventType eventType, param interface{}) error
+	setSeen(ctx context.Context, user *User) error
+	addLog(ctx context.Context, user *User, eventType LogEventType, param interface{}) error
+
+	// setCredentialIssued records that the keyshare credential was issued to the user after registration.
+	// Accounts to which it is never issued are deleted after some time.
+	setCredentialIssued(ctx context.Context, user *User) error
+
+	// Store email verification tokens on registration, valid for the specified amount of hours.
+	// Only the hash of the token is stored (see keyshare.HashEmailToken).
+	addEmailVerification(ctx context.Context, user *User, emailAddress, tokenHash string, validity int) error
+
+	// verifyEmail consumes the email verification token having the given hash, marking the associated
+	// email address as verified. It returns errEmailTokenInvalid if the token is unknown, expired or
+	// already used, without distinguishing between these cases.
+	verifyEmail(ctx context.Context, tokenHash string) error
+
+	// emailVerified returns whether the user has at least one verified email address.
+	emailVerified(ctx context.Context, user *User) (bool, error)
+
+	// removeEmails removes all email addresses of the user, along with their pending verifications
+	// and unsubscribe tokens.
+	removeEmails(ctx context.Context, user *User) error
+
+	// Store unsubscribe tokens (of which only the hash is given) for email addresses of the user, with
+	// which the address can be removed without logging in, e.g. using a link in emails sent to it.
+	// Unsubscribe tokens do not expire.
+	addUnsubscribeToken(ctx context.Context, user *User, emailAddress, tokenHash string) error
+
+	// unsubscribe removes the email address for which the unsubscribe token having the given hash was
+	// stored, along with its pending verifications and unsubscribe tokens, returning the user to which
+	// it belonged, or errUnsubscribeTokenInvalid if the token is unknown or already used.
+	unsubscribe(ctx context.Context, tokenHash string) (*User, error)
+
+	// Additional devices of the user, each having its own secrets (and thus its own PIN).
+	// device, updateDeviceSecrets and removeDevice return errDeviceNotFound for unknown devices.
+	addDevice(ctx context.Context, user *User, device *Device) error
+	device(ctx context.Context, user *User, id string) (*Device, error)
+	devices(ctx context.Context, user *User) ([]*Device, error)
+	updateDeviceSecrets(ctx context.Context, user *User, id string, secrets keysharecore.UserSecrets) error
+	removeDevice(ctx context.Context, user *User, id string) error
+
+	// Store device enrollment codes, valid for the specified duration
+	addEnrollmentCode(ctx context.Context, user *User, code string, validity time.Duration) error
+
+	// consumeEnrollmentCode consumes the given device enrollment code of the user, returning
+	// errEnrollmentCodeInvalid if it is unknown, expired or already used.
+	consumeEnrollmentCode(ctx context.Context, user *User, code string) error
+
+	// Store the recovery token of the user (of which only the hash is given), valid for the specified
+	// duration, replacing any previous recovery token of the user
+	addRecoveryToken(ctx context.Context, user *User, tokenHash string, validity time.Duration) error
 
-	// Store email verification tokens on registration
-	addEmailVerification(user *User, emailAddress, token string) error
+	// consumeRecoveryToken consumes the recovery token having the given hash, returning the user to
+	// which it belongs, or errRecoveryTokenInvalid if it is unknown, expired or already used.
+	consumeRecoveryToken(ctx context.Context, tokenHash string) (*User, error)
+
+	// Administration of all users.
+	// userStats returns the amount of accounts per state; listUsers returns the metadata of at most
+	// limit accounts ordered by username, starting after the specified username (if not empty).
+	userStats(ctx context.Context) (*userStats, error)
+	listUsers(ctx context.Context, after string, limit int) ([]*userMetadata, error)
+
+	// Usage statistics, per day (in UTC).
+	// rollupUsage aggregates the keyshare sessions (LogEventIRMASession log entries) of the days
+	// before the day of until into usage statistics, starting after the last day that was aggregated
+	// before (or at the first session, if none). Running it again for the same days has no effect.
+	// usageStats returns the usage statistics of the days from from up to and including to.
+	rollupUsage(ctx context.Context, until time.Time) error
+	usageStats(ctx context.Context, from, to time.Time) ([]*usageStat, error)
+
+	// Maintenance of all users, see maintenance.go.
+	// usersAfter returns at most limit users including their secrets, ordered by username, starting
+	// after the specified username (if not empty).
+	// replaceSecrets replaces the secrets of the user (or of its additional device, if user.DeviceID
+	// is set) by user.Secrets, provided they still equal old; otherwise it returns false.
+	usersAfter(ctx context.Context, after string, limit int) ([]*User, error)
+	replaceSecrets(ctx context.Context, user *User, old keysharecore.UserSecrets) (bool, error)
+
+	// deleteExpiredEmailVerifications deletes at most limit expired email verification tokens,
+	// returning how many were deleted.
+	deleteExpiredEmailVerifications(ctx context.Context, limit int) (int, error)
+
+	// deleteLogsBefore deletes at most limit log entries from before t, except those of the
+	// specified types, returning how many were deleted.
+	deleteLogsBefore(ctx context.Context, t time.Time, keepTypes []LogEventType, limit int) (int, error)
+
+	// rebuildUsage aggregates the keyshare sessions of the specified day into usage statistics, like
+	// rollupUsage, replacing the statistics of that day if it was aggregated before.
+	rebuildUsage(ctx context.Context, day time.Time) error
+
+	// instrument sets the timeout of the operations on the database (i.e. calls of the methods of
+	// DB), the duration above which they are logged as slow, and the function to which they are
+	// reported. Implementations whose operations cannot be slow may ignore it.
+	instrument(instr keyshare.DBInstrumentation)
+}
+
+// healthReporter is implemented by DB implementations that can become unavailable,
+// reporting how long they have been failing (or 0 if they are not).
+type healthReporter interface {
+	failingFor() time.Duration
 }
 
 // User represents a user of this server.
@@ -57,5 +209,62 @@ type User struct {
 	Username string
 	Language string
 	Secrets  keysharecore.UserSecrets
+	// Subject of the identity at the OpenID Connect provider that the account is bound to, if any
+	OIDCSubject string
+	// ID of the additional device whose secrets are in Secrets, or empty for the device
+	// with which the account was registered
+	DeviceID string
 	id       int64
+	// Incremented on each update of the user, to detect concurrent updates (see DB.updateUser)
+	version int64
+}
+
+// Device represents an additional device of a user.
+type Device struct {
+	ID      string
+	Name    string
+	Secrets keysharecore.UserSecrets
+	Created time.Time
+}
+
+// userStats contains the amount of accounts per state. Accounts deleted by the user are not counted.
+type userStats struct {
+	Accounts int `json:"accounts"`
+	// Accounts that are currently blocked after too many wrong PIN attempts
+	Blocked int `json:"blocked"`
+	// Accounts having at least one verified email address
+	EmailVerified int `json:"emailVerified"`
+	// Accounts having registered an email address, but never having verified one
+	EmailUnverified int `json:"emailUnverified"`
+	// Accounts scheduled for deletion
+	PendingDeletion int `json:"pendingDeletion"`
+	// Accounts to which the keyshare credential has not (yet) been issued after registration
+	CredentialPending int `json:"credentialPending"`
+	// Accounts to which the keyshare credential has been issued, including those registered before
+	// this was recorded
+	CredentialIssued int `json:"credentialIssued"`
+}
+
+// usageStat contains the amount of keyshare sessions on a day, and the amount of distinct users
+// that performed them.
+type usageStat struct {
+	Date     string `json:"date"` // in YYYY-MM-DD format
+	Sessions int    `json:"sessions"`
+	Users    int    `json:"users"`
+}
+
+const usageDateFormat = "2006-01-02"
+
+// usageDay returns the start of the day (in UTC) of the specified time.
+func usageDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// userMetadata contains the metadata of an account, excluding its secrets.
+type userMetadata struct {
+	Username      string          `json:"username"`
+	Created       *irma.Timestamp `json:"created,omitempty"` // Not known for accounts created before this was recorded
+	LastSeen      *irma.Timestamp `json:"lastSeen"`
+	EmailVerified bool            `json:"emailVerified"`
+	BlockedUntil  *irma.Timestamp `json:"blockedUntil,omitempty"`
 }
@@ -0,0 +1,160 @@
+package keyshareserver
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// Maintenance operations, to be invoked by operators (e.g. using a command line tool or an
+// administration endpoint). They process their items in batches, checking between batches whether
+// the context is cancelled. Each item is processed atomically, so that an operation can be cancelled
+// at any moment and simply be run again: running an operation again only continues where it left off.
+
+// maintenanceBatchSize is the default amount of items processed per batch by maintenance operations.
+const maintenanceBatchSize = 1000
+
+// MaintenanceProgress reports the progress of a maintenance operation.
+type MaintenanceProgress struct {
+	// Amount of items (secrets of accounts and devices, email verification tokens or days) processed so far
+	Processed int
+	// Amount of processed items that were modified (secrets that were re-encrypted, or tokens that
+	// were deleted)
+	Changed int
+}
+
+// MaintenanceProgressFunc is called by maintenance operations after each batch, with the progress so far.
+type MaintenanceProgressFunc func(MaintenanceProgress)
+
+// ReencryptAllUsers re-encrypts the secrets of all accounts and their devices that are not yet
+// encrypted with the current storage key (storage_primary_key_file), processing batchSize accounts
+// per batch (default 1000). Afterwards, the fallback storage keys are no longer needed.
+// The progress function, if not nil, is called after each batch.
+func (s *Server) ReencryptAllUsers(ctx context.Context, batchSize int, progress MaintenanceProgressFunc) (MaintenanceProgress, error) {
+	if batchSize <= 0 {
+		batchSize = maintenanceBatchSize
+	}
+
+	var p MaintenanceProgress
+	cursor := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return p, err
+		}
+		users, err := s.db.usersAfter(ctx, cursor, batchSize)
+		if err != nil {
+			return p, err
+		}
+		if len(users) == 0 {
+			return p, nil
+		}
+		for _, user := range users {
+			if err = s.reencryptUser(ctx, user, &p); err != nil {
+				return p, errors.WrapPrefix(err, "failed to re-encrypt secrets of user "+user.Username, 0)
+			}
+		}
+		cursor = users[len(users)-1].Username
+		if progress != nil {
+			progress(p)
+		}
+	}
+}
+
+// reencryptUser re-encrypts the secrets of the user and of its additional devices, if necessary.
+func (s *Server) reencryptUser(ctx context.Context, user *User, p *MaintenanceProgress) error {
+	if err := s.reencryptSecrets(ctx, user, p); err != nil {
+		return err
+	}
+
+	devices, err := s.db.devices(ctx, user)
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		device, err := s.db.device(ctx, user, d.ID)
+		if err == errDeviceNotFound {
+			continue // removed in the meantime
+		}
+		if err != nil {
+			return err
+		}
+		deviceUser := &User{Username: user.Username, Secrets: device.Secrets, DeviceID: device.ID, id: user.id}
+		if err = s.reencryptSecrets(ctx, deviceUser, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reencryptSecrets re-encrypts the secrets of the user (or of its device user.DeviceID) with the
+// current storage key, if they are encrypted with another key.
+func (s *Server) reencryptSecrets(ctx context.Context, user *User, p *MaintenanceProgress) error {
+	p.Processed++
+	old := user.Secrets
+	secrets, changed, err := s.core.ReencryptUserSecrets(old)
+	if err != nil || !changed {
+		return err
+	}
+	user.Secrets = secrets
+	replaced, err := s.db.replaceSecrets(ctx, user, old)
+	if err != nil {
+		return err
+	}
+	// If the secrets were not replaced, they were changed in the meantime (e.g. when the user changed
+	// the PIN), in which case they are already encrypted with the current key.
+	if replaced {
+		p.Changed++
+	}
+	return nil
+}
+
+// PurgeExpiredVerifications deletes all expired email verification tokens. The progress function,
+// if not nil, is called after each batch.
+func (s *Server) PurgeExpiredVerifications(ctx context.Context, progress MaintenanceProgressFunc) (MaintenanceProgress, error) {
+	var p MaintenanceProgress
+	for {
+		if err := ctx.Err(); err != nil {
+			return p, err
+		}
+		deleted, err := s.db.deleteExpiredEmailVerifications(ctx, maintenanceBatchSize)
+		if err != nil {
+			return p, err
+		}
+		p.Processed += deleted
+		p.Changed += deleted
+		if progress != nil {
+			progress(p)
+		}
+		if deleted < maintenanceBatchSize {
+			return p, nil
+		}
+	}
+}
+
+// RebuildUsageStats aggregates the keyshare sessions of the days from from up to and including to
+// into usage statistics again, replacing the statistics of those days. Days that have not yet ended
+// are skipped, as they are aggregated automatically once they have. Note that sessions of accounts
+// that have been deleted in the meantime are no longer counted. The progress function, if not nil,
+// is called after each day.
+func (s *Server) RebuildUsageStats(ctx context.Context, from, to time.Time, progress MaintenanceProgressFunc) (MaintenanceProgress, error) {
+	last := usageDay(time.Now()).Add(-24 * time.Hour)
+	if to.After(last) {
+		to = last
+	}
+
+	var p MaintenanceProgress
+	for day := usageDay(from); !day.After(to); day = day.Add(24 * time.Hour) {
+		if err := ctx.Err(); err != nil {
+			return p, err
+		}
+		if err := s.db.rebuildUsage(ctx, day); err != nil {
+			return p, err
+		}
+		p.Processed++
+		if progress != nil {
+			progress(p)
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,230 @@
+package keyshareserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/irmago/internal/keysharecore"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryDBMaintenance(t *testing.T) {
+	testMaintenance(t, NewMemoryDB())
+}
+
+func TestMemoryDBUpdateConflicts(t *testing.T) {
+	testUpdateConflicts(t, NewMemoryDB())
+}
+
+// testMaintenance tests the maintenance operations of the server on the DB, checking that running
+// them again has no effect.
+func testMaintenance(t *testing.T, db DB) {
+	ctx := context.Background()
+	var oldKey, newKey keysharecore.AESKey
+	oldKey[0], newKey[0] = 1, 2
+	oldCore := keysharecore.NewKeyshareCore(&keysharecore.Configuration{DecryptionKeyID: 1, DecryptionKey: oldKey})
+	core := keysharecore.NewKeyshareCore(&keysharecore.Configuration{DecryptionKeyID: 2, DecryptionKey: newKey})
+	core.DangerousAddDecryptionKey(1, oldKey)
+	s := &Server{db: db, core: core}
+
+	// Users having secrets encrypted with the old key, of which every other one has an additional device,
+	// and every third one having an expired email verification token
+	n := 25
+	for i := 0; i < n; i++ {
+		secrets, err := oldCore.NewUserSecrets("12345")
+		require.NoError(t, err)
+		user := &User{Username: fmt.Sprintf("user%02d", i), Secrets: secrets}
+		require.NoError(t, db.AddUser(ctx, user))
+		if i%2 == 0 {
+			secrets, err = oldCore.NewDeviceSecrets(secrets, "54321")
+			require.NoError(t, err)
+			require.NoError(t, db.addDevice(ctx, user, &Device{ID: "device", Name: "test", Secrets: secrets, Created: time.Now()}))
+		}
+		if i%3 == 0 {
+			require.NoError(t, db.addEmailVerification(ctx, user, "test@example.com", fmt.Sprintf("expired%02d", i), -1))
+		}
+		require.NoError(t, db.addEmailVerification(ctx, user, "test@example.com", fmt.Sprintf("token%02d", i), 24))
+	}
+	secretsCount := n + (n+1)/2
+
+	// Re-encrypt in batches, reporting progress after each batch
+	var reported []MaintenanceProgress
+	p, err := s.ReencryptAllUsers(ctx, 10, func(p MaintenanceProgress) {
+		reported = append(reported, p)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, MaintenanceProgress{Processed: secretsCount, Changed: secretsCount}, p)
+	require.Len(t, reported, 3)
+	assert.Equal(t, p, reported[2])
+
+	p, err = s.ReencryptAllUsers(ctx, 10, nil)
+	require.NoError(t, err)
+	assert.Equal(t, MaintenanceProgress{Processed: secretsCount}, p)
+
+	// All secrets can now be used without the old key
+	jwtKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	core = keysharecore.NewKeyshareCore(&keysharecore.Configuration{DecryptionKeyID: 2, DecryptionKey: newKey, JWTPrivateKey: jwtKey})
+	for i := 0; i < n; i++ {
+		user, err := db.user(ctx, fmt.Sprintf("user%02d", i))
+		require.NoError(t, err)
+		_, err = core.ValidatePin(user.Secrets, "12345")
+		require.NoError(t, err)
+		if i%2 == 0 {
+			device, err := db.device(ctx, user, "device")
+			require.NoError(t, err)
+			_, err = core.ValidatePin(device.Secrets, "54321")
+			require.NoError(t, err)
+		}
+	}
+
+	// Secrets that were changed in the meantime are not replaced
+	user, err := db.user(ctx, "user00")
+	require.NoError(t, err)
+	current := user.Secrets
+	user.Secrets, err = core.NewUserSecrets("12345")
+	require.NoError(t, err)
+	replaced, err := db.replaceSecrets(ctx, user, user.Secrets)
+	require.NoError(t, err)
+	assert.False(t, replaced)
+	replaced, err = db.replaceSecrets(ctx, user, current)
+	require.NoError(t, err)
+	assert.True(t, replaced)
+
+	// Only expired email verification tokens are purged
+	expired := (n + 2) / 3
+	p, err = s.PurgeExpiredVerifications(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, MaintenanceProgress{Processed: expired, Changed: expired}, p)
+	p, err = s.PurgeExpiredVerifications(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, MaintenanceProgress{}, p)
+	assert.Equal(t, errEmailTokenInvalid, db.verifyEmail(ctx, "expired00"))
+	assert.NoError(t, db.verifyEmail(ctx, "token00"))
+
+	// Rebuilding a day replaces its usage statistics
+	today := usageDay(time.Now())
+	tomorrow := today.Add(24 * time.Hour)
+	require.NoError(t, db.addLog(ctx, user, LogEventIRMASession, nil))
+	require.NoError(t, db.rollupUsage(ctx, tomorrow))
+	require.NoError(t, db.addLog(ctx, user, LogEventIRMASession, nil))
+	for i := 0; i < 2; i++ {
+		require.NoError(t, db.rebuildUsage(ctx, today))
+		stats, err := db.usageStats(ctx, today, today)
+		require.NoError(t, err)
+		assert.Equal(t, []*usageStat{{Date: today.Format(usageDateFormat), Sessions: 2, Users: 1}}, stats)
+	}
+
+	// The current day is not rebuilt by the server
+	from := today.Add(-3 * 24 * time.Hour)
+	for i := 0; i < 2; i++ {
+		p, err = s.RebuildUsageStats(ctx, from, tomorrow, nil)
+		require.NoError(t, err)
+		assert.Equal(t, MaintenanceProgress{Processed: 3}, p)
+		stats, err := db.usageStats(ctx, from, tomorrow)
+		require.NoError(t, err)
+		require.Len(t, stats, 4)
+		assert.Equal(t, &usageStat{Date: from.Format(usageDateFormat)}, stats[0])
+		assert.Equal(t, 2, stats[3].Sessions)
+	}
+
+	// Cancelled operations stop before doing anything
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = s.ReencryptAllUsers(cancelled, 10, nil)
+	assert.Equal(t, context.Canceled, err)
+	_, err = s.PurgeExpiredVerifications(cancelled, nil)
+	assert.Equal(t, context.Canceled, err)
+	_, err = s.RebuildUsageStats(cancelled, from, tomorrow, nil)
+	assert.Equal(t, context.Canceled, err)
+}
+
+// interleavingDB runs beforeUpdate (once) just before the next updateUser call, to interleave
+// other operations with updates of users.
+type interleavingDB struct {
+	DB
+	beforeUpdate func()
+}
+
+func (db *interleavingDB) updateUser(ctx context.Context, user *User) error {
+	if f := db.beforeUpdate; f != nil {
+		db.beforeUpdate = nil
+		f()
+	}
+	return db.DB.updateUser(ctx, user)
+}
+
+// testUpdateConflicts tests that PIN changes are not undone by concurrent PIN changes or
+// re-encryption of the secrets of the user, and vice versa.
+func testUpdateConflicts(t *testing.T, db DB) {
+	ctx := context.Background()
+	var oldKey, newKey keysharecore.AESKey
+	oldKey[0], newKey[0] = 1, 2
+	jwtKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	oldCore := keysharecore.NewKeyshareCore(&keysharecore.Configuration{DecryptionKeyID: 1, DecryptionKey: oldKey})
+	core := keysharecore.NewKeyshareCore(&keysharecore.Configuration{DecryptionKeyID: 2, DecryptionKey: newKey, JWTPrivateKey: jwtKey})
+	core.DangerousAddDecryptionKey(1, oldKey)
+	idb := &interleavingDB{DB: db}
+	conf := &Configuration{Configuration: &server.Configuration{Logger: logrus.New()}}
+	s := &Server{db: idb, core: core, conf: conf, current: conf}
+
+	secrets, err := oldCore.NewUserSecrets("12345")
+	require.NoError(t, err)
+	require.NoError(t, db.AddUser(ctx, &User{Username: "testuser", Language: "en", Secrets: secrets}))
+	validatePin := func(pin string) error {
+		user, err := db.user(ctx, "testuser")
+		require.NoError(t, err)
+		_, err = core.ValidatePin(user.Secrets, pin)
+		return err
+	}
+
+	// The secrets are re-encrypted while the PIN is being changed
+	idb.beforeUpdate = func() {
+		p, err := s.ReencryptAllUsers(ctx, 0, nil)
+		require.NoError(t, err)
+		require.Equal(t, MaintenanceProgress{Processed: 1, Changed: 1}, p)
+	}
+	user, err := db.user(ctx, "testuser")
+	require.NoError(t, err)
+	status, err := s.updatePin(ctx, user, "12345", "23456")
+	require.NoError(t, err)
+	require.Equal(t, "success", status.Status)
+	require.Nil(t, idb.beforeUpdate)
+	require.NoError(t, validatePin("23456"))
+	require.Equal(t, keysharecore.ErrInvalidPin, validatePin("12345"))
+	p, err := s.ReencryptAllUsers(ctx, 0, nil)
+	require.NoError(t, err)
+	require.Equal(t, MaintenanceProgress{Processed: 1}, p)
+
+	// Another PIN change finishes while the PIN is being changed
+	idb.beforeUpdate = func() {
+		user, err := db.user(ctx, "testuser")
+		require.NoError(t, err)
+		status, err := s.updatePin(ctx, user, "23456", "34567")
+		require.NoError(t, err)
+		require.Equal(t, "success", status.Status)
+	}
+	user, err = db.user(ctx, "testuser")
+	require.NoError(t, err)
+	status, err = s.updatePin(ctx, user, "23456", "45678")
+	require.NoError(t, err)
+	require.NotEqual(t, "success", status.Status)
+	require.NoError(t, validatePin("34567"))
+	require.Equal(t, keysharecore.ErrInvalidPin, validatePin("45678"))
+
+	// Updating a user that was changed in the meantime fails
+	user, err = db.user(ctx, "testuser")
+	require.NoError(t, err)
+	stale := *user
+	require.NoError(t, db.updateUser(ctx, user))
+	require.Equal(t, errUpdateConflict, db.updateUser(ctx, &stale))
+	require.NoError(t, db.updateUser(ctx, user))
+}
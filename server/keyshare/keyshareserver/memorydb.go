@@ -1,39 +1,107 @@
 package keyshareserver
 
 import (
+	"context"
+	"sort"
 	"sync"
+	"time"
 
+	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/keysharecore"
 	"github.com/privacybydesign/irmago/server/keyshare"
 )
 
 // memoryDB provides an easy-to-configure testing implementation of the
 // keyshare server database. It does not provide full functionality, instead
-// mocking some behaviour, as noted on the specific functions.
+// mocking some behaviour, as noted on the specific functions. As all operations
+// complete immediately, it ignores the contexts passed to it.
 
 type memoryDB struct {
 	sync.Mutex
-	users map[string]keysharecore.UserSecrets
+	users    map[string]*memoryUser
+	subjects map[string]string // usernames per OpenID Connect subject
+
+	emailTokens map[string]*memoryEmailToken // per token hash
+	emails      map[string][]string          // verified email addresses per username
+
+	unsubscribeTokens map[string]*memoryUnsubscribeToken // per token hash
+
+	userDevices     map[string]map[string]*Device // additional devices per username
+	enrollmentCodes map[string]*memoryEnrollmentCode
+	recoveryTokens  map[string]*memoryRecoveryToken // per token hash
+
+	logs  []memoryLogEntry      // in order of time, kept so that usage can be aggregated again
+	usage map[string]*usageStat // per date
+}
+
+type memoryLogEntry struct {
+	username string
+	event    LogEventType
+	time     time.Time
+}
+
+type memoryEnrollmentCode struct {
+	username string
+	expiry   time.Time
+}
+
+type memoryRecoveryToken struct {
+	username string
+	expiry   time.Time
+}
+
+type memoryUser struct {
+	secrets          keysharecore.UserSecrets
+	language         string
+	created          time.Time
+	lastSeen         time.Time
+	credentialIssued bool
+	version          int64
+}
+
+type memoryUnsubscribeToken struct {
+	username string
+	email    string
+}
+
+type memoryEmailToken struct {
+	username string
+	email    string
+	expiry   time.Time
+	used     bool
 }
 
 func NewMemoryDB() DB {
-	return &memoryDB{users: map[string]keysharecore.UserSecrets{}}
+	return &memoryDB{
+		users:       map[string]*memoryUser{},
+		subjects:    map[string]string{},
+		emailTokens: map[string]*memoryEmailToken{},
+		emails:      map[string][]string{},
+
+		unsubscribeTokens: map[string]*memoryUnsubscribeToken{},
+
+		userDevices:     map[string]map[string]*Device{},
+		enrollmentCodes: map[string]*memoryEnrollmentCode{},
+		recoveryTokens:  map[string]*memoryRecoveryToken{},
+
+		usage: map[string]*usageStat{},
+	}
 }
 
-func (db *memoryDB) user(username string) (*User, error) {
+func (db *memoryDB) user(_ context.Context, username string) (*User, error) {
 	// Ensure access to database is single-threaded
 	db.Lock()
 	defer db.Unlock()
 
 	// Check and fetch user data
-	secrets, ok := db.users[username]
+	u, ok := db.users[username]
 	if !ok {
 		return nil, keyshare.ErrUserNotFound
 	}
-	return &User{Username: username, Secrets: secrets}, nil
+	return &User{Username: username, Language: u.language, Secrets: u.secrets, version: u.version}, nil
 }
 
-func (db *memoryDB) AddUser(user *User) error {
+func (db *memoryDB) AddUser(_ context.Context, user *User) error {
 	// Ensure access to database is single-threaded
 	db.Lock()
 	defer db.Unlock()
@@ -43,45 +111,548 @@ func (db *memoryDB) AddUser(user *User) error {
 	if exists {
 		return errUserAlreadyExists
 	}
-	db.users[user.Username] = user.Secrets
+	if user.OIDCSubject != "" {
+		if _, exists = db.subjects[user.OIDCSubject]; exists {
+			return errAccountExists
+		}
+		db.subjects[user.OIDCSubject] = user.Username
+	}
+	now := time.Now()
+	db.users[user.Username] = &memoryUser{secrets: user.Secrets, language: user.Language, created: now, lastSeen: now}
 	return nil
 }
 
-func (db *memoryDB) updateUser(user *User) error {
+func (db *memoryDB) userByOIDCSubject(_ context.Context, subject string) (*User, error) {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	username, ok := db.subjects[subject]
+	if !ok {
+		return nil, keyshare.ErrUserNotFound
+	}
+	u := db.users[username]
+	return &User{Username: username, Language: u.language, Secrets: u.secrets, OIDCSubject: subject, version: u.version}, nil
+}
+
+func (db *memoryDB) updateUser(_ context.Context, user *User) error {
 	// Ensure access to database is single-threaded
 	db.Lock()
 	defer db.Unlock()
 
 	// Check and update user.
-	_, exists := db.users[user.Username]
+	u, exists := db.users[user.Username]
 	if !exists {
 		return keyshare.ErrUserNotFound
 	}
-	db.users[user.Username] = user.Secrets
+	if u.version != user.version {
+		return errUpdateConflict
+	}
+	u.secrets = user.Secrets
+	u.language = user.Language
+	u.version++
+	user.version = u.version
 	return nil
 }
 
-func (db *memoryDB) reservePinTry(user *User) (bool, int, int64, error) {
+func (db *memoryDB) reservePinTry(_ context.Context, user *User) (bool, int, int64, error) {
 	// Since this is a testing DB, implementing anything more than always allow creates hastle
 	return true, 1, 0, nil
 }
 
-func (db *memoryDB) resetPinTries(user *User) error {
+func (db *memoryDB) pinTries(_ context.Context, user *User) (int, int64, error) {
+	// Since this is a testing DB, pin checks are always allowed
+	return maxPinTries, 0, nil
+}
+
+func (db *memoryDB) resetPinTries(_ context.Context, user *User) error {
 	// Since this is a testing DB, implementing anything more than always allow creates hastle
 	return nil
 }
 
-func (db *memoryDB) setSeen(user *User) error {
-	// We don't need to do anything here, as this information cannot be extracted locally
+func (db *memoryDB) setSeen(_ context.Context, user *User) error {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	if u, ok := db.users[user.Username]; ok {
+		u.lastSeen = time.Now()
+	}
+	return nil
+}
+
+func (db *memoryDB) setCredentialIssued(_ context.Context, user *User) error {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	u, ok := db.users[user.Username]
+	if !ok {
+		return keyshare.ErrUserNotFound
+	}
+	u.credentialIssued = true
+	return nil
+}
+
+func (db *memoryDB) addLog(_ context.Context, user *User, eventType LogEventType, param interface{}) error {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	// The parameters are not kept, as the log cannot be extracted locally
+	db.logs = append(db.logs, memoryLogEntry{username: user.Username, event: eventType, time: time.Now()})
+	return nil
+}
+
+func (db *memoryDB) addEmailVerification(_ context.Context, user *User, emailAddress, tokenHash string, validity int) error {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	db.emailTokens[tokenHash] = &memoryEmailToken{
+		username: user.Username,
+		email:    emailAddress,
+		expiry:   time.Now().Add(time.Duration(validity) * time.Hour),
+	}
+	return nil
+}
+
+func (db *memoryDB) verifyEmail(_ context.Context, tokenHash string) error {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	t, ok := db.emailTokens[tokenHash]
+	if !ok || t.used || t.expiry.Before(time.Now()) {
+		return errEmailTokenInvalid
+	}
+
+	t.used = true
+	for _, email := range db.emails[t.username] {
+		if email == t.email {
+			return nil
+		}
+	}
+	db.emails[t.username] = append(db.emails[t.username], t.email)
+	return nil
+}
+
+func (db *memoryDB) emailVerified(_ context.Context, user *User) (bool, error) {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	return len(db.emails[user.Username]) > 0, nil
+}
+
+func (db *memoryDB) removeEmails(_ context.Context, user *User) error {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	db.removeEmail(user.Username, nil)
+	return nil
+}
+
+func (db *memoryDB) addUnsubscribeToken(_ context.Context, user *User, emailAddress, tokenHash string) error {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	db.unsubscribeTokens[tokenHash] = &memoryUnsubscribeToken{username: user.Username, email: emailAddress}
+	return nil
+}
+
+func (db *memoryDB) unsubscribe(_ context.Context, tokenHash string) (*User, error) {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	t, ok := db.unsubscribeTokens[tokenHash]
+	if !ok {
+		return nil, errUnsubscribeTokenInvalid
+	}
+	db.removeEmail(t.username, &t.email)
+	u, ok := db.users[t.username]
+	if !ok {
+		return nil, errUnsubscribeTokenInvalid
+	}
+	return &User{Username: t.username, Language: u.language, Secrets: u.secrets, version: u.version}, nil
+}
+
+// removeEmail removes the specified email address of the user (or all of them, if nil), along with
+// their pending verifications and unsubscribe tokens. The caller must hold the lock.
+func (db *memoryDB) removeEmail(username string, email *string) {
+	matches := func(u, e string) bool {
+		return u == username && (email == nil || e == *email)
+	}
+	var kept []string
+	for _, e := range db.emails[username] {
+		if !matches(username, e) {
+			kept = append(kept, e)
+		}
+	}
+	db.emails[username] = kept
+	for hash, t := range db.emailTokens {
+		if matches(t.username, t.email) {
+			delete(db.emailTokens, hash)
+		}
+	}
+	for hash, t := range db.unsubscribeTokens {
+		if matches(t.username, t.email) {
+			delete(db.unsubscribeTokens, hash)
+		}
+	}
+}
+
+func (db *memoryDB) addDevice(_ context.Context, user *User, device *Device) error {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	if _, exists := db.users[user.Username]; !exists {
+		return keyshare.ErrUserNotFound
+	}
+	if db.userDevices[user.Username] == nil {
+		db.userDevices[user.Username] = map[string]*Device{}
+	}
+	d := *device
+	db.userDevices[user.Username][device.ID] = &d
+	return nil
+}
+
+func (db *memoryDB) device(_ context.Context, user *User, id string) (*Device, error) {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	device, ok := db.userDevices[user.Username][id]
+	if !ok {
+		return nil, errDeviceNotFound
+	}
+	d := *device
+	return &d, nil
+}
+
+func (db *memoryDB) devices(_ context.Context, user *User) ([]*Device, error) {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	var devices []*Device
+	for _, device := range db.userDevices[user.Username] {
+		d := *device
+		devices = append(devices, &d)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Created.Before(devices[j].Created)
+	})
+	return devices, nil
+}
+
+func (db *memoryDB) updateDeviceSecrets(_ context.Context, user *User, id string, secrets keysharecore.UserSecrets) error {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	device, ok := db.userDevices[user.Username][id]
+	if !ok {
+		return errDeviceNotFound
+	}
+	device.Secrets = secrets
+	return nil
+}
+
+func (db *memoryDB) removeDevice(_ context.Context, user *User, id string) error {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	if _, ok := db.userDevices[user.Username][id]; !ok {
+		return errDeviceNotFound
+	}
+	delete(db.userDevices[user.Username], id)
+	return nil
+}
+
+func (db *memoryDB) addEnrollmentCode(_ context.Context, user *User, code string, validity time.Duration) error {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	db.enrollmentCodes[code] = &memoryEnrollmentCode{
+		username: user.Username,
+		expiry:   time.Now().Add(validity),
+	}
+	return nil
+}
+
+func (db *memoryDB) consumeEnrollmentCode(_ context.Context, user *User, code string) error {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	c, ok := db.enrollmentCodes[code]
+	if !ok || c.username != user.Username || c.expiry.Before(time.Now()) {
+		return errEnrollmentCodeInvalid
+	}
+	delete(db.enrollmentCodes, code)
+	return nil
+}
+
+func (db *memoryDB) addRecoveryToken(_ context.Context, user *User, tokenHash string, validity time.Duration) error {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	for hash, t := range db.recoveryTokens {
+		if t.username == user.Username {
+			delete(db.recoveryTokens, hash)
+		}
+	}
+	db.recoveryTokens[tokenHash] = &memoryRecoveryToken{
+		username: user.Username,
+		expiry:   time.Now().Add(validity),
+	}
 	return nil
 }
 
-func (db *memoryDB) addLog(user *User, eventType eventType, param interface{}) error {
-	// We don't need to do anything here, as this information cannot be extracted locally
+func (db *memoryDB) consumeRecoveryToken(_ context.Context, tokenHash string) (*User, error) {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	t, ok := db.recoveryTokens[tokenHash]
+	if !ok || t.expiry.Before(time.Now()) {
+		return nil, errRecoveryTokenInvalid
+	}
+	delete(db.recoveryTokens, tokenHash)
+	u, ok := db.users[t.username]
+	if !ok {
+		return nil, errRecoveryTokenInvalid
+	}
+	return &User{Username: t.username, Language: u.language, Secrets: u.secrets, version: u.version}, nil
+}
+
+func (db *memoryDB) userStats(_ context.Context) (*userStats, error) {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	registered := map[string]bool{} // usernames having registered an email address
+	for _, t := range db.emailTokens {
+		registered[t.username] = true
+	}
+
+	// Accounts are never blocked or scheduled for deletion in this testing DB
+	stats := &userStats{Accounts: len(db.users)}
+	for username, u := range db.users {
+		if len(db.emails[username]) > 0 {
+			stats.EmailVerified++
+		} else if registered[username] {
+			stats.EmailUnverified++
+		}
+		if u.credentialIssued {
+			stats.CredentialIssued++
+		} else {
+			stats.CredentialPending++
+		}
+	}
+	return stats, nil
+}
+
+func (db *memoryDB) listUsers(_ context.Context, after string, limit int) ([]*userMetadata, error) {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	var usernames []string
+	for username := range db.users {
+		if username > after {
+			usernames = append(usernames, username)
+		}
+	}
+	sort.Strings(usernames)
+	if len(usernames) > limit {
+		usernames = usernames[:limit]
+	}
+
+	users := make([]*userMetadata, 0, len(usernames))
+	for _, username := range usernames {
+		u := db.users[username]
+		created, lastSeen := irma.Timestamp(u.created), irma.Timestamp(u.lastSeen)
+		users = append(users, &userMetadata{
+			Username:      username,
+			Created:       &created,
+			LastSeen:      &lastSeen,
+			EmailVerified: len(db.emails[username]) > 0,
+		})
+	}
+	return users, nil
+}
+
+func (db *memoryDB) rollupUsage(_ context.Context, until time.Time) error {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	// Continue after the last aggregated day, or start at the day of the first session
+	var start time.Time
+	for date := range db.usage {
+		day, err := time.Parse(usageDateFormat, date)
+		if err != nil {
+			return err
+		}
+		if next := day.Add(24 * time.Hour); next.After(start) {
+			start = next
+		}
+	}
+	if start.IsZero() {
+		for _, entry := range db.logs {
+			if entry.event == LogEventIRMASession {
+				start = usageDay(entry.time)
+				break
+			}
+		}
+		if start.IsZero() {
+			return nil
+		}
+	}
+
+	for day := start; day.Before(usageDay(until)); day = day.Add(24 * time.Hour) {
+		db.aggregateUsage(day)
+	}
 	return nil
 }
 
-func (db *memoryDB) addEmailVerification(user *User, emailAddress, token string) error {
-	// We don't need to do anything here, as this information cannot be extracted locally
+func (db *memoryDB) deleteLogsBefore(_ context.Context, t time.Time, keepTypes []LogEventType, limit int) (int, error) {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	keep := map[LogEventType]struct{}{}
+	for _, eventType := range keepTypes {
+		keep[eventType] = struct{}{}
+	}
+	deleted, logs := 0, db.logs[:0]
+	for _, entry := range db.logs {
+		if _, ok := keep[entry.event]; !ok && deleted < limit && entry.time.Before(t) {
+			deleted++
+			continue
+		}
+		logs = append(logs, entry)
+	}
+	db.logs = logs
+	return deleted, nil
+}
+
+func (db *memoryDB) rebuildUsage(_ context.Context, day time.Time) error {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	db.aggregateUsage(usageDay(day))
 	return nil
 }
+
+// aggregateUsage computes the usage statistics of the day starting at the specified time.
+// It must be called with the lock held.
+func (db *memoryDB) aggregateUsage(day time.Time) {
+	stat := &usageStat{Date: day.Format(usageDateFormat)}
+	users := map[string]struct{}{}
+	for _, entry := range db.logs {
+		if entry.event == LogEventIRMASession && !entry.time.Before(day) && entry.time.Before(day.Add(24*time.Hour)) {
+			stat.Sessions++
+			users[entry.username] = struct{}{}
+		}
+	}
+	stat.Users = len(users)
+	db.usage[stat.Date] = stat
+}
+
+func (db *memoryDB) usageStats(_ context.Context, from, to time.Time) ([]*usageStat, error) {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	stats := []*usageStat{}
+	for day := usageDay(from); !day.After(usageDay(to)); day = day.Add(24 * time.Hour) {
+		if stat, ok := db.usage[day.Format(usageDateFormat)]; ok {
+			copied := *stat
+			stats = append(stats, &copied)
+		}
+	}
+	return stats, nil
+}
+
+func (db *memoryDB) usersAfter(_ context.Context, after string, limit int) ([]*User, error) {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	var usernames []string
+	for username := range db.users {
+		if username > after {
+			usernames = append(usernames, username)
+		}
+	}
+	sort.Strings(usernames)
+	if len(usernames) > limit {
+		usernames = usernames[:limit]
+	}
+
+	users := make([]*User, 0, len(usernames))
+	for _, username := range usernames {
+		u := db.users[username]
+		users = append(users, &User{Username: username, Language: u.language, Secrets: u.secrets, version: u.version})
+	}
+	return users, nil
+}
+
+func (db *memoryDB) replaceSecrets(_ context.Context, user *User, old keysharecore.UserSecrets) (bool, error) {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	u, ok := db.users[user.Username]
+	if !ok {
+		return false, keyshare.ErrUserNotFound
+	}
+	secrets := &u.secrets
+	if user.DeviceID != "" {
+		device, ok := db.userDevices[user.Username][user.DeviceID]
+		if !ok {
+			return false, errDeviceNotFound
+		}
+		secrets = &device.Secrets
+	}
+	if *secrets != old {
+		return false, nil
+	}
+	*secrets = user.Secrets
+	if user.DeviceID == "" {
+		u.version++
+	}
+	return true, nil
+}
+
+func (db *memoryDB) deleteExpiredEmailVerifications(_ context.Context, limit int) (int, error) {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	deleted, now := 0, time.Now()
+	for hash, t := range db.emailTokens {
+		if deleted == limit {
+			break
+		}
+		if t.expiry.Before(now) {
+			delete(db.emailTokens, hash)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// instrument does nothing, as the operations of memoryDB complete immediately.
+func (db *memoryDB) instrument(keyshare.DBInstrumentation) {}
@@ -1,7 +1,10 @@
 package keyshareserver
 
 import (
+	"context"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -11,36 +14,343 @@ func TestMemoryDBUserManagement(t *testing.T) {
 	db := NewMemoryDB()
 
 	user := &User{Username: "testuser"}
-	err := db.AddUser(user)
+	err := db.AddUser(context.Background(), user)
 	require.NoError(t, err)
 	assert.Equal(t, "testuser", user.Username)
 
-	nuser, err := db.user("testuser")
+	nuser, err := db.user(context.Background(), "testuser")
 	require.NoError(t, err)
 	assert.Equal(t, "testuser", nuser.Username)
 
-	_, err = db.user("nonexistent")
+	_, err = db.user(context.Background(), "nonexistent")
 	assert.Error(t, err)
 
 	user = &User{Username: "testuser"}
-	err = db.AddUser(user)
+	err = db.AddUser(context.Background(), user)
 	assert.Error(t, err)
 
-	err = db.updateUser(nuser)
+	err = db.updateUser(context.Background(), nuser)
 	assert.NoError(t, err)
 
-	err = db.addEmailVerification(nuser, "test@test.com", "testtoken")
+	err = db.addEmailVerification(context.Background(), nuser, "test@test.com", "testtoken", 24)
 	assert.NoError(t, err)
 
-	err = db.addLog(nuser, eventTypePinCheckSuccess, nil)
+	verified, err := db.emailVerified(context.Background(), nuser)
 	assert.NoError(t, err)
+	assert.False(t, verified)
 
-	ok, tries, wait, err := db.reservePinTry(nuser)
+	err = db.verifyEmail(context.Background(), "testtoken")
+	assert.NoError(t, err)
+	err = db.verifyEmail(context.Background(), "testtoken")
+	assert.Equal(t, errEmailTokenInvalid, err)
+	err = db.verifyEmail(context.Background(), "nonexistent")
+	assert.Equal(t, errEmailTokenInvalid, err)
+
+	err = db.addEmailVerification(context.Background(), nuser, "test@test.com", "expiredtoken", -1)
+	assert.NoError(t, err)
+	err = db.verifyEmail(context.Background(), "expiredtoken")
+	assert.Equal(t, errEmailTokenInvalid, err)
+
+	verified, err = db.emailVerified(context.Background(), nuser)
+	assert.NoError(t, err)
+	assert.True(t, verified)
+
+	err = db.addLog(context.Background(), nuser, LogEventPinCheckSuccess, nil)
+	assert.NoError(t, err)
+
+	ok, tries, wait, err := db.reservePinTry(context.Background(), nuser)
 	assert.NoError(t, err)
 	assert.True(t, ok)
 	assert.True(t, tries > 0)
 	assert.Equal(t, int64(0), wait)
 
-	err = db.setSeen(nuser)
+	err = db.setSeen(context.Background(), nuser)
 	assert.NoError(t, err)
 }
+
+func TestMemoryDBDevices(t *testing.T) {
+	testDevices(t, NewMemoryDB())
+}
+
+// testDevices tests the management of additional devices and device enrollment codes of the DB.
+func testDevices(t *testing.T, db DB) {
+	user := &User{Username: "testuser"}
+	require.NoError(t, db.AddUser(context.Background(), user))
+	user, err := db.user(context.Background(), "testuser")
+	require.NoError(t, err)
+
+	devices, err := db.devices(context.Background(), user)
+	require.NoError(t, err)
+	assert.Empty(t, devices)
+
+	created := time.Unix(time.Now().Unix(), 0)
+	require.NoError(t, db.addDevice(context.Background(), user, &Device{ID: "tablet", Name: "Tablet", Secrets: user.Secrets, Created: created}))
+	require.NoError(t, db.addDevice(context.Background(), user, &Device{ID: "laptop", Created: created.Add(time.Second)}))
+
+	device, err := db.device(context.Background(), user, "tablet")
+	require.NoError(t, err)
+	assert.Equal(t, &Device{ID: "tablet", Name: "Tablet", Secrets: user.Secrets, Created: created}, device)
+	_, err = db.device(context.Background(), user, "nonexistent")
+	assert.Equal(t, errDeviceNotFound, err)
+
+	devices, err = db.devices(context.Background(), user)
+	require.NoError(t, err)
+	require.Len(t, devices, 2)
+	assert.Equal(t, "tablet", devices[0].ID)
+	assert.Equal(t, "laptop", devices[1].ID)
+
+	device.Secrets[0] ^= 1
+	require.NoError(t, db.updateDeviceSecrets(context.Background(), user, "tablet", device.Secrets))
+	updated, err := db.device(context.Background(), user, "tablet")
+	require.NoError(t, err)
+	assert.Equal(t, device.Secrets, updated.Secrets)
+	assert.Equal(t, errDeviceNotFound, db.updateDeviceSecrets(context.Background(), user, "nonexistent", device.Secrets))
+
+	require.NoError(t, db.removeDevice(context.Background(), user, "tablet"))
+	assert.Equal(t, errDeviceNotFound, db.removeDevice(context.Background(), user, "tablet"))
+	_, err = db.device(context.Background(), user, "tablet")
+	assert.Equal(t, errDeviceNotFound, err)
+
+	require.NoError(t, db.addEnrollmentCode(context.Background(), user, "code", time.Minute))
+	require.NoError(t, db.addEnrollmentCode(context.Background(), user, "expiredcode", -time.Minute))
+	assert.Equal(t, errEnrollmentCodeInvalid, db.consumeEnrollmentCode(context.Background(), user, "nonexistent"))
+	assert.Equal(t, errEnrollmentCodeInvalid, db.consumeEnrollmentCode(context.Background(), user, "expiredcode"))
+	assert.Equal(t, errEnrollmentCodeInvalid, db.consumeEnrollmentCode(context.Background(), &User{Username: "otheruser"}, "code"))
+	assert.NoError(t, db.consumeEnrollmentCode(context.Background(), user, "code"))
+	assert.Equal(t, errEnrollmentCodeInvalid, db.consumeEnrollmentCode(context.Background(), user, "code"))
+}
+
+func TestMemoryDBRecoveryTokens(t *testing.T) {
+	testRecoveryTokens(t, NewMemoryDB())
+}
+
+// testRecoveryTokens tests the storage of recovery tokens of the DB.
+func testRecoveryTokens(t *testing.T, db DB) {
+	user := &User{Username: "testuser"}
+	require.NoError(t, db.AddUser(context.Background(), user))
+	user, err := db.user(context.Background(), "testuser")
+	require.NoError(t, err)
+
+	require.NoError(t, db.addRecoveryToken(context.Background(), user, "expiredtoken", -time.Minute))
+	_, err = db.consumeRecoveryToken(context.Background(), "expiredtoken")
+	assert.Equal(t, errRecoveryTokenInvalid, err)
+
+	// A new token replaces the previous one of the user
+	require.NoError(t, db.addRecoveryToken(context.Background(), user, "oldtoken", time.Minute))
+	require.NoError(t, db.addRecoveryToken(context.Background(), user, "token", time.Minute))
+	_, err = db.consumeRecoveryToken(context.Background(), "oldtoken")
+	assert.Equal(t, errRecoveryTokenInvalid, err)
+	_, err = db.consumeRecoveryToken(context.Background(), "nonexistent")
+	assert.Equal(t, errRecoveryTokenInvalid, err)
+
+	recovered, err := db.consumeRecoveryToken(context.Background(), "token")
+	require.NoError(t, err)
+	assert.Equal(t, "testuser", recovered.Username)
+	_, err = db.consumeRecoveryToken(context.Background(), "token")
+	assert.Equal(t, errRecoveryTokenInvalid, err)
+}
+
+func TestMemoryDBEmails(t *testing.T) {
+	testEmails(t, NewMemoryDB())
+}
+
+// testEmails tests the removal of email addresses from the DB.
+func testEmails(t *testing.T, db DB) {
+	ctx := context.Background()
+	require.NoError(t, db.AddUser(ctx, &User{Username: "testuser"}))
+	require.NoError(t, db.AddUser(ctx, &User{Username: "otheruser"}))
+	user, err := db.user(ctx, "testuser")
+	require.NoError(t, err)
+	other, err := db.user(ctx, "otheruser")
+	require.NoError(t, err)
+
+	addEmail := func(user *User, email, token string) {
+		require.NoError(t, db.addEmailVerification(ctx, user, email, token, 24))
+		require.NoError(t, db.addUnsubscribeToken(ctx, user, email, "unsubscribe"+token))
+	}
+	verified := func(user *User) bool {
+		verified, err := db.emailVerified(ctx, user)
+		require.NoError(t, err)
+		return verified
+	}
+	addEmail(user, "test@example.com", "token")
+	require.NoError(t, db.verifyEmail(ctx, "token"))
+	addEmail(user, "pending@example.com", "pendingtoken")
+	addEmail(other, "test@example.com", "othertoken")
+	require.NoError(t, db.verifyEmail(ctx, "othertoken"))
+
+	// Unsubscribing removes only the address of the user for which the token was stored
+	_, err = db.unsubscribe(ctx, "nonexistent")
+	assert.Equal(t, errUnsubscribeTokenInvalid, err)
+	unsubscribed, err := db.unsubscribe(ctx, "unsubscribetoken")
+	require.NoError(t, err)
+	assert.Equal(t, "testuser", unsubscribed.Username)
+	assert.False(t, verified(user))
+	assert.True(t, verified(other))
+	_, err = db.unsubscribe(ctx, "unsubscribetoken")
+	assert.Equal(t, errUnsubscribeTokenInvalid, err)
+	require.NoError(t, db.verifyEmail(ctx, "pendingtoken"))
+	assert.True(t, verified(user))
+
+	// Removing the addresses of the user also removes their pending verifications and unsubscribe tokens
+	addEmail(user, "new@example.com", "newtoken")
+	require.NoError(t, db.removeEmails(ctx, user))
+	assert.False(t, verified(user))
+	assert.Equal(t, errEmailTokenInvalid, db.verifyEmail(ctx, "newtoken"))
+	_, err = db.unsubscribe(ctx, "unsubscribependingtoken")
+	assert.Equal(t, errUnsubscribeTokenInvalid, err)
+	assert.True(t, verified(other))
+}
+
+func TestMemoryDBUsage(t *testing.T) {
+	testUsage(t, NewMemoryDB())
+}
+
+// testUsage tests the aggregation of keyshare sessions into usage statistics of the DB. As the log
+// entries are recorded at the current time, the days up to and including today are aggregated by
+// rolling up until tomorrow.
+func testUsage(t *testing.T, db DB) {
+	ctx := context.Background()
+	today := usageDay(time.Now())
+	tomorrow := today.Add(24 * time.Hour)
+
+	// Without sessions, there is nothing to aggregate
+	require.NoError(t, db.rollupUsage(ctx, tomorrow))
+	stats, err := db.usageStats(ctx, today.Add(-7*24*time.Hour), tomorrow)
+	require.NoError(t, err)
+	assert.Empty(t, stats)
+
+	alice, bob := &User{Username: "alice"}, &User{Username: "bob"}
+	require.NoError(t, db.AddUser(ctx, alice))
+	require.NoError(t, db.AddUser(ctx, bob))
+	require.NoError(t, db.addLog(ctx, alice, LogEventIRMASession, nil))
+	require.NoError(t, db.addLog(ctx, alice, LogEventIRMASession, nil))
+	require.NoError(t, db.addLog(ctx, bob, LogEventIRMASession, nil))
+	require.NoError(t, db.addLog(ctx, bob, LogEventPinCheckSuccess, nil))
+
+	// Days that have not ended are not aggregated
+	require.NoError(t, db.rollupUsage(ctx, time.Now()))
+	stats, err = db.usageStats(ctx, today, today)
+	require.NoError(t, err)
+	assert.Empty(t, stats)
+
+	// Aggregating the same day twice has no effect
+	expected := []*usageStat{{Date: today.Format(usageDateFormat), Sessions: 3, Users: 2}}
+	for i := 0; i < 2; i++ {
+		require.NoError(t, db.rollupUsage(ctx, tomorrow))
+		stats, err = db.usageStats(ctx, today, today)
+		require.NoError(t, err)
+		assert.Equal(t, expected, stats)
+	}
+
+	// Aggregated days are not aggregated again, and days without sessions are included
+	require.NoError(t, db.addLog(ctx, bob, LogEventIRMASession, nil))
+	require.NoError(t, db.rollupUsage(ctx, tomorrow.Add(24*time.Hour)))
+	stats, err = db.usageStats(ctx, today.Add(-24*time.Hour), tomorrow.Add(24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, append(expected, &usageStat{Date: tomorrow.Format(usageDateFormat)}), stats)
+
+	stats, err = db.usageStats(ctx, tomorrow, tomorrow)
+	require.NoError(t, err)
+	assert.Len(t, stats, 1)
+}
+
+func TestMemoryDBDeleteLogsBefore(t *testing.T) {
+	testDeleteLogsBefore(t, NewMemoryDB())
+}
+
+// testDeleteLogsBefore tests the deletion of log entries of the DB. As the log entries are recorded
+// at the current time, they are deleted by deleting the entries from before a second from now.
+func testDeleteLogsBefore(t *testing.T, db DB) {
+	ctx := context.Background()
+	alice := &User{Username: "alice"}
+	require.NoError(t, db.AddUser(ctx, alice))
+	for i := 0; i < 3; i++ {
+		require.NoError(t, db.addLog(ctx, alice, LogEventIRMASession, nil))
+	}
+	require.NoError(t, db.addLog(ctx, alice, LogEventPinCheckFailed, 2))
+	require.NoError(t, db.addLog(ctx, alice, LogEventPinCheckBlocked, 60))
+
+	// Entries from after the specified time are kept
+	deleted, err := db.deleteLogsBefore(ctx, time.Now().Add(-time.Hour), nil, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+
+	// At most limit entries are deleted, keeping those of the specified types
+	later := time.Now().Add(time.Second)
+	keep := []LogEventType{LogEventPinCheckFailed, LogEventPinCheckBlocked}
+	deleted, err = db.deleteLogsBefore(ctx, later, keep, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+	deleted, err = db.deleteLogsBefore(ctx, later, keep, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	deleted, err = db.deleteLogsBefore(ctx, later, keep, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+
+	deleted, err = db.deleteLogsBefore(ctx, later, []LogEventType{LogEventPinCheckBlocked}, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	deleted, err = db.deleteLogsBefore(ctx, later, nil, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+}
+
+func TestMemoryDBUserAdministration(t *testing.T) {
+	testUserAdministration(t, NewMemoryDB(), 10000)
+}
+
+// testUserAdministration tests the user statistics and pagination of the DB on n synthetic users,
+// of which every third has a verified email address and every fifth (if not verified) an unverified one,
+// and every other one has been issued the keyshare credential.
+func testUserAdministration(t *testing.T, db DB, n int) {
+	verified, unverified, issued := 0, 0, 0
+	for i := 0; i < n; i++ {
+		user := &User{Username: fmt.Sprintf("user%06d", i)}
+		require.NoError(t, db.AddUser(context.Background(), user))
+		if i%2 == 0 {
+			require.NoError(t, db.setCredentialIssued(context.Background(), user))
+			issued++
+		}
+		switch {
+		case i%3 == 0:
+			token := fmt.Sprintf("token%06d", i)
+			require.NoError(t, db.addEmailVerification(context.Background(), user, "test@example.com", token, 24))
+			require.NoError(t, db.verifyEmail(context.Background(), token))
+			verified++
+		case i%5 == 0:
+			require.NoError(t, db.addEmailVerification(context.Background(), user, "test@example.com", fmt.Sprintf("token%06d", i), 24))
+			unverified++
+		}
+	}
+
+	stats, err := db.userStats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, n, stats.Accounts)
+	assert.Equal(t, verified, stats.EmailVerified)
+	assert.Equal(t, unverified, stats.EmailUnverified)
+	assert.Equal(t, issued, stats.CredentialIssued)
+	assert.Equal(t, n-issued, stats.CredentialPending)
+
+	// Page through all users, which must each be returned once in order
+	i, cursor := 0, ""
+	for {
+		users, err := db.listUsers(context.Background(), cursor, 999)
+		require.NoError(t, err)
+		if len(users) == 0 {
+			break
+		}
+		require.True(t, len(users) <= 999)
+		for _, user := range users {
+			require.Equal(t, fmt.Sprintf("user%06d", i), user.Username)
+			require.Equal(t, i%3 == 0, user.EmailVerified)
+			require.NotNil(t, user.Created)
+			require.NotNil(t, user.LastSeen)
+			require.Nil(t, user.BlockedUntil)
+			i++
+		}
+		cursor = users[len(users)-1].Username
+	}
+	require.Equal(t, n, i)
+}
@@ -0,0 +1,241 @@
+package keyshareserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var errUnknownSigningKey = errors.New("ID token signed with unknown key")
+
+const (
+	// Maximum age of the cached keys of the OpenID Connect provider
+	oidcKeysMaxAge = time.Hour
+	// Minimum time between refetching the keys when encountering an unknown key ID
+	oidcKeysMinRefetch = time.Minute
+)
+
+// oidcVerifier verifies ID tokens issued by an OpenID Connect provider, using the keys from the
+// JSON Web Key Set of the provider, which it fetches and caches.
+type oidcVerifier struct {
+	issuer         string
+	audience       string
+	requiredClaims map[string]string
+	jwksURL        string
+	client         *http.Client
+	// Tolerance for the time claims of ID tokens
+	clockSkewTolerance time.Duration
+
+	mutex   sync.Mutex
+	keys    map[string]interface{}
+	fetched time.Time
+}
+
+func newOIDCVerifier(conf *Configuration) *oidcVerifier {
+	return &oidcVerifier{
+		issuer:         conf.OIDCIssuer,
+		audience:       conf.OIDCAudience,
+		requiredClaims: conf.OIDCRequiredClaims,
+		jwksURL:        conf.OIDCJWKSURL,
+		client:         conf.Egress.Client(false),
+
+		clockSkewTolerance: conf.IrmaConfiguration.ClockSkewTolerance(),
+	}
+}
+
+// verify checks the signature and claims of the ID token, returning its subject.
+func (v *oidcVerifier) verify(idToken string) (string, error) {
+	// We check the time claims ourselves below, to take clock skew into account.
+	parser := &jwt.Parser{
+		ValidMethods:         []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"},
+		SkipClaimsValidation: true,
+	}
+	token, err := parser.Parse(idToken, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return v.key(kid)
+	})
+	if err != nil {
+		return "", errors.WrapPrefix(err, "invalid ID token", 0)
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	now, tolerance := time.Now(), v.clockSkewTolerance
+	if !claims.VerifyExpiresAt(now.Add(-tolerance).Unix(), true) ||
+		!claims.VerifyIssuedAt(now.Add(tolerance).Unix(), false) ||
+		!claims.VerifyNotBefore(now.Add(tolerance).Unix(), false) {
+		return "", errors.New("invalid ID token: token expired or not yet valid")
+	}
+	if !claims.VerifyIssuer(v.issuer, true) {
+		return "", errors.New("invalid ID token: wrong issuer")
+	}
+	if !claims.VerifyAudience(v.audience, true) {
+		return "", errors.New("invalid ID token: wrong audience")
+	}
+	for name, value := range v.requiredClaims {
+		if claim, ok := claims[name]; !ok || fmt.Sprint(claim) != value {
+			return "", errors.New("invalid ID token: required claim " + name + " missing or wrong")
+		}
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return "", errors.New("invalid ID token: missing subject")
+	}
+	return subject, nil
+}
+
+// key returns the key with the specified ID from the cached keys of the provider,
+// refetching them when they are too old or when the key is not known.
+func (v *oidcVerifier) key(kid string) (interface{}, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	since := time.Since(v.fetched)
+	if v.keys == nil || since > oidcKeysMaxAge || (v.lookup(kid) == nil && since > oidcKeysMinRefetch) {
+		keys, err := v.fetchKeys()
+		if err != nil {
+			return nil, err
+		}
+		v.keys, v.fetched = keys, time.Now()
+	}
+	if key := v.lookup(kid); key != nil {
+		return key, nil
+	}
+	return nil, errUnknownSigningKey
+}
+
+func (v *oidcVerifier) lookup(kid string) interface{} {
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key
+		}
+	}
+	return v.keys[kid]
+}
+
+func (v *oidcVerifier) fetchKeys() (map[string]interface{}, error) {
+	if v.jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.get(strings.TrimSuffix(v.issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, errors.WrapPrefix(err, "failed to fetch OpenID Connect discovery document", 0)
+		}
+		if discovery.JWKSURI == "" {
+			return nil, errors.New("OpenID Connect discovery document contains no jwks_uri")
+		}
+		v.jwksURL = discovery.JWKSURI
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := v.get(v.jwksURL, &jwks); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to fetch OpenID Connect keys", 0)
+	}
+	keys := map[string]interface{}{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "failed to parse OpenID Connect key "+jwk.Kid, 0)
+		}
+		if key != nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (v *oidcVerifier) get(url string, result interface{}) error {
+	res, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("%s returned status %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// jsonWebKey is a public key from a JSON Web Key Set (RFC 7517).
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+
+	// RSA keys
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// Elliptic curve keys
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey returns the RSA or ECDSA public key, or nil for keys of other types.
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBase64Int(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64Int(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() {
+			return nil, errors.New("RSA exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeBase64Int(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBase64Int(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, nil
+	}
+}
+
+func decodeBase64Int(s string) (*big.Int, error) {
+	bts, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(bts), nil
+}
@@ -0,0 +1,91 @@
+package keyshareserver
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// Descriptions of the PIN statuses, with fmt verbs for the amount of remaining attempts and the
+// (formatted) duration that the user is blocked respectively.
+var (
+	pinFailureDescriptions = map[string]string{
+		"en": "Wrong PIN. You have %d attempts left.",
+		"nl": "Verkeerde pincode. Je hebt nog %d pogingen.",
+	}
+	pinLastAttemptDescriptions = map[string]string{
+		"en": "Wrong PIN. You have one attempt left, after which your account is temporarily blocked.",
+		"nl": "Verkeerde pincode. Je hebt nog één poging, waarna je account tijdelijk geblokkeerd wordt.",
+	}
+	pinBlockedDescriptions = map[string]string{
+		"en": "Your account is blocked for %s because of too many wrong PIN attempts.",
+		"nl": "Je account is %s geblokkeerd vanwege te veel verkeerde pincodes.",
+	}
+	durationUnits = map[string][4][2]string{
+		"en": {{"second", "seconds"}, {"minute", "minutes"}, {"hour", "hours"}, {"day", "days"}},
+		"nl": {{"seconde", "seconden"}, {"minuut", "minuten"}, {"uur", "uur"}, {"dag", "dagen"}},
+	}
+)
+
+func pinStatusFailure(tries int) irma.KeysharePinStatus {
+	return irma.KeysharePinStatus{Status: "failure", Message: fmt.Sprintf("%v", tries), Remaining: tries}
+}
+
+func pinStatusBlocked(wait int64) irma.KeysharePinStatus {
+	return irma.KeysharePinStatus{Status: "error", Message: fmt.Sprintf("%v", wait), Blocked: wait}
+}
+
+// translatePinStatus sets the description of a failure or error PIN status, in the first of the
+// given languages for which a translation exists (see keyshare.EmailConfiguration.Language).
+func (s *Server) translatePinStatus(status *irma.KeysharePinStatus, langs ...string) {
+	switch status.Status {
+	case "failure":
+		if status.Remaining == 1 {
+			status.Language = s.conf.Language(pinLastAttemptDescriptions, langs...)
+			status.Description = pinLastAttemptDescriptions[status.Language]
+		} else {
+			status.Language = s.conf.Language(pinFailureDescriptions, langs...)
+			status.Description = fmt.Sprintf(pinFailureDescriptions[status.Language], status.Remaining)
+		}
+	case "error":
+		status.Language = s.conf.Language(pinBlockedDescriptions, langs...)
+		status.Description = fmt.Sprintf(pinBlockedDescriptions[status.Language],
+			formatDuration(status.Blocked, status.Language))
+	}
+}
+
+// formatDuration formats the amount of seconds in the largest unit in which it is at least 1,
+// rounding up (e.g. 2 minutes for 61 seconds).
+func formatDuration(seconds int64, lang string) string {
+	units := durationUnits[lang]
+	sizes := [4]int64{1, 60, 60 * 60, 24 * 60 * 60}
+	i := len(sizes) - 1
+	for i > 0 && seconds < sizes[i] {
+		i--
+	}
+	amount := (seconds + sizes[i] - 1) / sizes[i]
+	if amount == 1 {
+		return fmt.Sprintf("%d %s", amount, units[i][0])
+	}
+	return fmt.Sprintf("%d %s", amount, units[i][1])
+}
+
+// requestedLanguages returns the languages requested in the specified message field, or else in the
+// Accept-Language header, in order of preference.
+func requestedLanguages(r *http.Request, lang string) []string {
+	if lang != "" {
+		return []string{lang}
+	}
+	var langs []string
+	for _, tag := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		if i := strings.Index(tag, ";"); i >= 0 {
+			tag = tag[:i]
+		}
+		if tag = strings.TrimSpace(tag); tag != "" && tag != "*" {
+			langs = append(langs, tag)
+		}
+	}
+	return langs
+}
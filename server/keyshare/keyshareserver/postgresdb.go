@@ -1,13 +1,17 @@
 package keyshareserver
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"strings"
 	"time"
 
 	"github.com/go-errors/errors"
 	_ "github.com/jackc/pgx/stdlib"
+	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/privacybydesign/irmago/internal/keysharecore"
 	"github.com/privacybydesign/irmago/server/keyshare"
 )
 
@@ -19,8 +23,7 @@ type postgresDB struct {
 	db keyshare.DB
 }
 
-const maxPinTries = 3         // Number of tries allowed on pin before we start with exponential backoff
-const emailTokenValidity = 24 // amount of time user's email validation token is valid (in hours)
+const maxPinTries = 3 // Number of tries allowed on pin before we start with exponential backoff
 
 // Initial amount of time user is forced to back off when having multiple pin failures (in seconds).
 // var so that tests may change it.
@@ -32,6 +35,7 @@ func newPostgresDB(connstring string) (DB, error) {
 		return nil, err
 	}
 	if err = db.Ping(); err != nil {
+		_ = db.Close()
 		return nil, errors.Errorf("failed to connect to database: %v", err)
 	}
 	return &postgresDB{
@@ -39,19 +43,36 @@ func newPostgresDB(connstring string) (DB, error) {
 	}, nil
 }
 
-func (db *postgresDB) AddUser(user *User) error {
-	res, err := db.db.Query("INSERT INTO irma.users (username, language, coredata, last_seen, pin_counter, pin_block_date) VALUES ($1, $2, $3, $4, 0, 0) RETURNING id",
+// Close closes the connection pool of the database.
+func (db *postgresDB) Close() error {
+	return db.db.Close()
+}
+
+func (db *postgresDB) failingFor() time.Duration {
+	return db.db.FailingFor()
+}
+
+func (db *postgresDB) instrument(instr keyshare.DBInstrumentation) {
+	db.db.Instrumentation = instr
+}
+
+func (db *postgresDB) AddUser(ctx context.Context, user *User) error {
+	ctx, done := db.db.Operation(ctx, "AddUser")
+	defer done()
+
+	res, err := db.db.QueryContext(ctx, "INSERT INTO irma.users (username, language, coredata, last_seen, pin_counter, pin_block_date, oidc_subject, created, credential_issued) VALUES ($1, $2, $3, $4, 0, 0, $5, $4, false) RETURNING id",
 		user.Username,
 		user.Language,
 		user.Secrets[:],
-		time.Now().Unix())
+		time.Now().Unix(),
+		sql.NullString{String: user.OIDCSubject, Valid: user.OIDCSubject != ""})
 	if err != nil {
-		return err
+		return accountExistsError(err)
 	}
 	defer common.Close(res)
 	if !res.Next() {
 		if err = res.Err(); err != nil {
-			return err
+			return accountExistsError(err)
 		}
 		return errUserAlreadyExists
 	}
@@ -64,13 +85,36 @@ func (db *postgresDB) AddUser(user *User) error {
 	return nil
 }
 
-func (db *postgresDB) user(username string) (*User, error) {
+// accountExistsError returns errAccountExists if inserting a user failed because another user is
+// already bound to its OIDC subject (e.g. when registering concurrently), and err otherwise.
+func accountExistsError(err error) error {
+	if keyshare.IsUniqueViolation(err, "oidc_subject_index") {
+		return errAccountExists
+	}
+	return err
+}
+
+func (db *postgresDB) user(ctx context.Context, username string) (*User, error) {
+	ctx, done := db.db.Operation(ctx, "user")
+	defer done()
+
+	return db.queryUser(ctx, "username = $1", username)
+}
+
+func (db *postgresDB) userByOIDCSubject(ctx context.Context, subject string) (*User, error) {
+	ctx, done := db.db.Operation(ctx, "userByOIDCSubject")
+	defer done()
+
+	return db.queryUser(ctx, "oidc_subject = $1", subject)
+}
+
+func (db *postgresDB) queryUser(ctx context.Context, where string, arg interface{}) (*User, error) {
 	var result User
 	var secrets []byte
-	err := db.db.QueryUser(
-		"SELECT id, username, language, coredata FROM irma.users WHERE username = $1 AND coredata IS NOT NULL",
-		[]interface{}{&result.id, &result.Username, &result.Language, &secrets},
-		username,
+	err := db.db.QueryUserContext(ctx,
+		"SELECT id, username, language, coredata, COALESCE(oidc_subject, ''), version FROM irma.users WHERE "+where+" AND coredata IS NOT NULL",
+		[]interface{}{&result.id, &result.Username, &result.Language, &secrets, &result.OIDCSubject, &result.version},
+		arg,
 	)
 	if err != nil {
 		return nil, err
@@ -82,20 +126,43 @@ func (db *postgresDB) user(username string) (*User, error) {
 	return &result, nil
 }
 
-func (db *postgresDB) updateUser(user *User) error {
-	return db.db.ExecUser(
-		"UPDATE irma.users SET username = $1, language = $2, coredata = $3 WHERE id=$4",
+func (db *postgresDB) updateUser(ctx context.Context, user *User) error {
+	ctx, done := db.db.Operation(ctx, "updateUser")
+	defer done()
+
+	c, err := db.db.ExecCountContext(ctx,
+		"UPDATE irma.users SET username = $1, language = $2, coredata = $3, version = version + 1 WHERE id = $4 AND version = $5",
 		user.Username,
 		user.Language,
 		user.Secrets[:],
 		user.id,
+		user.version,
 	)
+	if err != nil {
+		return err
+	}
+	if c == 0 {
+		// Either the user was changed in the meantime, or it does not exist
+		err = db.db.QueryScanContext(ctx, "SELECT 1 FROM irma.users WHERE id = $1", nil, user.id)
+		if err == sql.ErrNoRows {
+			return keyshare.ErrUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return errUpdateConflict
+	}
+	user.version++
+	return nil
 }
 
-func (db *postgresDB) reservePinTry(user *User) (bool, int, int64, error) {
+func (db *postgresDB) reservePinTry(ctx context.Context, user *User) (bool, int, int64, error) {
+	ctx, done := db.db.Operation(ctx, "reservePinTry")
+	defer done()
+
 	// Check that account is not blocked already, and if not,
 	//  update pinCounter and pinBlockDate
-	uprows, err := db.db.Query(`
+	uprows, err := db.db.QueryContext(ctx, `
 		UPDATE irma.users
 		SET pin_counter = pin_counter+1,
 			pin_block_date = $1 + CASE WHEN pin_counter-$3 < 0 THEN 0
@@ -123,7 +190,7 @@ func (db *postgresDB) reservePinTry(user *User) (bool, int, int64, error) {
 		}
 		// if no results, then account either does not exist (which would be weird here) or is blocked
 		// so request wait timeout
-		pinrows, err := db.db.Query("SELECT pin_block_date FROM irma.users WHERE id=$1 AND coredata IS NOT NULL", user.id)
+		pinrows, err := db.db.QueryContext(ctx, "SELECT pin_block_date FROM irma.users WHERE id=$1 AND coredata IS NOT NULL", user.id)
 		if err != nil {
 			return false, 0, 0, err
 		}
@@ -159,18 +226,53 @@ func (db *postgresDB) reservePinTry(user *User) (bool, int, int64, error) {
 	return allowed, tries, wait, nil
 }
 
-func (db *postgresDB) resetPinTries(user *User) error {
-	return db.db.ExecUser(
+func (db *postgresDB) pinTries(ctx context.Context, user *User) (int, int64, error) {
+	ctx, done := db.db.Operation(ctx, "pinTries")
+	defer done()
+
+	var (
+		counter int
+		wait    int64
+	)
+	err := db.db.QueryUserContext(ctx,
+		"SELECT pin_counter, pin_block_date FROM irma.users WHERE id = $1 AND coredata IS NOT NULL",
+		[]interface{}{&counter, &wait},
+		user.id,
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	wait = wait - time.Now().Unix()
+	if wait > 0 {
+		return 0, wait, nil
+	}
+	// After a block has passed, reservePinTry allows one more attempt before blocking again
+	tries := maxPinTries - counter
+	if tries < 1 {
+		tries = 1
+	}
+	return tries, 0, nil
+}
+
+func (db *postgresDB) resetPinTries(ctx context.Context, user *User) error {
+	ctx, done := db.db.Operation(ctx, "resetPinTries")
+	defer done()
+
+	return db.db.ExecUserContext(ctx,
 		"UPDATE irma.users SET pin_counter = 0, pin_block_date = 0 WHERE id = $1",
 		user.id,
 	)
 }
 
-func (db *postgresDB) setSeen(user *User) error {
+func (db *postgresDB) setSeen(ctx context.Context, user *User) error {
+	ctx, done := db.db.Operation(ctx, "setSeen")
+	defer done()
+
 	// If the user is scheduled for deletion (delete_on is not null), undo that by resetting
 	// delete_on back to null, but only if the user did not explicitly delete her account herself
 	// in the myIRMA website, in which case coredata is null.
-	return db.db.ExecUser(
+	return db.db.ExecUserContext(ctx,
 		`UPDATE irma.users
 		 SET last_seen = $1,
 		     delete_on = CASE
@@ -182,7 +284,17 @@ func (db *postgresDB) setSeen(user *User) error {
 	)
 }
 
-func (db *postgresDB) addLog(user *User, eventType eventType, param interface{}) error {
+func (db *postgresDB) setCredentialIssued(ctx context.Context, user *User) error {
+	ctx, done := db.db.Operation(ctx, "setCredentialIssued")
+	defer done()
+
+	return db.db.ExecUserContext(ctx, "UPDATE irma.users SET credential_issued = true WHERE id = $1", user.id)
+}
+
+func (db *postgresDB) addLog(ctx context.Context, user *User, eventType LogEventType, param interface{}) error {
+	ctx, done := db.db.Operation(ctx, "addLog")
+	defer done()
+
 	var encodedParamString *string
 	if param != nil {
 		encodedParam, err := json.Marshal(param)
@@ -193,7 +305,7 @@ func (db *postgresDB) addLog(user *User, eventType eventType, param interface{})
 		encodedParamString = &encodedParams
 	}
 
-	_, err := db.db.Exec("INSERT INTO irma.log_entry_records (time, event, param, user_id) VALUES ($1, $2, $3, $4)",
+	_, err := db.db.ExecContext(ctx, "INSERT INTO irma.log_entry_records (time, event, param, user_id) VALUES ($1, $2, $3, $4)",
 		time.Now().Unix(),
 		eventType,
 		encodedParamString,
@@ -201,11 +313,497 @@ func (db *postgresDB) addLog(user *User, eventType eventType, param interface{})
 	return err
 }
 
-func (db *postgresDB) addEmailVerification(user *User, emailAddress, token string) error {
-	_, err := db.db.Exec("INSERT INTO irma.email_verification_tokens (token, email, user_id, expiry) VALUES ($1, $2, $3, $4)",
-		token,
+func (db *postgresDB) addEmailVerification(ctx context.Context, user *User, emailAddress, tokenHash string, validity int) error {
+	ctx, done := db.db.Operation(ctx, "addEmailVerification")
+	defer done()
+
+	_, err := db.db.ExecContext(ctx, "INSERT INTO irma.email_verification_tokens (token_hash, email, user_id, expiry) VALUES ($1, $2, $3, $4)",
+		tokenHash,
+		emailAddress,
+		user.id,
+		time.Now().Add(time.Duration(validity)*time.Hour).Unix())
+	return err
+}
+
+func (db *postgresDB) verifyEmail(ctx context.Context, tokenHash string) error {
+	ctx, done := db.db.Operation(ctx, "verifyEmail")
+	defer done()
+
+	// Mark the token as used in the same query that checks it, so that it can be used only once.
+	// Unknown, expired and used tokens all fail this single query, so that they cannot be told
+	// apart by the response or its timing.
+	var id int64
+	var email string
+	err := db.db.QueryScanContext(ctx,
+		"UPDATE irma.email_verification_tokens SET used = TRUE WHERE token_hash = $1 AND expiry >= $2 AND NOT used RETURNING user_id, email",
+		[]interface{}{&id, &email},
+		tokenHash, time.Now().Unix())
+	if err == sql.ErrNoRows {
+		return errEmailTokenInvalid
+	}
+	if err != nil {
+		return err
+	}
+
+	// Try to restore email in process of deletion
+	aff, err := db.db.ExecCountContext(ctx, "UPDATE irma.emails SET delete_on = NULL WHERE user_id = $1 AND email = $2", id, email)
+	if err != nil {
+		return err
+	}
+	if aff > 1 {
+		return errors.Errorf("Unexpected number of affected rows %d for email adding", aff)
+	}
+	if aff == 1 {
+		return nil
+	}
+
+	// Fall back to adding new one
+	_, err = db.db.ExecContext(ctx, "INSERT INTO irma.emails (user_id, email) VALUES ($1, $2)", id, email)
+	return err
+}
+
+func (db *postgresDB) emailVerified(ctx context.Context, user *User) (bool, error) {
+	ctx, done := db.db.Operation(ctx, "emailVerified")
+	defer done()
+
+	err := db.db.QueryScanContext(ctx,
+		"SELECT 1 FROM irma.emails WHERE user_id = $1 AND (delete_on >= $2 OR delete_on IS NULL) LIMIT 1",
+		nil,
+		user.id, time.Now().Unix())
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (db *postgresDB) removeEmails(ctx context.Context, user *User) error {
+	ctx, done := db.db.Operation(ctx, "removeEmails")
+	defer done()
+
+	_, err := db.db.ExecContext(ctx,
+		`WITH emails AS (
+		     DELETE FROM irma.emails WHERE user_id = $1
+		 ), verifications AS (
+		     DELETE FROM irma.email_verification_tokens WHERE user_id = $1
+		 )
+		 DELETE FROM irma.email_unsubscribe_tokens WHERE user_id = $1`,
+		user.id)
+	return err
+}
+
+func (db *postgresDB) addUnsubscribeToken(ctx context.Context, user *User, emailAddress, tokenHash string) error {
+	ctx, done := db.db.Operation(ctx, "addUnsubscribeToken")
+	defer done()
+
+	_, err := db.db.ExecContext(ctx, "INSERT INTO irma.email_unsubscribe_tokens (token_hash, email, user_id) VALUES ($1, $2, $3)",
+		tokenHash,
 		emailAddress,
+		user.id)
+	return err
+}
+
+func (db *postgresDB) unsubscribe(ctx context.Context, tokenHash string) (*User, error) {
+	ctx, done := db.db.Operation(ctx, "unsubscribe")
+	defer done()
+
+	// Remove the email address along with all of its tokens in the same query that checks the token
+	var id int64
+	err := db.db.QueryScanContext(ctx,
+		`WITH token AS (
+		     SELECT user_id, email FROM irma.email_unsubscribe_tokens WHERE token_hash = $1
+		 ), tokens AS (
+		     DELETE FROM irma.email_unsubscribe_tokens WHERE (user_id, email) IN (SELECT user_id, email FROM token)
+		 ), emails AS (
+		     DELETE FROM irma.emails WHERE (user_id, email) IN (SELECT user_id, email FROM token)
+		 ), verifications AS (
+		     DELETE FROM irma.email_verification_tokens WHERE (user_id, email) IN (SELECT user_id, email FROM token)
+		 )
+		 SELECT user_id FROM token`,
+		[]interface{}{&id},
+		tokenHash)
+	if err == sql.ErrNoRows {
+		return nil, errUnsubscribeTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	user, err := db.queryUser(ctx, "id = $1", id)
+	if err == keyshare.ErrUserNotFound {
+		return nil, errUnsubscribeTokenInvalid
+	}
+	return user, err
+}
+
+func (db *postgresDB) addDevice(ctx context.Context, user *User, device *Device) error {
+	ctx, done := db.db.Operation(ctx, "addDevice")
+	defer done()
+
+	_, err := db.db.ExecContext(ctx, "INSERT INTO irma.user_devices (user_id, device_id, name, coredata, created) VALUES ($1, $2, $3, $4, $5)",
 		user.id,
-		time.Now().Add(emailTokenValidity*time.Hour).Unix())
+		device.ID,
+		device.Name,
+		device.Secrets[:],
+		device.Created.Unix())
 	return err
 }
+
+func (db *postgresDB) device(ctx context.Context, user *User, id string) (*Device, error) {
+	ctx, done := db.db.Operation(ctx, "device")
+	defer done()
+
+	var device Device
+	var secrets []byte
+	var created int64
+	err := db.db.QueryScanContext(ctx,
+		"SELECT device_id, name, coredata, created FROM irma.user_devices WHERE user_id = $1 AND device_id = $2",
+		[]interface{}{&device.ID, &device.Name, &secrets, &created},
+		user.id, id,
+	)
+	if err == sql.ErrNoRows {
+		return nil, errDeviceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(secrets) != len(device.Secrets[:]) {
+		return nil, errInvalidRecord
+	}
+	copy(device.Secrets[:], secrets)
+	device.Created = time.Unix(created, 0)
+	return &device, nil
+}
+
+func (db *postgresDB) devices(ctx context.Context, user *User) ([]*Device, error) {
+	ctx, done := db.db.Operation(ctx, "devices")
+	defer done()
+
+	var devices []*Device
+	err := db.db.QueryIterateContext(ctx,
+		"SELECT device_id, name, created FROM irma.user_devices WHERE user_id = $1 ORDER BY created",
+		func(rows *sql.Rows) error {
+			var device Device
+			var created int64
+			if err := rows.Scan(&device.ID, &device.Name, &created); err != nil {
+				return err
+			}
+			device.Created = time.Unix(created, 0)
+			devices = append(devices, &device)
+			return nil
+		},
+		user.id,
+	)
+	return devices, err
+}
+
+func (db *postgresDB) updateDeviceSecrets(ctx context.Context, user *User, id string, secrets keysharecore.UserSecrets) error {
+	ctx, done := db.db.Operation(ctx, "updateDeviceSecrets")
+	defer done()
+
+	return db.execDevice(ctx,
+		"UPDATE irma.user_devices SET coredata = $1 WHERE user_id = $2 AND device_id = $3",
+		secrets[:], user.id, id,
+	)
+}
+
+func (db *postgresDB) removeDevice(ctx context.Context, user *User, id string) error {
+	ctx, done := db.db.Operation(ctx, "removeDevice")
+	defer done()
+
+	return db.execDevice(ctx, "DELETE FROM irma.user_devices WHERE user_id = $1 AND device_id = $2", user.id, id)
+}
+
+func (db *postgresDB) execDevice(ctx context.Context, query string, args ...interface{}) error {
+	c, err := db.db.ExecCountContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if c != 1 {
+		return errDeviceNotFound
+	}
+	return nil
+}
+
+func (db *postgresDB) addEnrollmentCode(ctx context.Context, user *User, code string, validity time.Duration) error {
+	ctx, done := db.db.Operation(ctx, "addEnrollmentCode")
+	defer done()
+
+	_, err := db.db.ExecContext(ctx, "INSERT INTO irma.device_enrollment_codes (code, expiry, user_id) VALUES ($1, $2, $3)",
+		code,
+		time.Now().Add(validity).Unix(),
+		user.id)
+	return err
+}
+
+func (db *postgresDB) consumeEnrollmentCode(ctx context.Context, user *User, code string) error {
+	ctx, done := db.db.Operation(ctx, "consumeEnrollmentCode")
+	defer done()
+
+	// Delete the code in the same query that checks it, so that it can be used only once
+	c, err := db.db.ExecCountContext(ctx,
+		"DELETE FROM irma.device_enrollment_codes WHERE user_id = $1 AND code = $2 AND expiry >= $3",
+		user.id, code, time.Now().Unix(),
+	)
+	if err != nil {
+		return err
+	}
+	if c != 1 {
+		return errEnrollmentCodeInvalid
+	}
+	return nil
+}
+
+func (db *postgresDB) addRecoveryToken(ctx context.Context, user *User, tokenHash string, validity time.Duration) error {
+	ctx, done := db.db.Operation(ctx, "addRecoveryToken")
+	defer done()
+
+	_, err := db.db.ExecContext(ctx,
+		`INSERT INTO irma.recovery_tokens (token_hash, expiry, user_id) VALUES ($1, $2, $3)
+		 ON CONFLICT (user_id) DO UPDATE SET token_hash = EXCLUDED.token_hash, expiry = EXCLUDED.expiry`,
+		tokenHash,
+		time.Now().Add(validity).Unix(),
+		user.id)
+	return err
+}
+
+func (db *postgresDB) consumeRecoveryToken(ctx context.Context, tokenHash string) (*User, error) {
+	ctx, done := db.db.Operation(ctx, "consumeRecoveryToken")
+	defer done()
+
+	// Delete the token in the same query that checks it, so that it can be used only once
+	var id int64
+	err := db.db.QueryScanContext(ctx,
+		"DELETE FROM irma.recovery_tokens WHERE token_hash = $1 AND expiry >= $2 RETURNING user_id",
+		[]interface{}{&id},
+		tokenHash, time.Now().Unix())
+	if err == sql.ErrNoRows {
+		return nil, errRecoveryTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	user, err := db.queryUser(ctx, "id = $1", id)
+	if err == keyshare.ErrUserNotFound {
+		return nil, errRecoveryTokenInvalid
+	}
+	return user, err
+}
+
+// Condition on irma.users selecting users having at least one verified email address
+const userEmailVerified = "EXISTS (SELECT 1 FROM irma.emails WHERE emails.user_id = users.id AND (emails.delete_on >= $1 OR emails.delete_on IS NULL))"
+
+func (db *postgresDB) userStats(ctx context.Context) (*userStats, error) {
+	ctx, done := db.db.Operation(ctx, "userStats")
+	defer done()
+
+	var stats userStats
+	err := db.db.QueryScanContext(ctx,
+		`SELECT COUNT(*),
+		        COUNT(*) FILTER (WHERE pin_block_date > $1),
+		        COUNT(*) FILTER (WHERE `+userEmailVerified+`),
+		        COUNT(*) FILTER (WHERE NOT `+userEmailVerified+` AND EXISTS (
+		            SELECT 1 FROM irma.email_verification_tokens WHERE email_verification_tokens.user_id = users.id)),
+		        COUNT(*) FILTER (WHERE delete_on IS NOT NULL),
+		        COUNT(*) FILTER (WHERE credential_issued = false),
+		        COUNT(*) FILTER (WHERE credential_issued IS NOT false)
+		 FROM irma.users WHERE coredata IS NOT NULL`,
+		[]interface{}{&stats.Accounts, &stats.Blocked, &stats.EmailVerified, &stats.EmailUnverified, &stats.PendingDeletion,
+			&stats.CredentialPending, &stats.CredentialIssued},
+		time.Now().Unix(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+func (db *postgresDB) listUsers(ctx context.Context, after string, limit int) ([]*userMetadata, error) {
+	ctx, done := db.db.Operation(ctx, "listUsers")
+	defer done()
+
+	now := time.Now().Unix()
+	users := make([]*userMetadata, 0, limit)
+	err := db.db.QueryIterateContext(ctx,
+		`SELECT username, created, last_seen, pin_block_date, `+userEmailVerified+`
+		 FROM irma.users WHERE username > $2 AND coredata IS NOT NULL ORDER BY username LIMIT $3`,
+		func(rows *sql.Rows) error {
+			var user userMetadata
+			var created sql.NullInt64
+			var lastSeen, blockDate int64
+			if err := rows.Scan(&user.Username, &created, &lastSeen, &blockDate, &user.EmailVerified); err != nil {
+				return err
+			}
+			if created.Valid {
+				user.Created = timestamp(created.Int64)
+			}
+			user.LastSeen = timestamp(lastSeen)
+			if blockDate > now {
+				user.BlockedUntil = timestamp(blockDate)
+			}
+			users = append(users, &user)
+			return nil
+		},
+		now, after, limit,
+	)
+	return users, err
+}
+
+func timestamp(unix int64) *irma.Timestamp {
+	t := irma.Timestamp(time.Unix(unix, 0))
+	return &t
+}
+
+func (db *postgresDB) rollupUsage(ctx context.Context, until time.Time) error {
+	start, err := db.usageRollupStart(ctx)
+	if err != nil || start.IsZero() {
+		return err
+	}
+
+	// Days are aggregated entirely, so that doing so again (e.g. by another instance) is harmless.
+	// Each day is a separate operation, so that catching up on many days is not cut off by the timeout.
+	for day := start; day.Before(usageDay(until)); day = day.Add(24 * time.Hour) {
+		if err := db.rebuildUsage(ctx, day); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// usageRollupStart returns the day after the last aggregated day, or else the day of the first
+// session, or the zero time if there are no sessions.
+func (db *postgresDB) usageRollupStart(ctx context.Context) (time.Time, error) {
+	ctx, done := db.db.Operation(ctx, "rollupUsage")
+	defer done()
+
+	var last sql.NullTime
+	if err := db.db.QueryScanContext(ctx, "SELECT MAX(date) FROM irma.usage_stats", []interface{}{&last}); err != nil {
+		return time.Time{}, err
+	}
+	if last.Valid {
+		return usageDay(last.Time).Add(24 * time.Hour), nil
+	}
+	var first sql.NullInt64
+	err := db.db.QueryScanContext(ctx,
+		"SELECT MIN(time) FROM irma.log_entry_records WHERE event = $1",
+		[]interface{}{&first},
+		LogEventIRMASession)
+	if err != nil || !first.Valid {
+		return time.Time{}, err
+	}
+	return usageDay(time.Unix(first.Int64, 0)), nil
+}
+
+func (db *postgresDB) deleteLogsBefore(ctx context.Context, t time.Time, keepTypes []LogEventType, limit int) (int, error) {
+	ctx, done := db.db.Operation(ctx, "deleteLogsBefore")
+	defer done()
+
+	// The event types are passed as a single comma-separated parameter, as they contain no commas
+	keep := make([]string, len(keepTypes))
+	for i, eventType := range keepTypes {
+		keep[i] = string(eventType)
+	}
+	c, err := db.db.ExecCountContext(ctx,
+		`DELETE FROM irma.log_entry_records WHERE id IN (
+		     SELECT id FROM irma.log_entry_records
+		     WHERE time < $1 AND event <> ALL(string_to_array($2, ',')) LIMIT $3)`,
+		t.Unix(), strings.Join(keep, ","), limit)
+	return int(c), err
+}
+
+func (db *postgresDB) rebuildUsage(ctx context.Context, day time.Time) error {
+	ctx, done := db.db.Operation(ctx, "rebuildUsage")
+	defer done()
+
+	day = usageDay(day)
+	_, err := db.db.ExecContext(ctx,
+		`INSERT INTO irma.usage_stats (date, sessions, users)
+		 SELECT $1::date, COUNT(*), COUNT(DISTINCT user_id) FROM irma.log_entry_records
+		 WHERE event = $2 AND time >= $3 AND time < $4
+		 ON CONFLICT (date) DO UPDATE SET sessions = EXCLUDED.sessions, users = EXCLUDED.users`,
+		day.Format(usageDateFormat),
+		LogEventIRMASession,
+		day.Unix(),
+		day.Add(24*time.Hour).Unix())
+	return err
+}
+
+func (db *postgresDB) usageStats(ctx context.Context, from, to time.Time) ([]*usageStat, error) {
+	ctx, done := db.db.Operation(ctx, "usageStats")
+	defer done()
+
+	stats := []*usageStat{}
+	err := db.db.QueryIterateContext(ctx,
+		"SELECT date, sessions, users FROM irma.usage_stats WHERE date >= $1::date AND date <= $2::date ORDER BY date",
+		func(rows *sql.Rows) error {
+			var stat usageStat
+			var date time.Time
+			if err := rows.Scan(&date, &stat.Sessions, &stat.Users); err != nil {
+				return err
+			}
+			stat.Date = date.Format(usageDateFormat)
+			stats = append(stats, &stat)
+			return nil
+		},
+		usageDay(from).Format(usageDateFormat), usageDay(to).Format(usageDateFormat),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (db *postgresDB) usersAfter(ctx context.Context, after string, limit int) ([]*User, error) {
+	ctx, done := db.db.Operation(ctx, "usersAfter")
+	defer done()
+
+	users := make([]*User, 0, limit)
+	err := db.db.QueryIterateContext(ctx,
+		`SELECT id, username, language, coredata, COALESCE(oidc_subject, ''), version
+		 FROM irma.users WHERE username > $1 AND coredata IS NOT NULL ORDER BY username LIMIT $2`,
+		func(rows *sql.Rows) error {
+			var user User
+			var secrets []byte
+			if err := rows.Scan(&user.id, &user.Username, &user.Language, &secrets, &user.OIDCSubject, &user.version); err != nil {
+				return err
+			}
+			if len(secrets) != len(user.Secrets[:]) {
+				return errInvalidRecord
+			}
+			copy(user.Secrets[:], secrets)
+			users = append(users, &user)
+			return nil
+		},
+		after, limit,
+	)
+	return users, err
+}
+
+func (db *postgresDB) replaceSecrets(ctx context.Context, user *User, old keysharecore.UserSecrets) (bool, error) {
+	ctx, done := db.db.Operation(ctx, "replaceSecrets")
+	defer done()
+
+	// Compare the secrets in the same query that replaces them, so that concurrent changes
+	// (e.g. of the PIN) are not undone, and make concurrent updateUser calls fail
+	var c int64
+	var err error
+	if user.DeviceID == "" {
+		c, err = db.db.ExecCountContext(ctx,
+			"UPDATE irma.users SET coredata = $1, version = version + 1 WHERE id = $2 AND coredata = $3",
+			user.Secrets[:], user.id, old[:])
+	} else {
+		c, err = db.db.ExecCountContext(ctx,
+			"UPDATE irma.user_devices SET coredata = $1 WHERE user_id = $2 AND device_id = $3 AND coredata = $4",
+			user.Secrets[:], user.id, user.DeviceID, old[:])
+	}
+	return c == 1, err
+}
+
+func (db *postgresDB) deleteExpiredEmailVerifications(ctx context.Context, limit int) (int, error) {
+	ctx, done := db.db.Operation(ctx, "deleteExpiredEmailVerifications")
+	defer done()
+
+	c, err := db.db.ExecCountContext(ctx,
+		`DELETE FROM irma.email_verification_tokens WHERE id IN (
+		     SELECT id FROM irma.email_verification_tokens WHERE expiry < $1 LIMIT $2)`,
+		time.Now().Unix(), limit)
+	return int(c), err
+}
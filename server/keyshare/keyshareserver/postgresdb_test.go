@@ -3,10 +3,17 @@
 package keyshareserver
 
 import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/privacybydesign/irmago/internal/keysharecore"
 	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server/keyshare"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -19,32 +26,418 @@ func TestPostgresDBUserManagement(t *testing.T) {
 	require.NoError(t, err)
 
 	user := &User{Username: "testuser"}
-	err = db.AddUser(user)
+	err = db.AddUser(context.Background(), user)
 	require.NoError(t, err)
 	assert.Equal(t, "testuser", user.Username)
 
-	nuser, err := db.user("testuser")
+	nuser, err := db.user(context.Background(), "testuser")
 	require.NoError(t, err)
 	assert.Equal(t, "testuser", nuser.Username)
 
-	_, err = db.user("notexist")
+	_, err = db.user(context.Background(), "notexist")
 	assert.Error(t, err)
 
-	err = db.updateUser(nuser)
+	err = db.updateUser(context.Background(), nuser)
 	assert.NoError(t, err)
 
 	user = &User{Username: "testuser"}
-	err = db.AddUser(user)
+	err = db.AddUser(context.Background(), user)
 	assert.Error(t, err)
 
-	err = db.addLog(nuser, eventTypePinCheckFailed, 15)
+	err = db.addLog(context.Background(), nuser, LogEventPinCheckFailed, 15)
 	assert.NoError(t, err)
 
-	err = db.addEmailVerification(nuser, "test@example.com", "testtoken")
+	err = db.addEmailVerification(context.Background(), nuser, "test@example.com", "testtoken", 24)
 	assert.NoError(t, err)
 
-	err = db.setSeen(nuser)
+	verified, err := db.emailVerified(context.Background(), nuser)
 	assert.NoError(t, err)
+	assert.False(t, verified)
+
+	err = db.verifyEmail(context.Background(), "testtoken")
+	assert.NoError(t, err)
+	err = db.verifyEmail(context.Background(), "testtoken")
+	assert.Equal(t, errEmailTokenInvalid, err)
+	err = db.verifyEmail(context.Background(), "nonexistent")
+	assert.Equal(t, errEmailTokenInvalid, err)
+
+	err = db.addEmailVerification(context.Background(), nuser, "test@example.com", "expiredtoken", -1)
+	assert.NoError(t, err)
+	err = db.verifyEmail(context.Background(), "expiredtoken")
+	assert.Equal(t, errEmailTokenInvalid, err)
+
+	verified, err = db.emailVerified(context.Background(), nuser)
+	assert.NoError(t, err)
+	assert.True(t, verified)
+
+	err = db.setSeen(context.Background(), nuser)
+	assert.NoError(t, err)
+}
+
+func TestPostgresDBDevices(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl)
+	require.NoError(t, err)
+	testDevices(t, db)
+}
+
+func TestPostgresDBRecoveryTokens(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl)
+	require.NoError(t, err)
+	testRecoveryTokens(t, db)
+}
+
+func TestPostgresDBEmails(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl)
+	require.NoError(t, err)
+	testEmails(t, db)
+}
+
+func TestPostgresDBUsage(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl)
+	require.NoError(t, err)
+	testUsage(t, db)
+}
+
+func TestPostgresDBMaintenance(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl)
+	require.NoError(t, err)
+	testMaintenance(t, db)
+}
+
+func TestPostgresDBUpdateConflicts(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl)
+	require.NoError(t, err)
+	testUpdateConflicts(t, db)
+}
+
+func TestPostgresDBDeleteLogsBefore(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl)
+	require.NoError(t, err)
+	testDeleteLogsBefore(t, db)
+}
+
+func TestPostgresDBInstrumentation(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl)
+	require.NoError(t, err)
+	var ops []string
+	db.instrument(keyshare.DBInstrumentation{
+		Timeout: 100 * time.Millisecond,
+		OnOperation: func(op string, duration time.Duration, err error) {
+			ops = append(ops, op)
+		},
+	})
+
+	user := &User{Username: "testuser"}
+	require.NoError(t, db.AddUser(context.Background(), user))
+	_, err = db.user(context.Background(), "notexist")
+	require.Error(t, err)
+	require.Equal(t, []string{"AddUser", "user"}, ops)
+
+	// Operations taking longer than the timeout are cancelled
+	pdb := db.(*postgresDB)
+	ctx, done := pdb.db.Operation(context.Background(), "sleep")
+	_, err = pdb.db.ExecContext(ctx, "SELECT pg_sleep(1)")
+	done()
+	require.Error(t, err)
+	require.Equal(t, "sleep", ops[len(ops)-1])
+}
+
+func TestPostgresDBLogTimeIndexMigration(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl)
+	require.NoError(t, err)
+	pdb := db.(*postgresDB)
+	_, err = pdb.db.Exec("DROP INDEX irma.log_entry_records_time_index")
+	require.NoError(t, err)
+
+	test.RunScriptOnDB(t, "../migrations/log_entry_records_time_index.sql", false)
+	var count int
+	require.NoError(t, pdb.db.QueryScan(
+		"SELECT COUNT(*) FROM pg_indexes WHERE schemaname = 'irma' AND indexname = 'log_entry_records_time_index'",
+		[]interface{}{&count}))
+	assert.Equal(t, 1, count)
+
+	// Running the migration again has no effect
+	test.RunScriptOnDB(t, "../migrations/log_entry_records_time_index.sql", false)
+}
+
+func TestPostgresDBEmailTokenMigration(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl)
+	require.NoError(t, err)
+	user := &User{Username: "testuser"}
+	require.NoError(t, db.AddUser(context.Background(), user))
+
+	// Revert to the table as it was, containing the tokens themselves
+	pdb := db.(*postgresDB)
+	_, err = pdb.db.Exec("ALTER TABLE irma.email_verification_tokens RENAME COLUMN token_hash TO token")
+	require.NoError(t, err)
+	_, err = pdb.db.Exec("INSERT INTO irma.email_verification_tokens (token, email, user_id, expiry) VALUES ('oldtoken', 'test@example.com', $1, $2)",
+		user.id, time.Now().Add(time.Hour).Unix())
+	require.NoError(t, err)
+
+	test.RunScriptOnDB(t, "../migrations/email_verification_token_hashes.sql", false)
+	assert.Equal(t, errEmailTokenInvalid, db.verifyEmail(context.Background(), "oldtoken"))
+	assert.NoError(t, db.verifyEmail(context.Background(), keyshare.HashEmailToken("oldtoken")))
+	assert.Equal(t, errEmailTokenInvalid, db.verifyEmail(context.Background(), keyshare.HashEmailToken("oldtoken")))
+}
+
+func TestPostgresDBEmailTokenUsedMigration(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl)
+	require.NoError(t, err)
+	user := &User{Username: "testuser"}
+	require.NoError(t, db.AddUser(context.Background(), user))
+
+	pdb := db.(*postgresDB)
+	_, err = pdb.db.Exec("ALTER TABLE irma.email_verification_tokens DROP COLUMN used")
+	require.NoError(t, err)
+	_, err = pdb.db.Exec("INSERT INTO irma.email_verification_tokens (token_hash, email, user_id, expiry) VALUES ('oldtoken', 'test@example.com', $1, $2)",
+		user.id, time.Now().Add(time.Hour).Unix())
+	require.NoError(t, err)
+
+	test.RunScriptOnDB(t, "../migrations/email_verification_used.sql", false)
+	assert.NoError(t, db.verifyEmail(context.Background(), "oldtoken"))
+	assert.Equal(t, errEmailTokenInvalid, db.verifyEmail(context.Background(), "oldtoken"))
+
+	// Running the migration again has no effect
+	test.RunScriptOnDB(t, "../migrations/email_verification_used.sql", false)
+	assert.Equal(t, errEmailTokenInvalid, db.verifyEmail(context.Background(), "oldtoken"))
+}
+
+func TestPostgresDBOIDCSubjectMigration(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl)
+	require.NoError(t, err)
+	pdb := db.(*postgresDB)
+	_, err = pdb.db.Exec("ALTER TABLE irma.users DROP COLUMN oidc_subject")
+	require.NoError(t, err)
+	_, err = pdb.db.Exec("INSERT INTO irma.users (username, language, coredata, last_seen, pin_counter, pin_block_date) VALUES ('olduser', 'en', $1, 0, 0, 0)",
+		make([]byte, len(keysharecore.UserSecrets{})))
+	require.NoError(t, err)
+
+	test.RunScriptOnDB(t, "../migrations/user_oidc_subject.sql", false)
+	user, err := db.user(context.Background(), "olduser")
+	require.NoError(t, err)
+	assert.Equal(t, "", user.OIDCSubject)
+
+	require.NoError(t, db.AddUser(context.Background(), &User{Username: "newuser", OIDCSubject: "subject"}))
+	user, err = db.userByOIDCSubject(context.Background(), "subject")
+	require.NoError(t, err)
+	assert.Equal(t, "newuser", user.Username)
+	assert.Equal(t, errAccountExists, db.AddUser(context.Background(), &User{Username: "otheruser", OIDCSubject: "subject"}))
+
+	// Running the migration again has no effect
+	test.RunScriptOnDB(t, "../migrations/user_oidc_subject.sql", false)
+}
+
+func TestPostgresDBDevicesMigration(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl)
+	require.NoError(t, err)
+	pdb := db.(*postgresDB)
+	_, err = pdb.db.Exec("DROP TABLE irma.user_devices, irma.device_enrollment_codes")
+	require.NoError(t, err)
+
+	test.RunScriptOnDB(t, "../migrations/user_devices.sql", false)
+	testDevices(t, db)
+
+	// Running the migration again has no effect
+	test.RunScriptOnDB(t, "../migrations/user_devices.sql", false)
+}
+
+func TestPostgresDBUserCreatedMigration(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl)
+	require.NoError(t, err)
+	pdb := db.(*postgresDB)
+	_, err = pdb.db.Exec("ALTER TABLE irma.users DROP COLUMN created")
+	require.NoError(t, err)
+	_, err = pdb.db.Exec("INSERT INTO irma.users (username, language, coredata, last_seen, pin_counter, pin_block_date) VALUES ('olduser', 'en', $1, 0, 0, 0)",
+		make([]byte, len(keysharecore.UserSecrets{})))
+	require.NoError(t, err)
+
+	test.RunScriptOnDB(t, "../migrations/user_created.sql", false)
+	require.NoError(t, db.AddUser(context.Background(), &User{Username: "newuser"}))
+	users, err := db.listUsers(context.Background(), "", 10)
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	assert.Equal(t, "newuser", users[0].Username)
+	assert.NotNil(t, users[0].Created)
+	assert.Equal(t, "olduser", users[1].Username)
+	assert.Nil(t, users[1].Created)
+
+	// Running the migration again has no effect
+	test.RunScriptOnDB(t, "../migrations/user_created.sql", false)
+}
+
+func TestPostgresDBCredentialIssuedMigration(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl)
+	require.NoError(t, err)
+	pdb := db.(*postgresDB)
+	_, err = pdb.db.Exec("ALTER TABLE irma.users DROP COLUMN credential_issued")
+	require.NoError(t, err)
+	_, err = pdb.db.Exec("INSERT INTO irma.users (username, language, coredata, last_seen, pin_counter, pin_block_date) VALUES ('olduser', 'en', $1, 0, 0, 0)",
+		make([]byte, len(keysharecore.UserSecrets{})))
+	require.NoError(t, err)
+
+	test.RunScriptOnDB(t, "../migrations/user_credential_issued.sql", false)
+	require.NoError(t, db.AddUser(context.Background(), &User{Username: "newuser"}))
+	stats, err := db.userStats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.CredentialPending)
+	assert.Equal(t, 1, stats.CredentialIssued)
+
+	// Running the migration again has no effect
+	test.RunScriptOnDB(t, "../migrations/user_credential_issued.sql", false)
+}
+
+func TestPostgresDBRecoveryTokenMigration(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl)
+	require.NoError(t, err)
+	pdb := db.(*postgresDB)
+	_, err = pdb.db.Exec("DROP TABLE irma.recovery_tokens")
+	require.NoError(t, err)
+
+	test.RunScriptOnDB(t, "../migrations/recovery_tokens.sql", false)
+	testRecoveryTokens(t, db)
+
+	// Running the migration again has no effect
+	test.RunScriptOnDB(t, "../migrations/recovery_tokens.sql", false)
+}
+
+func TestPostgresDBUsageMigration(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl)
+	require.NoError(t, err)
+	pdb := db.(*postgresDB)
+	_, err = pdb.db.Exec("DROP TABLE irma.usage_stats")
+	require.NoError(t, err)
+	_, err = pdb.db.Exec("DROP INDEX irma.log_entry_records_event_index")
+	require.NoError(t, err)
+
+	test.RunScriptOnDB(t, "../migrations/log_entry_records_event_index.sql", false)
+	test.RunScriptOnDB(t, "../migrations/usage_stats.sql", false)
+	var count int
+	require.NoError(t, pdb.db.QueryScan(
+		"SELECT COUNT(*) FROM pg_indexes WHERE schemaname = 'irma' AND indexname = 'log_entry_records_event_index'",
+		[]interface{}{&count}))
+	assert.Equal(t, 1, count)
+	testUsage(t, db)
+
+	// Running the migrations again has no effect
+	test.RunScriptOnDB(t, "../migrations/log_entry_records_event_index.sql", false)
+	test.RunScriptOnDB(t, "../migrations/usage_stats.sql", false)
+}
+
+func TestPostgresDBUnsubscribeTokenMigration(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl)
+	require.NoError(t, err)
+	pdb := db.(*postgresDB)
+	_, err = pdb.db.Exec("DROP TABLE irma.email_unsubscribe_tokens")
+	require.NoError(t, err)
+
+	test.RunScriptOnDB(t, "../migrations/email_unsubscribe_tokens.sql", false)
+	testEmails(t, db)
+
+	// Running the migration again has no effect
+	test.RunScriptOnDB(t, "../migrations/email_unsubscribe_tokens.sql", false)
+}
+
+func TestPostgresDBUserVersionMigration(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl)
+	require.NoError(t, err)
+	pdb := db.(*postgresDB)
+	_, err = pdb.db.Exec("ALTER TABLE irma.users DROP COLUMN version")
+	require.NoError(t, err)
+	_, err = pdb.db.Exec("INSERT INTO irma.users (username, language, coredata, last_seen, pin_counter, pin_block_date) VALUES ('olduser', 'en', $1, 0, 0, 0)",
+		make([]byte, len(keysharecore.UserSecrets{})))
+	require.NoError(t, err)
+
+	test.RunScriptOnDB(t, "../migrations/user_version.sql", false)
+	user, err := db.user(context.Background(), "olduser")
+	require.NoError(t, err)
+	stale := *user
+	require.NoError(t, db.updateUser(context.Background(), user))
+	require.Equal(t, errUpdateConflict, db.updateUser(context.Background(), &stale))
+
+	// Running the migration again has no effect
+	test.RunScriptOnDB(t, "../migrations/user_version.sql", false)
+}
+
+func TestPostgresDBUserAdministration(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl)
+	require.NoError(t, err)
+	testUserAdministration(t, db, 2500)
+
+	// Block a user by exhausting its PIN attempts
+	user, err := db.user(context.Background(), "user000007")
+	require.NoError(t, err)
+	for i := 0; i < maxPinTries; i++ {
+		_, _, _, err = db.reservePinTry(context.Background(), user)
+		require.NoError(t, err)
+	}
+	stats, err := db.userStats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Blocked)
+	users, err := db.listUsers(context.Background(), "user000006", 1)
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, "user000007", users[0].Username)
+	assert.NotNil(t, users[0].BlockedUntil)
 }
 
 func TestPostgresDBPinReservation(t *testing.T) {
@@ -57,15 +450,21 @@ func TestPostgresDBPinReservation(t *testing.T) {
 	require.NoError(t, err)
 
 	user := &User{Username: "testuser"}
-	err = db.AddUser(user)
+	err = db.AddUser(context.Background(), user)
 	require.NoError(t, err)
 
 	// reservePinTry sets user fields in the database as if the attempt was wrong. If the attempt
 	// was in fact correct, then these fields are cleared again later by the keyshare server by
-	// invoking db.resetPinTries(user). So below we may think of reservePinTry invocations as
+	// invoking db.resetPinTries(context.Background(), user). So below we may think of reservePinTry invocations as
 	// wrong pin attempts.
 
-	ok, tries, wait, err := db.reservePinTry(user)
+	// pinTries does not reserve an attempt
+	tries, wait, err := db.pinTries(context.Background(), user)
+	require.NoError(t, err)
+	assert.Equal(t, maxPinTries, tries)
+	assert.Equal(t, int64(0), wait)
+
+	ok, tries, wait, err := db.reservePinTry(context.Background(), user)
 	require.NoError(t, err)
 	assert.True(t, ok)
 	assert.Equal(t, maxPinTries-1, tries)
@@ -73,7 +472,7 @@ func TestPostgresDBPinReservation(t *testing.T) {
 
 	// Try until we have no tries left
 	for tries != 0 {
-		ok, tries, wait, err = db.reservePinTry(user)
+		ok, tries, wait, err = db.reservePinTry(context.Background(), user)
 		require.NoError(t, err)
 		assert.True(t, ok)
 	}
@@ -84,24 +483,32 @@ func TestPostgresDBPinReservation(t *testing.T) {
 	time.Sleep(time.Duration(wait-1) * time.Second)
 
 	// Try again, not yet allowed
-	ok, tries, wait, err = db.reservePinTry(user)
+	ok, tries, wait, err = db.reservePinTry(context.Background(), user)
 	assert.NoError(t, err)
 	assert.False(t, ok)
 	assert.Equal(t, 0, tries)
 	assert.Equal(t, int64(1), wait)
+	tries, wait, err = db.pinTries(context.Background(), user)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, tries)
+	assert.Equal(t, int64(1), wait)
 
 	// Wait till just after block end
 	time.Sleep(2 * time.Second)
 
-	// Trying is now allowed
-	ok, tries, wait, err = db.reservePinTry(user)
+	// Trying is now allowed, once
+	tries, wait, err = db.pinTries(context.Background(), user)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, tries)
+	assert.Equal(t, int64(0), wait)
+	ok, tries, wait, err = db.reservePinTry(context.Background(), user)
 	assert.NoError(t, err)
 	assert.True(t, ok)
 	assert.Equal(t, 0, tries)
 	assert.Equal(t, 2*backoffStart, wait) // next attempt after doubled timeout
 
 	// Since we just used another attempt we are now blocked again
-	ok, tries, wait, err = db.reservePinTry(user)
+	ok, tries, wait, err = db.reservePinTry(context.Background(), user)
 	assert.NoError(t, err)
 	assert.False(t, ok)
 	assert.Equal(t, 0, tries)
@@ -111,22 +518,135 @@ func TestPostgresDBPinReservation(t *testing.T) {
 	time.Sleep(time.Duration(wait+1) * time.Second)
 
 	// Try a final time
-	ok, tries, wait, err = db.reservePinTry(user)
+	ok, tries, wait, err = db.reservePinTry(context.Background(), user)
 	assert.NoError(t, err)
 	assert.True(t, ok)
 	assert.Equal(t, 0, tries)
 	assert.Equal(t, 4*backoffStart, wait) // next attempt after again a doubled timeout
 
-	err = db.resetPinTries(user)
+	err = db.resetPinTries(context.Background(), user)
+	assert.NoError(t, err)
+	tries, wait, err = db.pinTries(context.Background(), user)
 	assert.NoError(t, err)
+	assert.Equal(t, maxPinTries, tries)
+	assert.Equal(t, int64(0), wait)
 
-	ok, tries, wait, err = db.reservePinTry(user)
+	ok, tries, wait, err = db.reservePinTry(context.Background(), user)
 	assert.NoError(t, err)
 	assert.True(t, ok)
 	assert.True(t, tries > 0)
 	assert.Equal(t, int64(0), wait)
 }
 
+func TestPostgresDBTransientErrors(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+	defer func(delay time.Duration) { keyshare.RetryBaseDelay = delay }(keyshare.RetryBaseDelay)
+	keyshare.RetryBaseDelay = 10 * time.Millisecond
+
+	proxy := startResetProxy(t, "localhost:5432")
+	defer proxy.close()
+	db, err := newPostgresDB(strings.Replace(test.PostgresTestUrl, "localhost:5432", proxy.listener.Addr().String(), 1))
+	require.NoError(t, err)
+	health := db.(healthReporter)
+
+	user := &User{Username: "testuser"}
+	require.NoError(t, db.AddUser(context.Background(), user))
+
+	// Established connections are reset
+	proxy.reset(0)
+	_, err = db.user(context.Background(), "testuser")
+	require.NoError(t, err)
+	require.Zero(t, health.failingFor())
+
+	// New connections are also reset for a while, e.g. during a failover
+	// (leaving one attempt for a pooled connection that was reset)
+	proxy.reset(keyshare.RetryAttempts - 1)
+	_, err = db.user(context.Background(), "testuser")
+	require.NoError(t, err)
+	require.Zero(t, health.failingFor())
+
+	// The database remains unavailable
+	proxy.reset(100)
+	_, err = db.user(context.Background(), "testuser")
+	require.Error(t, err)
+	require.NotZero(t, health.failingFor())
+
+	// And recovers
+	proxy.reset(0)
+	_, err = db.user(context.Background(), "testuser")
+	require.NoError(t, err)
+	require.Zero(t, health.failingFor())
+}
+
+// resetProxy forwards TCP connections to the specified address, resetting them on request.
+type resetProxy struct {
+	listener net.Listener
+	target   string
+
+	mutex  sync.Mutex
+	conns  []*net.TCPConn
+	refuse int
+}
+
+func startResetProxy(t *testing.T, target string) *resetProxy {
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	proxy := &resetProxy{listener: listener, target: target}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return // closed
+			}
+			proxy.forward(conn.(*net.TCPConn))
+		}
+	}()
+	return proxy
+}
+
+func (p *resetProxy) forward(conn *net.TCPConn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.refuse > 0 {
+		p.refuse--
+		resetConn(conn)
+		return
+	}
+	upstream, err := net.Dial("tcp", p.target)
+	if err != nil {
+		resetConn(conn)
+		return
+	}
+	p.conns = append(p.conns, conn, upstream.(*net.TCPConn))
+	go func() { _, _ = io.Copy(upstream, conn) }()
+	go func() { _, _ = io.Copy(conn, upstream) }()
+}
+
+// reset resets all established connections, as well as the specified amount of new connections.
+func (p *resetProxy) reset(refuse int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, conn := range p.conns {
+		resetConn(conn)
+	}
+	p.conns = nil
+	p.refuse = refuse
+}
+
+func (p *resetProxy) close() {
+	_ = p.listener.Close()
+	p.reset(0)
+}
+
+func resetConn(conn *net.TCPConn) {
+	_ = conn.SetLinger(0) // send RST instead of FIN when closing
+	_ = conn.Close()
+}
+
 func SetupDatabase(t *testing.T) {
 	test.RunScriptOnDB(t, "../cleanup.sql", true)
 	test.RunScriptOnDB(t, "../schema.sql", false)
@@ -0,0 +1,86 @@
+package keyshareserver
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/privacybydesign/irmago/server"
+)
+
+// Amount of seconds after which clients should retry operations refused in read-only mode
+const readOnlyRetryAfter = 300
+
+// Descriptions of the error with which operations are refused in read-only mode.
+var readOnlyDescriptions = map[string]string{
+	"en": "The keyshare server is being maintained, during which this is not possible. Please try again later.",
+	"nl": "Er wordt onderhoud aan de keyshare server uitgevoerd, waardoor dit tijdelijk niet mogelijk is. Probeer het later opnieuw.",
+}
+
+// readOnlyStatus is the request and response body of /admin/read-only.
+type readOnlyStatus struct {
+	ReadOnly bool `json:"readOnly"`
+}
+
+// ReadOnly returns whether the server is in read-only maintenance mode (see Configuration.ReadOnly).
+func (s *Server) ReadOnly() bool {
+	return atomic.LoadInt32(&s.readOnly) == 1
+}
+
+// SetReadOnly switches read-only maintenance mode (see Configuration.ReadOnly) on or off.
+func (s *Server) SetReadOnly(readOnly bool) {
+	var value int32
+	if readOnly {
+		value = 1
+	}
+	if atomic.SwapInt32(&s.readOnly, value) == value {
+		return
+	}
+	s.conf.Logger.WithField("readOnly", readOnly).Info("Read-only maintenance mode switched")
+	s.conf.Hooks.KeyshareReadOnly(readOnly)
+}
+
+// readOnlyMiddleware refuses the requests to state-changing endpoints while the server is in
+// read-only mode, with a translated message.
+func (s *Server) readOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.ReadOnly() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		description := readOnlyDescriptions[s.conf.Language(readOnlyDescriptions, requestedLanguages(r, "")...)]
+		w.Header().Set("Retry-After", strconv.Itoa(readOnlyRetryAfter))
+		if acceptsHTML(r) {
+			writeEmailVerificationPage(w, http.StatusServiceUnavailable, description)
+			return
+		}
+		server.WriteError(w, server.ErrorReadOnly, description)
+	})
+}
+
+// activityError handles a failure to record the activity of a user using setSeen or addLog. In
+// read-only mode, during which the database may refuse such writes, it is logged as a warning and
+// nil is returned; otherwise it is logged as an error and returned.
+func (s *Server) activityError(ctx context.Context, err error, msg string) error {
+	if s.ReadOnly() {
+		s.conf.Logger.WithField("error", err).Warn(msg)
+		return nil
+	}
+	s.logError(ctx, err, msg)
+	return err
+}
+
+// /admin/read-only
+// Returns whether the server is in read-only mode, after switching it on or off if posted.
+func (s *Server) handleAdminReadOnly(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var msg readOnlyStatus
+		if err := server.ParseBody(r, &msg); err != nil {
+			server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+			return
+		}
+		s.SetReadOnly(msg.ReadOnly)
+	}
+	server.WriteJson(w, readOnlyStatus{ReadOnly: s.ReadOnly()})
+}
@@ -0,0 +1,183 @@
+package keyshareserver
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// configSetting is a setting of the keyshare server, by its name in configuration files.
+type configSetting struct {
+	name  string
+	value func(conf *Configuration) interface{}
+}
+
+// Settings that ReloadConfig changes in the running server.
+var reloadableSettings = []configSetting{
+	{"email_server", func(c *Configuration) interface{} { return c.EmailServer }},
+	{"email_from", func(c *Configuration) interface{} { return c.EmailFrom }},
+	{"default_language", func(c *Configuration) interface{} { return c.DefaultLanguage }},
+	{"registration_email_files", func(c *Configuration) interface{} { return c.RegistrationEmailFiles }},
+	{"registration_email_subjects", func(c *Configuration) interface{} { return c.RegistrationEmailSubjects }},
+	{"verification_url", func(c *Configuration) interface{} { return c.VerificationURL }},
+	{"email_token_validity", func(c *Configuration) interface{} { return c.EmailTokenValidity }},
+	{"recovery_token_validity", func(c *Configuration) interface{} { return c.RecoveryTokenValidity }},
+	{"db_failure_threshold", func(c *Configuration) interface{} { return c.DBFailureThreshold }},
+	{"ready_ignores_key_failures", func(c *Configuration) interface{} { return c.ReadyIgnoresKeyFailures }},
+	{"log_retention", func(c *Configuration) interface{} { return c.LogRetention }},
+	{"deprecation_date", func(c *Configuration) interface{} { return c.DeprecationDate }},
+	{"sunset_date", func(c *Configuration) interface{} { return c.SunsetDate }},
+	{"version_message", func(c *Configuration) interface{} { return c.VersionMessage }},
+	{"maintenance_start", func(c *Configuration) interface{} { return c.MaintenanceStart }},
+	{"maintenance_end", func(c *Configuration) interface{} { return c.MaintenanceEnd }},
+	{"maintenance_message", func(c *Configuration) interface{} { return c.MaintenanceMessage }},
+	{"min_app_version", func(c *Configuration) interface{} { return c.MinAppVersion }},
+	{"disable_plaintext_pins", func(c *Configuration) interface{} { return c.DisablePlaintextPins }},
+	{"read_only", func(c *Configuration) interface{} { return c.ReadOnly }},
+}
+
+// Settings that are only used when the server starts, so that changing them requires a restart.
+var immutableSettings = []configSetting{
+	{"path_prefix", func(c *Configuration) interface{} { prefix, _ := parsePathPrefix(c.PathPrefix); return prefix }},
+	{"db_type", func(c *Configuration) interface{} { return c.DBType }},
+	{"db_str", func(c *Configuration) interface{} { return c.DBConnStr }},
+	{"db_timeout", func(c *Configuration) interface{} { return withDefault(c.DBTimeout, DBTimeoutDefault) }},
+	{"db_slow_threshold", func(c *Configuration) interface{} { return withDefault(c.DBSlowThreshold, DBSlowThresholdDefault) }},
+	{"jwt_key_id", func(c *Configuration) interface{} { return c.JwtKeyID }},
+	{"jwt_issuer", func(c *Configuration) interface{} { return c.JwtIssuer }},
+	{"jwt_audience", func(c *Configuration) interface{} { return c.JwtAudience }},
+	{"jwt_pin_expiry", func(c *Configuration) interface{} { return c.JwtPinExpiry }},
+	{"jwt_privkey", func(c *Configuration) interface{} { return c.JwtPrivateKey }},
+	{"jwt_privkey_file", func(c *Configuration) interface{} { return c.JwtPrivateKeyFile }},
+	{"jwt_accept_missing_claims", func(c *Configuration) interface{} { return c.JwtAcceptMissingClaims }},
+	{"storage_primary_key_file", func(c *Configuration) interface{} { return c.StoragePrimaryKeyFile }},
+	{"storage_fallback_key_files", func(c *Configuration) interface{} { return c.StorageFallbackKeyFiles }},
+	{"pin_encryption_key", func(c *Configuration) interface{} { return c.PinEncryptionKey }},
+	{"pin_encryption_key_file", func(c *Configuration) interface{} { return c.PinEncryptionKeyFile }},
+	{"keyshare_attributes", func(c *Configuration) interface{} { return c.keyshareAttributes() }},
+	{"oidc_issuer", func(c *Configuration) interface{} { return c.OIDCIssuer }},
+	{"oidc_audience", func(c *Configuration) interface{} { return c.OIDCAudience }},
+	{"oidc_required_claims", func(c *Configuration) interface{} { return c.OIDCRequiredClaims }},
+	{"oidc_jwks_url", func(c *Configuration) interface{} { return c.OIDCJWKSURL }},
+	{"require_registration_attestation", func(c *Configuration) interface{} { return c.RequireRegistrationAttestation }},
+	{"admin_token", func(c *Configuration) interface{} { return c.AdminToken }},
+	{"uniform_pin_responses", func(c *Configuration) interface{} { return c.UniformPinResponses }},
+	{"pinned_scheme_key_files", func(c *Configuration) interface{} { return c.PinnedSchemeKeyFiles }},
+	{"trusted_issuers", func(c *Configuration) interface{} { return c.TrustedIssuers }},
+	{"error_report_file", func(c *Configuration) interface{} { return c.ErrorReportFile }},
+}
+
+// withDefault returns the value of a setting, or its default if it is 0. The running configuration
+// has its defaults applied while new configurations do not, so this prevents false changes.
+func withDefault(value, def int) int {
+	if value == 0 {
+		return def
+	}
+	return value
+}
+
+// changedSettings returns the names of the settings that differ between the configurations.
+// Empty and nil maps and slices are considered equal.
+func changedSettings(settings []configSetting, old, new *Configuration) []string {
+	var changed []string
+	for _, setting := range settings {
+		v1, v2 := reflect.ValueOf(setting.value(old)), reflect.ValueOf(setting.value(new))
+		if (v1.Kind() == reflect.Map || v1.Kind() == reflect.Slice) && v1.Len() == 0 && v2.Len() == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(v1.Interface(), v2.Interface()) {
+			changed = append(changed, setting.name)
+		}
+	}
+	return changed
+}
+
+func (s *Server) currentConf() *Configuration {
+	s.confMutex.RLock()
+	defer s.confMutex.RUnlock()
+	return s.current
+}
+
+// ReloadConfig changes the configuration of the running server, without interrupting the handling
+// of requests. It changes the email settings (including the registration email templates, the
+// verification URLs and the validity of email verification tokens), the validity of recovery tokens,
+// the database failure threshold, whether /api/ready ignores public keys that failed to load, the
+// retention of log entries, the deprecation and sunset announcement, the status announced in
+// /api/status, whether plaintext PINs are refused, read-only maintenance mode (if changed in the
+// configuration, overriding /admin/read-only), and the log verbosity (unless the new configuration
+// specifies another Logger than the running server).
+//
+// The other settings of the keyshare server, such as the database connection, the JWT and storage
+// keys and the keyshare attributes, are only used when the server starts: if they differ from those
+// of the running server, the new configuration is rejected with an error listing them. The other
+// settings of the embedded IRMA server configuration (including its Hooks), and the
+// RegistrationAttestor, are ignored.
+//
+// The new configuration is validated as by New; if it is rejected, the running configuration is
+// left unchanged. Reloads are logged, and reported to Hooks.OnConfigReload.
+func (s *Server) ReloadConfig(newConf *Configuration) error {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	changed, err := s.reloadConfig(newConf)
+	s.conf.Hooks.ConfigReload(changed, err)
+	if err != nil {
+		return err
+	}
+	s.conf.Logger.WithField("changed", changed).Info("Configuration reloaded")
+	return nil
+}
+
+func (s *Server) reloadConfig(newConf *Configuration) ([]string, error) {
+	current := s.currentConf()
+	if changed := changedSettings(immutableSettings, current, newConf); len(changed) > 0 {
+		return nil, server.LogError(errors.Errorf(
+			"Cannot reload configuration: changing %s requires a restart", strings.Join(changed, ", ")))
+	}
+
+	conf := *current
+	conf.EmailConfiguration = newConf.EmailConfiguration
+	conf.RegistrationEmailFiles = newConf.RegistrationEmailFiles
+	conf.RegistrationEmailSubjects = newConf.RegistrationEmailSubjects
+	conf.VerificationURL = map[string]string{}
+	for lang, u := range newConf.VerificationURL {
+		conf.VerificationURL[lang] = u
+	}
+	conf.EmailTokenValidity = newConf.EmailTokenValidity
+	conf.RecoveryTokenValidity = newConf.RecoveryTokenValidity
+	conf.DBFailureThreshold = newConf.DBFailureThreshold
+	conf.ReadyIgnoresKeyFailures = newConf.ReadyIgnoresKeyFailures
+	conf.LogRetention = newConf.LogRetention
+	conf.DeprecationDate = newConf.DeprecationDate
+	conf.SunsetDate = newConf.SunsetDate
+	conf.VersionMessage = newConf.VersionMessage
+	conf.MaintenanceStart = newConf.MaintenanceStart
+	conf.MaintenanceEnd = newConf.MaintenanceEnd
+	conf.MaintenanceMessage = newConf.MaintenanceMessage
+	conf.MinAppVersion = newConf.MinAppVersion
+	conf.DisablePlaintextPins = newConf.DisablePlaintextPins
+	conf.ReadOnly = newConf.ReadOnly
+	if err := validateReloadableConf(&conf); err != nil {
+		return nil, err
+	}
+	changed := changedSettings(reloadableSettings, current, &conf)
+
+	// The logger is shared with the embedded IRMA server, and its level can be changed concurrently
+	logger := s.conf.Logger
+	if newConf.Configuration != nil && (newConf.Logger == nil || newConf.Logger == logger) {
+		if level := server.Verbosity(newConf.Verbose); level != logger.GetLevel() {
+			logger.SetLevel(level)
+			changed = append(changed, "verbose")
+		}
+	}
+
+	s.confMutex.Lock()
+	s.current = &conf
+	s.confMutex.Unlock()
+	if conf.ReadOnly != current.ReadOnly {
+		s.SetReadOnly(conf.ReadOnly)
+	}
+	return changed, nil
+}
@@ -0,0 +1,124 @@
+package keyshareserver
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadConfig(t *testing.T) {
+	type reload struct {
+		changed []string
+		err     error
+	}
+	var lock sync.Mutex
+	var reloads []reload
+	defer func(l, il *logrus.Logger) { server.Logger = l; irma.SetLogger(il) }(server.Logger, irma.Logger)
+	logger, _ := logrustest.NewNullLogger()
+	db := createDB(t)
+	conf := testConfiguration(t, db, "")
+	conf.Logger = logger
+	conf.Hooks = &server.Hooks{OnConfigReload: func(changed []string, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		reloads = append(reloads, reload{changed, err})
+	}}
+	keyshareServer, httpServer := startKeyshareServer(t, conf)
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	// Requests are handled while the configuration is reloaded
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				res, err := http.Get("http://localhost:8080/api/version")
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, http.StatusOK, res.StatusCode)
+				assert.NoError(t, res.Body.Close())
+			}
+		}()
+	}
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	newConf := func() *Configuration {
+		c := testConfiguration(t, db, "")
+		c.Logger = logger
+		return c
+	}
+
+	// Accepted reload
+	c := newConf()
+	c.SunsetDate = "2030-01-01T00:00:00Z"
+	c.VersionMessage = map[string]string{"en": "Please update your app"}
+	c.Verbose = 2
+	require.NoError(t, keyshareServer.ReloadConfig(c))
+	require.Equal(t, logrus.TraceLevel, logger.GetLevel())
+
+	var info irma.KeyshareVersionInfo
+	test.HTTPGet(t, nil, "http://localhost:8080/api/version", nil, 200, &info)
+	require.NotNil(t, info.Sunset)
+	require.Equal(t, int64(1893456000), time.Time(*info.Sunset).Unix())
+	require.Equal(t, "Please update your app", info.Message["en"])
+
+	// Reloading the same configuration changes nothing
+	require.NoError(t, keyshareServer.ReloadConfig(c))
+
+	// Changes to settings that are only used at startup are rejected
+	c = newConf()
+	c.StoragePrimaryKeyFile = filepath.Join(filepath.Dir(c.StoragePrimaryKeyFile), "otherkey")
+	c.KeyshareAttribute = irma.NewAttributeTypeIdentifier("test.test.mijnirma.other")
+	c.DBType = DBTypePostgres
+	err := keyshareServer.ReloadConfig(c)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "db_type, storage_primary_key_file, keyshare_attributes")
+
+	// Invalid configurations are rejected
+	c = newConf()
+	c.SunsetDate = "next year"
+	require.Error(t, keyshareServer.ReloadConfig(c))
+	c = newConf()
+	c.DisablePlaintextPins = true
+	require.Error(t, keyshareServer.ReloadConfig(c))
+
+	// Rejected reloads leave the running configuration unchanged
+	info = irma.KeyshareVersionInfo{}
+	test.HTTPGet(t, nil, "http://localhost:8080/api/version", nil, 200, &info)
+	require.NotNil(t, info.Sunset)
+	require.Equal(t, logrus.TraceLevel, logger.GetLevel())
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Len(t, reloads, 5)
+	require.Equal(t, []string{"sunset_date", "version_message", "verbose"}, reloads[0].changed)
+	require.NoError(t, reloads[0].err)
+	require.Empty(t, reloads[1].changed)
+	require.NoError(t, reloads[1].err)
+	for _, r := range reloads[2:] {
+		require.Error(t, r.err)
+	}
+	require.True(t, strings.HasPrefix(reloads[2].err.Error(), "Cannot reload configuration"))
+}
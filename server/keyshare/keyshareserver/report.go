@@ -0,0 +1,119 @@
+package keyshareserver
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Maximum size in bytes of the request body of /api/report
+	errorReportMaxSize = 4 * irma.ClientErrorReportMaxStack
+	// Maximum length of the fields of error reports other than the stack trace
+	errorReportMaxFieldLength = 128
+	// Amount of error reports accepted per IP address per minute
+	errorReportRateLimitIP = 10
+)
+
+// ErrorReportSink stores the error reports that clients send to /api/report
+// (see irmaclient.Client.ReportSessionError).
+type ErrorReportSink interface {
+	Store(report *irma.ClientErrorReport) error
+}
+
+// FileErrorReportSink appends error reports as JSON lines to a file.
+type FileErrorReportSink struct {
+	Path string
+	lock sync.Mutex
+}
+
+func (s *FileErrorReportSink) Store(report *irma.ClientErrorReport) error {
+	bts, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	f, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(bts, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// logErrorReportSink logs error reports, if no ErrorReportFile or ErrorReportSink is configured.
+type logErrorReportSink struct {
+	logger *logrus.Logger
+}
+
+func (s logErrorReportSink) Store(report *irma.ClientErrorReport) error {
+	s.logger.WithFields(logrus.Fields{
+		"session":       report.SessionTokenHash,
+		"errorType":     report.ErrorType,
+		"remoteError":   report.RemoteError,
+		"remoteStatus":  report.RemoteStatus,
+		"clientVersion": report.ClientVersion,
+		"platform":      report.Platform,
+		"stack":         report.Stack,
+	}).Warn("Client error report")
+	return nil
+}
+
+// validateErrorReport checks that the fields of the report are present and not too long.
+func validateErrorReport(report *irma.ClientErrorReport) error {
+	if report.ErrorType == "" {
+		return errors.New("missing error type")
+	}
+	if report.SessionTokenHash != "" {
+		if hash, err := hex.DecodeString(report.SessionTokenHash); err != nil || len(hash) != 32 {
+			return errors.New("session token hash must be a hex encoded SHA-256 hash")
+		}
+	}
+	for _, field := range []string{string(report.ErrorType), report.RemoteError, report.ClientVersion, report.Platform} {
+		if len(field) > errorReportMaxFieldLength {
+			return errors.Errorf("fields may contain at most %d bytes", errorReportMaxFieldLength)
+		}
+	}
+	if len(report.Stack) > irma.ClientErrorReportMaxStack {
+		return errors.Errorf("stack trace may contain at most %d bytes", irma.ClientErrorReportMaxStack)
+	}
+	return nil
+}
+
+// /api/report
+func (s *Server) handleErrorReport(w http.ResponseWriter, r *http.Request) {
+	if !s.errorReportLimiter.allow(s.conf.TrustedProxyNetworks.ClientIP(r), errorReportRateLimitIP) {
+		w.Header().Set("Retry-After", "60")
+		server.WriteError(w, server.ErrorTooManyRequests, "too many error reports")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, errorReportMaxSize)
+	var report irma.ClientErrorReport
+	if err := server.ParseBody(r, &report); err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	if err := validateErrorReport(&report); err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+
+	if err := s.conf.ErrorReportSink.Store(&report); err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not store error report")
+		s.writeInternalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
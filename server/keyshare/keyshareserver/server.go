@@ -1,10 +1,23 @@
 package keyshareserver
 
 import (
+	"bytes"
 	"context"
-	"fmt"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-errors/errors"
@@ -14,11 +27,13 @@ import (
 	"github.com/privacybydesign/gabi/big"
 	irma "github.com/privacybydesign/irmago"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/curve25519"
 
 	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/privacybydesign/irmago/internal/keysharecore"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/privacybydesign/irmago/server/keyshare"
 
 	"github.com/go-chi/chi"
 )
@@ -26,6 +41,10 @@ import (
 type Server struct {
 	// configuration
 	conf *Configuration
+	// Configuration in use, differing from conf in the settings changed by ReloadConfig
+	confMutex   sync.RWMutex
+	current     *Configuration
+	reloadMutex sync.Mutex
 
 	// external components
 	core     *keysharecore.Core
@@ -38,67 +57,280 @@ type Server struct {
 
 	// Session data, keeping track of current keyshare protocol session state for each user
 	store sessionStore
+
+	// Synthetic PIN attempts of unknown users, if Configuration.UniformPinResponses is enabled
+	unknownUsers *unknownUserStore
+
+	// Issuance sessions of the keyshare credential started on registration, by their token
+	registrationSessions *registrationSessionStore
+	pinMessages          *pinMessageStore
+
+	// Requests to /users/pinstatus in the current minute per username and IP address
+	pinStatusLimiter *requestLimiter
+	// Requests to /api/report in the current minute per IP address
+	errorReportLimiter *requestLimiter
+
+	// Result of the last loading of the Idemix public keys into the keyshare core
+	keysMutex sync.Mutex
+	keys      *keyLoadResult
+	// Removes the listener that loads the Idemix public keys when the IRMA configuration changes
+	removeUpdateListener func()
+
+	// JWT containing the public key of Configuration.PinEncryptionKey, served at /api/pinkey
+	pinKeyJWT string
+
+	// Whether the server is in read-only maintenance mode (1) or not (0), see Configuration.ReadOnly
+	readOnly int32
+
+	// Ensures that the server is stopped only once, and the error that occurred when stopping it
+	stopOnce sync.Once
+	stopErr  error
+}
+
+// keyLoadResult is the outcome of loading the Idemix public keys into the keyshare core,
+// as returned by /admin/keys and /admin/reload-keys.
+type keyLoadResult struct {
+	Time    *irma.Timestamp                                `json:"time"`
+	Failed  int                                            `json:"failed"`
+	Issuers map[irma.IssuerIdentifier]*issuerKeyLoadResult `json:"issuers"`
+}
+
+type issuerKeyLoadResult struct {
+	Loaded []uint   `json:"loaded,omitempty"`
+	Errors []string `json:"errors,omitempty"`
 }
 
 var errMissingCommitment = errors.New("missing previous call to getCommitments")
 
+// Keys of the values that userMiddleware and authorizationMiddleware store in the request context,
+// of an unexported type so that they cannot collide with those of other packages.
+type contextKey int
+
+const (
+	userKey contextKey = iota
+	authorizationKey
+)
+
+// requestAuthorization is the authorization JWT sent along with a request, and whether it is
+// valid for the user of the request.
+type requestAuthorization struct {
+	token string
+	valid bool
+}
+
+func userFromContext(ctx context.Context) (*User, bool) {
+	user, ok := ctx.Value(userKey).(*User)
+	return user, ok && user != nil
+}
+
+func authorizationFromContext(ctx context.Context) (requestAuthorization, bool) {
+	authorization, ok := ctx.Value(authorizationKey).(requestAuthorization)
+	return authorization, ok
+}
+
+// Maximum amount of requests to /users/pinstatus per minute per username and per IP address, so that
+// it cannot be used to closely monitor when users are blocked. As the IP address is that of the reverse
+// proxy if it is not configured as trusted proxy, its maximum is higher; clients that are refused do not
+// show remaining attempts.
+const (
+	pinStatusRateLimitUser = 10
+	pinStatusRateLimitIP   = 600
+)
+
+// Amount of users fetched at once from the database when exporting all users in /admin/users
+const adminUsersPageSize = 1000
+
+// Device enrollment codes authorizing the enrollment of additional devices of users
+const (
+	enrollmentCodeLength   = 10
+	enrollmentCodeValidity = 5 * time.Minute
+)
+
+// Length of recovery tokens, with which users re-enroll to their existing account on a new device.
+// As they are valid for a long time and stored by clients outside of the app, only their hashes are
+// stored in the database.
+const recoveryTokenLength = 64
+
+// Range of keyshare protocol versions supported by this server
+// (see the X-IRMA-Keyshare-ProtocolVersion header sent by clients)
+// Since version 3, /prove/getResponse returns an irma.KeyshareProofResponse instead of the bare ProofP JWT.
+// Since version 4, PIN verifications and changes for unknown users may result in a synthetic PIN status
+// instead of server.ErrorUserNotRegistered (see Configuration.UniformPinResponses).
+// Since version 5, requests containing a PIN are encrypted to the key published at /api/pinkey
+// (see Configuration.PinEncryptionKey).
+// Since version 6, /client/register returns an irma.KeyshareRegistrationSession instead of the bare
+// session pointer.
+// Since version 7, /prove/getCommitments returns an irma.OrderedProofPCommitmentMap, whose encoding
+// does not depend on map order.
+const (
+	minProtocolVersion = 2
+	maxProtocolVersion = 7
+)
+
+// Page shown to users opening the email verification link in their browser
+var emailVerificationPage = template.Must(template.New("emailverification").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.}}</title></head>
+<body><p>{{.}}</p></body>
+</html>
+`))
+
+// emailVerificationResult is the JSON response of a successful email verification.
+type emailVerificationResult struct {
+	Verified bool `json:"verified"`
+}
+
+// readyStatus is the JSON response of the /api/ready endpoint.
+type readyStatus struct {
+	Ready bool `json:"ready"`
+}
+
+// userStatus is the JSON response of the /users/status endpoint.
+type userStatus struct {
+	EmailVerified bool `json:"emailVerified"`
+}
+
+// New creates and starts a keyshare server. If it returns an error, everything it started is
+// stopped again.
 func New(conf *Configuration) (*Server, error) {
-	var err error
 	s := &Server{
-		conf:      conf,
-		store:     newMemorySessionStore(10 * time.Second),
-		scheduler: gocron.NewScheduler(),
+		conf:                 conf,
+		current:              conf,
+		store:                newMemorySessionStore(10 * time.Second),
+		registrationSessions: newRegistrationSessionStore(),
+		pinMessages:          newPinMessageStore(),
+		scheduler:            gocron.NewScheduler(),
+		pinStatusLimiter:     newRequestLimiter(),
+		errorReportLimiter:   newRequestLimiter(),
+	}
+	if err := s.start(); err != nil {
+		s.Stop()
+		return nil, err
 	}
+	return s, nil
+}
+
+func (s *Server) start() error {
+	var err error
+	conf := s.conf
 
 	// Setup IRMA session server
+	if err = readPinnedSchemeKeys(conf); err != nil {
+		return err
+	}
 	s.irmaserv, err = irmaserver.New(conf.Configuration)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Process configuration and create keyshare core
 	err = validateConf(conf)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	if conf.DB != nil {
 		s.db = conf.DB
 	} else {
 		s.db, err = setupDatabase(conf)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
+	s.db.instrument(keyshare.DBInstrumentation{
+		Timeout:       time.Duration(conf.DBTimeout) * time.Millisecond,
+		SlowThreshold: time.Duration(conf.DBSlowThreshold) * time.Millisecond,
+		OnOperation:   conf.Hooks.KeyshareDBOperation,
+	})
 	s.core, err = setupCore(conf)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if conf.pinEncryptionKey != nil {
+		pinKey, err := curve25519.X25519(conf.pinEncryptionKey, curve25519.Basepoint)
+		if err != nil {
+			return server.LogError(errors.WrapPrefix(err, "invalid PIN encryption key", 0))
+		}
+		if s.pinKeyJWT, err = s.core.SignPinEncryptionKey(pinKey); err != nil {
+			return server.LogError(err)
+		}
 	}
 
 	// Load Idemix keys into core, and ensure that new keys added in the future will be loaded as well.
 	if err = s.loadIdemixKeys(conf.IrmaConfiguration); err != nil {
-		return nil, err
+		return err
 	}
-	conf.IrmaConfiguration.UpdateListeners = append(conf.IrmaConfiguration.UpdateListeners, func(c *irma.Configuration) {
+	s.removeUpdateListener = conf.IrmaConfiguration.AddUpdateListener(func(c *irma.Configuration) {
 		if err := s.loadIdemixKeys(c); err != nil {
 			// run periodically; can only log the error here
 			_ = server.LogError(err)
 		}
-	})
+	}, false)
+
+	if conf.ReadOnly {
+		s.readOnly = 1
+	}
+	conf.Hooks.KeyshareReadOnly(conf.ReadOnly)
+
+	if conf.UniformPinResponses {
+		if s.unknownUsers, err = newUnknownUserStore(conf.uniformPinResponsesKey, maxUnknownUsers); err != nil {
+			return err
+		}
+		s.scheduler.Every(10).Minutes().Do(s.unknownUsers.flush)
+	}
 
 	// Setup session cache clearing
 	s.scheduler.Every(10).Seconds().Do(s.store.flush)
+	s.scheduler.Every(10).Minutes().Do(s.registrationSessions.flush)
+	s.scheduler.Every(1).Minute().Do(s.pinMessages.flush)
+	s.scheduler.Every(1).Minute().Do(s.pinStatusLimiter.reset)
+	s.scheduler.Every(1).Minute().Do(s.errorReportLimiter.reset)
+
+	// Usage statistics are aggregated per completed day. Checking hourly for days to aggregate ensures
+	// that this happens soon after midnight (UTC), also when the server is restarted.
+	s.scheduler.Every(1).Hour().Do(s.rollupUsage)
+	s.scheduler.Every(1).Hour().Do(s.deleteExpiredLogs)
 	s.stopScheduler = s.scheduler.Start()
 
-	return s, nil
+	return nil
 }
 
+// Stop stops the server: first its scheduled jobs, then the loading of Idemix public keys and the
+// embedded IRMA server, and finally it closes the database if the server opened it (i.e., if
+// Configuration.DB was not set). It can be called more than once, and also on a nil server as
+// returned by New when it failed.
 func (s *Server) Stop() {
-	s.stopScheduler <- true
-	s.irmaserv.Stop()
+	_ = s.Close()
+}
+
+// Close stops the server like Stop, returning the error that occurred when closing the database, if any.
+// It implements io.Closer.
+func (s *Server) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.stopOnce.Do(func() {
+		if s.stopScheduler != nil {
+			s.stopScheduler <- true
+		}
+		if s.removeUpdateListener != nil {
+			s.removeUpdateListener()
+		}
+		if s.irmaserv != nil {
+			s.irmaserv.Stop()
+		}
+		if closer, ok := s.db.(io.Closer); ok && s.conf.DB == nil {
+			s.stopErr = closer.Close()
+		}
+	})
+	return s.stopErr
 }
 
+// Handler returns a http.Handler that handles all keyshare server requests. To protect the http.Server
+// serving it against slow clients, apply the ConfigureHTTPServer() and LimitListener() methods of
+// the server.Configuration to it.
 func (s *Server) Handler() http.Handler {
 	router := chi.NewRouter()
+	router.Use(server.HooksMiddleware(s.conf.Hooks))
 
 	router.Group(func(router chi.Router) {
 		router.Use(server.SizeLimitMiddleware)
@@ -106,54 +338,156 @@ func (s *Server) Handler() http.Handler {
 
 		opts := server.LogOptions{Response: true, Headers: true, From: false, EncodeBinary: true}
 		router.Use(server.LogMiddleware("keyshareserver", opts))
+		router.Use(s.sunsetMiddleware)
+
+		router.Get("/api/version", s.handleVersion)
+		router.Get("/api/status", s.handleStatus)
+		router.Get("/api/ready", s.handleReady)
+		if s.pinKeyJWT != "" {
+			router.Get("/api/pinkey", s.handlePinKey)
+		}
+		router.Post("/api/report", s.handleErrorReport)
 
 		// Registration
-		router.Post("/client/register", s.handleRegister)
+		router.With(s.readOnlyMiddleware, s.pinDecryptionMiddleware("client/register")).Post("/client/register", s.handleRegister)
+		router.With(s.readOnlyMiddleware, s.pinDecryptionMiddleware("client/recover")).Post("/client/recover", s.handleRecover)
+		router.With(s.readOnlyMiddleware, s.pinDecryptionMiddleware("client/register/device")).Post("/client/register/device", s.handleRegisterDevice)
+		router.Get("/client/register/{token}/status", s.handleRegistrationStatus)
 
 		// Pin logic
-		router.Post("/users/verify/pin", s.handleVerifyPin)
-		router.Post("/users/change/pin", s.handleChangePin)
+		router.With(s.pinDecryptionMiddleware("users/verify/pin")).Post("/users/verify/pin", s.handleVerifyPin)
+		router.With(s.readOnlyMiddleware, s.pinDecryptionMiddleware("users/change/pin")).Post("/users/change/pin", s.handleChangePin)
+		router.Get("/users/pinstatus", s.handlePinStatus)
+
+		// Email address verification
+		router.With(s.readOnlyMiddleware).Get("/users/email/verify/{token}", s.handleVerifyEmail)
+		router.With(s.readOnlyMiddleware).Post("/users/email/verify/{token}", s.handleVerifyEmail)
+		router.With(s.readOnlyMiddleware).Get("/users/email/unsubscribe/{token}", s.handleUnsubscribe)
+		router.With(s.readOnlyMiddleware).Post("/users/email/unsubscribe/{token}", s.handleUnsubscribe)
 
 		// Keyshare sessions
 		router.Group(func(router chi.Router) {
 			router.Use(s.userMiddleware)
 			router.Use(s.authorizationMiddleware)
+			router.Get("/users/status", s.handleUserStatus)
+			router.With(s.readOnlyMiddleware).Put("/users/email", s.handleChangeEmail)
+			router.With(s.readOnlyMiddleware).Delete("/users/email", s.handleRemoveEmail)
+			router.Get("/users/devices", s.handleDevices)
+			router.With(s.readOnlyMiddleware).Post("/users/devices/code", s.handleEnrollmentCode)
+			router.With(s.readOnlyMiddleware).Post("/users/devices/{id}/revoke", s.handleRevokeDevice)
+			router.With(s.readOnlyMiddleware).Post("/users/recovery/token", s.handleRecoveryToken)
 			router.Post("/prove/getCommitments", s.handleCommitments)
 			router.Post("/prove/getResponse", s.handleResponse)
 		})
 	})
 
+	// Administration endpoints, not subject to the write timeout as exporting all users may take long
+	if s.conf.AdminToken != "" {
+		router.Group(func(router chi.Router) {
+			opts := server.LogOptions{Response: false, Headers: false, From: true, TrustedProxies: s.conf.TrustedProxyNetworks}
+			router.Use(server.LogMiddleware("keyshareserver-admin", opts))
+			router.Use(s.adminMiddleware)
+			router.Get("/admin/stats", s.handleAdminStats)
+			router.Get("/admin/stats/usage", s.handleAdminUsageStats)
+			router.Get("/admin/users", s.handleAdminUsers)
+			router.Get("/admin/keys", s.handleAdminKeys)
+			router.Post("/admin/reload-keys", s.handleAdminReloadKeys)
+			router.Get("/admin/read-only", s.handleAdminReadOnly)
+			router.Post("/admin/read-only", s.handleAdminReadOnly)
+		})
+	}
+
 	// IRMA server for issuing myirma credential during registration
 	router.Mount("/irma/", s.irmaserv.HandlerFunc())
+
+	if s.conf.PathPrefix != "" {
+		return stripPathPrefix(s.conf.PathPrefix, router)
+	}
 	return router
 }
 
-// On configuration changes, update the keyshare core with all current public keys of the IRMA issuers.
+// stripPathPrefix removes the prefix from the paths of requests to the handler. Contrary to
+// http.StripPrefix, requests whose paths do not start with the prefix are passed on unchanged, so
+// that the handler serves both requests forwarded by a proxy that keeps the prefix and requests
+// sent directly to the server (e.g. health checks).
+func stripPathPrefix(prefix string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(r.URL.Path, prefix)
+		if p == r.URL.Path || (p != "" && p[0] != '/') {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if p == "" {
+			p = "/"
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = p
+		r2.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, prefix)
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// On configuration changes, update the keyshare core with all current public keys of the IRMA issuers
+// (or of the trusted issuers, if configured). The result is recorded per issuer, for inspection by
+// operators using /admin/keys.
 func (s *Server) loadIdemixKeys(conf *irma.Configuration) error {
+	s.keysMutex.Lock()
+	defer s.keysMutex.Unlock()
+
+	now := irma.Timestamp(time.Now())
+	result := &keyLoadResult{Time: &now, Issuers: map[irma.IssuerIdentifier]*issuerKeyLoadResult{}}
+	loaded := 0
 	errs := multierror.Error{}
+	fail := func(issuerResult *issuerKeyLoadResult, err error) {
+		errs.Errors = append(errs.Errors, err)
+		issuerResult.Errors = append(issuerResult.Errors, err.Error())
+		result.Failed++
+	}
+
 	for _, issuer := range conf.Issuers {
+		if !s.conf.trustsIssuer(issuer.Identifier()) {
+			continue
+		}
+		issuerResult := &issuerKeyLoadResult{}
+		result.Issuers[issuer.Identifier()] = issuerResult
 		keyIDs, err := conf.PublicKeyIndices(issuer.Identifier())
 		if err != nil {
-			errs.Errors = append(errs.Errors, errors.Errorf("issuer %v: could not find key IDs: %v", issuer, err))
+			fail(issuerResult, errors.Errorf("issuer %v: could not find key IDs: %v", issuer, err))
 			continue
 		}
 		for _, id := range keyIDs {
 			key, err := conf.PublicKey(issuer.Identifier(), id)
 			if err != nil {
-				errs.Errors = append(errs.Errors, server.LogError(errors.Errorf("key %v-%v: could not fetch public key: %v", issuer, id, err)))
+				fail(issuerResult, server.LogError(errors.Errorf("key %v-%v: could not fetch public key: %v", issuer, id, err)))
+				continue
+			}
+			if key == nil {
+				// e.g. the key file is not contained in the signed index of the scheme
+				fail(issuerResult, server.LogError(errors.Errorf("key %v-%v: public key not found", issuer, id)))
 				continue
 			}
 			s.core.DangerousAddTrustedPublicKey(irma.PublicKeyIdentifier{Issuer: issuer.Identifier(), Counter: id}, key)
+			issuerResult.Loaded = append(issuerResult.Loaded, id)
+			loaded++
 		}
 	}
+
+	s.keys = result
+	s.conf.Hooks.KeyshareKeysLoaded(loaded, result.Failed)
 	return errs.ErrorOrNil()
 }
 
 // /prove/getCommitments
 func (s *Server) handleCommitments(w http.ResponseWriter, r *http.Request) {
 	// Fetch from context
-	user := r.Context().Value("user").(*User)
-	authorization := r.Context().Value("authorization").(string)
+	ctx := r.Context()
+	user, authorization, ok := s.requestUser(w, r)
+	if !ok {
+		return
+	}
 
 	// Read keys
 	var keys []irma.PublicKeyIdentifier
@@ -167,23 +501,29 @@ func (s *Server) handleCommitments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	commitments, err := s.generateCommitments(user, authorization, keys)
+	start := time.Now()
+	commitments, err := s.generateCommitments(ctx, user, authorization.token, keys)
+	s.conf.Hooks.KeyshareOperation(user.Username, server.KeyshareOperationCommitments, time.Since(start), err)
 	if err != nil && (err == keysharecore.ErrInvalidChallenge || err == keysharecore.ErrInvalidJWT) {
 		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
 		return
 	}
 	if err != nil {
 		// already logged
-		server.WriteError(w, server.ErrorInternal, err.Error())
+		s.writeInternalError(w, r, err)
 		return
 	}
 
-	server.WriteJson(w, commitments)
+	if protocolVersion(r) < 7 {
+		server.WriteJson(w, commitments)
+		return
+	}
+	server.WriteJson(w, (*irma.OrderedProofPCommitmentMap)(commitments))
 }
 
-func (s *Server) generateCommitments(user *User, authorization string, keys []irma.PublicKeyIdentifier) (*irma.ProofPCommitmentMap, error) {
+func (s *Server) generateCommitments(ctx context.Context, user *User, authorization string, keys []irma.PublicKeyIdentifier) (*irma.ProofPCommitmentMap, error) {
 	// Generate commitments
-	commitments, commitID, err := s.core.GenerateCommitments(user.Secrets, authorization, keys)
+	commitments, commitID, err := s.core.GenerateCommitments(ctx, user.Secrets, authorization, keys)
 	if err != nil {
 		s.conf.Logger.WithField("error", err).Warn("Could not generate commitments for request")
 		return nil, err
@@ -212,70 +552,97 @@ func (s *Server) generateCommitments(user *User, authorization string, keys []ir
 // /prove/getResponse
 func (s *Server) handleResponse(w http.ResponseWriter, r *http.Request) {
 	// Fetch from context
-	user := r.Context().Value("user").(*User)
-	authorization := r.Context().Value("authorization").(string)
+	ctx := r.Context()
+	user, authorization, ok := s.requestUser(w, r)
+	if !ok {
+		return
+	}
 
 	// Read challenge
-	challenge := new(big.Int)
+	challenge := new(irma.BigInt)
 	if err := server.ParseBody(r, challenge); err != nil {
 		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
 		return
 	}
 
 	// verify access (avoids leaking whether there is a session ongoing to unauthorized callers)
-	if !r.Context().Value("hasValidAuthorization").(bool) {
+	if !authorization.valid {
 		s.conf.Logger.Warn("Could not generate keyshare response due to invalid authorization")
 		server.WriteError(w, server.ErrorInvalidRequest, "Invalid authorization")
 		return
 	}
 
 	// And do the actual responding
-	proofResponse, err := s.generateResponse(user, authorization, challenge)
+	start := time.Now()
+	proofResponse, commitID, err := s.generateResponse(ctx, user, authorization.token, challenge.Int())
+	s.conf.Hooks.KeyshareOperation(user.Username, server.KeyshareOperationResponse, time.Since(start), err)
 	if err != nil &&
 		(err == keysharecore.ErrInvalidChallenge ||
 			err == keysharecore.ErrInvalidJWT ||
+			err == keysharecore.ErrCommitmentConsumed ||
 			err == errMissingCommitment) {
 		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
 		return
 	}
 	if err != nil {
 		// already logged
-		server.WriteError(w, server.ErrorInternal, err.Error())
+		s.writeInternalError(w, r, err)
 		return
 	}
 
-	server.WriteString(w, proofResponse)
+	if protocolVersion(r) < 3 {
+		server.WriteString(w, proofResponse)
+		return
+	}
+	server.WriteJson(w, irma.KeyshareProofResponse{
+		JWT:       proofResponse,
+		SessionID: strconv.FormatUint(commitID, 10),
+	})
 }
 
-func (s *Server) generateResponse(user *User, authorization string, challenge *big.Int) (string, error) {
+func (s *Server) generateResponse(ctx context.Context, user *User, authorization string, challenge *big.Int) (string, uint64, error) {
 	// Get data from session
 	sessionData := s.store.get(user.Username)
 	if sessionData == nil {
 		s.conf.Logger.Warn("Request for response without previous call to get commitments")
-		return "", errMissingCommitment
+		return "", 0, errMissingCommitment
 	}
 
 	// Indicate activity on user account
-	err := s.db.setSeen(user)
-	if err != nil {
-		s.conf.Logger.WithField("error", err).Error("Could not mark user as seen recently")
+	if err := s.db.setSeen(ctx, user); err != nil {
 		// Do not send to user
+		_ = s.activityError(ctx, err, "Could not mark user as seen recently")
 	}
 
 	// Make log entry
-	err = s.db.addLog(user, eventTypeIRMASession, nil)
-	if err != nil {
-		s.conf.Logger.WithField("error", err).Error("Could not add log entry for user")
-		return "", err
+	if err := s.db.addLog(ctx, user, LogEventIRMASession, nil); err != nil {
+		// Do not fail the session of the user just because the database is briefly unavailable
+		_ = s.activityError(ctx, err, "Could not add log entry for user")
 	}
 
-	proofResponse, err := s.core.GenerateResponse(user.Secrets, authorization, sessionData.CommitID, challenge, sessionData.KeyID)
+	proofResponse, err := s.core.GenerateResponse(ctx, user.Secrets, authorization, sessionData.CommitID, challenge, sessionData.KeyID)
 	if err != nil {
-		s.conf.Logger.WithField("error", err).Error("Could not generate response for request")
-		return "", err
+		s.logError(ctx, err, "Could not generate response for request")
+		return "", 0, err
+	}
+
+	return proofResponse, sessionData.CommitID, nil
+}
+
+// protocolVersion returns the keyshare protocol version sent by the client,
+// defaulting to the minimum supported version if absent or invalid.
+func protocolVersion(r *http.Request) int {
+	version, err := strconv.Atoi(r.Header.Get("X-IRMA-Keyshare-ProtocolVersion"))
+	if err != nil || version < minProtocolVersion {
+		return minProtocolVersion
 	}
+	return version
+}
 
-	return proofResponse, nil
+// uniformPinResponses returns whether a synthetic PIN status should be sent instead of
+// server.ErrorUserNotRegistered, for PIN verifications and changes of unknown users.
+func (s *Server) uniformPinResponses(r *http.Request) bool {
+	return s.unknownUsers != nil && protocolVersion(r) >= 4
 }
 
 // /users/verify/pin
@@ -288,7 +655,22 @@ func (s *Server) handleVerifyPin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Fetch user
-	user, err := s.db.user(msg.Username)
+	user, err := s.user(r.Context(), msg.Username, r.Header.Get("X-IRMA-Keyshare-Device"))
+	if err == errDeviceNotFound {
+		s.conf.Logger.WithField("username", msg.Username).Warn("Could not find device in db")
+		server.WriteError(w, server.ErrorDeviceNotRegistered, "")
+		return
+	}
+	if err != nil && s.requestCancelled(r) {
+		return
+	}
+	if err == keyshare.ErrUserNotFound && s.uniformPinResponses(r) {
+		s.conf.Logger.WithField("username", msg.Username).Warn("PIN verification for unknown user, sending synthetic PIN status")
+		status := s.unknownUsers.pinStatus(msg.Username)
+		s.translatePinStatus(&status, requestedLanguages(r, msg.Language)...)
+		server.WriteJson(w, status)
+		return
+	}
 	if err != nil {
 		s.conf.Logger.WithFields(logrus.Fields{"username": msg.Username, "error": err}).Warn("Could not find user in db")
 		server.WriteError(w, server.ErrorUserNotRegistered, "")
@@ -296,71 +678,120 @@ func (s *Server) handleVerifyPin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// and verify pin
-	result, err := s.verifyPin(user, msg.Pin)
+	start := time.Now()
+	result, err := s.verifyPin(r.Context(), user, msg.Pin)
+	s.conf.Hooks.KeyshareOperation(user.Username, server.KeyshareOperationVerifyPin, time.Since(start), err)
 	if err != nil {
 		// already logged
-		server.WriteError(w, server.ErrorInternal, err.Error())
+		s.writeInternalError(w, r, err)
 		return
 	}
+	s.translatePinStatus(&result, append(requestedLanguages(r, msg.Language), user.Language)...)
 
 	server.WriteJson(w, result)
 }
 
-func (s *Server) verifyPin(user *User, pin string) (irma.KeysharePinStatus, error) {
+// handlePinStatus returns the remaining PIN attempts of the user, and how long the user is blocked,
+// so that clients can show these before asking for the PIN. As the user is not yet authenticated, this
+// does not require a JWT; the same synthetic attempts as in handleVerifyPin are returned for unknown
+// users if Configuration.UniformPinResponses is enabled.
+func (s *Server) handlePinStatus(w http.ResponseWriter, r *http.Request) {
+	username := r.Header.Get("X-IRMA-Keyshare-Username")
+	if !s.pinStatusLimiter.allow("ip:"+s.conf.TrustedProxyNetworks.ClientIP(r), pinStatusRateLimitIP) ||
+		!s.pinStatusLimiter.allow("user:"+username, pinStatusRateLimitUser) {
+		w.Header().Set("Retry-After", "60")
+		server.WriteError(w, server.ErrorTooManyRequests, "too many PIN status requests")
+		return
+	}
+
+	// Fetch user
+	user, err := s.user(r.Context(), username, r.Header.Get("X-IRMA-Keyshare-Device"))
+	if err == errDeviceNotFound {
+		s.conf.Logger.WithField("username", username).Warn("Could not find device in db")
+		server.WriteError(w, server.ErrorDeviceNotRegistered, "")
+		return
+	}
+	if err != nil && s.requestCancelled(r) {
+		return
+	}
+	if err == keyshare.ErrUserNotFound && s.uniformPinResponses(r) {
+		s.conf.Logger.WithField("username", username).Warn("PIN status of unknown user, sending synthetic PIN attempts")
+		server.WriteJson(w, s.unknownUsers.pinAttempts(username))
+		return
+	}
+	if err != nil {
+		s.conf.Logger.WithFields(logrus.Fields{"username": username, "error": err}).Warn("Could not find user in db")
+		server.WriteError(w, server.ErrorUserNotRegistered, "")
+		return
+	}
+
+	tries, wait, err := s.db.pinTries(r.Context(), user)
+	if err != nil {
+		s.logError(r.Context(), err, "Could not fetch PIN attempts of user")
+		s.writeInternalError(w, r, err)
+		return
+	}
+	server.WriteJson(w, irma.KeysharePinAttempts{Remaining: tries, Blocked: wait})
+}
+
+func (s *Server) verifyPin(ctx context.Context, user *User, pin string) (irma.KeysharePinStatus, error) {
 	// Check whether pin check is currently allowed
-	ok, tries, wait, err := s.reservePinCheck(user)
+	ok, tries, wait, err := s.reservePinCheck(ctx, user)
 	if err != nil {
 		return irma.KeysharePinStatus{}, err
 	}
 	if !ok {
-		return irma.KeysharePinStatus{Status: "error", Message: fmt.Sprintf("%v", wait)}, nil
+		return pinStatusBlocked(wait), nil
 	}
 
 	// At this point, we are allowed to do an actual check (we have successfully reserved a spot for it), so do it.
 	jwtt, err := s.core.ValidatePin(user.Secrets, pin)
 	if err != nil && err != keysharecore.ErrInvalidPin {
 		// Errors other than invalid pin are real errors
-		s.conf.Logger.WithField("error", err).Error("Could not validate pin")
+		s.logError(ctx, err, "Could not validate pin")
 		return irma.KeysharePinStatus{}, err
 	}
 
 	if err == keysharecore.ErrInvalidPin {
 		// Handle invalid pin
-		err = s.db.addLog(user, eventTypePinCheckFailed, tries)
+		err = s.db.addLog(ctx, user, LogEventPinCheckFailed, tries)
 		if err != nil {
-			s.conf.Logger.WithField("error", err).Error("Could not add log entry for user")
-			return irma.KeysharePinStatus{}, err
+			if err = s.activityError(ctx, err, "Could not add log entry for user"); err != nil {
+				return irma.KeysharePinStatus{}, err
+			}
 		}
 		if tries == 0 {
-			err = s.db.addLog(user, eventTypePinCheckBlocked, wait)
+			err = s.db.addLog(ctx, user, LogEventPinCheckBlocked, wait)
 			if err != nil {
-				s.conf.Logger.WithField("error", err).Error("Could not add log entry for user")
-				return irma.KeysharePinStatus{}, err
+				if err = s.activityError(ctx, err, "Could not add log entry for user"); err != nil {
+					return irma.KeysharePinStatus{}, err
+				}
 			}
-			return irma.KeysharePinStatus{Status: "error", Message: fmt.Sprintf("%v", wait)}, nil
+			return pinStatusBlocked(wait), nil
 		} else {
-			return irma.KeysharePinStatus{Status: "failure", Message: fmt.Sprintf("%v", tries)}, nil
+			return pinStatusFailure(tries), nil
 		}
 	}
 
 	// Handle success
-	err = s.db.resetPinTries(user)
+	err = s.db.resetPinTries(ctx, user)
 	if err != nil {
-		s.conf.Logger.WithField("error", err).Error("Could not reset users pin check logic")
+		s.logError(ctx, err, "Could not reset users pin check logic")
 		// Do not send to user
 	}
-	err = s.db.setSeen(user)
+	err = s.db.setSeen(ctx, user)
 	if err != nil {
-		s.conf.Logger.WithField("error", err).Error("Could not indicate user activity")
 		// Do not send to user
+		_ = s.activityError(ctx, err, "Could not indicate user activity")
 	}
-	err = s.db.addLog(user, eventTypePinCheckSuccess, nil)
+	err = s.db.addLog(ctx, user, LogEventPinCheckSuccess, nil)
 	if err != nil {
-		s.conf.Logger.WithField("error", err).Error("Could not add log entry for user")
-		return irma.KeysharePinStatus{}, err
+		if err = s.activityError(ctx, err, "Could not add log entry for user"); err != nil {
+			return irma.KeysharePinStatus{}, err
+		}
 	}
 
-	return irma.KeysharePinStatus{Status: "success", Message: jwtt}, err
+	return irma.KeysharePinStatus{Status: "success", Message: jwtt}, nil
 }
 
 // /users/change/pin
@@ -373,60 +804,126 @@ func (s *Server) handleChangePin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Fetch user
-	user, err := s.db.user(msg.Username)
+	user, err := s.user(r.Context(), msg.Username, r.Header.Get("X-IRMA-Keyshare-Device"))
+	if err == errDeviceNotFound {
+		s.conf.Logger.WithField("username", msg.Username).Warn("Could not find device in db")
+		server.WriteError(w, server.ErrorDeviceNotRegistered, "")
+		return
+	}
+	if err != nil && s.requestCancelled(r) {
+		return
+	}
+	if err == keyshare.ErrUserNotFound && s.uniformPinResponses(r) {
+		s.conf.Logger.WithField("username", msg.Username).Warn("PIN change for unknown user, sending synthetic PIN status")
+		status := s.unknownUsers.pinStatus(msg.Username)
+		s.translatePinStatus(&status, requestedLanguages(r, msg.Language)...)
+		server.WriteJson(w, status)
+		return
+	}
 	if err != nil {
 		s.conf.Logger.WithFields(logrus.Fields{"username": msg.Username, "error": err}).Warn("Could not find user in db")
 		server.WriteError(w, server.ErrorUserNotRegistered, "")
 		return
 	}
 
-	result, err := s.updatePin(user, msg.OldPin, msg.NewPin)
+	start := time.Now()
+	result, err := s.updatePin(r.Context(), user, msg.OldPin, msg.NewPin)
+	s.conf.Hooks.KeyshareOperation(user.Username, server.KeyshareOperationChangePin, time.Since(start), err)
 	if err != nil {
 		// already logged
-		server.WriteError(w, server.ErrorInternal, err.Error())
+		s.writeInternalError(w, r, err)
 		return
 	}
+	s.translatePinStatus(&result, append(requestedLanguages(r, msg.Language), user.Language)...)
 	server.WriteJson(w, result)
 }
 
-func (s *Server) updatePin(user *User, oldPin, newPin string) (irma.KeysharePinStatus, error) {
+func (s *Server) updatePin(ctx context.Context, user *User, oldPin, newPin string) (irma.KeysharePinStatus, error) {
 	// Check whether pin check is currently allowed
-	ok, tries, wait, err := s.reservePinCheck(user)
+	ok, tries, wait, err := s.reservePinCheck(ctx, user)
 	if err != nil {
 		return irma.KeysharePinStatus{}, err
 	}
 	if !ok {
-		return irma.KeysharePinStatus{Status: "error", Message: fmt.Sprintf("%v", wait)}, nil
+		return pinStatusBlocked(wait), nil
 	}
 
-	// Try to do the update
-	user.Secrets, err = s.core.ChangePin(user.Secrets, oldPin, newPin)
+	// Try to do the update, and write the user back
+	changePin := func(user *User) (err error) {
+		user.Secrets, err = s.core.ChangePin(user.Secrets, oldPin, newPin)
+		return err
+	}
+	// If the PIN was changed concurrently, the old PIN is invalid when the update is retried
+	if user.DeviceID != "" {
+		err = s.updateDeviceSecrets(ctx, user, changePin)
+	} else {
+		err = s.updateUser(ctx, user, changePin)
+	}
 	if err == keysharecore.ErrInvalidPin {
 		if tries == 0 {
-			return irma.KeysharePinStatus{Status: "error", Message: fmt.Sprintf("%v", wait)}, nil
+			return pinStatusBlocked(wait), nil
 		} else {
-			return irma.KeysharePinStatus{Status: "failure", Message: fmt.Sprintf("%v", tries)}, nil
+			return pinStatusFailure(tries), nil
 		}
 	} else if err != nil {
-		s.conf.Logger.WithField("error", err).Error("Could not change pin")
+		s.logError(ctx, err, "Could not change pin")
 		return irma.KeysharePinStatus{}, err
 	}
 
 	// Mark pincheck as success, resetting users wait and count
-	err = s.db.resetPinTries(user)
+	err = s.db.resetPinTries(ctx, user)
 	if err != nil {
-		s.conf.Logger.WithField("error", err).Error("Could not reset users pin check logic")
+		s.logError(ctx, err, "Could not reset users pin check logic")
 		// Do not send to user
 	}
 
-	// Write user back
-	err = s.db.updateUser(user)
-	if err != nil {
-		s.conf.Logger.WithField("error", err).Error("Could not write updated user to database")
-		return irma.KeysharePinStatus{}, err
+	return irma.KeysharePinStatus{Status: "success"}, nil
+}
+
+// updateUser applies update to the user and writes it to the database. If the user was changed in
+// the meantime (e.g. by a concurrent PIN change or re-encryption of its secrets), it reads the user
+// again and retries once, so that either change is not silently undone by the other.
+func (s *Server) updateUser(ctx context.Context, user *User, update func(*User) error) error {
+	for retried := false; ; retried = true {
+		if err := update(user); err != nil {
+			return err
+		}
+		// this also normalizes languages stored before they were validated
+		user.Language = s.currentConf().NormalizeLanguage(user.Language)
+		err := s.db.updateUser(ctx, user)
+		if err != errUpdateConflict || retried {
+			return err
+		}
+		current, err := s.db.user(ctx, user.Username)
+		if err != nil {
+			return err
+		}
+		*user = *current
 	}
+}
 
-	return irma.KeysharePinStatus{Status: "success"}, nil
+// updateDeviceSecrets is like updateUser, for the secrets of the additional device of the user
+// (user.DeviceID). They are only written back if they were not changed concurrently; if they were,
+// the update is retried once on the current secrets of the device.
+func (s *Server) updateDeviceSecrets(ctx context.Context, user *User, update func(*User) error) error {
+	for retried := false; ; retried = true {
+		old := user.Secrets
+		if err := update(user); err != nil {
+			return err
+		}
+		replaced, err := s.db.replaceSecrets(ctx, user, old)
+		if err != nil || replaced {
+			return err
+		}
+		if retried {
+			return errUpdateConflict
+		}
+		device, err := s.db.device(ctx, user, user.DeviceID)
+		if err != nil {
+			return err
+		}
+		user.Secrets = device.Secrets
+	}
 }
 
 // /client/register
@@ -438,134 +935,1189 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sessionptr, err := s.register(msg)
+	if !s.verifyAttestation(w, msg) {
+		return
+	}
+
+	// Re-enrollment to an existing account, which satisfied the registration policy (and was bound
+	// to the identity of the user, if configured) when it was registered
+	if msg.RecoveryToken != "" {
+		s.reenroll(w, r, msg)
+		return
+	}
+
+	// Check the registration policy of our scheme. As the client hashes the PIN, we cannot check its length.
+	if err := s.registrationPolicy().ValidateEnrollment(msg.Email, msg.AcceptedTermsVersion); err != nil {
+		s.conf.Logger.WithField("error", err).Info("Enrollment does not satisfy registration policy")
+		server.WriteError(w, server.ErrorRegistrationPolicy, err.Error())
+		return
+	}
+
+	// If configured, bind the account to the identity of the user at the OpenID Connect provider
+	var subject string
+	if s.conf.oidc != nil {
+		var err error
+		if subject, err = s.conf.oidc.verify(msg.IDToken); err != nil {
+			s.conf.Logger.WithField("error", err).Info("Enrollment with invalid ID token")
+			server.WriteError(w, server.ErrorInvalidIDToken, err.Error())
+			return
+		}
+	}
+
+	session, err := s.register(r.Context(), msg, subject)
 	if err != nil && err == keysharecore.ErrPinTooLong {
 		// Too long pin is not an internal error
 		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
 		return
 	}
+	if err != nil && err == errAccountExists {
+		server.WriteError(w, server.ErrorAccountExists, "")
+		return
+	}
 	if err != nil {
 		// Already logged
-		server.WriteError(w, server.ErrorInternal, err.Error())
+		s.writeInternalError(w, r, err)
 		return
 	}
-	server.WriteJson(w, sessionptr)
+	writeRegistrationSession(w, r, session)
+}
+
+// writeRegistrationSession writes the registration session, or only its session pointer to clients
+// using a keyshare protocol version below 6.
+func writeRegistrationSession(w http.ResponseWriter, r *http.Request, session *irma.KeyshareRegistrationSession) {
+	if protocolVersion(r) < 6 {
+		server.WriteJson(w, session.SessionPtr)
+		return
+	}
+	server.WriteJson(w, session)
 }
 
-func (s *Server) register(msg irma.KeyshareEnrollment) (*irma.Qr, error) {
+func (s *Server) register(ctx context.Context, msg irma.KeyshareEnrollment, subject string) (_ *irma.KeyshareRegistrationSession, err error) {
+	var username string
+	start := time.Now()
+	defer func() {
+		s.conf.Hooks.KeyshareOperation(username, server.KeyshareOperationRegister, time.Since(start), err)
+	}()
+
+	if subject != "" {
+		_, err := s.db.userByOIDCSubject(ctx, subject)
+		if err == nil {
+			s.conf.Logger.Info("Enrollment for identity that is already bound to an account")
+			return nil, errAccountExists
+		}
+		if err != keyshare.ErrUserNotFound {
+			s.logError(ctx, err, "Could not fetch user from database")
+			return nil, err
+		}
+	}
+
 	// Generate keyshare server account
-	username := common.NewRandomString(12, common.AlphanumericChars)
+	username = common.NewRandomString(12, common.AlphanumericChars)
 
 	secrets, err := s.core.NewUserSecrets(msg.Pin)
 	if err != nil {
-		s.conf.Logger.WithField("error", err).Error("Could not register user")
+		s.logError(ctx, err, "Could not register user")
+		return nil, err
+	}
+	language := s.currentConf().NormalizeLanguage(msg.Language)
+	user := &User{Username: username, Language: language, Secrets: secrets, OIDCSubject: subject}
+	err = s.db.AddUser(ctx, user)
+	if err == errAccountExists {
 		return nil, err
 	}
-	user := &User{Username: username, Language: msg.Language, Secrets: secrets}
-	err = s.db.AddUser(user)
 	if err != nil {
-		s.conf.Logger.WithField("error", err).Error("Could not store new user in database")
+		s.logError(ctx, err, "Could not store new user in database")
 		return nil, err
 	}
 
 	// Send email if user specified email address
-	if msg.Email != nil && *msg.Email != "" && s.conf.EmailServer != "" {
-		err = s.sendRegistrationEmail(user, msg.Language, *msg.Email)
+	if msg.Email != nil && *msg.Email != "" && s.currentConf().EmailServer != "" {
+		err = s.sendRegistrationEmail(ctx, user, language, *msg.Email)
 		if err != nil {
 			// already logged in sendRegistrationEmail
 			return nil, err
 		}
 	}
 
-	// Setup and return issuance session for keyshare credential.
-	request := irma.NewIssuanceRequest([]*irma.CredentialRequest{
-		{
-			CredentialTypeID: s.conf.KeyshareAttribute.CredentialTypeIdentifier(),
-			Attributes: map[string]string{
-				s.conf.KeyshareAttribute.Name(): username,
-			},
-		}})
-	sessionptr, _, _, err := s.irmaserv.StartSession(request, nil)
+	sessionptr, requestorToken, err := s.startKeyshareAttributeSession(username, func(result *server.SessionResult) {
+		s.credentialIssued(user, result)
+	})
 	if err != nil {
-		s.conf.Logger.WithField("error", err).Error("Could not start keyshare credential issuance sessions")
 		return nil, err
 	}
-	return sessionptr, nil
+	return &irma.KeyshareRegistrationSession{
+		SessionPtr: sessionptr,
+		Token:      s.registrationSessions.add(user, requestorToken),
+	}, nil
 }
 
-func (s *Server) sendRegistrationEmail(user *User, language, email string) error {
-	// Generate token
-	token := common.NewSessionToken()
-
-	// Add it to the database
-	err := s.db.addEmailVerification(user, email, token)
-	if err != nil {
-		s.conf.Logger.WithField("error", err).Error("Could not generate email verification mail record")
-		return err
+// /client/register/{token}/status
+func (s *Server) handleRegistrationStatus(w http.ResponseWriter, r *http.Request) {
+	session := s.registrationSessions.get(chi.URLParam(r, "token"))
+	if session == nil {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+		return
 	}
-
-	verificationBaseURL := s.conf.TranslateString(s.conf.VerificationURL, language)
-	return s.conf.SendEmail(
-		s.conf.registrationEmailTemplates,
-		s.conf.RegistrationEmailSubjects,
-		map[string]string{"VerificationURL": verificationBaseURL + token},
-		email,
-		language,
-	)
+	result, err := s.irmaserv.GetSessionResult(session.requestorToken)
+	if err != nil || result == nil {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+		return
+	}
+	// The session handler normally records this already, but it does not survive restarts
+	if result.Status == irma.ServerStatusDone && s.registrationSessions.setIssued(session) {
+		s.credentialIssued(session.user, result)
+	}
+	server.WriteJson(w, result.Status)
 }
 
-func (s *Server) userMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Extract username from request
-		username := r.Header.Get("X-IRMA-Keyshare-Username")
-
-		// and fetch its information
-		user, err := s.db.user(username)
-		if err != nil {
-			s.conf.Logger.WithFields(logrus.Fields{"username": username, "error": err}).Warn("Could not find user in db")
-			server.WriteError(w, server.ErrorUserNotRegistered, err.Error())
-			return
-		}
-
-		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "user", user)))
-	})
+// credentialIssued records the outcome of the issuance session of the keyshare credential started
+// on registration, so that accounts to which it was never issued can be cleaned up.
+func (s *Server) credentialIssued(user *User, result *server.SessionResult) {
+	if result.Status != irma.ServerStatusDone || result.Err != nil {
+		s.conf.Logger.WithField("status", result.Status).Info("Keyshare credential not issued after registration")
+		return
+	}
+	if err := s.db.setCredentialIssued(context.Background(), user); err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not record issuance of keyshare credential")
+	}
 }
 
-func (s *Server) authorizationMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Extract authorization from request
-		authorization := r.Header.Get("Authorization")
-		if strings.HasPrefix(authorization, "Bearer ") {
-			authorization = authorization[7:]
-		}
-
-		// verify access
-		ctx := r.Context()
-		err := s.core.ValidateJWT(ctx.Value("user").(*User).Secrets, authorization)
-		hasValidAuthorization := err == nil
+// /client/recover
+func (s *Server) handleRecover(w http.ResponseWriter, r *http.Request) {
+	if s.conf.oidc == nil {
+		server.WriteError(w, server.ErrorUnsupported, "account recovery requires OpenID Connect registration")
+		return
+	}
 
-		// Construct new context with both authorization and its validity
-		nextContext := context.WithValue(
-			context.WithValue(ctx, "authorization", authorization),
-			"hasValidAuthorization", hasValidAuthorization)
+	// Extract request
+	var msg irma.KeyshareRecovery
+	if err := server.ParseBody(r, &msg); err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
 
-		next.ServeHTTP(w, r.WithContext(nextContext))
-	})
+	// Fetch user bound to the identity of the ID token
+	subject, err := s.conf.oidc.verify(msg.IDToken)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Info("Recovery with invalid ID token")
+		server.WriteError(w, server.ErrorInvalidIDToken, err.Error())
+		return
+	}
+	user, err := s.db.userByOIDCSubject(r.Context(), subject)
+	if err != nil && s.requestCancelled(r) {
+		return
+	}
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Warn("Could not find user in db")
+		server.WriteError(w, server.ErrorUserNotRegistered, "")
+		return
+	}
+
+	secrets, err := s.newSecrets(r.Context(), msg.Pin)
+	if err != nil && err == keysharecore.ErrPinTooLong {
+		// Too long pin is not an internal error
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	if err != nil {
+		// Already logged
+		s.writeInternalError(w, r, err)
+		return
+	}
+	sessionptr, _, err := s.recover(r.Context(), user, secrets, msg.Language, LogEventAccountRecovered)
+	if err != nil {
+		// Already logged
+		s.writeInternalError(w, r, err)
+		return
+	}
+	server.WriteJson(w, sessionptr)
+}
+
+// newSecrets generates new secrets for a user protected by the specified PIN.
+func (s *Server) newSecrets(ctx context.Context, pin string) (keysharecore.UserSecrets, error) {
+	secrets, err := s.core.NewUserSecrets(pin)
+	if err != nil {
+		s.logError(ctx, err, "Could not generate new secrets for user")
+	}
+	return secrets, err
+}
+
+// recover binds the account of the user to a new device, by replacing the secrets of the user with
+// the specified new ones (see newSecrets()). This invalidates the secrets of the old device.
+// It returns the session pointer and requestor token of the issuance session of the keyshare credential.
+func (s *Server) recover(ctx context.Context, user *User, secrets keysharecore.UserSecrets, language string, event LogEventType) (*irma.Qr, irma.RequestorToken, error) {
+	err := s.updateUser(ctx, user, func(user *User) error {
+		user.Secrets = secrets
+		if language != "" {
+			user.Language = language
+		}
+		return nil
+	})
+	if err != nil {
+		s.logError(ctx, err, "Could not write updated user to database")
+		return nil, "", err
+	}
+	if err = s.db.resetPinTries(ctx, user); err != nil {
+		s.logError(ctx, err, "Could not reset users pin check logic")
+		// Do not send to user
+	}
+	// The additional devices of the user contain the old keyshare secret, so they cannot be used anymore
+	devices, err := s.db.devices(ctx, user)
+	if err != nil {
+		s.logError(ctx, err, "Could not fetch devices of user")
+		return nil, "", err
+	}
+	for _, device := range devices {
+		if err = s.db.removeDevice(ctx, user, device.ID); err != nil {
+			s.logError(ctx, err, "Could not remove device of user")
+			return nil, "", err
+		}
+	}
+	if err = s.db.addLog(ctx, user, event, nil); err != nil {
+		s.logError(ctx, err, "Could not add log entry for user")
+		return nil, "", err
+	}
+
+	return s.startKeyshareAttributeSession(user.Username, nil)
+}
+
+// reenroll binds the account to which the recovery token of the registration message belongs to
+// a new device, keeping its username. The recovery token is consumed, but only once the new secrets
+// have been generated, so that the token remains usable if the PIN is rejected.
+func (s *Server) reenroll(w http.ResponseWriter, r *http.Request, msg irma.KeyshareEnrollment) {
+	ctx := r.Context()
+	secrets, err := s.newSecrets(ctx, msg.Pin)
+	if err != nil && err == keysharecore.ErrPinTooLong {
+		// Too long pin is not an internal error
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	if err != nil {
+		// Already logged
+		s.writeInternalError(w, r, err)
+		return
+	}
+
+	user, err := s.db.consumeRecoveryToken(ctx, hashRecoveryToken(msg.RecoveryToken))
+	if err != nil && s.requestCancelled(r) {
+		return
+	}
+	if err == errRecoveryTokenInvalid {
+		s.conf.Logger.Info("Re-enrollment with invalid recovery token")
+		server.WriteError(w, server.ErrorInvalidRecoveryToken, "")
+		return
+	}
+	if err != nil {
+		s.logError(ctx, err, "Could not consume recovery token")
+		s.writeInternalError(w, r, err)
+		return
+	}
+
+	sessionptr, requestorToken, err := s.recover(ctx, user, secrets, msg.Language, LogEventReenrolled)
+	if err != nil {
+		// Already logged
+		s.writeInternalError(w, r, err)
+		return
+	}
+	writeRegistrationSession(w, r, &irma.KeyshareRegistrationSession{
+		SessionPtr: sessionptr,
+		Token:      s.registrationSessions.add(user, requestorToken),
+	})
+}
+
+func hashRecoveryToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// /client/register/device
+func (s *Server) handleRegisterDevice(w http.ResponseWriter, r *http.Request) {
+	// Extract request
+	var msg irma.KeyshareDeviceEnrollment
+	if err := server.ParseBody(r, &msg); err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+
+	// Fetch user
+	user, err := s.db.user(r.Context(), msg.Username)
+	if err != nil && s.requestCancelled(r) {
+		return
+	}
+	if err != nil {
+		s.conf.Logger.WithFields(logrus.Fields{"username": msg.Username, "error": err}).Warn("Could not find user in db")
+		server.WriteError(w, server.ErrorUserNotRegistered, "")
+		return
+	}
+
+	registration, err := s.registerDevice(r.Context(), user, msg)
+	if err != nil && err == keysharecore.ErrPinTooLong {
+		// Too long pin is not an internal error
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	if err != nil && err == errEnrollmentCodeInvalid {
+		server.WriteError(w, server.ErrorInvalidEnrollmentCode, "")
+		return
+	}
+	if err != nil {
+		// Already logged
+		s.writeInternalError(w, r, err)
+		return
+	}
+	server.WriteJson(w, registration)
+}
+
+// registerDevice adds a device to the account of the user, having its own secrets protected by the
+// specified PIN but sharing the keyshare secret of the account, after consuming the enrollment code.
+func (s *Server) registerDevice(ctx context.Context, user *User, msg irma.KeyshareDeviceEnrollment) (*irma.KeyshareDeviceRegistration, error) {
+	secrets, err := s.core.NewDeviceSecrets(user.Secrets, msg.Pin)
+	if err != nil {
+		s.logError(ctx, err, "Could not generate secrets for device")
+		return nil, err
+	}
+
+	err = s.db.consumeEnrollmentCode(ctx, user, msg.Code)
+	if err == errEnrollmentCodeInvalid {
+		s.conf.Logger.Info("Device enrollment with invalid enrollment code")
+		return nil, err
+	}
+	if err != nil {
+		s.logError(ctx, err, "Could not consume device enrollment code")
+		return nil, err
+	}
+
+	device := &Device{
+		ID:      common.NewSessionToken(),
+		Name:    msg.Name,
+		Secrets: secrets,
+		Created: time.Now(),
+	}
+	if err = s.db.addDevice(ctx, user, device); err != nil {
+		s.logError(ctx, err, "Could not store new device in database")
+		return nil, err
+	}
+	if err = s.db.addLog(ctx, user, LogEventDeviceAdded, device.ID); err != nil {
+		s.logError(ctx, err, "Could not add log entry for user")
+		return nil, err
+	}
+
+	sessionptr, _, err := s.startKeyshareAttributeSession(user.Username, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &irma.KeyshareDeviceRegistration{DeviceID: device.ID, SessionPtr: sessionptr}, nil
+}
+
+// startKeyshareAttributeSession starts an issuance session for the keyshare attribute containing the username,
+// running the handler on completion, if specified. It returns the session pointer and the requestor token of the session.
+func (s *Server) startKeyshareAttributeSession(username string, handler server.SessionHandler) (*irma.Qr, irma.RequestorToken, error) {
+	request := irma.NewIssuanceRequest([]*irma.CredentialRequest{
+		{
+			CredentialTypeID: s.conf.KeyshareAttribute.CredentialTypeIdentifier(),
+			Attributes: map[string]string{
+				s.conf.KeyshareAttribute.Name(): username,
+			},
+		}})
+	sessionptr, requestorToken, _, err := s.irmaserv.StartSession(request, handler)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not start keyshare credential issuance sessions")
+		return nil, "", err
+	}
+	return sessionptr, requestorToken, nil
+}
+
+// registrationPolicy returns the keyshare registration policy of the scheme of the keyshare attribute, if any.
+func (s *Server) registrationPolicy() *irma.KeyshareRegistrationPolicy {
+	schemeID := s.conf.KeyshareAttribute.CredentialTypeIdentifier().IssuerIdentifier().SchemeManagerIdentifier()
+	if scheme := s.conf.IrmaConfiguration.SchemeManagers[schemeID]; scheme != nil {
+		return scheme.KeyshareRegistration
+	}
+	return nil
+}
+
+func (s *Server) sendRegistrationEmail(ctx context.Context, user *User, language, email string) error {
+	// Generate tokens
+	token := common.NewSessionToken()
+	unsubscribeToken := common.NewSessionToken()
+
+	// Add them to the database
+	conf := s.currentConf()
+	err := s.db.addEmailVerification(ctx, user, email, keyshare.HashEmailToken(token), conf.EmailTokenValidity)
+	if err != nil {
+		s.logError(ctx, err, "Could not generate email verification mail record")
+		return err
+	}
+	if err = s.db.addUnsubscribeToken(ctx, user, email, keyshare.HashEmailToken(unsubscribeToken)); err != nil {
+		s.logError(ctx, err, "Could not store unsubscribe token")
+		return err
+	}
+
+	// Mail clients supporting it offer to unsubscribe using the List-Unsubscribe header (RFC 2369),
+	// with a single POST request to the link (RFC 8058), which requires an absolute URL
+	unsubscribeURL := conf.baseURL + "/users/email/unsubscribe/" + unsubscribeToken
+	var headers map[string]string
+	if u, err := url.Parse(unsubscribeURL); err == nil && u.IsAbs() {
+		headers = map[string]string{
+			"List-Unsubscribe":      "<" + unsubscribeURL + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		}
+	}
+
+	verificationBaseURL := conf.TranslateString(conf.VerificationURL, language)
+	return conf.SendEmailWithHeaders(
+		conf.registrationEmailTemplates,
+		conf.RegistrationEmailSubjects,
+		map[string]string{"VerificationURL": verificationBaseURL + token, "UnsubscribeURL": unsubscribeURL},
+		email,
+		language,
+		headers,
+	)
+}
+
+// /api/version
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	info := irma.KeyshareVersionInfo{
+		MinProtocolVersion: minProtocolVersion,
+		MaxProtocolVersion: maxProtocolVersion,
+	}
+	conf := s.currentConf()
+	if conf.deprecation != nil {
+		info.Deprecation = (*irma.Timestamp)(conf.deprecation)
+	}
+	if conf.sunset != nil {
+		info.Sunset = (*irma.Timestamp)(conf.sunset)
+	}
+	if len(conf.VersionMessage) > 0 {
+		info.Message = irma.TranslatedString(conf.VersionMessage)
+	}
+	server.WriteJson(w, info)
+}
+
+// /api/status
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	conf := s.currentConf()
+	status := irma.KeyshareStatus{
+		Status:        irma.KeyshareStatusOperational,
+		MinAppVersion: conf.MinAppVersion,
+	}
+	start, end, now := conf.maintenanceStart, conf.maintenanceEnd, time.Now()
+	if (start != nil || end != nil) && (end == nil || now.Before(*end)) {
+		status.Maintenance = &irma.KeyshareMaintenanceWindow{
+			Start: (*irma.Timestamp)(start),
+			End:   (*irma.Timestamp)(end),
+		}
+		if len(conf.MaintenanceMessage) > 0 {
+			status.Maintenance.Message = irma.TranslatedString(conf.MaintenanceMessage)
+		}
+		if start == nil || !now.Before(*start) {
+			status.Status = irma.KeyshareStatusMaintenance
+		}
+	}
+	if status.Status == irma.KeyshareStatusOperational && s.ReadOnly() {
+		status.Status = irma.KeyshareStatusReadOnly
+	}
+	server.WriteJson(w, status)
+}
+
+// /api/pinkey
+func (s *Server) handlePinKey(w http.ResponseWriter, r *http.Request) {
+	server.WriteString(w, s.pinKeyJWT)
+}
+
+// /users/email/verify/{token}
+func (s *Server) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var serr server.Error
+	switch err := s.db.verifyEmail(r.Context(), keyshare.HashEmailToken(chi.URLParam(r, "token"))); err {
+	case nil:
+		if acceptsHTML(r) {
+			writeEmailVerificationPage(w, http.StatusOK, "Your email address has been verified.")
+		} else {
+			server.WriteJson(w, emailVerificationResult{Verified: true})
+		}
+		return
+	case errEmailTokenInvalid:
+		// Unknown, expired and used tokens get the same response, so that it does not reveal
+		// which tokens exist
+		s.conf.Logger.Info("Invalid email verification token")
+		serr = server.ErrorInvalidEmailToken
+	default:
+		s.logError(r.Context(), err, "Could not verify email token")
+		if s.requestCancelled(r) {
+			return
+		}
+		serr = server.ErrorInternal
+	}
+
+	if acceptsHTML(r) {
+		writeEmailVerificationPage(w, serr.Status, serr.Description)
+	} else {
+		server.WriteError(w, serr, "")
+	}
+}
+
+// /users/status
+func (s *Server) handleUserStatus(w http.ResponseWriter, r *http.Request) {
+	// Fetch from context
+	ctx := r.Context()
+	user, authorization, ok := s.requestUser(w, r)
+	if !ok {
+		return
+	}
+	if !authorization.valid {
+		server.WriteError(w, server.ErrorInvalidJWT, "")
+		return
+	}
+
+	verified, err := s.db.emailVerified(ctx, user)
+	if err != nil {
+		s.logError(ctx, err, "Could not determine email verification status")
+		s.writeInternalError(w, r, err)
+		return
+	}
+	server.WriteJson(w, userStatus{EmailVerified: verified})
+}
+
+// /users/email
+// Replaces the email address(es) of the user by the posted one, sending a verification email to it.
+func (s *Server) handleChangeEmail(w http.ResponseWriter, r *http.Request) {
+	// Fetch from context
+	ctx := r.Context()
+	user, authorization, ok := s.requestUser(w, r)
+	if !ok {
+		return
+	}
+	if !authorization.valid {
+		server.WriteError(w, server.ErrorInvalidJWT, "")
+		return
+	}
+
+	var msg irma.KeyshareEmail
+	if err := server.ParseBody(r, &msg); err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	if s.currentConf().EmailServer == "" {
+		server.WriteError(w, server.ErrorInvalidRequest, "email addresses are not supported by this keyshare server")
+		return
+	}
+	if !keyshare.ValidEmailAddress(msg.Email) {
+		server.WriteError(w, server.ErrorInvalidRequest, "invalid email address")
+		return
+	}
+	if err := s.registrationPolicy().ValidateEmail(&msg.Email); err != nil {
+		server.WriteError(w, server.ErrorRegistrationPolicy, err.Error())
+		return
+	}
+
+	if err := s.db.removeEmails(ctx, user); err != nil {
+		s.logError(ctx, err, "Could not remove email addresses of user")
+		s.writeInternalError(w, r, err)
+		return
+	}
+	language := user.Language
+	if msg.Language != "" {
+		language = s.currentConf().NormalizeLanguage(msg.Language)
+	}
+	if err := s.sendRegistrationEmail(ctx, user, language, msg.Email); err != nil {
+		// already logged in sendRegistrationEmail
+		s.writeInternalError(w, r, err)
+		return
+	}
+	if err := s.db.addLog(ctx, user, LogEventEmailChanged, nil); err != nil {
+		s.logError(ctx, err, "Could not add log entry for user")
+		// Do not send to user
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// /users/email
+// Removes the email address(es) of the user, along with their pending verifications.
+func (s *Server) handleRemoveEmail(w http.ResponseWriter, r *http.Request) {
+	// Fetch from context
+	ctx := r.Context()
+	user, authorization, ok := s.requestUser(w, r)
+	if !ok {
+		return
+	}
+	if !authorization.valid {
+		server.WriteError(w, server.ErrorInvalidJWT, "")
+		return
+	}
+
+	if err := s.registrationPolicy().ValidateEmail(nil); err != nil {
+		server.WriteError(w, server.ErrorRegistrationPolicy, err.Error())
+		return
+	}
+	if err := s.db.removeEmails(ctx, user); err != nil {
+		s.logError(ctx, err, "Could not remove email addresses of user")
+		s.writeInternalError(w, r, err)
+		return
+	}
+	if err := s.db.addLog(ctx, user, LogEventEmailRemoved, nil); err != nil {
+		s.logError(ctx, err, "Could not add log entry for user")
+		// Do not send to user
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func (s *Server) reservePinCheck(user *User) (bool, int, int64, error) {
-	ok, tries, wait, err := s.db.reservePinTry(user)
+// /users/email/unsubscribe/{token}
+// Removes the email address to which the email containing the unsubscribe link was sent, without
+// logging in. Unknown and used tokens get the same response, so that following the link again
+// succeeds and the response does not reveal which tokens exist.
+func (s *Server) handleUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user, err := s.db.unsubscribe(ctx, keyshare.HashEmailToken(chi.URLParam(r, "token")))
+	switch err {
+	case nil:
+		if err = s.db.addLog(ctx, user, LogEventEmailRemoved, "unsubscribe"); err != nil {
+			s.logError(ctx, err, "Could not add log entry for user")
+			// Do not send to user
+		}
+	case errUnsubscribeTokenInvalid:
+		s.conf.Logger.Info("Invalid unsubscribe token")
+	default:
+		s.logError(ctx, err, "Could not remove email address using unsubscribe token")
+		if s.requestCancelled(r) {
+			return
+		}
+		if acceptsHTML(r) {
+			writeEmailVerificationPage(w, server.ErrorInternal.Status, server.ErrorInternal.Description)
+		} else {
+			server.WriteError(w, server.ErrorInternal, "")
+		}
+		return
+	}
+
+	if acceptsHTML(r) {
+		writeEmailVerificationPage(w, http.StatusOK, "Your email address has been removed.")
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// /users/devices
+func (s *Server) handleDevices(w http.ResponseWriter, r *http.Request) {
+	// Fetch from context
+	ctx := r.Context()
+	user, authorization, ok := s.requestUser(w, r)
+	if !ok {
+		return
+	}
+	if !authorization.valid {
+		server.WriteError(w, server.ErrorInvalidJWT, "")
+		return
+	}
+
+	devices, err := s.db.devices(ctx, user)
 	if err != nil {
-		s.conf.Logger.WithField("error", err).Error("Could not reserve pin check slot")
+		s.logError(ctx, err, "Could not fetch devices of user")
+		s.writeInternalError(w, r, err)
+		return
+	}
+	result := make([]irma.KeyshareDevice, 0, len(devices))
+	for _, device := range devices {
+		result = append(result, irma.KeyshareDevice{
+			ID:      device.ID,
+			Name:    device.Name,
+			Created: (*irma.Timestamp)(&device.Created),
+		})
+	}
+	server.WriteJson(w, result)
+}
+
+// /users/devices/code
+func (s *Server) handleEnrollmentCode(w http.ResponseWriter, r *http.Request) {
+	// Fetch from context
+	ctx := r.Context()
+	user, authorization, ok := s.requestUser(w, r)
+	if !ok {
+		return
+	}
+	if !authorization.valid {
+		server.WriteError(w, server.ErrorInvalidJWT, "")
+		return
+	}
+
+	code := common.NewRandomString(enrollmentCodeLength, common.AlphanumericChars)
+	if err := s.db.addEnrollmentCode(ctx, user, code, enrollmentCodeValidity); err != nil {
+		s.logError(ctx, err, "Could not store device enrollment code")
+		s.writeInternalError(w, r, err)
+		return
+	}
+	expiry := irma.Timestamp(time.Now().Add(enrollmentCodeValidity))
+	server.WriteJson(w, irma.KeyshareEnrollmentCode{Code: code, Expiry: &expiry})
+}
+
+// /users/recovery/token
+func (s *Server) handleRecoveryToken(w http.ResponseWriter, r *http.Request) {
+	// Fetch from context
+	ctx := r.Context()
+	user, authorization, ok := s.requestUser(w, r)
+	if !ok {
+		return
+	}
+	if !authorization.valid {
+		server.WriteError(w, server.ErrorInvalidJWT, "")
+		return
+	}
+
+	token := common.NewRandomString(recoveryTokenLength, common.AlphanumericChars)
+	validity := time.Duration(s.currentConf().RecoveryTokenValidity) * 24 * time.Hour
+	if err := s.db.addRecoveryToken(ctx, user, hashRecoveryToken(token), validity); err != nil {
+		s.logError(ctx, err, "Could not store recovery token")
+		s.writeInternalError(w, r, err)
+		return
+	}
+	expiry := irma.Timestamp(time.Now().Add(validity))
+	server.WriteJson(w, irma.KeyshareRecoveryToken{Token: token, Expiry: &expiry})
+}
+
+// /users/devices/{id}/revoke
+func (s *Server) handleRevokeDevice(w http.ResponseWriter, r *http.Request) {
+	// Fetch from context
+	ctx := r.Context()
+	user, authorization, ok := s.requestUser(w, r)
+	if !ok {
+		return
+	}
+	if !authorization.valid {
+		server.WriteError(w, server.ErrorInvalidJWT, "")
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+	err := s.db.removeDevice(ctx, user, id)
+	if err == errDeviceNotFound {
+		server.WriteError(w, server.ErrorDeviceNotRegistered, "")
+		return
+	}
+	if err != nil {
+		s.logError(ctx, err, "Could not remove device of user")
+		s.writeInternalError(w, r, err)
+		return
+	}
+	if err = s.db.addLog(ctx, user, LogEventDeviceRevoked, id); err != nil {
+		s.logError(ctx, err, "Could not add log entry for user")
+		// Do not send to user
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// /admin/stats
+func (s *Server) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.db.userStats(r.Context())
+	if err != nil {
+		s.logError(r.Context(), err, "Could not compute user statistics")
+		s.writeInternalError(w, r, err)
+		return
+	}
+	server.WriteJson(w, stats)
+}
+
+// /admin/stats/usage?from=...&to=...
+// Writes the daily usage statistics of the days from the from date up to and including the to date
+// (in YYYY-MM-DD format) as JSON, or as CSV if the client accepts text/csv. Days are included once
+// they have been aggregated, which happens within an hour after they end.
+func (s *Server) handleAdminUsageStats(w http.ResponseWriter, r *http.Request) {
+	from, err := time.Parse(usageDateFormat, r.URL.Query().Get("from"))
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, "from must be a date in YYYY-MM-DD format")
+		return
+	}
+	to, err := time.Parse(usageDateFormat, r.URL.Query().Get("to"))
+	if err != nil || to.Before(from) {
+		server.WriteError(w, server.ErrorInvalidRequest, "to must be a date in YYYY-MM-DD format, not before from")
+		return
+	}
+
+	stats, err := s.db.usageStats(r.Context(), from, to)
+	if err != nil {
+		s.logError(r.Context(), err, "Could not fetch usage statistics")
+		s.writeInternalError(w, r, err)
+		return
+	}
+	if !acceptsCSV(r) {
+		server.WriteJson(w, stats)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	writer := csv.NewWriter(w)
+	_ = writer.Write([]string{"date", "sessions", "users"})
+	for _, stat := range stats {
+		_ = writer.Write([]string{stat.Date, strconv.Itoa(stat.Sessions), strconv.Itoa(stat.Users)})
+	}
+	writer.Flush()
+	if err = writer.Error(); err != nil {
+		// The status has already been sent
+		s.logError(r.Context(), err, "Could not write usage statistics")
+	}
+}
+
+// acceptsCSV returns whether the Accept header of the request includes text/csv.
+func acceptsCSV(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(header, ",") {
+			if t, _, err := mime.ParseMediaType(mediaType); err == nil && t == "text/csv" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rollupUsage aggregates the keyshare sessions of the days that ended since the last run into the
+// usage statistics.
+func (s *Server) rollupUsage() {
+	if err := s.db.rollupUsage(context.Background(), time.Now()); err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not aggregate usage statistics")
+	}
+}
+
+// deleteExpiredLogs deletes the log entries whose retention period (see Configuration.LogRetention)
+// has passed.
+func (s *Server) deleteExpiredLogs() {
+	if err := s.applyLogRetention(context.Background(), time.Now()); err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not delete expired log entries")
+	}
+}
+
+// applyLogRetention deletes the log entries that are older at the specified time than the retention
+// period of their event type. The entries of the types having the shortest retention period are
+// deleted first, keeping those of the types that are retained longer.
+func (s *Server) applyLogRetention(ctx context.Context, now time.Time) error {
+	retention := s.currentConf().LogRetention
+	periods := make([]int, 0, len(retention))
+	for _, days := range retention {
+		periods = append(periods, days)
+	}
+	sort.Ints(periods)
+
+	deleted := 0
+	for i, days := range periods {
+		if i > 0 && periods[i-1] == days {
+			continue
+		}
+		var keep []LogEventType
+		for _, eventType := range LogEventTypes {
+			if d, ok := retention[eventType]; !ok || d > days {
+				keep = append(keep, eventType)
+			}
+		}
+		before := now.Add(-time.Duration(days) * 24 * time.Hour)
+		for {
+			count, err := s.db.deleteLogsBefore(ctx, before, keep, maintenanceBatchSize)
+			if err != nil {
+				return err
+			}
+			deleted += count
+			if count < maintenanceBatchSize {
+				break
+			}
+		}
+	}
+
+	if deleted > 0 {
+		s.conf.Logger.WithField("count", deleted).Debug("Deleted expired log entries")
+	}
+	return nil
+}
+
+// /admin/users?cursor=...
+// Writes the metadata of all users ordered by username, as newline-delimited JSON, starting after the
+// username specified as cursor (if any). An interrupted export can thus be resumed by specifying the
+// last received username as cursor.
+func (s *Server) handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	cursor := r.URL.Query().Get("cursor")
+	users, err := s.db.listUsers(r.Context(), cursor, adminUsersPageSize)
+	if err != nil {
+		s.logError(r.Context(), err, "Could not fetch users")
+		s.writeInternalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	for len(users) > 0 {
+		for _, user := range users {
+			if err = encoder.Encode(user); err != nil {
+				// The client went away; nothing we can do about it
+				s.conf.Logger.WithField("error", err).Info("Could not write users")
+				return
+			}
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		if len(users) < adminUsersPageSize {
+			return
+		}
+		if users, err = s.db.listUsers(r.Context(), users[len(users)-1].Username, adminUsersPageSize); err != nil {
+			// As we already started writing the response we cannot send an error to the client,
+			// which will notice that the export is incomplete by the absence of the last users.
+			s.logError(r.Context(), err, "Could not fetch users")
+			return
+		}
+	}
+}
+
+// /api/ready
+// Reports the server as unavailable when the database has been failing for longer than
+// Configuration.DBFailureThreshold, or when Idemix public keys failed to load (unless
+// Configuration.ReadyIgnoresKeyFailures is set), so that load balancers can route requests elsewhere.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	conf := s.currentConf()
+	if db, ok := s.db.(healthReporter); ok {
+		if failing := db.failingFor(); failing > time.Duration(conf.DBFailureThreshold)*time.Second {
+			s.conf.Logger.WithField("duration", failing.String()).Warn("Database is failing, reporting server as unavailable")
+			server.WriteError(w, server.ErrorUnavailable, "database unavailable")
+			return
+		}
+	}
+	if !conf.ReadyIgnoresKeyFailures {
+		s.keysMutex.Lock()
+		failed := s.keys.Failed
+		s.keysMutex.Unlock()
+		if failed > 0 {
+			s.conf.Logger.WithField("failed", failed).Warn("Public keys failed to load, reporting server as unavailable")
+			server.WriteError(w, server.ErrorUnavailable, "public keys failed to load")
+			return
+		}
+	}
+	server.WriteJson(w, readyStatus{Ready: true})
+}
+
+// /admin/keys
+func (s *Server) handleAdminKeys(w http.ResponseWriter, r *http.Request) {
+	s.keysMutex.Lock()
+	defer s.keysMutex.Unlock()
+	server.WriteJson(w, s.keys)
+}
+
+// /admin/reload-keys
+// Loads the Idemix public keys again, e.g. after fixing keys that failed to load,
+// without waiting for the next update of the IRMA configuration.
+func (s *Server) handleAdminReloadKeys(w http.ResponseWriter, r *http.Request) {
+	if err := s.loadIdemixKeys(s.conf.IrmaConfiguration); err != nil {
+		s.conf.Logger.WithField("error", err).Warn("Not all public keys could be loaded")
+	}
+	s.handleAdminKeys(w, r)
+}
+
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func writeEmailVerificationPage(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := emailVerificationPage.Execute(w, message); err != nil {
+		_ = server.LogError(err)
+	}
+}
+
+// pinDecryptionMiddleware decrypts the bodies of requests to the specified endpoint containing a PIN,
+// which clients using keyshare protocol version 5 or higher encrypt to the PIN encryption key
+// (see irma.EncryptKeyshareMessage), refusing expired and replayed messages. Unencrypted bodies of
+// clients using older versions are passed through unless Configuration.DisablePlaintextPins is set.
+func (s *Server) pinDecryptionMiddleware(endpoint string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if protocolVersion(r) < 5 || s.conf.pinEncryptionKey == nil {
+				if s.currentConf().DisablePlaintextPins {
+					server.WriteError(w, server.ErrorPinEncryption, "unencrypted PINs are not accepted")
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var msg irma.KeyshareEncryptedMessage
+			if err := server.ParseBody(r, &msg); err != nil {
+				server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+				return
+			}
+			tolerance := s.conf.IrmaConfiguration.ClockSkewTolerance()
+			body, err := msg.Decrypt(s.conf.pinEncryptionKey, endpoint, tolerance)
+			if err != nil {
+				s.conf.Logger.WithField("error", err).Info("Could not decrypt PIN message")
+				server.WriteError(w, server.ErrorPinEncryption, "could not decrypt message")
+				return
+			}
+			expiry := time.Unix(msg.Timestamp, 0).Add(irma.KeyshareMessageLifetime + tolerance)
+			if !s.pinMessages.add(&msg, expiry) {
+				s.conf.Logger.Warn("Refused replayed PIN message")
+				server.WriteError(w, server.ErrorPinEncryption, "message was already received")
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// sunsetMiddleware announces the configured deprecation and sunset dates in the response headers.
+func (s *Server) sunsetMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conf := s.currentConf()
+		if conf.deprecation != nil {
+			w.Header().Set("Deprecation", conf.deprecation.UTC().Format(http.TimeFormat))
+		}
+		if conf.sunset != nil {
+			w.Header().Set("Sunset", conf.sunset.UTC().Format(http.TimeFormat))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) userMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Extract username and device from request
+		username := r.Header.Get("X-IRMA-Keyshare-Username")
+		deviceID := r.Header.Get("X-IRMA-Keyshare-Device")
+
+		// and fetch its information
+		user, err := s.user(r.Context(), username, deviceID)
+		if err == errDeviceNotFound {
+			s.conf.Logger.WithFields(logrus.Fields{"username": username, "device": deviceID}).Warn("Could not find device in db")
+			server.WriteError(w, server.ErrorDeviceNotRegistered, err.Error())
+			return
+		}
+		if err != nil && s.requestCancelled(r) {
+			return
+		}
+		if err != nil {
+			s.conf.Logger.WithFields(logrus.Fields{"username": username, "error": err}).Warn("Could not find user in db")
+			server.WriteError(w, server.ErrorUserNotRegistered, err.Error())
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, user)))
+	})
+}
+
+// adminMiddleware only allows requests containing the configured admin token.
+func (s *Server) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.conf.AdminToken)) != 1 {
+			s.conf.Logger.Warn("Administration request with invalid token")
+			server.WriteError(w, server.ErrorUnauthorized, "invalid administration token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) authorizationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Extract authorization from request
+		authorization := r.Header.Get("Authorization")
+		if strings.HasPrefix(authorization, "Bearer ") {
+			authorization = authorization[7:]
+		}
+
+		// verify access
+		ctx := r.Context()
+		user, ok := userFromContext(ctx)
+		if !ok {
+			s.conf.Logger.Error("No user in request context: userMiddleware must precede authorizationMiddleware")
+			server.WriteError(w, server.ErrorInternal, "")
+			return
+		}
+		err := s.core.ValidateJWT(user.Secrets, authorization)
+
+		// Construct new context with both authorization and its validity
+		nextContext := context.WithValue(ctx, authorizationKey, requestAuthorization{
+			token: authorization,
+			valid: err == nil,
+		})
+
+		next.ServeHTTP(w, r.WithContext(nextContext))
+	})
+}
+
+// requestUser returns the user and authorization that userMiddleware and authorizationMiddleware
+// stored in the request context. If these are missing, which happens only if the handler was
+// mounted without these middlewares, it logs this and writes an internal server error.
+func (s *Server) requestUser(w http.ResponseWriter, r *http.Request) (*User, requestAuthorization, bool) {
+	user, ok := userFromContext(r.Context())
+	if !ok {
+		s.conf.Logger.WithField("path", r.URL.Path).Error("No user in request context: handler not mounted behind userMiddleware")
+		server.WriteError(w, server.ErrorInternal, "")
+		return nil, requestAuthorization{}, false
+	}
+	authorization, ok := authorizationFromContext(r.Context())
+	if !ok {
+		s.conf.Logger.WithField("path", r.URL.Path).Error("No authorization in request context: handler not mounted behind authorizationMiddleware")
+		server.WriteError(w, server.ErrorInternal, "")
+		return nil, requestAuthorization{}, false
+	}
+	return user, authorization, true
+}
+
+// user fetches the specified user, containing the secrets of the specified additional device
+// of the user, or those of the device with which the account was registered if deviceID is empty.
+func (s *Server) user(ctx context.Context, username, deviceID string) (*User, error) {
+	user, err := s.db.user(ctx, username)
+	if err != nil || deviceID == "" {
+		return user, err
+	}
+	device, err := s.db.device(ctx, user, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	user.Secrets, user.DeviceID = device.Secrets, device.ID
+	return user, nil
+}
+
+func (s *Server) reservePinCheck(ctx context.Context, user *User) (bool, int, int64, error) {
+	ok, tries, wait, err := s.db.reservePinTry(ctx, user)
+	if err != nil {
+		s.logError(ctx, err, "Could not reserve pin check slot")
 		return false, 0, 0, err
 	}
 	if !ok {
-		err = s.db.addLog(user, eventTypePinCheckRefused, nil)
+		err = s.db.addLog(ctx, user, LogEventPinCheckRefused, nil)
 		if err != nil {
-			s.conf.Logger.WithField("error", err).Error("Could not add log entry for user")
-			return false, 0, 0, err
+			if err = s.activityError(ctx, err, "Could not add log entry for user"); err != nil {
+				return false, 0, 0, err
+			}
 		}
 		return false, tries, wait, nil
 	}
 	return true, tries, wait, nil
 }
+
+// requestCancelled returns whether the client cancelled the request, or it timed out, before we
+// finished handling it. In that case nobody is waiting for the response, so none needs to be written.
+func (s *Server) requestCancelled(r *http.Request) bool {
+	if err := r.Context().Err(); err != nil {
+		s.conf.Logger.WithField("error", err).Info("Request cancelled")
+		return true
+	}
+	return false
+}
+
+// logError logs an error that occurred while handling a request. If the request was cancelled,
+// the error is most likely caused by that instead of by a problem of this server, so then it is
+// logged at debug level.
+func (s *Server) logError(ctx context.Context, err error, msg string) {
+	entry := s.conf.Logger.WithField("error", err)
+	if ctx.Err() != nil {
+		entry.Debug(msg)
+		return
+	}
+	entry.Error(msg)
+}
+
+// writeInternalError writes an internal server error response, unless the request was cancelled.
+func (s *Server) writeInternalError(w http.ResponseWriter, r *http.Request, err error) {
+	if s.requestCancelled(r) {
+		return
+	}
+	server.WriteError(w, server.ErrorInternal, err.Error())
+}
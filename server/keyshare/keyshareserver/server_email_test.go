@@ -3,9 +3,14 @@
 package keyshareserver
 
 import (
+	"context"
+	"net/http"
 	"testing"
 
+	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
 )
 
 func TestServerRegistrationWithEmail(t *testing.T) {
@@ -35,3 +40,36 @@ func TestServerRegistrationWithEmail(t *testing.T) {
 		200, nil,
 	)
 }
+
+func TestServerChangeEmail(t *testing.T) {
+	db := createDB(t)
+	keyshareServer, httpServer := StartKeyshareServer(t, db, "localhost:1025")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	var jwtMsg irma.KeysharePinStatus
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin",
+		`{"id":"testusername","pin":"puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n"}`, nil,
+		200, &jwtMsg,
+	)
+	require.Equal(t, "success", jwtMsg.Status)
+	auth := func() http.Header {
+		return http.Header{
+			"X-IRMA-Keyshare-Username": []string{"testusername"},
+			"Authorization":            []string{jwtMsg.Message},
+		}
+	}
+
+	var rerr irma.RemoteError
+	test.HTTPPut(t, nil, "http://localhost:8080/users/email", `{"email":"Test <test@example.com>"}`, auth(), 400, &rerr)
+	require.Equal(t, string(server.ErrorInvalidRequest.Type), rerr.ErrorName)
+
+	// The new address replaces the verified one, and is not verified until the verification link is followed
+	user, err := db.user(context.Background(), "testusername")
+	require.NoError(t, err)
+	require.NoError(t, db.addEmailVerification(context.Background(), user, "old@example.com", "token", 24))
+	require.NoError(t, db.verifyEmail(context.Background(), "token"))
+	test.HTTPPut(t, nil, "http://localhost:8080/users/email", `{"email":"new@example.com","language":"en"}`, auth(), 204, nil)
+	verified, err := db.emailVerified(context.Background(), user)
+	require.NoError(t, err)
+	require.False(t, verified)
+}
@@ -1,21 +1,43 @@
 package keyshareserver
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/go-errors/errors"
+	"github.com/golang-jwt/jwt/v4"
 	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/privacybydesign/irmago/internal/keysharecore"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/privacybydesign/irmago/server/keyshare"
 	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"golang.org/x/crypto/curve25519"
 )
 
 func init() {
@@ -72,6 +94,420 @@ func TestServerHandleRegister(t *testing.T) {
 		`{"pin":"testpin","language":"nonexistinglanguage"}`, nil,
 		200, nil,
 	)
+
+	// Without OpenID Connect registration, accounts cannot be recovered
+	test.HTTPPost(t, nil, "http://localhost:8080/client/recover",
+		`{"idToken":"ey.ey.ey","pin":"testpin","language":"en"}`, nil,
+		501, nil,
+	)
+}
+
+func TestRegistrationLanguage(t *testing.T) {
+	db := NewMemoryDB()
+	keyshareServer, httpServer := StartKeyshareServer(t, db, "")
+	defer func() { StopKeyshareServer(t, keyshareServer, httpServer) }()
+
+	for lang, expected := range map[string]string{
+		`"EN-us"`:                              "en-us",
+		`"en_US.UTF-8"`:                        "en-us",
+		`"nl"`:                                 "nl",
+		`""`:                                   "en",
+		`"\ud83d\ude00"`:                       "en",
+		`"nonexistinglanguage"`:                "en",
+		`"` + strings.Repeat("a-", 100) + `a"`: "en",
+	} {
+		test.HTTPPost(t, nil, "http://localhost:8080/client/register",
+			`{"pin":"testpin","language":`+lang+`}`, nil,
+			200, nil,
+		)
+		memdb := db.(*memoryDB)
+		require.Len(t, memdb.users, 1, lang)
+		for username, user := range memdb.users {
+			require.Equal(t, expected, user.language, lang)
+			delete(memdb.users, username)
+		}
+	}
+
+	// Languages stored before they were validated are normalized when the user is next updated
+	db = createDB(t)
+	user, err := db.user(context.Background(), "testusername")
+	require.NoError(t, err)
+	user.Language = "nl_NL.UTF-8"
+	require.NoError(t, db.updateUser(context.Background(), user))
+	StopKeyshareServer(t, keyshareServer, httpServer)
+	keyshareServer, httpServer = StartKeyshareServer(t, db, "")
+
+	var status irma.KeysharePinStatus
+	test.HTTPPost(t, nil, "http://localhost:8080/users/change/pin",
+		`{"id":"testusername","oldpin":"puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n","newpin":"ljaksdfj;alkf"}`, nil,
+		200, &status,
+	)
+	require.Equal(t, "success", status.Status)
+	user, err = db.user(context.Background(), "testusername")
+	require.NoError(t, err)
+	require.Equal(t, "nl-nl", user.Language)
+}
+
+func TestCredentialIssued(t *testing.T) {
+	db := NewMemoryDB()
+	keyshareServer, httpServer := StartKeyshareServer(t, db, "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	test.HTTPPost(t, nil, "http://localhost:8080/client/register",
+		`{"pin":"testpin","language":"en"}`, nil,
+		200, nil,
+	)
+	users, err := db.listUsers(context.Background(), "", 10)
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	user, err := db.user(context.Background(), users[0].Username)
+	require.NoError(t, err)
+
+	// Until the issuance session of the keyshare credential is done, the credential is pending
+	keyshareServer.credentialIssued(user, &server.SessionResult{Status: irma.ServerStatusCancelled})
+	stats, err := db.userStats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.CredentialPending)
+	assert.Equal(t, 0, stats.CredentialIssued)
+
+	keyshareServer.credentialIssued(user, &server.SessionResult{Status: irma.ServerStatusDone})
+	stats, err = db.userStats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, stats.CredentialPending)
+	assert.Equal(t, 1, stats.CredentialIssued)
+}
+
+func TestRegistrationStatus(t *testing.T) {
+	db := NewMemoryDB()
+	keyshareServer, httpServer := StartKeyshareServer(t, db, "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	// Older clients receive only the session pointer
+	var raw map[string]interface{}
+	test.HTTPPost(t, nil, "http://localhost:8080/client/register",
+		`{"pin":"testpin","language":"en"}`, nil,
+		200, &raw,
+	)
+	require.Contains(t, raw, "u")
+	require.NotContains(t, raw, "token")
+
+	var session irma.KeyshareRegistrationSession
+	test.HTTPPost(t, nil, "http://localhost:8080/client/register",
+		`{"pin":"testpin","language":"en"}`, http.Header{"X-IRMA-Keyshare-ProtocolVersion": []string{"6"}},
+		200, &session,
+	)
+	require.NotNil(t, session.SessionPtr)
+	require.NotEmpty(t, session.Token)
+
+	var status irma.ServerStatus
+	test.HTTPGet(t, nil, "http://localhost:8080/client/register/"+session.Token+"/status", nil, 200, &status)
+	require.Equal(t, irma.ServerStatusInitialized, status)
+
+	// Only registration sessions can be reached
+	test.HTTPGet(t, nil, "http://localhost:8080/client/register/nonexistingtoken/status", nil, 400, nil)
+	requestorToken := keyshareServer.registrationSessions.get(session.Token).requestorToken
+	test.HTTPGet(t, nil, "http://localhost:8080/client/register/"+string(requestorToken)+"/status", nil, 400, nil)
+
+	require.NoError(t, keyshareServer.irmaserv.CancelSession(requestorToken))
+	test.HTTPGet(t, nil, "http://localhost:8080/client/register/"+session.Token+"/status", nil, 200, &status)
+	require.Equal(t, irma.ServerStatusCancelled, status)
+	stats, err := db.userStats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.CredentialPending)
+}
+
+func TestRegistrationKeyshareAttributes(t *testing.T) {
+	conf := testConfiguration(t, NewMemoryDB(), "")
+	conf.KeyshareAttribute = irma.AttributeTypeIdentifier{}
+	conf.KeyshareAttributes = []irma.AttributeTypeIdentifier{
+		irma.NewAttributeTypeIdentifier("test.test.mijnirma.email"),
+		irma.NewAttributeTypeIdentifier("test.test.email.email"),
+	}
+	keyshareServer, httpServer := startKeyshareServer(t, conf)
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	// Registration issues the primary keyshare attribute
+	var session irma.KeyshareRegistrationSession
+	test.HTTPPost(t, nil, "http://localhost:8080/client/register",
+		`{"pin":"testpin","language":"en"}`, http.Header{"X-IRMA-Keyshare-ProtocolVersion": []string{"6"}},
+		200, &session,
+	)
+	requestorToken := keyshareServer.registrationSessions.get(session.Token).requestorToken
+	request, err := keyshareServer.irmaserv.GetRequest(requestorToken)
+	require.NoError(t, err)
+	creds := request.SessionRequest().(*irma.IssuanceRequest).Credentials
+	require.Len(t, creds, 1)
+	require.Equal(t, irma.NewCredentialTypeIdentifier("test.test.mijnirma"), creds[0].CredentialTypeID)
+	require.Contains(t, creds[0].Attributes, "email")
+}
+
+func TestOIDCRegistration(t *testing.T) {
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	var jwksRequests int32
+	mux := http.NewServeMux()
+	provider := httptest.NewServer(mux)
+	defer provider.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		server.WriteJson(w, map[string]string{"issuer": provider.URL, "jwks_uri": provider.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&jwksRequests, 1)
+		server.WriteJson(w, map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "testkey",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(sk.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(sk.E)).Bytes()),
+		}}})
+	})
+	idToken := func(subject string, modify func(jwt.MapClaims)) string {
+		claims := jwt.MapClaims{
+			"iss":            provider.URL,
+			"aud":            "irmaapp",
+			"sub":            subject,
+			"iat":            time.Now().Unix(),
+			"exp":            time.Now().Add(5 * time.Minute).Unix(),
+			"email_verified": true,
+		}
+		if modify != nil {
+			modify(claims)
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "testkey"
+		signed, err := token.SignedString(sk)
+		require.NoError(t, err)
+		return signed
+	}
+
+	db := NewMemoryDB()
+	conf := testConfiguration(t, db, "")
+	conf.OIDCIssuer = provider.URL
+	conf.OIDCAudience = "irmaapp"
+	conf.OIDCRequiredClaims = map[string]string{"email_verified": "true"}
+	keyshareServer, httpServer := startKeyshareServer(t, conf)
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	pin := `puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n`
+	enroll := func(token string, status int) {
+		var rerr irma.RemoteError
+		test.HTTPPost(t, nil, "http://localhost:8080/client/register",
+			`{"pin":"`+pin+`","language":"en","idToken":"`+token+`"}`, nil,
+			status, &rerr,
+		)
+		if status == 403 {
+			require.Equal(t, string(server.ErrorInvalidIDToken.Type), rerr.ErrorName)
+		}
+	}
+
+	// ID tokens are required and validated
+	enroll("", 403)
+	enroll("ey.ey.ey", 403)
+	enroll(idToken("alice", func(claims jwt.MapClaims) { claims["aud"] = "otherapp" }), 403)
+	enroll(idToken("alice", func(claims jwt.MapClaims) { claims["iss"] = "https://example.com" }), 403)
+	enroll(idToken("alice", func(claims jwt.MapClaims) { claims["exp"] = time.Now().Add(-time.Hour).Unix() }), 403)
+	enroll(idToken("alice", func(claims jwt.MapClaims) { delete(claims, "email_verified") }), 403)
+	enroll(idToken("alice", nil), 200)
+
+	// An identity can be bound to only one account
+	enroll(idToken("alice", nil), 409)
+
+	// The keys of the provider are cached
+	require.Equal(t, int32(1), atomic.LoadInt32(&jwksRequests))
+
+	user, err := db.userByOIDCSubject(context.Background(), "alice")
+	require.NoError(t, err)
+	var jwtMsg irma.KeysharePinStatus
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin",
+		`{"id":"`+user.Username+`","pin":"`+pin+`"}`, nil,
+		200, &jwtMsg,
+	)
+	require.Equal(t, "success", jwtMsg.Status)
+	oldAuth := http.Header{
+		"X-IRMA-Keyshare-Username": []string{user.Username},
+		"Authorization":            []string{jwtMsg.Message},
+	}
+	test.HTTPGet(t, nil, "http://localhost:8080/users/status", oldAuth, 200, nil)
+
+	// Recovery requires an ID token of an identity that is bound to an account
+	test.HTTPPost(t, nil, "http://localhost:8080/client/recover",
+		`{"idToken":"ey.ey.ey","pin":"newpin","language":"en"}`, nil,
+		403, nil,
+	)
+	var rerr irma.RemoteError
+	test.HTTPPost(t, nil, "http://localhost:8080/client/recover",
+		`{"idToken":"`+idToken("bob", nil)+`","pin":"newpin","language":"en"}`, nil,
+		403, &rerr,
+	)
+	require.Equal(t, string(server.ErrorUserNotRegistered.Type), rerr.ErrorName)
+
+	// Recovering the account invalidates the secrets of the old device
+	var qr irma.Qr
+	test.HTTPPost(t, nil, "http://localhost:8080/client/recover",
+		`{"idToken":"`+idToken("alice", nil)+`","pin":"newpin","language":"en"}`, nil,
+		200, &qr,
+	)
+	require.Equal(t, irma.ActionIssuing, qr.Type)
+	test.HTTPGet(t, nil, "http://localhost:8080/users/status", oldAuth, 403, nil)
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin",
+		`{"id":"`+user.Username+`","pin":"`+pin+`"}`, nil,
+		200, &jwtMsg,
+	)
+	require.Equal(t, "failure", jwtMsg.Status)
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin",
+		`{"id":"`+user.Username+`","pin":"newpin"}`, nil,
+		200, &jwtMsg,
+	)
+	require.Equal(t, "success", jwtMsg.Status)
+}
+
+func TestServerRegistrationPolicy(t *testing.T) {
+	keyshareServer, httpServer := StartKeyshareServer(t, NewMemoryDB(), "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+	keyshareServer.conf.IrmaConfiguration.SchemeManagers[irma.NewSchemeManagerIdentifier("test")].KeyshareRegistration =
+		&irma.KeyshareRegistrationPolicy{
+			Email:        irma.KeyshareEmailRequired,
+			TermsURL:     "https://example.com/terms",
+			TermsVersion: "2",
+		}
+
+	var rerr irma.RemoteError
+	test.HTTPPost(t, nil, "http://localhost:8080/client/register",
+		`{"pin":"testpin","language":"en","acceptedTermsVersion":"2"}`, nil,
+		400, &rerr,
+	)
+	require.Equal(t, string(server.ErrorRegistrationPolicy.Type), rerr.ErrorName)
+	test.HTTPPost(t, nil, "http://localhost:8080/client/register",
+		`{"pin":"testpin","email":"test@test.com","language":"en","acceptedTermsVersion":"1"}`, nil,
+		400, &rerr,
+	)
+	require.Equal(t, string(server.ErrorRegistrationPolicy.Type), rerr.ErrorName)
+	test.HTTPPost(t, nil, "http://localhost:8080/client/register",
+		`{"pin":"testpin","email":"test@test.com","language":"en","acceptedTermsVersion":"2"}`, nil,
+		200, nil,
+	)
+}
+
+type attestorFunc func(token, platform string) error
+
+func (f attestorFunc) Verify(token, platform string) error {
+	return f(token, platform)
+}
+
+func TestRegistrationAttestation(t *testing.T) {
+	conf := testConfiguration(t, NewMemoryDB(), "")
+	conf.RegistrationAttestor = PlatformAttestors{"android": attestorFunc(func(token, _ string) error {
+		if token != "genuine" {
+			return errors.New("not genuine")
+		}
+		return nil
+	})}
+	conf.RequireRegistrationAttestation = true
+	keyshareServer, httpServer := startKeyshareServer(t, conf)
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	register := func(attestation string, status int) {
+		var rerr irma.RemoteError
+		test.HTTPPost(t, nil, "http://localhost:8080/client/register",
+			`{"pin":"testpin","language":"en"`+attestation+`}`, nil,
+			status, &rerr,
+		)
+		if status == 403 {
+			require.Equal(t, string(server.ErrorAttestationFailed.Type), rerr.ErrorName)
+		}
+	}
+	register("", 403)
+	register(`,"attestationToken":"emulated","attestationPlatform":"android"`, 403)
+	register(`,"attestationToken":"genuine","attestationPlatform":"ios"`, 403)
+	register(`,"attestationToken":"genuine","attestationPlatform":"android"`, 200)
+
+	// Re-enrollments to existing accounts do not require attestation
+	var rerr irma.RemoteError
+	test.HTTPPost(t, nil, "http://localhost:8080/client/register",
+		`{"pin":"testpin","language":"en","recoveryToken":"unknown"}`, nil,
+		403, &rerr,
+	)
+	require.Equal(t, string(server.ErrorInvalidRecoveryToken.Type), rerr.ErrorName)
+}
+
+func TestSunset(t *testing.T) {
+	conf := testConfiguration(t, createDB(t), "")
+	conf.DeprecationDate = "2029-01-01T00:00:00Z"
+	conf.SunsetDate = "2030-01-01T00:00:00+01:00"
+	conf.VersionMessage = map[string]string{"en": "Please update your app"}
+	keyshareServer, httpServer := startKeyshareServer(t, conf)
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	res, err := http.Post("http://localhost:8080/users/verify/pin", "application/json",
+		strings.NewReader(`{"id":"testusername","pin":"puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n"}`))
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, "Mon, 01 Jan 2029 00:00:00 GMT", res.Header.Get("Deprecation"))
+	assert.Equal(t, "Mon, 31 Dec 2029 23:00:00 GMT", res.Header.Get("Sunset"))
+
+	var info irma.KeyshareVersionInfo
+	test.HTTPGet(t, nil, "http://localhost:8080/api/version", nil, 200, &info)
+	assert.Equal(t, minProtocolVersion, info.MinProtocolVersion)
+	assert.Equal(t, maxProtocolVersion, info.MaxProtocolVersion)
+	require.NotNil(t, info.Sunset)
+	assert.Equal(t, int64(1893452400), time.Time(*info.Sunset).Unix())
+	assert.Equal(t, "Please update your app", info.Message["en"])
+
+	conf = testConfiguration(t, NewMemoryDB(), "")
+	conf.SunsetDate = "next year"
+	_, err = New(conf)
+	assert.Error(t, err)
+}
+
+func TestStatus(t *testing.T) {
+	keyshareServer, httpServer := StartKeyshareServer(t, createDB(t), "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	var status irma.KeyshareStatus
+	test.HTTPGet(t, nil, "http://localhost:8080/api/status", nil, 200, &status)
+	assert.Equal(t, irma.KeyshareStatus{Status: irma.KeyshareStatusOperational}, status)
+
+	reload := func(start, end string) {
+		conf := testConfiguration(t, keyshareServer.conf.DB, "")
+		conf.MaintenanceStart = start
+		conf.MaintenanceEnd = end
+		conf.MaintenanceMessage = map[string]string{"en": "Scheduled maintenance"}
+		conf.MinAppVersion = "7.0.0"
+		require.NoError(t, keyshareServer.ReloadConfig(conf))
+		status = irma.KeyshareStatus{}
+		test.HTTPGet(t, nil, "http://localhost:8080/api/status", nil, 200, &status)
+		assert.Equal(t, "7.0.0", status.MinAppVersion)
+	}
+
+	// An upcoming maintenance window is announced, while the server is still operational
+	reload("2099-01-01T00:00:00Z", "2099-01-01T02:00:00Z")
+	assert.Equal(t, irma.KeyshareStatusOperational, status.Status)
+	require.NotNil(t, status.Maintenance)
+	require.NotNil(t, status.Maintenance.Start)
+	assert.Equal(t, int64(4070908800), time.Time(*status.Maintenance.Start).Unix())
+	assert.Equal(t, "Scheduled maintenance", status.Maintenance.Message["en"])
+
+	// During the window, the status is maintenance
+	reload("2020-01-01T00:00:00Z", "2099-01-01T02:00:00Z")
+	assert.Equal(t, irma.KeyshareStatusMaintenance, status.Status)
+	require.NotNil(t, status.Maintenance)
+	reload("2020-01-01T00:00:00Z", "")
+	assert.Equal(t, irma.KeyshareStatusMaintenance, status.Status)
+	require.NotNil(t, status.Maintenance)
+	assert.Nil(t, status.Maintenance.End)
+
+	// Past windows are not announced
+	reload("2020-01-01T00:00:00Z", "2020-01-01T02:00:00Z")
+	assert.Equal(t, irma.KeyshareStatusOperational, status.Status)
+	assert.Nil(t, status.Maintenance)
+
+	conf := testConfiguration(t, keyshareServer.conf.DB, "")
+	conf.MaintenanceStart = "2099-01-01T02:00:00Z"
+	conf.MaintenanceEnd = "2099-01-01T00:00:00Z"
+	assert.Error(t, keyshareServer.ReloadConfig(conf))
+	conf.MaintenanceStart, conf.MaintenanceEnd = "", ""
+	conf.MaintenanceMessage = map[string]string{"en": "Scheduled maintenance"}
+	assert.Error(t, keyshareServer.ReloadConfig(conf))
 }
 
 func TestPinTries(t *testing.T) {
@@ -101,6 +537,78 @@ func TestPinTries(t *testing.T) {
 	require.Equal(t, "1", jwtMsg.Message)
 }
 
+func TestMissingMiddleware(t *testing.T) {
+	logger, hook := logrustest.NewNullLogger()
+	defer func(l *logrus.Logger) { server.Logger = l }(server.Logger)
+	defer irma.SetLogger(irma.Logger)
+
+	conf := testConfiguration(t, createDB(t), "")
+	conf.Logger = logger
+	keyshareServer, err := New(conf)
+	require.NoError(t, err)
+	defer keyshareServer.Stop()
+
+	for path, handler := range map[string]http.HandlerFunc{
+		"/prove/getCommitments": keyshareServer.handleCommitments,
+		"/prove/getResponse":    keyshareServer.handleResponse,
+		"/users/status":         keyshareServer.handleUserStatus,
+	} {
+		// Values stored under the same strings by other middlewares are not used
+		ctx := context.WithValue(context.Background(), "user", &User{Username: "testusername"})
+		ctx = context.WithValue(ctx, "authorization", "ey.ey.ey")
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`["test.test-3"]`)).WithContext(ctx)
+		rec := httptest.NewRecorder()
+		hook.Reset()
+
+		require.NotPanics(t, func() { handler(rec, req) })
+		require.Equal(t, http.StatusInternalServerError, rec.Code, path)
+		require.Equal(t, logrus.ErrorLevel, hook.Entries[0].Level)
+		require.Contains(t, hook.Entries[0].Message, "userMiddleware")
+	}
+
+	// Without authorizationMiddleware
+	req := httptest.NewRequest(http.MethodPost, "/prove/getCommitments", strings.NewReader(`["test.test-3"]`))
+	req.Header.Set("X-IRMA-Keyshare-Username", "testusername")
+	rec := httptest.NewRecorder()
+	hook.Reset()
+	keyshareServer.userMiddleware(http.HandlerFunc(keyshareServer.handleCommitments)).ServeHTTP(rec, req)
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+	require.Contains(t, hook.Entries[0].Message, "authorizationMiddleware")
+}
+
+func TestCancelledRequest(t *testing.T) {
+	logger, hook := logrustest.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	defer func(l *logrus.Logger) { server.Logger = l }(server.Logger)
+	defer irma.SetLogger(irma.Logger)
+
+	conf := testConfiguration(t, &testDB{db: createDB(t), ok: true, tries: 1, delay: time.Minute}, "")
+	conf.Logger = logger
+	keyshareServer, err := New(conf)
+	require.NoError(t, err)
+	defer keyshareServer.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "/users/verify/pin",
+		strings.NewReader(`{"id":"testusername","pin":"puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n"}`),
+	).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	// The slow pin reservation is aborted, after which no response is written
+	start := time.Now()
+	keyshareServer.handleVerifyPin(rec, req)
+	assert.Less(t, int64(time.Since(start)), int64(10*time.Second))
+	assert.Zero(t, rec.Body.Len())
+
+	// and nothing is logged as an error or sent as internal server error
+	for _, entry := range hook.AllEntries() {
+		assert.NotEqual(t, logrus.ErrorLevel, entry.Level, entry.Message)
+		assert.NotEqual(t, "Sending session error", entry.Message)
+	}
+	assert.Equal(t, "Request cancelled", hook.LastEntry().Message)
+}
+
 func TestPinNoRemainingTries(t *testing.T) {
 	db := createDB(t)
 
@@ -126,6 +634,151 @@ func TestPinNoRemainingTries(t *testing.T) {
 	}
 }
 
+func TestPinStatusDescriptions(t *testing.T) {
+	db := createDB(t)
+	user, err := db.user(context.Background(), "testusername")
+	require.NoError(t, err)
+	require.NoError(t, db.AddUser(context.Background(), &User{Username: "nlusername", Language: "nl", Secrets: user.Secrets}))
+
+	tdb := &testDB{db: db, ok: true, tries: 2, wait: 0, err: nil}
+	keyshareServer, httpServer := StartKeyshareServer(t, tdb, "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	verifyPin := func(body string, headers http.Header) irma.KeysharePinStatus {
+		var status irma.KeysharePinStatus
+		test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin", body, headers, 200, &status)
+		return status
+	}
+
+	// Language of the user, or else the default language
+	status := verifyPin(`{"id":"nlusername","pin":"puZGbaLDmFywGhFDi4vW2G87Zh"}`, nil)
+	require.Equal(t, "failure", status.Status)
+	require.Equal(t, "2", status.Message)
+	require.Equal(t, 2, status.Remaining)
+	require.Equal(t, "nl", status.Language)
+	require.Equal(t, "Verkeerde pincode. Je hebt nog 2 pogingen.", status.Description)
+	status = verifyPin(`{"id":"testusername","pin":"puZGbaLDmFywGhFDi4vW2G87Zh"}`, nil)
+	require.Equal(t, "en", status.Language)
+	require.Equal(t, "Wrong PIN. You have 2 attempts left.", status.Description)
+
+	// Requested language, from the message or else the Accept-Language header
+	status = verifyPin(`{"id":"nlusername","pin":"puZGbaLDmFywGhFDi4vW2G87Zh","language":"en-GB"}`, nil)
+	require.Equal(t, "en", status.Language)
+	headers := http.Header{}
+	headers["Accept-Language"] = []string{"fr-FR, nl;q=0.8"}
+	status = verifyPin(`{"id":"testusername","pin":"puZGbaLDmFywGhFDi4vW2G87Zh"}`, headers)
+	require.Equal(t, "nl", status.Language)
+	status = verifyPin(`{"id":"nlusername","pin":"puZGbaLDmFywGhFDi4vW2G87Zh","language":"fr"}`, nil)
+	require.Equal(t, "nl", status.Language)
+
+	tdb.tries = 1
+	status = verifyPin(`{"id":"testusername","pin":"puZGbaLDmFywGhFDi4vW2G87Zh"}`, nil)
+	require.Equal(t, "Wrong PIN. You have one attempt left, after which your account is temporarily blocked.", status.Description)
+
+	tdb.tries, tdb.wait = 0, 120
+	var changeStatus irma.KeysharePinStatus
+	test.HTTPPost(t, nil, "http://localhost:8080/users/change/pin",
+		`{"id":"nlusername","oldpin":"puZGbaLDmFywGhFDi4vW2G87Zh","newpin":"ljaksdfj;alkf"}`, nil,
+		200, &changeStatus,
+	)
+	require.Equal(t, "error", changeStatus.Status)
+	require.Equal(t, int64(120), changeStatus.Blocked)
+	require.Equal(t, "Je account is 2 minuten geblokkeerd vanwege te veel verkeerde pincodes.", changeStatus.Description)
+}
+
+func TestFormatDuration(t *testing.T) {
+	require.Equal(t, "1 second", formatDuration(1, "en"))
+	require.Equal(t, "59 seconds", formatDuration(59, "en"))
+	require.Equal(t, "1 minute", formatDuration(60, "en"))
+	require.Equal(t, "2 minutes", formatDuration(61, "en"))
+	require.Equal(t, "1 uur", formatDuration(3600, "nl"))
+	require.Equal(t, "24 uur", formatDuration(24*3600-1, "nl"))
+	require.Equal(t, "2 dagen", formatDuration(24*3600+1, "nl"))
+}
+
+func TestPinStatus(t *testing.T) {
+	db := createDB(t)
+	user := http.Header{"X-IRMA-Keyshare-Username": []string{"testusername"}}
+
+	keyshareServer, httpServer := StartKeyshareServer(t, &testDB{db: db, ok: true, tries: 2}, "")
+	var attempts irma.KeysharePinAttempts
+	test.HTTPGet(t, nil, "http://localhost:8080/users/pinstatus", user, 200, &attempts)
+	require.Equal(t, irma.KeysharePinAttempts{Remaining: 2}, attempts)
+
+	// Unknown users
+	test.HTTPGet(t, nil, "http://localhost:8080/users/pinstatus",
+		http.Header{"X-IRMA-Keyshare-Username": []string{"doesnotexist"}}, 403, nil,
+	)
+
+	// Requests are limited per user
+	for i := 1; i < pinStatusRateLimitUser; i++ {
+		test.HTTPGet(t, nil, "http://localhost:8080/users/pinstatus", user, 200, &attempts)
+	}
+	test.HTTPGet(t, nil, "http://localhost:8080/users/pinstatus", user, 429, nil)
+	StopKeyshareServer(t, keyshareServer, httpServer)
+
+	// Blocked users
+	keyshareServer, httpServer = StartKeyshareServer(t, &testDB{db: db, ok: false, tries: 0, wait: 5}, "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+	attempts = irma.KeysharePinAttempts{}
+	test.HTTPGet(t, nil, "http://localhost:8080/users/pinstatus", user, 200, &attempts)
+	require.Equal(t, irma.KeysharePinAttempts{Blocked: 5}, attempts)
+}
+
+func TestErrorReports(t *testing.T) {
+	conf := testConfiguration(t, createDB(t), "")
+	conf.ErrorReportFile = filepath.Join(t.TempDir(), "reports.jsonl")
+	keyshareServer, httpServer := startKeyshareServer(t, conf)
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	report := func(report irma.ClientErrorReport, expectedStatus int) {
+		bts, err := json.Marshal(report)
+		require.NoError(t, err)
+		test.HTTPPost(t, nil, "http://localhost:8080/api/report", string(bts), nil, expectedStatus, nil)
+	}
+
+	hash := sha256.Sum256([]byte("token"))
+	valid := irma.ClientErrorReport{
+		SessionTokenHash: hex.EncodeToString(hash[:]),
+		ErrorType:        irma.ErrorServerResponse,
+		RemoteError:      "SESSION_UNKNOWN",
+		RemoteStatus:     400,
+		ClientVersion:    irma.Version,
+		Platform:         "android/arm64",
+		Stack:            "main.main()",
+	}
+	report(valid, 204)
+
+	// Reports are validated and limited in size
+	invalid := valid
+	invalid.ErrorType = ""
+	report(invalid, 400)
+	invalid = valid
+	invalid.SessionTokenHash = "token"
+	report(invalid, 400)
+	invalid = valid
+	invalid.Platform = strings.Repeat("a", errorReportMaxFieldLength+1)
+	report(invalid, 400)
+	invalid = valid
+	invalid.Stack = strings.Repeat("a", irma.ClientErrorReportMaxStack+1)
+	report(invalid, 400)
+	invalid.Stack = strings.Repeat("a", errorReportMaxSize)
+	report(invalid, 400)
+
+	// Only valid reports are stored
+	bts, err := ioutil.ReadFile(conf.ErrorReportFile)
+	require.NoError(t, err)
+	var stored irma.ClientErrorReport
+	require.NoError(t, json.Unmarshal(bts, &stored))
+	require.Equal(t, valid, stored)
+
+	// Reports are limited per IP address
+	for i := 6; i < errorReportRateLimitIP; i++ {
+		report(valid, 204)
+	}
+	report(valid, 429)
+}
+
 func TestMissingUser(t *testing.T) {
 	keyshareServer, httpServer := StartKeyshareServer(t, NewMemoryDB(), "")
 	defer StopKeyshareServer(t, keyshareServer, httpServer)
@@ -157,6 +810,179 @@ func TestMissingUser(t *testing.T) {
 	)
 }
 
+func TestUniformPinResponses(t *testing.T) {
+	conf := testConfiguration(t, NewMemoryDB(), "")
+	conf.UniformPinResponses = true
+	keyshareServer, httpServer := startKeyshareServer(t, conf)
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	v3 := http.Header{"X-IRMA-Keyshare-ProtocolVersion": []string{"3"}}
+	v4 := http.Header{"X-IRMA-Keyshare-ProtocolVersion": []string{"4"}}
+
+	// Clients using older protocol versions still learn that the user does not exist
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin",
+		`{"id":"doesnotexist","pin":"bla"}`, v3,
+		403, nil,
+	)
+
+	// Newer clients get failures with decreasing tries, as for existing users, until the user is blocked
+	var status irma.KeysharePinStatus
+	tries := maxPinTries
+	for status.Status != "error" {
+		test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin",
+			`{"id":"doesnotexist","pin":"bla"}`, v4,
+			200, &status,
+		)
+		if status.Status == "failure" {
+			remaining, err := strconv.Atoi(status.Message)
+			require.NoError(t, err)
+			require.Less(t, remaining, tries)
+			tries = remaining
+		}
+	}
+	require.Equal(t, strconv.Itoa(int(backoffStart)), status.Message)
+
+	test.HTTPPost(t, nil, "http://localhost:8080/users/change/pin",
+		`{"id":"doesnotexist","oldpin":"old","newpin":"new"}`, v4,
+		200, &status,
+	)
+	require.Equal(t, "error", status.Status)
+
+	// The PIN status reflects the synthetic attempts
+	var attempts irma.KeysharePinAttempts
+	test.HTTPGet(t, nil, "http://localhost:8080/users/pinstatus", http.Header{
+		"X-IRMA-Keyshare-Username":        []string{"doesnotexist"},
+		"X-IRMA-Keyshare-ProtocolVersion": []string{"4"},
+	}, 200, &attempts)
+	require.Zero(t, attempts.Remaining)
+	require.NotZero(t, attempts.Blocked)
+
+	// The synthetic amount of remaining tries is stable per user
+	other, err := newUnknownUserStore(keyshareServer.unknownUsers.key, maxUnknownUsers)
+	require.NoError(t, err)
+	for _, username := range []string{"a", "b", "c", "d"} {
+		require.Equal(t, keyshareServer.unknownUsers.pinAttempts(username), other.pinAttempts(username))
+		require.Equal(t, keyshareServer.unknownUsers.pinStatus(username), other.pinStatus(username))
+	}
+}
+
+func TestUniformPinResponsesKey(t *testing.T) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+
+	// Instances configured with the same key respond alike for unknown users, see TestUniformPinResponses
+	conf := testConfiguration(t, NewMemoryDB(), "")
+	conf.UniformPinResponses = true
+	conf.UniformPinResponsesKey = base64.StdEncoding.EncodeToString(key)
+	keyshareServer, httpServer := startKeyshareServer(t, conf)
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+	require.Equal(t, key, keyshareServer.unknownUsers.key)
+}
+
+func TestUnknownUserStoreBounded(t *testing.T) {
+	store, err := newUnknownUserStore(nil, 2)
+	require.NoError(t, err)
+
+	store.pinStatus("a")
+	counter := store.users["a"].Value.(*unknownUser).counter
+	store.pinStatus("b")
+	store.pinAttempts("a")
+	store.pinStatus("c")
+
+	// The least recently used unknown user is forgotten first
+	require.Len(t, store.users, 2)
+	require.Contains(t, store.users, "a")
+	require.Contains(t, store.users, "c")
+	require.Equal(t, 2, store.lru.Len())
+	require.Equal(t, counter, store.users["a"].Value.(*unknownUser).counter)
+
+	// Expired unknown users are flushed
+	store.users["a"].Value.(*unknownUser).expiry = time.Now().Add(-time.Second)
+	store.flush()
+	require.Len(t, store.users, 1)
+	require.Equal(t, 1, store.lru.Len())
+}
+
+func TestPinEncryption(t *testing.T) {
+	privateKey := make([]byte, curve25519.ScalarSize)
+	_, err := rand.Read(privateKey)
+	require.NoError(t, err)
+
+	// Without PIN encryption key, no key is published
+	keyshareServer, httpServer := StartKeyshareServer(t, NewMemoryDB(), "")
+	test.HTTPGet(t, nil, "http://localhost:8080/api/pinkey", nil, 404, nil)
+	StopKeyshareServer(t, keyshareServer, httpServer)
+
+	conf := testConfiguration(t, createDB(t), "")
+	conf.PinEncryptionKey = base64.StdEncoding.EncodeToString(privateKey)
+	keyshareServer, httpServer = startKeyshareServer(t, conf)
+
+	// The published key is signed with the JWT key
+	var token []byte
+	test.HTTPGet(t, nil, "http://localhost:8080/api/pinkey", nil, 200, &token)
+	jwtKeyBytes, err := ioutil.ReadFile(conf.JwtPrivateKeyFile)
+	require.NoError(t, err)
+	jwtKey, err := jwt.ParseRSAPrivateKeyFromPEM(jwtKeyBytes)
+	require.NoError(t, err)
+	claims := &irma.KeysharePinKeyClaims{}
+	_, err = jwt.ParseWithClaims(string(token), claims, func(*jwt.Token) (interface{}, error) { return &jwtKey.PublicKey, nil })
+	require.NoError(t, err)
+	pinKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	require.NoError(t, err)
+	require.Equal(t, pinKey, claims.PinKey)
+
+	pinmsg := `{"id":"testusername","pin":"puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n"}`
+	encrypt := func(endpoint string) string {
+		msg, err := irma.EncryptKeyshareMessage(pinKey, endpoint, []byte(pinmsg))
+		require.NoError(t, err)
+		bts, err := json.Marshal(msg)
+		require.NoError(t, err)
+		return string(bts)
+	}
+	v5 := http.Header{"X-IRMA-Keyshare-ProtocolVersion": []string{"5"}}
+
+	var status irma.KeysharePinStatus
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin", encrypt("users/verify/pin"), v5, 200, &status)
+	require.Equal(t, "success", status.Status)
+
+	// Messages encrypted for other endpoints are refused
+	var rerr irma.RemoteError
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin", encrypt("users/change/pin"), v5, 400, &rerr)
+	require.Equal(t, string(server.ErrorPinEncryption.Type), rerr.ErrorName)
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin", pinmsg, v5, 400, nil)
+
+	// Replayed messages are refused
+	replayed := encrypt("users/verify/pin")
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin", replayed, v5, 200, &status)
+	require.Equal(t, "success", status.Status)
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin", replayed, v5, 400, &rerr)
+	require.Equal(t, string(server.ErrorPinEncryption.Type), rerr.ErrorName)
+
+	// as are messages of which the timestamp was altered
+	var msg irma.KeyshareEncryptedMessage
+	require.NoError(t, json.Unmarshal([]byte(encrypt("users/verify/pin")), &msg))
+	msg.Timestamp--
+	altered, err := json.Marshal(msg)
+	require.NoError(t, err)
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin", string(altered), v5, 400, &rerr)
+	require.Equal(t, string(server.ErrorPinEncryption.Type), rerr.ErrorName)
+
+	// Older clients can still send unencrypted PINs
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin", pinmsg, nil, 200, &status)
+	require.Equal(t, "success", status.Status)
+	StopKeyshareServer(t, keyshareServer, httpServer)
+
+	// unless disabled
+	conf.DisablePlaintextPins = true
+	keyshareServer, httpServer = startKeyshareServer(t, conf)
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin", pinmsg, nil, 400, &rerr)
+	require.Equal(t, string(server.ErrorPinEncryption.Type), rerr.ErrorName)
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin", encrypt("users/verify/pin"), v5, 200, &status)
+	require.Equal(t, "success", status.Status)
+	StopKeyshareServer(t, keyshareServer, httpServer)
+}
+
 func TestKeyshareSessions(t *testing.T) {
 	db := createDB(t)
 	keyshareServer, httpServer := StartKeyshareServer(t, db, "")
@@ -214,23 +1040,849 @@ func TestKeyshareSessions(t *testing.T) {
 		200, nil,
 	)
 
-	// finish session
-	test.HTTPPost(t, nil, "http://localhost:8080/prove/getResponse",
-		"12345678", http.Header{
-			"X-IRMA-Keyshare-Username": []string{"testusername"},
-			"Authorization":            []string{jwtMsg.Message},
-		},
-		200, nil,
-	)
-}
-
-func StartKeyshareServer(t *testing.T, db DB, emailserver string) (*Server, *http.Server) {
-	testdataPath := test.FindTestdataFolder(t)
-	s, err := New(&Configuration{
+	// finish session; in keyshare protocol version 2, the response is the bare JWT
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:8080/prove/getResponse", strings.NewReader("12345678"))
+	require.NoError(t, err)
+	req.Header = http.Header{
+		"X-IRMA-Keyshare-Username":        []string{"testusername"},
+		"X-IRMA-Keyshare-ProtocolVersion": []string{"2"},
+		"Authorization":                   []string{jwtMsg.Message},
+		"Content-Type":                    []string{"application/json"},
+	}
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	bts, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, 200, res.StatusCode)
+	require.Equal(t, "text/plain; charset=utf-8", res.Header.Get("Content-Type"))
+	require.Regexp(t, `^[\w-]+\.[\w-]+\.[\w-]+$`, string(bts))
+	_, _, err = new(jwt.Parser).ParseUnverified(string(bts), jwt.MapClaims{})
+	require.NoError(t, err)
+
+	// in keyshare protocol version 3, it is a KeyshareProofResponse
+	headers := http.Header{
+		"X-IRMA-Keyshare-Username":        []string{"testusername"},
+		"X-IRMA-Keyshare-ProtocolVersion": []string{"3"},
+		"Authorization":                   []string{jwtMsg.Message},
+	}
+	test.HTTPPost(t, nil, "http://localhost:8080/prove/getCommitments", `["test.test-3"]`, headers, 200, nil)
+	var proofResponse irma.KeyshareProofResponse
+	test.HTTPPost(t, nil, "http://localhost:8080/prove/getResponse", "12345678", headers, 200, &proofResponse)
+	require.NotEmpty(t, proofResponse.SessionID)
+	_, _, err = new(jwt.Parser).ParseUnverified(proofResponse.JWT, jwt.MapClaims{})
+	require.NoError(t, err)
+
+	// the commitments cannot be used for another response
+	var rerr irma.RemoteError
+	test.HTTPPost(t, nil, "http://localhost:8080/prove/getResponse", "87654321", headers, 400, &rerr)
+	require.Equal(t, keysharecore.ErrCommitmentConsumed.Error(), rerr.Message)
+
+	// in keyshare protocol version 7, the commitments are an ordered list
+	headers["X-IRMA-Keyshare-ProtocolVersion"] = []string{"7"}
+	var raw struct {
+		Commitments []map[string]interface{} `json:"c"`
+	}
+	test.HTTPPost(t, nil, "http://localhost:8080/prove/getCommitments", `["test.test-3","test.test-2"]`, headers, 200, &raw)
+	require.Len(t, raw.Commitments, 2)
+	require.Equal(t, "test.test-2", raw.Commitments[0]["key"])
+	require.Equal(t, "test.test-3", raw.Commitments[1]["key"])
+	var commitments irma.ProofPCommitmentMap
+	test.HTTPPost(t, nil, "http://localhost:8080/prove/getCommitments", `["test.test-3"]`, headers, 200, &commitments)
+	require.Contains(t, commitments.Commitments, irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test.test"), Counter: 3})
+}
+
+func TestDatabaseFailures(t *testing.T) {
+	db := &testDB{db: createDB(t), ok: true, tries: 1, wait: 0}
+	keyshareServer, httpServer := StartKeyshareServer(t, db, "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	var ready readyStatus
+	test.HTTPGet(t, nil, "http://localhost:8080/api/ready", nil, 200, &ready)
+	require.True(t, ready.Ready)
+
+	var jwtMsg irma.KeysharePinStatus
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin",
+		`{"id":"testusername","pin":"puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n"}`, nil,
+		200, &jwtMsg,
+	)
+	require.Equal(t, "success", jwtMsg.Status)
+
+	// Failing to log the session does not fail the session
+	db.logErr = errors.New("connection reset")
+	headers := http.Header{
+		"X-IRMA-Keyshare-Username":        []string{"testusername"},
+		"X-IRMA-Keyshare-ProtocolVersion": []string{"3"},
+		"Authorization":                   []string{jwtMsg.Message},
+	}
+	test.HTTPPost(t, nil, "http://localhost:8080/prove/getCommitments", `["test.test-3"]`, headers, 200, nil)
+	test.HTTPPost(t, nil, "http://localhost:8080/prove/getResponse", "12345678", headers, 200, nil)
+
+	// The server is reported unavailable only when the database fails for too long
+	db.failing = time.Second
+	test.HTTPGet(t, nil, "http://localhost:8080/api/ready", nil, 200, nil)
+	db.failing = time.Duration(DBFailureThresholdDefault+1) * time.Second
+	test.HTTPGet(t, nil, "http://localhost:8080/api/ready", nil, 503, nil)
+}
+
+func TestReadOnly(t *testing.T) {
+	db := &testDB{db: createDB(t), ok: true, tries: 1, wait: 0}
+	conf := testConfiguration(t, db, "")
+	conf.AdminToken = "admintoken"
+	var switched []bool
+	conf.Hooks = &server.Hooks{OnKeyshareReadOnly: func(readOnly bool) {
+		switched = append(switched, readOnly)
+	}}
+	keyshareServer, httpServer := startKeyshareServer(t, conf)
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+	require.Equal(t, []bool{false}, switched)
+
+	// Read-only mode is switched at the administration endpoint
+	auth := http.Header{"Authorization": []string{"admintoken"}}
+	var mode readOnlyStatus
+	test.HTTPPost(t, nil, "http://localhost:8080/admin/read-only", `{"readOnly":true}`, nil, 403, nil)
+	test.HTTPPost(t, nil, "http://localhost:8080/admin/read-only", `{"readOnly":true}`, auth, 200, &mode)
+	require.True(t, mode.ReadOnly)
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/read-only", auth, 200, &mode)
+	require.True(t, mode.ReadOnly)
+	require.Equal(t, []bool{false, true}, switched)
+
+	var status irma.KeyshareStatus
+	test.HTTPGet(t, nil, "http://localhost:8080/api/status", nil, 200, &status)
+	require.Equal(t, irma.KeyshareStatusReadOnly, status.Status)
+
+	// Operations changing state are refused, with a translated message
+	refused := func(path, body, lang string) {
+		req, err := http.NewRequest(http.MethodPost, "http://localhost:8080"+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept-Language", lang)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, res.Body.Close()) }()
+		require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+		require.Equal(t, strconv.Itoa(readOnlyRetryAfter), res.Header.Get("Retry-After"))
+		var remoteErr irma.RemoteError
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&remoteErr))
+		require.Equal(t, string(server.ErrorReadOnly.Type), remoteErr.ErrorName)
+		require.Equal(t, readOnlyDescriptions[lang], remoteErr.Message)
+	}
+	refused("/client/register", `{"pin":"testpin","email":"test@example.com","language":"en"}`, "en")
+	refused("/users/change/pin", `{"id":"testusername","oldpin":"puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n","newpin":"ljaksdfj;alkf"}`, "nl")
+
+	// while PIN verifications and keyshare sessions keep working, also if their activity cannot be recorded
+	db.logErr = errors.New("read-only transaction")
+	var jwtMsg irma.KeysharePinStatus
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin",
+		`{"id":"testusername","pin":"puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n"}`, nil,
+		200, &jwtMsg,
+	)
+	require.Equal(t, "success", jwtMsg.Status)
+	headers := http.Header{
+		"X-IRMA-Keyshare-Username":        []string{"testusername"},
+		"X-IRMA-Keyshare-ProtocolVersion": []string{"3"},
+		"Authorization":                   []string{jwtMsg.Message},
+	}
+	test.HTTPPost(t, nil, "http://localhost:8080/prove/getCommitments", `["test.test-3"]`, headers, 200, nil)
+	test.HTTPPost(t, nil, "http://localhost:8080/prove/getResponse", "12345678", headers, 200, nil)
+
+	// Outside read-only mode, failing to record PIN verifications fails them
+	keyshareServer.SetReadOnly(false)
+	require.Equal(t, []bool{false, true, false}, switched)
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin",
+		`{"id":"testusername","pin":"puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n"}`, nil,
+		500, nil,
+	)
+	test.HTTPGet(t, nil, "http://localhost:8080/api/status", nil, 200, &status)
+	require.Equal(t, irma.KeyshareStatusOperational, status.Status)
+
+	// Read-only mode can also be switched by reloading the configuration
+	conf = testConfiguration(t, db, "")
+	conf.AdminToken = "admintoken"
+	conf.ReadOnly = true
+	require.NoError(t, keyshareServer.ReloadConfig(conf))
+	require.True(t, keyshareServer.ReadOnly())
+	require.Equal(t, []bool{false, true, false, true}, switched)
+}
+
+func TestDevices(t *testing.T) {
+	db := createDB(t)
+	keyshareServer, httpServer := StartKeyshareServer(t, db, "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	pin := `puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n`
+	verifyPin := func(pin, device string) irma.KeysharePinStatus {
+		var jwtMsg irma.KeysharePinStatus
+		test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin",
+			`{"id":"testusername","pin":"`+pin+`"}`, http.Header{"X-IRMA-Keyshare-Device": []string{device}},
+			200, &jwtMsg,
+		)
+		return jwtMsg
+	}
+	jwtMsg := verifyPin(pin, "")
+	require.Equal(t, "success", jwtMsg.Status)
+	auth := http.Header{
+		"X-IRMA-Keyshare-Username": []string{"testusername"},
+		"Authorization":            []string{jwtMsg.Message},
+	}
+
+	// Enrollment codes can only be obtained by enrolled devices
+	test.HTTPPost(t, nil, "http://localhost:8080/users/devices/code", "", http.Header{
+		"X-IRMA-Keyshare-Username": []string{"testusername"},
+		"Authorization":            []string{"fakeauthorization"},
+	}, 403, nil)
+	var code irma.KeyshareEnrollmentCode
+	test.HTTPPost(t, nil, "http://localhost:8080/users/devices/code", "", auth, 200, &code)
+	require.NotEmpty(t, code.Code)
+
+	// Enroll an additional device
+	var rerr irma.RemoteError
+	test.HTTPPost(t, nil, "http://localhost:8080/client/register/device",
+		`{"id":"testusername","code":"wrongcode","pin":"devicepin","name":"Tablet"}`, nil,
+		403, &rerr,
+	)
+	require.Equal(t, string(server.ErrorInvalidEnrollmentCode.Type), rerr.ErrorName)
+	var registration irma.KeyshareDeviceRegistration
+	test.HTTPPost(t, nil, "http://localhost:8080/client/register/device",
+		`{"id":"testusername","code":"`+code.Code+`","pin":"devicepin","name":"Tablet"}`, nil,
+		200, &registration,
+	)
+	require.NotEmpty(t, registration.DeviceID)
+	require.NotNil(t, registration.SessionPtr)
+	test.HTTPPost(t, nil, "http://localhost:8080/client/register/device",
+		`{"id":"testusername","code":"`+code.Code+`","pin":"devicepin","name":"Tablet"}`, nil,
+		403, nil,
+	)
+
+	// The device has its own pin and access tokens
+	require.Equal(t, "failure", verifyPin(pin, registration.DeviceID).Status)
+	require.Equal(t, "failure", verifyPin("devicepin", "").Status)
+	jwtMsg = verifyPin("devicepin", registration.DeviceID)
+	require.Equal(t, "success", jwtMsg.Status)
+	deviceAuth := http.Header{
+		"X-IRMA-Keyshare-Username": []string{"testusername"},
+		"X-IRMA-Keyshare-Device":   []string{registration.DeviceID},
+		"Authorization":            []string{jwtMsg.Message},
+	}
+	test.HTTPPost(t, nil, "http://localhost:8080/prove/getCommitments", `["test.test-3"]`, deviceAuth, 200, nil)
+	test.HTTPPost(t, nil, "http://localhost:8080/prove/getCommitments", `["test.test-3"]`, http.Header{
+		"X-IRMA-Keyshare-Username": []string{"testusername"},
+		"Authorization":            []string{jwtMsg.Message},
+	}, 400, nil)
+
+	test.HTTPPost(t, nil, "http://localhost:8080/users/change/pin",
+		`{"id":"testusername","oldpin":"devicepin","newpin":"newdevicepin"}`,
+		http.Header{"X-IRMA-Keyshare-Device": []string{registration.DeviceID}},
+		200, &jwtMsg,
+	)
+	require.Equal(t, "success", jwtMsg.Status)
+	require.Equal(t, "success", verifyPin("newdevicepin", registration.DeviceID).Status)
+	require.Equal(t, "success", verifyPin(pin, "").Status)
+
+	// A PIN change using outdated secrets of the device does not undo a concurrent PIN change
+	user, err := db.user(context.Background(), "testusername")
+	require.NoError(t, err)
+	device, err := db.device(context.Background(), user, registration.DeviceID)
+	require.NoError(t, err)
+	user.DeviceID, user.Secrets = device.ID, device.Secrets
+	test.HTTPPost(t, nil, "http://localhost:8080/users/change/pin",
+		`{"id":"testusername","oldpin":"newdevicepin","newpin":"otherdevicepin"}`,
+		http.Header{"X-IRMA-Keyshare-Device": []string{registration.DeviceID}},
+		200, &jwtMsg,
+	)
+	require.Equal(t, "success", jwtMsg.Status)
+	status, err := keyshareServer.updatePin(context.Background(), user, "newdevicepin", "stalepin")
+	require.NoError(t, err)
+	require.Equal(t, "failure", status.Status)
+	require.Equal(t, "success", verifyPin("otherdevicepin", registration.DeviceID).Status)
+
+	// List and revoke devices
+	var devices []irma.KeyshareDevice
+	test.HTTPGet(t, nil, "http://localhost:8080/users/devices", auth, 200, &devices)
+	require.Len(t, devices, 1)
+	require.Equal(t, registration.DeviceID, devices[0].ID)
+	require.Equal(t, "Tablet", devices[0].Name)
+
+	test.HTTPPost(t, nil, "http://localhost:8080/users/devices/"+registration.DeviceID+"/revoke", "", auth, 204, nil)
+	test.HTTPPost(t, nil, "http://localhost:8080/users/devices/"+registration.DeviceID+"/revoke", "", auth, 403, nil)
+	test.HTTPPost(t, nil, "http://localhost:8080/prove/getCommitments", `["test.test-3"]`, deviceAuth, 403, &rerr)
+	require.Equal(t, string(server.ErrorDeviceNotRegistered.Type), rerr.ErrorName)
+	test.HTTPGet(t, nil, "http://localhost:8080/users/devices", auth, 200, &devices)
+	require.Empty(t, devices)
+}
+
+func TestRecoveryToken(t *testing.T) {
+	db := createDB(t)
+	keyshareServer, httpServer := StartKeyshareServer(t, db, "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	pin := `puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n`
+	verifyPin := func(pin string) irma.KeysharePinStatus {
+		var jwtMsg irma.KeysharePinStatus
+		test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin",
+			`{"id":"testusername","pin":"`+pin+`"}`, nil,
+			200, &jwtMsg,
+		)
+		return jwtMsg
+	}
+	jwtMsg := verifyPin(pin)
+	require.Equal(t, "success", jwtMsg.Status)
+	auth := http.Header{
+		"X-IRMA-Keyshare-Username": []string{"testusername"},
+		"Authorization":            []string{jwtMsg.Message},
+	}
+	user, err := db.user(context.Background(), "testusername")
+	require.NoError(t, err)
+	require.NoError(t, db.addDevice(context.Background(), user, &Device{ID: "tablet", Secrets: user.Secrets, Created: time.Now()}))
+
+	// Recovery tokens can only be obtained by enrolled devices
+	test.HTTPPost(t, nil, "http://localhost:8080/users/recovery/token", "", http.Header{
+		"X-IRMA-Keyshare-Username": []string{"testusername"},
+		"Authorization":            []string{"fakeauthorization"},
+	}, 403, nil)
+	var token irma.KeyshareRecoveryToken
+	test.HTTPPost(t, nil, "http://localhost:8080/users/recovery/token", "", auth, 200, &token)
+	require.Len(t, token.Token, recoveryTokenLength)
+	require.True(t, time.Time(*token.Expiry).After(time.Now().Add(89*24*time.Hour)))
+
+	reenroll := func(token string, status int) {
+		var rerr irma.RemoteError
+		test.HTTPPost(t, nil, "http://localhost:8080/client/register",
+			`{"pin":"newpin","language":"en","recoveryToken":"`+token+`"}`, nil,
+			status, &rerr,
+		)
+		if status == 403 {
+			require.Equal(t, string(server.ErrorInvalidRecoveryToken.Type), rerr.ErrorName)
+		}
+	}
+	reenroll("wrongtoken", 403)
+	require.NoError(t, db.addRecoveryToken(context.Background(), user, hashRecoveryToken("expiredtoken"), -time.Minute))
+	reenroll("expiredtoken", 403)
+
+	// Only the latest recovery token of the user can be used
+	var oldToken irma.KeyshareRecoveryToken
+	oldToken, token = token, irma.KeyshareRecoveryToken{}
+	test.HTTPPost(t, nil, "http://localhost:8080/users/recovery/token", "", auth, 200, &token)
+	reenroll(oldToken.Token, 403)
+
+	// Rejected PINs do not consume the recovery token
+	test.HTTPPost(t, nil, "http://localhost:8080/client/register",
+		`{"pin":"`+strings.Repeat("a", 65)+`","language":"en","recoveryToken":"`+token.Token+`"}`, nil,
+		400, nil,
+	)
+
+	// Re-enrolling keeps the username, and invalidates the secrets of all previous devices
+	reenroll(token.Token, 200)
+	test.HTTPGet(t, nil, "http://localhost:8080/users/status", auth, 403, nil)
+	require.Equal(t, "failure", verifyPin(pin).Status)
+	require.Equal(t, "success", verifyPin("newpin").Status)
+	devices, err := db.devices(context.Background(), user)
+	require.NoError(t, err)
+	require.Empty(t, devices)
+
+	// Recovery tokens can be used only once
+	reenroll(token.Token, 403)
+}
+
+func TestHooks(t *testing.T) {
+	var lock sync.Mutex
+	var ops []server.KeyshareOperation
+	var usernames []string
+	var sessions []irma.RequestorToken
+	routes := map[string]int{}
+	conf := testConfiguration(t, createDB(t), "")
+	conf.Hooks = &server.Hooks{
+		OnSessionCreated: func(token irma.RequestorToken, action irma.Action) {
+			lock.Lock()
+			defer lock.Unlock()
+			assert.Equal(t, irma.ActionIssuing, action)
+			sessions = append(sessions, token)
+		},
+		OnKeyshareOperation: func(username string, op server.KeyshareOperation, _ time.Duration, err error) {
+			lock.Lock()
+			defer lock.Unlock()
+			assert.NoError(t, err)
+			ops = append(ops, op)
+			usernames = append(usernames, username)
+		},
+		OnHTTPRequest: func(route string, status int, _ time.Duration) {
+			lock.Lock()
+			defer lock.Unlock()
+			routes[route] = status
+			panic("panics in hooks are recovered")
+		},
+	}
+	keyshareServer, httpServer := startKeyshareServer(t, conf)
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	// Registering starts the issuance session of the keyshare credential
+	test.HTTPPost(t, nil, "http://localhost:8080/client/register", `{"pin":"testpin","language":"en"}`, nil, 200, nil)
+	var jwtMsg irma.KeysharePinStatus
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin",
+		`{"id":"testusername","pin":"puZGbaLDmFywGhFDi4vW2G87Zh"}`, nil,
+		200, &jwtMsg,
+	)
+	require.Equal(t, "failure", jwtMsg.Status)
+	test.HTTPGet(t, nil, "http://localhost:8080/irma/session/foo/status", nil, 400, nil)
+
+	require.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(routes) == 3
+	}, time.Second, 10*time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	require.Equal(t, []server.KeyshareOperation{server.KeyshareOperationRegister, server.KeyshareOperationVerifyPin}, ops)
+	require.NotEmpty(t, usernames[0])
+	require.Equal(t, "testusername", usernames[1])
+	require.Len(t, sessions, 1)
+	require.Equal(t, 200, routes["/client/register"])
+	require.Equal(t, 200, routes["/users/verify/pin"])
+	// Requests to the mounted IRMA server are reported once, with the route within it, which
+	// ends in a wildcard as the unknown session is rejected before the route is fully matched
+	require.Equal(t, 400, routes["/irma/session/{clientToken}/*"])
+}
+
+func TestAdmin(t *testing.T) {
+	db := NewMemoryDB()
+	n := 2*adminUsersPageSize + 10
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.AddUser(context.Background(), &User{Username: fmt.Sprintf("user%06d", i)}))
+	}
+
+	// Without admin token, the administration endpoints are disabled
+	keyshareServer, httpServer := StartKeyshareServer(t, db, "")
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/stats", http.Header{"Authorization": []string{""}}, 404, nil)
+	StopKeyshareServer(t, keyshareServer, httpServer)
+
+	conf := testConfiguration(t, db, "")
+	conf.AdminToken = "admintoken"
+	keyshareServer, httpServer = startKeyshareServer(t, conf)
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/stats", nil, 403, nil)
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/stats", http.Header{"Authorization": []string{"wrongtoken"}}, 403, nil)
+	auth := http.Header{"Authorization": []string{"admintoken"}}
+
+	var stats userStats
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/stats", auth, 200, &stats)
+	require.Equal(t, n, stats.Accounts)
+
+	exportUsers := func(cursor string) []userMetadata {
+		var bts []byte
+		test.HTTPGet(t, nil, "http://localhost:8080/admin/users?cursor="+cursor, auth, 200, &bts)
+		var users []userMetadata
+		decoder := json.NewDecoder(bytes.NewReader(bts))
+		for decoder.More() {
+			var user userMetadata
+			require.NoError(t, decoder.Decode(&user))
+			users = append(users, user)
+		}
+		return users
+	}
+	users := exportUsers("")
+	require.Len(t, users, n)
+	for i, user := range users {
+		require.Equal(t, fmt.Sprintf("user%06d", i), user.Username)
+	}
+	users = exportUsers("user000009")
+	require.Len(t, users, n-10)
+	require.Equal(t, "user000010", users[0].Username)
+	require.Empty(t, exportUsers("zzz"))
+}
+
+func TestAdminUsageStats(t *testing.T) {
+	db := createDB(t)
+	user, err := db.user(context.Background(), "testusername")
+	require.NoError(t, err)
+	require.NoError(t, db.addLog(context.Background(), user, LogEventIRMASession, nil))
+	today := usageDay(time.Now())
+	require.NoError(t, db.rollupUsage(context.Background(), today.Add(24*time.Hour)))
+
+	conf := testConfiguration(t, db, "")
+	conf.AdminToken = "admintoken"
+	keyshareServer, httpServer := startKeyshareServer(t, conf)
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+	auth := http.Header{"Authorization": []string{"admintoken"}}
+	date := today.Format(usageDateFormat)
+
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/stats/usage?from="+date+"&to="+date, nil, 403, nil)
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/stats/usage?from="+date, auth, 400, nil)
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/stats/usage?from=yesterday&to="+date, auth, 400, nil)
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/stats/usage?from="+date+"&to=2000-01-01", auth, 400, nil)
+
+	var stats []usageStat
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/stats/usage?from=2000-01-01&to="+date, auth, 200, &stats)
+	require.Equal(t, []usageStat{{Date: date, Sessions: 1, Users: 1}}, stats)
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/stats/usage?from=2000-01-01&to=2000-01-31", auth, 200, &stats)
+	require.Empty(t, stats)
+
+	var csv []byte
+	csvAuth := http.Header{"Authorization": []string{"admintoken"}, "Accept": []string{"text/csv, application/json;q=0.5"}}
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/stats/usage?from="+date+"&to="+date, csvAuth, 200, &csv)
+	require.Equal(t, "date,sessions,users\n"+date+",1,1\n", string(csv))
+}
+
+func TestLogRetention(t *testing.T) {
+	db := NewMemoryDB()
+	user := &User{Username: "testuser"}
+	require.NoError(t, db.AddUser(context.Background(), user))
+	for _, eventType := range []LogEventType{
+		LogEventIRMASession, LogEventPinCheckSuccess, LogEventPinCheckBlocked, LogEventDeviceAdded,
+	} {
+		require.NoError(t, db.addLog(context.Background(), user, eventType, nil))
+	}
+
+	conf := testConfiguration(t, db, "")
+	conf.LogRetention = map[LogEventType]int{
+		LogEventIRMASession:     30,
+		LogEventPinCheckSuccess: 30,
+		LogEventPinCheckBlocked: 365,
+	}
+	s, err := New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+
+	remaining := func() []LogEventType {
+		var events []LogEventType
+		for _, entry := range db.(*memoryDB).logs {
+			events = append(events, entry.event)
+		}
+		return events
+	}
+
+	// Entries are deleted once the retention period of their event type has passed, while entries
+	// of event types without retention period are kept
+	now := time.Now()
+	require.NoError(t, s.applyLogRetention(context.Background(), now.Add(29*24*time.Hour)))
+	require.Equal(t, []LogEventType{
+		LogEventIRMASession, LogEventPinCheckSuccess, LogEventPinCheckBlocked, LogEventDeviceAdded,
+	}, remaining())
+	require.NoError(t, s.applyLogRetention(context.Background(), now.Add(31*24*time.Hour)))
+	require.Equal(t, []LogEventType{LogEventPinCheckBlocked, LogEventDeviceAdded}, remaining())
+	require.NoError(t, s.applyLogRetention(context.Background(), now.Add(364*24*time.Hour)))
+	require.Equal(t, []LogEventType{LogEventPinCheckBlocked, LogEventDeviceAdded}, remaining())
+	require.NoError(t, s.applyLogRetention(context.Background(), now.Add(366*24*time.Hour)))
+	require.Equal(t, []LogEventType{LogEventDeviceAdded}, remaining())
+}
+
+func TestAdminKeys(t *testing.T) {
+	// Use a copy of the schemes, so that we can add a broken key
+	schemes, err := ioutil.TempDir("", "irma_configuration")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.RemoveAll(schemes)) }()
+	require.NoError(t, common.CopyDirectory(filepath.Join(test.FindTestdataFolder(t), "irma_configuration"), schemes))
+
+	conf := testConfiguration(t, NewMemoryDB(), "")
+	conf.SchemesPath = schemes
+	conf.AdminToken = "admintoken"
+	var loaded, failed int
+	conf.Hooks = &server.Hooks{OnKeyshareKeysLoaded: func(l, f int) { loaded, failed = l, f }}
+	keyshareServer, httpServer := startKeyshareServer(t, conf)
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+	auth := http.Header{"Authorization": []string{"admintoken"}}
+
+	issuer := irma.NewIssuerIdentifier("test.test")
+	var result keyLoadResult
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/keys", auth, 200, &result)
+	require.Zero(t, result.Failed)
+	require.NotNil(t, result.Time)
+	require.Equal(t, []uint{0, 1, 2, 3}, result.Issuers[issuer].Loaded)
+	require.Empty(t, result.Issuers[issuer].Errors)
+	require.NotZero(t, loaded)
+	require.Zero(t, failed)
+	test.HTTPGet(t, nil, "http://localhost:8080/api/ready", nil, 200, nil)
+
+	// A broken key does not prevent the other keys from being loaded
+	keyfile := filepath.Join(schemes, "test", "test", "PublicKeys", "4.xml")
+	require.NoError(t, ioutil.WriteFile(keyfile, []byte("broken"), 0600))
+	test.HTTPPost(t, nil, "http://localhost:8080/admin/reload-keys", "", auth, 200, &result)
+	require.Equal(t, 1, result.Failed)
+	require.Len(t, result.Issuers[issuer].Errors, 1)
+	require.Equal(t, []uint{0, 1, 2, 3}, result.Issuers[issuer].Loaded)
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/keys", auth, 200, &result)
+	require.Equal(t, 1, result.Failed)
+	require.Equal(t, 1, failed)
+
+	// The server is reported unavailable until the key is fixed, unless configured otherwise
+	test.HTTPGet(t, nil, "http://localhost:8080/api/ready", nil, 503, nil)
+	reloaded := testConfiguration(t, conf.DB, "")
+	reloaded.SchemesPath = schemes
+	reloaded.AdminToken = "admintoken"
+	reloaded.ReadyIgnoresKeyFailures = true
+	require.NoError(t, keyshareServer.ReloadConfig(reloaded))
+	test.HTTPGet(t, nil, "http://localhost:8080/api/ready", nil, 200, nil)
+	reloaded.ReadyIgnoresKeyFailures = false
+	require.NoError(t, keyshareServer.ReloadConfig(reloaded))
+	test.HTTPGet(t, nil, "http://localhost:8080/api/ready", nil, 503, nil)
+
+	test.HTTPPost(t, nil, "http://localhost:8080/admin/reload-keys", "", nil, 403, nil)
+
+	require.NoError(t, os.Remove(keyfile))
+	test.HTTPPost(t, nil, "http://localhost:8080/admin/reload-keys", "", auth, 200, &result)
+	require.Zero(t, result.Failed)
+	require.Zero(t, failed)
+	test.HTTPGet(t, nil, "http://localhost:8080/api/ready", nil, 200, nil)
+}
+
+func TestTrustedKeys(t *testing.T) {
+	schemes := filepath.Join(test.FindTestdataFolder(t), "irma_configuration")
+
+	// Pinning a key other than the one with which the scheme is signed prevents the server from starting
+	conf := testConfiguration(t, NewMemoryDB(), "")
+	conf.PinnedSchemeKeyFiles = map[irma.SchemeManagerIdentifier]string{
+		irma.NewSchemeManagerIdentifier("test"): filepath.Join(schemes, "irma-demo", "pk.pem"),
+	}
+	_, err := New(conf)
+	require.Error(t, err)
+
+	// Only the keys of trusted issuers are loaded
+	conf = testConfiguration(t, NewMemoryDB(), "")
+	conf.PinnedSchemeKeyFiles = map[irma.SchemeManagerIdentifier]string{
+		irma.NewSchemeManagerIdentifier("test"): filepath.Join(schemes, "test", "pk.pem"),
+	}
+	conf.TrustedIssuers = []irma.IssuerIdentifier{irma.NewIssuerIdentifier("test.test")}
+	conf.AdminToken = "admintoken"
+	keyshareServer, httpServer := startKeyshareServer(t, conf)
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	var result keyLoadResult
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/keys", http.Header{"Authorization": []string{"admintoken"}}, 200, &result)
+	require.Contains(t, result.Issuers, irma.NewIssuerIdentifier("test.test"))
+	require.NotContains(t, result.Issuers, irma.NewIssuerIdentifier("irma-demo.RU"))
+}
+
+func TestVerifyEmail(t *testing.T) {
+	db := createDB(t)
+	keyshareServer, httpServer := StartKeyshareServer(t, db, "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	user, err := db.user(context.Background(), "testusername")
+	require.NoError(t, err)
+	for token, validity := range map[string]int{"testtoken": 24, "expiredtoken": -1, "htmltoken": 24} {
+		require.NoError(t, db.addEmailVerification(context.Background(), user, "test@example.com", keyshare.HashEmailToken(token), validity))
+	}
+
+	var jwtMsg irma.KeysharePinStatus
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin",
+		`{"id":"testusername","pin":"puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n"}`, nil,
+		200, &jwtMsg,
+	)
+	require.Equal(t, "success", jwtMsg.Status)
+	headers := http.Header{
+		"X-IRMA-Keyshare-Username": []string{"testusername"},
+		"Authorization":            []string{jwtMsg.Message},
+	}
+
+	var status userStatus
+	test.HTTPGet(t, nil, "http://localhost:8080/users/status", headers, 200, &status)
+	assert.False(t, status.EmailVerified)
+
+	var result emailVerificationResult
+	test.HTTPGet(t, nil, "http://localhost:8080/users/email/verify/testtoken", nil, 200, &result)
+	assert.True(t, result.Verified)
+
+	test.HTTPGet(t, nil, "http://localhost:8080/users/status", headers, 200, &status)
+	assert.True(t, status.EmailVerified)
+
+	// Tokens can be used only once. Used, expired and unknown tokens get identical responses.
+	var bodies []string
+	for _, token := range []string{"testtoken", "expiredtoken", "nonexistent"} {
+		res, err := http.Get("http://localhost:8080/users/email/verify/" + token)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(res.Body)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		assert.Equal(t, server.ErrorInvalidEmailToken.Status, res.StatusCode)
+		bodies = append(bodies, string(body))
+	}
+	assert.Equal(t, bodies[0], bodies[1])
+	assert.Equal(t, bodies[0], bodies[2])
+	var rerr irma.RemoteError
+	require.NoError(t, json.Unmarshal([]byte(bodies[0]), &rerr))
+	assert.Equal(t, server.ErrorInvalidEmailToken.Type, server.ErrorType(rerr.ErrorName))
+
+	// Browsers get a HTML page
+	var page []byte
+	test.HTTPGet(t, nil, "http://localhost:8080/users/email/verify/htmltoken",
+		http.Header{"Accept": []string{"text/html"}}, 200, &page)
+	assert.Contains(t, string(page), "Your email address has been verified.")
+	test.HTTPGet(t, nil, "http://localhost:8080/users/email/verify/htmltoken",
+		http.Header{"Accept": []string{"text/html"}}, 403, &page)
+	assert.Contains(t, string(page), server.ErrorInvalidEmailToken.Description)
+
+	// The user status requires a valid authorization
+	test.HTTPGet(t, nil, "http://localhost:8080/users/status", http.Header{
+		"X-IRMA-Keyshare-Username": []string{"testusername"},
+		"Authorization":            []string{"fakeauthorization"},
+	}, 403, nil)
+}
+
+func TestEmailManagement(t *testing.T) {
+	db := createDB(t)
+	keyshareServer, httpServer := StartKeyshareServer(t, db, "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	ctx := context.Background()
+	user, err := db.user(ctx, "testusername")
+	require.NoError(t, err)
+	addEmail := func(token string) {
+		require.NoError(t, db.addEmailVerification(ctx, user, "test@example.com", keyshare.HashEmailToken(token), 24))
+		require.NoError(t, db.verifyEmail(ctx, keyshare.HashEmailToken(token)))
+		require.NoError(t, db.addUnsubscribeToken(ctx, user, "test@example.com", keyshare.HashEmailToken("unsubscribe"+token)))
+	}
+
+	var jwtMsg irma.KeysharePinStatus
+	test.HTTPPost(t, nil, "http://localhost:8080/users/verify/pin",
+		`{"id":"testusername","pin":"puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n"}`, nil,
+		200, &jwtMsg,
+	)
+	require.Equal(t, "success", jwtMsg.Status)
+	auth := func() http.Header {
+		return http.Header{
+			"X-IRMA-Keyshare-Username": []string{"testusername"},
+			"Authorization":            []string{jwtMsg.Message},
+		}
+	}
+	verified := func() bool {
+		var status userStatus
+		test.HTTPGet(t, nil, "http://localhost:8080/users/status", auth(), 200, &status)
+		return status.EmailVerified
+	}
+
+	// Removing the email address requires a valid authorization
+	addEmail("token")
+	test.HTTPDelete(t, nil, "http://localhost:8080/users/email", http.Header{
+		"X-IRMA-Keyshare-Username": []string{"testusername"},
+		"Authorization":            []string{"fakeauthorization"},
+	}, 403, nil)
+	require.True(t, verified())
+	test.HTTPDelete(t, nil, "http://localhost:8080/users/email", auth(), 204, nil)
+	require.False(t, verified())
+	_, err = db.unsubscribe(ctx, keyshare.HashEmailToken("unsubscribetoken"))
+	require.Equal(t, errUnsubscribeTokenInvalid, err)
+
+	// and is refused if the registration policy requires an email address
+	scheme := keyshareServer.conf.IrmaConfiguration.SchemeManagers[irma.NewSchemeManagerIdentifier("test")]
+	scheme.KeyshareRegistration = &irma.KeyshareRegistrationPolicy{Email: irma.KeyshareEmailRequired}
+	var rerr irma.RemoteError
+	test.HTTPDelete(t, nil, "http://localhost:8080/users/email", auth(), 400, &rerr)
+	require.Equal(t, string(server.ErrorRegistrationPolicy.Type), rerr.ErrorName)
+	scheme.KeyshareRegistration = nil
+
+	// The email address can be removed without authorization using the unsubscribe token, after
+	// which the token gets the same response as unknown tokens
+	addEmail("token")
+	test.HTTPGet(t, nil, "http://localhost:8080/users/email/unsubscribe/unsubscribetoken", nil, 204, nil)
+	require.False(t, verified())
+	test.HTTPGet(t, nil, "http://localhost:8080/users/email/unsubscribe/unsubscribetoken", nil, 204, nil)
+	test.HTTPGet(t, nil, "http://localhost:8080/users/email/unsubscribe/nonexistent", nil, 204, nil)
+
+	// also by mail clients using a POST (RFC 8058), and browsers get a HTML page
+	addEmail("posttoken")
+	test.HTTPPost(t, nil, "http://localhost:8080/users/email/unsubscribe/unsubscribeposttoken",
+		"List-Unsubscribe=One-Click", http.Header{"Content-Type": []string{"application/x-www-form-urlencoded"}}, 204, nil)
+	require.False(t, verified())
+	addEmail("htmltoken")
+	var page []byte
+	test.HTTPGet(t, nil, "http://localhost:8080/users/email/unsubscribe/unsubscribehtmltoken",
+		http.Header{"Accept": []string{"text/html"}}, 200, &page)
+	require.Contains(t, string(page), "Your email address has been removed.")
+	require.False(t, verified())
+
+	// Without an email server, email addresses cannot be changed
+	test.HTTPPut(t, nil, "http://localhost:8080/users/email", `{"email":"new@example.com"}`, auth(), 400, &rerr)
+	require.Equal(t, string(server.ErrorInvalidRequest.Type), rerr.ErrorName)
+}
+
+func TestPathPrefix(t *testing.T) {
+	conf := testConfiguration(t, NewMemoryDB(), "")
+	conf.URL = "http://localhost:8080"
+	conf.PathPrefix = "/keyshare"
+	s, err := New(conf)
+	require.NoError(t, err)
+
+	// The proxy forwards /keyshare/ including the prefix; health checks reach the server directly
+	handler := s.Handler()
+	mux := http.NewServeMux()
+	mux.Handle("/keyshare/", handler)
+	mux.Handle("/api/", handler)
+	httpServer := &http.Server{Addr: "localhost:8080", Handler: mux}
+	go func() {
+		err := httpServer.ListenAndServe()
+		if err == http.ErrServerClosed {
+			err = nil
+		}
+		assert.NoError(t, err)
+	}()
+	time.Sleep(200 * time.Millisecond) // Give server time to start
+	defer StopKeyshareServer(t, s, httpServer)
+
+	test.HTTPGet(t, nil, "http://localhost:8080/keyshare/api/ready", nil, 200, nil)
+	test.HTTPGet(t, nil, "http://localhost:8080/api/ready", nil, 200, nil)
+	test.HTTPGet(t, nil, "http://localhost:8080/keyshare", nil, 404, nil)
+
+	// The session pointer of the registration refers to the embedded IRMA server under the prefix
+	var qr irma.Qr
+	test.HTTPPost(t, nil, "http://localhost:8080/keyshare/client/register",
+		`{"pin":"testpin","language":"en"}`, nil,
+		200, &qr,
+	)
+	require.Equal(t, irma.ActionIssuing, qr.Type)
+	require.True(t, strings.HasPrefix(qr.URL, "http://localhost:8080/keyshare/irma/session/"), qr.URL)
+
+	request := irma.ClientSessionRequest{Request: &irma.IssuanceRequest{}}
+	test.HTTPGet(t, nil, qr.URL, http.Header{
+		irma.MinVersionHeader:    []string{`"2.8"`},
+		irma.MaxVersionHeader:    []string{`"2.8"`},
+		irma.AuthorizationHeader: []string{"testauthorization"},
+	}, 200, &request)
+	require.Equal(t, irma.ActionIssuing, request.Request.Action())
+	var status irma.ServerStatus
+	test.HTTPGet(t, nil, qr.URL+"/status", nil, 200, &status)
+	require.Equal(t, irma.ServerStatusConnected, status)
+}
+
+func TestServerStop(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	s, err := New(testConfiguration(t, NewMemoryDB(), ""))
+	require.NoError(t, err)
+	s.Stop()
+	s.Stop()
+
+	var closer io.Closer = s
+	require.NoError(t, closer.Close())
+}
+
+func TestServerNewFailingDB(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	// The embedded IRMA server is started before the database connection fails
+	conf := testConfiguration(t, nil, "")
+	conf.DBType = DBTypePostgres
+	conf.DBConnStr = "postgresql://localhost:1/test?connect_timeout=1"
+	s, err := New(conf)
+	require.Error(t, err)
+	require.Nil(t, s)
+
+	// Stopping the server returned by New is harmless
+	s.Stop()
+	require.NoError(t, s.Close())
+}
+
+func StartKeyshareServer(t *testing.T, db DB, emailserver string) (*Server, *http.Server) {
+	return startKeyshareServer(t, testConfiguration(t, db, emailserver))
+}
+
+func testConfiguration(t *testing.T, db DB, emailserver string) *Configuration {
+	testdataPath := test.FindTestdataFolder(t)
+	return &Configuration{
 		Configuration: &server.Configuration{
 			SchemesPath:           filepath.Join(testdataPath, "irma_configuration"),
 			IssuerPrivateKeysPath: filepath.Join(testdataPath, "privatekeys"),
 			Logger:                irma.Logger,
+			EgressAllowedNetworks: []string{"127.0.0.0/8", "::1"},
 		},
 		EmailConfiguration: keyshare.EmailConfiguration{
 			EmailServer:     emailserver,
@@ -251,7 +1903,11 @@ func StartKeyshareServer(t *testing.T, db DB, emailserver string) (*Server, *htt
 		VerificationURL: map[string]string{
 			"en": "http://example.com/verify/",
 		},
-	})
+	}
+}
+
+func startKeyshareServer(t *testing.T, conf *Configuration) (*Server, *http.Server) {
+	s, err := New(conf)
 	require.NoError(t, err)
 
 	serv := &http.Server{
@@ -283,43 +1939,174 @@ type testDB struct {
 	tries int
 	wait  int64
 	err   error
+
+	// If set, reservePinTry takes this long, unless its context is cancelled earlier
+	delay time.Duration
+
+	// If set, setSeen and addLog fail with this error
+	logErr error
+	// Reported by failingFor
+	failing time.Duration
+}
+
+func (db *testDB) AddUser(ctx context.Context, user *User) error {
+	return db.db.AddUser(ctx, user)
+}
+
+func (db *testDB) user(ctx context.Context, username string) (*User, error) {
+	return db.db.user(ctx, username)
+}
+
+func (db *testDB) updateUser(ctx context.Context, user *User) error {
+	return db.db.updateUser(ctx, user)
+}
+
+func (db *testDB) userByOIDCSubject(ctx context.Context, subject string) (*User, error) {
+	return db.db.userByOIDCSubject(ctx, subject)
+}
+
+func (db *testDB) reservePinTry(ctx context.Context, _ *User) (bool, int, int64, error) {
+	select {
+	case <-time.After(db.delay):
+		return db.ok, db.tries, db.wait, db.err
+	case <-ctx.Done():
+		return false, 0, 0, ctx.Err()
+	}
+}
+
+func (db *testDB) pinTries(_ context.Context, _ *User) (int, int64, error) {
+	return db.tries, db.wait, db.err
+}
+
+func (db *testDB) resetPinTries(ctx context.Context, user *User) error {
+	return db.db.resetPinTries(ctx, user)
+}
+
+func (db *testDB) setSeen(ctx context.Context, user *User) error {
+	if db.logErr != nil {
+		return db.logErr
+	}
+	return db.db.setSeen(ctx, user)
+}
+
+func (db *testDB) setCredentialIssued(ctx context.Context, user *User) error {
+	return db.db.setCredentialIssued(ctx, user)
+}
+
+func (db *testDB) addLog(ctx context.Context, user *User, entrytype LogEventType, params interface{}) error {
+	if db.logErr != nil {
+		return db.logErr
+	}
+	return db.db.addLog(ctx, user, entrytype, params)
+}
+
+func (db *testDB) addEmailVerification(ctx context.Context, user *User, email, tokenHash string, validity int) error {
+	return db.db.addEmailVerification(ctx, user, email, tokenHash, validity)
+}
+
+func (db *testDB) verifyEmail(ctx context.Context, tokenHash string) error {
+	return db.db.verifyEmail(ctx, tokenHash)
+}
+
+func (db *testDB) emailVerified(ctx context.Context, user *User) (bool, error) {
+	return db.db.emailVerified(ctx, user)
+}
+
+func (db *testDB) removeEmails(ctx context.Context, user *User) error {
+	return db.db.removeEmails(ctx, user)
+}
+
+func (db *testDB) addUnsubscribeToken(ctx context.Context, user *User, email, tokenHash string) error {
+	return db.db.addUnsubscribeToken(ctx, user, email, tokenHash)
+}
+
+func (db *testDB) unsubscribe(ctx context.Context, tokenHash string) (*User, error) {
+	return db.db.unsubscribe(ctx, tokenHash)
+}
+
+func (db *testDB) addDevice(ctx context.Context, user *User, device *Device) error {
+	return db.db.addDevice(ctx, user, device)
+}
+
+func (db *testDB) device(ctx context.Context, user *User, id string) (*Device, error) {
+	return db.db.device(ctx, user, id)
+}
+
+func (db *testDB) devices(ctx context.Context, user *User) ([]*Device, error) {
+	return db.db.devices(ctx, user)
+}
+
+func (db *testDB) updateDeviceSecrets(ctx context.Context, user *User, id string, secrets keysharecore.UserSecrets) error {
+	return db.db.updateDeviceSecrets(ctx, user, id, secrets)
+}
+
+func (db *testDB) removeDevice(ctx context.Context, user *User, id string) error {
+	return db.db.removeDevice(ctx, user, id)
+}
+
+func (db *testDB) addEnrollmentCode(ctx context.Context, user *User, code string, validity time.Duration) error {
+	return db.db.addEnrollmentCode(ctx, user, code, validity)
+}
+
+func (db *testDB) consumeEnrollmentCode(ctx context.Context, user *User, code string) error {
+	return db.db.consumeEnrollmentCode(ctx, user, code)
+}
+
+func (db *testDB) addRecoveryToken(ctx context.Context, user *User, tokenHash string, validity time.Duration) error {
+	return db.db.addRecoveryToken(ctx, user, tokenHash, validity)
+}
+
+func (db *testDB) consumeRecoveryToken(ctx context.Context, tokenHash string) (*User, error) {
+	return db.db.consumeRecoveryToken(ctx, tokenHash)
+}
+
+func (db *testDB) rollupUsage(ctx context.Context, until time.Time) error {
+	return db.db.rollupUsage(ctx, until)
+}
+
+func (db *testDB) usageStats(ctx context.Context, from, to time.Time) ([]*usageStat, error) {
+	return db.db.usageStats(ctx, from, to)
+}
+
+func (db *testDB) userStats(ctx context.Context) (*userStats, error) {
+	return db.db.userStats(ctx)
 }
 
-func (db *testDB) AddUser(user *User) error {
-	return db.db.AddUser(user)
+func (db *testDB) listUsers(ctx context.Context, after string, limit int) ([]*userMetadata, error) {
+	return db.db.listUsers(ctx, after, limit)
 }
 
-func (db *testDB) user(username string) (*User, error) {
-	return db.db.user(username)
+func (db *testDB) usersAfter(ctx context.Context, after string, limit int) ([]*User, error) {
+	return db.db.usersAfter(ctx, after, limit)
 }
 
-func (db *testDB) updateUser(user *User) error {
-	return db.db.updateUser(user)
+func (db *testDB) replaceSecrets(ctx context.Context, user *User, old keysharecore.UserSecrets) (bool, error) {
+	return db.db.replaceSecrets(ctx, user, old)
 }
 
-func (db *testDB) reservePinTry(_ *User) (bool, int, int64, error) {
-	return db.ok, db.tries, db.wait, db.err
+func (db *testDB) deleteExpiredEmailVerifications(ctx context.Context, limit int) (int, error) {
+	return db.db.deleteExpiredEmailVerifications(ctx, limit)
 }
 
-func (db *testDB) resetPinTries(user *User) error {
-	return db.db.resetPinTries(user)
+func (db *testDB) deleteLogsBefore(ctx context.Context, t time.Time, keepTypes []LogEventType, limit int) (int, error) {
+	return db.db.deleteLogsBefore(ctx, t, keepTypes, limit)
 }
 
-func (db *testDB) setSeen(user *User) error {
-	return db.db.setSeen(user)
+func (db *testDB) rebuildUsage(ctx context.Context, day time.Time) error {
+	return db.db.rebuildUsage(ctx, day)
 }
 
-func (db *testDB) addLog(user *User, entrytype eventType, params interface{}) error {
-	return db.db.addLog(user, entrytype, params)
+func (db *testDB) instrument(instr keyshare.DBInstrumentation) {
+	db.db.instrument(instr)
 }
 
-func (db *testDB) addEmailVerification(user *User, email, token string) error {
-	return db.db.addEmailVerification(user, email, token)
+func (db *testDB) failingFor() time.Duration {
+	return db.failing
 }
 
 func createDB(t *testing.T) DB {
 	db := NewMemoryDB()
-	err := db.AddUser(&User{
+	err := db.AddUser(context.Background(), &User{
 		Username: "",
 		Secrets:  keysharecore.UserSecrets{},
 	})
@@ -328,7 +2115,7 @@ func createDB(t *testing.T) DB {
 	bts, err := base64.StdEncoding.DecodeString("YWJjZK4w5SC+7D4lDrhiJGvB1iwxSeF90dGGPoGqqG7g3ivbfHibOdkKoOTZPbFlttBzn2EJgaEsL24Re8OWWWw5pd31/GCd14RXcb9Wy2oWhbr0pvJDLpIxXZt/qiQC0nJiIAYWLGZOdj5o0irDfqP1CSfw3IoKkVEl4lHRj0LCeINJIOpEfGlFtl4DHlWu8SMQFV1AIm3Gv64XzGncdkclVd41ti7cicBrcK8N2u9WvY/jCS4/Lxa2syp/O4IY")
 	require.NoError(t, err)
 	copy(secrets[:], bts)
-	err = db.AddUser(&User{
+	err = db.AddUser(context.Background(), &User{
 		Username: "testusername",
 		Secrets:  secrets,
 	})
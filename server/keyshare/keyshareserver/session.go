@@ -1,10 +1,15 @@
 package keyshareserver
 
 import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"sync"
 	"time"
 
 	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
 )
 
 type session struct {
@@ -19,34 +24,253 @@ type sessionStore interface {
 	flush()
 }
 
-type memorySessionStore struct {
-	sync.Mutex
+// Number of shards of the memorySessionStore. Each shard has its own lock, so that requests of
+// different users seldom contend for the same lock.
+const sessionStoreShards = 64
 
-	sessions        map[string]*session
+// memorySessionStore keeps the sessions in memory, sharded by a hash of the username.
+type memorySessionStore struct {
+	shards          [sessionStoreShards]sessionStoreShard
 	sessionLifetime time.Duration
 }
 
+type sessionStoreShard struct {
+	sync.Mutex
+	sessions map[string]*session
+	_        [48]byte // pad to a cache line, so that the locks of adjacent shards do not share one
+}
+
 func newMemorySessionStore(sessionLifetime time.Duration) sessionStore {
-	return &memorySessionStore{
-		sessionLifetime: sessionLifetime,
-		sessions:        map[string]*session{},
+	s := &memorySessionStore{sessionLifetime: sessionLifetime}
+	for i := range s.shards {
+		s.shards[i].sessions = map[string]*session{}
+	}
+	return s
+}
+
+// shard returns the shard of the user, using the FNV-1a hash of the username (computed inline, as
+// hash/fnv would allocate on each call).
+func (s *memorySessionStore) shard(username string) *sessionStoreShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(username); i++ {
+		h ^= uint32(username[i])
+		h *= 16777619
 	}
+	return &s.shards[h%sessionStoreShards]
 }
 
 func (s *memorySessionStore) add(username string, session *session) {
-	s.Lock()
-	defer s.Unlock()
+	shard := s.shard(username)
+	shard.Lock()
+	defer shard.Unlock()
 	session.expiry = time.Now().Add(s.sessionLifetime)
-	s.sessions[username] = session
+	shard.sessions[username] = session
 }
 
+// get returns the session of the user, or nil if it does not exist or has expired
+// (even if it has not yet been flushed).
 func (s *memorySessionStore) get(username string) *session {
+	shard := s.shard(username)
+	shard.Lock()
+	defer shard.Unlock()
+	session := shard.sessions[username]
+	if session == nil || time.Now().After(session.expiry) {
+		return nil
+	}
+	return session
+}
+
+func (s *memorySessionStore) flush() {
+	now := time.Now()
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.Lock()
+		for k, v := range shard.sessions {
+			if now.After(v.expiry) {
+				delete(shard.sessions, k)
+			}
+		}
+		shard.Unlock()
+	}
+}
+
+// Time after their last PIN attempt (or the end of their blocking) after which the synthetic
+// PIN attempts of unknown users are forgotten
+const unknownUserLifetime = time.Hour
+
+// Maximum amount of unknown users of which the synthetic PIN attempts are remembered
+const maxUnknownUsers = 100000
+
+// unknownUserStore keeps track of synthetic PIN attempts of unknown users, which are reported
+// instead of an error if Configuration.UniformPinResponses is enabled. It mimics the PIN attempt
+// counter and exponential backoff of existing users, so that the responses do not reveal whether
+// an account exists. The initial amount of previous failed attempts is derived from a keyed hash
+// of the username, so that it is stable but differs per user. At most max unknown users are
+// remembered; when more are added, the least recently used ones are forgotten.
+type unknownUserStore struct {
+	sync.Mutex
+
+	key   []byte
+	max   int
+	users map[string]*list.Element
+	lru   *list.List // of *unknownUser, most recently used first
+}
+
+type unknownUser struct {
+	username     string
+	counter      int
+	blockedUntil time.Time
+	expiry       time.Time
+}
+
+// newUnknownUserStore returns an unknownUserStore using the specified key, or a random key if it is
+// nil, remembering at most max unknown users.
+func newUnknownUserStore(key []byte, max int) (*unknownUserStore, error) {
+	if key == nil {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &unknownUserStore{key: key, max: max, users: map[string]*list.Element{}, lru: list.New()}, nil
+}
+
+// user returns the unknown user, creating it if necessary. The store must be locked.
+func (s *unknownUserStore) user(username string) *unknownUser {
+	if elem := s.users[username]; elem != nil {
+		s.lru.MoveToFront(elem)
+		return elem.Value.(*unknownUser)
+	}
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(username))
+	user := &unknownUser{username: username, counter: int(mac.Sum(nil)[0]) % maxPinTries}
+	s.users[username] = s.lru.PushFront(user)
+	if s.lru.Len() > s.max {
+		s.remove(s.lru.Back())
+	}
+	return user
+}
+
+// remove forgets the unknown user in the specified element. The store must be locked.
+func (s *unknownUserStore) remove(elem *list.Element) {
+	s.lru.Remove(elem)
+	delete(s.users, elem.Value.(*unknownUser).username)
+}
+
+// pinStatus registers a failed PIN attempt for the unknown user, returning the resulting status.
+func (s *unknownUserStore) pinStatus(username string) irma.KeysharePinStatus {
 	s.Lock()
 	defer s.Unlock()
-	return s.sessions[username]
+
+	now := time.Now()
+	user := s.user(username)
+
+	// Like postgresDB.reservePinTry() and Server.verifyPin()
+	if wait := int64(user.blockedUntil.Sub(now).Seconds()); wait > 0 {
+		return pinStatusBlocked(wait)
+	}
+	user.counter++
+	tries := maxPinTries - user.counter
+	if tries > 0 {
+		user.expiry = now.Add(unknownUserLifetime)
+		return pinStatusFailure(tries)
+	}
+	wait := backoffStart << uint(user.counter-maxPinTries)
+	user.blockedUntil = now.Add(time.Duration(wait) * time.Second)
+	user.expiry = user.blockedUntil.Add(unknownUserLifetime)
+	return pinStatusBlocked(wait)
 }
 
-func (s *memorySessionStore) flush() {
+// pinAttempts returns the remaining PIN attempts of the unknown user, like postgresDB.pinTries().
+func (s *unknownUserStore) pinAttempts(username string) irma.KeysharePinAttempts {
+	s.Lock()
+	defer s.Unlock()
+
+	user := s.user(username)
+	if user.expiry.IsZero() {
+		user.expiry = time.Now().Add(unknownUserLifetime)
+	}
+	if wait := int64(time.Until(user.blockedUntil).Seconds()); wait > 0 {
+		return irma.KeysharePinAttempts{Blocked: wait}
+	}
+	tries := maxPinTries - user.counter
+	if tries < 1 {
+		tries = 1
+	}
+	return irma.KeysharePinAttempts{Remaining: tries}
+}
+
+func (s *unknownUserStore) flush() {
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+	for _, elem := range s.users {
+		if now.After(elem.Value.(*unknownUser).expiry) {
+			s.remove(elem)
+		}
+	}
+}
+
+// Time after which the token of a registration session can no longer be used to follow the session,
+// which is by then forgotten by the IRMA server anyway
+const registrationSessionLifetime = time.Hour
+
+// registrationSessionStore keeps track of the issuance sessions of the keyshare credential started
+// on registration, by the token returned to the frontend, so that no other sessions of the IRMA
+// server can be reached using these tokens.
+type registrationSessionStore struct {
+	sync.Mutex
+	sessions map[string]*registrationSession
+}
+
+type registrationSession struct {
+	requestorToken irma.RequestorToken
+	user           *User
+	issued         bool
+	expiry         time.Time
+}
+
+func newRegistrationSessionStore() *registrationSessionStore {
+	return &registrationSessionStore{sessions: map[string]*registrationSession{}}
+}
+
+// add returns a new token for the registration session of the user.
+func (s *registrationSessionStore) add(user *User, requestorToken irma.RequestorToken) string {
+	s.Lock()
+	defer s.Unlock()
+	token := common.NewSessionToken()
+	s.sessions[token] = &registrationSession{
+		requestorToken: requestorToken,
+		user:           user,
+		expiry:         time.Now().Add(registrationSessionLifetime),
+	}
+	return token
+}
+
+// get returns the unexpired registration session of the token, or nil if there is none.
+func (s *registrationSessionStore) get(token string) *registrationSession {
+	s.Lock()
+	defer s.Unlock()
+	session := s.sessions[token]
+	if session == nil || time.Now().After(session.expiry) {
+		return nil
+	}
+	return session
+}
+
+// setIssued records that the keyshare credential was issued in the registration session,
+// returning whether this was not already recorded.
+func (s *registrationSessionStore) setIssued(session *registrationSession) bool {
+	s.Lock()
+	defer s.Unlock()
+	if session.issued {
+		return false
+	}
+	session.issued = true
+	return true
+}
+
+func (s *registrationSessionStore) flush() {
 	now := time.Now()
 	s.Lock()
 	defer s.Unlock()
@@ -56,3 +280,65 @@ func (s *memorySessionStore) flush() {
 		}
 	}
 }
+
+// pinMessageStore remembers the ephemeral keys of the encrypted PIN messages received during
+// their lifetime, so that replays of them can be refused. As the encryption key of a message is
+// derived from its ephemeral key, a replayed message necessarily carries the same ephemeral key.
+type pinMessageStore struct {
+	sync.Mutex
+	messages map[string]time.Time
+}
+
+func newPinMessageStore() *pinMessageStore {
+	return &pinMessageStore{messages: map[string]time.Time{}}
+}
+
+// add records the message, which is accepted until the specified expiry, returning whether it was
+// not already recorded.
+func (s *pinMessageStore) add(msg *irma.KeyshareEncryptedMessage, expiry time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+	key := string(msg.EphemeralKey)
+	if _, ok := s.messages[key]; ok {
+		return false
+	}
+	s.messages[key] = expiry
+	return true
+}
+
+func (s *pinMessageStore) flush() {
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+	for k, expiry := range s.messages {
+		if now.After(expiry) {
+			delete(s.messages, k)
+		}
+	}
+}
+
+// requestLimiter counts requests per key (e.g. username or IP address) in the current minute.
+type requestLimiter struct {
+	sync.Mutex
+	counts map[string]int
+}
+
+func newRequestLimiter() *requestLimiter {
+	return &requestLimiter{counts: map[string]int{}}
+}
+
+func (l *requestLimiter) allow(key string, max int) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.counts[key] >= max {
+		return false
+	}
+	l.counts[key]++
+	return true
+}
+
+func (l *requestLimiter) reset() {
+	l.Lock()
+	defer l.Unlock()
+	l.counts = map[string]int{}
+}
@@ -0,0 +1,161 @@
+package keyshareserver
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemorySessionStore(t *testing.T) {
+	store := newMemorySessionStore(50 * time.Millisecond).(*memorySessionStore)
+
+	store.add("testuser", &session{CommitID: 1})
+	store.add("otheruser", &session{CommitID: 2})
+	require.Equal(t, uint64(1), store.get("testuser").CommitID)
+	require.Equal(t, uint64(2), store.get("otheruser").CommitID)
+	require.Nil(t, store.get("nonexistent"))
+
+	// Adding a session replaces the previous one
+	store.add("testuser", &session{CommitID: 3})
+	require.Equal(t, uint64(3), store.get("testuser").CommitID)
+
+	// Expired sessions are not returned, also before they are flushed
+	time.Sleep(60 * time.Millisecond)
+	require.Nil(t, store.get("testuser"))
+	store.add("otheruser", &session{CommitID: 4})
+	store.flush()
+	require.Nil(t, store.get("testuser"))
+	require.Equal(t, uint64(4), store.get("otheruser").CommitID)
+
+	count := 0
+	for i := range store.shards {
+		count += len(store.shards[i].sessions)
+	}
+	require.Equal(t, 1, count)
+}
+
+func TestMemorySessionStoreConcurrentFlush(t *testing.T) {
+	store := newMemorySessionStore(time.Millisecond)
+	usernames := testUsernames(16)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				store.flush()
+			}
+		}
+	}()
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 2000; j++ {
+				username := usernames[(i+j)%len(usernames)]
+				if j%4 == 0 {
+					store.add(username, &session{CommitID: uint64(j)})
+					continue
+				}
+				now := time.Now()
+				if s := store.get(username); s != nil && now.After(s.expiry) {
+					t.Errorf("expired session of %s returned", username)
+					return
+				}
+			}
+		}(i)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	close(done)
+	wg.Wait()
+}
+
+// singleLockSessionStore is a session store guarded by a single lock, as memorySessionStore used
+// to be, serving as baseline in the benchmarks.
+type singleLockSessionStore struct {
+	sync.Mutex
+
+	sessions        map[string]*session
+	sessionLifetime time.Duration
+}
+
+func (s *singleLockSessionStore) add(username string, session *session) {
+	s.Lock()
+	defer s.Unlock()
+	session.expiry = time.Now().Add(s.sessionLifetime)
+	s.sessions[username] = session
+}
+
+func (s *singleLockSessionStore) get(username string) *session {
+	s.Lock()
+	defer s.Unlock()
+	return s.sessions[username]
+}
+
+func (s *singleLockSessionStore) flush() {
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+	for k, v := range s.sessions {
+		if now.After(v.expiry) {
+			delete(s.sessions, k)
+		}
+	}
+}
+
+func testUsernames(n int) []string {
+	usernames := make([]string, n)
+	for i := range usernames {
+		usernames[i] = fmt.Sprintf("user%d", i)
+	}
+	return usernames
+}
+
+// BenchmarkSessionStore compares the stores under parallel load. In the keyshare protocol each
+// session adds the user's session when generating commitments and gets it when generating the
+// response, so a realistic mix consists of about as many gets as adds.
+func BenchmarkSessionStore(b *testing.B) {
+	stores := map[string]func() sessionStore{
+		"single lock": func() sessionStore {
+			return &singleLockSessionStore{sessions: map[string]*session{}, sessionLifetime: 10 * time.Second}
+		},
+		"sharded": func() sessionStore {
+			return newMemorySessionStore(10 * time.Second)
+		},
+	}
+	usernames := testUsernames(10000)
+
+	for _, name := range []string{"single lock", "sharded"} {
+		for _, reads := range []int{50, 90} {
+			b.Run(fmt.Sprintf("%s/%d%% reads", name, reads), func(b *testing.B) {
+				store := stores[name]()
+				for _, username := range usernames {
+					store.add(username, &session{})
+				}
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					r := rand.New(rand.NewSource(time.Now().UnixNano()))
+					for pb.Next() {
+						username := usernames[r.Intn(len(usernames))]
+						if r.Intn(100) < reads {
+							store.get(username)
+						} else {
+							store.add(username, &session{})
+						}
+					}
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,13 @@
+-- Migrates a database created using an earlier version of schema.sql by adding the table of the
+-- unsubscribe tokens included in the emails sent by the keyshare server, with which email addresses
+-- can be removed without logging in. This can be run while the keyshare server and MyIRMA server
+-- are using the database, but must be run before updating the keyshare server.
+CREATE TABLE IF NOT EXISTS irma.email_unsubscribe_tokens
+(
+    id serial PRIMARY KEY,
+    token_hash text NOT NULL,
+    email text NOT NULL,
+    user_id int NOT NULL REFERENCES irma.users (id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX IF NOT EXISTS email_unsubscribe_token_index ON irma.email_unsubscribe_tokens (token_hash);
+CREATE INDEX IF NOT EXISTS email_unsubscribe_token_user_index ON irma.email_unsubscribe_tokens (user_id, email);
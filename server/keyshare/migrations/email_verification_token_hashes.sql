@@ -0,0 +1,8 @@
+-- Migrates a database created using an earlier version of schema.sql, in which email verification
+-- tokens were stored as is, to storing only their SHA-256 hashes (see keyshare.HashEmailToken).
+-- Outstanding tokens remain valid. Run this once, while no keyshare server or MyIRMA server is
+-- using the database. Requires PostgreSQL 11 or higher.
+BEGIN;
+ALTER TABLE irma.email_verification_tokens RENAME COLUMN token TO token_hash;
+UPDATE irma.email_verification_tokens SET token_hash = encode(sha256(convert_to(token_hash, 'UTF8')), 'hex');
+COMMIT;
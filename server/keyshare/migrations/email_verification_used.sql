@@ -0,0 +1,5 @@
+-- Migrates a database created using an earlier version of schema.sql by adding the used column of
+-- irma.email_verification_tokens, with which the keyshare server ensures that each email verification
+-- token can be used only once. Outstanding tokens remain valid. This can be run while the keyshare
+-- server and MyIRMA server are using the database, but must be run before updating them.
+ALTER TABLE irma.email_verification_tokens ADD COLUMN IF NOT EXISTS used boolean NOT NULL DEFAULT FALSE;
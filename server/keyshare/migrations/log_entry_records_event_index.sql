@@ -0,0 +1,5 @@
+-- Migrates a database created using an earlier version of schema.sql by adding the index on the event
+-- type and time of log entries, with which the keyshare server aggregates its daily usage statistics
+-- (see usage_stats.sql). The index is created without locking the table against writes, so this can be
+-- run while the keyshare server and MyIRMA server are using the database.
+CREATE INDEX CONCURRENTLY IF NOT EXISTS log_entry_records_event_index ON irma.log_entry_records (event, time);
@@ -0,0 +1,5 @@
+-- Migrates a database created using an earlier version of schema.sql by adding the index on the time
+-- of log entries, with which the keyshare server deletes the entries whose retention period has passed
+-- (see the log_retention setting). The index is created without locking the table against writes,
+-- so this can be run while the keyshare server and MyIRMA server are using the database.
+CREATE INDEX CONCURRENTLY IF NOT EXISTS log_entry_records_time_index ON irma.log_entry_records (time);
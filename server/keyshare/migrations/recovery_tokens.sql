@@ -0,0 +1,13 @@
+-- Migrates a database created using an earlier version of schema.sql by adding the table of the hashes of
+-- the recovery tokens, with which users re-enroll to their existing account. This can be run while the
+-- keyshare server and MyIRMA server are using the database, but must be run before updating the
+-- keyshare server.
+CREATE TABLE IF NOT EXISTS irma.recovery_tokens
+(
+    id serial PRIMARY KEY,
+    token_hash text NOT NULL,
+    expiry bigint NOT NULL,
+    user_id int NOT NULL REFERENCES irma.users (id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX IF NOT EXISTS recovery_token_index ON irma.recovery_tokens (token_hash);
+CREATE UNIQUE INDEX IF NOT EXISTS recovery_token_user_index ON irma.recovery_tokens (user_id);
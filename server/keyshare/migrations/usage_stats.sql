@@ -0,0 +1,13 @@
+-- Migrates a database created using an earlier version of schema.sql by adding the table of the daily
+-- usage statistics aggregated by the keyshare server. The last aggregated day in this table is where the
+-- next aggregation continues, so the first aggregation after this migration covers all days since the
+-- first keyshare session still in irma.log_entry_records (days of which log entries were already deleted,
+-- see the log_retention setting, are counted incompletely). This can be run while the keyshare server
+-- and MyIRMA server are using the database, but must be run before updating the keyshare server, after
+-- log_entry_records_event_index.sql.
+CREATE TABLE IF NOT EXISTS irma.usage_stats
+(
+    date date PRIMARY KEY,
+    sessions int NOT NULL,
+    users int NOT NULL
+);
@@ -0,0 +1,5 @@
+-- Migrates a database created using an earlier version of schema.sql by adding the created column of
+-- irma.users, in which the keyshare server records when an account was registered. It remains empty for
+-- existing accounts, whose registration time is not known. This can be run while the keyshare server and
+-- MyIRMA server are using the database, but must be run before updating the keyshare server.
+ALTER TABLE irma.users ADD COLUMN IF NOT EXISTS created bigint;
@@ -0,0 +1,6 @@
+-- Migrates a database created using an earlier version of schema.sql by adding the credential_issued
+-- column of irma.users, in which the keyshare server records whether the keyshare credential was issued
+-- after registration. It remains empty for existing accounts, which are considered to have received
+-- their credential, so that they are not deleted. This can be run while the keyshare server and MyIRMA
+-- server are using the database, but must be run before updating the keyshare server.
+ALTER TABLE irma.users ADD COLUMN IF NOT EXISTS credential_issued boolean;
@@ -0,0 +1,24 @@
+-- Migrates a database created using an earlier version of schema.sql by adding the tables of the devices
+-- enrolled to an account and of the enrollment codes with which they enroll, with which a keyshare
+-- account can be used on multiple devices. Existing accounts keep using only the device on which they
+-- were registered. This can be run while the keyshare server and MyIRMA server are using the database,
+-- but must be run before updating the keyshare server.
+CREATE TABLE IF NOT EXISTS irma.user_devices
+(
+    id serial PRIMARY KEY,
+    user_id int NOT NULL REFERENCES irma.users (id) ON DELETE CASCADE,
+    device_id text NOT NULL,
+    name text NOT NULL,
+    coredata bytea NOT NULL,
+    created bigint NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS user_devices_index ON irma.user_devices (user_id, device_id);
+
+CREATE TABLE IF NOT EXISTS irma.device_enrollment_codes
+(
+    id serial PRIMARY KEY,
+    code text NOT NULL,
+    expiry bigint NOT NULL,
+    user_id int NOT NULL REFERENCES irma.users (id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX IF NOT EXISTS device_enrollment_code_index ON irma.device_enrollment_codes (user_id, code);
@@ -0,0 +1,6 @@
+-- Migrates a database created using an earlier version of schema.sql by adding the oidc_subject column
+-- of irma.users and its unique index, with which the keyshare server binds accounts to an OpenID Connect
+-- identity. Existing accounts remain unbound. This can be run while the keyshare server and MyIRMA
+-- server are using the database, but must be run before updating the keyshare server.
+ALTER TABLE irma.users ADD COLUMN IF NOT EXISTS oidc_subject text;
+CREATE UNIQUE INDEX IF NOT EXISTS oidc_subject_index ON irma.users (oidc_subject);
@@ -0,0 +1,5 @@
+-- Migrates a database created using an earlier version of schema.sql by adding the version column of
+-- irma.users, which the keyshare server increments on each update of the secrets of a user to detect
+-- concurrent updates. This can be run while the keyshare server and MyIRMA server are using the
+-- database, but must be run before updating the keyshare server.
+ALTER TABLE irma.users ADD COLUMN IF NOT EXISTS version int NOT NULL DEFAULT 0;
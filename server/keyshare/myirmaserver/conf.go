@@ -45,7 +45,7 @@ type Configuration struct {
 	// Session lifetime in seconds
 	SessionLifetime int `json:"session_lifetime" mapstructure:"session_lifetime"`
 
-	// Keyshare attributes to use for login
+	// Keyshare attributes to use for login, any one of which users can disclose
 	KeyshareAttributes []irma.AttributeTypeIdentifier `json:"keyshare_attributes" mapstructure:"keyshare_attributes"`
 	EmailAttributes    []irma.AttributeTypeIdentifier `json:"email_attributes" mapstructure:"email_attributes"`
 
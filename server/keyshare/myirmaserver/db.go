@@ -9,7 +9,7 @@ type db interface {
 
 	userIDByUsername(username string) (int64, error)
 
-	verifyEmailToken(token string) (int64, error)
+	verifyEmailToken(tokenHash string) (int64, error)
 	verifyLoginToken(token, username string) (int64, error)
 
 	scheduleUserRemoval(id int64, delay time.Duration) error
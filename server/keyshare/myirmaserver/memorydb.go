@@ -19,7 +19,7 @@ type memoryDB struct {
 	userData map[string]memoryUserData
 
 	loginEmailTokens  map[string]string
-	verifyEmailTokens map[string]int64
+	verifyEmailTokens map[string]int64 // per token hash
 }
 
 func newMemoryDB() db {
@@ -52,18 +52,18 @@ func (db *memoryDB) scheduleUserRemoval(id int64, _ time.Duration) error {
 	return keyshare.ErrUserNotFound
 }
 
-func (db *memoryDB) verifyEmailToken(token string) (int64, error) {
+func (db *memoryDB) verifyEmailToken(tokenHash string) (int64, error) {
 	db.Lock()
 	defer db.Unlock()
 
-	userID, ok := db.verifyEmailTokens[token]
+	userID, ok := db.verifyEmailTokens[tokenHash]
 	if !ok {
 		// We return this particular error in this case for consistency with the postgres DB.
 		// The calling function replaces this with a more informative error for the frontend.
 		return 0, keyshare.ErrUserNotFound
 	}
 
-	delete(db.verifyEmailTokens, token)
+	delete(db.verifyEmailTokens, tokenHash)
 
 	return userID, nil
 }
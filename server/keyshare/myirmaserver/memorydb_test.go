@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/privacybydesign/irmago/server/keyshare"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -17,7 +18,7 @@ func TestMemoryDBUserManagement(t *testing.T) {
 			},
 		},
 		verifyEmailTokens: map[string]int64{
-			"testtoken": 15,
+			keyshare.HashEmailToken("testtoken"): 15,
 		},
 	}
 
@@ -25,11 +26,11 @@ func TestMemoryDBUserManagement(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, int64(15), id)
 
-	id, err = db.verifyEmailToken("testtoken")
+	id, err = db.verifyEmailToken(keyshare.HashEmailToken("testtoken"))
 	assert.NoError(t, err)
 	assert.Equal(t, int64(15), id)
 
-	_, err = db.verifyEmailToken("testtoken")
+	_, err = db.verifyEmailToken(keyshare.HashEmailToken("testtoken"))
 	assert.Error(t, err)
 
 	_, err = db.userIDByUsername("DNE")
@@ -6,7 +6,6 @@ import (
 
 	"github.com/go-errors/errors"
 	_ "github.com/jackc/pgx/stdlib"
-	"github.com/privacybydesign/irmago/server"
 	"github.com/privacybydesign/irmago/server/keyshare"
 )
 
@@ -39,13 +38,14 @@ func (db *postgresDB) userIDByUsername(username string) (int64, error) {
 	return id, db.db.QueryUser("SELECT id FROM irma.users WHERE username = $1", []interface{}{&id}, username)
 }
 
-func (db *postgresDB) verifyEmailToken(token string) (int64, error) {
+func (db *postgresDB) verifyEmailToken(tokenHash string) (int64, error) {
+	// Mark the token as used in the same query that checks it, so that it can be used only once
 	var email string
 	var id int64
 	err := db.db.QueryScan(
-		"SELECT user_id, email FROM irma.email_verification_tokens WHERE token = $1 AND expiry >= $2",
+		"UPDATE irma.email_verification_tokens SET used = TRUE WHERE token_hash = $1 AND expiry >= $2 AND NOT used RETURNING user_id, email",
 		[]interface{}{&id, &email},
-		token, time.Now().Unix())
+		tokenHash, time.Now().Unix())
 	if err == sql.ErrNoRows {
 		return 0, errTokenNotFound
 	}
@@ -57,17 +57,6 @@ func (db *postgresDB) verifyEmailToken(token string) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
-
-	// Beyond this point, errors are no longer relevant for frontend, so only log
-	aff, err := db.db.ExecCount("DELETE FROM irma.email_verification_tokens WHERE token = $1", token)
-	if err != nil {
-		_ = server.LogError(err)
-		return id, nil
-	}
-	if aff != 1 {
-		_ = server.LogError(errors.Errorf("Unexpected number of deleted records %d for token", aff))
-		return id, nil
-	}
 	return id, nil
 }
 
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server/keyshare"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -21,7 +22,7 @@ func TestPostgresDBUserManagement(t *testing.T) {
 	pdb := db.(*postgresDB)
 	_, err = pdb.db.Exec("INSERT INTO irma.users (id, username, last_seen, language, coredata, pin_counter, pin_block_date) VALUES (15, 'testuser', 0, '', '', 0,0)")
 	require.NoError(t, err)
-	_, err = pdb.db.Exec("INSERT INTO irma.email_verification_tokens (token, email, expiry, user_id) VALUES ('testtoken', 'test@test.com', $1, 15)", time.Now().Unix())
+	_, err = pdb.db.Exec("INSERT INTO irma.email_verification_tokens (token_hash, email, expiry, user_id) VALUES ($1, 'test@test.com', $2, 15)", keyshare.HashEmailToken("testtoken"), time.Now().Unix())
 	require.NoError(t, err)
 
 	id, err := db.userIDByUsername("testuser")
@@ -32,7 +33,7 @@ func TestPostgresDBUserManagement(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, []userEmail(nil), user.Emails)
 
-	id, err = db.verifyEmailToken("testtoken")
+	id, err = db.verifyEmailToken(keyshare.HashEmailToken("testtoken"))
 	assert.NoError(t, err)
 	assert.Equal(t, int64(15), id)
 
@@ -40,7 +41,7 @@ func TestPostgresDBUserManagement(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, []userEmail{{Email: "test@test.com", DeleteInProgress: false}}, user.Emails)
 
-	_, err = db.verifyEmailToken("testtoken")
+	_, err = db.verifyEmailToken(keyshare.HashEmailToken("testtoken"))
 	assert.Error(t, err)
 
 	_, err = db.userIDByUsername("DNE")
@@ -34,6 +34,12 @@ var (
 	errInvalidEmail = errors.New("Email not associated with account")
 )
 
+// Key of the session that sessionMiddleware stores in the request context,
+// of an unexported type so that it cannot collide with those of other packages.
+type contextKey int
+
+const sessionKey contextKey = 0
+
 func New(conf *Configuration) (*Server, error) {
 	irmaserv, err := irmaserver.New(conf.Configuration)
 	if err != nil {
@@ -70,6 +76,9 @@ func (s *Server) Stop() {
 	s.schedulerStop <- true
 }
 
+// Handler returns a http.Handler that handles all MyIRMA server requests. To protect the http.Server
+// serving it against slow clients, apply the ConfigureHTTPServer() and LimitListener() methods of
+// the server.Configuration to it.
 func (s *Server) Handler() http.Handler {
 	router := chi.NewRouter()
 
@@ -174,7 +183,10 @@ func (s *Server) sendDeleteEmails(session *session) error {
 }
 
 func (s *Server) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
-	session := r.Context().Value("session").(*session)
+	session, ok := s.requestSession(w, r)
+	if !ok {
+		return
+	}
 
 	// First, send emails
 	if s.conf.EmailServer != "" {
@@ -372,14 +384,23 @@ func (s *Server) processLoginIrmaSessionResult(session *session) (server.Error,
 	return server.Error{}, ""
 }
 
+// loginRequest returns the disclosure request for logging in, in which any one of the keyshare
+// attributes can be disclosed.
+func (s *Server) loginRequest() *irma.DisclosureRequest {
+	discon := irma.AttributeDisCon{}
+	for _, attr := range s.conf.KeyshareAttributes {
+		discon = append(discon, irma.AttributeCon{{Type: attr}})
+	}
+	request := irma.NewDisclosureRequest()
+	request.Disclose = irma.AttributeConDisCon{discon}
+	return request
+}
+
 func (s *Server) handleIrmaLogin(w http.ResponseWriter, r *http.Request) {
 	session := s.store.create()
 	sessiontoken := session.token
 
-	qr, loginToken, frontendRequest, err := s.irmaserv.StartSession(
-		irma.NewDisclosureRequest(s.conf.KeyshareAttributes...),
-		nil,
-	)
+	qr, loginToken, frontendRequest, err := s.irmaserv.StartSession(s.loginRequest(), nil)
 	if err != nil {
 		s.conf.Logger.WithField("error", err).Error("Error during startup of IRMA session for login")
 		server.WriteError(w, server.ErrorInternal, err.Error())
@@ -401,7 +422,7 @@ func (s *Server) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, err := s.db.verifyEmailToken(token)
+	id, err := s.db.verifyEmailToken(keyshare.HashEmailToken(token))
 	if err == errTokenNotFound {
 		s.conf.Logger.Info("Unknown email verification token")
 		server.WriteError(w, server.ErrorInvalidRequest, "Unknown email verification token")
@@ -439,7 +460,10 @@ func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleUserInfo(w http.ResponseWriter, r *http.Request) {
-	session := r.Context().Value("session").(*session)
+	session, ok := s.requestSession(w, r)
+	if !ok {
+		return
+	}
 
 	// Handle finished IRMA session used for adding email address, if any
 	if session.emailSessionToken != "" {
@@ -475,7 +499,10 @@ func (s *Server) handleGetLogs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session := r.Context().Value("session").(*session)
+	session, ok := s.requestSession(w, r)
+	if !ok {
+		return
+	}
 	entries, err := s.db.logs(*session.userID, offset, 11)
 	if err != nil {
 		s.conf.Logger.WithField("error", err).Error("Could not load log entries")
@@ -539,7 +566,10 @@ func (s *Server) handleRemoveEmail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session := r.Context().Value("session").(*session)
+	session, ok := s.requestSession(w, r)
+	if !ok {
+		return
+	}
 	err := s.processRemoveEmail(session, email)
 	if err == errInvalidEmail {
 		server.WriteError(w, server.ErrorInvalidRequest, "Not a valid email address for user")
@@ -590,7 +620,10 @@ func (s *Server) processAddEmailIrmaSessionResult(session *session) (server.Erro
 }
 
 func (s *Server) handleAddEmail(w http.ResponseWriter, r *http.Request) {
-	session := r.Context().Value("session").(*session)
+	session, ok := s.requestSession(w, r)
+	if !ok {
+		return
+	}
 
 	qr, emailToken, frontendRequest, err := s.irmaserv.StartSession(
 		irma.NewDisclosureRequest(s.conf.EmailAttributes...),
@@ -623,10 +656,23 @@ func (s *Server) sessionMiddleware(next http.Handler) http.Handler {
 
 		session.Lock()
 		defer session.Unlock()
-		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "session", session)))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionKey, session)))
 	})
 }
 
+// requestSession returns the session that sessionMiddleware stored in the request context. If it is
+// missing, which happens only if the handler was mounted without sessionMiddleware, it logs this
+// and writes an internal server error.
+func (s *Server) requestSession(w http.ResponseWriter, r *http.Request) (*session, bool) {
+	session, ok := r.Context().Value(sessionKey).(*session)
+	if !ok || session == nil {
+		s.conf.Logger.WithField("path", r.URL.Path).Error("No session in request context: handler not mounted behind sessionMiddleware")
+		server.WriteError(w, server.ErrorInternal, "")
+		return nil, false
+	}
+	return session, true
+}
+
 func (s *Server) staticFilesHandler() http.Handler {
 	return http.StripPrefix(s.conf.StaticPrefix, http.FileServer(http.Dir(s.conf.StaticPath)))
 }
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server/keyshare"
 )
 
 func TestServerLoginEmail(t *testing.T) {
@@ -26,7 +27,7 @@ func TestServerLoginEmail(t *testing.T) {
 			"testtoken": "test@test.com",
 		},
 		verifyEmailTokens: map[string]int64{
-			"testemailtoken": 15,
+			keyshare.HashEmailToken("testemailtoken"): 15,
 		},
 	}
 	myirmaServer, httpServer := StartMyIrmaServer(t, db, "localhost:1025")
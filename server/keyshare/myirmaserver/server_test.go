@@ -70,6 +70,18 @@ func TestServerIrmaSessions(t *testing.T) {
 	test.HTTPPost(t, client, "http://localhost:8081/email/add", "", nil, 200, nil)
 }
 
+func TestServerLoginRequest(t *testing.T) {
+	primary := irma.NewAttributeTypeIdentifier("test.test.mijnirma.email")
+	secondary := irma.NewAttributeTypeIdentifier("test.test.email.email")
+	s := &Server{conf: &Configuration{KeyshareAttributes: []irma.AttributeTypeIdentifier{primary, secondary}}}
+
+	// Disclosing any one of the keyshare attributes suffices
+	require.Equal(t, irma.AttributeConDisCon{{
+		{{Type: primary}},
+		{{Type: secondary}},
+	}}, s.loginRequest().Disclose)
+}
+
 func TestServerSessionMgmnt(t *testing.T) {
 	db := &memoryDB{
 		userData: map[string]memoryUserData{
@@ -87,7 +99,7 @@ func TestServerSessionMgmnt(t *testing.T) {
 			"testtoken": "test@test.com",
 		},
 		verifyEmailTokens: map[string]int64{
-			"testemailtoken": 15,
+			keyshare.HashEmailToken("testemailtoken"): 15,
 		},
 	}
 	myirmaServer, httpServer := StartMyIrmaServer(t, db, "")
@@ -9,9 +9,44 @@ CREATE TABLE IF NOT EXISTS irma.users
     last_seen bigint NOT NULL,
     pin_counter int NOT NULL,
     pin_block_date bigint NOT NULL,
-    delete_on bigint
+    delete_on bigint,
+    oidc_subject text,
+    created bigint,
+    credential_issued boolean,
+    version int NOT NULL DEFAULT 0
 );
 CREATE UNIQUE INDEX username_index ON irma.users (username);
+CREATE UNIQUE INDEX oidc_subject_index ON irma.users (oidc_subject);
+
+CREATE TABLE IF NOT EXISTS irma.user_devices
+(
+    id serial PRIMARY KEY,
+    user_id int NOT NULL REFERENCES irma.users (id) ON DELETE CASCADE,
+    device_id text NOT NULL,
+    name text NOT NULL,
+    coredata bytea NOT NULL,
+    created bigint NOT NULL
+);
+CREATE UNIQUE INDEX user_devices_index ON irma.user_devices (user_id, device_id);
+
+CREATE TABLE IF NOT EXISTS irma.device_enrollment_codes
+(
+    id serial PRIMARY KEY,
+    code text NOT NULL,
+    expiry bigint NOT NULL,
+    user_id int NOT NULL REFERENCES irma.users (id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX device_enrollment_code_index ON irma.device_enrollment_codes (user_id, code);
+
+CREATE TABLE IF NOT EXISTS irma.recovery_tokens
+(
+    id serial PRIMARY KEY,
+    token_hash text NOT NULL,
+    expiry bigint NOT NULL,
+    user_id int NOT NULL REFERENCES irma.users (id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX recovery_token_index ON irma.recovery_tokens (token_hash);
+CREATE UNIQUE INDEX recovery_token_user_index ON irma.recovery_tokens (user_id);
 
 CREATE TABLE IF NOT EXISTS irma.log_entry_records
 (
@@ -22,16 +57,36 @@ CREATE TABLE IF NOT EXISTS irma.log_entry_records
     user_id int NOT NULL REFERENCES irma.users (id) ON DELETE CASCADE
 );
 CREATE INDEX log_entry_records_user_id_index ON irma.log_entry_records (user_id, time);
+CREATE INDEX log_entry_records_event_index ON irma.log_entry_records (event, time);
+CREATE INDEX log_entry_records_time_index ON irma.log_entry_records (time);
+
+CREATE TABLE IF NOT EXISTS irma.usage_stats
+(
+    date date PRIMARY KEY,
+    sessions int NOT NULL,
+    users int NOT NULL
+);
 
 CREATE TABLE IF NOT EXISTS irma.email_verification_tokens
 (
     id serial PRIMARY KEY,
-    token text NOT NULL,
+    token_hash text NOT NULL,
     email text NOT NULL,
     expiry bigint NOT NULL,
+    used boolean NOT NULL DEFAULT FALSE,
+    user_id int NOT NULL REFERENCES irma.users (id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX email_verification_token_index ON irma.email_verification_tokens (token_hash);
+
+CREATE TABLE IF NOT EXISTS irma.email_unsubscribe_tokens
+(
+    id serial PRIMARY KEY,
+    token_hash text NOT NULL,
+    email text NOT NULL,
     user_id int NOT NULL REFERENCES irma.users (id) ON DELETE CASCADE
 );
-CREATE UNIQUE INDEX email_verification_token_index ON irma.email_verification_tokens (token);
+CREATE UNIQUE INDEX email_unsubscribe_token_index ON irma.email_unsubscribe_tokens (token_hash);
+CREATE INDEX email_unsubscribe_token_user_index ON irma.email_unsubscribe_tokens (user_id, email);
 
 CREATE TABLE IF NOT EXISTS irma.email_login_tokens
 (
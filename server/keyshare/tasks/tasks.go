@@ -54,7 +54,7 @@ func (t *taskHandler) cleanupEmails() {
 	}
 }
 
-// Remove old login and email verification tokens
+// Remove old login and email verification tokens, and device enrollment codes
 func (t *taskHandler) cleanupTokens() {
 	_, err := t.db.Exec("DELETE FROM irma.email_login_tokens WHERE expiry < $1", time.Now().Unix())
 	if err != nil {
@@ -64,6 +64,16 @@ func (t *taskHandler) cleanupTokens() {
 	_, err = t.db.Exec("DELETE FROM irma.email_verification_tokens WHERE expiry < $1", time.Now().Unix())
 	if err != nil {
 		t.conf.Logger.WithField("error", err).Error("Could not remove email verification tokens that have expired")
+		return
+	}
+	_, err = t.db.Exec("DELETE FROM irma.device_enrollment_codes WHERE expiry < $1", time.Now().Unix())
+	if err != nil {
+		t.conf.Logger.WithField("error", err).Error("Could not remove device enrollment codes that have expired")
+		return
+	}
+	_, err = t.db.Exec("DELETE FROM irma.recovery_tokens WHERE expiry < $1", time.Now().Unix())
+	if err != nil {
+		t.conf.Logger.WithField("error", err).Error("Could not remove recovery tokens that have expired")
 	}
 }
 
@@ -106,9 +116,23 @@ func (t *taskHandler) sendExpiryEmails(id int64, username, lang string) error {
 	return nil
 }
 
-// Mark old unused accounts for deletion, and inform their owners.
+// Accounts to which the keyshare credential was not issued within this duration after registration,
+// and which were not used since, are deleted; the user never obtained the username required to use them.
+const unissuedAccountDelay = 24 * time.Hour
+
+// Mark old unused accounts for deletion, and inform their owners. Accounts to which the keyshare
+// credential was never issued are deleted directly.
 func (t *taskHandler) expireAccounts() {
-	// Disable this task when email server is not given
+	// Accounts registered before credential issuance was recorded have credential_issued NULL
+	// and are kept. The flag is set by the issuance session handler of the keyshare server, which
+	// does not survive restarts, so accounts that were seen after their registration are kept too.
+	_, err := t.db.Exec("DELETE FROM irma.users WHERE credential_issued = false AND created < $1 AND last_seen <= created",
+		time.Now().Add(-unissuedAccountDelay).Unix())
+	if err != nil {
+		t.conf.Logger.WithField("error", err).Error("Could not remove accounts to which the keyshare credential was never issued")
+	}
+
+	// Disable the remainder of this task when email server is not given
 	if t.conf.EmailServer == "" {
 		t.conf.Logger.Warning("Expiring accounts is disabled, as no email server is configured")
 		return
@@ -120,7 +144,7 @@ func (t *taskHandler) expireAccounts() {
 	// We do this for only 10 users at a time to prevent us from sending out lots of emails
 	// simultaneously, which could lead to our email server being flagged as sending spam.
 	// The users excluded by this limit will get their email next time this task is executed.
-	err := t.db.QueryIterate(`
+	err = t.db.QueryIterate(`
 		SELECT id, username, language
 		FROM irma.users
 		WHERE last_seen < $1 AND (
@@ -59,12 +59,16 @@ func TestCleanupTokens(t *testing.T) {
 
 	db, err := sql.Open("pgx", test.PostgresTestUrl)
 	require.NoError(t, err)
-	_, err = db.Exec("INSERT INTO irma.users (id, username, last_seen, language, coredata, pin_counter, pin_block_date) VALUES (15, 'testuser', 15, '', '', 0,0)")
+	_, err = db.Exec("INSERT INTO irma.users (id, username, last_seen, language, coredata, pin_counter, pin_block_date) VALUES (15, 'testuser', 15, '', '', 0,0), (16, 'testuser2', 15, '', '', 0,0)")
 	require.NoError(t, err)
-	_, err = db.Exec("INSERT INTO irma.email_verification_tokens (token, user_id, email, expiry) VALUES ('t1', 15, 't1@test.com', 0), ('t2', 15, 't2@test.com', $1)", time.Now().Add(time.Hour).Unix())
+	_, err = db.Exec("INSERT INTO irma.email_verification_tokens (token_hash, user_id, email, expiry) VALUES ('t1', 15, 't1@test.com', 0), ('t2', 15, 't2@test.com', $1)", time.Now().Add(time.Hour).Unix())
 	require.NoError(t, err)
 	_, err = db.Exec("INSERT INTO irma.email_login_tokens (token, email, expiry) VALUES ('t1', 't1@test.com', 0), ('t2', 't2@test.com', $1)", time.Now().Add(time.Hour).Unix())
 	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO irma.device_enrollment_codes (code, user_id, expiry) VALUES ('c1', 15, 0), ('c2', 15, $1)", time.Now().Add(time.Hour).Unix())
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO irma.recovery_tokens (token_hash, user_id, expiry) VALUES ('h1', 15, 0), ('h2', 16, $1)", time.Now().Add(time.Hour).Unix())
+	require.NoError(t, err)
 
 	th, err := newHandler(&Configuration{DBConnStr: test.PostgresTestUrl, Logger: irma.Logger})
 	require.NoError(t, err)
@@ -73,6 +77,8 @@ func TestCleanupTokens(t *testing.T) {
 
 	assert.Equal(t, 1, countRows(t, db, "email_verification_tokens", ""))
 	assert.Equal(t, 1, countRows(t, db, "email_login_tokens", ""))
+	assert.Equal(t, 1, countRows(t, db, "device_enrollment_codes", ""))
+	assert.Equal(t, 1, countRows(t, db, "recovery_tokens", ""))
 }
 
 func TestCleanupAccounts(t *testing.T) {
@@ -128,6 +134,29 @@ func TestExpireAccounts(t *testing.T) {
 	assert.Equal(t, 1, countRows(t, db, "users", "delete_on IS NOT NULL"))
 }
 
+func TestExpireUnissuedAccounts(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := sql.Open("pgx", test.PostgresTestUrl)
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO irma.users(id, username, language, coredata, pin_counter, pin_block_date, last_seen, created, credential_issued) VALUES (15, 'A', '', '', 0, 0, $1-25*3600, $1-25*3600, false), (16, 'B', '', '', 0, 0, $1, $1-3600, false), (17, 'C', '', '', 0, 0, $1, $1-25*3600, true), (18, 'D', '', '', 0, 0, $1, NULL, NULL), (19, 'E', '', '', 0, 0, $1, $1-25*3600, false)", time.Now().Unix())
+	require.NoError(t, err)
+
+	// Unissued accounts are deleted even when no email server is configured
+	th, err := newHandler(&Configuration{
+		DBConnStr: test.PostgresTestUrl,
+		Logger:    irma.Logger,
+	})
+	require.NoError(t, err)
+
+	th.expireAccounts()
+
+	// Account E was used after registration, so the user did obtain its username
+	assert.Equal(t, 4, countRows(t, db, "users", ""))
+	assert.Equal(t, 0, countRows(t, db, "users", "username = 'A'"))
+}
+
 func TestConfiguration(t *testing.T) {
 	testdataPath := test.FindTestdataFolder(t)
 
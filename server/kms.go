@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+)
+
+// KMSSettings configures fetching issuer private keys at startup from an external key management
+// service, instead of reading them from IssuerPrivateKeysPath. The keys are kept in locked memory
+// for the lifetime of the server.
+//
+// The CL signatures that the server creates during issuance require computing e-th roots modulo
+// the public key modulus for varying e, as well as the factorization of the modulus for revocation
+// witnesses, so these cannot be delegated to the fixed-exponent RSA operations offered by KMSes.
+type KMSSettings struct {
+	// URL of the key management service. The private key with counter c of issuer i is fetched with
+	// GET <URL>/<i>/<c>, to which it must respond with the key in the same XML format as the
+	// private key files, or with status 404 if it has no such key.
+	URL string `json:"url" mapstructure:"url"`
+	// Bearer token with which the server authenticates to the key management service (optional)
+	Token     string `json:"token,omitempty" mapstructure:"token"`
+	TokenFile string `json:"token_file,omitempty" mapstructure:"token_file"`
+	// Issuers whose private keys to fetch. For each of them at least one private key must be present.
+	Issuers []string `json:"issuers" mapstructure:"issuers"`
+
+	// Store from which to fetch the private keys instead of URL (for library usage)
+	Store irma.PrivateKeyStore `json:"-"`
+}
+
+// httpKeyStore fetches private keys from a key management service over HTTP.
+type httpKeyStore struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (conf *Configuration) verifyKMS() error {
+	settings := conf.IssuerPrivateKeysKMS
+	if len(settings.Issuers) == 0 {
+		return errors.New("no issuers specified whose private keys to fetch from the KMS")
+	}
+	issuers := make([]irma.IssuerIdentifier, 0, len(settings.Issuers))
+	for _, issuer := range settings.Issuers {
+		issuers = append(issuers, irma.NewIssuerIdentifier(issuer))
+	}
+
+	store := settings.Store
+	if store == nil {
+		if settings.URL == "" {
+			return errors.New("no KMS URL specified")
+		}
+		if conf.Production && !strings.HasPrefix(settings.URL, "https://") {
+			return errors.New("KMS URL must be https:// in production mode")
+		}
+		s := &httpKeyStore{
+			url:    strings.TrimSuffix(settings.URL, "/"),
+			client: conf.Egress.Client(false),
+		}
+		if settings.Token != "" || settings.TokenFile != "" {
+			token, err := common.ReadKey(settings.Token, settings.TokenFile)
+			if err != nil {
+				return errors.WrapPrefix(err, "failed to read KMS token", 0)
+			}
+			s.token = strings.TrimSpace(string(token))
+		}
+		store = s
+	}
+
+	ring, err := irma.NewPrivateKeyRingStore(store, issuers, conf.IrmaConfiguration)
+	if err != nil {
+		return errors.WrapPrefix(err, "failed to fetch private keys from KMS", 0)
+	}
+	return conf.IrmaConfiguration.AddPrivateKeyRing(ring)
+}
+
+func (s *httpKeyStore) PrivateKey(id irma.IssuerIdentifier, counter uint) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/%s/%d", s.url, id.String(), counter), nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer common.Close(res.Body)
+	if res.StatusCode == http.StatusNotFound {
+		return nil, irma.ErrMissingPrivateKey
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("KMS responded with status %d", res.StatusCode)
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+var _ irma.PrivateKeyStore = (*httpKeyStore)(nil)
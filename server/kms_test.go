@@ -0,0 +1,55 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKMSPrivateKeys(t *testing.T) {
+	testdata := test.FindTestdataFolder(t)
+	rukey, err := ioutil.ReadFile(filepath.Join(testdata, "privatekeys", "irma-demo.RU.2.xml"))
+	require.NoError(t, err)
+
+	kms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/irma-demo.RU/2" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(rukey)
+	}))
+	defer kms.Close()
+
+	egress, err := NewEgress([]string{"127.0.0.0/8"}, nil, 0)
+	require.NoError(t, err)
+	newConf := func(settings *KMSSettings) *Configuration {
+		irmaconf, err := irma.NewConfiguration(filepath.Join(testdata, "irma_configuration"), irma.ConfigurationOptions{})
+		require.NoError(t, err)
+		require.NoError(t, irmaconf.ParseFolder())
+		return &Configuration{IrmaConfiguration: irmaconf, IssuerPrivateKeysKMS: settings, Logger: Logger, Egress: egress}
+	}
+
+	conf := newConf(&KMSSettings{URL: kms.URL + "/", Token: "secret", Issuers: []string{"irma-demo.RU"}})
+	require.NoError(t, conf.verifyPrivateKeys())
+	sk, err := conf.IrmaConfiguration.PrivateKeys.Latest(irma.NewIssuerIdentifier("irma-demo.RU"))
+	require.NoError(t, err)
+	require.Equal(t, uint(2), sk.Counter)
+
+	// Startup fails if a configured issuer has no accessible key
+	conf = newConf(&KMSSettings{URL: kms.URL, Token: "secret", Issuers: []string{"irma-demo.RU", "irma-demo.MijnOverheid"}})
+	require.Error(t, conf.verifyPrivateKeys())
+	conf = newConf(&KMSSettings{URL: kms.URL, Token: "wrong", Issuers: []string{"irma-demo.RU"}})
+	require.Error(t, conf.verifyPrivateKeys())
+	conf = newConf(&KMSSettings{URL: kms.URL, Token: "secret"})
+	require.Error(t, conf.verifyPrivateKeys())
+}
@@ -5,25 +5,33 @@ import (
 	irma "github.com/privacybydesign/irmago"
 )
 
-func parseLegacySessionRequest(r []byte) (irma.RequestorRequest, error) {
-	var attempts = []irma.Validator{&irma.ServiceProviderRequest{}, &irma.SignatureRequestorRequest{}, &irma.IdentityProviderRequest{}}
-	t, err := tryUnmarshalJson(r, attempts)
-	if err == nil {
-		return t.(irma.RequestorRequest), nil
-	}
-	attempts = []irma.Validator{&irma.DisclosureRequest{}, &irma.SignatureRequest{}, &irma.IssuanceRequest{}}
-	t, err = tryUnmarshalJson(r, attempts)
-	if err == nil {
-		return wrapSessionRequest(t.(irma.SessionRequest))
+// legacyRequestAttempts returns the types as which a request without @context is to be parsed:
+// the (requestor) request type of its (nested) legacy type, or if absent, all request types.
+func legacyRequestAttempts(envelope requestEnvelope) ([]irma.Validator, error) {
+	if envelope.Request != nil && envelope.Request.Type != "" {
+		switch envelope.Request.Type {
+		case irma.ActionDisclosing:
+			return []irma.Validator{&irma.ServiceProviderRequest{}}, nil
+		case irma.ActionSigning:
+			return []irma.Validator{&irma.SignatureRequestorRequest{}}, nil
+		case irma.ActionIssuing:
+			return []irma.Validator{&irma.IdentityProviderRequest{}}, nil
+		}
+		return nil, &SessionRequestError{Kind: ErrRequestUnknownType, Err: errors.Errorf("unknown type %s", envelope.Request.Type)}
 	}
-	return nil, errors.New("Failed to JSON unmarshal request bytes")
-}
 
-func tryUnmarshalJson(bts []byte, attempts []irma.Validator) (irma.Validator, error) {
-	for _, a := range attempts {
-		if err := irma.UnmarshalValidate(bts, a); err == nil {
-			return a, nil
-		}
+	switch envelope.Type {
+	case "":
+		return []irma.Validator{
+			&irma.ServiceProviderRequest{}, &irma.SignatureRequestorRequest{}, &irma.IdentityProviderRequest{},
+			&irma.DisclosureRequest{}, &irma.SignatureRequest{}, &irma.IssuanceRequest{},
+		}, nil
+	case irma.ActionDisclosing:
+		return []irma.Validator{&irma.DisclosureRequest{}}, nil
+	case irma.ActionSigning:
+		return []irma.Validator{&irma.SignatureRequest{}}, nil
+	case irma.ActionIssuing:
+		return []irma.Validator{&irma.IssuanceRequest{}}, nil
 	}
-	return nil, errors.New("")
+	return nil, &SessionRequestError{Kind: ErrRequestUnknownType, Err: errors.Errorf("unknown type %s", envelope.Type)}
 }
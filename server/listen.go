@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-errors/errors"
+	"golang.org/x/net/netutil"
+)
+
+// The read timeouts of http.Server limit how long clients may take to send their requests,
+// which the per-request TimeoutMiddleware cannot do: it only starts once the request headers have
+// been read. Together with the connection limit, these prevent a few slow clients from
+// exhausting the connections of the server.
+
+func (conf *Configuration) verifyHTTPLimits() error {
+	for _, timeout := range []*int{&conf.ReadHeaderTimeout, &conf.ReadTimeout} {
+		if *timeout == 0 {
+			*timeout = int(ReadTimeout / time.Second)
+		}
+	}
+	if conf.IdleTimeout == 0 {
+		conf.IdleTimeout = 120
+	}
+	if conf.ReadHeaderTimeout < 0 || conf.ReadTimeout < 0 || conf.IdleTimeout < 0 {
+		return errors.New("read_header_timeout, read_timeout and idle_timeout must not be negative")
+	}
+	if conf.StatusTimeout == 0 {
+		conf.StatusTimeout = int(ReadTimeout / time.Second)
+	}
+	if conf.ProofTimeout == 0 {
+		conf.ProofTimeout = 30
+	}
+	if conf.StatusTimeout < 0 || conf.ProofTimeout < 0 {
+		return errors.New("status_timeout and proof_timeout must not be negative")
+	}
+	if conf.MaxConnections == 0 {
+		conf.MaxConnections = 1000
+	}
+	if conf.MaxConnections < -1 {
+		return errors.New("max_connections must be positive, or -1 for no maximum")
+	}
+	return nil
+}
+
+// ConfigureHTTPServer applies the read and idle timeouts of the configuration to the HTTP server.
+// The IRMA server and keyshare servers do this themselves when started by the irma command;
+// applications that serve the Handler() of one of these servers using their own http.Server
+// should call this on it, and serve it on a listener wrapped using LimitListener. The
+// configuration must have been checked, e.g. by creating the server with it.
+func (conf *Configuration) ConfigureHTTPServer(serv *http.Server) {
+	serv.ReadHeaderTimeout = time.Duration(conf.ReadHeaderTimeout) * time.Second
+	serv.ReadTimeout = time.Duration(conf.ReadTimeout) * time.Second
+	serv.IdleTimeout = time.Duration(conf.IdleTimeout) * time.Second
+}
+
+// LimitListener returns a listener that accepts at most MaxConnections simultaneous connections
+// from the specified listener, or the listener itself if there is no maximum.
+func (conf *Configuration) LimitListener(l net.Listener) net.Listener {
+	if conf.MaxConnections < 0 {
+		return l
+	}
+	return netutil.LimitListener(l, conf.MaxConnections)
+}
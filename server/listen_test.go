@@ -0,0 +1,65 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyHTTPLimits(t *testing.T) {
+	conf := &Configuration{}
+	require.NoError(t, conf.verifyHTTPLimits())
+	require.Equal(t, 5, conf.ReadHeaderTimeout)
+	require.Equal(t, 5, conf.ReadTimeout)
+	require.Equal(t, 120, conf.IdleTimeout)
+	require.Equal(t, 5, conf.StatusTimeout)
+	require.Equal(t, 30, conf.ProofTimeout)
+	require.Equal(t, 1000, conf.MaxConnections)
+
+	conf = &Configuration{ReadHeaderTimeout: 2, MaxConnections: -1}
+	require.NoError(t, conf.verifyHTTPLimits())
+	require.Equal(t, 2, conf.ReadHeaderTimeout)
+	require.Equal(t, -1, conf.MaxConnections)
+
+	require.Error(t, (&Configuration{ReadTimeout: -1}).verifyHTTPLimits())
+	require.Error(t, (&Configuration{MaxConnections: -2}).verifyHTTPLimits())
+	require.Error(t, (&Configuration{ProofTimeout: -1}).verifyHTTPLimits())
+}
+
+func TestSlowClients(t *testing.T) {
+	conf := &Configuration{ReadHeaderTimeout: 1, MaxConnections: 1}
+	require.NoError(t, conf.verifyHTTPLimits())
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	serv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	conf.ConfigureHTTPServer(serv)
+	require.Equal(t, time.Second, serv.ReadHeaderTimeout)
+	go func() { _ = serv.Serve(conf.LimitListener(l)) }()
+	defer serv.Close()
+
+	// A client sending its request headers slowly is disconnected
+	slow, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer slow.Close()
+	_, err = slow.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n"))
+	require.NoError(t, err)
+
+	// Meanwhile, it occupies the only connection that is accepted
+	client := &http.Client{Timeout: 200 * time.Millisecond}
+	_, err = client.Get("http://" + l.Addr().String())
+	require.Error(t, err)
+
+	require.NoError(t, slow.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = ioutil.ReadAll(slow)
+	require.NoError(t, err) // connection closed by server, not by our deadline
+
+	res, err := http.Get("http://" + l.Addr().String())
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.NoError(t, res.Body.Close())
+}
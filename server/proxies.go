@@ -0,0 +1,123 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// TrustedProxies contains the networks of the reverse proxies in front of a server, whose
+// forwarding headers are trusted to determine the IP address of the client of a request.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses a list of IP addresses and CIDR ranges (e.g. 10.0.0.0/8) of trusted proxies.
+func ParseTrustedProxies(proxies []string) (TrustedProxies, error) {
+	var result TrustedProxies
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, errors.Errorf("invalid trusted proxy %s: not an IP address or CIDR range", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, errors.Errorf("invalid trusted proxy %s: %v", proxy, err)
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+func (proxies TrustedProxies) trusted(ip net.IP) bool {
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP address of the client that sent the request. If the request was sent
+// by a trusted proxy, the addresses that the proxies added to the Forwarded header (RFC 7239),
+// or if absent to the X-Forwarded-For header, are walked from the right, up to the first address
+// that is not a trusted proxy: as the client may send these headers itself, only the addresses
+// added by trusted proxies can be relied on. If neither is present, the X-Real-IP header is used.
+// Without trusted proxies, this returns RemoteIP(r).
+func (proxies TrustedProxies) ClientIP(r *http.Request) string {
+	remote := RemoteIP(r)
+	ip := net.ParseIP(remote)
+	if ip == nil || !proxies.trusted(ip) {
+		return remote
+	}
+
+	hops := forwardedFor(r.Header)
+	if hops == nil {
+		hops = headerList(r.Header, "X-Forwarded-For")
+	}
+	if hops == nil {
+		hops = headerList(r.Header, "X-Real-IP")
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHop(hops[i])
+		if hop == nil {
+			// Not an IP address (e.g. "unknown" or an obfuscated identifier), so the
+			// preceding addresses cannot be checked either
+			break
+		}
+		ip = hop
+		if !proxies.trusted(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// headerList returns the comma-separated elements of all values of the specified header.
+func headerList(header http.Header, name string) []string {
+	var result []string
+	for _, value := range header.Values(name) {
+		for _, element := range strings.Split(value, ",") {
+			result = append(result, strings.TrimSpace(element))
+		}
+	}
+	return result
+}
+
+// forwardedFor returns the "for" parameters of the elements of the Forwarded header (RFC 7239).
+// Elements without "for" parameter are included as empty strings, so that they are not trusted.
+func forwardedFor(header http.Header) []string {
+	var result []string
+	for _, element := range headerList(header, "Forwarded") {
+		var value string
+		for _, pair := range strings.Split(element, ";") {
+			parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(parts) == 2 && strings.EqualFold(parts[0], "for") {
+				value = strings.Trim(parts[1], `"`)
+			}
+		}
+		result = append(result, value)
+	}
+	return result
+}
+
+// parseHop parses an address from a forwarding header, which may include a port, and in which
+// IPv6 addresses may be enclosed in brackets (e.g. 192.0.2.60:4711 or [2001:db8::17]:4711).
+func parseHop(hop string) net.IP {
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return net.ParseIP(host)
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]"))
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", " 2001:db8::/32", "::1"})
+	require.NoError(t, err)
+	require.Len(t, proxies, 4)
+	require.Equal(t, "192.0.2.1/32", proxies[1].String())
+	require.Equal(t, "::1/128", proxies[3].String())
+
+	proxies, err = ParseTrustedProxies(nil)
+	require.NoError(t, err)
+	require.Empty(t, proxies)
+
+	for _, invalid := range []string{"", "10.0.0.0/33", "10.0.0", "proxy.example.com", "10.0.0.1:80"} {
+		_, err = ParseTrustedProxies([]string{invalid})
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "2001:db8::/32"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		remote   string
+		headers  http.Header
+		expected string
+	}{
+		{"direct", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"untrusted remote", "192.0.2.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "192.0.2.1"},
+		{"untrusted remote real ip", "192.0.2.1:1234", http.Header{"X-Real-Ip": {"198.51.100.1"}}, "192.0.2.1"},
+		{"trusted remote without headers", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"forwarded for", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"proxy chain", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1, 10.0.0.2, 10.0.0.3"}}, "198.51.100.1"},
+		{"multiple headers", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1", "10.0.0.2"}}, "198.51.100.1"},
+		{"spoofed forwarded for", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"203.0.113.66, 198.51.100.1"}}, "198.51.100.1"},
+		{"spoofed trusted address", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"10.6.6.6, 198.51.100.1, 10.0.0.2"}}, "198.51.100.1"},
+		{"garbage", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1, nonsense"}}, "10.0.0.1"},
+		{"garbage behind client", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"nonsense, 198.51.100.1"}}, "198.51.100.1"},
+		{"all trusted", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"with port", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1:4711"}}, "198.51.100.1"},
+		{"ipv6", "[2001:db8::1]:1234", http.Header{"X-Forwarded-For": {"2001:db9::17, 2001:db8::2"}}, "2001:db9::17"},
+		{"real ip", "10.0.0.1:1234", http.Header{"X-Real-Ip": {"198.51.100.1"}}, "198.51.100.1"},
+		{"real ip ignored", "10.0.0.1:1234", http.Header{"X-Real-Ip": {"203.0.113.66"}, "X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"forwarded", "10.0.0.1:1234", http.Header{"Forwarded": {`for=198.51.100.1;proto=https;by=10.0.0.1`}}, "198.51.100.1"},
+		{"forwarded chain", "10.0.0.1:1234", http.Header{"Forwarded": {`for=203.0.113.66, For="[2001:db9::17]:4711", for=10.0.0.2`}}, "2001:db9::17"},
+		{"forwarded preferred", "10.0.0.1:1234", http.Header{"Forwarded": {"for=198.51.100.1"}, "X-Forwarded-For": {"203.0.113.66"}}, "198.51.100.1"},
+		{"forwarded unknown", "10.0.0.1:1234", http.Header{"Forwarded": {"for=unknown, for=10.0.0.2"}}, "10.0.0.2"},
+		{"forwarded without for", "10.0.0.1:1234", http.Header{"Forwarded": {"for=203.0.113.66, proto=https"}}, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &http.Request{RemoteAddr: tt.remote, Header: tt.headers}
+			require.Equal(t, tt.expected, proxies.ClientIP(r))
+		})
+	}
+
+	// Without trusted proxies, the headers are ignored
+	r := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: http.Header{"X-Forwarded-For": {"198.51.100.1"}}}
+	require.Equal(t, "10.0.0.1", TrustedProxies(nil).ClientIP(r))
+}
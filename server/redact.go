@@ -0,0 +1,101 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// AttributeValueLogging specifies whether disclosed attribute values may appear in logs, and in
+// session results that are kept after the requestor fetched them.
+type AttributeValueLogging string
+
+const (
+	AttributeValueLoggingFull   AttributeValueLogging = "full"   // attribute values are included as is
+	AttributeValueLoggingHashed AttributeValueLogging = "hashed" // attribute values are replaced by salted hashes
+	AttributeValueLoggingNever  AttributeValueLogging = "never"  // attribute values are removed
+)
+
+var (
+	attributeValueLogging = AttributeValueLoggingFull
+
+	// Salt of the hashes replacing attribute values in "hashed" mode. It is generated once per
+	// process, so that equal attribute values can be correlated across sessions and log lines,
+	// while the values themselves cannot be recovered by hashing candidate values.
+	attributeValueSalt = newAttributeValueSalt()
+)
+
+func newAttributeValueSalt() []byte {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	return salt
+}
+
+func (conf *Configuration) verifyLogAttributeValues() error {
+	switch conf.LogAttributeValues {
+	case "":
+		attributeValueLogging = AttributeValueLoggingFull
+	case AttributeValueLoggingFull, AttributeValueLoggingHashed, AttributeValueLoggingNever:
+		attributeValueLogging = conf.LogAttributeValues
+	default:
+		return errors.Errorf("log_attribute_values must be one of full, hashed or never, was %s", conf.LogAttributeValues)
+	}
+	return nil
+}
+
+// LoggedResult returns the session result as it may be logged, or kept after the requestor fetched
+// it. Depending on Configuration.LogAttributeValues, this is either the result itself, or a copy
+// in which the disclosed attribute values are replaced by salted hashes or removed; in the latter
+// two cases the attribute-based signature, which also contains the attribute values, is removed,
+// and Redacted is set.
+// All session results that end up in logs pass through this function.
+func LoggedResult(result *SessionResult) *SessionResult {
+	if result == nil || result.Redacted || attributeValueLogging == AttributeValueLoggingFull {
+		return result
+	}
+
+	logged := *result
+	logged.Redacted = true
+	logged.Signature = nil
+	if result.Disclosed != nil {
+		logged.Disclosed = make([][]*irma.DisclosedAttribute, len(result.Disclosed))
+	}
+	for i, attrs := range result.Disclosed {
+		logged.Disclosed[i] = make([]*irma.DisclosedAttribute, len(attrs))
+		for j, attr := range attrs {
+			a := *attr
+			a.RawValue, a.Value = nil, nil
+			if attributeValueLogging == AttributeValueLoggingHashed && attr.RawValue != nil {
+				hash := hashAttributeValue(*attr.RawValue)
+				a.RawValue = &hash
+			}
+			logged.Disclosed[i][j] = &a
+		}
+	}
+	return &logged
+}
+
+// DeletedResult returns the session result without its disclosed attributes and signature, as
+// kept after the result was read if Configuration.DeleteResultOnRead is set.
+func DeletedResult(result *SessionResult) *SessionResult {
+	if result == nil {
+		return nil
+	}
+	deleted := *result
+	deleted.Deleted = true
+	deleted.Disclosed = nil
+	deleted.Signature = nil
+	return &deleted
+}
+
+func hashAttributeValue(value string) string {
+	mac := hmac.New(sha256.New, attributeValueSalt)
+	_, _ = mac.Write([]byte(value))
+	return "sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
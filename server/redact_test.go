@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func setAttributeValueLogging(t *testing.T, mode AttributeValueLogging) {
+	conf := &Configuration{LogAttributeValues: mode}
+	require.NoError(t, conf.verifyLogAttributeValues())
+	t.Cleanup(func() { attributeValueLogging = AttributeValueLoggingFull })
+}
+
+func disclosureResult() *SessionResult {
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	value, other := "s1234567", "s7654321"
+	return &SessionResult{
+		Token:  "token",
+		Status: irma.ServerStatusDone,
+		Type:   irma.ActionSigning,
+		Disclosed: [][]*irma.DisclosedAttribute{
+			{{Identifier: studentID, RawValue: &value, Value: irma.NewTranslatedString(&value), Status: irma.AttributeProofStatusPresent}},
+			{{Identifier: studentID, RawValue: &value, Value: irma.NewTranslatedString(&value), Status: irma.AttributeProofStatusPresent}},
+			{{Identifier: studentID, RawValue: &other, Value: irma.NewTranslatedString(&other), Status: irma.AttributeProofStatusPresent}},
+			{{Identifier: studentID, Status: irma.AttributeProofStatusNull}},
+		},
+		Signature: &irma.SignedMessage{Message: "message"},
+	}
+}
+
+func TestLoggedResult(t *testing.T) {
+	result := disclosureResult()
+
+	setAttributeValueLogging(t, AttributeValueLoggingFull)
+	require.Same(t, result, LoggedResult(result))
+
+	setAttributeValueLogging(t, AttributeValueLoggingNever)
+	logged := LoggedResult(result)
+	require.True(t, logged.Redacted)
+	require.Nil(t, logged.Signature)
+	for _, attrs := range logged.Disclosed {
+		require.Nil(t, attrs[0].RawValue)
+		require.Nil(t, attrs[0].Value)
+		require.Equal(t, "irma-demo.RU.studentCard.studentID", attrs[0].Identifier.String())
+	}
+	require.Equal(t, irma.AttributeProofStatusNull, logged.Disclosed[3][0].Status)
+
+	setAttributeValueLogging(t, AttributeValueLoggingHashed)
+	logged = LoggedResult(result)
+	require.True(t, logged.Redacted)
+	require.Nil(t, logged.Signature)
+	require.Nil(t, logged.Disclosed[0][0].Value)
+	require.True(t, strings.HasPrefix(*logged.Disclosed[0][0].RawValue, "sha256:"))
+	require.NotContains(t, *logged.Disclosed[0][0].RawValue, "s1234567")
+	// Equal values can be correlated, different ones not
+	require.Equal(t, *logged.Disclosed[0][0].RawValue, *logged.Disclosed[1][0].RawValue)
+	require.NotEqual(t, *logged.Disclosed[0][0].RawValue, *logged.Disclosed[2][0].RawValue)
+	require.Nil(t, logged.Disclosed[3][0].RawValue)
+	// Results are redacted only once
+	require.Same(t, logged, LoggedResult(logged))
+
+	// The result itself is left unchanged
+	require.Equal(t, disclosureResult(), result)
+
+	require.Error(t, (&Configuration{LogAttributeValues: "sometimes"}).verifyLogAttributeValues())
+}
+
+func TestLoggedResultLogs(t *testing.T) {
+	logger, hook := logrustest.NewNullLogger()
+	logger.SetLevel(logrus.TraceLevel)
+	defer func(l, il *logrus.Logger) { Logger = l; irma.SetLogger(il) }(Logger, irma.Logger)
+	Logger = logger
+	irma.SetLogger(logger)
+
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer callback.Close()
+
+	handler := LogMiddleware("test", LogOptions{Response: true})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := disclosureResult()
+		SetLoggedResponse(r, LoggedResult(result))
+		WriteJson(w, result)
+	}))
+
+	egress, err := NewEgress([]string{"127.0.0.0/8"}, nil, 0)
+	require.NoError(t, err)
+
+	for _, mode := range []AttributeValueLogging{AttributeValueLoggingFull, AttributeValueLoggingHashed, AttributeValueLoggingNever} {
+		t.Run(string(mode), func(t *testing.T) {
+			setAttributeValueLogging(t, mode)
+			hook.Reset()
+
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/result", nil))
+			DoResultCallback(egress, callback.URL, disclosureResult(), "", 0, nil, false)
+
+			var logs strings.Builder
+			for _, entry := range hook.AllEntries() {
+				logs.WriteString(fmt.Sprint(entry.Message, entry.Data))
+			}
+			require.Contains(t, logs.String(), "irma-demo.RU.studentCard.studentID")
+			switch mode {
+			case AttributeValueLoggingFull:
+				require.Contains(t, logs.String(), "s1234567")
+			case AttributeValueLoggingHashed:
+				require.NotContains(t, logs.String(), "s1234567")
+				require.Contains(t, logs.String(), hashAttributeValue("s1234567"))
+			case AttributeValueLoggingNever:
+				require.NotContains(t, logs.String(), "s1234567")
+				require.NotContains(t, logs.String(), `"rawvalue":"`)
+			}
+		})
+	}
+}
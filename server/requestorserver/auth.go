@@ -45,12 +45,14 @@ const (
 )
 
 type HmacAuthenticator struct {
-	hmackeys      map[string]interface{}
-	maxRequestAge int
+	hmackeys           map[string]interface{}
+	maxRequestAge      int
+	clockSkewTolerance time.Duration
 }
 type PublicKeyAuthenticator struct {
-	publickeys    map[string]interface{}
-	maxRequestAge int
+	publickeys         map[string]interface{}
+	maxRequestAge      int
+	clockSkewTolerance time.Duration
 }
 type PresharedKeyAuthenticator struct {
 	presharedkeys map[string]string
@@ -90,11 +92,11 @@ func (NilAuthenticator) Initialize(name string, requestor Requestor) error {
 func (hauth *HmacAuthenticator) AuthenticateSession(
 	headers http.Header, body []byte,
 ) (applies bool, request irma.RequestorRequest, requestor string, err *irma.RemoteError) {
-	return jwtAuthenticate(headers, body, jwt.SigningMethodHS256.Name, hauth.hmackeys, hauth.maxRequestAge)
+	return jwtAuthenticate(headers, body, jwt.SigningMethodHS256.Name, hauth.hmackeys, hauth.maxRequestAge, hauth.clockSkewTolerance)
 }
 
 func (hauth *HmacAuthenticator) AuthenticateRevocation(headers http.Header, body []byte) (bool, *irma.RevocationRequest, string, *irma.RemoteError) {
-	return jwtAutheticateRevocation(headers, body, jwt.SigningMethodHS256.Name, hauth.hmackeys, hauth.maxRequestAge)
+	return jwtAutheticateRevocation(headers, body, jwt.SigningMethodHS256.Name, hauth.hmackeys, hauth.maxRequestAge, hauth.clockSkewTolerance)
 }
 
 func (hauth *HmacAuthenticator) Initialize(name string, requestor Requestor) error {
@@ -117,11 +119,11 @@ func (hauth *HmacAuthenticator) Initialize(name string, requestor Requestor) err
 func (pkauth *PublicKeyAuthenticator) AuthenticateSession(
 	headers http.Header, body []byte,
 ) (bool, irma.RequestorRequest, string, *irma.RemoteError) {
-	return jwtAuthenticate(headers, body, jwt.SigningMethodRS256.Name, pkauth.publickeys, pkauth.maxRequestAge)
+	return jwtAuthenticate(headers, body, jwt.SigningMethodRS256.Name, pkauth.publickeys, pkauth.maxRequestAge, pkauth.clockSkewTolerance)
 }
 
 func (pkauth *PublicKeyAuthenticator) AuthenticateRevocation(headers http.Header, body []byte) (bool, *irma.RevocationRequest, string, *irma.RemoteError) {
-	return jwtAutheticateRevocation(headers, body, jwt.SigningMethodRS256.Name, pkauth.publickeys, pkauth.maxRequestAge)
+	return jwtAutheticateRevocation(headers, body, jwt.SigningMethodRS256.Name, pkauth.publickeys, pkauth.maxRequestAge, pkauth.clockSkewTolerance)
 }
 
 func (pkauth *PublicKeyAuthenticator) Initialize(name string, requestor Requestor) error {
@@ -204,9 +206,11 @@ func jwtKeyExtractor(publickeys map[string]interface{}) func(token *jwt.Token) (
 	}
 }
 
-// jwtAuthenticate is a helper function for JWT-based authenticators that verifies and parses JWTs.
+// jwtAuthenticate is a helper function for JWT-based authenticators that verifies and parses JWTs,
+// tolerating the specified clock skew when checking their validity period.
 func jwtAuthenticate(
 	headers http.Header, body []byte, signatureAlg string, keys map[string]interface{}, maxRequestAge int,
+	tolerance time.Duration,
 ) (bool, irma.RequestorRequest, string, *irma.RemoteError) {
 	if !jwtApplies(headers, body, signatureAlg) {
 		return false, nil, "", nil
@@ -216,14 +220,19 @@ func jwtAuthenticate(
 	// before we can construct a struct instance of the appropriate type into which to unmarshal the JWT contents.
 	claims := &jwt.StandardClaims{}
 	requestorJwt := string(body)
-	_, err := jwt.ParseWithClaims(requestorJwt, claims, jwtKeyExtractor(keys))
+	parser := &jwt.Parser{SkipClaimsValidation: true} // Validated below, tolerating clock skew
+	_, err := parser.ParseWithClaims(requestorJwt, claims, jwtKeyExtractor(keys))
 	if err != nil {
 		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
 	}
-	if time.Unix(claims.IssuedAt, 0).Add(time.Duration(maxRequestAge) * time.Second).Before(time.Now()) {
+	now := time.Now()
+	if time.Unix(claims.IssuedAt, 0).Add(time.Duration(maxRequestAge) * time.Second).Before(now) {
 		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, "jwt too old")
 	}
-	if !claims.VerifyIssuedAt(time.Now().Unix(), true) {
+	if !claims.VerifyExpiresAt(now.Add(-tolerance).Unix(), false) {
+		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, "jwt expired")
+	}
+	if !claims.VerifyIssuedAt(now.Add(tolerance).Unix(), true) || !claims.VerifyNotBefore(now.Add(tolerance).Unix(), false) {
 		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, "jwt not yet valid")
 	}
 
@@ -232,6 +241,9 @@ func jwtAuthenticate(
 	if err != nil {
 		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
 	}
+	if err = parsedJwt.ValidWithTolerance(tolerance); err != nil {
+		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, err.Error())
+	}
 
 	requestor := claims.Issuer // presence is ensured by jwtKeyExtractor
 	return true, parsedJwt.RequestorRequest(), requestor, nil
@@ -239,14 +251,19 @@ func jwtAuthenticate(
 
 func jwtAutheticateRevocation(
 	headers http.Header, body []byte, signatureAlg string, keys map[string]interface{}, maxRequestAge int,
+	tolerance time.Duration,
 ) (bool, *irma.RevocationRequest, string, *irma.RemoteError) {
 	if !jwtApplies(headers, body, signatureAlg) {
 		return false, nil, "", nil
 	}
 	s := &irma.RevocationJwt{}
-	if _, err := jwt.ParseWithClaims(string(body), s, jwtKeyExtractor(keys)); err != nil {
+	parser := &jwt.Parser{SkipClaimsValidation: true} // Validated below, tolerating clock skew
+	if _, err := parser.ParseWithClaims(string(body), s, jwtKeyExtractor(keys)); err != nil {
 		return false, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
 	}
+	if err := s.ValidWithTolerance(tolerance); err != nil {
+		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, err.Error())
+	}
 	if time.Unix(time.Time(s.IssuedAt).Unix(), 0).Add(time.Duration(maxRequestAge) * time.Second).Before(time.Now()) {
 		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, "jwt too old")
 	}
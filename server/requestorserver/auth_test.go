@@ -158,7 +158,23 @@ func TestHmacAuthenticator_Authenticate(t *testing.T) {
 		applies, _, _, err := authenticator.AuthenticateSession(requestHeaders, []byte(invalidJwtData))
 		require.True(t, applies)
 		require.Error(t, err)
-		require.Equal(t, string(server.ErrorInvalidRequest.Type), err.ErrorName)
+		require.Equal(t, string(server.ErrorUnauthorized.Type), err.ErrorName)
+	})
+
+	t.Run("jwt data issued within clock skew tolerance", func(t *testing.T) {
+		j := irma.NewServiceProviderJwt("my_requestor", disclosureRequest)
+		j.IssuedAt = (irma.Timestamp)(time.Now().Add(30 * time.Second))
+		jwtData, jErr := j.Sign(jwt.SigningMethodHS256, key)
+		require.NoError(t, jErr)
+		applies, _, _, err := authenticator.AuthenticateSession(requestHeaders, []byte(jwtData))
+		require.True(t, applies)
+		require.Error(t, err)
+
+		tolerant := authenticator
+		tolerant.clockSkewTolerance = time.Minute
+		applies, _, _, err = tolerant.AuthenticateSession(requestHeaders, []byte(jwtData))
+		require.True(t, applies)
+		require.Nil(t, err)
 	})
 
 	t.Run("jwt signed using invalid key", func(t *testing.T) {
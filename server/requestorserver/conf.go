@@ -56,6 +56,13 @@ type Configuration struct {
 	StaticPath string `json:"static_path" mapstructure:"static_path"`
 	// Host static files under this URL prefix
 	StaticPrefix string `json:"static_prefix" mapstructure:"static_prefix"`
+
+	// Session request templates by name, which requestors can start sessions with using
+	// {"template": name, "overrides": {...}}
+	RequestTemplates map[string]interface{} `json:"request_templates"`
+	// If set, the /admin/templates endpoints with which request templates are managed are enabled,
+	// requiring this token in the Authorization header
+	AdminToken string `json:"admin_token" mapstructure:"admin_token"`
 }
 
 // Permissions specify which attributes or credential a requestor may verify or issue.
@@ -156,8 +163,7 @@ func (conf *Configuration) initialize() error {
 	if conf.DisableRequestorAuthentication {
 		authenticators = map[AuthenticationMethod]Authenticator{AuthenticationMethodNone: NilAuthenticator{}}
 		conf.Logger.Warn("Authentication of incoming session requests disabled: anyone who can reach this server can use it")
-		havekeys := conf.HavePrivateKeys()
-		if len(conf.Permissions.Issuing) > 0 && havekeys {
+		if len(conf.Permissions.Issuing) > 0 && !conf.DisableIssuance && conf.HavePrivateKeys() {
 			if conf.separateClientServer() || !conf.Production {
 				conf.Logger.Warn("Issuance enabled and private keys installed: anyone who can reach this server can use it to issue attributes")
 			} else {
@@ -176,10 +182,15 @@ func (conf *Configuration) initialize() error {
 				return errors.New("No requestors configured; either configure one or more requestors or disable requestor authentication")
 			}
 		}
+		tolerance := conf.IrmaConfiguration.ClockSkewTolerance()
 		authenticators = map[AuthenticationMethod]Authenticator{
-			AuthenticationMethodHmac:      &HmacAuthenticator{hmackeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge},
-			AuthenticationMethodPublicKey: &PublicKeyAuthenticator{publickeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge},
-			AuthenticationMethodToken:     &PresharedKeyAuthenticator{presharedkeys: map[string]string{}},
+			AuthenticationMethodHmac: &HmacAuthenticator{
+				hmackeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge, clockSkewTolerance: tolerance,
+			},
+			AuthenticationMethodPublicKey: &PublicKeyAuthenticator{
+				publickeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge, clockSkewTolerance: tolerance,
+			},
+			AuthenticationMethodToken: &PresharedKeyAuthenticator{presharedkeys: map[string]string{}},
 		}
 
 		// Initialize authenticators
@@ -341,7 +352,8 @@ func (conf *Configuration) validatePermissionSet(requestor string, requestorperm
 					errs = append(errs, fmt.Sprintf("%s %s permission '%s': unknown credential type", requestor, typ, permission))
 					continue
 				}
-				if (typ == "issuing" || typ == "revoking") && !conf.SkipPrivateKeysCheck {
+				// Issuance permissions need no private keys if issuance is disabled altogether
+				if (typ == "issuing" && !conf.DisableIssuance || typ == "revoking") && !conf.SkipPrivateKeysCheck {
 					sk, err := conf.IrmaConfiguration.PrivateKeys.Latest(credtype.IssuerIdentifier())
 					if err != nil {
 						errs = append(errs, fmt.Sprintf("%s %s permission '%s': failed to load private key: %s", requestor, typ, permission, err))
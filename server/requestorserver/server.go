@@ -6,18 +6,22 @@ package requestorserver
 
 import (
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/cors"
+	"github.com/go-errors/errors"
 	"github.com/golang-jwt/jwt/v4"
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/common"
@@ -28,14 +32,39 @@ import (
 
 // Server is a requestor server instance.
 type Server struct {
-	conf     *Configuration
-	irmaserv *irmaserver.Server
-	stop     chan struct{}
-	stopped  chan struct{}
+	conf      *Configuration
+	irmaserv  *irmaserver.Server
+	templates *requestTemplates
+	stop      chan struct{}
+	stopped   chan struct{}
 }
 
 // Start the server. If successful then it will not return until Stop() is called.
 func (s *Server) Start(config *Configuration) error {
+	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", s.conf.ListenAddress, s.conf.Port))
+	if err != nil {
+		return server.LogError(err)
+	}
+	var clientListener net.Listener
+	if s.conf.separateClientServer() {
+		clientListener, err = net.Listen("tcp", fmt.Sprintf("%s:%d", s.conf.ClientListenAddress, s.conf.ClientPort))
+		if err != nil {
+			_ = l.Close()
+			return server.LogError(err)
+		}
+	}
+	return s.Serve(l, clientListener)
+}
+
+// Serve is like Start, but accepts connections on the specified listeners instead of listening at
+// the configured addresses and ports. The client listener must be specified if and only if a
+// separate client server is configured (i.e. if client_port is set). If successful then it will
+// not return until Stop() is called.
+func (s *Server) Serve(l net.Listener, clientListener net.Listener) error {
+	if (clientListener != nil) != s.conf.separateClientServer() {
+		return server.LogError(errors.New("client listener must be specified if and only if client_port is set"))
+	}
+
 	if s.conf.LogJSON {
 		s.conf.Logger.WithField("configuration", s.conf).Debug("Configuration")
 	} else {
@@ -61,11 +90,11 @@ func (s *Server) Start(config *Configuration) error {
 
 	if s.conf.separateClientServer() {
 		go func() {
-			done <- s.startClientServer()
+			done <- s.startClientServer(clientListener)
 		}()
 	}
 	go func() {
-		done <- s.startRequestorServer()
+		done <- s.startRequestorServer(l)
 	}()
 
 	var stopped bool
@@ -83,28 +112,27 @@ func (s *Server) Start(config *Configuration) error {
 	return err
 }
 
-func (s *Server) startRequestorServer() error {
+func (s *Server) startRequestorServer(l net.Listener) error {
 	tlsConf, _ := s.conf.tlsConfig()
-	return s.startServer(s.Handler(), "Server", s.conf.ListenAddress, s.conf.Port, tlsConf)
+	return s.startServer(s.Handler(), "Server", l, tlsConf)
 }
 
-func (s *Server) startClientServer() error {
+func (s *Server) startClientServer(l net.Listener) error {
 	tlsConf, _ := s.conf.clientTlsConfig()
-	return s.startServer(s.ClientHandler(), "Client server", s.conf.ClientListenAddress, s.conf.ClientPort, tlsConf)
+	return s.startServer(s.ClientHandler(), "Client server", l, tlsConf)
 }
 
-func (s *Server) startServer(handler http.Handler, name, addr string, port int, tlsConf *tls.Config) error {
-	fulladdr := fmt.Sprintf("%s:%d", addr, port)
-	s.conf.Logger.Info(name, " listening at ", fulladdr, s.conf.ApiPrefix)
+func (s *Server) startServer(handler http.Handler, name string, l net.Listener, tlsConf *tls.Config) error {
+	s.conf.Logger.Info(name, " listening at ", l.Addr().String(), s.conf.ApiPrefix)
 
+	// See https://blog.cloudflare.com/the-complete-guide-to-golang-net-http-timeouts/
+	// Write timeouts are handled per request using middleware (to exclude SSE endpoints)
 	serv := &http.Server{
-		Addr:      fulladdr,
 		Handler:   handler,
 		TLSConfig: tlsConf,
-		// See https://blog.cloudflare.com/the-complete-guide-to-golang-net-http-timeouts/
-		// Write timeouts are handled per request using middleware (to exclude SSE endpoints)
-		ReadTimeout: server.ReadTimeout,
 	}
+	s.conf.ConfigureHTTPServer(serv)
+	l = s.conf.LimitListener(l)
 
 	go func() {
 		<-s.stop
@@ -118,14 +146,20 @@ func (s *Server) startServer(handler http.Handler, name, addr string, port int,
 
 	if tlsConf != nil {
 		s.conf.Logger.Info(name, " TLS enabled")
-		return server.FilterStopError(serv.ListenAndServeTLS("", ""))
+		return server.FilterStopError(serv.ServeTLS(l, "", ""))
 	} else {
-		return server.FilterStopError(serv.ListenAndServe())
+		return server.FilterStopError(serv.Serve(l))
 	}
 }
 
+// Stop the server. When the handlers of the server are served using your own http.Server instead
+// of using Start() or Serve(), this only stops the IRMA server, and the http.Server must be
+// stopped separately.
 func (s *Server) Stop() {
 	s.irmaserv.Stop()
+	if s.stop == nil {
+		return
+	}
 	s.stop <- struct{}{}
 	<-s.stopped
 	if s.conf.separateClientServer() {
@@ -141,9 +175,14 @@ func New(config *Configuration) (*Server, error) {
 	if err := config.initialize(); err != nil {
 		return nil, err
 	}
+	templates, err := newRequestTemplates(config.RequestTemplates)
+	if err != nil {
+		return nil, err
+	}
 	return &Server{
-		conf:     config,
-		irmaserv: irmaserv,
+		conf:      config,
+		irmaserv:  irmaserv,
+		templates: templates,
 	}, nil
 }
 
@@ -159,6 +198,10 @@ func (s *Server) prefixRouter(router *chi.Mux) (prefixedRouter *chi.Mux) {
 	return
 }
 
+// ClientHandler returns a http.Handler that handles the IRMA client messages only, i.e. the
+// endpoints of the URL included in session pointers (QRs) and the static files, if any. Together
+// with RequestorHandler() this allows the client-facing endpoints to be served publicly while the
+// requestor endpoints are only reachable internally.
 func (s *Server) ClientHandler() http.Handler {
 	router := chi.NewRouter()
 	router.Use(cors.New(corsOptions).Handler)
@@ -173,27 +216,48 @@ func (s *Server) attachClientEndpoints(router *chi.Mux) {
 	}
 }
 
-// Handler returns a http.Handler that handles all IRMA requestor messages
-// and IRMA client messages.
-func (s *Server) Handler() http.Handler {
+// RequestorHandler returns a http.Handler that handles the IRMA requestor messages only, i.e. the
+// endpoints for starting and managing sessions, fetching their results, revocation and
+// administration. Sessions started through it can be performed by clients through the
+// ClientHandler() of the same Server, as both share the session store of the Server.
+func (s *Server) RequestorHandler() http.Handler {
 	router := chi.NewRouter()
+	router.Use(server.HooksMiddleware(s.conf.Hooks))
 	router.Use(cors.New(corsOptions).Handler)
+	s.attachRequestorEndpoints(router)
+	return s.prefixRouter(router)
+}
 
-	if !s.conf.separateClientServer() {
-		// Mount server for irmaclient
-		s.attachClientEndpoints(router)
+// Handler returns a http.Handler that handles all IRMA requestor messages
+// and IRMA client messages, i.e. both the endpoints of RequestorHandler() and ClientHandler(),
+// unless a separate client server is configured (client_port), in which case it is
+// RequestorHandler(). When serving it using your own http.Server instead of using Serve(),
+// apply the ConfigureHTTPServer() and LimitListener() methods of the server.Configuration to it,
+// to protect it against slow clients.
+func (s *Server) Handler() http.Handler {
+	if s.conf.separateClientServer() {
+		return s.RequestorHandler()
 	}
 
-	log := server.LogOptions{Response: true, Headers: true, From: true}
+	router := chi.NewRouter()
+	router.Use(server.HooksMiddleware(s.conf.Hooks))
+	router.Use(cors.New(corsOptions).Handler)
+	s.attachClientEndpoints(router)
+	s.attachRequestorEndpoints(router)
+	return s.prefixRouter(router)
+}
+
+func (s *Server) attachRequestorEndpoints(router *chi.Mux) {
+	log := server.LogOptions{Response: true, Headers: true, From: true, TrustedProxies: s.conf.TrustedProxyNetworks}
 	router.NotFound(server.LogMiddleware("requestor", log)(router.NotFoundHandler()).ServeHTTP)
 	router.MethodNotAllowed(server.LogMiddleware("requestor", log)(router.MethodNotAllowedHandler()).ServeHTTP)
 
 	// Group main API endpoints, so we can attach our request/response logger to it
-	// while not adding it to the endpoints already added above (which do their own logging).
+	// while not adding it to the client endpoints (which do their own logging).
 
 	router.Group(func(r chi.Router) {
 		r.Use(server.SizeLimitMiddleware)
-		r.Use(server.TimeoutMiddleware([]string{"/statusevents"}, server.WriteTimeout))
+		r.Use(server.TimeoutMiddleware(map[string]time.Duration{"/statusevents": 0}, server.WriteTimeout))
 		r.Use(cors.New(corsOptions).Handler)
 		r.Use(server.LogMiddleware("requestor", log))
 
@@ -223,7 +287,18 @@ func (s *Server) Handler() http.Handler {
 		r.Post("/revocation", s.handleRevocation)
 	})
 
-	return s.prefixRouter(router)
+	if s.conf.AdminToken != "" {
+		router.Group(func(r chi.Router) {
+			r.Use(server.SizeLimitMiddleware)
+			r.Use(server.TimeoutMiddleware(nil, server.WriteTimeout))
+			r.Use(server.LogMiddleware("admin", log))
+			r.Use(s.adminMiddleware)
+			r.Get("/admin/templates", s.handleAdminTemplates)
+			r.Post("/admin/templates/{name}", s.handleAdminPutTemplate)
+			r.Delete("/admin/templates/{name}", s.handleAdminDeleteTemplate)
+			r.Get("/admin/static-sessions", s.handleAdminStaticSessions)
+		})
+	}
 }
 
 func (s *Server) StaticFilesHandler() http.Handler {
@@ -248,6 +323,17 @@ func (s *Server) handleCreateSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// If the request refers to a request template, expand it into the full request, which is then
+	// authenticated and authorized like any other request
+	var template string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var rerr *irma.RemoteError
+		if body, template, rerr = s.expandTemplate(body); rerr != nil {
+			server.WriteResponse(w, nil, rerr)
+			return
+		}
+	}
+
 	// Authenticate request: check if the requestor is known and allowed to submit requests.
 	// We do this by feeding the HTTP POST details to all known authenticators, and see if
 	// one of them is applicable and able to authenticate the request.
@@ -266,6 +352,7 @@ func (s *Server) handleCreateSession(w http.ResponseWriter, r *http.Request) {
 	if ok := s.checkAuth(w, r, rerr, applies, body); !ok {
 		return
 	}
+	rrequest.Base().Template = template
 
 	s.createSession(w, requestor, rrequest)
 }
@@ -348,22 +435,89 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleResult writes the session result. The disclosed attributes can be filtered using the
+// attributes query parameter, containing a comma-separated list of attribute types that must have
+// been requested in the session, and format=flat returns only the values of the disclosed
+// attributes by their type. Result JWTs and callbacks always contain all disclosed attributes.
 func (s *Server) handleResult(w http.ResponseWriter, r *http.Request) {
 	requestorToken := r.Context().Value("requestorToken").(irma.RequestorToken)
 
-	res, err := s.irmaserv.GetSessionResult(requestorToken)
+	// Check the query before fetching the result, which may delete it (see DeleteResultOnRead)
+	var flat bool
+	switch format := r.URL.Query().Get("format"); format {
+	case "":
+	case "flat":
+		flat = true
+	default:
+		server.WriteError(w, server.ErrorInvalidRequest, "unsupported result format "+format)
+		return
+	}
+	attrs, ok := s.resultAttributes(w, r, requestorToken)
+	if !ok {
+		return
+	}
+
+	res, err := s.irmaserv.FetchSessionResult(requestorToken)
 	if err != nil {
 		mapToServerError(w, err)
 		return
 	}
 
-	if res.LegacySession {
-		server.WriteJson(w, res.Legacy())
+	if attrs != nil {
+		res = server.FilteredResult(res, attrs)
+	}
+	if flat {
+		server.SetLoggedResponse(r, server.FlatResult(server.LoggedResult(res)))
+		server.WriteJson(w, server.FlatResult(res), r)
+	} else if res.LegacySession {
+		server.SetLoggedResponse(r, server.LoggedResult(res).Legacy())
+		server.WriteJson(w, res.Legacy(), r)
 	} else {
-		server.WriteJson(w, res)
+		server.SetLoggedResponse(r, server.LoggedResult(res))
+		server.WriteJson(w, res, r)
 	}
 }
 
+// resultAttributes returns the attribute types in the attributes query parameter of the result
+// endpoint, if present, or else writes an error if they were not all requested in the session.
+func (s *Server) resultAttributes(w http.ResponseWriter, r *http.Request, requestorToken irma.RequestorToken) ([]irma.AttributeTypeIdentifier, bool) {
+	params := r.URL.Query()["attributes"]
+	if len(params) == 0 {
+		return nil, true
+	}
+
+	request, err := s.irmaserv.GetRequest(requestorToken)
+	if err != nil {
+		mapToServerError(w, err)
+		return nil, false
+	}
+	requested := map[irma.AttributeTypeIdentifier]struct{}{}
+	_ = request.SessionRequest().Disclosure().Disclose.Iterate(func(attr *irma.AttributeRequest) error {
+		requested[attr.Type] = struct{}{}
+		return nil
+	})
+
+	var attrs []irma.AttributeTypeIdentifier
+	for _, param := range params {
+		for _, id := range strings.Split(param, ",") {
+			if id = strings.TrimSpace(id); id == "" {
+				continue
+			}
+			attr, err := irma.ParseAttributeTypeIdentifier(id)
+			if err != nil {
+				server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+				return nil, false
+			}
+			if _, ok := requested[attr]; !ok {
+				server.WriteError(w, server.ErrorInvalidRequest, "attribute "+id+" was not requested in the session")
+				return nil, false
+			}
+			attrs = append(attrs, attr)
+		}
+	}
+	return attrs, true
+}
+
 func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
 	if s.conf.JwtRSAPrivateKey == nil {
 		s.conf.Logger.Warn("Session result JWT requested but no JWT private key is configured")
@@ -373,11 +527,12 @@ func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
 
 	requestorToken := r.Context().Value("requestorToken").(irma.RequestorToken)
 
-	res, err := s.irmaserv.GetSessionResult(requestorToken)
+	res, err := s.irmaserv.FetchSessionResult(requestorToken)
 	if err != nil {
 		mapToServerError(w, err)
 		return
 	}
+	server.SetLoggedResponse(r, server.LoggedResult(res))
 
 	request, err := s.irmaserv.GetRequest(res.Token)
 	if err != nil {
@@ -389,6 +544,7 @@ func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
 		s.conf.JwtIssuer,
 		request.Base().ResultJwtValidity,
 		s.conf.JwtRSAPrivateKey,
+		request.Base().ResultJwtProofDetails,
 	)
 	if err != nil {
 		s.conf.Logger.Error("Failed to sign session result JWT")
@@ -396,7 +552,7 @@ func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
 		server.WriteError(w, server.ErrorUnknown, err.Error())
 		return
 	}
-	server.WriteString(w, j)
+	server.WriteString(w, j, r)
 }
 
 func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
@@ -407,11 +563,12 @@ func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	requestorToken := r.Context().Value("requestorToken").(irma.RequestorToken)
-	res, err := s.irmaserv.GetSessionResult(requestorToken)
+	res, err := s.irmaserv.FetchSessionResult(requestorToken)
 	if err != nil {
 		mapToServerError(w, err)
 		return
 	}
+	server.SetLoggedResponse(r, server.LoggedResult(res))
 
 	claims := jwt.MapClaims{}
 
@@ -486,9 +643,17 @@ func (s *Server) handlePublicKey(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) createSession(w http.ResponseWriter, requestor string, rrequest irma.RequestorRequest) {
+	// Session types disabled on this server are refused whatever the permissions of the requestor
+	request := rrequest.SessionRequest()
+	if !s.conf.SessionTypeEnabled(request.Action()) {
+		s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "action": request.Action()}).
+			Warn("Requestor attempted to start session of disabled type")
+		server.WriteError(w, server.ErrorSessionTypeDisabled, string(request.Action()))
+		return
+	}
+
 	// Authorize request: check if the requestor is allowed to verify or issue
 	// the requested attributes or credentials
-	request := rrequest.SessionRequest()
 	if request.Action() == irma.ActionIssuing {
 		allowed, reason := s.conf.CanIssue(requestor, request.(*irma.IssuanceRequest).Credentials)
 		if !allowed {
@@ -530,10 +695,15 @@ func (s *Server) createSession(w http.ResponseWriter, requestor string, rrequest
 	}
 
 	// Everything is authenticated and parsed, we're good to go!
-	qr, requestorToken, frontendRequest, err := s.irmaserv.StartSession(rrequest, nil)
+	qr, requestorToken, frontendRequest, err := s.irmaserv.StartRequestorSession(rrequest, nil, requestor)
 	if err != nil {
 		if _, ok := err.(*irmaserver.RedisError); ok {
 			server.WriteError(w, server.ErrorInternal, "")
+		} else if _, ok := err.(*irmaserver.TooManySessionsError); ok {
+			s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn(err.Error())
+			server.WriteError(w, server.ErrorTooManySessions, err.Error())
+		} else if _, ok := err.(*irmaserver.SessionTypeDisabledError); ok {
+			server.WriteError(w, server.ErrorSessionTypeDisabled, err.Error())
 		} else {
 			server.WriteError(w, server.ErrorInvalidRequest, err.Error())
 		}
@@ -593,7 +763,76 @@ func (s *Server) checkAuth(w http.ResponseWriter, r *http.Request, rerr *irma.Re
 func mapToServerError(w http.ResponseWriter, err error) {
 	if _, ok := err.(*irmaserver.UnknownSessionError); ok {
 		server.WriteError(w, server.ErrorSessionUnknown, "")
+	} else if _, ok := err.(*irmaserver.ResultConsumedError); ok {
+		server.WriteError(w, server.ErrorResultConsumed, "")
 	} else {
 		server.WriteError(w, server.ErrorInternal, "")
 	}
 }
+
+// expandTemplate returns the JSON of the expanded request and the template name if the body is a
+// reference to a request template, and the body itself otherwise.
+func (s *Server) expandTemplate(body []byte) ([]byte, string, *irma.RemoteError) {
+	ref, err := parseTemplateReference(body)
+	if err != nil {
+		return nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+	}
+	if ref == nil {
+		return body, "", nil
+	}
+	rrequest, rerr := s.templates.expand(ref)
+	if rerr != nil {
+		return nil, "", rerr
+	}
+	expanded, err := json.Marshal(rrequest)
+	if err != nil {
+		return nil, "", server.RemoteError(server.ErrorInternal, err.Error())
+	}
+	return expanded, ref.Template, nil
+}
+
+// adminMiddleware only allows requests containing the configured admin token.
+func (s *Server) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.conf.AdminToken)) != 1 {
+			s.conf.Logger.Warn("Administration request with invalid token")
+			server.WriteError(w, server.ErrorUnauthorized, "invalid administration token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleAdminTemplates(w http.ResponseWriter, r *http.Request) {
+	server.WriteJson(w, s.templates.all())
+}
+
+func (s *Server) handleAdminStaticSessions(w http.ResponseWriter, r *http.Request) {
+	server.WriteJson(w, s.irmaserv.StaticSessions())
+}
+
+func (s *Server) handleAdminPutTemplate(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	name := chi.URLParam(r, "name")
+	if err = s.templates.put(name, body); err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	s.conf.Logger.WithField("template", name).Info("Request template registered")
+	server.WriteString(w, "OK")
+}
+
+func (s *Server) handleAdminDeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if !s.templates.delete(name) {
+		server.WriteError(w, server.ErrorUnknownTemplate, name)
+		return
+	}
+	s.conf.Logger.WithField("template", name).Info("Request template deleted")
+	server.WriteString(w, "OK")
+}
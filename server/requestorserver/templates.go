@@ -0,0 +1,172 @@
+package requestorserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// Session requests can be registered as named templates, in the configuration (request_templates)
+// or using the administration endpoints. Instead of a full session request, requestors can then
+// send a template reference of the form
+//
+//	{"template": "age-check-v2", "overrides": {"clientReturnUrl": "https://example.com"}}
+//
+// which is expanded to the template, with the overridden fields replaced, before the request is
+// authenticated and authorized. Templates are stored as JSON and parsed again on every expansion,
+// so that updating a template does not affect sessions that were already started with it.
+
+var templateNameRegex = regexp.MustCompile("^[a-zA-Z0-9_.-]+$")
+
+// TemplateReference refers to a registered request template, with which a session is started.
+type TemplateReference struct {
+	Template  string          `json:"template"`
+	Overrides json.RawMessage `json:"overrides,omitempty"`
+}
+
+// TemplateOverrides contains the fields of a request template that can be overridden per session.
+type TemplateOverrides struct {
+	// Labels of the disjunctions of the disclosure, by index
+	Labels map[int]irma.TranslatedString `json:"labels,omitempty"`
+	// URL to proceed to when the session is completed
+	ClientReturnURL string `json:"clientReturnUrl,omitempty"`
+}
+
+// requestTemplates contains the registered request templates by name.
+type requestTemplates struct {
+	sync.RWMutex
+	templates map[string]json.RawMessage
+}
+
+func newRequestTemplates(templates map[string]interface{}) (*requestTemplates, error) {
+	t := &requestTemplates{templates: map[string]json.RawMessage{}}
+	for name, template := range templates {
+		bts, err := json.Marshal(template)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "failed to parse request template "+name, 0)
+		}
+		if err = t.put(name, bts); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// put registers the session request as template under the specified name, replacing the template
+// previously registered under that name, if any.
+func (t *requestTemplates) put(name string, request []byte) error {
+	if !templateNameRegex.MatchString(name) {
+		return errors.Errorf("request template name %s not allowed, must consist of letters, digits, '_', '.' and '-'", name)
+	}
+	if _, err := server.ParseSessionRequest(request); err != nil {
+		return errors.WrapPrefix(err, "failed to parse request template "+name, 0)
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, request); err != nil {
+		return errors.WrapPrefix(err, "failed to parse request template "+name, 0)
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.templates[name] = buf.Bytes()
+	return nil
+}
+
+// delete removes the specified template, returning whether it was registered.
+func (t *requestTemplates) delete(name string) bool {
+	t.Lock()
+	defer t.Unlock()
+	_, ok := t.templates[name]
+	delete(t.templates, name)
+	return ok
+}
+
+// all returns the registered templates, ordered by name.
+func (t *requestTemplates) all() []templateEntry {
+	t.RLock()
+	defer t.RUnlock()
+	entries := make([]templateEntry, 0, len(t.templates))
+	for name, request := range t.templates {
+		entries = append(entries, templateEntry{Name: name, Request: request})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+type templateEntry struct {
+	Name    string          `json:"name"`
+	Request json.RawMessage `json:"request"`
+}
+
+// expand returns a new session request parsed from the referenced template, to which the overrides
+// of the reference have been applied.
+func (t *requestTemplates) expand(ref *TemplateReference) (irma.RequestorRequest, *irma.RemoteError) {
+	t.RLock()
+	template, ok := t.templates[ref.Template]
+	t.RUnlock()
+	if !ok {
+		return nil, server.RemoteError(server.ErrorUnknownTemplate, ref.Template)
+	}
+
+	rrequest, err := server.ParseSessionRequest([]byte(template))
+	if err != nil {
+		return nil, server.RemoteError(server.ErrorInternal, "failed to parse request template "+ref.Template)
+	}
+	if len(ref.Overrides) > 0 {
+		var overrides TemplateOverrides
+		decoder := json.NewDecoder(bytes.NewReader(ref.Overrides))
+		decoder.DisallowUnknownFields()
+		if err = decoder.Decode(&overrides); err != nil {
+			return nil, server.RemoteError(server.ErrorInvalidRequest, "invalid template overrides: "+err.Error())
+		}
+		if err = overrides.apply(rrequest.SessionRequest()); err != nil {
+			return nil, server.RemoteError(server.ErrorInvalidRequest, "invalid template overrides: "+err.Error())
+		}
+	}
+	rrequest.Base().Template = ref.Template
+	return rrequest, nil
+}
+
+func (o *TemplateOverrides) apply(request irma.SessionRequest) error {
+	if o.ClientReturnURL != "" {
+		request.Base().ClientReturnURL = o.ClientReturnURL
+	}
+	if len(o.Labels) > 0 {
+		disclosure := request.Disclosure()
+		for i, label := range o.Labels {
+			if i < 0 || i >= len(disclosure.Disclose) {
+				return errors.Errorf("label %d does not refer to a disjunction of the request", i)
+			}
+			if disclosure.Labels == nil {
+				disclosure.Labels = map[int]irma.TranslatedString{}
+			}
+			disclosure.Labels[i] = label
+		}
+	}
+	return nil
+}
+
+// parseTemplateReference returns the template reference contained in the JSON session request body,
+// if it is one.
+func parseTemplateReference(body []byte) (*TemplateReference, error) {
+	var ref TemplateReference
+	if err := json.Unmarshal(body, &ref); err != nil || ref.Template == "" {
+		return nil, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	for field := range fields {
+		if field != "template" && field != "overrides" {
+			return nil, errors.Errorf("template reference contains unsupported field %s", field)
+		}
+	}
+	return &ref, nil
+}
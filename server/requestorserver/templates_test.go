@@ -0,0 +1,51 @@
+package requestorserver
+
+import (
+	"encoding/json"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestTemplateExpansion(t *testing.T) {
+	templates, err := newRequestTemplates(map[string]interface{}{
+		"age-check-v2": irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLower.over18")),
+	})
+	require.NoError(t, err)
+
+	ref, err := parseTemplateReference([]byte(`{"template": "age-check-v2", "overrides": {"labels": {"0": {"en": "Age"}}, "clientReturnUrl": "https://example.com"}}`))
+	require.NoError(t, err)
+	rrequest, rerr := templates.expand(ref)
+	require.Nil(t, rerr)
+	require.Equal(t, "age-check-v2", rrequest.Base().Template)
+	require.Equal(t, "https://example.com", rrequest.SessionRequest().Base().ClientReturnURL)
+	require.Equal(t, "Age", rrequest.SessionRequest().Disclosure().Labels[0]["en"])
+
+	// Overrides do not affect the template itself
+	rrequest, rerr = templates.expand(&TemplateReference{Template: "age-check-v2"})
+	require.Nil(t, rerr)
+	require.Empty(t, rrequest.SessionRequest().Base().ClientReturnURL)
+	require.Empty(t, rrequest.SessionRequest().Disclosure().Labels[0]["en"])
+
+	// Expanded requests are independent of later template updates
+	require.NoError(t, templates.put("age-check-v2", []byte(`{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.MijnOverheid.ageLower.over12"]]]}`)))
+	require.Equal(t, "irma-demo.MijnOverheid.ageLower.over18", rrequest.SessionRequest().Disclosure().Disclose[0][0][0].Type.String())
+
+	_, rerr = templates.expand(&TemplateReference{Template: "age-check-v2", Overrides: json.RawMessage(`{"labels": {"1": {"en": "Age"}}}`)})
+	require.NotNil(t, rerr)
+	_, rerr = templates.expand(&TemplateReference{Template: "age-check-v2", Overrides: json.RawMessage(`{"callbackUrl": "https://example.com"}`)})
+	require.NotNil(t, rerr)
+	_, rerr = templates.expand(&TemplateReference{Template: "unknown"})
+	require.Equal(t, "UNKNOWN_TEMPLATE", rerr.ErrorName)
+
+	// Regular requests and references containing other fields
+	ref, err = parseTemplateReference([]byte(`{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.MijnOverheid.ageLower.over12"]]]}`))
+	require.NoError(t, err)
+	require.Nil(t, ref)
+	_, err = parseTemplateReference([]byte(`{"template": "age-check-v2", "validity": 60}`))
+	require.Error(t, err)
+
+	require.Error(t, templates.put("age check", []byte(`{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.MijnOverheid.ageLower.over12"]]]}`)))
+	require.Error(t, templates.put("invalid", []byte(`{"disclose": 1}`)))
+}
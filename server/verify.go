@@ -0,0 +1,254 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/privacybydesign/gabi"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// VerificationResult is the outcome of verifying a disclosure or attribute-based signature,
+// including the status of each of the credentials contained in it.
+type VerificationResult struct {
+	ProofStatus irma.ProofStatus             `json:"proofStatus"`
+	Disclosed   [][]*irma.DisclosedAttribute `json:"disclosed,omitempty"`
+	Credentials []*CredentialStatus          `json:"credentials,omitempty"`
+	Issues      []ProofIssue                 `json:"issues,omitempty"`
+}
+
+// CredentialStatus describes the verification status of a single credential of a proof.
+// Note that the cryptographic validity of the proofs can only be established for all credentials
+// together, so it is reported in the ProofStatus of the VerificationResult instead of here.
+type CredentialStatus struct {
+	CredentialType irma.CredentialTypeIdentifier `json:"credentialType,omitempty"`
+	PublicKey      *irma.PublicKeyIdentifier     `json:"publicKey,omitempty"`
+	SigningDate    irma.Timestamp                `json:"signingDate"`
+	Expiry         irma.Timestamp                `json:"expiry"`
+	Status         CredentialStatusType          `json:"status"`
+	// Whether the credential is marked as test credential, see irma.MetadataAttribute.IsTestCredential
+	TestCredential bool `json:"testCredential,omitempty"`
+}
+
+type CredentialStatusType string
+
+const (
+	CredentialStatusValid                 = CredentialStatusType("VALID")                   // Credential was valid
+	CredentialStatusExpired               = CredentialStatusType("EXPIRED")                 // Credential was expired at proof creation time
+	CredentialStatusUnknownCredentialType = CredentialStatusType("UNKNOWN_CREDENTIAL_TYPE") // Credential type not present in the configuration
+	CredentialStatusUnknownPublicKey      = CredentialStatusType("UNKNOWN_PUBLIC_KEY")      // Issuer public key not present in the configuration
+	CredentialStatusInvalidMetadata       = CredentialStatusType("INVALID_METADATA")        // Credential was issued after its expiry date or that of its public key
+	CredentialStatusNotDisclosed          = CredentialStatusType("NOT_DISCLOSED")           // Proof is not a disclosure proof
+)
+
+// ProofIssue describes a reason why a proof is not valid. Issues concerning a specific credential
+// or disjunction of the request identify it.
+type ProofIssue struct {
+	// Credential type of the credential, or the first requested attribute of the disjunction, if any
+	Identifier string         `json:"identifier,omitempty"`
+	Code       ProofIssueCode `json:"code"`
+	Message    string         `json:"message"`
+}
+
+type ProofIssueCode string
+
+const (
+	ProofIssueInvalidProof          = ProofIssueCode("INVALID_PROOF")                       // Proofs are cryptographically invalid, or lack required nonrevocation proofs
+	ProofIssueUnmatchedRequest      = ProofIssueCode("UNMATCHED_REQUEST")                   // Attribute-based signature does not correspond to the request
+	ProofIssueInvalidTimestamp      = ProofIssueCode("INVALID_TIMESTAMP")                   // Attribute-based signature has an invalid timestamp
+	ProofIssueMissingAttributes     = ProofIssueCode("MISSING_ATTRIBUTES")                  // Disclosed attributes do not satisfy a disjunction of the request
+	ProofIssueExpired               = ProofIssueCode(CredentialStatusExpired)               // Credential was expired at proof creation time
+	ProofIssueUnknownCredentialType = ProofIssueCode(CredentialStatusUnknownCredentialType) // Credential type not present in the configuration
+	ProofIssueUnknownPublicKey      = ProofIssueCode(CredentialStatusUnknownPublicKey)      // Issuer public key not present in the configuration
+	ProofIssueInvalidMetadata       = ProofIssueCode(CredentialStatusInvalidMetadata)       // Credential was issued after its expiry date or that of its public key
+	ProofIssueTestCredential        = ProofIssueCode("TEST_CREDENTIAL")                     // Credential is a test credential, which the verifier does not accept
+)
+
+// VerifyDisclosure verifies the disclosure against the request, returning the overall proof status
+// and disclosed attributes as irma.Disclosure.Verify() does, along with the status of each contained
+// credential.
+func VerifyDisclosure(conf *irma.Configuration, request *irma.DisclosureRequest, proof *irma.Disclosure) (*VerificationResult, error) {
+	disclosed, status, err := proof.Verify(conf, request)
+	credentials := credentialStatuses(conf, proof.Proofs, time.Now())
+	return &VerificationResult{
+		ProofStatus: status,
+		Disclosed:   disclosed,
+		Credentials: credentials,
+		Issues:      proofIssues(status, request.Disclose, disclosed, credentials),
+	}, err
+}
+
+// VerifySignature verifies the attribute-based signature, optionally against the request, returning
+// the overall proof status and disclosed attributes as irma.SignedMessage.Verify() does, along with the
+// status of each contained credential.
+func VerifySignature(conf *irma.Configuration, request *irma.SignatureRequest, signature *irma.SignedMessage) (*VerificationResult, error) {
+	disclosed, status, err := signature.Verify(conf, request)
+	t := time.Now()
+	if signature.Timestamp != nil && status != irma.ProofStatusInvalidTimestamp {
+		t = time.Unix(signature.Timestamp.Time, 0)
+	}
+	var condiscon irma.AttributeConDisCon
+	if request != nil {
+		condiscon = request.Disclose
+	}
+	credentials := credentialStatuses(conf, signature.Signature, t)
+	return &VerificationResult{
+		ProofStatus: status,
+		Disclosed:   disclosed,
+		Credentials: credentials,
+		Issues:      proofIssues(status, condiscon, disclosed, credentials),
+	}, err
+}
+
+// RejectTestCredentials changes the proof status of a valid result containing test credentials
+// (see irma.MetadataAttribute.IsTestCredential) to irma.ProofStatusTestCredential, for verifiers
+// that do not accept them.
+func (result *VerificationResult) RejectTestCredentials() {
+	if result.ProofStatus != irma.ProofStatusValid || !TestCredentialDisclosed(result.Disclosed) {
+		return
+	}
+	result.ProofStatus = irma.ProofStatusTestCredential
+	result.Issues = proofIssues(result.ProofStatus, nil, result.Disclosed, result.Credentials)
+}
+
+// TestCredentialDisclosed returns whether any of the disclosed attributes was disclosed out of a
+// test credential.
+func TestCredentialDisclosed(disclosed [][]*irma.DisclosedAttribute) bool {
+	for _, attrs := range disclosed {
+		for _, attr := range attrs {
+			if attr.TestCredential {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ProofIssues explains why the proofs, as verified by irma.Disclosure.VerifyAgainstRequest() at the
+// specified time resulting in the given proof status and disclosed attributes, are not valid.
+func ProofIssues(
+	conf *irma.Configuration,
+	proofs gabi.ProofList,
+	condiscon irma.AttributeConDisCon,
+	status irma.ProofStatus,
+	disclosed [][]*irma.DisclosedAttribute,
+	validAt time.Time,
+) []ProofIssue {
+	if status == irma.ProofStatusValid {
+		return nil
+	}
+	return proofIssues(status, condiscon, disclosed, credentialStatuses(conf, proofs, validAt))
+}
+
+func proofIssues(
+	status irma.ProofStatus,
+	condiscon irma.AttributeConDisCon,
+	disclosed [][]*irma.DisclosedAttribute,
+	credentials []*CredentialStatus,
+) []ProofIssue {
+	var issues []ProofIssue
+	switch status {
+	case irma.ProofStatusValid:
+		return nil
+	case irma.ProofStatusInvalid:
+		issues = append(issues, ProofIssue{Code: ProofIssueInvalidProof, Message: "proofs are invalid"})
+	case irma.ProofStatusUnmatchedRequest:
+		return []ProofIssue{{Code: ProofIssueUnmatchedRequest, Message: "signature does not correspond to the request"}}
+	case irma.ProofStatusInvalidTimestamp:
+		return []ProofIssue{{Code: ProofIssueInvalidTimestamp, Message: "signature has an invalid timestamp"}}
+	case irma.ProofStatusTestCredential:
+		for _, cred := range credentials {
+			if cred.TestCredential {
+				issues = append(issues, ProofIssue{
+					Identifier: cred.CredentialType.String(),
+					Code:       ProofIssueTestCredential,
+					Message:    "credential is a test credential",
+				})
+			}
+		}
+		return issues
+	case irma.ProofStatusMissingAttributes:
+		for i, discon := range condiscon {
+			// The attributes satisfying the i'th disjunction are in disclosed[i], unless it is nil, or
+			// contains the extra attributes if the disclosure did not address all disjunctions
+			if i < len(disclosed) && disclosed[i] != nil &&
+				(len(disclosed[i]) == 0 || disclosed[i][0].Status != irma.AttributeProofStatusExtra) {
+				continue
+			}
+			issue := ProofIssue{
+				Code:    ProofIssueMissingAttributes,
+				Message: fmt.Sprintf("disclosed attributes do not satisfy disjunction %d of the request", i+1),
+			}
+			if len(discon) > 0 && len(discon[0]) > 0 {
+				issue.Identifier = discon[0][0].Type.String()
+			}
+			issues = append(issues, issue)
+		}
+	}
+
+	for _, cred := range credentials {
+		issue := ProofIssue{Code: ProofIssueCode(cred.Status)}
+		if cred.CredentialType.String() != "" {
+			issue.Identifier = cred.CredentialType.String()
+		}
+		switch cred.Status {
+		case CredentialStatusExpired:
+			issue.Message = fmt.Sprintf("credential expired at %s", time.Time(cred.Expiry).UTC().Format(time.RFC3339))
+		case CredentialStatusUnknownCredentialType:
+			issue.Message = "credential type not present in the configuration"
+		case CredentialStatusUnknownPublicKey:
+			issue.Message = fmt.Sprintf("issuer public key %s-%d not present in the configuration", cred.PublicKey.Issuer, cred.PublicKey.Counter)
+		case CredentialStatusInvalidMetadata:
+			issue.Message = "credential was issued after its expiry date or that of its public key"
+		default:
+			continue
+		}
+		issues = append(issues, issue)
+	}
+	return issues
+}
+
+func credentialStatuses(conf *irma.Configuration, proofs gabi.ProofList, validAt time.Time) []*CredentialStatus {
+	statuses := make([]*CredentialStatus, 0, len(proofs))
+	for _, proof := range proofs {
+		statuses = append(statuses, credentialStatus(conf, proof, validAt))
+	}
+	return statuses
+}
+
+func credentialStatus(conf *irma.Configuration, proof gabi.Proof, validAt time.Time) *CredentialStatus {
+	proofd, ok := proof.(*gabi.ProofD)
+	if !ok || len(proofd.ADisclosed) < 2 || proofd.ADisclosed[1] == nil {
+		return &CredentialStatus{Status: CredentialStatusNotDisclosed}
+	}
+
+	metadata := irma.MetadataFromInt(proofd.ADisclosed[1], conf) // index 1 is metadata attribute
+	status := &CredentialStatus{
+		SigningDate:    irma.Timestamp(metadata.SigningDate()),
+		Expiry:         irma.Timestamp(metadata.Expiry()),
+		TestCredential: metadata.IsTestCredential(),
+	}
+	credtype := metadata.CredentialType()
+	if credtype == nil {
+		status.Status = CredentialStatusUnknownCredentialType
+		return status
+	}
+	status.CredentialType = credtype.Identifier()
+	status.PublicKey = &irma.PublicKeyIdentifier{
+		Issuer:  credtype.IssuerIdentifier(),
+		Counter: metadata.KeyCounter(),
+	}
+
+	pk, err := metadata.PublicKey()
+	switch {
+	case err != nil || pk == nil:
+		status.Status = CredentialStatusUnknownPublicKey
+	case metadata.SigningDate().Unix() > pk.ExpiryDate || metadata.SigningDate().After(metadata.Expiry()):
+		status.Status = CredentialStatusInvalidMetadata
+	case metadata.Expiry().Before(validAt.Add(-conf.ClockSkewTolerance())):
+		status.Status = CredentialStatusExpired
+	default:
+		status.Status = CredentialStatusValid
+	}
+	return status
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProofIssues(t *testing.T) {
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	fullName := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.familyname")
+	condiscon := irma.AttributeConDisCon{
+		irma.AttributeDisCon{irma.AttributeCon{{Type: studentID}}},
+		irma.AttributeDisCon{irma.AttributeCon{{Type: fullName}}},
+	}
+	value := "s1234567"
+	present := []*irma.DisclosedAttribute{{Identifier: studentID, RawValue: &value, Status: irma.AttributeProofStatusPresent}}
+	extra := []*irma.DisclosedAttribute{{Identifier: studentID, RawValue: &value, Status: irma.AttributeProofStatusExtra}}
+	valid := []*CredentialStatus{{CredentialType: studentCard, Status: CredentialStatusValid}}
+
+	codes := func(issues []ProofIssue) (codes []ProofIssueCode, ids []string) {
+		for _, issue := range issues {
+			require.NotEmpty(t, issue.Message)
+			codes = append(codes, issue.Code)
+			ids = append(ids, issue.Identifier)
+		}
+		return
+	}
+
+	require.Empty(t, proofIssues(irma.ProofStatusValid, condiscon, [][]*irma.DisclosedAttribute{present, present}, valid))
+
+	c, _ := codes(proofIssues(irma.ProofStatusInvalid, condiscon, nil, valid))
+	require.Equal(t, []ProofIssueCode{ProofIssueInvalidProof}, c)
+	c, _ = codes(proofIssues(irma.ProofStatusUnmatchedRequest, condiscon, nil, valid))
+	require.Equal(t, []ProofIssueCode{ProofIssueUnmatchedRequest}, c)
+	c, _ = codes(proofIssues(irma.ProofStatusInvalidTimestamp, condiscon, nil, valid))
+	require.Equal(t, []ProofIssueCode{ProofIssueInvalidTimestamp}, c)
+
+	// Disclosed attributes not matching the second disjunction
+	c, ids := codes(proofIssues(irma.ProofStatusMissingAttributes, condiscon, [][]*irma.DisclosedAttribute{present, nil}, valid))
+	require.Equal(t, []ProofIssueCode{ProofIssueMissingAttributes}, c)
+	require.Equal(t, []string{fullName.String()}, ids)
+
+	// Disclosure not addressing the disjunctions at all, containing only extra attributes
+	c, ids = codes(proofIssues(irma.ProofStatusMissingAttributes, condiscon, [][]*irma.DisclosedAttribute{extra}, valid))
+	require.Equal(t, []ProofIssueCode{ProofIssueMissingAttributes, ProofIssueMissingAttributes}, c)
+	require.Equal(t, []string{studentID.String(), fullName.String()}, ids)
+
+	// Issues of individual credentials
+	credentials := []*CredentialStatus{
+		{CredentialType: studentCard, Status: CredentialStatusValid},
+		{CredentialType: studentCard, Status: CredentialStatusExpired, Expiry: irma.Timestamp(time.Now().Add(-time.Hour))},
+		{Status: CredentialStatusUnknownCredentialType},
+		{CredentialType: studentCard, Status: CredentialStatusUnknownPublicKey,
+			PublicKey: &irma.PublicKeyIdentifier{Issuer: studentCard.IssuerIdentifier(), Counter: 7}},
+		{CredentialType: studentCard, Status: CredentialStatusInvalidMetadata},
+		{Status: CredentialStatusNotDisclosed},
+	}
+	c, ids = codes(proofIssues(irma.ProofStatusExpired, condiscon, [][]*irma.DisclosedAttribute{present, present}, credentials))
+	require.Equal(t, []ProofIssueCode{ProofIssueExpired, ProofIssueUnknownCredentialType, ProofIssueUnknownPublicKey, ProofIssueInvalidMetadata}, c)
+	require.Equal(t, []string{studentCard.String(), "", studentCard.String(), studentCard.String()}, ids)
+
+	// Credential issues are also reported next to invalid proofs
+	c, _ = codes(proofIssues(irma.ProofStatusInvalid, condiscon, nil, credentials[:2]))
+	require.Equal(t, []ProofIssueCode{ProofIssueInvalidProof, ProofIssueExpired}, c)
+}
+
+func TestResultJwtProofDetails(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	result := &SessionResult{
+		Type:         irma.ActionDisclosing,
+		ProofStatus:  irma.ProofStatusInvalid,
+		ProofDetails: []ProofIssue{{Code: ProofIssueInvalidProof, Message: "proofs are invalid"}},
+	}
+
+	parse := func(j string) *SessionResult {
+		claims := &struct {
+			jwt.StandardClaims
+			*SessionResult
+		}{SessionResult: &SessionResult{}}
+		_, err := jwt.ParseWithClaims(j, claims, func(*jwt.Token) (interface{}, error) { return &key.PublicKey, nil })
+		require.NoError(t, err)
+		return claims.SessionResult
+	}
+
+	// Proof details are omitted by default, without modifying the result
+	j, err := ResultJwt(result, "testserver", 60, key, false)
+	require.NoError(t, err)
+	parsed := parse(j)
+	require.Equal(t, irma.ProofStatusInvalid, parsed.ProofStatus)
+	require.Nil(t, parsed.ProofDetails)
+	require.Len(t, result.ProofDetails, 1)
+
+	j, err = ResultJwt(result, "testserver", 60, key, true)
+	require.NoError(t, err)
+	require.Equal(t, result.ProofDetails, parse(j).ProofDetails)
+}
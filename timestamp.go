@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/asn1"
 	gobig "math/big"
+	"time"
 
 	"github.com/bwesterb/go-atum"
 	"github.com/go-errors/errors"
@@ -100,7 +101,8 @@ func TimestampRequest(message string, sigs []*big.Int, disclosed [][]*big.Int, n
 }
 
 // Given an SignedMessage, verify the timestamp over the signed message, disclosed attributes,
-// and rerandomized CL-signatures.
+// and rerandomized CL-signatures, and that it does not lie in the future (tolerating the
+// ClockSkewTolerance() of the configuration).
 func (sm *SignedMessage) VerifyTimestamp(message string, conf *Configuration) error {
 	// Extract the disclosed attributes and randomized CL-signatures from the proofs in order to
 	// construct the nonce that should be signed by the timestamp server.
@@ -139,5 +141,8 @@ func (sm *SignedMessage) VerifyTimestamp(message string, conf *Configuration) er
 	if !valid {
 		return errors.New("Timestamp signature invalid")
 	}
+	if time.Unix(sm.Timestamp.Time, 0).After(time.Now().Add(conf.ClockSkewTolerance())) {
+		return errors.New("Timestamp lies in the future")
+	}
 	return nil
 }
@@ -6,12 +6,14 @@ import (
 	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
+	goerrors "errors"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -34,10 +36,44 @@ type HTTPTransport struct {
 	ForceHTTPS bool
 	client     *retryablehttp.Client
 	headers    http.Header
+	ctx        context.Context
+
+	// SunsetHandler, if set, is invoked when a response contains Deprecation or Sunset headers.
+	SunsetHandler func(*SunsetAnnouncement)
+
+	// UnavailableHandler, if set, is invoked when a request fails because the server could not be
+	// reached or responded with 503 Service Unavailable, before the error is returned.
+	UnavailableHandler func(*SessionError)
+
+	// MaxRetryAfter is the longest delay after which requests are retried that the server refused
+	// with 429 Too Many Requests or 503 Service Unavailable, and a Retry-After header specifying
+	// that delay. Requests are retried at most MaxRetryAfterAttempts times, and not if the delay
+	// exceeds the deadline of the context of the transport. If zero, requests are not retried.
+	MaxRetryAfter time.Duration
+
+	// LoggedBody, if set, is logged instead of the bodies of outgoing requests, for requests
+	// containing data that should not be logged as is.
+	LoggedBody interface{}
+}
+
+// SunsetAnnouncement contains what a server announced in the Deprecation and Sunset response
+// headers (see RFC 8594) about when it will stop supporting the protocol in use.
+type SunsetAnnouncement struct {
+	Deprecated  bool       // whether the protocol in use is deprecated
+	Deprecation *time.Time // when the protocol is or was deprecated, if specified
+	Sunset      *time.Time // when the server stops supporting the protocol, if specified
 }
 
 var HTTPHeaders = map[string]http.Header{}
 
+// MaxRetryAfterAttempts is the amount of times that a request is retried after the delay that the
+// server specified in its Retry-After header (see HTTPTransport.MaxRetryAfter).
+const MaxRetryAfterAttempts = 3
+
+// ErrRequestRefused can be wrapped in the errors of dial functions set using HTTPTransport.SetDialer,
+// to refuse a request without it being retried.
+var ErrRequestRefused = goerrors.New("request refused")
+
 // Logger is used for logging. If not set, init() will initialize it to logrus.StandardLogger().
 var Logger *logrus.Logger
 
@@ -60,7 +96,19 @@ func SetLogger(logger *logrus.Logger) {
 	gabi.Logger = Logger
 	common.Logger = Logger
 	revocation.Logger = Logger
-	sseclient.Logger = log.New(Logger.WithField("type", "sseclient").WriterLevel(logrus.TraceLevel), "", 0)
+	sseclient.Logger = log.New(logWriter{Logger.WithField("type", "sseclient"), logrus.TraceLevel}, "", 0)
+}
+
+// logWriter logs everything written to it as separate log entries. Contrary to the writer returned
+// by logrus.Entry.WriterLevel() it does not start a goroutine, so it need not be closed.
+type logWriter struct {
+	entry *logrus.Entry
+	level logrus.Level
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.entry.Log(w.level, strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
 }
 
 // SetTLSClientConfig sets the TLS configuration being used for future outbound connections.
@@ -103,6 +151,12 @@ func NewHTTPTransport(serverURL string, forceHTTPS bool) *HTTPTransport {
 		RetryMax:     2,
 		Backoff:      retryablehttp.DefaultBackoff,
 		CheckRetry: func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+			if goerrors.Is(err, ErrRequestRefused) {
+				return false, err
+			}
 			// Don't retry on 5xx (which retryablehttp does by default)
 			return err != nil || resp.StatusCode == 0, err
 		},
@@ -131,6 +185,17 @@ func NewHTTPTransport(serverURL string, forceHTTPS bool) *HTTPTransport {
 	}
 }
 
+// SetDialer makes the transport open connections using dial instead of net.Dial, e.g. to restrict
+// the addresses to which requests can be sent, and sets the timeout of requests if it is not zero.
+func (transport *HTTPTransport) SetDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error), timeout time.Duration) {
+	inner := transport.client.HTTPClient.Transport.(*http.Transport)
+	inner.Dial = nil
+	inner.DialContext = dial
+	if timeout != 0 {
+		transport.client.HTTPClient.Timeout = timeout
+	}
+}
+
 func (transport *HTTPTransport) marshal(o interface{}) ([]byte, error) {
 	if transport.Binary {
 		return MarshalBinary(o)
@@ -152,6 +217,14 @@ func (transport *HTTPTransport) unmarshalValidate(data []byte, dst interface{})
 	return UnmarshalValidate(data, dst)
 }
 
+func (transport *HTTPTransport) logBody(body interface{}, binary bool) {
+	if transport.LoggedBody != nil {
+		transport.log("body", transport.LoggedBody, false)
+	} else {
+		transport.log("body", body, binary)
+	}
+}
+
 func (transport *HTTPTransport) log(prefix string, message interface{}, binary bool) {
 	if !Logger.IsLevelEnabled(logrus.TraceLevel) {
 		return // do nothing if nothing would be printed anyway
@@ -179,6 +252,14 @@ func (transport *HTTPTransport) SetHeader(name, val string) {
 	transport.headers.Set(name, val)
 }
 
+// WithContext returns a copy of the transport whose requests are aborted when the context is done.
+// The copy shares its headers with the original.
+func (transport *HTTPTransport) WithContext(ctx context.Context) *HTTPTransport {
+	t := *transport
+	t.ctx = ctx
+	return &t
+}
+
 func (transport *HTTPTransport) request(
 	url string, method string, reader io.Reader, contenttype string,
 ) (response *http.Response, err error) {
@@ -187,7 +268,11 @@ func (transport *HTTPTransport) request(
 	if common.ForceHTTPS && transport.ForceHTTPS && !strings.HasPrefix(u, "https") {
 		return nil, &SessionError{ErrorType: ErrorHTTPS, Err: errors.New("remote server does not use https")}
 	}
-	req.Request, err = http.NewRequest(method, u, reader)
+	ctx := transport.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	req.Request, err = http.NewRequestWithContext(ctx, method, u, reader)
 	if err != nil {
 		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
 	}
@@ -200,47 +285,179 @@ func (transport *HTTPTransport) request(
 	}
 	res, err := transport.client.Do(&req)
 	if err != nil {
-		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
+		// Requests aborted by the caller do not say anything about the availability of the server
+		if ctx.Err() != nil {
+			return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
+		}
+		return nil, transport.unavailable(&SessionError{ErrorType: ErrorTransport, Err: err})
+	}
+	if transport.SunsetHandler != nil {
+		if announcement := ParseSunsetHeaders(res.Header); announcement != nil {
+			transport.SunsetHandler(announcement)
+		}
 	}
 	return res, nil
 }
 
+// send performs the request with the specified body, retrying it if the server refuses it with a
+// Retry-After header specifying a delay of at most MaxRetryAfter (see there).
+func (transport *HTTPTransport) send(url string, method string, body []byte, contenttype string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		res, err := transport.request(url, method, reader, contenttype)
+		if err != nil {
+			return nil, err
+		}
+		delay, ok := retryAfter(res)
+		if !ok || delay > transport.MaxRetryAfter || attempt == MaxRetryAfterAttempts || !transport.wait(delay) {
+			return res, nil
+		}
+		_, _ = io.Copy(ioutil.Discard, res.Body)
+		_ = res.Body.Close()
+		Logger.Debugf("%s %s refused with status %d, retried after %s", method, url, res.StatusCode, delay)
+	}
+}
+
+// wait waits for the specified delay, returning false if the context of the transport is done
+// before or would be done before the delay has passed.
+func (transport *HTTPTransport) wait(delay time.Duration) bool {
+	ctx := transport.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		return false
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// retryAfter returns the delay specified in the Retry-After header of the response, if the server
+// refused the request with 429 Too Many Requests or 503 Service Unavailable.
+func retryAfter(res *http.Response) (time.Duration, bool) {
+	if res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	return ParseRetryAfter(res.Header)
+}
+
+// ParseRetryAfter parses the Retry-After header, containing either an amount of seconds or a HTTP
+// date, into the delay after which the request may be retried. The boolean is false if the header
+// is absent or invalid.
+func ParseRetryAfter(header http.Header) (time.Duration, bool) {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		Logger.Warnf("failed to parse Retry-After header %s: %s", value, err.Error())
+		return 0, false
+	}
+	if delay := time.Until(t); delay > 0 {
+		return delay.Round(time.Second), true
+	}
+	return 0, true
+}
+
+// unavailable invokes the UnavailableHandler, if set, returning the error.
+func (transport *HTTPTransport) unavailable(err *SessionError) *SessionError {
+	if transport.UnavailableHandler != nil {
+		transport.UnavailableHandler(err)
+	}
+	return err
+}
+
+// ParseSunsetHeaders parses the Deprecation and Sunset headers, returning nil if neither is present.
+// The Sunset header contains a HTTP date; the Deprecation header contains either a HTTP date,
+// a Unix timestamp prefixed with @, or "true".
+func ParseSunsetHeaders(header http.Header) *SunsetAnnouncement {
+	deprecation, sunset := header.Get("Deprecation"), header.Get("Sunset")
+	if deprecation == "" && sunset == "" {
+		return nil
+	}
+
+	announcement := &SunsetAnnouncement{}
+	if deprecation != "" && deprecation != "false" {
+		announcement.Deprecated = true
+		if t, err := parseSunsetDate(deprecation); err == nil {
+			announcement.Deprecation = &t
+		} else if deprecation != "true" {
+			Logger.Warnf("failed to parse Deprecation header %s: %s", deprecation, err.Error())
+		}
+	}
+	if sunset != "" {
+		if t, err := parseSunsetDate(sunset); err == nil {
+			announcement.Sunset = &t
+		} else {
+			Logger.Warnf("failed to parse Sunset header %s: %s", sunset, err.Error())
+		}
+	}
+	return announcement
+}
+
+func parseSunsetDate(value string) (time.Time, error) {
+	if strings.HasPrefix(value, "@") {
+		i, err := strconv.ParseInt(value[1:], 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(i, 0), nil
+	}
+	return http.ParseTime(value)
+}
+
 func (transport *HTTPTransport) jsonRequest(url string, method string, result interface{}, object interface{}) error {
-	if method != http.MethodPost && method != http.MethodGet && method != http.MethodDelete {
+	if method != http.MethodPost && method != http.MethodPut && method != http.MethodGet && method != http.MethodDelete {
 		panic("Unsupported HTTP method " + method)
 	}
 	if method == http.MethodGet && object != nil {
 		panic("Cannot GET and also post an object")
 	}
 
-	var reader io.Reader
+	var body []byte
 	var contenttype string
 	if object != nil {
 		switch o := object.(type) {
 		case []byte:
-			transport.log("body", o, true)
+			transport.logBody(o, true)
 			contenttype = "application/octet-stream"
-			reader = bytes.NewBuffer(o)
+			body = o
 		case string:
-			transport.log("body", o, false)
+			transport.logBody(o, false)
 			contenttype = "text/plain; charset=UTF-8"
-			reader = bytes.NewBuffer([]byte(o))
+			body = []byte(o)
 		default:
 			marshaled, err := transport.marshal(object)
 			if err != nil {
 				return &SessionError{ErrorType: ErrorSerialization, Err: err}
 			}
-			transport.log("body", string(marshaled), transport.Binary)
+			transport.logBody(string(marshaled), transport.Binary)
 			if transport.Binary {
 				contenttype = "application/octet-stream"
 			} else {
 				contenttype = "application/json; charset=UTF-8"
 			}
-			reader = bytes.NewBuffer(marshaled)
+			body = marshaled
 		}
 	}
 
-	res, err := transport.request(url, method, reader, contenttype)
+	res, err := transport.send(url, method, body, contenttype)
 	if err != nil {
 		return err
 	}
@@ -250,7 +467,7 @@ func (transport *HTTPTransport) jsonRequest(url string, method string, result in
 		return nil
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
+	body, err = ioutil.ReadAll(res.Body)
 	if err != nil {
 		return &SessionError{ErrorType: ErrorServerResponse, Err: err, RemoteStatus: res.StatusCode}
 	}
@@ -264,12 +481,19 @@ func (transport *HTTPTransport) jsonRequest(url string, method string, result in
 		}
 	} else if res.StatusCode != http.StatusOK {
 		apierr := &RemoteError{}
+		var serr *SessionError
 		err = transport.unmarshal(body, apierr)
 		if err != nil || apierr.ErrorName == "" { // Not an ApiErrorMessage
-			return &SessionError{ErrorType: ErrorServerResponse, Err: err, RemoteStatus: res.StatusCode}
+			serr = &SessionError{ErrorType: ErrorServerResponse, Err: err, RemoteStatus: res.StatusCode}
+		} else {
+			transport.log("error", apierr, false)
+			serr = &SessionError{ErrorType: ErrorApi, RemoteStatus: res.StatusCode, RemoteError: apierr}
 		}
-		transport.log("error", apierr, false)
-		return &SessionError{ErrorType: ErrorApi, RemoteStatus: res.StatusCode, RemoteError: apierr}
+		serr.RetryAfter, _ = retryAfter(res)
+		if res.StatusCode == http.StatusServiceUnavailable {
+			return transport.unavailable(serr)
+		}
+		return serr
 	}
 
 	transport.log("response", body, transport.Binary)
@@ -289,13 +513,18 @@ func (transport *HTTPTransport) jsonRequest(url string, method string, result in
 }
 
 func (transport *HTTPTransport) GetBytes(url string) ([]byte, error) {
-	res, err := transport.request(url, http.MethodGet, nil, "")
+	res, err := transport.send(url, http.MethodGet, nil, "")
 	if err != nil {
 		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
 	}
 
 	if res.StatusCode != 200 {
-		return nil, &SessionError{ErrorType: ErrorServerResponse, RemoteStatus: res.StatusCode}
+		serr := &SessionError{ErrorType: ErrorServerResponse, RemoteStatus: res.StatusCode}
+		serr.RetryAfter, _ = retryAfter(res)
+		if res.StatusCode == http.StatusServiceUnavailable {
+			return nil, transport.unavailable(serr)
+		}
+		return nil, serr
 	}
 	b, err := ioutil.ReadAll(res.Body)
 	if err != nil {
@@ -314,7 +543,17 @@ func (transport *HTTPTransport) Get(url string, result interface{}) error {
 	return transport.jsonRequest(url, http.MethodGet, result, nil)
 }
 
+// Put sends the object to the server using a PUT request and parses its response into result.
+func (transport *HTTPTransport) Put(url string, result interface{}, object interface{}) error {
+	return transport.jsonRequest(url, http.MethodPut, result, object)
+}
+
 // Delete performs a DELETE.
 func (transport *HTTPTransport) Delete() error {
-	return transport.jsonRequest("", http.MethodDelete, nil, nil)
+	return transport.DeleteURL("")
+}
+
+// DeleteURL performs a DELETE of the specified URL.
+func (transport *HTTPTransport) DeleteURL(url string) error {
+	return transport.jsonRequest(url, http.MethodDelete, nil, nil)
 }
@@ -2,6 +2,8 @@ package irma
 
 import (
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
 	"time"
 
 	"github.com/go-errors/errors"
@@ -25,6 +27,7 @@ const (
 	ProofStatusUnmatchedRequest  = ProofStatus("UNMATCHED_REQUEST")  // Proof does not correspond to a specified request
 	ProofStatusMissingAttributes = ProofStatus("MISSING_ATTRIBUTES") // Proof does not contain all requested attributes
 	ProofStatusExpired           = ProofStatus("EXPIRED")            // Attributes were expired at proof creation time (now, or according to timestamp in case of abs)
+	ProofStatusTestCredential    = ProofStatus("TEST_CREDENTIAL")    // Attributes were disclosed out of test credentials, which the verifier does not accept
 
 	AttributeProofStatusPresent = AttributeProofStatus("PRESENT") // Attribute is disclosed and matches the value
 	AttributeProofStatusExtra   = AttributeProofStatus("EXTRA")   // Attribute is disclosed, but wasn't requested in request
@@ -40,6 +43,40 @@ type DisclosedAttribute struct {
 	IssuanceTime     Timestamp               `json:"issuancetime"`
 	NotRevoked       bool                    `json:"notrevoked,omitempty"`
 	NotRevokedBefore *Timestamp              `json:"notrevokedbefore,omitempty"`
+	// Only set for disjunctions of which all instances were requested: identifies the credential
+	// instance out of which the attribute was disclosed (a hash of the values disclosed out of it)
+	InstanceHash string `json:"instancehash,omitempty"`
+	// Whether the credential out of which the attribute was disclosed is marked as test credential,
+	// see MetadataAttribute.IsTestCredential
+	TestCredential bool `json:"testcredential,omitempty"`
+}
+
+const (
+	// DefaultClockSkewTolerance is the clock skew tolerance of configurations for which
+	// SetClockSkewTolerance() was not called.
+	DefaultClockSkewTolerance = 60 * time.Second
+	// MaxClockSkewTolerance is the maximum value that can be set using SetClockSkewTolerance().
+	MaxClockSkewTolerance = 5 * time.Minute
+)
+
+// ClockSkewTolerance returns the tolerated difference between the clocks of the parties involved in
+// IRMA sessions (e.g. issuers, verifiers and keyshare servers), which is taken into account
+// when checking validity periods. Defaults to DefaultClockSkewTolerance.
+func (conf *Configuration) ClockSkewTolerance() time.Duration {
+	if conf == nil || conf.clockSkewTolerance == nil {
+		return DefaultClockSkewTolerance
+	}
+	return *conf.clockSkewTolerance
+}
+
+// SetClockSkewTolerance sets the tolerance returned by ClockSkewTolerance(). It should be called
+// before the configuration is used, as it is not synchronized with reads of the tolerance.
+func (conf *Configuration) SetClockSkewTolerance(tolerance time.Duration) error {
+	if tolerance < 0 || tolerance > MaxClockSkewTolerance {
+		return errors.Errorf("clock skew tolerance must be between 0 and %s", MaxClockSkewTolerance)
+	}
+	conf.clockSkewTolerance = &tolerance
+	return nil
 }
 
 // ProofList is a gabi.ProofList with some extra methods.
@@ -74,7 +111,7 @@ func (pl ProofList) ExtractPublicKeys(configuration *Configuration) ([]*gabikeys
 }
 
 // Expired returns true if any of the contained disclosure proofs is specified at the specified time,
-// or now, when the specified time is nil.
+// or now, when the specified time is nil, taking the ClockSkewTolerance() into account.
 func (pl ProofList) Expired(configuration *Configuration, t *time.Time) (bool, error) {
 	if t == nil {
 		temp := time.Now()
@@ -86,7 +123,7 @@ func (pl ProofList) Expired(configuration *Configuration, t *time.Time) (bool, e
 			continue
 		}
 		metadata := MetadataFromInt(proofd.ADisclosed[1], configuration) // index 1 is metadata attribute
-		if metadata.Expiry().Before(*t) {
+		if metadata.Expiry().Before(t.Add(-configuration.ClockSkewTolerance())) {
 			return true, nil
 		}
 		pk, err := metadata.PublicKey()
@@ -289,10 +326,24 @@ func (d *Disclosure) extraIndices(condiscon AttributeConDisCon) []*DisclosedAttr
 // the disjunction list. The first return parameter of this function indicates whether or not all
 // disjunctions (if present) are satisfied.
 func (d *Disclosure) DisclosedAttributes(configuration *Configuration, condiscon AttributeConDisCon, revtimes map[int]*time.Time) (bool, [][]*DisclosedAttribute, error) {
+	return d.disclosedAttributes(configuration, condiscon, nil, revtimes)
+}
+
+// RequestedAttributes is DisclosedAttributes for the disjunctions of the request (if not nil),
+// returning all disclosed credential instances for the disjunctions of which it asks all instances.
+func (d *Disclosure) RequestedAttributes(configuration *Configuration, request *DisclosureRequest, revtimes map[int]*time.Time) (bool, [][]*DisclosedAttribute, error) {
+	var condiscon AttributeConDisCon
+	if request != nil {
+		condiscon = request.Disclose
+	}
+	return d.disclosedAttributes(configuration, condiscon, request, revtimes)
+}
+
+func (d *Disclosure) disclosedAttributes(configuration *Configuration, condiscon AttributeConDisCon, request *DisclosureRequest, revtimes map[int]*time.Time) (bool, [][]*DisclosedAttribute, error) {
 	if revtimes == nil {
 		revtimes = map[int]*time.Time{}
 	}
-	complete, list, err := condiscon.Satisfy(d, revtimes, configuration)
+	complete, list, err := condiscon.satisfy(d, revtimes, configuration, request)
 	if err != nil {
 		return false, nil, err
 	}
@@ -322,9 +373,13 @@ func parseAttribute(index int, metadata *MetadataAttribute, attr *big.Int) (*Dis
 		return nil, nil, errors.New("ProofList contained a disclosure proof of an unknown credential type")
 	}
 	if index == 1 {
-		attrid = NewAttributeTypeIdentifier(credtype.Identifier().String())
-		p := "present"
-		attrval = &p
+		// Only the metadata attribute is disclosed, proving possession of the credential
+		return &DisclosedAttribute{
+			Identifier:     NewAttributeTypeIdentifier(credtype.Identifier().String()),
+			Status:         AttributeProofStatusPresent,
+			IssuanceTime:   Timestamp(metadata.SigningDate()),
+			TestCredential: metadata.IsTestCredential(),
+		}, nil, nil
 	} else {
 		attrid = credtype.AttributeTypes[index-2].GetAttributeTypeIdentifier()
 		if credtype.AttributeTypes[index-2].RandomBlind {
@@ -338,14 +393,26 @@ func parseAttribute(index int, metadata *MetadataAttribute, attr *big.Int) (*Dis
 		status = AttributeProofStatusNull
 	}
 	return &DisclosedAttribute{
-		Identifier:   attrid,
-		RawValue:     attrval,
-		Value:        NewTranslatedString(attrval),
-		Status:       status,
-		IssuanceTime: Timestamp(metadata.SigningDate()),
+		Identifier:     attrid,
+		RawValue:       attrval,
+		Value:          NewTranslatedString(attrval),
+		Status:         status,
+		IssuanceTime:   Timestamp(metadata.SigningDate()),
+		TestCredential: metadata.IsTestCredential(),
 	}, attrval, nil
 }
 
+// instanceHash returns a hash of the metadata attribute and of the specified attributes disclosed
+// in the proof, identifying the credential instance out of which they were disclosed.
+func instanceHash(proofd *gabi.ProofD, indices []*DisclosedAttributeIndex) string {
+	h := sha256.New()
+	h.Write([]byte(proofd.ADisclosed[1].String()))
+	for _, index := range indices {
+		h.Write([]byte("," + proofd.ADisclosed[index.AttributeIndex].String()))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 func (d *Disclosure) VerifyAgainstRequest(
 	configuration *Configuration,
 	request SessionRequest,
@@ -361,11 +428,11 @@ func (d *Disclosure) VerifyAgainstRequest(
 	}
 
 	// Next extract the contained attributes from the proofs, and match them to the signature request if present
-	var required AttributeConDisCon
+	var required *DisclosureRequest
 	if request != nil {
-		required = request.Disclosure().Disclose
+		required = request.Disclosure()
 	}
-	allmatched, list, err := d.DisclosedAttributes(configuration, required, revtimes)
+	allmatched, list, err := d.RequestedAttributes(configuration, required, revtimes)
 	if err != nil {
 		return nil, ProofStatusInvalid, err
 	}
@@ -400,23 +467,54 @@ func (d *Disclosure) Verify(configuration *Configuration, request *DisclosureReq
 //
 // The signature request is optional; if it is nil then the attribute-based signature is still verified, and all
 // containing attributes returned in the result.
+//
+// If the signature request is in standalone mode (see SignatureModeStandalone), then the signature must have been
+// created in standalone mode, and its nonce need not match that of the request; otherwise the signature must have
+// been created in the session of the request.
 func (sm *SignedMessage) Verify(configuration *Configuration, request *SignatureRequest) ([][]*DisclosedAttribute, ProofStatus, error) {
 	var message string
 
 	if len(sm.Signature) == 0 {
 		return nil, ProofStatusInvalid, nil
 	}
+	switch sm.Mode {
+	case "", SignatureModeSession:
+	case SignatureModeStandalone:
+		// Standalone signatures must contain the nonce generated by the client
+		if sm.Nonce == nil || sm.Nonce.Sign() == 0 {
+			return nil, ProofStatusInvalid, nil
+		}
+	default:
+		return nil, ProofStatusInvalid, nil
+	}
+	// A signature is over either a message or a message hash
+	if sm.MessageHash != nil && sm.Message != "" {
+		return nil, ProofStatusInvalid, nil
+	}
+	nonce, err := sm.nonce()
+	if err != nil {
+		return nil, ProofStatusInvalid, nil
+	}
 
 	// First check if this signature matches the request
 	if request != nil {
 		if !sm.MatchesNonceAndContext(request) {
 			return nil, ProofStatusUnmatchedRequest, nil
 		}
-		// If there is a request, then the signed message must be that of the request
-		message = request.Message
+		// If there is a request, then the signed message must be that of the request.
+		// If the signature is over a message hash, then MatchesNonceAndContext has checked
+		// that it is the hash of the message of the request.
+		if sm.MessageHash != nil {
+			message, err = sm.TimestampMessage()
+		} else {
+			message, err = request.TimestampMessage()
+		}
 	} else {
 		// If not, we just verify that the signed message is a valid signature over its contained message
-		message = sm.Message
+		message, err = sm.TimestampMessage()
+	}
+	if err != nil {
+		return nil, ProofStatusInvalid, nil
 	}
 
 	// Next, verify the timestamp so we can safely use its time
@@ -434,7 +532,7 @@ func (sm *SignedMessage) Verify(configuration *Configuration, request *Signature
 	if request != nil {
 		r = request
 	}
-	return sm.Disclosure().VerifyAgainstRequest(configuration, r, sm.Context, sm.GetNonce(), nil, &t, true)
+	return sm.Disclosure().VerifyAgainstRequest(configuration, r, sm.Context, nonce, nil, &t, true)
 }
 
 // ExpiredError indicates that something (e.g. a JWT) has expired.